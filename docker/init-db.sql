@@ -93,8 +93,8 @@ ON CONFLICT (id) DO NOTHING;
 
 -- Insert default security rules
 INSERT INTO rules (id, name, rule_type, description, priority, enabled, conditions, actions, tags) VALUES
-    ('block-suspicious-agents', 'Block Suspicious User Agents', 'blacklist', 'Block requests from suspicious user agents', 200, TRUE,
-     '[{"field": "user_agent", "operator": "contains", "value": "bot"}]',
+    ('block-suspicious-agents', 'Block Suspicious User Agents', 'blacklist', 'Block automation, unknown bots and clients posing as known crawlers', 200, TRUE,
+     '[{"field": "ua_class", "operator": "in", "value": ["automation", "bot", "spoofed_crawler"]}]',
      '[{"type": "deny", "parameters": {"reason": "suspicious user agent"}}]',
      ARRAY['security', 'user-agent']),
     
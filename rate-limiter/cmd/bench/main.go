@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// benchmarkLine matches a result line of go test -bench, capturing the
+// benchmark name without its Benchmark prefix and GOMAXPROCS suffix, and
+// its ns/op
+var benchmarkLine = regexp.MustCompile(`^Benchmark(\S+?)(?:-\d+)?\s+\d+\s+([0-9.]+) ns/op`)
+
+// bench checks the results of go test -bench, read from the files named as
+// arguments or from standard input, against a performance budget, and exits
+// non-zero when the mean ns/op of a benchmark exceeds its budget:
+//
+//	go test -run '^$' -bench . -count 5 ./internal/api | go run ./cmd/bench -budget cmd/bench/budget.json
+func main() {
+	budgetPath := flag.String("budget", "cmd/bench/budget.json", "JSON file of maximum ns/op by benchmark name")
+	flag.Parse()
+
+	data, err := os.ReadFile(*budgetPath)
+	if err != nil {
+		log.Fatalf("Error reading budget: %v", err)
+	}
+	var budget map[string]float64
+	if err := json.Unmarshal(data, &budget); err != nil {
+		log.Fatalf("Error parsing budget: %v", err)
+	}
+
+	var inputs []io.Reader
+	for _, path := range flag.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Error reading results: %v", err)
+		}
+		defer file.Close()
+		inputs = append(inputs, file)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+
+	nsPerOp, err := meanNsPerOp(io.MultiReader(inputs...))
+	if err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+	if len(nsPerOp) == 0 {
+		log.Fatal("No benchmark results")
+	}
+
+	exceeded := overBudget(nsPerOp, budget)
+	for _, line := range exceeded {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	if len(exceeded) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%d benchmarks within budget\n", len(nsPerOp))
+}
+
+// meanNsPerOp returns the mean ns/op of each benchmark over its runs
+func meanNsPerOp(r io.Reader) (map[string]float64, error) {
+	totals := make(map[string]float64)
+	runs := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := benchmarkLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		ns, err := strconv.ParseFloat(match[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ns/op %q of %s: %w", match[2], match[1], err)
+		}
+		totals[match[1]] += ns
+		runs[match[1]]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, total := range totals {
+		totals[name] = total / float64(runs[name])
+	}
+	return totals, nil
+}
+
+// overBudget describes the benchmarks whose mean ns/op exceeds their budget
+func overBudget(nsPerOp, budget map[string]float64) []string {
+	var exceeded []string
+	for name, limit := range budget {
+		if ns, ok := nsPerOp[name]; ok && ns > limit {
+			exceeded = append(exceeded, fmt.Sprintf("%s: %.0f ns/op over budget of %.0f ns/op", name, ns, limit))
+		}
+	}
+	sort.Strings(exceeded)
+	return exceeded
+}
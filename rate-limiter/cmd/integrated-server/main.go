@@ -2,69 +2,457 @@ package main
 
 import (
 	"context"
+	"flag"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
 	rateLimiterAPI "github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/challenge"
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/configcheck"
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/console"
+	"github.com/NickChunglolz/rate-limiter/internal/featureflags"
 	rateLimiterHandlers "github.com/NickChunglolz/rate-limiter/internal/handlers"
 	rateLimiterInfra "github.com/NickChunglolz/rate-limiter/internal/infrastructure"
 	"github.com/NickChunglolz/rate-limiter/internal/integration"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/locks"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
+	"github.com/NickChunglolz/rate-limiter/internal/rulesync"
+	"github.com/NickChunglolz/rate-limiter/internal/threatfeed"
 	ruleEngine "github.com/NickChunglolz/rule-engine/engine"
 	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
 	ruleInfra "github.com/NickChunglolz/rule-engine/infrastructure"
 )
 
 func main() {
+	validate := flag.Bool("validate-config", false, "Check the configuration, the storage it names and rules files, print a report and exit non-zero on problems")
+	rulesFiles := flag.String("rules", "", "Comma-separated JSON files of security rules to check with -validate-config")
+	flag.Parse()
+	if *validate {
+		validateConfig(":8081", *rulesFiles, configcheck.CheckSecurityRules)
+	}
+	
+	// Load configuration
+	cfg, err := config.LoadServerConfig(":8081")
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
+	accessLogConfig, err := config.LoadAccessLogConfig()
+	if err != nil {
+		log.Fatalf("Invalid access log configuration: %v", err)
+	}
+	counterConfig, err := config.LoadCounterConfig()
+	if err != nil {
+		log.Fatalf("Invalid counter configuration: %v", err)
+	}
+	forwardAuthConfig, err := config.LoadForwardAuthConfig()
+	if err != nil {
+		log.Fatalf("Invalid forward auth configuration: %v", err)
+	}
+	throttleConfig, err := config.LoadThrottleConfig()
+	if err != nil {
+		log.Fatalf("Invalid throttle configuration: %v", err)
+	}
+	alertConfig, err := config.LoadAlertConfig()
+	if err != nil {
+		log.Fatalf("Invalid alert configuration: %v", err)
+	}
+	outboxConfig, err := config.LoadOutboxConfig()
+	if err != nil {
+		log.Fatalf("Invalid outbox configuration: %v", err)
+	}
+	writeBatchConfig, err := config.LoadWriteBatchConfig()
+	if err != nil {
+		log.Fatalf("Invalid write batching configuration: %v", err)
+	}
+	projectionConfig, err := config.LoadProjectionConfig()
+	if err != nil {
+		log.Fatalf("Invalid projection configuration: %v", err)
+	}
+	readReplicaConfig, err := config.LoadReadReplicaConfig()
+	if err != nil {
+		log.Fatalf("Invalid read replica configuration: %v", err)
+	}
+	eventBusConfig, err := config.LoadEventBusConfig()
+	if err != nil {
+		log.Fatalf("Invalid event bus configuration: %v", err)
+	}
+	keyLimitConfig, err := config.LoadKeyLimitConfig()
+	if err != nil {
+		log.Fatalf("Invalid key limit configuration: %v", err)
+	}
+	refundConfig, err := config.LoadRefundConfig()
+	if err != nil {
+		log.Fatalf("Invalid refund configuration: %v", err)
+	}
+	blockedCacheConfig, err := config.LoadBlockedCacheConfig()
+	if err != nil {
+		log.Fatalf("Invalid blocked cache configuration: %v", err)
+	}
+	aggregateCacheConfig, err := config.LoadAggregateCacheConfig()
+	if err != nil {
+		log.Fatalf("Invalid aggregate cache configuration: %v", err)
+	}
+	grantConfig, err := config.LoadGrantConfig()
+	if err != nil {
+		log.Fatalf("Invalid budget grant configuration: %v", err)
+	}
+	leaseConfig, err := config.LoadLeaseConfig()
+	if err != nil {
+		log.Fatalf("Invalid lease configuration: %v", err)
+	}
+	deniedResponseConfig, err := config.LoadDeniedResponseConfig()
+	if err != nil {
+		log.Fatalf("Invalid denied response configuration: %v", err)
+	}
+	grpcConfig, err := config.LoadGRPCConfig()
+	if err != nil {
+		log.Fatalf("Invalid gRPC configuration: %v", err)
+	}
+	lockConfig, err := config.LoadLockConfig()
+	if err != nil {
+		log.Fatalf("Invalid lock configuration: %v", err)
+	}
+	enrichmentConfig, err := config.LoadEnrichmentConfig()
+	if err != nil {
+		log.Fatalf("Invalid enrichment configuration: %v", err)
+	}
+	ruleCacheConfig, err := config.LoadRuleCacheConfig()
+	if err != nil {
+		log.Fatalf("Invalid rule cache configuration: %v", err)
+	}
+	threatFeedConfig, err := config.LoadThreatFeedConfig()
+	if err != nil {
+		log.Fatalf("Invalid threat feed configuration: %v", err)
+	}
+	challengeConfig, err := config.LoadChallengeConfig()
+	if err != nil {
+		log.Fatalf("Invalid challenge configuration: %v", err)
+	}
+	privacyConfig, err := config.LoadPrivacyConfig()
+	if err != nil {
+		log.Fatalf("Invalid privacy configuration: %v", err)
+	}
+	remoteWriteConfig, err := config.LoadRemoteWriteConfig()
+	if err != nil {
+		log.Fatalf("Invalid remote write configuration: %v", err)
+	}
+	rolloutConfig, err := config.LoadRolloutConfig()
+	if err != nil {
+		log.Fatalf("Invalid rollout configuration: %v", err)
+	}
+	warmStartConfig, err := config.LoadWarmStartConfig()
+	if err != nil {
+		log.Fatalf("Invalid warm start configuration: %v", err)
+	}
+	storageFailureConfig, err := config.LoadStorageFailureConfig()
+	if err != nil {
+		log.Fatalf("Invalid storage failure configuration: %v", err)
+	}
+	decisionConfig, err := config.LoadDecisionConfig()
+	if err != nil {
+		log.Fatalf("Invalid decision configuration: %v", err)
+	}
+	featureFlagConfig, err := config.LoadFeatureFlagConfig()
+	if err != nil {
+		log.Fatalf("Invalid feature flag configuration: %v", err)
+	}
+	ruleApprovalConfig, err := config.LoadRuleApprovalConfig()
+	if err != nil {
+		log.Fatalf("Invalid rule approval configuration: %v", err)
+	}
+
 	// Initialize Rate Limiter components
-	eventStore := rateLimiterInfra.NewInMemoryEventStore()
+	eventStore := rateLimiterInfra.NewInMemoryEventStore().WithMaxKeys(keyLimitConfig.MaxKeys)
 	rateLimitRuleRepository := rateLimiterInfra.NewInMemoryRuleRepository()
-	readModel := rateLimiterInfra.NewInMemoryReadModel()
-	eventBus := rateLimiterInfra.NewEventBus()
+	overrideRepository := rateLimiterInfra.NewInMemoryOverrideRepository()
+	freezeRepository := rateLimiterInfra.NewInMemoryFreezeRepository()
+	rolloutRepository := rateLimiterInfra.NewInMemoryRolloutRepository()
+	leaseRepository := rateLimiterInfra.NewInMemoryLeaseRepository()
+	clientRepository := rateLimiterInfra.NewInMemoryClientRepository()
+	statsRetention := rateLimiterInfra.StatsRetention{
+		Minutes: projectionConfig.StatsRetention,
+		Hours:   projectionConfig.HourlyStatsRetention,
+		Days:    projectionConfig.DailyStatsRetention,
+	}
+	readModel := rateLimiterInfra.NewCachedReadModel(rateLimiterInfra.NewInMemoryReadModel().WithStatsRetention(statsRetention).WithUnknownEventPolicy(rateLimiterInfra.UnknownEventPolicy(projectionConfig.UnknownEvents)), projectionConfig.CacheTTL)
+	eventBus := rateLimiterInfra.NewEventBus().WithSubscriberOptions(rateLimiterInfra.SubscriberOptions{
+		BufferSize: eventBusConfig.BufferSize,
+		Policy:     rateLimiterInfra.BackpressurePolicy(eventBusConfig.Policy),
+		Timeout:    eventBusConfig.BlockTimeout,
+	})
+
+	// Decisions save their events in batches, one round trip each, when
+	// write batching is on
+	var decisionEvents rateLimiterHandlers.EventStore = eventStore
+	var writeBatcher *rateLimiterInfra.WriteBatcher
+	if writeBatchConfig.Enabled {
+		writeBatcher = rateLimiterInfra.NewWriteBatcher(eventStore, writeBatchConfig.FlushInterval, writeBatchConfig.MaxBatch)
+		decisionEvents = writeBatcher
+		fmt.Printf("Batching event saves: up to %d per batch, each saved within %s\n", writeBatchConfig.MaxBatch, writeBatchConfig.FlushInterval)
+	}
+	commandHandler := rateLimiterHandlers.NewRateLimitCommandHandler(decisionEvents, rateLimitRuleRepository).
+		WithOverrideRepository(overrideRepository).
+		WithFreezeRepository(freezeRepository).
+		WithRolloutRepository(rolloutRepository).
+		WithLeaseRepository(leaseRepository).
+		WithClientRepository(clientRepository).
+		WithMaxRefunds(refundConfig.MaxPerWindow)
+	if outboxConfig.Enabled {
+		// Stored events reach the bus through the outbox relay instead
+		eventStore.WithOutbox()
+		relay := rateLimiterInfra.NewOutboxRelay(eventStore, eventBus, outboxConfig.RelayInterval, outboxConfig.BatchSize)
+		go relay.Run(context.Background())
+	} else {
+		commandHandler.WithEventPublisher(eventBus)
+	}
+	if counterStore := setupCounterStore(counterConfig); counterStore != nil {
+		commandHandler.WithCounterStore(counterStore)
+	}
+	var aggregateCache *rateLimiterInfra.AggregateCache
+	if aggregateCacheConfig.Size > 0 {
+		// Decide recently decided keys without loading their events
+		aggregateCache = rateLimiterInfra.NewAggregateCache(aggregateCacheConfig.Size)
+		commandHandler.WithAggregateCache(aggregateCache)
+	}
+	pseudonymizer := setupPrivacy(privacyConfig)
+	// History, stats and activity queries are answered by read replicas
+	// within their staleness bounds when there are any
+	var queryReadModel rateLimiterHandlers.ReadModel = readModel
+	readReplicas := setupReadReplicas(readReplicaConfig, projectionConfig, statsRetention, eventStore, readModel)
+	if readReplicas != nil {
+		queryReadModel = readReplicas
+	}
+	queryHandler := rateLimiterHandlers.NewRateLimitQueryHandler(queryReadModel, rateLimitRuleRepository).
+		WithOverrideRepository(overrideRepository).
+		WithFreezeRepository(freezeRepository).
+		WithRolloutRepository(rolloutRepository).
+		WithLeaseRepository(leaseRepository).
+		WithClientRepository(clientRepository).
+		WithEventStore(eventStore).
+		WithPseudonymizer(pseudonymizer)
+	if flags := setupFeatureFlags(featureFlagConfig); flags != nil {
+		commandHandler.WithFlagEvaluator(flags)
+		queryHandler.WithFlagEvaluator(flags)
+	}
 
-	commandHandler := rateLimiterHandlers.NewRateLimitCommandHandler(eventStore, rateLimitRuleRepository)
-	queryHandler := rateLimiterHandlers.NewRateLimitQueryHandler(readModel, rateLimitRuleRepository)
-	rateLimiterService := rateLimiterAPI.NewRateLimiterService(commandHandler, queryHandler)
+	// Count decisions by resource, tenant and algorithm for the metrics
+	decisionMetrics := rateLimiterInfra.NewDecisionMetrics(rateLimitRuleRepository, clientRepository)
+	rateLimiterService := rateLimiterAPI.NewRateLimiterService(commandHandler, queryHandler).WithDecisionRecorder(decisionMetrics).WithPseudonymizer(pseudonymizer).
+		WithBudgetGrants(grantConfig.MaxRequests, grantConfig.TTL).
+		WithLeases(leaseConfig.MaxTokens, leaseConfig.MaxTTL).
+		WithFailurePolicy(setupFailurePolicy(storageFailureConfig)).
+		WithRuleIndex(rateLimitRuleRepository).
+		WithDecisionDeadline(decisionConfig.Deadline).
+		WithRuleSimulation(eventStore)
+	var blockedCache *rateLimiterInfra.BlockedCache
+	if blockedCacheConfig.Size > 0 {
+		// Deny blocked clients from cache until their blocks end or a reset
+		// or refund published on the event bus lifts them
+		blockedCache = rateLimiterInfra.NewBlockedCache(blockedCacheConfig.Size)
+		rateLimiterService.WithBlockedCache(blockedCache)
+		go blockedCache.Watch(context.Background(), eventBus.Subscribe("*"))
+	}
 
 	// Initialize Rule Engine components
 	ruleRepository := ruleInfra.NewInMemoryRuleRepository()
 	eventPublisher := ruleInfra.NewSimpleEventPublisher()
-	ruleEngineService := ruleEngine.NewRuleEngine(ruleRepository, eventPublisher)
+	notifier := rateLimiterInfra.NewWebhookNotifier(os.Stdout, alertConfig.WebhookURL, alertConfig.DedupeWindow)
+	go notifier.Run(context.Background())
+	go notifier.NotifyThresholds(context.Background(), eventBus.Subscribe("RateLimitThresholdReached"))
+	ruleEngineService := ruleEngine.NewRuleEngine(ruleRepository, eventPublisher).
+		WithStatsCollector(ruleInfra.NewInMemoryRuleStatsStore()).
+		WithActionDispatcher(notifier).
+		WithEnrichment(setupEnrichment(enrichmentConfig)).
+		WithPrincipal(principal.FromContext)
+	if ruleCacheConfig.TTL > 0 {
+		ruleEngineService.WithResultCache(ruleEngine.NewResultCache(ruleCacheConfig.TTL, ruleCacheConfig.MaxEntries))
+	}
 
 	// Initialize Integrated Service
-	integratedService := integration.NewIntegratedRateLimiterService(rateLimiterService, ruleEngineService)
+	integratedService := integration.NewIntegratedRateLimiterService(rateLimiterService, ruleEngineService).
+		WithMaxThrottleDelay(throttleConfig.MaxDelay).
+		WithChallenges(setupChallenges(challengeConfig)).
+		WithEventPublisher(eventBus)
+	if ruleApprovalConfig.Enabled {
+		// Hold high-impact rule changes until another principal approves them
+		integratedService.WithRuleApprovals(integration.ApprovalPolicy{PriorityThreshold: ruleApprovalConfig.PriorityThreshold})
+	}
 
-	// Setup event projection
-	go setupEventProjection(eventBus, readModel)
+	// Project stored events to the read model, waking on each published event
+	projection := rateLimiterInfra.NewReadModelProjection(eventStore, readModel, projectionConfig.PollInterval).
+		WithCatchUp(projectionConfig.CatchUpThreshold, projectionConfig.CatchUpBatchSize).
+		WithNotifications(eventBus.Subscribe("*"))
+	go projection.Run(context.Background())
 
 	// Setup default rules and rate limits
 	setupDefaultConfiguration(rateLimiterService, ruleEngineService)
-
+	
+	// Import threat feeds into blacklist and whitelist rules on a schedule
+	threatFeeds := setupThreatFeeds(threatFeedConfig, ruleEngineService)
+	go threatFeeds.Run(context.Background())
+	
+	// Keep the ban list in rules of its own, publishing its changes on the
+	// event bus, holding additions needing approval and removing entries as
+	// they expire
+	banList := threatfeed.NewBanList(ruleEngineService).WithEventPublisher(eventBus).WithApprovals(integratedService)
+	go banList.Run(context.Background(), threatFeedConfig.BanListSweepInterval)
+	
+	// Load hot state into memory before reporting ready
+	warmStart := setupWarmStart(warmStartConfig, eventStore, ruleEngineService)
+	go warmStart.Run(context.Background())
+	
+	// Push decision counters to a Prometheus remote-write endpoint when configured
+	if remoteWriteConfig.URL != "" {
+		go setupRemoteWrite(remoteWriteConfig, decisionMetrics).Run(context.Background())
+	}
+	
+	// Advance, promote or roll back rule rollouts by their cohorts' deny rates
+	go rateLimiterInfra.NewRolloutEvaluator(rateLimiterService, rolloutConfig.EvaluationInterval).Run(context.Background())
+	go rateLimiterInfra.NewLeaseExpirer(rateLimiterService, leaseConfig.ExpiryInterval).Run(context.Background())
+	go rateLimiterInfra.NewStatsRollup(readModel.InMemoryReadModel, projectionConfig.StatsRollupInterval).Run(context.Background())
+	
 	// Setup HTTP server with integrated endpoints
-	mux := setupIntegratedRoutes(integratedService)
-	handler := loggingMiddleware(corsMiddleware(mux))
+	mux := setupIntegratedRoutes(integratedService, rateLimiterService, forwardAuthConfig, throttleConfig, setupDeniedTemplates(deniedResponseConfig))
+	healthHandler := rateLimiterAPI.NewHealthHTTPHandler(projection, projectionConfig.MaxReadyLag.Seconds()).WithEventBus(eventBus).WithKeyStore(eventStore).WithDecisions(decisionMetrics).WithUnknownEvents(readModel).WithWarmStart(warmStart).WithDegraded(rateLimiterService)
+	if len(threatFeedConfig.Feeds) > 0 {
+		healthHandler.WithThreatFeeds(threatFeeds)
+	}
+	if blockedCache != nil {
+		healthHandler.WithBlockedCache(blockedCache)
+	}
+	if aggregateCache != nil {
+		healthHandler.WithAggregateCache(aggregateCache)
+	}
+	if writeBatcher != nil {
+		healthHandler.WithWriteBatcher(writeBatcher)
+	}
+	if readReplicas != nil {
+		healthHandler.WithReadReplicas(readReplicas)
+	}
+	healthHandler.RegisterRoutes(mux)
+	rateLimiterAPI.NewThreatFeedHTTPHandler(threatFeeds).RegisterRoutes(mux)
+	rateLimiterAPI.NewBanListHTTPHandler(banList).RegisterRoutes(mux)
+		rateLimiterAPI.NewEventBusHTTPHandler(eventBus, eventStore).RegisterRoutes(mux)
+	rateLimiterAPI.NewEventDumpHTTPHandler(eventStore, eventStore).WithEventPublisher(eventBus).RegisterRoutes(mux)
+	rateLimiterAPI.NewClientHTTPHandler(rateLimiterService).RegisterRoutes(mux)
+	graphQLHandler, err := rateLimiterAPI.NewGraphQLHTTPHandler(rateLimiterService)
+	if err != nil {
+		log.Fatalf("Error creating GraphQL schema: %v", err)
+	}
+	graphQLHandler.RegisterRoutes(mux)
+	rateLimiterAPI.NewEventStreamHTTPHandler(eventBus).RegisterRoutes(mux)
+	console.RegisterRoutes(mux)
+	
+	// Elect the instance that runs leader-only background workers, failing
+	// over to another when it stops renewing its lock
+	elector := locks.NewElector(setupLockProvider(lockConfig), "integrated-server", lockConfig.Identity, lockConfig.TTL)
+	go elector.Run(context.Background())
+	rateLimiterAPI.NewClusterHTTPHandler(lockConfig.Backend, elector).RegisterRoutes(mux)
+	if pseudonymizer.Enabled() && privacyConfig.LookupToken != "" {
+		rateLimiterAPI.NewPrivacyHTTPHandler(pseudonymizer, privacyConfig.LookupToken).RegisterRoutes(mux)
+	}
+	accessLogger := accesslog.NewLogger(accesslog.NewJSONSink(os.Stdout), accessLogConfig.SampleRate).WithPseudonymizer(pseudonymizer)
+	handler := accesslog.Middleware(accessLogger, corsMiddleware(mux))
+
+	server, err := rateLimiterAPI.NewServer(cfg, handler)
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
 
 	// Start server
-	addr := ":8081"
-	fmt.Printf("Integrated Rate Limiter with Rule Engine server starting on %s\n", addr)
+	fmt.Printf("Integrated Rate Limiter with Rule Engine server starting on %s\n", cfg.Addr)
 	fmt.Println("Available endpoints:")
 	fmt.Println("  GET  /health         - Health check")
+	fmt.Println("  GET  /readyz         - Read model readiness")
+	fmt.Println("  GET  /metrics        - Projection lag metrics")
+	fmt.Println("  GET  /api/v1/eventbus/subscribers - Event bus subscribers and queue depths")
+	fmt.Println("  POST /api/v1/eventbus/subscribers/{id}/{pause,resume,replay} - Control event delivery to a subscriber")
+	fmt.Println("  GET  /api/v1/admin/events/dump - Stored events of an aggregate or time range as an event dump")
+	fmt.Println("  POST /api/v1/admin/events/import - Append the events of a dump to the event store")
 	fmt.Println("  POST /api/v1/check   - Integrated request check")
+	fmt.Println("  GET  /api/v1/forward-auth - Reverse proxy forward auth check")
+	fmt.Println("  POST /api/v1/challenges/verify - Verify a challenge solution, exempting the client from challenges")
+	fmt.Println("  GET|POST /api/v1/rules - List or create security rules")
+	fmt.Println("  PUT  /api/v1/rules   - Create or replace a security rule")
+	fmt.Println("  DELETE /api/v1/rules?id= - Delete a security rule")
+	fmt.Println("  GET|PUT|DELETE /api/v1/rules/{id} - Get, replace or delete a security rule")
+	fmt.Println("  POST /api/v1/rules/{id}/{enable,disable} - Enable or disable a security rule")
+	fmt.Println("  POST /api/v1/rules/bulk - Enable, disable or delete security rules by tag")
+	fmt.Println("  GET  /api/v1/rules/stats - Hit statistics for all security rules")
+	fmt.Println("  GET  /api/v1/rules/{id}/stats - Hit statistics for a security rule")
+	fmt.Println("  GET  /api/v1/rule-changes - Security rule changes awaiting or past approval")
+	fmt.Println("  POST /api/v1/rule-changes/{id}/{approve,reject} - Approve or reject a pending security rule change")
+	fmt.Println("  GET|POST|PUT /api/v1/ratelimit/rules - List, create or apply rate limit rules")
+	fmt.Println("  POST /api/v1/ratelimit/rules/simulate - Replay recorded traffic through a proposed rate limit rule")
+	fmt.Println("  GET|POST|DELETE /api/v1/ratelimit/overrides - Temporary per-client rate limit overrides")
+	fmt.Println("  GET|POST|DELETE /api/v1/ratelimit/freezes - Scheduled deny-all or allow-all freezes")
+	fmt.Println("  GET|POST /api/v1/ratelimit/rollouts - Staged rollouts of rate limit rule changes")
+	fmt.Println("  POST /api/v1/ratelimit/rollouts/{promote,rollback}?id= - Promote or roll back a rollout")
+	fmt.Println("  GET|POST /api/v1/ratelimit/leases - Lease clients tokens of their quota to admit requests locally")
+	fmt.Println("  POST /api/v1/ratelimit/leases/renew - Report the tokens of a lease used and renew or release it")
+	fmt.Println("  GET  /api/v1/ratelimit/explain - Why a client's requests to a resource are allowed or blocked")
+	fmt.Println("  POST /api/v1/ratelimit/peek - Whether a rate limit check would be allowed, without consuming quota")
+	fmt.Println("  POST /api/v1/ratelimit/check-all - Check several resources at once, consuming quota of all or none")
+	fmt.Println("  POST /api/v1/ratelimit/refund - Give back the quota of a request whose operation failed")
+	fmt.Println("  GET|POST /graphql - Read-only GraphQL API over clients, statuses, history and rules")
+	fmt.Println("  GET  /api/v1/events/stream - Published events as server-sent events")
+	fmt.Println("  GET  /console        - Admin web console")
+	fmt.Println("  GET  /api/v1/admin/cluster - Lock backend and this instance's leadership of background workers")
+	if pseudonymizer.Enabled() && privacyConfig.LookupToken != "" {
+		fmt.Println("  POST /api/v1/admin/privacy/lookup - Pseudonyms of client IDs, IP addresses and user agents (privacy mode)")
+	}
+	fmt.Println("  GET|POST /api/v1/clients - List or register clients")
+	fmt.Println("  GET|PUT|DELETE /api/v1/clients/{id} - Manage a registered client")
+	fmt.Println("  POST /api/v1/clients/{id}/{disable,enable} - Disable or re-enable a client")
+	fmt.Println("  DELETE /api/v1/clients/{id}/data - Erase a client's events, history, stats and overrides")
+	fmt.Println("  GET  /api/v1/erasures/{id} - Get an erasure job")
 	fmt.Println("  POST /api/v1/security/block-ips - Block IP addresses")
+	fmt.Println("  GET  /api/v1/threat-feeds - Imported threat feeds with their entries, changes and matches")
+	fmt.Println("  GET  /api/v1/threat-feeds/lookup?ip= - Threat feeds listing an address, with provenance")
+	fmt.Println("  POST /api/v1/threat-feeds/{name}/import - Import a threat feed now")
+	fmt.Println("  GET|POST|DELETE /api/v1/ban-list - List, add or remove (?network=) ban list entries")
+	fmt.Println("  GET  /api/v1/ban-list/expiring?within= - Ban list entries expiring soon")
+	fmt.Println("  GET  /api/v1/ban-list/export, POST /api/v1/ban-list/import - Export or import the ban list as JSON or CSV")
 	fmt.Println("  POST /api/v1/security/rate-limit-resources - Rate limit resources")
 
-	log.Fatal(http.ListenAndServe(addr, handler))
+	// Serve gRPC health checking and reflection when configured
+	if grpcConfig.Addr != "" {
+		grpcServer := rateLimiterAPI.NewGRPCServer(grpcConfig, projection, projectionConfig.MaxReadyLag.Seconds()).WithWarmStart(warmStart)
+		go grpcServer.WatchReadiness(context.Background(), time.Second)
+		go func() {
+			log.Fatal(grpcServer.ListenAndServe())
+		}()
+		fmt.Printf("gRPC server starting on %s (grpc.health.v1, reflection)\n", grpcConfig.Addr)
+	}
+
+	log.Fatal(server.ListenAndServe())
 }
 
-func setupEventProjection(eventBus *rateLimiterInfra.EventBus, readModel *rateLimiterInfra.InMemoryReadModel) {
-	events := eventBus.Subscribe("*")
-	for event := range events {
-		ctx := context.Background()
-		if err := readModel.UpdateFromEvent(ctx, event); err != nil {
-			log.Printf("Error updating read model from event: %v", err)
+func setupCounterStore(counterConfig config.CounterConfig) rateLimiterHandlers.CounterStore {
+	switch counterConfig.Backend {
+	case "memory":
+		return rateLimiterInfra.NewInMemoryCounterStore()
+	case "memcached":
+		counterStore, err := rateLimiterInfra.NewMemcachedCounterStore(counterConfig.MemcachedServers)
+		if err != nil {
+			log.Fatalf("Error creating memcached counter store: %v", err)
 		}
+		return counterStore
+	default:
+		return nil
 	}
 }
 
@@ -72,9 +460,9 @@ func setupDefaultConfiguration(rateLimiterService *rateLimiterAPI.RateLimiterSer
 	ctx := context.Background()
 
 	// Create default rate limiting rules
-	rateLimiterService.CreateRule(ctx, "api", 100, time.Minute, "sliding_window")
-	rateLimiterService.CreateRule(ctx, "login", 5, 15*time.Minute, "fixed_window")
-	rateLimiterService.CreateRule(ctx, "upload", 10, time.Hour, "sliding_window")
+	rateLimiterService.CreateRule(ctx, rateLimiterAPI.RuleSpec{Resource: "api", Limit: 100, Window: time.Minute, Algorithm: "sliding_window"})
+	rateLimiterService.CreateRule(ctx, rateLimiterAPI.RuleSpec{Resource: "login", Limit: 5, Window: 15 * time.Minute, Algorithm: "fixed_window"})
+	rateLimiterService.CreateRule(ctx, rateLimiterAPI.RuleSpec{Resource: "upload", Limit: 10, Window: time.Hour, Algorithm: "sliding_window"})
 
 	// Create default security rules
 
@@ -83,14 +471,14 @@ func setupDefaultConfiguration(rateLimiterService *rateLimiterAPI.RateLimiterSer
 		ID:          "block-suspicious-agents",
 		Name:        "Block Suspicious User Agents",
 		Type:        ruleDomain.BlacklistRule,
-		Description: "Block requests from suspicious user agents",
+		Description: "Block automation, unknown bots and clients posing as known crawlers",
 		Priority:    200,
 		Enabled:     true,
 		Conditions: []ruleDomain.RuleCondition{
 			{
-				Field:    "user_agent",
-				Operator: "contains",
-				Value:    "bot",
+				Field:    "ua_class",
+				Operator: "in",
+				Value:    []interface{}{"automation", "bot", "spoofed_crawler"},
 			},
 		},
 		Actions: []ruleDomain.RuleAction{
@@ -167,13 +555,14 @@ func setupDefaultConfiguration(rateLimiterService *rateLimiterAPI.RateLimiterSer
 	fmt.Println("  - login: 5 attempts/15 minutes")
 	fmt.Println("  - upload: 10 uploads/hour")
 	fmt.Println("Security Rules:")
-	fmt.Println("  - Block suspicious user agents")
+	fmt.Println("  - Block automation, unknown bots and spoofed crawlers")
 	fmt.Println("  - Aggressive login rate limiting (3/5min)")
 	fmt.Println("  - Whitelist internal IPs (192.168.x.x)")
 }
 
-func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *http.ServeMux {
+func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService, rateLimiterService *rateLimiterAPI.RateLimiterService, forwardAuthConfig config.ForwardAuthConfig, throttleConfig config.ThrottleConfig, deniedTemplates *denial.Templates) *http.ServeMux {
 	mux := http.NewServeMux()
+	denied := rateLimiterAPI.NewDeniedResponse(deniedTemplates, rateLimiterService)
 
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -197,12 +586,15 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 			Resource    string                 `json:"resource"`
 			IPAddress   string                 `json:"ip_address,omitempty"`
 			UserAgent   string                 `json:"user_agent,omitempty"`
+			Method      string                 `json:"method,omitempty"`
+			Path        string                 `json:"path,omitempty"`
+			Headers     map[string]string      `json:"headers,omitempty"`
+			QueryParams map[string]string      `json:"query_params,omitempty"`
 			Metadata    map[string]string      `json:"metadata,omitempty"`
 			RequestData map[string]interface{} `json:"request_data,omitempty"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if !rateLimiterAPI.DecodeJSON(w, r, &req) {
 			return
 		}
 
@@ -213,7 +605,7 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 
 		// Use request IP and User-Agent if not provided
 		if req.IPAddress == "" {
-			req.IPAddress = r.RemoteAddr
+			req.IPAddress = clientip.FromRequest(r)
 		}
 		if req.UserAgent == "" {
 			req.UserAgent = r.UserAgent()
@@ -225,30 +617,191 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 			req.RequestData = make(map[string]interface{})
 		}
 
-		result, err := service.CheckRequestWithRules(
-			r.Context(),
-			req.ClientID,
-			req.Resource,
-			req.IPAddress,
-			req.UserAgent,
-			req.Metadata,
-			req.RequestData,
-		)
+		headers := make(map[string]string, len(req.Headers))
+		for name, value := range req.Headers {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+
+		result, err := service.CheckRequest(r.Context(), ruleDomain.RuleEvaluationContext{
+			ClientID:    req.ClientID,
+			Resource:    req.Resource,
+			IPAddress:   req.IPAddress,
+			UserAgent:   req.UserAgent,
+			Method:      req.Method,
+			Path:        req.Path,
+			Headers:     headers,
+			QueryParams: req.QueryParams,
+			Metadata:    req.Metadata,
+			RequestData: req.RequestData,
+		})
 		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			rateLimiterAPI.WriteError(w, err)
 			return
 		}
 
+		accesslog.Annotate(r.Context(), req.ClientID, req.Resource, result.Decision(), result.RemainingQuota(), result.MatchedRuleIDs())
+		accesslog.AnnotateReason(r.Context(), result.Reason, result.BlockingRuleIDs)
+
 		statusCode := http.StatusOK
-		if !result.Allowed {
+		switch {
+		case result.Challenge != nil:
+			statusCode = http.StatusForbidden
+		case !result.Allowed:
 			statusCode = http.StatusTooManyRequests
 		}
+		if result.RateLimitStatus != nil {
+			rateLimiterAPI.WriteRateLimitHeaders(w, result.RateLimitStatus)
+		}
+		rateLimiterAPI.WriteThrottleHeader(w, result.ThrottleDelay)
 
+		if statusCode == http.StatusTooManyRequests && denied.Write(r.Context(), w, statusCode, req.ClientID, req.Resource, result.Reason, result.RateLimitStatus) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(statusCode)
 		json.NewEncoder(w).Encode(result)
 	})
 
+	// Forward auth endpoint for Traefik ForwardAuth and Caddy forward_auth.
+	// The proxy describes the original request in X-Forwarded-* headers.
+	mux.HandleFunc("/api/v1/forward-auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ipAddress := clientip.FromRequest(r)
+		clientID := r.Header.Get(forwardAuthConfig.ClientIDHeader)
+		if clientID == "" && forwardAuthConfig.SessionClients {
+			// Only the hash of the session token is stored and logged
+			if session := keytemplate.Session(r.Header, forwardAuthConfig.SessionCookie); session != "" {
+				clientID = "session:" + session
+			}
+		}
+		if clientID == "" {
+			clientID = ipAddress
+		}
+		resource := r.URL.Query().Get("resource")
+		if resource == "" {
+			resource = forwardAuthConfig.DefaultResource
+		}
+
+		metadata := map[string]string{
+			"method": r.Header.Get("X-Forwarded-Method"),
+			"proto":  r.Header.Get("X-Forwarded-Proto"),
+			"host":   r.Header.Get("X-Forwarded-Host"),
+			"uri":    r.Header.Get("X-Forwarded-Uri"),
+		}
+		requestData := map[string]interface{}{
+			"method": metadata["method"],
+			"host":   metadata["host"],
+			"uri":    metadata["uri"],
+		}
+
+		// Describe the original request rather than the auth subrequest
+		evalCtx := integration.EvaluationContextFromRequest(r, clientID, resource, ipAddress)
+		evalCtx.Method = metadata["method"]
+		evalCtx.Path, evalCtx.QueryParams = "", nil
+		if uri, err := url.ParseRequestURI(metadata["uri"]); err == nil {
+			evalCtx.Path = uri.Path
+			evalCtx.QueryParams = integration.FlattenQuery(uri.Query())
+		}
+		evalCtx.Metadata = metadata
+		evalCtx.RequestData = requestData
+
+		result, err := service.CheckRequest(r.Context(), evalCtx)
+		if err != nil {
+			rateLimiterAPI.WriteError(w, err)
+			return
+		}
+
+		accesslog.Annotate(r.Context(), clientID, resource, result.Decision(), result.RemainingQuota(), result.MatchedRuleIDs())
+		accesslog.AnnotateReason(r.Context(), result.Reason, result.BlockingRuleIDs)
+
+		if result.RateLimitStatus != nil {
+			rateLimiterAPI.WriteRateLimitHeaders(w, result.RateLimitStatus)
+		}
+
+		switch result.Decision() {
+		case accesslog.DecisionAllowed:
+			// Throttled requests are held here, which delays them at the proxy
+			if throttleConfig.InjectDelay && result.ThrottleDelay > 0 {
+				if err := waitThrottle(r.Context(), result.ThrottleDelay); err != nil {
+					rateLimiterAPI.WriteError(w, err)
+					return
+				}
+			} else {
+				rateLimiterAPI.WriteThrottleHeader(w, result.ThrottleDelay)
+			}
+			w.WriteHeader(http.StatusOK)
+		case accesslog.DecisionBlockedByRule:
+			http.Error(w, result.Reason, http.StatusForbidden)
+		case accesslog.DecisionChallenged:
+			// Send the client to the captcha, to come back to the original
+			// URL once solved; JS challenges are served by the proxy's
+			// error page, which gets the token from the headers
+			w.Header().Set("X-Challenge", result.Challenge.Kind)
+			w.Header().Set("X-Challenge-Token", result.Challenge.Token)
+			if result.Challenge.URL != "" {
+				location := result.Challenge.URL
+				if metadata["host"] != "" {
+					location = withReturnTo(location, metadata["proto"]+"://"+metadata["host"]+metadata["uri"])
+				}
+				http.Redirect(w, r, location, http.StatusFound)
+				return
+			}
+			http.Error(w, result.Reason, http.StatusForbidden)
+		default:
+			if !denied.Write(r.Context(), w, http.StatusTooManyRequests, clientID, resource, result.Reason, result.RateLimitStatus) {
+				http.Error(w, result.Reason, http.StatusTooManyRequests)
+			}
+		}
+	})
+
+	// Challenge verification endpoint: clients that solve the challenge of
+	// a challenge rule are let through for a while
+	mux.HandleFunc("POST /api/v1/challenges/verify", func(w http.ResponseWriter, r *http.Request) {
+		var solution challenge.Solution
+		if !rateLimiterAPI.DecodeJSON(w, r, &solution) {
+			return
+		}
+		if solution.Token == "" {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+
+		pass, err := service.Challenges().Verify(r.Context(), solution, clientip.FromRequest(r))
+		switch {
+		case errors.Is(err, challenge.ErrInvalidToken), errors.Is(err, challenge.ErrExpired), errors.Is(err, challenge.ErrUnsolved):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pass)
+	})
+
+	// Declarative rule management endpoints
+	mux.HandleFunc("/api/v1/ratelimit/rules", rateLimiterAPI.NewHTTPHandler(rateLimiterService).RulesHandler)
+	mux.HandleFunc("/api/v1/ratelimit/rules/simulate", rateLimiterAPI.NewHTTPHandler(rateLimiterService).SimulateRuleHandler)
+	mux.HandleFunc("/api/v1/ratelimit/overrides", rateLimiterAPI.NewHTTPHandler(rateLimiterService).OverridesHandler)
+	mux.HandleFunc("/api/v1/ratelimit/freezes", rateLimiterAPI.NewHTTPHandler(rateLimiterService).FreezesHandler)
+	mux.HandleFunc("/api/v1/ratelimit/rollouts", rateLimiterAPI.NewHTTPHandler(rateLimiterService).RolloutsHandler)
+	mux.HandleFunc("/api/v1/ratelimit/rollouts/promote", rateLimiterAPI.NewHTTPHandler(rateLimiterService).PromoteRolloutHandler)
+	mux.HandleFunc("/api/v1/ratelimit/rollouts/rollback", rateLimiterAPI.NewHTTPHandler(rateLimiterService).RollBackRolloutHandler)
+	mux.HandleFunc("/api/v1/ratelimit/leases", rateLimiterAPI.NewHTTPHandler(rateLimiterService).LeasesHandler)
+	mux.HandleFunc("/api/v1/ratelimit/leases/renew", rateLimiterAPI.NewHTTPHandler(rateLimiterService).RenewLeaseHandler)
+	mux.HandleFunc("/api/v1/ratelimit/explain", rateLimiterAPI.NewHTTPHandler(rateLimiterService).ExplainHandler)
+	mux.HandleFunc("/api/v1/ratelimit/peek", rateLimiterAPI.NewHTTPHandler(rateLimiterService).PeekHandler)
+	mux.HandleFunc("/api/v1/ratelimit/check-all", rateLimiterAPI.NewHTTPHandler(rateLimiterService).WithDeniedTemplates(deniedTemplates).CheckAllHandler)
+	mux.HandleFunc("/api/v1/ratelimit/refund", rateLimiterAPI.NewHTTPHandler(rateLimiterService).RefundHandler)
+
+	// Rule engine rule management and hit statistics endpoints
+	integration.NewRuleHTTPHandler(service).RegisterRoutes(mux)
+
 	// Block IPs endpoint
 	mux.HandleFunc("/api/v1/security/block-ips", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -261,8 +814,7 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 			Reason      string   `json:"reason,omitempty"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if !rateLimiterAPI.DecodeJSON(w, r, &req) {
 			return
 		}
 
@@ -280,7 +832,7 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 
 		err := service.CreateIPBasedRule(r.Context(), req.IPAddresses, "block", parameters)
 		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			integration.WriteRuleError(w, err)
 			return
 		}
 
@@ -303,8 +855,7 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 			Algorithm string   `json:"algorithm,omitempty"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if !rateLimiterAPI.DecodeJSON(w, r, &req) {
 			return
 		}
 
@@ -325,7 +876,7 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 
 		err = service.CreateResourceBasedRule(r.Context(), req.Resources, req.Limit, window, req.Algorithm)
 		if err != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			integration.WriteRuleError(w, err)
 			return
 		}
 
@@ -337,14 +888,17 @@ func setupIntegratedRoutes(service *integration.IntegratedRateLimiterService) *h
 	return mux
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapper, r)
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapper.statusCode, duration)
-	})
+// waitThrottle sleeps for delay, returning early with the context's error
+func waitThrottle(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
@@ -362,12 +916,254 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// setupEnrichment builds the chain of enrichers that add fields to requests
+// before security rules are evaluated
+func setupEnrichment(enrichmentConfig config.EnrichmentConfig) *ruleEngine.EnrichmentChain {
+	chain := ruleEngine.NewEnrichmentChain()
+	for _, enricher := range enrichmentConfig.Enrichers {
+		switch enricher.Name {
+		case "useragent":
+			userAgent := ruleInfra.NewUserAgentEnricher()
+			if enrichmentConfig.CrawlerVerification > 0 {
+				userAgent.WithCrawlerVerification(ruleInfra.NewCrawlerVerifier(enrichmentConfig.CrawlerVerification))
+			}
+			chain.Add(userAgent, enricher.Timeout)
+		case "geoip":
+			geoIP, err := ruleInfra.LoadGeoIPEnricher(enrichmentConfig.GeoIPDatabase)
+			if err != nil {
+				log.Fatalf("Error loading GeoIP database: %v", err)
+			}
+			chain.Add(geoIP, enricher.Timeout)
+		case "device":
+			chain.Add(ruleInfra.NewDeviceEnricher(), enricher.Timeout)
+		case "reputation":
+			chain.Add(ruleInfra.NewHTTPLookupEnricher("reputation", enrichmentConfig.ReputationURL, nil), enricher.Timeout)
+		case "account":
+			chain.Add(ruleInfra.NewHTTPLookupEnricher("account", enrichmentConfig.AccountFlagsURL, nil), enricher.Timeout)
+		}
+	}
+	if names := chain.Enrichers(); len(names) > 0 {
+		fmt.Printf("Enriching requests with: %s\n", strings.Join(names, ", "))
+	}
+	return chain
+}
+
+// setupThreatFeeds creates the importer of the configured threat feeds
+func setupThreatFeeds(threatFeedConfig config.ThreatFeedConfig, rules threatfeed.RuleStore) *threatfeed.Importer {
+	feeds := make([]threatfeed.Feed, 0, len(threatFeedConfig.Feeds))
+	names := make([]string, 0, len(threatFeedConfig.Feeds))
+	for _, feed := range threatFeedConfig.Feeds {
+		feeds = append(feeds, threatfeed.Feed{
+			Name:     feed.Name,
+			URL:      feed.URL,
+			Format:   feed.Format,
+			Action:   feed.Action,
+			Interval: feed.Interval,
+			Header:   feed.Header,
+		})
+		names = append(names, fmt.Sprintf("%s (%s, every %s)", feed.Name, feed.Action, feed.Interval))
+	}
+	if len(names) > 0 {
+		fmt.Printf("Importing threat feeds: %s\n", strings.Join(names, ", "))
+	}
+	return threatfeed.NewImporter(rules, feeds, nil)
+}
+
+// setupRemoteWrite creates the exporter pushing decision counters to the
+// remote-write endpoint
+func setupRemoteWrite(remoteWriteConfig config.RemoteWriteConfig, decisionMetrics *rateLimiterInfra.DecisionMetrics) *rateLimiterInfra.RemoteWriteExporter {
+	fmt.Printf("Pushing decision metrics to %s every %s\n", remoteWriteConfig.URL, remoteWriteConfig.Interval)
+	return rateLimiterInfra.NewRemoteWriteExporter(remoteWriteConfig.URL, remoteWriteConfig.Interval, decisionMetrics).
+		WithLabels(remoteWriteConfig.Labels).
+		WithBasicAuth(remoteWriteConfig.Username, remoteWriteConfig.Password).
+		WithBearerToken(remoteWriteConfig.BearerToken)
+}
+
+// setupPrivacy creates the pseudonymizer of privacy mode, or nil when it is
+// off
+func setupPrivacy(privacyConfig config.PrivacyConfig) *privacy.Pseudonymizer {
+	if !privacyConfig.Enabled {
+		return nil
+	}
+	fmt.Println("Privacy mode: client IDs, IP addresses and user agents are stored as keyed hashes")
+	return privacy.NewPseudonymizer([]byte(privacyConfig.Key))
+}
+
+// setupFeatureFlags creates the evaluator of the feature flags gating rules
+// with the configured provider, or returns nil when none is configured
+func setupFeatureFlags(featureFlagConfig config.FeatureFlagConfig) rateLimiterHandlers.FlagEvaluator {
+	switch {
+	case featureFlagConfig.File != "":
+		provider, err := featureflags.NewFileProvider(featureFlagConfig.File)
+		if err != nil {
+			log.Fatalf("Error loading feature flags: %v", err)
+		}
+		go provider.Run(context.Background(), featureFlagConfig.RefreshInterval)
+		fmt.Printf("Evaluating feature flags from %s, read every %s\n", featureFlagConfig.File, featureFlagConfig.RefreshInterval)
+		return featureflags.NewEvaluator(provider)
+	case featureFlagConfig.OFREPURL != "":
+		provider := featureflags.NewOFREPProvider(featureFlagConfig.OFREPURL, featureFlagConfig.OFREPToken, featureFlagConfig.Timeout, featureFlagConfig.CacheTTL)
+		fmt.Printf("Evaluating feature flags with the OFREP service at %s\n", featureFlagConfig.OFREPURL)
+		return featureflags.NewEvaluator(provider)
+	default:
+		return nil
+	}
+}
+
+// setupReadReplicas creates the read model routing queries to read replicas
+// within the staleness bounds of their query types, or nil when there are no
+// replicas. Each replica is a read model of its own tailing the event store,
+// standing in for a replica of a SQL or Redis read model.
+func setupReadReplicas(readReplicaConfig config.ReadReplicaConfig, projectionConfig config.ProjectionConfig, statsRetention rateLimiterInfra.StatsRetention, eventStore rateLimiterInfra.EventStream, primary rateLimiterInfra.PrimaryReadModel) *rateLimiterInfra.ReplicatedReadModel {
+	if readReplicaConfig.Replicas == 0 {
+		return nil
+	}
+	replicas := make([]rateLimiterInfra.ReadReplica, 0, readReplicaConfig.Replicas)
+	for i := 1; i <= readReplicaConfig.Replicas; i++ {
+		readModel := rateLimiterInfra.NewInMemoryReadModel().WithStatsRetention(statsRetention).WithUnknownEventPolicy(rateLimiterInfra.UnknownEventPolicy(projectionConfig.UnknownEvents))
+		projection := rateLimiterInfra.NewReadModelProjection(eventStore, readModel, readReplicaConfig.PollInterval).
+			WithCatchUp(projectionConfig.CatchUpThreshold, projectionConfig.CatchUpBatchSize)
+		go projection.Run(context.Background())
+		go rateLimiterInfra.NewStatsRollup(readModel, projectionConfig.StatsRollupInterval).Run(context.Background())
+		replicas = append(replicas, rateLimiterInfra.ReadReplica{Name: fmt.Sprintf("replica-%d", i), ReadModel: readModel, Lag: projection})
+	}
+	maxStaleness := make(map[rateLimiterInfra.ReadQuery]time.Duration, len(readReplicaConfig.MaxStaleness))
+	for query, staleness := range readReplicaConfig.MaxStaleness {
+		maxStaleness[rateLimiterInfra.ReadQuery(query)] = staleness
+	}
+	readReplicas := rateLimiterInfra.NewReplicatedReadModel(primary, replicas, maxStaleness)
+	go readReplicas.Run(context.Background(), readReplicaConfig.LagInterval)
+	fmt.Printf("Answering read model queries from %d read replica(s) within %v\n", len(replicas), readReplicaConfig.MaxStaleness)
+	return readReplicas
+}
+
+// setupChallenges creates the service issuing the challenges of challenge
+// rules
+func setupChallenges(challengeConfig config.ChallengeConfig) *challenge.Service {
+	if challengeConfig.Secret == "" {
+		fmt.Println("CHALLENGE_SECRET is not set: challenge tokens are only valid on this instance until restart")
+	}
+	return challenge.NewService(challenge.Config{
+		Secret:           []byte(challengeConfig.Secret),
+		Kind:             challengeConfig.Kind,
+		TTL:              challengeConfig.TTL,
+		PassTTL:          challengeConfig.PassTTL,
+		Difficulty:       challengeConfig.Difficulty,
+		CaptchaURL:       challengeConfig.CaptchaURL,
+		CaptchaVerifyURL: challengeConfig.CaptchaVerifyURL,
+		CaptchaSecret:    challengeConfig.CaptchaSecret,
+	})
+}
+
+// withReturnTo adds the URL to return to after a captcha to its URL
+func withReturnTo(captchaURL, returnTo string) string {
+	u, err := url.Parse(captchaURL)
+	if err != nil {
+		return captchaURL
+	}
+	query := u.Query()
+	query.Set("return_to", returnTo)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// setupLockProvider creates the lock provider selected by the configuration
+func setupLockProvider(lockConfig config.LockConfig) locks.Provider {
+	switch lockConfig.Backend {
+	case "redis":
+		provider, err := locks.NewRedisProvider(lockConfig.Addrs)
+		if err != nil {
+			log.Fatalf("Error creating redis lock provider: %v", err)
+		}
+		return provider.WithPassword(lockConfig.RedisPassword)
+	case "etcd":
+		provider, err := locks.NewEtcdProvider(lockConfig.Addrs, nil)
+		if err != nil {
+			log.Fatalf("Error creating etcd lock provider: %v", err)
+		}
+		return provider
+	case "postgres":
+		provider, err := locks.NewPostgresProvider(lockConfig.Addrs[0])
+		if err != nil {
+			log.Fatalf("Error creating postgres lock provider: %v", err)
+		}
+		return provider
+	case "kubernetes":
+		// In-cluster unless an API URL is given, e.g. with `kubectl proxy`
+		namespace := lockConfig.Namespace
+		if namespace == "" {
+			namespace = rulesync.InClusterNamespace()
+		}
+		if len(lockConfig.Addrs) > 0 {
+			return locks.NewKubeLeaseProvider(lockConfig.Addrs[0], os.Getenv("KUBE_TOKEN"), nil, namespace, lockConfig.Identity)
+		}
+		baseURL, token, httpClient, err := rulesync.InClusterConfig()
+		if err != nil {
+			log.Fatalf("Error creating kubernetes lock provider: %v", err)
+		}
+		return locks.NewKubeLeaseProvider(baseURL, token, httpClient, namespace, lockConfig.Identity)
+	default:
+		return locks.NewInMemoryProvider()
+	}
+}
+
+// setupDeniedTemplates loads the templates of denied response bodies, or
+// returns nil to leave denials to the default bodies
+func setupDeniedTemplates(deniedResponseConfig config.DeniedResponseConfig) *denial.Templates {
+	if deniedResponseConfig.Templates == "" {
+		return nil
+	}
+	templates, err := denial.Load(deniedResponseConfig.Templates)
+	if err != nil {
+		log.Fatalf("Invalid denied response templates: %v", err)
+	}
+	return templates
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// setupWarmStart creates the warm start, compiling the security rules and
+// preloading the recently active aggregates when the event store decodes
+// their events on loading
+func setupWarmStart(warmStartConfig config.WarmStartConfig, eventStore rateLimiterHandlers.EventStore, ruleEngineService *ruleEngine.RuleEngine) *rateLimiterInfra.WarmStart {
+	warmStart := rateLimiterInfra.NewWarmStart(warmStartConfig.Timeout).
+		Add("security rules", ruleEngineService.Warm)
+	if preloader, ok := eventStore.(rateLimiterInfra.AggregatePreloader); ok && warmStartConfig.MaxKeys > 0 {
+		warmStart.Add("aggregates", rateLimiterInfra.PreloadRecentAggregates(preloader, warmStartConfig.Window, warmStartConfig.MaxKeys))
+	}
+	return warmStart
+}
+
+// setupFailurePolicy creates the policy deciding checks while storage is
+// unavailable from its configuration
+func setupFailurePolicy(storageFailureConfig config.StorageFailureConfig) rateLimiterAPI.FailurePolicy {
+	policy := rateLimiterAPI.FailurePolicy{
+		Mode:      rateLimiterAPI.FailureMode(storageFailureConfig.Mode),
+		Resources: make(map[string]rateLimiterAPI.FailureMode, len(storageFailureConfig.Resources)),
+	}
+	for resource, mode := range storageFailureConfig.Resources {
+		policy.Resources[resource] = rateLimiterAPI.FailureMode(mode)
+	}
+	if policy.Mode != rateLimiterAPI.FailError || len(policy.Resources) > 0 {
+		fmt.Printf("Storage failures decided fail-%s, with %d resource override(s)\n", policy.Mode, len(policy.Resources))
+	}
+	return policy
+}
+
+// validateConfig checks the configuration as it would be loaded at startup,
+// the storage and services it names and the rules files, prints a report
+// and exits, non-zero when a check failed
+func validateConfig(defaultAddr, rulesFiles string, checkRules func(r *configcheck.Report, path string)) {
+	var report configcheck.Report
+	env := configcheck.CheckEnvironment(&report, defaultAddr)
+	configcheck.CheckConnectivity(context.Background(), &report, env)
+	if rulesFiles != "" {
+		for _, path := range strings.Split(rulesFiles, ",") {
+			checkRules(&report, path)
+		}
+	}
+	
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
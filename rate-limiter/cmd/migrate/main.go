@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NickChunglolz/rate-limiter/internal/migration"
+)
+
+// migrate copies the state of a rate limiter, exported by the server on
+// shutdown, into a storage backend during a maintenance window, verifies
+// that the backend holds the same events, rules, overrides, freezes,
+// rollouts, leases, clients and read model state, and writes the migrated
+// state to a new export file for the server to start from
+func main() {
+	from := flag.String("from", "", "Export file to migrate, written by the server's -export")
+	to := flag.String("to", "memory", "Backend to migrate to: "+strings.Join(migration.Backends, ", "))
+	out := flag.String("out", "", "Export file to write the migrated state to; verified by reading it back")
+	flag.Parse()
+	if *from == "" {
+		fmt.Fprintln(os.Stderr, "Usage: migrate -from EXPORT_FILE [-to BACKEND] [-out EXPORT_FILE]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	// The export file is checked against its digest as it is read
+	source, err := migration.NewStores("memory")
+	if err != nil {
+		log.Fatal(err)
+	}
+	sourceDigest, err := importFile(ctx, *from, source)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", *from, err)
+	}
+
+	destination, err := migration.NewStores(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := migration.Copy(ctx, source, destination); err != nil {
+		log.Fatalf("Error migrating to %s: %v", *to, err)
+	}
+	destinationDigest, err := migration.Summarize(ctx, destination)
+	if err != nil {
+		log.Fatalf("Error reading back %s: %v", *to, err)
+	}
+
+	mismatches := sourceDigest.Mismatches(destinationDigest)
+	printReport(*from, *to, sourceDigest, destinationDigest)
+	if len(mismatches) > 0 {
+		log.Fatalf("Migration to %s failed verification: %s differ", *to, strings.Join(mismatches, ", "))
+	}
+
+	if *out != "" {
+		if err := exportFile(ctx, *out, destination, destinationDigest); err != nil {
+			log.Fatalf("Error writing %s: %v", *out, err)
+		}
+		fmt.Printf("Wrote the migrated state to %s\n", *out)
+	}
+}
+
+// importFile restores the export file at path into stores
+func importFile(ctx context.Context, path string, stores migration.Stores) (migration.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return migration.Import(ctx, file, stores)
+}
+
+// exportFile writes the state held by stores to an export file at path,
+// and reads it back to check that it holds the state digest summarizes.
+// The file is written aside and renamed into place once checked.
+func exportFile(ctx context.Context, path string, stores migration.Stores, digest migration.Digest) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = migration.Export(ctx, stores, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	readBack, err := migration.NewStores("memory")
+	if err != nil {
+		return err
+	}
+	written, err := importFile(ctx, file.Name(), readBack)
+	if err != nil {
+		return fmt.Errorf("reading back the export file failed: %w", err)
+	}
+	if mismatches := digest.Mismatches(written); len(mismatches) > 0 {
+		return fmt.Errorf("export file does not hold the migrated state: %s differ", strings.Join(mismatches, ", "))
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// printReport prints the records of each kind of state in the source and
+// the destination and whether they match
+func printReport(from, to string, source, destination migration.Digest) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "STATE\t%s\t%s\tVERIFIED\n", from, to)
+	for _, section := range source {
+		migrated, ok := destination.Section(section.Kind)
+		verified := "yes"
+		switch {
+		case !ok:
+			verified = "missing"
+		case migrated != section:
+			verified = "NO"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", section.Kind, section.Count, migrated.Count, verified)
+	}
+	w.Flush()
+}
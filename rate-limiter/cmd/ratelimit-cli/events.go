@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/migration"
+)
+
+const (
+	// defaultServer is the admin API the event commands talk to by default
+	defaultServer = "http://localhost:8080"
+
+	// replayTick is how far ahead of their time events are sent, so events
+	// closer together than this are imported in one request
+	replayTick = 10 * time.Millisecond
+
+	// progressInterval is how often a replay reports its progress
+	progressInterval = 5 * time.Second
+)
+
+// dumpEvents writes the stored events of an aggregate and/or time range to
+// a file or standard output as an event dump
+func dumpEvents(args []string) {
+	flags := flag.NewFlagSet("events dump", flag.ExitOnError)
+	server := flags.String("server", defaultServer, "Base URL of the server's admin API")
+	token := flags.String("token", os.Getenv("ADMIN_TOKEN"), "Admin token (default $ADMIN_TOKEN)")
+	aggregateID := flags.String("aggregate-id", "", "Dump the events of this aggregate, e.g. client:resource")
+	start := flags.String("start", "", "Dump the events from this time (RFC3339)")
+	end := flags.String("end", "", "Dump the events before this time (RFC3339)")
+	out := flags.String("out", "", "File to write the dump to (default standard output)")
+	flags.Parse(args)
+	if *aggregateID == "" && *start == "" {
+		log.Fatal("Choose the events to dump with -aggregate-id and/or -start")
+	}
+
+	params := url.Values{}
+	for name, value := range map[string]string{"aggregate_id": *aggregateID, "start_time": *start, "end_time": *end} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	resp, err := adminRequest(context.Background(), http.MethodGet, *server+"/api/v1/admin/events/dump?"+params.Encode(), *token, nil)
+	if err != nil {
+		log.Fatalf("Error dumping events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Error creating dump file: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		log.Fatalf("Error writing dump: %v", err)
+	}
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", n, *out)
+	}
+}
+
+// replayEvents imports the events of a dump, or of an export file, into a
+// server, pacing them as they were recorded at the chosen speed so that its
+// read model and event subscribers see the traffic as it happened
+func replayEvents(args []string) {
+	flags := flag.NewFlagSet("events replay", flag.ExitOnError)
+	server := flags.String("server", defaultServer, "Base URL of the server's admin API")
+	token := flags.String("token", os.Getenv("ADMIN_TOKEN"), "Admin token (default $ADMIN_TOKEN)")
+	speed := flags.Float64("speed", 1, "Speed relative to the recorded traffic, e.g. 10 for ten times as fast; 0 imports as fast as the server takes them")
+	batchBytes := flags.Int("batch-bytes", 512<<10, "Largest request to send; keep below the server's HTTP_MAX_BODY_BYTES")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: ratelimit-cli events replay [flags] DUMP_FILE (- for standard input)")
+	}
+	if *speed < 0 {
+		log.Fatal("-speed must not be negative")
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Error opening dump: %v", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := newReplayer(ctx, *server, *token, *speed, *batchBytes)
+	err := migration.ReadEvents(in, r.add)
+	if err == nil {
+		err = r.flush()
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d events in %s\n", r.imported, time.Since(r.started).Round(time.Millisecond))
+	if err != nil {
+		log.Fatalf("Error replaying events: %v", err)
+	}
+}
+
+// replayer sends the events of a dump to the import endpoint in batches,
+// each once its time comes
+type replayer struct {
+	ctx        context.Context
+	url        string
+	token      string
+	speed      float64
+	batchBytes int
+
+	batch   bytes.Buffer
+	writer  *migration.EventWriter
+	pending int
+
+	first      time.Time // Time of the first event
+	last       time.Time // Time of the last event added
+	started    time.Time // When the first event was read
+	imported   int
+	reportedAt time.Time
+}
+
+// newReplayer creates a replayer importing into the server at baseURL
+func newReplayer(ctx context.Context, baseURL, token string, speed float64, batchBytes int) *replayer {
+	r := &replayer{
+		ctx:        ctx,
+		url:        strings.TrimSuffix(baseURL, "/") + "/api/v1/admin/events/import",
+		token:      token,
+		speed:      speed,
+		batchBytes: batchBytes,
+		started:    time.Now(),
+	}
+	r.writer = migration.NewEventWriter(&r.batch)
+	r.reportedAt = r.started
+	return r
+}
+
+// add adds event to the batch, first sending the batch and waiting when
+// the event is not due yet
+func (r *replayer) add(event domain.Event, inHistory bool) error {
+	if r.first.IsZero() {
+		r.first = event.Timestamp()
+		r.started = time.Now()
+	}
+	if r.speed > 0 {
+		offset := time.Duration(float64(event.Timestamp().Sub(r.first)) / r.speed)
+		if wait := time.Until(r.started.Add(offset)); wait > replayTick {
+			if err := r.flush(); err != nil {
+				return err
+			}
+			select {
+			case <-r.ctx.Done():
+				return r.ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	if err := r.writer.Write(event, inHistory); err != nil {
+		return err
+	}
+	if err := r.writer.Flush(); err != nil {
+		return err
+	}
+	r.pending++
+	r.last = event.Timestamp()
+	if r.batch.Len() >= r.batchBytes {
+		return r.flush()
+	}
+	return nil
+}
+
+// flush sends the batch to the import endpoint
+func (r *replayer) flush() error {
+	if r.pending == 0 {
+		return nil
+	}
+	resp, err := adminRequest(r.ctx, http.MethodPost, r.url, r.token, &r.batch)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Imported int `json:"imported"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("reading the import response failed: %w", err)
+	}
+	r.imported += result.Imported
+	r.batch.Reset()
+	r.pending = 0
+
+	if time.Since(r.reportedAt) >= progressInterval {
+		r.reportedAt = time.Now()
+		fmt.Fprintf(os.Stderr, "Replayed %d events, up to %s\n", r.imported, r.last.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// adminRequest sends a request to the admin API with the admin token, and
+// returns the response if it succeeded
+func adminRequest(ctx context.Context, method, target, token string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/NickChunglolz/rate-limiter/internal/dashboards"
+)
+
+const usage = `Usage: ratelimit-cli <command> [flags]
+
+Commands:
+  dashboards list      List the Grafana dashboards
+  dashboards export    Write Grafana dashboard JSON for the exported metrics
+  events dump          Write stored events of a key or time range as an event dump
+  events replay        Import an event dump into a server at the recorded pace
+`
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] + " " + args[1] {
+	case "dashboards list":
+		for _, name := range dashboards.Names() {
+			fmt.Println(name)
+		}
+	case "dashboards export":
+		exportDashboards(args[2:])
+	case "events dump":
+		dumpEvents(args[2:])
+	case "events replay":
+		replayEvents(args[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// exportDashboards writes the chosen dashboards to a directory, one file
+// each, or a single dashboard to standard output
+func exportDashboards(args []string) {
+	flags := flag.NewFlagSet("dashboards export", flag.ExitOnError)
+	outDir := flags.String("out", "", "Directory to write <name>.json dashboards to (default standard output, one dashboard only)")
+	name := flags.String("name", "", "Dashboard to export (default all)")
+	datasource := flags.String("datasource", dashboards.DefaultDatasource, "Prometheus datasource the dashboards query by default")
+	flags.Parse(args)
+
+	names := dashboards.Names()
+	if *name != "" {
+		names = []string{*name}
+	}
+	if *outDir == "" && len(names) > 1 {
+		log.Fatal("Choose a dashboard with -name or a directory with -out to export them all")
+	}
+
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			log.Fatalf("Error creating output directory: %v", err)
+		}
+	}
+
+	for _, name := range names {
+		dashboard, err := dashboards.Get(name)
+		if err != nil {
+			log.Fatalf("Error exporting dashboard: %v", err)
+		}
+		data, err := dashboards.Export(dashboard, *datasource)
+		if err != nil {
+			log.Fatalf("Error encoding dashboard %s: %v", name, err)
+		}
+		data = append(data, '\n')
+
+		if *outDir == "" {
+			os.Stdout.Write(data)
+			continue
+		}
+		path := filepath.Join(*outDir, name+".json")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			log.Fatalf("Error writing dashboard: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/locks"
+	"github.com/NickChunglolz/rate-limiter/internal/rulesync"
+)
+
+func main() {
+	// Load configuration
+	cfg, err := config.LoadRuleSyncConfig()
+	if err != nil {
+		log.Fatalf("Invalid rule syncer configuration: %v", err)
+	}
+	lockConfig, err := config.LoadLockConfig()
+	if err != nil {
+		log.Fatalf("Invalid lock configuration: %v", err)
+	}
+
+	// Connect to the Kubernetes API, in-cluster unless an API URL is given
+	// (e.g. http://localhost:8001 with `kubectl proxy`)
+	var kube *rulesync.KubeClient
+	if cfg.KubeAPIURL != "" {
+		kube = rulesync.NewKubeClient(cfg.KubeAPIURL, os.Getenv("KUBE_TOKEN"), nil)
+	} else {
+		kube, err = rulesync.NewInClusterKubeClient()
+		if err != nil {
+			log.Fatalf("Error creating kubernetes client: %v", err)
+		}
+	}
+
+	syncer := rulesync.NewSyncer(kube, rulesync.NewLimiterClient(cfg.LimiterURL), cfg.Namespace, cfg.ResyncInterval)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = "all namespaces"
+	}
+	fmt.Printf("Rule syncer reconciling %s into %s\n", namespace, cfg.LimiterURL)
+	fmt.Println("Watching:")
+	fmt.Printf("  RateLimitRule.%s/%s\n", rulesync.Group, rulesync.Version)
+	fmt.Printf("  SecurityRule.%s/%s\n", rulesync.Group, rulesync.Version)
+	fmt.Printf("  ConfigMaps labelled %s=true\n", rulesync.ConfigMapLabel)
+
+	// Replicas elect one of them to reconcile, and the others stand by to
+	// take over
+	elector := locks.NewElector(setupLockProvider(lockConfig), ruleSyncerElection, lockConfig.Identity, lockConfig.TTL)
+	elector.Go("rule-sync", syncer.Run)
+	fmt.Printf("Reconciling as %s while leading the %q election (%s locks)\n", lockConfig.Identity, ruleSyncerElection, lockConfig.Backend)
+	elector.Run(ctx)
+}
+
+// ruleSyncerElection names the election of the reconciling replica
+const ruleSyncerElection = "rule-syncer"
+
+// setupLockProvider creates the lock provider selected by the configuration
+func setupLockProvider(lockConfig config.LockConfig) locks.Provider {
+	switch lockConfig.Backend {
+	case "redis":
+		provider, err := locks.NewRedisProvider(lockConfig.Addrs)
+		if err != nil {
+			log.Fatalf("Error creating redis lock provider: %v", err)
+		}
+		return provider.WithPassword(lockConfig.RedisPassword)
+	case "etcd":
+		provider, err := locks.NewEtcdProvider(lockConfig.Addrs, nil)
+		if err != nil {
+			log.Fatalf("Error creating etcd lock provider: %v", err)
+		}
+		return provider
+	case "postgres":
+		provider, err := locks.NewPostgresProvider(lockConfig.Addrs[0])
+		if err != nil {
+			log.Fatalf("Error creating postgres lock provider: %v", err)
+		}
+		return provider
+	case "kubernetes":
+		// In-cluster unless an API URL is given, e.g. with `kubectl proxy`
+		namespace := lockConfig.Namespace
+		if namespace == "" {
+			namespace = rulesync.InClusterNamespace()
+		}
+		if len(lockConfig.Addrs) > 0 {
+			return locks.NewKubeLeaseProvider(lockConfig.Addrs[0], os.Getenv("KUBE_TOKEN"), nil, namespace, lockConfig.Identity)
+		}
+		baseURL, token, httpClient, err := rulesync.InClusterConfig()
+		if err != nil {
+			log.Fatalf("Error creating kubernetes lock provider: %v", err)
+		}
+		return locks.NewKubeLeaseProvider(baseURL, token, httpClient, namespace, lockConfig.Identity)
+	default:
+		return locks.NewInMemoryProvider()
+	}
+}
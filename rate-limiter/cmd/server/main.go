@@ -2,67 +2,665 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"google.golang.org/grpc"
+
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
 	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/configcheck"
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/console"
+	"github.com/NickChunglolz/rate-limiter/internal/featureflags"
 	"github.com/NickChunglolz/rate-limiter/internal/handlers"
 	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+	"github.com/NickChunglolz/rate-limiter/internal/locks"
+	"github.com/NickChunglolz/rate-limiter/internal/migration"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
+	"github.com/NickChunglolz/rate-limiter/internal/sidecar"
+	"github.com/NickChunglolz/rate-limiter/internal/rulesync"
 )
 
+// exportTimeout bounds stopping the server and exporting its state
+const exportTimeout = 5 * time.Minute
+
 func main() {
+	validate := flag.Bool("validate-config", false, "Check the configuration, the storage it names and rules files, print a report and exit non-zero on problems")
+	rulesFiles := flag.String("rules", "", "Comma-separated JSON files of rate limit rules to check with -validate-config")
+	importPath := flag.String("import", "", "Export file to start from, written by -export or cmd/migrate")
+	exportPath := flag.String("export", "", "File to export the state to on SIGINT or SIGTERM, for cmd/migrate")
+	flag.Parse()
+	if *validate {
+		validateConfig(":8080", *rulesFiles, configcheck.CheckRateLimitRules)
+	}
+	
+	// Load configuration
+	cfg, err := config.LoadServerConfig(":8080")
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
+	adminConfig, err := config.LoadAdminServerConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid admin server configuration: %v", err)
+	}
+	accessLogConfig, err := config.LoadAccessLogConfig()
+	if err != nil {
+		log.Fatalf("Invalid access log configuration: %v", err)
+	}
+	counterConfig, err := config.LoadCounterConfig()
+	if err != nil {
+		log.Fatalf("Invalid counter configuration: %v", err)
+	}
+	analyticsConfig, err := config.LoadAnalyticsConfig()
+	if err != nil {
+		log.Fatalf("Invalid analytics configuration: %v", err)
+	}
+	outboxConfig, err := config.LoadOutboxConfig()
+	if err != nil {
+		log.Fatalf("Invalid outbox configuration: %v", err)
+	}
+	writeBatchConfig, err := config.LoadWriteBatchConfig()
+	if err != nil {
+		log.Fatalf("Invalid write batching configuration: %v", err)
+	}
+	projectionConfig, err := config.LoadProjectionConfig()
+	if err != nil {
+		log.Fatalf("Invalid projection configuration: %v", err)
+	}
+	readReplicaConfig, err := config.LoadReadReplicaConfig()
+	if err != nil {
+		log.Fatalf("Invalid read replica configuration: %v", err)
+	}
+	eventBusConfig, err := config.LoadEventBusConfig()
+	if err != nil {
+		log.Fatalf("Invalid event bus configuration: %v", err)
+	}
+	keyLimitConfig, err := config.LoadKeyLimitConfig()
+	if err != nil {
+		log.Fatalf("Invalid key limit configuration: %v", err)
+	}
+	refundConfig, err := config.LoadRefundConfig()
+	if err != nil {
+		log.Fatalf("Invalid refund configuration: %v", err)
+	}
+	blockedCacheConfig, err := config.LoadBlockedCacheConfig()
+	if err != nil {
+		log.Fatalf("Invalid blocked cache configuration: %v", err)
+	}
+	aggregateCacheConfig, err := config.LoadAggregateCacheConfig()
+	if err != nil {
+		log.Fatalf("Invalid aggregate cache configuration: %v", err)
+	}
+	grantConfig, err := config.LoadGrantConfig()
+	if err != nil {
+		log.Fatalf("Invalid budget grant configuration: %v", err)
+	}
+	leaseConfig, err := config.LoadLeaseConfig()
+	if err != nil {
+		log.Fatalf("Invalid lease configuration: %v", err)
+	}
+	deniedResponseConfig, err := config.LoadDeniedResponseConfig()
+	if err != nil {
+		log.Fatalf("Invalid denied response configuration: %v", err)
+	}
+	grpcConfig, err := config.LoadGRPCConfig()
+	if err != nil {
+		log.Fatalf("Invalid gRPC configuration: %v", err)
+	}
+	sidecarConfig, err := config.LoadSidecarConfig()
+	if err != nil {
+		log.Fatalf("Invalid sidecar configuration: %v", err)
+	}
+	noticeConfig, err := config.LoadNoticeConfig()
+	if err != nil {
+		log.Fatalf("Invalid notice configuration: %v", err)
+	}
+	apiConfig, err := config.LoadAPIConfig()
+	if err != nil {
+		log.Fatalf("Invalid API configuration: %v", err)
+	}
+	lockConfig, err := config.LoadLockConfig()
+	if err != nil {
+		log.Fatalf("Invalid lock configuration: %v", err)
+	}
+	alertConfig, err := config.LoadAlertConfig()
+	if err != nil {
+		log.Fatalf("Invalid alert configuration: %v", err)
+	}
+	privacyConfig, err := config.LoadPrivacyConfig()
+	if err != nil {
+		log.Fatalf("Invalid privacy configuration: %v", err)
+	}
+	remoteWriteConfig, err := config.LoadRemoteWriteConfig()
+	if err != nil {
+		log.Fatalf("Invalid remote write configuration: %v", err)
+	}
+	rolloutConfig, err := config.LoadRolloutConfig()
+	if err != nil {
+		log.Fatalf("Invalid rollout configuration: %v", err)
+	}
+	warmStartConfig, err := config.LoadWarmStartConfig()
+	if err != nil {
+		log.Fatalf("Invalid warm start configuration: %v", err)
+	}
+	storageFailureConfig, err := config.LoadStorageFailureConfig()
+	if err != nil {
+		log.Fatalf("Invalid storage failure configuration: %v", err)
+	}
+	decisionConfig, err := config.LoadDecisionConfig()
+	if err != nil {
+		log.Fatalf("Invalid decision configuration: %v", err)
+	}
+	featureFlagConfig, err := config.LoadFeatureFlagConfig()
+	if err != nil {
+		log.Fatalf("Invalid feature flag configuration: %v", err)
+	}
+	
 	// Initialize infrastructure components
-	eventStore := infrastructure.NewInMemoryEventStore()
+	eventStore := infrastructure.NewInMemoryEventStore().WithMaxKeys(keyLimitConfig.MaxKeys)
 	ruleRepository := infrastructure.NewInMemoryRuleRepository()
-	readModel := infrastructure.NewInMemoryReadModel()
-	eventBus := infrastructure.NewEventBus()
+	overrideRepository := infrastructure.NewInMemoryOverrideRepository()
+	freezeRepository := infrastructure.NewInMemoryFreezeRepository()
+	rolloutRepository := infrastructure.NewInMemoryRolloutRepository()
+	leaseRepository := infrastructure.NewInMemoryLeaseRepository()
+	clientRepository := infrastructure.NewInMemoryClientRepository()
+	statsRetention := infrastructure.StatsRetention{
+		Minutes: projectionConfig.StatsRetention,
+		Hours:   projectionConfig.HourlyStatsRetention,
+		Days:    projectionConfig.DailyStatsRetention,
+	}
+	readModel := infrastructure.NewCachedReadModel(infrastructure.NewInMemoryReadModel().WithStatsRetention(statsRetention).WithUnknownEventPolicy(infrastructure.UnknownEventPolicy(projectionConfig.UnknownEvents)), projectionConfig.CacheTTL)
+	stores := migration.Stores{
+		Events:    eventStore,
+		Rules:     ruleRepository,
+		Overrides: overrideRepository,
+		Freezes:   freezeRepository,
+		Rollouts:  rolloutRepository,
+		Leases:    leaseRepository,
+		Clients:   clientRepository,
+	}
+	if *importPath != "" {
+		// The projection rebuilds the read model from the imported events
+		importState(*importPath, stores)
+	}
+	eventBus := infrastructure.NewEventBus().WithSubscriberOptions(infrastructure.SubscriberOptions{
+		BufferSize: eventBusConfig.BufferSize,
+		Policy:     infrastructure.BackpressurePolicy(eventBusConfig.Policy),
+		Timeout:    eventBusConfig.BlockTimeout,
+	})
 	
 	// Initialize CQRS handlers
-	commandHandler := handlers.NewRateLimitCommandHandler(eventStore, ruleRepository)
-	queryHandler := handlers.NewRateLimitQueryHandler(readModel, ruleRepository)
+	// Decisions save their events in batches, one round trip each, when
+	// write batching is on
+	var decisionEvents handlers.EventStore = eventStore
+	var writeBatcher *infrastructure.WriteBatcher
+	if writeBatchConfig.Enabled {
+		writeBatcher = infrastructure.NewWriteBatcher(eventStore, writeBatchConfig.FlushInterval, writeBatchConfig.MaxBatch)
+		decisionEvents = writeBatcher
+		fmt.Printf("Batching event saves: up to %d per batch, each saved within %s\n", writeBatchConfig.MaxBatch, writeBatchConfig.FlushInterval)
+	}
+	commandHandler := handlers.NewRateLimitCommandHandler(decisionEvents, ruleRepository).
+		WithOverrideRepository(overrideRepository).
+		WithFreezeRepository(freezeRepository).
+		WithRolloutRepository(rolloutRepository).
+		WithLeaseRepository(leaseRepository).
+		WithClientRepository(clientRepository).
+		WithMaxRefunds(refundConfig.MaxPerWindow)
+	if outboxConfig.Enabled {
+		// Stored events reach the bus through the outbox relay instead
+		eventStore.WithOutbox()
+		relay := infrastructure.NewOutboxRelay(eventStore, eventBus, outboxConfig.RelayInterval, outboxConfig.BatchSize)
+		go relay.Run(context.Background())
+	} else {
+		commandHandler.WithEventPublisher(eventBus)
+	}
+	if counterStore := setupCounterStore(counterConfig); counterStore != nil {
+		commandHandler.WithCounterStore(counterStore)
+	}
+	var aggregateCache *infrastructure.AggregateCache
+	if aggregateCacheConfig.Size > 0 {
+		// Decide recently decided keys without loading their events
+		aggregateCache = infrastructure.NewAggregateCache(aggregateCacheConfig.Size)
+		commandHandler.WithAggregateCache(aggregateCache)
+	}
+	pseudonymizer := setupPrivacy(privacyConfig)
+	// History, stats and activity queries are answered by read replicas
+	// within their staleness bounds when there are any
+	var queryReadModel handlers.ReadModel = readModel
+	readReplicas := setupReadReplicas(readReplicaConfig, projectionConfig, statsRetention, eventStore, readModel)
+	if readReplicas != nil {
+		queryReadModel = readReplicas
+	}
+	queryHandler := handlers.NewRateLimitQueryHandler(queryReadModel, ruleRepository).
+		WithOverrideRepository(overrideRepository).
+		WithFreezeRepository(freezeRepository).
+		WithRolloutRepository(rolloutRepository).
+		WithLeaseRepository(leaseRepository).
+		WithClientRepository(clientRepository).
+		WithEventStore(eventStore).
+		WithPseudonymizer(pseudonymizer)
+	if flags := setupFeatureFlags(featureFlagConfig); flags != nil {
+		commandHandler.WithFlagEvaluator(flags)
+		queryHandler.WithFlagEvaluator(flags)
+	}
 	
-	// Initialize service and HTTP handler
-	service := api.NewRateLimiterService(commandHandler, queryHandler)
-	httpHandler := api.NewHTTPHandler(service)
+	// Initialize service and HTTP handler, counting decisions by resource,
+	// tenant and algorithm for the metrics
+	decisionMetrics := infrastructure.NewDecisionMetrics(ruleRepository, clientRepository)
+	service := api.NewRateLimiterService(commandHandler, queryHandler).WithDecisionRecorder(decisionMetrics).WithPseudonymizer(pseudonymizer).
+		WithBudgetGrants(grantConfig.MaxRequests, grantConfig.TTL).
+		WithLeases(leaseConfig.MaxTokens, leaseConfig.MaxTTL).
+		WithFailurePolicy(setupFailurePolicy(storageFailureConfig)).
+		WithRuleIndex(ruleRepository).
+		WithDecisionDeadline(decisionConfig.Deadline).
+		WithRuleSimulation(eventStore)
+	var blockedCache *infrastructure.BlockedCache
+	if blockedCacheConfig.Size > 0 {
+		// Deny blocked clients from cache until their blocks end or a reset
+		// or refund published on the event bus lifts them
+		blockedCache = infrastructure.NewBlockedCache(blockedCacheConfig.Size)
+		service.WithBlockedCache(blockedCache)
+		go blockedCache.Watch(context.Background(), eventBus.Subscribe("*"))
+	}
+	httpHandler := api.NewHTTPHandler(service).
+		WithDeniedTemplates(setupDeniedTemplates(deniedResponseConfig)).
+		WithV1Deprecation(api.Deprecation{At: apiConfig.V1DeprecatedAt, Sunset: apiConfig.V1Sunset})
 	
-	// Setup event projection to read model
-	go setupEventProjection(eventBus, readModel)
+	// Project stored events to the read model, waking on each published event
+	projection := infrastructure.NewReadModelProjection(eventStore, readModel, projectionConfig.PollInterval).
+		WithCatchUp(projectionConfig.CatchUpThreshold, projectionConfig.CatchUpBatchSize).
+		WithNotifications(eventBus.Subscribe("*"))
+	go projection.Run(context.Background())
 	
-	// Create some default rules for demonstration
-	setupDefaultRules(service)
+	// Alert when clients reach the soft threshold of a rule
+	notifier := infrastructure.NewWebhookNotifier(os.Stdout, alertConfig.WebhookURL, alertConfig.DedupeWindow)
+	go notifier.Run(context.Background())
+	go notifier.NotifyThresholds(context.Background(), eventBus.Subscribe("RateLimitThresholdReached"))
 	
-	// Setup HTTP routes
-	mux := httpHandler.SetupRoutes()
+	// Create some default rules for demonstration, unless starting from
+	// imported state
+	if *importPath == "" {
+		setupDefaultRules(service)
+	}
 	
-	// Add middleware for logging and CORS
-	handler := loggingMiddleware(corsMiddleware(mux))
+	// Load hot state into memory before reporting ready
+	warmStart := setupWarmStart(warmStartConfig, eventStore)
+	go warmStart.Run(context.Background())
+	
+	// Setup HTTP routes. With an admin listener, the data listener serves
+	// only the checks and health, and the admin listener everything else.
+	mux := http.NewServeMux()
+	adminMux := mux
+	if adminConfig.Addr != "" {
+		adminMux = http.NewServeMux()
+	}
+	httpHandler.RegisterDataRoutes(mux)
+	httpHandler.RegisterAdminRoutes(adminMux)
+	healthHandler := api.NewHealthHTTPHandler(projection, projectionConfig.MaxReadyLag.Seconds()).WithEventBus(eventBus).WithKeyStore(eventStore).WithDecisions(decisionMetrics).WithUnknownEvents(readModel).WithWarmStart(warmStart).WithDegraded(service)
+	if blockedCache != nil {
+		healthHandler.WithBlockedCache(blockedCache)
+	}
+	if aggregateCache != nil {
+		healthHandler.WithAggregateCache(aggregateCache)
+	}
+	if writeBatcher != nil {
+		healthHandler.WithWriteBatcher(writeBatcher)
+	}
+	if readReplicas != nil {
+		healthHandler.WithReadReplicas(readReplicas)
+	}
+	healthHandler.RegisterRoutes(mux)
+	if adminMux != mux {
+		healthHandler.RegisterRoutes(adminMux)
+	}
+	api.NewEventBusHTTPHandler(eventBus, eventStore).RegisterRoutes(adminMux)
+	api.NewEventDumpHTTPHandler(eventStore, eventStore).WithEventPublisher(eventBus).RegisterRoutes(adminMux)
+	api.NewClientHTTPHandler(service).RegisterRoutes(adminMux)
+	graphQLHandler, err := api.NewGraphQLHTTPHandler(service)
+	if err != nil {
+		log.Fatalf("Error creating GraphQL schema: %v", err)
+	}
+	graphQLHandler.RegisterRoutes(adminMux)
+	api.NewEventStreamHTTPHandler(eventBus).RegisterRoutes(adminMux)
+	console.RegisterRoutes(adminMux)
+	
+	// Elect the instance that runs leader-only background workers, failing
+	// over to another when it stops renewing its lock
+	elector := locks.NewElector(setupLockProvider(lockConfig), "rate-limiter", lockConfig.Identity, lockConfig.TTL)
+	go elector.Run(context.Background())
+	api.NewClusterHTTPHandler(lockConfig.Backend, elector).RegisterRoutes(adminMux)
+	if pseudonymizer.Enabled() && privacyConfig.LookupToken != "" {
+		api.NewPrivacyHTTPHandler(pseudonymizer, privacyConfig.LookupToken).RegisterRoutes(adminMux)
+	}
+	
+	// Export events to the analytics store when configured
+	if analyticsConfig.ClickHouseURL != "" {
+		setupAnalytics(analyticsConfig, eventBus, adminMux, pseudonymizer)
+	}
+	
+	// Push decision counters to a Prometheus remote-write endpoint when configured
+	if remoteWriteConfig.URL != "" {
+		go setupRemoteWrite(remoteWriteConfig, decisionMetrics).Run(context.Background())
+	}
+	
+	// Advance, promote or roll back rule rollouts by their cohorts' deny rates
+	go infrastructure.NewRolloutEvaluator(service, rolloutConfig.EvaluationInterval).Run(context.Background())
+	go infrastructure.NewLeaseExpirer(service, leaseConfig.ExpiryInterval).Run(context.Background())
+	go infrastructure.NewStatsRollup(readModel.InMemoryReadModel, projectionConfig.StatsRollupInterval).Run(context.Background())
+	
+	// Add middleware for access logging and CORS
+	accessLogger := accesslog.NewLogger(accesslog.NewJSONSink(os.Stdout), accessLogConfig.SampleRate).WithPseudonymizer(pseudonymizer)
+	handler := accesslog.Middleware(accessLogger, corsMiddleware(mux))
+	
+	server, err := api.NewServer(cfg, handler)
+	if err != nil {
+		log.Fatalf("Invalid server configuration: %v", err)
+	}
 	
 	// Start server
-	addr := ":8080"
-	fmt.Printf("Rate Limiter server starting on %s\n", addr)
+	fmt.Printf("Rate Limiter server starting on %s\n", cfg.Addr)
 	fmt.Println("Available endpoints:")
 	fmt.Println("  POST /api/v1/ratelimit/check")
+	fmt.Println("  POST /api/v1/ratelimit/check-all")
+	fmt.Println("  POST /api/v1/ratelimit/peek")
 	fmt.Println("  GET  /api/v1/ratelimit/status")
+	fmt.Println("  GET  /api/v1/ratelimit/explain")
 	fmt.Println("  GET  /api/v1/ratelimit/history")
 	fmt.Println("  GET  /api/v1/ratelimit/stats")
-	fmt.Println("  POST /api/v1/ratelimit/rules")
+	fmt.Println("  GET|POST /api/v1/ratelimit/rules")
+	fmt.Println("  POST /api/v1/ratelimit/rules/simulate")
 	fmt.Println("  POST /api/v1/ratelimit/reset")
+	fmt.Println("  POST /api/v1/ratelimit/refund")
+	fmt.Println("  GET|POST|DELETE /api/v1/ratelimit/overrides")
+	fmt.Println("  GET|POST|DELETE /api/v1/ratelimit/freezes")
+	fmt.Println("  GET|POST /api/v1/ratelimit/rollouts")
+	fmt.Println("  POST /api/v1/ratelimit/rollouts/{promote,rollback}")
+	fmt.Println("  GET|POST /api/v1/ratelimit/leases")
+	fmt.Println("  POST /api/v1/ratelimit/leases/renew")
+	fmt.Println("  GET|POST /api/v1/clients")
+	fmt.Println("  GET|PUT|DELETE /api/v1/clients/{id}")
+	fmt.Println("  POST /api/v1/clients/{id}/{disable,enable}")
+	fmt.Println("  DELETE /api/v1/clients/{id}/data")
+	fmt.Println("  GET  /api/v1/erasures/{id}")
+	fmt.Println("  GET  /readyz")
+	fmt.Println("  GET  /metrics")
+	fmt.Println("  GET  /api/v1/eventbus/subscribers")
+	fmt.Println("  POST /api/v1/eventbus/subscribers/{id}/{pause,resume,replay}")
+	fmt.Println("  GET  /api/v1/admin/events/dump")
+	fmt.Println("  POST /api/v1/admin/events/import")
+	fmt.Println("  GET|POST /graphql")
+	fmt.Println("  GET  /api/v1/events/stream")
+	fmt.Println("  GET  /console")
+	fmt.Println("  GET  /api/v1/admin/cluster")
+	if pseudonymizer.Enabled() && privacyConfig.LookupToken != "" {
+		fmt.Println("  POST /api/v1/admin/privacy/lookup")
+	}
+	if analyticsConfig.ClickHouseURL != "" {
+		fmt.Println("  GET  /api/v1/analytics/history")
+		fmt.Println("  GET  /api/v1/analytics/stats")
+	}
+	
+	// Serve the admin and query endpoints on their own listener when
+	// configured, so that they can be firewalled off from the checks
+	if adminMux != mux {
+		public := []string{"/readyz", "/api/v1/admin/privacy/lookup"}
+		adminHandler := accesslog.Middleware(accessLogger, corsMiddleware(api.AdminAuthMiddleware(adminConfig.Token, public, adminMux)))
+		adminServer, err := api.NewServer(adminConfig.ServerConfig, adminHandler)
+		if err != nil {
+			log.Fatalf("Invalid admin server configuration: %v", err)
+		}
+		go func() {
+			log.Fatal(adminServer.ListenAndServe())
+		}()
+		fmt.Printf("Admin server starting on %s; only checks, refunds, leases and health are served on %s\n", adminConfig.Addr, cfg.Addr)
+	}
+	
+	// Track which clients are denied, for gateways to deny them locally,
+	// when they can be told over gRPC streams or Redis
+	var denialNotifier *sidecar.Notifier
+	if grpcConfig.Addr != "" || noticeConfig.RedisAddr != "" {
+		denialNotifier = sidecar.NewNotifier()
+		go denialNotifier.Run(context.Background(), eventBus.Subscribe("*"))
+	}
+	if noticeConfig.RedisAddr != "" {
+		publisher := sidecar.NewRedisPublisher(noticeConfig)
+		denialNotifier.WatchAll(publisher)
+		go publisher.Run(context.Background())
+		fmt.Printf("Publishing notices about denied clients to Redis at %s\n", noticeConfig.RedisAddr)
+	}
+	
+	// Serve gRPC health checking, reflection and the check stream for
+	// gateways when configured
+	if grpcConfig.Addr != "" {
+		grpcServer := api.NewGRPCServer(grpcConfig, projection, projectionConfig.MaxReadyLag.Seconds(), grpc.ForceServerCodec(sidecar.Codec{})).WithWarmStart(warmStart)
+		sidecar.NewStreamServer(service, denialNotifier).WithAccessLog(accessLogger).Register(grpcServer.Server)
+		go grpcServer.WatchReadiness(context.Background(), time.Second)
+		go func() {
+			log.Fatal(grpcServer.ListenAndServe())
+		}()
+		fmt.Printf("gRPC server starting on %s (grpc.health.v1, reflection, ratelimit.v1.CheckStream)\n", grpcConfig.Addr)
+	}
 	
-	log.Fatal(http.ListenAndServe(addr, handler))
+	// Answer checks from a co-located process over the binary sidecar
+	// protocol when configured
+	if sidecarConfig.Addr != "" {
+		sidecarServer := sidecar.NewServer(sidecarConfig, service).WithAccessLog(accessLogger)
+		go func() {
+			log.Fatal(sidecarServer.ListenAndServe())
+		}()
+		fmt.Printf("Sidecar server starting on %s\n", sidecarConfig.Addr)
+	}
+	
+	// Stop and export the state for a migration when asked to
+	var exported <-chan struct{}
+	if *exportPath != "" {
+		stores.ReadModel = readModel.InMemoryReadModel
+		exported = exportOnSignal(*exportPath, server, projection, stores)
+	}
+	
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) && exported != nil {
+		<-exported
+		return
+	}
+	log.Fatal(err)
+}
+
+// importState restores the state of an export file into stores before
+// serving
+func importState(path string, stores migration.Stores) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Error opening export file: %v", err)
+	}
+	defer file.Close()
+	
+	digest, err := migration.Import(context.Background(), file, stores)
+	if err != nil {
+		log.Fatalf("Error importing %s: %v", path, err)
+	}
+	events, _ := digest.Section(migration.KindEvents)
+	rules, _ := digest.Section(migration.KindRules)
+	fmt.Printf("Imported %d events and %d rules from %s\n", events.Count, rules.Count, path)
 }
 
-// setupEventProjection sets up event projection from command side to query side
-func setupEventProjection(eventBus *infrastructure.EventBus, readModel *infrastructure.InMemoryReadModel) {
-	// Subscribe to all events
+// exportOnSignal stops serving HTTP on SIGINT or SIGTERM and, once the read
+// model has caught up, exports the state held by stores to path. The file
+// is written aside and renamed into place. The returned channel is closed
+// once the state is exported.
+func exportOnSignal(path string, server *api.Server, projection *infrastructure.ReadModelProjection, stores migration.Stores) <-chan struct{} {
+	exported := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	
+	go func() {
+		<-signals
+		fmt.Printf("Stopping to export the state to %s\n", path)
+		
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error stopping server: %v", err)
+		}
+		for {
+			lag, err := projection.Lag(ctx)
+			if err != nil {
+				log.Fatalf("Error exporting state: %v", err)
+			}
+			if lag.Pending == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		
+		file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+		if err != nil {
+			log.Fatalf("Error exporting state: %v", err)
+		}
+		digest, err := migration.Export(ctx, stores, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), path)
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			log.Fatalf("Error exporting state: %v", err)
+		}
+		
+		events, _ := digest.Section(migration.KindEvents)
+		fmt.Printf("Exported %d events and the other state to %s\n", events.Count, path)
+		close(exported)
+	}()
+	return exported
+}
+
+// setupAnalytics starts the ClickHouse exporter and serves long-range
+// history and statistics from it
+func setupAnalytics(analyticsConfig config.AnalyticsConfig, eventBus *infrastructure.EventBus, mux *http.ServeMux, pseudonymizer *privacy.Pseudonymizer) {
+	client, err := infrastructure.NewClickHouseClient(analyticsConfig.ClickHouseURL)
+	if err != nil {
+		log.Fatalf("Error creating clickhouse client: %v", err)
+	}
+	
+	sink, err := infrastructure.NewClickHouseEventSink(client, analyticsConfig.Table, analyticsConfig.BatchSize, analyticsConfig.FlushInterval)
+	if err != nil {
+		log.Fatalf("Error creating clickhouse exporter: %v", err)
+	}
+	if err := sink.EnsureSchema(context.Background(), analyticsConfig.RetentionDays); err != nil {
+		log.Printf("Error creating clickhouse schema: %v", err)
+	}
+	
+	store, err := infrastructure.NewClickHouseAnalyticsStore(client, analyticsConfig.Table)
+	if err != nil {
+		log.Fatalf("Error creating clickhouse analytics store: %v", err)
+	}
+	
 	events := eventBus.Subscribe("*")
+	go func() {
+		for event := range events {
+			sink.Export(event)
+		}
+	}()
+	go sink.Run(context.Background())
 	
-	for event := range events {
-		ctx := context.Background()
-		if err := readModel.UpdateFromEvent(ctx, event); err != nil {
-			log.Printf("Error updating read model from event: %v", err)
+	analyticsHandler := api.NewAnalyticsHTTPHandler(handlers.NewAnalyticsQueryHandler(store)).WithPseudonymizer(pseudonymizer)
+	analyticsHandler.RegisterRoutes(mux)
+}
+
+// setupRemoteWrite creates the exporter pushing decision counters to the
+// remote-write endpoint
+func setupRemoteWrite(remoteWriteConfig config.RemoteWriteConfig, decisionMetrics *infrastructure.DecisionMetrics) *infrastructure.RemoteWriteExporter {
+	fmt.Printf("Pushing decision metrics to %s every %s\n", remoteWriteConfig.URL, remoteWriteConfig.Interval)
+	return infrastructure.NewRemoteWriteExporter(remoteWriteConfig.URL, remoteWriteConfig.Interval, decisionMetrics).
+		WithLabels(remoteWriteConfig.Labels).
+		WithBasicAuth(remoteWriteConfig.Username, remoteWriteConfig.Password).
+		WithBearerToken(remoteWriteConfig.BearerToken)
+}
+
+// setupPrivacy creates the pseudonymizer of privacy mode, or nil when it is
+// off
+func setupPrivacy(privacyConfig config.PrivacyConfig) *privacy.Pseudonymizer {
+	if !privacyConfig.Enabled {
+		return nil
+	}
+	fmt.Println("Privacy mode: client IDs, IP addresses and user agents are stored as keyed hashes")
+	return privacy.NewPseudonymizer([]byte(privacyConfig.Key))
+}
+
+// setupFeatureFlags creates the evaluator of the feature flags gating rules
+// with the configured provider, or returns nil when none is configured
+func setupFeatureFlags(featureFlagConfig config.FeatureFlagConfig) handlers.FlagEvaluator {
+	switch {
+	case featureFlagConfig.File != "":
+		provider, err := featureflags.NewFileProvider(featureFlagConfig.File)
+		if err != nil {
+			log.Fatalf("Error loading feature flags: %v", err)
+		}
+		go provider.Run(context.Background(), featureFlagConfig.RefreshInterval)
+		fmt.Printf("Evaluating feature flags from %s, read every %s\n", featureFlagConfig.File, featureFlagConfig.RefreshInterval)
+		return featureflags.NewEvaluator(provider)
+	case featureFlagConfig.OFREPURL != "":
+		provider := featureflags.NewOFREPProvider(featureFlagConfig.OFREPURL, featureFlagConfig.OFREPToken, featureFlagConfig.Timeout, featureFlagConfig.CacheTTL)
+		fmt.Printf("Evaluating feature flags with the OFREP service at %s\n", featureFlagConfig.OFREPURL)
+		return featureflags.NewEvaluator(provider)
+	default:
+		return nil
+	}
+}
+
+// setupReadReplicas creates the read model routing queries to read replicas
+// within the staleness bounds of their query types, or nil when there are no
+// replicas. Each replica is a read model of its own tailing the event store,
+// standing in for a replica of a SQL or Redis read model.
+func setupReadReplicas(readReplicaConfig config.ReadReplicaConfig, projectionConfig config.ProjectionConfig, statsRetention infrastructure.StatsRetention, eventStore infrastructure.EventStream, primary infrastructure.PrimaryReadModel) *infrastructure.ReplicatedReadModel {
+	if readReplicaConfig.Replicas == 0 {
+		return nil
+	}
+	replicas := make([]infrastructure.ReadReplica, 0, readReplicaConfig.Replicas)
+	for i := 1; i <= readReplicaConfig.Replicas; i++ {
+		readModel := infrastructure.NewInMemoryReadModel().WithStatsRetention(statsRetention).WithUnknownEventPolicy(infrastructure.UnknownEventPolicy(projectionConfig.UnknownEvents))
+		projection := infrastructure.NewReadModelProjection(eventStore, readModel, readReplicaConfig.PollInterval).
+			WithCatchUp(projectionConfig.CatchUpThreshold, projectionConfig.CatchUpBatchSize)
+		go projection.Run(context.Background())
+		go infrastructure.NewStatsRollup(readModel, projectionConfig.StatsRollupInterval).Run(context.Background())
+		replicas = append(replicas, infrastructure.ReadReplica{Name: fmt.Sprintf("replica-%d", i), ReadModel: readModel, Lag: projection})
+	}
+	maxStaleness := make(map[infrastructure.ReadQuery]time.Duration, len(readReplicaConfig.MaxStaleness))
+	for query, staleness := range readReplicaConfig.MaxStaleness {
+		maxStaleness[infrastructure.ReadQuery(query)] = staleness
+	}
+	readReplicas := infrastructure.NewReplicatedReadModel(primary, replicas, maxStaleness)
+	go readReplicas.Run(context.Background(), readReplicaConfig.LagInterval)
+	fmt.Printf("Answering read model queries from %d read replica(s) within %v\n", len(replicas), readReplicaConfig.MaxStaleness)
+	return readReplicas
+}
+
+// setupCounterStore creates the shared counter store selected by the configuration
+func setupCounterStore(counterConfig config.CounterConfig) handlers.CounterStore {
+	switch counterConfig.Backend {
+	case "memory":
+		return infrastructure.NewInMemoryCounterStore()
+	case "memcached":
+		counterStore, err := infrastructure.NewMemcachedCounterStore(counterConfig.MemcachedServers)
+		if err != nil {
+			log.Fatalf("Error creating memcached counter store: %v", err)
 		}
+		return counterStore
+	default:
+		return nil
 	}
 }
 
@@ -71,19 +669,19 @@ func setupDefaultRules(service *api.RateLimiterService) {
 	ctx := context.Background()
 	
 	// API rate limit: 100 requests per minute
-	err := service.CreateRule(ctx, "api", 100, time.Minute, "sliding_window")
+	err := service.CreateRule(ctx, api.RuleSpec{Resource: "api", Limit: 100, Window: time.Minute, Algorithm: "sliding_window"})
 	if err != nil {
 		log.Printf("Error creating API rule: %v", err)
 	}
 	
 	// Login rate limit: 5 attempts per 15 minutes
-	err = service.CreateRule(ctx, "login", 5, 15*time.Minute, "fixed_window")
+	err = service.CreateRule(ctx, api.RuleSpec{Resource: "login", Limit: 5, Window: 15 * time.Minute, Algorithm: "fixed_window"})
 	if err != nil {
 		log.Printf("Error creating login rule: %v", err)
 	}
 	
 	// Upload rate limit: 10 uploads per hour
-	err = service.CreateRule(ctx, "upload", 10, time.Hour, "sliding_window")
+	err = service.CreateRule(ctx, api.RuleSpec{Resource: "upload", Limit: 10, Window: time.Hour, Algorithm: "sliding_window"})
 	if err != nil {
 		log.Printf("Error creating upload rule: %v", err)
 	}
@@ -94,21 +692,6 @@ func setupDefaultRules(service *api.RateLimiterService) {
 	fmt.Println("  - upload: 10 uploads/hour (sliding window)")
 }
 
-// loggingMiddleware logs HTTP requests
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// Create a response writer wrapper to capture status code
-		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		
-		next.ServeHTTP(wrapper, r)
-		
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapper.statusCode, duration)
-	})
-}
-
 // corsMiddleware adds CORS headers
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -125,13 +708,101 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
+// setupLockProvider creates the lock provider selected by the configuration
+func setupLockProvider(lockConfig config.LockConfig) locks.Provider {
+	switch lockConfig.Backend {
+	case "redis":
+		provider, err := locks.NewRedisProvider(lockConfig.Addrs)
+		if err != nil {
+			log.Fatalf("Error creating redis lock provider: %v", err)
+		}
+		return provider.WithPassword(lockConfig.RedisPassword)
+	case "etcd":
+		provider, err := locks.NewEtcdProvider(lockConfig.Addrs, nil)
+		if err != nil {
+			log.Fatalf("Error creating etcd lock provider: %v", err)
+		}
+		return provider
+	case "postgres":
+		provider, err := locks.NewPostgresProvider(lockConfig.Addrs[0])
+		if err != nil {
+			log.Fatalf("Error creating postgres lock provider: %v", err)
+		}
+		return provider
+	case "kubernetes":
+		// In-cluster unless an API URL is given, e.g. with `kubectl proxy`
+		namespace := lockConfig.Namespace
+		if namespace == "" {
+			namespace = rulesync.InClusterNamespace()
+		}
+		if len(lockConfig.Addrs) > 0 {
+			return locks.NewKubeLeaseProvider(lockConfig.Addrs[0], os.Getenv("KUBE_TOKEN"), nil, namespace, lockConfig.Identity)
+		}
+		baseURL, token, httpClient, err := rulesync.InClusterConfig()
+		if err != nil {
+			log.Fatalf("Error creating kubernetes lock provider: %v", err)
+		}
+		return locks.NewKubeLeaseProvider(baseURL, token, httpClient, namespace, lockConfig.Identity)
+	default:
+		return locks.NewInMemoryProvider()
+	}
 }
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+// setupDeniedTemplates loads the templates of denied response bodies, or
+// returns nil to leave denials to the default bodies
+func setupDeniedTemplates(deniedResponseConfig config.DeniedResponseConfig) *denial.Templates {
+	if deniedResponseConfig.Templates == "" {
+		return nil
+	}
+	templates, err := denial.Load(deniedResponseConfig.Templates)
+	if err != nil {
+		log.Fatalf("Invalid denied response templates: %v", err)
+	}
+	return templates
+}
+
+// setupWarmStart creates the warm start, preloading the recently active
+// aggregates when the event store decodes their events on loading
+func setupWarmStart(warmStartConfig config.WarmStartConfig, eventStore handlers.EventStore) *infrastructure.WarmStart {
+	warmStart := infrastructure.NewWarmStart(warmStartConfig.Timeout)
+	if preloader, ok := eventStore.(infrastructure.AggregatePreloader); ok && warmStartConfig.MaxKeys > 0 {
+		warmStart.Add("aggregates", infrastructure.PreloadRecentAggregates(preloader, warmStartConfig.Window, warmStartConfig.MaxKeys))
+	}
+	return warmStart
+}
+
+// setupFailurePolicy creates the policy deciding checks while storage is
+// unavailable from its configuration
+func setupFailurePolicy(storageFailureConfig config.StorageFailureConfig) api.FailurePolicy {
+	policy := api.FailurePolicy{
+		Mode:      api.FailureMode(storageFailureConfig.Mode),
+		Resources: make(map[string]api.FailureMode, len(storageFailureConfig.Resources)),
+	}
+	for resource, mode := range storageFailureConfig.Resources {
+		policy.Resources[resource] = api.FailureMode(mode)
+	}
+	if policy.Mode != api.FailError || len(policy.Resources) > 0 {
+		fmt.Printf("Storage failures decided fail-%s, with %d resource override(s)\n", policy.Mode, len(policy.Resources))
+	}
+	return policy
+}
+
+// validateConfig checks the configuration as it would be loaded at startup,
+// the storage and services it names and the rules files, prints a report
+// and exits, non-zero when a check failed
+func validateConfig(defaultAddr, rulesFiles string, checkRules func(r *configcheck.Report, path string)) {
+	var report configcheck.Report
+	env := configcheck.CheckEnvironment(&report, defaultAddr)
+	configcheck.CheckConnectivity(context.Background(), &report, env)
+	if rulesFiles != "" {
+		for _, path := range strings.Split(rulesFiles, ",") {
+			checkRules(&report, path)
+		}
+	}
+	
+	report.Print(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }
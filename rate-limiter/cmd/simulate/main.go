@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+	"github.com/NickChunglolz/rate-limiter/internal/simulate"
+)
+
+// resource is the resource the simulated rule limits
+const resource = "simulate"
+
+func main() {
+	algorithm := flag.String("algorithm", "sliding_window", "Rate limiting algorithm")
+	limit := flag.Int("limit", 10, "Requests allowed per window")
+	window := flag.Duration("window", time.Second, "Rate limit window")
+	counters := flag.Bool("counters", false, "Decide fixed and sliding window counter requests with the counter store")
+	profilePath := flag.String("profile", "", "Recorded profile to replay (JSON lines with client_id and offset_ms or time)")
+	clients := flag.Int("clients", 10, "Synthetic clients")
+	rate := flag.Float64("rate", 20, "Requests per second per synthetic client")
+	pattern := flag.String("pattern", simulate.PatternSteady, "Synthetic traffic pattern: steady, burst or ramp")
+	burstSize := flag.Int("burst-size", 20, "Extra requests per burst (burst pattern)")
+	burstEvery := flag.Duration("burst-every", 2*time.Second, "Time between bursts (burst pattern)")
+	duration := flag.Duration("duration", 5*time.Second, "Length of the synthetic profile")
+	jitter := flag.Float64("jitter", 0.2, "Random spread of synthetic request times, as a fraction of the interval")
+	seed := flag.Int64("seed", 1, "Random seed for the synthetic profile")
+	workers := flag.Int("workers", 32, "Concurrent decisions")
+	jsonOutput := flag.Bool("json", false, "Print the report as JSON")
+	flag.Parse()
+
+	requests, err := loadRequests(*profilePath, simulate.ProfileConfig{
+		Clients:    *clients,
+		Rate:       *rate,
+		Pattern:    *pattern,
+		BurstSize:  *burstSize,
+		BurstEvery: *burstEvery,
+		Duration:   *duration,
+		Jitter:     *jitter,
+		Seed:       *seed,
+	})
+	if err != nil {
+		log.Fatalf("Invalid traffic profile: %v", err)
+	}
+
+	// Build the limiter in-process, projecting synchronously so every
+	// decision sees the previous one
+	contention := &simulate.Contention{}
+	eventStore := simulate.NewInstrumentedEventStore(infrastructure.NewInMemoryEventStore(), contention)
+	ruleRepository := infrastructure.NewInMemoryRuleRepository()
+	readModel := infrastructure.NewInMemoryReadModel()
+
+	commandHandler := handlers.NewRateLimitCommandHandler(eventStore, ruleRepository).
+		WithEventPublisher(infrastructure.NewReadModelPublisher(readModel))
+	if *counters {
+		commandHandler.WithCounterStore(simulate.NewInstrumentedCounterStore(infrastructure.NewInMemoryCounterStore(), contention))
+	}
+	queryHandler := handlers.NewRateLimitQueryHandler(readModel, ruleRepository)
+	service := api.NewRateLimiterService(commandHandler, queryHandler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := service.CreateRule(ctx, api.RuleSpec{Resource: resource, Limit: *limit, Window: *window, Algorithm: *algorithm}); err != nil {
+		log.Fatalf("Error creating rule: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Replaying %d requests against %s (%d per %v)\n", len(requests), *algorithm, *limit, *window)
+
+	runner := simulate.NewRunner(func(ctx context.Context, clientID string) (bool, error) {
+		status, err := service.CheckRateLimit(ctx, clientID, resource, "", "")
+		if err != nil {
+			return false, err
+		}
+		return status.IsAllowed, nil
+	}, *workers)
+
+	report := simulate.Summarize(runner.Run(ctx, requests), *limit, *window)
+	report.Contention = contention.Stats()
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+	report.Write(os.Stdout)
+}
+
+// loadRequests reads the recorded profile at path, or generates a synthetic
+// one when path is empty
+func loadRequests(path string, cfg simulate.ProfileConfig) ([]simulate.Request, error) {
+	if path == "" {
+		return simulate.Synthetic(cfg)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile: %w", err)
+	}
+	defer file.Close()
+
+	return simulate.LoadProfile(file)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// resource is the resource the benchmark rule limits
+const resource = "bench"
+
+// storebench measures decision and status query throughput of the in-memory
+// stores under concurrent load from many clients
+func main() {
+	algorithm := flag.String("algorithm", "fixed_window", "Rate limiting algorithm")
+	clients := flag.Int("clients", 1000, "Distinct clients")
+	workers := flag.Int("workers", 4*runtime.GOMAXPROCS(0), "Concurrent callers")
+	duration := flag.Duration("duration", 2*time.Second, "Length of each phase")
+	latency := flag.Duration("latency", 0, "Round trip added to each event store write, as to a persistent backend")
+	connections := flag.Int("connections", 10, "Event store writes in flight at once, as over a connection pool, when latency is set")
+	batchInterval := flag.Duration("batch-interval", 0, "Save events in batches flushed within this interval; 0 saves each decision on its own")
+	batchSize := flag.Int("batch-size", 256, "Saves that fill a batch")
+	aggregateCache := flag.Int("aggregate-cache", 0, "Aggregates held by the aggregate cache; 0 loads every aggregate from the event store")
+	flag.Parse()
+
+	eventStore := &remoteEventStore{
+		InMemoryEventStore: infrastructure.NewInMemoryEventStore(),
+		latency:            *latency,
+		connections:        make(chan struct{}, *connections),
+	}
+	ruleRepository := infrastructure.NewInMemoryRuleRepository()
+	readModel := infrastructure.NewInMemoryReadModel()
+
+	var decisionEvents handlers.EventStore = eventStore
+	if *batchInterval > 0 {
+		decisionEvents = infrastructure.NewWriteBatcher(eventStore, *batchInterval, *batchSize)
+	}
+	commandHandler := handlers.NewRateLimitCommandHandler(decisionEvents, ruleRepository).
+		WithEventPublisher(infrastructure.NewReadModelPublisher(readModel))
+	if *aggregateCache > 0 {
+		commandHandler.WithAggregateCache(infrastructure.NewAggregateCache(*aggregateCache))
+	}
+	queryHandler := handlers.NewRateLimitQueryHandler(readModel, ruleRepository)
+	service := api.NewRateLimiterService(commandHandler, queryHandler)
+
+	ctx := context.Background()
+
+	// A short window keeps each client's event history, which is replayed
+	// on every decision, from dominating the measurement
+	if err := service.CreateRule(ctx, api.RuleSpec{Resource: resource, Limit: 1000000, Window: time.Second, Algorithm: *algorithm}); err != nil {
+		log.Fatalf("Error creating rule: %v", err)
+	}
+
+	fmt.Printf("%d workers, %d clients, %s, GOMAXPROCS %d, write latency %s, batch interval %s, aggregate cache %d\n", *workers, *clients, *algorithm, runtime.GOMAXPROCS(0), *latency, *batchInterval, *aggregateCache)
+	run("decisions", *workers, *clients, *duration, func(clientID string) error {
+		_, err := service.CheckRateLimit(ctx, clientID, resource, "", "")
+		return err
+	})
+	run("status queries", *workers, *clients, *duration, func(clientID string) error {
+		_, err := service.GetRateLimitStatus(ctx, clientID, resource)
+		return err
+	})
+}
+
+// run calls op from workers goroutines for duration, spreading the calls
+// over clients, and prints the throughput
+func run(name string, workers, clients int, duration time.Duration, op func(clientID string) error) {
+	var calls, errors atomic.Int64
+	deadline := time.Now().Add(duration)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; time.Now().Before(deadline); i += workers {
+				if err := op(fmt.Sprintf("client-%d", i%clients)); err != nil {
+					errors.Add(1)
+				}
+				calls.Add(1)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	perSecond := float64(calls.Load()) / duration.Seconds()
+	fmt.Printf("%-15s %10.0f ops/s  %d errors\n", name, perSecond, errors.Load())
+}
+
+// remoteEventStore is an in-memory event store whose writes take a round
+// trip over one of a limited number of connections, as those of a
+// persistent backend do
+type remoteEventStore struct {
+	*infrastructure.InMemoryEventStore
+	latency     time.Duration
+	connections chan struct{}
+}
+
+// SaveEvents saves events after a round trip
+func (s *remoteEventStore) SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	s.roundTrip()
+	return s.InMemoryEventStore.SaveEvents(ctx, aggregateID, events, expectedVersion)
+}
+
+// SaveEventBatch saves the events of a batch after one round trip
+func (s *remoteEventStore) SaveEventBatch(ctx context.Context, writes []infrastructure.EventWrite) []error {
+	s.roundTrip()
+	return s.InMemoryEventStore.SaveEventBatch(ctx, writes)
+}
+
+// roundTrip waits for a connection and the latency of a round trip on it
+func (s *remoteEventStore) roundTrip() {
+	if s.latency <= 0 {
+		return
+	}
+	s.connections <- struct{}{}
+	time.Sleep(s.latency)
+	<-s.connections
+}
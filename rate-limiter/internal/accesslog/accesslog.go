@@ -0,0 +1,221 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
+)
+
+// Decision describes the outcome of a rate limit check
+type Decision string
+
+const (
+	DecisionAllowed       Decision = "allowed"
+	DecisionDenied        Decision = "denied"
+	DecisionBlockedByRule Decision = "blocked_by_rule"
+	DecisionChallenged    Decision = "challenged"
+)
+
+// Entry is a single access log record
+type Entry struct {
+	Time            time.Time     `json:"time"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	Status          int           `json:"status"`
+	Duration        time.Duration `json:"duration_ns"`
+	RemoteAddr      string        `json:"remote_addr"`
+	ClientIP        string        `json:"client_ip"`
+	ClientID        string        `json:"client_id,omitempty"`
+	Resource        string        `json:"resource,omitempty"`
+	Decision        Decision      `json:"decision,omitempty"`
+	MatchedRuleIDs  []string      `json:"matched_rule_ids,omitempty"`
+	BlockingRuleIDs []string      `json:"blocking_rule_ids,omitempty"`
+	Reason          string        `json:"reason,omitempty"`
+	RemainingQuota  *int          `json:"remaining_quota,omitempty"`
+	Transport       string        `json:"transport,omitempty"` // "sidecar" or "grpc" for checks not made over HTTP
+}
+
+// Sink receives access log entries
+type Sink interface {
+	Write(entry Entry) error
+}
+
+// JSONSink writes entries as JSON lines to an io.Writer
+type JSONSink struct {
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+// NewJSONSink creates a new JSON lines sink
+func NewJSONSink(out io.Writer) *JSONSink {
+	return &JSONSink{out: out}
+}
+
+// Write encodes the entry as a single JSON line
+func (s *JSONSink) Write(entry Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return json.NewEncoder(s.out).Encode(entry)
+}
+
+// Logger decides which entries are emitted and forwards them to a sink
+type Logger struct {
+	sink       Sink
+	sampleRate float64
+	random     func() float64
+	privacy    *privacy.Pseudonymizer
+}
+
+// NewLogger creates a logger that emits allowed requests with probability
+// sampleRate. Denied and rule-blocked requests are always emitted, as are
+// requests decided with a reason, such as by a freeze or while storage is
+// unavailable.
+func NewLogger(sink Sink, sampleRate float64) *Logger {
+	if sampleRate < 0 {
+		sampleRate = 0
+	}
+	if sampleRate > 1 {
+		sampleRate = 1
+	}
+
+	return &Logger{
+		sink:       sink,
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+	}
+}
+
+// WithPseudonymizer logs client IDs and addresses as their pseudonyms, as
+// they are stored in privacy mode
+func (l *Logger) WithPseudonymizer(pseudonymizer *privacy.Pseudonymizer) *Logger {
+	l.privacy = pseudonymizer
+	return l
+}
+
+// Log emits the entry if it survives sampling
+func (l *Logger) Log(entry Entry) error {
+	if !l.sampled(entry) {
+		return nil
+	}
+	if l.privacy.Enabled() {
+		entry.ClientID = l.privacy.ClientID(entry.ClientID)
+		entry.ClientIP = l.privacy.IPAddress(entry.ClientIP)
+		if host, _, err := net.SplitHostPort(entry.RemoteAddr); err == nil {
+			entry.RemoteAddr = l.privacy.IPAddress(host)
+		} else {
+			entry.RemoteAddr = l.privacy.IPAddress(entry.RemoteAddr)
+		}
+	}
+	return l.sink.Write(entry)
+}
+
+// sampled reports whether the entry should be emitted
+func (l *Logger) sampled(entry Entry) bool {
+	switch entry.Decision {
+	case DecisionDenied, DecisionBlockedByRule, DecisionChallenged:
+		return true
+	}
+	if entry.Reason != "" || l.sampleRate >= 1 {
+		return true
+	}
+	return l.random() < l.sampleRate
+}
+
+type annotationKey struct{}
+
+// annotation carries decision details from handlers back to the middleware
+type annotation struct {
+	clientID        string
+	resource        string
+	decision        Decision
+	matchedRuleIDs  []string
+	remainingQuota  *int
+	reason          string
+	blockingRuleIDs []string
+}
+
+// Annotate records the decision for the current request. It is a no-op when
+// the request was not routed through Middleware.
+func Annotate(ctx context.Context, clientID, resource string, decision Decision, remainingQuota int, matchedRuleIDs []string) {
+	a, ok := ctx.Value(annotationKey{}).(*annotation)
+	if !ok {
+		return
+	}
+
+	a.clientID = clientID
+	a.resource = resource
+	a.decision = decision
+	a.matchedRuleIDs = matchedRuleIDs
+	a.remainingQuota = &remainingQuota
+}
+
+// AnnotateReason records why the current request was decided the way it was
+// and which rules blocked it, if any
+func AnnotateReason(ctx context.Context, reason string, blockingRuleIDs []string) {
+	a, ok := ctx.Value(annotationKey{}).(*annotation)
+	if !ok {
+		return
+	}
+
+	a.reason = reason
+	a.blockingRuleIDs = blockingRuleIDs
+}
+
+// Middleware wraps next and logs every request through logger
+func Middleware(logger *Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		a := &annotation{}
+		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		next.ServeHTTP(wrapper, r.WithContext(context.WithValue(r.Context(), annotationKey{}, a)))
+
+		entry := Entry{
+			Time:            start,
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			Status:          wrapper.statusCode,
+			Duration:        time.Since(start),
+			RemoteAddr:      r.RemoteAddr,
+			ClientIP:        clientip.FromRequest(r),
+			ClientID:        a.clientID,
+			Resource:        a.resource,
+			Decision:        a.decision,
+			MatchedRuleIDs:  a.matchedRuleIDs,
+			BlockingRuleIDs: a.blockingRuleIDs,
+			Reason:          a.reason,
+			RemainingQuota:  a.remainingQuota,
+		}
+		if err := logger.Log(entry); err != nil {
+			log.Printf("Error writing access log entry: %v", err)
+		}
+	})
+}
+
+// responseWriter wraps http.ResponseWriter to capture status code
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streaming handlers can flush through the access log
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
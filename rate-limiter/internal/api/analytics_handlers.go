@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// maxAnalyticsRange bounds the time range of a single analytics query
+const maxAnalyticsRange = 90 * 24 * time.Hour
+
+// AnalyticsHTTPHandler provides HTTP endpoints for long-range analytics
+type AnalyticsHTTPHandler struct {
+	queryHandler handlers.QueryHandler
+	privacy      *privacy.Pseudonymizer
+}
+
+// NewAnalyticsHTTPHandler creates a new analytics HTTP handler
+func NewAnalyticsHTTPHandler(queryHandler handlers.QueryHandler) *AnalyticsHTTPHandler {
+	return &AnalyticsHTTPHandler{
+		queryHandler: queryHandler,
+	}
+}
+
+// WithPseudonymizer looks up clients by the pseudonyms their exported
+// events carry
+func (h *AnalyticsHTTPHandler) WithPseudonymizer(pseudonymizer *privacy.Pseudonymizer) *AnalyticsHTTPHandler {
+	h.privacy = pseudonymizer
+	return h
+}
+
+// GetHistoryHandler handles long-range history requests
+func (h *AnalyticsHTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	resource := r.URL.Query().Get("resource")
+	if clientID == "" || resource == "" {
+		http.Error(w, "client_id and resource are required", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, err := parseAnalyticsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := historyFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := parseHistoryCursor(r)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	limit := 0
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsed > 0 {
+		limit = parsed
+	}
+	offset := 0
+	if parsed, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && parsed >= 0 {
+		offset = parsed
+	}
+
+	if format != historyFormatJSON {
+		streamHistory(w, format, func(after *queries.HistoryCursor, limit, offset int) (*queries.RateLimitHistory, error) {
+			return h.history(r.Context(), clientID, resource, startTime, endTime, limit, offset, after)
+		}, after, limit, offset)
+		return
+	}
+
+	// Pages are bounded, unlike streamed histories
+	if limit == 0 || limit > 10000 {
+		limit = 100
+	}
+	result, err := h.history(r.Context(), clientID, resource, startTime, endTime, limit, offset, after)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// history reads a page of a client's history from the analytics store
+func (h *AnalyticsHTTPHandler) history(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor) (*queries.RateLimitHistory, error) {
+	result, err := h.queryHandler.Handle(ctx, &queries.GetAnalyticsHistoryQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("analytics-history-%d", time.Now().UnixNano()),
+			Type: "GetAnalyticsHistory",
+			Time: time.Now(),
+		},
+		ClientID:  h.privacy.LookupClientID(clientID),
+		Resource:  resource,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Limit:     limit,
+		Offset:    offset,
+		After:     after,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*queries.RateLimitHistory), nil
+}
+
+// GetStatsHandler handles long-range client statistics requests
+func (h *AnalyticsHTTPHandler) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		http.Error(w, "client_id is required", http.StatusBadRequest)
+		return
+	}
+
+	startTime, endTime, err := parseAnalyticsRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var interval time.Duration
+	if intervalStr := r.URL.Query().Get("interval"); intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil || interval < time.Second {
+			http.Error(w, "Invalid interval format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.queryHandler.Handle(r.Context(), &queries.GetAnalyticsStatsQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("analytics-stats-%d", time.Now().UnixNano()),
+			Type: "GetAnalyticsStats",
+			Time: time.Now(),
+		},
+		ClientID:  h.privacy.LookupClientID(clientID),
+		StartTime: startTime,
+		EndTime:   endTime,
+		Interval:  interval,
+	})
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RegisterRoutes adds the analytics endpoints to mux
+func (h *AnalyticsHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/analytics/history", h.GetHistoryHandler)
+	mux.HandleFunc("/api/v1/analytics/stats", h.GetStatsHandler)
+}
+
+// parseAnalyticsRange reads start_time/end_time, defaulting to the last 30
+// days and rejecting ranges longer than the retention period
+func parseAnalyticsRange(r *http.Request) (time.Time, time.Time, error) {
+	endTime := time.Now()
+	if endStr := r.URL.Query().Get("end_time"); endStr != "" {
+		parsed, err := time.Parse(time.RFC3339, endStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid end_time format")
+		}
+		endTime = parsed
+	}
+
+	startTime := endTime.Add(-30 * 24 * time.Hour)
+	if startStr := r.URL.Query().Get("start_time"); startStr != "" {
+		parsed, err := time.Parse(time.RFC3339, startStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("Invalid start_time format")
+		}
+		startTime = parsed
+	}
+
+	if !startTime.Before(endTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start_time must be before end_time")
+	}
+	if endTime.Sub(startTime) > maxAnalyticsRange {
+		return time.Time{}, time.Time{}, fmt.Errorf("time range must not exceed 90 days")
+	}
+
+	return startTime, endTime, nil
+}
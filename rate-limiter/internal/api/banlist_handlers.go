@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+	"github.com/NickChunglolz/rate-limiter/internal/threatfeed"
+)
+
+// defaultExpiringWithin is how far ahead the expiry report looks unless
+// asked otherwise
+const defaultExpiringWithin = 24 * time.Hour
+
+// BanListService keeps the networks denied or allowed by hand
+type BanListService interface {
+	Add(ctx context.Context, req threatfeed.BanRequest) (queries.BanListEntry, error)
+	Remove(ctx context.Context, network string) error
+	Entries(action string) []queries.BanListEntry
+	Expiring(within time.Duration) []queries.BanListEntry
+	Import(ctx context.Context, format string, r io.Reader, replace bool) (queries.BanListImport, error)
+	Export(w io.Writer, format string) error
+}
+
+// BanListHTTPHandler provides the ban list admin endpoints
+type BanListHTTPHandler struct {
+	banList BanListService
+}
+
+// NewBanListHTTPHandler creates a ban list admin handler
+func NewBanListHTTPHandler(banList BanListService) *BanListHTTPHandler {
+	return &BanListHTTPHandler{banList: banList}
+}
+
+// ListHandler returns the entries, optionally only those with the action
+// parameter, deny or allow
+func (h *BanListHTTPHandler) ListHandler(w http.ResponseWriter, r *http.Request) {
+	action := r.URL.Query().Get("action")
+	switch action {
+	case "", threatfeed.ActionDeny, threatfeed.ActionAllow:
+	default:
+		http.Error(w, "action must be deny or allow", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": h.banList.Entries(action)})
+}
+
+// AddHandler adds an entry, or replaces the entry of its network
+func (h *BanListHTTPHandler) AddHandler(w http.ResponseWriter, r *http.Request) {
+	var req threatfeed.BanRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	entry, err := h.banList.Add(r.Context(), req)
+	if err != nil {
+		writeBanListError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// RemoveHandler removes the entry of the network parameter
+func (h *BanListHTTPHandler) RemoveHandler(w http.ResponseWriter, r *http.Request) {
+	network := r.URL.Query().Get("network")
+	if network == "" {
+		http.Error(w, "network is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.banList.Remove(r.Context(), network); err != nil {
+		writeBanListError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExpiringHandler reports the entries expiring within the within parameter,
+// a duration of 24h by default, soonest first
+func (h *BanListHTTPHandler) ExpiringHandler(w http.ResponseWriter, r *http.Request) {
+	within := defaultExpiringWithin
+	if raw := r.URL.Query().Get("within"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "within must be a positive duration, e.g. 24h", http.StatusBadRequest)
+			return
+		}
+		within = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"within":  within.String(),
+		"entries": h.banList.Expiring(within),
+	})
+}
+
+// ExportHandler writes every entry as JSON or CSV, chosen by the format
+// parameter or the Accept header
+func (h *BanListHTTPHandler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := banListFormat(r, "Accept")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == threatfeed.BanListCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="ban-list.%s"`, format))
+	h.banList.Export(w, format)
+}
+
+// ImportHandler adds the entries of a JSON or CSV body, chosen by the format
+// parameter or the Content-Type header. With replace=true, entries the body
+// does not list are removed.
+func (h *BanListHTTPHandler) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := banListFormat(r, "Content-Type")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replace := false
+	if raw := r.URL.Query().Get("replace"); raw != "" {
+		if replace, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "replace must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.banList.Import(r.Context(), format, r.Body, replace)
+	if err != nil {
+		writeBanListError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RegisterRoutes adds the ban list endpoints to mux
+func (h *BanListHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/ban-list", h.ListHandler)
+	mux.HandleFunc("POST /api/v1/ban-list", h.AddHandler)
+	mux.HandleFunc("DELETE /api/v1/ban-list", h.RemoveHandler)
+	mux.HandleFunc("GET /api/v1/ban-list/expiring", h.ExpiringHandler)
+	mux.HandleFunc("GET /api/v1/ban-list/export", h.ExportHandler)
+	mux.HandleFunc("POST /api/v1/ban-list/import", h.ImportHandler)
+}
+
+// banListFormat returns the format of a ban list import or export. The
+// format parameter takes precedence over the media type in header, and JSON
+// is the default.
+func banListFormat(r *http.Request, header string) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case threatfeed.BanListJSON, threatfeed.BanListCSV:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q, expected json or csv", format)
+	}
+
+	for _, value := range strings.Split(r.Header.Get(header), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err == nil && mediaType == "text/csv" {
+			return threatfeed.BanListCSV, nil
+		}
+	}
+	return threatfeed.BanListJSON, nil
+}
+
+// writeBanListError maps a ban list error to an HTTP error response
+func writeBanListError(w http.ResponseWriter, err error) {
+	var pending domain.PendingChangeError
+	switch {
+	case errors.As(err, &pending):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(pending.PendingChange())
+	case errors.Is(err, domain.ErrPrincipalRequired):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, domain.ErrRuleChangePending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, threatfeed.ErrInvalidBan):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, threatfeed.ErrNotBanned):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		WriteError(w, err)
+	}
+}
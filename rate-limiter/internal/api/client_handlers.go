@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// erasureWait is how long an erasure request waits for the erasure to
+// finish before answering with the job to poll instead
+const erasureWait = 2 * time.Second
+
+// maxErasureJobs is the number of erasure jobs kept for polling
+const maxErasureJobs = 1000
+
+// Erasure job statuses
+const (
+	ErasureRunning   = "running"
+	ErasureCompleted = "completed"
+	ErasureFailed    = "failed"
+)
+
+// ClientHTTPHandler provides endpoints for managing the client registry
+// and erasing clients' data
+type ClientHTTPHandler struct {
+	service *RateLimiterService
+
+	mutex        sync.Mutex
+	erasures     map[string]*ErasureJob
+	erasureOrder []string // Job IDs, oldest first
+}
+
+// ErasureJob is an erasure of a client's data, run in the background so
+// that erasures of large stores outlive the request. It holds the client
+// ID only as recorded in the tombstone.
+type ErasureJob struct {
+	ID          string                        `json:"id"`
+	Status      string                        `json:"status"`
+	StartedAt   time.Time                     `json:"started_at"`
+	CompletedAt *time.Time                    `json:"completed_at,omitempty"`
+	Tombstone   *domain.ClientDataErasedEvent `json:"tombstone,omitempty"`
+	Error       string                        `json:"error,omitempty"`
+}
+
+// NewClientHTTPHandler creates a new client registry handler
+func NewClientHTTPHandler(service *RateLimiterService) *ClientHTTPHandler {
+	return &ClientHTTPHandler{
+		service:  service,
+		erasures: make(map[string]*ErasureJob),
+	}
+}
+
+// clientRequest is the body of client create and update requests
+type clientRequest struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Tier    string   `json:"tier,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Contact string   `json:"contact,omitempty"`
+}
+
+// CreateHandler registers a client
+func (h *ClientHTTPHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req clientRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	client, err := h.service.RegisterClient(r.Context(), req.ID, req.Name, req.Tier, req.Tags, req.Contact)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(client)
+}
+
+// ListHandler lists registered and discovered clients, filtered by the
+// optional tier and tag parameters and ordered by the optional sort
+// parameter: id, first_seen or last_seen
+func (h *ClientHTTPHandler) ListHandler(w http.ResponseWriter, r *http.Request) {
+	sort := r.URL.Query().Get("sort")
+	switch sort {
+	case "", "id", "first_seen", "last_seen":
+	default:
+		http.Error(w, "sort must be id, first_seen or last_seen", http.StatusBadRequest)
+		return
+	}
+
+	clients, err := h.service.ListClients(r.Context(), r.URL.Query().Get("tier"), r.URL.Query().Get("tag"), sort)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"clients": clients})
+}
+
+// GetHandler returns a registered client
+func (h *ClientHTTPHandler) GetHandler(w http.ResponseWriter, r *http.Request) {
+	client, err := h.service.GetClient(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// UpdateHandler replaces a client's name, tier, tags and contact
+func (h *ClientHTTPHandler) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var req clientRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	client, err := h.service.UpdateClient(r.Context(), r.PathValue("id"), req.Name, req.Tier, req.Tags, req.Contact)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// DeleteHandler removes a client from the registry
+func (h *ClientHTTPHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.DeleteClient(r.Context(), r.PathValue("id")); err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// EraseDataHandler erases a client's events, history, statistics and
+// overrides. It answers 200 with the finished job, or 202 with the job and
+// its Location when the erasure takes longer than erasureWait.
+func (h *ClientHTTPHandler) EraseDataHandler(w http.ResponseWriter, r *http.Request) {
+	id, done := h.startErasure(r.Context(), r.PathValue("id"))
+	select {
+	case <-done:
+	case <-time.After(erasureWait):
+	}
+
+	job, _ := h.erasure(id)
+	w.Header().Set("Content-Type", "application/json")
+	switch job.Status {
+	case ErasureRunning:
+		w.Header().Set("Location", "/api/v1/erasures/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case ErasureFailed:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// ErasureHandler returns an erasure job
+func (h *ClientHTTPHandler) ErasureHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.erasure(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "erasure not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// DisableHandler denies every request of a client until it is enabled
+func (h *ClientHTTPHandler) DisableHandler(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, true)
+}
+
+// EnableHandler re-enables a disabled client
+func (h *ClientHTTPHandler) EnableHandler(w http.ResponseWriter, r *http.Request) {
+	h.setDisabled(w, r, false)
+}
+
+// RegisterRoutes adds the client registry endpoints to mux
+func (h *ClientHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/clients", h.CreateHandler)
+	mux.HandleFunc("GET /api/v1/clients", h.ListHandler)
+	mux.HandleFunc("GET /api/v1/clients/{id}", h.GetHandler)
+	mux.HandleFunc("PUT /api/v1/clients/{id}", h.UpdateHandler)
+	mux.HandleFunc("DELETE /api/v1/clients/{id}", h.DeleteHandler)
+	mux.HandleFunc("POST /api/v1/clients/{id}/disable", h.DisableHandler)
+	mux.HandleFunc("POST /api/v1/clients/{id}/enable", h.EnableHandler)
+	mux.HandleFunc("DELETE /api/v1/clients/{id}/data", h.EraseDataHandler)
+	mux.HandleFunc("GET /api/v1/erasures/{id}", h.ErasureHandler)
+}
+
+// startErasure erases a client's data in the background, returning the ID
+// of the job and a channel closed when it finishes. The erasure is not
+// cancelled with ctx.
+func (h *ClientHTTPHandler) startErasure(ctx context.Context, clientID string) (string, <-chan struct{}) {
+	job := &ErasureJob{
+		ID:        fmt.Sprintf("erasure-%d", time.Now().UnixNano()),
+		Status:    ErasureRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	done := make(chan struct{})
+
+	h.mutex.Lock()
+	h.erasures[job.ID] = job
+	h.erasureOrder = append(h.erasureOrder, job.ID)
+	for len(h.erasureOrder) > maxErasureJobs && h.erasures[h.erasureOrder[0]].Status != ErasureRunning {
+		delete(h.erasures, h.erasureOrder[0])
+		h.erasureOrder = h.erasureOrder[1:]
+	}
+	h.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		tombstone, err := h.service.EraseClientData(context.WithoutCancel(ctx), clientID)
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		completedAt := time.Now().UTC()
+		job.CompletedAt = &completedAt
+		if err != nil {
+			log.Printf("Error erasing client data in %s: %v", job.ID, err)
+			job.Status = ErasureFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = ErasureCompleted
+		job.Tombstone = tombstone
+	}()
+	return job.ID, done
+}
+
+// erasure returns a copy of an erasure job
+func (h *ClientHTTPHandler) erasure(id string) (ErasureJob, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	job, ok := h.erasures[id]
+	if !ok {
+		return ErasureJob{}, false
+	}
+	return *job, true
+}
+
+// setDisabled disables or enables the client in the path
+func (h *ClientHTTPHandler) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	client, err := h.service.SetClientDisabled(r.Context(), r.PathValue("id"), disabled)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(client)
+}
+
+// writeClientError maps client registry errors to status codes
+func writeClientError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, domain.ErrClientNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, domain.ErrClientExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		WriteError(w, err)
+	}
+}
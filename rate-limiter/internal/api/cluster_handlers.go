@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/NickChunglolz/rate-limiter/internal/locks"
+)
+
+// LeadershipReporter reports this instance's view of a leader election
+type LeadershipReporter interface {
+	Status() locks.ElectionStatus
+}
+
+// ClusterHTTPHandler provides the admin endpoint exposing which instance
+// runs the leader-only background workers
+type ClusterHTTPHandler struct {
+	backend string
+	elector LeadershipReporter
+}
+
+// NewClusterHTTPHandler creates a cluster admin handler for an election held
+// over the named lock backend
+func NewClusterHTTPHandler(backend string, elector LeadershipReporter) *ClusterHTTPHandler {
+	return &ClusterHTTPHandler{
+		backend: backend,
+		elector: elector,
+	}
+}
+
+// ClusterHandler returns the lock backend and this instance's leadership
+// state
+func (h *ClusterHTTPHandler) ClusterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Backend string `json:"backend"`
+		locks.ElectionStatus
+	}{h.backend, h.elector.Status()})
+}
+
+// RegisterRoutes adds the cluster admin endpoint to mux
+func (h *ClusterHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/admin/cluster", h.ClusterHandler)
+}
@@ -0,0 +1,287 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// FailureMode is how a check is decided when the storage it needs fails or
+// times out
+type FailureMode string
+
+const (
+	FailError  FailureMode = "error"  // The check fails, answering 503 on a timeout and 500 otherwise
+	FailOpen   FailureMode = "open"   // The request is allowed without being counted
+	FailClosed FailureMode = "closed" // The request is denied
+)
+
+// FailurePolicy decides checks whose storage is unavailable, or that overrun
+// the decision deadline, globally or per resource, instead of failing them
+type FailurePolicy struct {
+	Mode      FailureMode            // Mode of resources not listed in Resources
+	Resources map[string]FailureMode // Modes of single resources
+}
+
+// mode returns the failure mode of resource
+func (p FailurePolicy) mode(resource string) FailureMode {
+	if mode, ok := p.Resources[resource]; ok {
+		return mode
+	}
+	if p.Mode == "" {
+		return FailError
+	}
+	return p.Mode
+}
+
+// degradedRetryAfter is the retry hint of requests denied while storage is
+// unavailable
+const degradedRetryAfter = 1
+
+// degradedLogInterval is the least time between logged degraded decisions.
+// Every degraded request is recorded in the access log instead.
+const degradedLogInterval = 10 * time.Second
+
+// otherResource counts the checks of resources without a rule, so that
+// clients checking made-up resources cannot grow the counts without bound
+const otherResource = "other"
+
+// errInvalidKeyTemplate marks checks that fail because of their rule rather
+// than storage, which are never decided by the failure policy
+var errInvalidKeyTemplate = errors.New("invalid key template")
+
+// failureCounts counts the checks decided by the failure policy and the
+// checks that overran the decision deadline
+type failureCounts struct {
+	degraded map[degradedLabels]uint64
+	timeouts map[string]uint64 // By resource
+	logged   time.Time         // When a degraded decision was last logged
+	unlogged uint64            // Degraded decisions since, not logged
+	mutex    sync.Mutex
+}
+
+func newFailureCounts() *failureCounts {
+	return &failureCounts{
+		degraded: make(map[degradedLabels]uint64),
+		timeouts: make(map[string]uint64),
+	}
+}
+
+// degradedLabels are the metric labels a degraded decision is counted under
+type degradedLabels struct {
+	resource string
+	mode     FailureMode
+}
+
+// WithFailurePolicy decides checks failing because storage is unavailable,
+// or overrunning the decision deadline, by the policy: they are allowed or
+// denied with a degraded status, logged and counted, rather than failed
+func (s *RateLimiterService) WithFailurePolicy(policy FailurePolicy) *RateLimiterService {
+	s.failure = policy
+	return s
+}
+
+// RuleIndex tells from memory, without querying storage, whether a resource
+// has rules, such as the snapshot of the in-memory rule repository
+type RuleIndex interface {
+	HasRules(resource string) bool
+}
+
+// WithRuleIndex counts the degraded and timed out checks of the resources
+// index has rules for by resource. Without an index only the resources the
+// failure policy names are.
+func (s *RateLimiterService) WithRuleIndex(index RuleIndex) *RateLimiterService {
+	s.ruleIndex = index
+	return s
+}
+
+// WithDecisionDeadline bounds the time a decision may take, from the start
+// of the check through rule evaluation, command handling and storage, so
+// that slow dependencies cannot stall callers. Decisions overrunning it are
+// counted and decided by the failure policy. No deadline is set when zero.
+func (s *RateLimiterService) WithDecisionDeadline(deadline time.Duration) *RateLimiterService {
+	s.deadline = deadline
+	return s
+}
+
+// DecisionContext returns the context of a decision, which is done when the
+// decision deadline passes. A decision spanning several checks, such as one
+// evaluating rules first, starts the deadline once for all of them; the
+// checks it makes keep to it.
+func (s *RateLimiterService) DecisionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.deadline <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.deadline)
+}
+
+// DecideUnavailable returns the status the failure policy decides a check
+// of resource failing with err by, or nil when the check is to fail. Checks
+// canceled by their caller and checks of invalid rules always fail. Checks
+// that overran their deadline are counted whatever the policy. Degraded
+// decisions are recorded in the access log entry of their request, and
+// logged at most once every degradedLogInterval.
+func (s *RateLimiterService) DecideUnavailable(ctx context.Context, clientID, resource, method string, err error) *queries.RateLimitStatus {
+	timedOut := errors.Is(err, context.DeadlineExceeded)
+	if timedOut {
+		s.failures.addTimeout(s.countedResource(resource))
+	}
+
+	mode := s.failure.mode(resource)
+	if mode == FailError || errors.Is(err, context.Canceled) || errors.Is(err, errInvalidKeyTemplate) {
+		return nil
+	}
+	reason := "storage unavailable"
+	if timedOut {
+		reason = "decision deadline exceeded"
+	}
+	clientID = s.privacy.ClientID(clientID)
+	accesslog.AnnotateReason(ctx, reason+", failing "+string(mode), nil)
+	if unlogged, ok := s.failures.logDue(s.clock.Now()); ok {
+		log.Printf("Decision unavailable (%s), failing %s request from %s to %s: %v (%d more degraded decisions since last logged)", reason, mode, clientID, resource, err, unlogged)
+	}
+	s.failures.addDegraded(s.countedResource(resource), mode)
+
+	status := &queries.RateLimitStatus{
+		ClientID:  clientID,
+		Resource:  domain.ScopedResource(resource, method),
+		IsAllowed: mode == FailOpen,
+		Reason:    reason,
+		Degraded:  "fail-" + string(mode),
+	}
+	if mode == FailClosed {
+		now := s.clock.Now()
+		status.IsBlocked = true
+		status.RetryAfter = degradedRetryAfter
+		status.ResetTime = now.Add(degradedRetryAfter * time.Second)
+	}
+	return status
+}
+
+// degradedStatuses returns the statuses the failure policy decides a check
+// of several resources failing with err by, or err when the check is to
+// fail. It fails when any resource's mode fails it, is denied by the first
+// resource failing closed, and is otherwise allowed by every resource.
+func (s *RateLimiterService) degradedStatuses(ctx context.Context, resources []string, attrs keytemplate.Attributes, err error) (*queries.MultiRateLimitStatus, error) {
+	denying := -1
+	for i, resource := range resources {
+		switch s.failure.mode(resource) {
+		case FailError:
+			if errors.Is(err, context.DeadlineExceeded) {
+				for _, resource := range resources {
+					s.failures.addTimeout(s.countedResource(resource))
+				}
+			}
+			return nil, err
+		case FailClosed:
+			if denying < 0 {
+				denying = i
+			}
+		}
+	}
+
+	if denying >= 0 {
+		status := s.DecideUnavailable(ctx, attrs.ClientID, resources[denying], attrs.Method, err)
+		if status == nil {
+			return nil, err
+		}
+		return deniedBy(resources[denying], status), nil
+	}
+
+	statuses := make([]*queries.RateLimitStatus, len(resources))
+	for i, resource := range resources {
+		if statuses[i] = s.DecideUnavailable(ctx, attrs.ClientID, resource, attrs.Method, err); statuses[i] == nil {
+			return nil, err
+		}
+	}
+	return &queries.MultiRateLimitStatus{IsAllowed: true, Statuses: statuses}, nil
+}
+
+// countedResource returns what the checks of resource are counted under:
+// the resource when it has a rule, and otherResource otherwise. It never
+// queries storage, which may be what the check failed on.
+func (s *RateLimiterService) countedResource(resource string) string {
+	if _, ok := s.failure.Resources[resource]; ok {
+		return resource
+	}
+	if s.ruleIndex != nil && s.ruleIndex.HasRules(resource) {
+		return resource
+	}
+	return otherResource
+}
+
+// logDue reports whether a degraded decision made at now is to be logged,
+// and how many were not logged since the last one that was
+func (c *failureCounts) logDue(now time.Time) (uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.logged) < degradedLogInterval {
+		c.unlogged++
+		return 0, false
+	}
+	unlogged := c.unlogged
+	c.logged = now
+	c.unlogged = 0
+	return unlogged, true
+}
+
+// addDegraded counts a check of resource decided in mode
+func (c *failureCounts) addDegraded(resource string, mode FailureMode) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.degraded[degradedLabels{resource: resource, mode: mode}]++
+}
+
+// addTimeout counts a check of resource that overran its deadline
+func (c *failureCounts) addTimeout(resource string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.timeouts[resource]++
+}
+
+// DegradedCounts returns the checks decided by the failure policy so far,
+// ordered by resource and mode
+func (s *RateLimiterService) DegradedCounts() []queries.DegradedCount {
+	s.failures.mutex.Lock()
+	counts := make([]queries.DegradedCount, 0, len(s.failures.degraded))
+	for labels, count := range s.failures.degraded {
+		counts = append(counts, queries.DegradedCount{
+			Resource: labels.resource,
+			Mode:     string(labels.mode),
+			Count:    count,
+		})
+	}
+	s.failures.mutex.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Resource != counts[j].Resource {
+			return counts[i].Resource < counts[j].Resource
+		}
+		return counts[i].Mode < counts[j].Mode
+	})
+	return counts
+}
+
+// DecisionTimeouts returns the checks that overran the decision deadline so
+// far, by resource
+func (s *RateLimiterService) DecisionTimeouts() map[string]uint64 {
+	s.failures.mutex.Lock()
+	defer s.failures.mutex.Unlock()
+
+	timeouts := make(map[string]uint64, len(s.failures.timeouts))
+	for resource, count := range s.failures.timeouts {
+		timeouts[resource] = count
+	}
+	return timeouts
+}
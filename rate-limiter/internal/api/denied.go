@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// DeniedResponse writes the bodies of denied responses from the templates
+// configured for the denied resource and the tier of the denied client
+type DeniedResponse struct {
+	templates *denial.Templates
+	service   *RateLimiterService
+}
+
+// NewDeniedResponse renders denials with templates, looking up the tiers of
+// registered clients with service when templates are chosen by tenant. Nil
+// templates leave every denial to the default body.
+func NewDeniedResponse(templates *denial.Templates, service *RateLimiterService) *DeniedResponse {
+	return &DeniedResponse{templates: templates, service: service}
+}
+
+// Write writes the templated body of a denial of clientID's request to
+// resource with statusCode. Status may be nil for denials without a rate
+// limit, such as those of blocking rules. It returns false, writing
+// nothing, when no template applies or rendering fails.
+func (d *DeniedResponse) Write(ctx context.Context, w http.ResponseWriter, statusCode int, clientID, resource, reason string, status *queries.RateLimitStatus) bool {
+	if d == nil || d.templates == nil {
+		return false
+	}
+
+	tenant := ""
+	if d.templates.Tenanted() {
+		// Unregistered clients have no tier
+		if client, err := d.service.GetClient(ctx, clientID); err == nil {
+			tenant = client.Tier
+		}
+	}
+	template := d.templates.Select(resource, tenant)
+	if template == nil {
+		return false
+	}
+
+	vars := denial.Vars{
+		ClientID: clientID,
+		Resource: resource,
+		Tenant:   tenant,
+		Reason:   reason,
+	}
+	if status != nil {
+		vars.Limit = status.Limit
+		vars.Remaining = status.RemainingQuota
+		vars.RetryAfter = RetryAfter(status, time.Now())
+		vars.ResetAt = status.ResetTime
+		if vars.Reason == "" {
+			vars.Reason = status.Reason
+		}
+	}
+	if vars.Reason == "" {
+		vars.Reason = "rate limit exceeded"
+	}
+	return template.Write(w, statusCode, vars)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// Media types of the binary encodings of statuses. Protobuf bodies are
+// messages of proto/ratelimit/v1/status.proto; MessagePack bodies are maps
+// with the keys of the JSON encoding.
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+// statusEncoding is how a status is written in a response body
+type statusEncoding int
+
+const (
+	encodingJSON statusEncoding = iota
+	encodingProtobuf
+	encodingMsgpack
+)
+
+// encodingTypes maps the media types accepted for each binary encoding
+var encodingTypes = map[string]statusEncoding{
+	"application/x-protobuf":  encodingProtobuf,
+	"application/protobuf":    encodingProtobuf,
+	"application/msgpack":     encodingMsgpack,
+	"application/x-msgpack":   encodingMsgpack,
+	"application/vnd.msgpack": encodingMsgpack,
+}
+
+// negotiateEncoding returns the encoding of statuses preferred by the Accept
+// header of r. JSON is the default; at equal quality, the first listed type
+// wins and wildcards lose to the types they match.
+func negotiateEncoding(r *http.Request) statusEncoding {
+	accept := r.Header.Get("Accept")
+	// Most callers take JSON; skip parsing their Accept headers
+	if !strings.Contains(accept, "protobuf") && !strings.Contains(accept, "msgpack") {
+		return encodingJSON
+	}
+
+	best, bestQ, bestWildcard := encodingJSON, 0.0, false
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		encoding, ok := encodingTypes[mediaType]
+		wildcard := mediaType == "*/*" || mediaType == "application/*"
+		if !ok {
+			if mediaType != "application/json" && !wildcard {
+				continue
+			}
+			encoding = encodingJSON
+		}
+		if q > bestQ || (q == bestQ && bestWildcard && !wildcard) {
+			best, bestQ, bestWildcard = encoding, q, wildcard
+		}
+	}
+	return best
+}
+
+// contentType returns the Content-Type of bodies in the encoding
+func (e statusEncoding) contentType() string {
+	switch e {
+	case encodingProtobuf:
+		return ContentTypeProtobuf
+	case encodingMsgpack:
+		return ContentTypeMsgpack
+	default:
+		return "application/json"
+	}
+}
+
+// WriteNegotiatedStatus writes status as the body of a response with code,
+// encoded as protobuf or MessagePack when the Accept header of r prefers
+// them and as WriteStatus does otherwise
+func WriteNegotiatedStatus(w http.ResponseWriter, r *http.Request, code int, status *queries.RateLimitStatus) {
+	encoding := negotiateEncoding(r)
+	w.Header().Add("Vary", "Accept")
+	if encoding == encodingJSON {
+		if RequestAPIVersion(r) == APIv2 {
+			writeDecision(w, code, status)
+			return
+		}
+		WriteStatus(w, code, status)
+		return
+	}
+
+	buf := statusBuffers.Get().(*[]byte)
+	if encoding == encodingProtobuf {
+		*buf = status.AppendProto((*buf)[:0])
+	} else {
+		*buf = status.AppendMsgpack((*buf)[:0])
+	}
+	writeEncoded(w, code, encoding, *buf)
+	statusBuffers.Put(buf)
+}
+
+// WriteNegotiatedStatuses writes the statuses of a check of several
+// resources as the body of a response with code, encoded as the Accept
+// header of r prefers
+func WriteNegotiatedStatuses(w http.ResponseWriter, r *http.Request, code int, result *queries.MultiRateLimitStatus) {
+	encoding := negotiateEncoding(r)
+	w.Header().Add("Vary", "Accept")
+	if encoding == encodingJSON {
+		if RequestAPIVersion(r) == APIv2 {
+			writeDecisions(w, code, result)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	buf := statusBuffers.Get().(*[]byte)
+	if encoding == encodingProtobuf {
+		*buf = result.AppendProto((*buf)[:0])
+	} else {
+		*buf = result.AppendMsgpack((*buf)[:0])
+	}
+	writeEncoded(w, code, encoding, *buf)
+	statusBuffers.Put(buf)
+}
+
+// writeEncoded writes a body in a binary encoding
+func writeEncoded(w http.ResponseWriter, code int, encoding statusEncoding, body []byte) {
+	w.Header().Set("Content-Type", encoding.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// acceptsJSON reports whether the response to r is written as JSON, and so
+// may be replaced by a denied response template
+func acceptsJSON(r *http.Request) bool {
+	return negotiateEncoding(r) == encodingJSON
+}
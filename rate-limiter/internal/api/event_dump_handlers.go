@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/migration"
+)
+
+// EventRestorer is an event store imported events are appended to
+type EventRestorer interface {
+	Restore(ctx context.Context, event domain.Event, inHistory bool) error
+}
+
+// EventPublisher publishes imported events, e.g. to the EventBus
+type EventPublisher interface {
+	Publish(event domain.Event)
+}
+
+// EventDumpHTTPHandler provides the admin endpoints dumping stored events
+// and importing dumps, to reproduce production traffic on another
+// instance. Imported events are appended to the event store, where the
+// read model projection applies them as it does live events, and published
+// to the subscribers of the event bus.
+type EventDumpHTTPHandler struct {
+	events    EventSelector
+	store     EventRestorer
+	publisher EventPublisher
+}
+
+// NewEventDumpHTTPHandler creates a handler dumping the events selected
+// from events and importing dumps into store
+func NewEventDumpHTTPHandler(events EventSelector, store EventRestorer) *EventDumpHTTPHandler {
+	return &EventDumpHTTPHandler{
+		events: events,
+		store:  store,
+	}
+}
+
+// WithEventPublisher publishes imported events to publisher
+func (h *EventDumpHTTPHandler) WithEventPublisher(publisher EventPublisher) *EventDumpHTTPHandler {
+	h.publisher = publisher
+	return h
+}
+
+// DumpHandler writes the stored events of an aggregate and/or time range as
+// an event dump, one event per line
+func (h *EventDumpHTTPHandler) DumpHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	aggregateID := params.Get("aggregate_id")
+	var startTime, endTime time.Time
+	var err error
+	if raw := params.Get("start_time"); raw != "" {
+		if startTime, err = time.Parse(time.RFC3339, raw); err != nil {
+			http.Error(w, "Invalid start_time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := params.Get("end_time"); raw != "" {
+		if endTime, err = time.Parse(time.RFC3339, raw); err != nil {
+			http.Error(w, "Invalid end_time format", http.StatusBadRequest)
+			return
+		}
+	}
+	if aggregateID == "" && startTime.IsZero() {
+		http.Error(w, "aggregate_id or start_time is required", http.StatusBadRequest)
+		return
+	}
+	if !endTime.IsZero() && !endTime.After(startTime) {
+		http.Error(w, "end_time must be after start_time", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.events.SelectEvents(r.Context(), aggregateID, startTime, endTime)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="events.ndjson"`)
+	if err := migration.WriteEvents(w, events); err != nil {
+		// Headers are sent; the truncated body is all that can be reported
+		log.Printf("Error writing event dump: %v", err)
+	}
+}
+
+// ImportHandler appends the events of a dump, or of an export file, posted
+// as the body to the event store and publishes them. Every line is decoded
+// before any event is appended, so a malformed dump imports nothing.
+func (h *EventDumpHTTPHandler) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	type imported struct {
+		event     domain.Event
+		inHistory bool
+	}
+	var events []imported
+	err := migration.ReadEvents(r.Body, func(event domain.Event, inHistory bool) error {
+		events = append(events, imported{event: event, inHistory: inHistory})
+		return nil
+	})
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Dump too large, post at most %d bytes at a time", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Invalid dump: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for i, e := range events {
+		if err := h.store.Restore(r.Context(), e.event, e.inHistory); err != nil {
+			log.Printf("Error importing event %s after %d events: %v", e.event.EventID(), i, err)
+			WriteError(w, err)
+			return
+		}
+		if h.publisher != nil {
+			h.publisher.Publish(e.event)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": len(events)})
+}
+
+// RegisterRoutes adds the event dump admin endpoints to mux
+func (h *EventDumpHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/admin/events/dump", h.DumpHandler)
+	mux.HandleFunc("POST /api/v1/admin/events/import", h.ImportHandler)
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// EventBusAdmin controls delivery to event bus subscribers
+type EventBusAdmin interface {
+	Stats() []queries.SubscriberStats
+	Pause(id uint64) error
+	Resume(id uint64) error
+	Replay(ctx context.Context, id uint64, events []domain.Event) (int, error)
+}
+
+// EventSelector selects stored events for replay
+type EventSelector interface {
+	SelectEvents(ctx context.Context, aggregateID string, startTime, endTime time.Time) ([]domain.Event, error)
+}
+
+// EventBusHTTPHandler provides admin endpoints for operating event bus
+// subscribers such as the read model projection
+type EventBusHTTPHandler struct {
+	eventBus EventBusAdmin
+	events   EventSelector
+}
+
+// NewEventBusHTTPHandler creates a new event bus admin handler replaying
+// events selected from events
+func NewEventBusHTTPHandler(eventBus EventBusAdmin, events EventSelector) *EventBusHTTPHandler {
+	return &EventBusHTTPHandler{
+		eventBus: eventBus,
+		events:   events,
+	}
+}
+
+// ListSubscribersHandler returns every subscriber with its queue depth and
+// delivery statistics
+func (h *EventBusHTTPHandler) ListSubscribersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"subscribers": h.eventBus.Stats()})
+}
+
+// PauseHandler holds events for a subscriber until it is resumed
+func (h *EventBusHTTPHandler) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, h.eventBus.Pause, "paused")
+}
+
+// ResumeHandler delivers held events to a subscriber and resumes delivery
+func (h *EventBusHTTPHandler) ResumeHandler(w http.ResponseWriter, r *http.Request) {
+	h.control(w, r, h.eventBus.Resume, "resumed")
+}
+
+// ReplayHandler replays stored events of an aggregate and/or time range
+// into a subscriber
+func (h *EventBusHTTPHandler) ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscriber id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		AggregateID string    `json:"aggregate_id"`
+		StartTime   time.Time `json:"start_time"`
+		EndTime     time.Time `json:"end_time"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.AggregateID == "" && req.StartTime.IsZero() {
+		http.Error(w, "aggregate_id or start_time is required", http.StatusBadRequest)
+		return
+	}
+	if !req.EndTime.IsZero() && !req.EndTime.After(req.StartTime) {
+		http.Error(w, "end_time must be after start_time", http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.events.SelectEvents(r.Context(), req.AggregateID, req.StartTime, req.EndTime)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	replayed, err := h.eventBus.Replay(r.Context(), id, events)
+	if err != nil {
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			WriteError(w, ctxErr)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subscriber": id,
+		"replayed":   replayed,
+	})
+}
+
+// RegisterRoutes adds the event bus admin endpoints to mux
+func (h *EventBusHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/eventbus/subscribers", h.ListSubscribersHandler)
+	mux.HandleFunc("POST /api/v1/eventbus/subscribers/{id}/pause", h.PauseHandler)
+	mux.HandleFunc("POST /api/v1/eventbus/subscribers/{id}/resume", h.ResumeHandler)
+	mux.HandleFunc("POST /api/v1/eventbus/subscribers/{id}/replay", h.ReplayHandler)
+}
+
+// control applies a pause or resume to the subscriber in the path
+func (h *EventBusHTTPHandler) control(w http.ResponseWriter, r *http.Request, apply func(id uint64) error, status string) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscriber id", http.StatusBadRequest)
+		return
+	}
+
+	if err := apply(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subscriber": id,
+		"status":     status,
+	})
+}
@@ -0,0 +1,546 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// GraphQLHTTPHandler serves a read-only GraphQL API, so dashboards can fetch
+// a client's resources with their status, recent history and rules in one
+// request instead of stitching several REST calls together. Fields are
+// named as in the REST responses.
+type GraphQLHTTPHandler struct {
+	service *RateLimiterService
+	schema  graphql.Schema
+}
+
+// graphQLRequest is the body of GraphQL POST requests
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+// graphQLClient is a client as the GraphQL API resolves it. Its stats are
+// loaded on first use and shared by the fields that need them.
+type graphQLClient struct {
+	id       string
+	client   *domain.Client          // Registry entry, if registered
+	activity *queries.ClientActivity // Observed traffic, if any
+	stats    func() (*queries.ClientStats, error)
+}
+
+// graphQLResource is a resource a client has sent requests to
+type graphQLResource struct {
+	clientID string
+	stats    queries.ResourceStats
+}
+
+// NewGraphQLHTTPHandler creates a new GraphQL handler
+func NewGraphQLHTTPHandler(service *RateLimiterService) (*GraphQLHTTPHandler, error) {
+	h := &GraphQLHTTPHandler{service: service}
+
+	schema, err := h.newSchema()
+	if err != nil {
+		return nil, err
+	}
+	h.schema = schema
+	return h, nil
+}
+
+// QueryHandler executes a GraphQL query sent as a JSON POST body or in the
+// query parameter of a GET request
+func (h *GraphQLHTTPHandler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				http.Error(w, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if !DecodeJSON(w, r, &req) {
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RegisterRoutes adds the GraphQL endpoint to mux
+func (h *GraphQLHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/graphql", h.QueryHandler)
+}
+
+// newSchema builds the schema of the GraphQL API
+func (h *GraphQLHTTPHandler) newSchema() (graphql.Schema, error) {
+	windowStatusType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "WindowStatus",
+		Fields: graphql.Fields{
+			"window":          &graphql.Field{Type: graphql.String},
+			"limit":           &graphql.Field{Type: graphql.Int},
+			"request_count":   &graphql.Field{Type: graphql.Int},
+			"remaining_quota": &graphql.Field{Type: graphql.Int},
+			"reset_time":      &graphql.Field{Type: graphql.DateTime},
+			"is_blocked":      &graphql.Field{Type: graphql.Boolean},
+		},
+	})
+
+	statusType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RateLimitStatus",
+		Fields: graphql.Fields{
+			"client_id":       &graphql.Field{Type: graphql.String},
+			"resource":        &graphql.Field{Type: graphql.String},
+			"is_allowed":      &graphql.Field{Type: graphql.Boolean},
+			"request_count":   &graphql.Field{Type: graphql.Int},
+			"limit":           &graphql.Field{Type: graphql.Int},
+			"remaining_quota": &graphql.Field{Type: graphql.Int},
+			"window_start":    &graphql.Field{Type: graphql.DateTime},
+			"window_end":      &graphql.Field{Type: graphql.DateTime},
+			"reset_time":      &graphql.Field{Type: graphql.DateTime},
+			"is_blocked":      &graphql.Field{Type: graphql.Boolean},
+			"blocked_until":   &graphql.Field{Type: graphql.DateTime},
+			"retry_after":     &graphql.Field{Type: graphql.Int},
+			"reason":          &graphql.Field{Type: graphql.String},
+			"request_rate":    &graphql.Field{Type: graphql.Float},
+			"exhausts_at":     &graphql.Field{Type: graphql.DateTime},
+			"warning":         &graphql.Field{Type: graphql.String},
+			"binding_window":  &graphql.Field{Type: graphql.String},
+			"windows":         &graphql.Field{Type: graphql.NewList(windowStatusType)},
+		},
+	})
+
+	windowLimitType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "WindowLimit",
+		Fields: graphql.Fields{
+			"limit": &graphql.Field{Type: graphql.Int},
+			"window": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Window as a Go duration, e.g. 1h0m0s",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(domain.WindowLimit).Window.String(), nil
+				},
+			},
+		},
+	})
+
+	ruleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Rule",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.String},
+			"resource": &graphql.Field{Type: graphql.String},
+			"method":   &graphql.Field{Type: graphql.String},
+			"limit":    &graphql.Field{Type: graphql.Int},
+			"window": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Window as a Go duration, e.g. 1m0s",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(domain.RateLimitRule).Window.String(), nil
+				},
+			},
+			"algorithm":      &graphql.Field{Type: graphql.String},
+			"key_template":   &graphql.Field{Type: graphql.String},
+			"soft_threshold": &graphql.Field{Type: graphql.Float},
+			"flag": &graphql.Field{
+				Type:        graphql.String,
+				Description: "Feature flag gating the rule; empty when it is always enforced",
+			},
+			"parameters": &graphql.Field{
+				Type:        graphql.String,
+				Description: `Algorithm parameters as JSON, e.g. {"token_bucket":{"refill_rate":5}}; null when unset`,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					parameters := p.Source.(domain.RateLimitRule).Parameters
+					if parameters == nil {
+						return nil, nil
+					}
+					data, err := json.Marshal(parameters)
+					return string(data), err
+				},
+			},
+			"windows": &graphql.Field{
+				Type:        graphql.NewList(windowLimitType),
+				Description: "Further limits over other windows",
+			},
+			"created_at":       &graphql.Field{Type: graphql.DateTime},
+			"updated_at":       &graphql.Field{Type: graphql.DateTime},
+			"description":      &graphql.Field{Type: graphql.String, Resolve: ruleAnnotation(func(a domain.RuleAnnotations) interface{} { return a.Description })},
+			"owner":            &graphql.Field{Type: graphql.String, Resolve: ruleAnnotation(func(a domain.RuleAnnotations) interface{} { return a.Owner })},
+			"change_ref":       &graphql.Field{Type: graphql.String, Resolve: ruleAnnotation(func(a domain.RuleAnnotations) interface{} { return a.ChangeRef })},
+			"created_by":       &graphql.Field{Type: graphql.String, Resolve: ruleAnnotation(func(a domain.RuleAnnotations) interface{} { return a.CreatedBy })},
+			"last_modified_by": &graphql.Field{Type: graphql.String, Resolve: ruleAnnotation(func(a domain.RuleAnnotations) interface{} { return a.LastModifiedBy })},
+		},
+	})
+
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RateLimitEvent",
+		Fields: graphql.Fields{
+			"event_id":      &graphql.Field{Type: graphql.String},
+			"event_type":    &graphql.Field{Type: graphql.String},
+			"client_id":     &graphql.Field{Type: graphql.String},
+			"resource":      &graphql.Field{Type: graphql.String},
+			"timestamp":     &graphql.Field{Type: graphql.DateTime},
+			"request_count": &graphql.Field{Type: graphql.Int},
+			"limit":         &graphql.Field{Type: graphql.Int},
+			"is_blocked":    &graphql.Field{Type: graphql.Boolean},
+		},
+	})
+
+	historyType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RateLimitHistory",
+		Fields: graphql.Fields{
+			"events":      &graphql.Field{Type: graphql.NewList(eventType)},
+			"total_count": &graphql.Field{Type: graphql.Int},
+			"has_more":    &graphql.Field{Type: graphql.Boolean},
+			"next_cursor": &graphql.Field{Type: graphql.String, Description: "Pass as after to get the next page"},
+		},
+	})
+
+	resourceType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ClientResource",
+		Fields: graphql.Fields{
+			"resource":         &graphql.Field{Type: graphql.String, Resolve: resourceStat(func(s queries.ResourceStats) interface{} { return s.Resource })},
+			"total_requests":   &graphql.Field{Type: graphql.Int, Resolve: resourceStat(func(s queries.ResourceStats) interface{} { return s.TotalRequests })},
+			"blocked_requests": &graphql.Field{Type: graphql.Int, Resolve: resourceStat(func(s queries.ResourceStats) interface{} { return s.BlockedRequests })},
+			"allowed_requests": &graphql.Field{Type: graphql.Int, Resolve: resourceStat(func(s queries.ResourceStats) interface{} { return s.AllowedRequests })},
+			"blocked_rate":     &graphql.Field{Type: graphql.Float, Resolve: resourceStat(func(s queries.ResourceStats) interface{} { return s.BlockedRate })},
+			"status": &graphql.Field{
+				Type: statusType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					resource := p.Source.(*graphQLResource)
+					return h.status(p.Context, resource.clientID, resource.stats.Resource)
+				},
+			},
+			"history": &graphql.Field{
+				Type:        historyType,
+				Description: "Decisions on the resource, by default up to 100 from the last 24 hours",
+				Args: graphql.FieldConfigArgument{
+					"start_time": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"end_time":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"limit":      &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100},
+					"offset":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+					"after":      &graphql.ArgumentConfig{Type: graphql.String, Description: "next_cursor of the previous page"},
+				},
+				Resolve: h.resolveHistory,
+			},
+			"rules": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(ruleType))),
+				Description: "Rules whose counters the resource is kept under",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return h.matchedRules(p.Context, p.Source.(*graphQLResource).stats.Resource)
+				},
+			},
+		},
+	})
+
+	clientType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Client",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*graphQLClient).id, nil
+				},
+			},
+			"registered": &graphql.Field{
+				Type: graphql.Boolean,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*graphQLClient).client != nil, nil
+				},
+			},
+			"name":                &graphql.Field{Type: graphql.String, Resolve: registryField(func(c *domain.Client) interface{} { return c.Name })},
+			"tier":                &graphql.Field{Type: graphql.String, Resolve: registryField(func(c *domain.Client) interface{} { return c.Tier })},
+			"tags":                &graphql.Field{Type: graphql.NewList(graphql.String), Resolve: registryField(func(c *domain.Client) interface{} { return c.Tags })},
+			"contact":             &graphql.Field{Type: graphql.String, Resolve: registryField(func(c *domain.Client) interface{} { return c.Contact })},
+			"disabled":            &graphql.Field{Type: graphql.Boolean, Resolve: registryField(func(c *domain.Client) interface{} { return c.Disabled })},
+			"disabled_at":         &graphql.Field{Type: graphql.DateTime, Resolve: registryField(func(c *domain.Client) interface{} { return c.DisabledAt })},
+			"first_seen":          &graphql.Field{Type: graphql.DateTime, Resolve: activityField(func(a *queries.ClientActivity) interface{} { return a.FirstSeen })},
+			"last_seen":           &graphql.Field{Type: graphql.DateTime, Resolve: activityField(func(a *queries.ClientActivity) interface{} { return a.LastSeen })},
+			"total_requests":      &graphql.Field{Type: graphql.Int, Resolve: clientStat(func(s *queries.ClientStats) interface{} { return s.TotalRequests })},
+			"blocked_requests":    &graphql.Field{Type: graphql.Int, Resolve: clientStat(func(s *queries.ClientStats) interface{} { return s.BlockedRequests })},
+			"allowed_requests":    &graphql.Field{Type: graphql.Int, Resolve: clientStat(func(s *queries.ClientStats) interface{} { return s.AllowedRequests })},
+			"requests_per_second": &graphql.Field{Type: graphql.Float, Resolve: clientStat(func(s *queries.ClientStats) interface{} { return s.RequestsPerSecond })},
+			"blocked_rate":        &graphql.Field{Type: graphql.Float, Resolve: clientStat(func(s *queries.ClientStats) interface{} { return s.BlockedRate })},
+			"resources": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(resourceType))),
+				Description: "Resources the client has sent requests to",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					client := p.Source.(*graphQLClient)
+					stats, err := client.stats()
+					if err != nil {
+						return nil, err
+					}
+					resources := make([]*graphQLResource, len(stats.ResourceStats))
+					for i, resourceStats := range stats.ResourceStats {
+						resources[i] = &graphQLResource{clientID: client.id, stats: resourceStats}
+					}
+					return resources, nil
+				},
+			},
+			"resource": &graphql.Field{
+				Type:        resourceType,
+				Description: "A resource of the client, whether or not it has sent requests to it",
+				Args: graphql.FieldConfigArgument{
+					"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					client := p.Source.(*graphQLClient)
+					stats, err := client.stats()
+					if err != nil {
+						return nil, err
+					}
+					name := p.Args["name"].(string)
+					for _, resourceStats := range stats.ResourceStats {
+						if resourceStats.Resource == name {
+							return &graphQLResource{clientID: client.id, stats: resourceStats}, nil
+						}
+					}
+					return &graphQLResource{clientID: client.id, stats: queries.ResourceStats{Resource: name}}, nil
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"client": &graphql.Field{
+				Type:        clientType,
+				Description: "A registered client or one seen in traffic; null for neither",
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: h.resolveClient,
+			},
+			"clients": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(clientType))),
+				Description: "Registered and discovered clients, filtered and sorted as by GET /api/v1/clients",
+				Args: graphql.FieldConfigArgument{
+					"tier": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"tag":  &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"sort": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+				},
+				Resolve: h.resolveClients,
+			},
+			"status": &graphql.Field{
+				Type: statusType,
+				Args: graphql.FieldConfigArgument{
+					"client_id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"resource":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return h.status(p.Context, p.Args["client_id"].(string), p.Args["resource"].(string))
+				},
+			},
+			"rules": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(ruleType))),
+				Args: graphql.FieldConfigArgument{
+					"resource": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rules, err := h.service.getRules(p.Context, p.Args["resource"].(string))
+					if rules == nil {
+						rules = []domain.RateLimitRule{}
+					}
+					return rules, err
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+// resolveClient resolves a registered client or one seen in traffic by ID
+func (h *GraphQLHTTPHandler) resolveClient(p graphql.ResolveParams) (interface{}, error) {
+	id := p.Args["id"].(string)
+
+	listings, err := h.service.ListClients(p.Context, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, listing := range listings {
+		if listing.ID == id {
+			return h.newClient(p.Context, listing.ID, listing.Client, listing.Activity), nil
+		}
+	}
+	return nil, nil
+}
+
+// resolveClients resolves the registered and discovered clients
+func (h *GraphQLHTTPHandler) resolveClients(p graphql.ResolveParams) (interface{}, error) {
+	sort := p.Args["sort"].(string)
+	switch sort {
+	case "", "id", "first_seen", "last_seen":
+	default:
+		return nil, errors.New("sort must be id, first_seen or last_seen")
+	}
+
+	listings, err := h.service.ListClients(p.Context, p.Args["tier"].(string), p.Args["tag"].(string), sort)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*graphQLClient, len(listings))
+	for i, listing := range listings {
+		clients[i] = h.newClient(p.Context, listing.ID, listing.Client, listing.Activity)
+	}
+	return clients, nil
+}
+
+// resolveHistory resolves the decisions of a client on a resource
+func (h *GraphQLHTTPHandler) resolveHistory(p graphql.ResolveParams) (interface{}, error) {
+	resource := p.Source.(*graphQLResource)
+
+	endTime := time.Now()
+	if end, ok := p.Args["end_time"].(time.Time); ok {
+		endTime = end
+	}
+	startTime := endTime.Add(-24 * time.Hour)
+	if start, ok := p.Args["start_time"].(time.Time); ok {
+		startTime = start
+	}
+
+	limit, offset := p.Args["limit"].(int), p.Args["offset"].(int)
+	if limit <= 0 || offset < 0 {
+		return nil, errors.New("limit must be positive and offset not negative")
+	}
+
+	var after *queries.HistoryCursor
+	if token, ok := p.Args["after"].(string); ok && token != "" {
+		var err error
+		if after, err = queries.ParseHistoryCursor(token); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.service.GetRateLimitHistory(p.Context, resource.clientID, resource.stats.Resource, startTime, endTime, limit, offset, after, queries.HistoryFilter{})
+}
+
+// newClient returns a client whose stats are loaded at most once
+func (h *GraphQLHTTPHandler) newClient(ctx context.Context, id string, client *domain.Client, activity *queries.ClientActivity) *graphQLClient {
+	return &graphQLClient{
+		id:       id,
+		client:   client,
+		activity: activity,
+		stats: sync.OnceValues(func() (*queries.ClientStats, error) {
+			now := time.Now()
+			return h.service.GetClientStats(ctx, id, now.Add(-24*time.Hour), now, "")
+		}),
+	}
+}
+
+// status returns a copy of a client's status on a resource, handing the
+// pooled answer of the service back
+func (h *GraphQLHTTPHandler) status(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
+	status, err := h.service.GetRateLimitStatus(ctx, clientID, resource)
+	if err != nil {
+		return nil, err
+	}
+	result := *status
+	queries.ReleaseStatus(status)
+	return &result, nil
+}
+
+// matchedRules returns the rules whose counters are kept under a resource,
+// which is scoped to a method for method-specific rules, e.g. "api:GET"
+func (h *GraphQLHTTPHandler) matchedRules(ctx context.Context, stateResource string) ([]domain.RateLimitRule, error) {
+	resources := []string{stateResource}
+	if i := strings.LastIndex(stateResource, ":"); i > 0 {
+		resources = append(resources, stateResource[:i])
+	}
+
+	matched := []domain.RateLimitRule{}
+	for _, resource := range resources {
+		rules, err := h.service.getRules(ctx, resource)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			if rule.StateResource() == stateResource {
+				matched = append(matched, rule)
+			}
+		}
+	}
+	return matched, nil
+}
+
+// registryField resolves a field of a client's registry entry, or null for
+// unregistered clients
+func registryField(field func(*domain.Client) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		client := p.Source.(*graphQLClient).client
+		if client == nil {
+			return nil, nil
+		}
+		return field(client), nil
+	}
+}
+
+// activityField resolves a field of a client's observed traffic, or null
+// when none was observed
+func activityField(field func(*queries.ClientActivity) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		activity := p.Source.(*graphQLClient).activity
+		if activity == nil {
+			return nil, nil
+		}
+		return field(activity), nil
+	}
+}
+
+// clientStat resolves a field of a client's stats
+func clientStat(field func(*queries.ClientStats) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		stats, err := p.Source.(*graphQLClient).stats()
+		if err != nil {
+			return nil, err
+		}
+		return field(stats), nil
+	}
+}
+
+// ruleAnnotation resolves an annotation of a rule, which the default
+// resolver does not find in the embedded struct
+func ruleAnnotation(field func(domain.RuleAnnotations) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return field(p.Source.(domain.RateLimitRule).RuleAnnotations), nil
+	}
+}
+
+// resourceStat resolves a field of a client's stats on a resource
+func resourceStat(field func(queries.ResourceStats) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return field(p.Source.(*graphQLResource).stats), nil
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+)
+
+// GRPCServer is a gRPC server with standard health checking and server
+// reflection, so load balancers and grpcurl work without extra setup. The
+// health of the server and of every registered service follows the
+// readiness of the warm start and the read model, as /readyz does.
+type GRPCServer struct {
+	*grpc.Server
+	addr          string
+	socketMode    os.FileMode
+	health        *health.Server
+	projection    ProjectionMonitor
+	warmStart     WarmStartMonitor
+	maxLagSeconds float64
+}
+
+// NewGRPCServer creates a gRPC server with the configured keepalive
+// settings and options. It reports not serving until WatchReadiness finds
+// the read model ready.
+func NewGRPCServer(cfg config.GRPCConfig, projection ProjectionMonitor, maxLagSeconds float64, options ...grpc.ServerOption) *GRPCServer {
+	options = append([]grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              cfg.KeepaliveTime,
+			Timeout:           cfg.KeepaliveTimeout,
+			MaxConnectionIdle: cfg.MaxConnectionIdle,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             cfg.KeepaliveMinTime,
+			PermitWithoutStream: true,
+		}),
+	}, options...)
+	server := grpc.NewServer(options...)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	return &GRPCServer{
+		Server:        server,
+		addr:          cfg.Addr,
+		socketMode:    cfg.SocketMode,
+		health:        healthServer,
+		projection:    projection,
+		maxLagSeconds: maxLagSeconds,
+	}
+}
+
+// WithWarmStart reports not serving until the warm start is done
+func (s *GRPCServer) WithWarmStart(warmStart WarmStartMonitor) *GRPCServer {
+	s.warmStart = warmStart
+	return s
+}
+
+// ListenAndServe listens on the configured address, a TCP address, Unix
+// socket or socket passed by systemd as Listen takes, and serves gRPC
+// requests
+func (s *GRPCServer) ListenAndServe() error {
+	listener, err := Listen(context.Background(), s.addr, 0, s.socketMode)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// WatchReadiness checks the warm start and the read model every interval and
+// updates the serving status of the server and its services until ctx is
+// done
+func (s *GRPCServer) WatchReadiness(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if s.warmStart == nil || s.warmStart.Ready() {
+			if lag, err := s.projection.Lag(ctx); err == nil && projectionReady(lag, s.maxLagSeconds) {
+				status = healthpb.HealthCheckResponse_SERVING
+			}
+		}
+		s.setServingStatus(status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GracefulStop reports not serving, so health checking clients drain, then
+// stops the server once pending calls finish
+func (s *GRPCServer) GracefulStop() {
+	s.health.Shutdown()
+	s.Server.GracefulStop()
+}
+
+// setServingStatus sets the status of the server and of every service
+// registered on it
+func (s *GRPCServer) setServingStatus(status healthpb.HealthCheckResponse_ServingStatus) {
+	s.health.SetServingStatus("", status)
+	for service := range s.GetServiceInfo() {
+		s.health.SetServingStatus(service, status)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// WriteRateLimitHeaders sets the X-RateLimit-* headers for a status,
+// including X-RateLimit-Warning past the rule's soft threshold and
+// X-RateLimit-Grant and X-RateLimit-Grant-Expires for a budget grant,
+// X-RateLimit-Degraded when storage was unavailable and the failure policy
+// decided the request, and, when the request was denied, Retry-After from
+// the algorithm's next-allowed time
+func WriteRateLimitHeaders(w http.ResponseWriter, status *queries.RateLimitStatus) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.RemainingQuota))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.ResetTime.Unix(), 10))
+	
+	if status.Warning != "" {
+		w.Header().Set("X-RateLimit-Warning", status.Warning)
+	}
+	
+	if status.Degraded != "" {
+		w.Header().Set("X-RateLimit-Degraded", status.Degraded)
+	}
+	
+	if status.Granted > 0 && status.GrantExpiresAt != nil {
+		w.Header().Set("X-RateLimit-Grant", strconv.Itoa(status.Granted))
+		w.Header().Set("X-RateLimit-Grant-Expires", strconv.FormatInt(status.GrantExpiresAt.Unix(), 10))
+	}
+	
+	if !status.IsAllowed {
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfter(status, time.Now())))
+	}
+}
+
+// statusBuffers holds the buffers that WriteStatus encodes statuses into
+var statusBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// WriteStatus writes status as the JSON body of a response with code. The
+// body is the same as json.NewEncoder(w).Encode(status) writes, encoded
+// into a pooled buffer.
+func WriteStatus(w http.ResponseWriter, code int, status *queries.RateLimitStatus) {
+	buf := statusBuffers.Get().(*[]byte)
+	*buf = append(status.AppendJSON((*buf)[:0]), '\n')
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(*buf)
+	
+	statusBuffers.Put(buf)
+}
+
+// WriteThrottleHeader sets X-Throttle-Delay, in milliseconds, when throttle
+// rules recommend delaying an allowed request
+func WriteThrottleHeader(w http.ResponseWriter, delay time.Duration) {
+	if delay > 0 {
+		w.Header().Set("X-Throttle-Delay", strconv.FormatInt(delay.Milliseconds(), 10))
+	}
+}
+
+// RetryAfter returns the seconds a denied client should wait, preferring the
+// next-allowed time recorded by the algorithm over the window reset
+func RetryAfter(status *queries.RateLimitStatus, now time.Time) int {
+	if !status.BlockedUntil.IsZero() {
+		if seconds := queries.RetryAfterSeconds(status.BlockedUntil, now); seconds > 0 {
+			return seconds
+		}
+	}
+	if seconds := queries.RetryAfterSeconds(status.ResetTime, now); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
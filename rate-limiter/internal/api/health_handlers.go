@@ -0,0 +1,444 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// ProjectionMonitor reports how far the read model is behind the event store
+type ProjectionMonitor interface {
+	Lag(ctx context.Context) (*queries.ProjectionLag, error)
+}
+
+// EventBusMonitor reports the delivery statistics of event bus subscribers
+type EventBusMonitor interface {
+	Stats() []queries.SubscriberStats
+}
+
+// DecisionMonitor reports rate limit decisions counted by metric labels
+type DecisionMonitor interface {
+	Counts() []queries.DecisionCount
+}
+
+// KeyStoreMonitor reports the cardinality of the client:resource keys an
+// event store holds
+type KeyStoreMonitor interface {
+	KeyStats() queries.KeyStats
+}
+
+// UnknownEventMonitor reports the events the read model skipped because it
+// does not know their type
+type UnknownEventMonitor interface {
+	UnknownEvents() map[string]uint64
+}
+
+// BlockedCacheMonitor reports the size and lookups of the cache of blocked
+// clients
+type BlockedCacheMonitor interface {
+	Stats() queries.BlockedCacheStats
+}
+
+// AggregateCacheMonitor reports the size and lookups of the cache of
+// rebuilt aggregates
+type AggregateCacheMonitor interface {
+	Stats() queries.AggregateCacheStats
+}
+
+// WriteBatchMonitor reports the batches of event saves and the saves
+// waiting for one
+type WriteBatchMonitor interface {
+	Stats() queries.WriteBatchStats
+}
+
+// ReadReplicaMonitor reports the lag of the replicas of the read model and
+// the queries they answered
+type ReadReplicaMonitor interface {
+	Stats() queries.ReadReplicaStats
+}
+
+// DegradedMonitor reports the checks decided by the storage failure policy
+// while storage was unavailable, and the checks that overran the decision
+// deadline
+type DegradedMonitor interface {
+	DegradedCounts() []queries.DegradedCount
+	DecisionTimeouts() map[string]uint64
+}
+
+// WarmStartMonitor reports whether the state loaded into memory at startup
+// is loaded
+type WarmStartMonitor interface {
+	Ready() bool
+}
+
+// HealthHTTPHandler provides readiness and metrics endpoints
+type HealthHTTPHandler struct {
+	projection    ProjectionMonitor
+	eventBus      EventBusMonitor
+	keyStore      KeyStoreMonitor
+	decisions     DecisionMonitor
+	threatFeeds   ThreatFeedMonitor
+	unknownEvents UnknownEventMonitor
+	blockedCache  BlockedCacheMonitor
+	aggregates    AggregateCacheMonitor
+	writeBatcher  WriteBatchMonitor
+	readReplicas  ReadReplicaMonitor
+	warmStart     WarmStartMonitor
+	degraded      DegradedMonitor
+	maxLagSeconds float64
+}
+
+// NewHealthHTTPHandler creates a new health handler. The service reports
+// not ready while the read model catches up or lags by more than
+// maxLagSeconds.
+func NewHealthHTTPHandler(projection ProjectionMonitor, maxLagSeconds float64) *HealthHTTPHandler {
+	return &HealthHTTPHandler{
+		projection:    projection,
+		maxLagSeconds: maxLagSeconds,
+	}
+}
+
+// WithEventBus adds per-subscriber delivery statistics to the metrics
+func (h *HealthHTTPHandler) WithEventBus(eventBus EventBusMonitor) *HealthHTTPHandler {
+	h.eventBus = eventBus
+	return h
+}
+
+// WithKeyStore adds key cardinality and eviction counts to the metrics
+func (h *HealthHTTPHandler) WithKeyStore(keyStore KeyStoreMonitor) *HealthHTTPHandler {
+	h.keyStore = keyStore
+	return h
+}
+
+// WithDecisions adds decision counts by resource, tenant, algorithm and
+// decision to the metrics
+func (h *HealthHTTPHandler) WithDecisions(decisions DecisionMonitor) *HealthHTTPHandler {
+	h.decisions = decisions
+	return h
+}
+
+// WithThreatFeeds adds the entries, imports and matches of threat feeds to
+// the metrics
+func (h *HealthHTTPHandler) WithThreatFeeds(threatFeeds ThreatFeedMonitor) *HealthHTTPHandler {
+	h.threatFeeds = threatFeeds
+	return h
+}
+
+// WithUnknownEvents adds the unknown events skipped by the read model, by
+// event type, to the metrics
+func (h *HealthHTTPHandler) WithUnknownEvents(unknownEvents UnknownEventMonitor) *HealthHTTPHandler {
+	h.unknownEvents = unknownEvents
+	return h
+}
+
+// WithBlockedCache adds the entries, hits and misses of the cache of blocked
+// clients to the metrics
+func (h *HealthHTTPHandler) WithBlockedCache(blockedCache BlockedCacheMonitor) *HealthHTTPHandler {
+	h.blockedCache = blockedCache
+	return h
+}
+
+// WithAggregateCache adds the entries, hits, misses and invalidations of the
+// cache of rebuilt aggregates, and its hit rate, to the metrics
+func (h *HealthHTTPHandler) WithAggregateCache(aggregates AggregateCacheMonitor) *HealthHTTPHandler {
+	h.aggregates = aggregates
+	return h
+}
+
+// WithWriteBatcher adds the batches of event saves, the saves made in them
+// and those waiting to the metrics
+func (h *HealthHTTPHandler) WithWriteBatcher(writeBatcher WriteBatchMonitor) *HealthHTTPHandler {
+	h.writeBatcher = writeBatcher
+	return h
+}
+
+// WithReadReplicas adds the lag of the read replicas and the queries
+// answered by the primary and the replicas, by query type, to the metrics
+func (h *HealthHTTPHandler) WithReadReplicas(readReplicas ReadReplicaMonitor) *HealthHTTPHandler {
+	h.readReplicas = readReplicas
+	return h
+}
+
+// WithWarmStart reports not ready until the warm start is done, so that
+// traffic only reaches the instance once its hot state is loaded
+func (h *HealthHTTPHandler) WithWarmStart(warmStart WarmStartMonitor) *HealthHTTPHandler {
+	h.warmStart = warmStart
+	return h
+}
+
+// WithDegraded adds the checks decided by the storage failure policy, by
+// resource and mode, and the decision timeouts, by resource, to the metrics
+func (h *HealthHTTPHandler) WithDegraded(degraded DegradedMonitor) *HealthHTTPHandler {
+	h.degraded = degraded
+	return h
+}
+
+// ReadyHandler reports whether the warm start is done and the read model is
+// fresh enough to serve
+func (h *HealthHTTPHandler) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lag, err := h.projection.Lag(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	status := "ready"
+	switch {
+	case h.warmStart != nil && !h.warmStart.Ready():
+		status = "warming_up"
+	case !projectionReady(lag, h.maxLagSeconds):
+		status = "catching_up"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"projection": lag,
+	})
+}
+
+// MetricsHandler serves projection lag in the Prometheus text format
+func (h *HealthHTTPHandler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lag, err := h.projection.Lag(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	catchingUp := 0
+	if lag.CatchingUp {
+		catchingUp = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeGauge(w, "rate_limiter_projection_position", "Events applied to the read model", float64(lag.Position))
+	writeGauge(w, "rate_limiter_event_store_head", "Events stored in the event store", float64(lag.Head))
+	writeGauge(w, "rate_limiter_projection_pending_events", "Events stored but not yet applied to the read model", float64(lag.Pending))
+	writeGauge(w, "rate_limiter_projection_lag_seconds", "Age of the oldest event not yet applied to the read model", lag.LagSeconds)
+	writeGauge(w, "rate_limiter_projection_catching_up", "1 while the read model processes a backlog in bulk", float64(catchingUp))
+
+	if h.eventBus != nil {
+		writeSubscriberMetrics(w, h.eventBus.Stats())
+	}
+	if h.keyStore != nil {
+		stats := h.keyStore.KeyStats()
+		writeGauge(w, "rate_limiter_aggregate_keys", "Client:resource keys held by the event store", float64(stats.Keys))
+		writeGauge(w, "rate_limiter_aggregate_keys_max", "Client:resource keys held before the least recently used is evicted, 0 when unlimited", float64(stats.MaxKeys))
+		writeCounter(w, "rate_limiter_aggregate_key_evictions_total", "Client:resource keys evicted from the event store", float64(stats.Evictions))
+	}
+	if h.decisions != nil {
+		writeDecisionMetrics(w, h.decisions.Counts())
+	}
+	if h.threatFeeds != nil {
+		writeThreatFeedMetrics(w, h.threatFeeds.Stats(r.Context()))
+	}
+	if h.unknownEvents != nil {
+		writeUnknownEventMetrics(w, h.unknownEvents.UnknownEvents())
+	}
+	if h.blockedCache != nil {
+		stats := h.blockedCache.Stats()
+		writeGauge(w, "rate_limiter_blocked_cache_entries", "Denials of blocked clients held by the blocked cache", float64(stats.Entries))
+		writeCounter(w, "rate_limiter_blocked_cache_hits_total", "Requests denied from the blocked cache", float64(stats.Hits))
+		writeCounter(w, "rate_limiter_blocked_cache_misses_total", "Requests the blocked cache did not know to be blocked", float64(stats.Misses))
+	}
+	if h.aggregates != nil {
+		writeAggregateCacheMetrics(w, h.aggregates.Stats())
+	}
+	if h.writeBatcher != nil {
+		stats := h.writeBatcher.Stats()
+		writeCounter(w, "rate_limiter_event_write_batches_total", "Batches of event saves stored in one round trip", float64(stats.Batches))
+		writeCounter(w, "rate_limiter_event_writes_batched_total", "Event saves stored in batches", float64(stats.Writes))
+		writeGauge(w, "rate_limiter_event_writes_pending", "Event saves waiting for their batch", float64(stats.Pending))
+	}
+	if h.readReplicas != nil {
+		writeReadReplicaMetrics(w, h.readReplicas.Stats())
+	}
+	if h.degraded != nil {
+		writeDegradedMetrics(w, h.degraded.DegradedCounts())
+		writeDecisionTimeoutMetrics(w, h.degraded.DecisionTimeouts())
+	}
+}
+
+// RegisterRoutes adds the health endpoints to mux
+func (h *HealthHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/readyz", h.ReadyHandler)
+	mux.HandleFunc("/metrics", h.MetricsHandler)
+}
+
+// projectionReady reports whether the read model is fresh enough to serve
+func projectionReady(lag *queries.ProjectionLag, maxLagSeconds float64) bool {
+	return !lag.CatchingUp && lag.LagSeconds <= maxLagSeconds
+}
+
+// writeGauge writes one gauge sample with its help and type lines
+func writeGauge(w http.ResponseWriter, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+}
+
+// writeCounter writes one counter sample with its help and type lines
+func writeCounter(w http.ResponseWriter, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %g\n", name, help, name, name, value)
+}
+
+// writeAggregateCacheMetrics writes the size and lookups of the cache of
+// rebuilt aggregates, with the share of lookups it answered
+func writeAggregateCacheMetrics(w http.ResponseWriter, stats queries.AggregateCacheStats) {
+	hitRate := 0.0
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		hitRate = float64(stats.Hits) / float64(lookups)
+	}
+	writeGauge(w, "rate_limiter_aggregate_cache_entries", "Aggregates held by the aggregate cache", float64(stats.Entries))
+	writeCounter(w, "rate_limiter_aggregate_cache_hits_total", "Decisions made on a cached aggregate without loading its events", float64(stats.Hits))
+	writeCounter(w, "rate_limiter_aggregate_cache_misses_total", "Decisions that loaded the events of their aggregate", float64(stats.Misses))
+	writeCounter(w, "rate_limiter_aggregate_cache_invalidations_total", "Cached aggregates dropped as stale or erased", float64(stats.Invalidations))
+	writeGauge(w, "rate_limiter_aggregate_cache_hit_rate", "Share of aggregate lookups answered by the cache since startup", hitRate)
+}
+
+// writeReadReplicaMetrics writes the lag of each read replica and the read
+// model queries labelled by query type and where they were answered
+func writeReadReplicaMetrics(w http.ResponseWriter, stats queries.ReadReplicaStats) {
+	const lagName = "rate_limiter_read_replica_lag_seconds"
+	fmt.Fprintf(w, "# HELP %s Lag of a read replica when last measured plus the time since\n# TYPE %s gauge\n", lagName, lagName)
+	for _, replica := range stats.Replicas {
+		fmt.Fprintf(w, "%s{replica=%q} %g\n", lagName, replica.Name, replica.LagSeconds)
+	}
+
+	const availableName = "rate_limiter_read_replica_available"
+	fmt.Fprintf(w, "# HELP %s 1 while a read replica answers queries, 0 while its lag is unknown\n# TYPE %s gauge\n", availableName, availableName)
+	for _, replica := range stats.Replicas {
+		available := 0
+		if replica.Available {
+			available = 1
+		}
+		fmt.Fprintf(w, "%s{replica=%q} %d\n", availableName, replica.Name, available)
+	}
+
+	const queriesName = "rate_limiter_read_queries_total"
+	fmt.Fprintf(w, "# HELP %s Read model queries by query type and whether the primary or a replica answered them\n# TYPE %s counter\n", queriesName, queriesName)
+	for _, count := range stats.Queries {
+		fmt.Fprintf(w, "%s{query=%q,target=%q} %d\n", queriesName, count.Query, count.Target, count.Count)
+	}
+}
+
+// writeDecisionMetrics writes decision counts labelled by resource, tenant,
+// algorithm and decision
+func writeDecisionMetrics(w http.ResponseWriter, counts []queries.DecisionCount) {
+	const name = "rate_limiter_decisions_total"
+	fmt.Fprintf(w, "# HELP %s Rate limit decisions by resource, client tier, algorithm and outcome\n# TYPE %s counter\n", name, name)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s{resource=%q,tenant=%q,algorithm=%q,decision=%q} %d\n", name, c.Resource, c.Tenant, c.Algorithm, c.Decision, c.Count)
+	}
+}
+
+// writeDegradedMetrics writes the checks decided by the storage failure
+// policy labelled by resource and mode
+func writeDegradedMetrics(w http.ResponseWriter, counts []queries.DegradedCount) {
+	const name = "rate_limiter_degraded_decisions_total"
+	fmt.Fprintf(w, "# HELP %s Checks decided by the failure policy because storage was unavailable\n# TYPE %s counter\n", name, name)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%s{resource=%q,mode=%q} %d\n", name, c.Resource, c.Mode, c.Count)
+	}
+}
+
+// writeDecisionTimeoutMetrics writes the checks that overran the decision
+// deadline labelled by resource
+func writeDecisionTimeoutMetrics(w http.ResponseWriter, timeouts map[string]uint64) {
+	const name = "rate_limiter_decision_timeouts_total"
+	fmt.Fprintf(w, "# HELP %s Checks that overran the decision deadline\n# TYPE %s counter\n", name, name)
+
+	resources := make([]string, 0, len(timeouts))
+	for resource := range timeouts {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	for _, resource := range resources {
+		fmt.Fprintf(w, "%s{resource=%q} %d\n", name, resource, timeouts[resource])
+	}
+}
+
+// writeUnknownEventMetrics writes the unknown events skipped by the read
+// model labelled by event type
+func writeUnknownEventMetrics(w http.ResponseWriter, counts map[string]uint64) {
+	const name = "rate_limiter_read_model_unknown_events_total"
+	fmt.Fprintf(w, "# HELP %s Events skipped by the read model because their type is unknown\n# TYPE %s counter\n", name, name)
+
+	eventTypes := make([]string, 0, len(counts))
+	for eventType := range counts {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	for _, eventType := range eventTypes {
+		fmt.Fprintf(w, "%s{event_type=%q} %d\n", name, eventType, counts[eventType])
+	}
+}
+
+// writeSubscriberMetrics writes event bus delivery statistics labelled by
+// subscriber
+func writeSubscriberMetrics(w http.ResponseWriter, stats []queries.SubscriberStats) {
+	metrics := []struct {
+		name, help, kind string
+		value            func(queries.SubscriberStats) float64
+	}{
+		{"rate_limiter_event_bus_delivered_total", "Events delivered to the subscriber", "counter",
+			func(s queries.SubscriberStats) float64 { return float64(s.Delivered) }},
+		{"rate_limiter_event_bus_dropped_total", "Events dropped because the subscriber's buffer was full", "counter",
+			func(s queries.SubscriberStats) float64 { return float64(s.Dropped) }},
+		{"rate_limiter_event_bus_queued_events", "Events waiting in the subscriber's buffer", "gauge",
+			func(s queries.SubscriberStats) float64 { return float64(s.Queued) }},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{subscriber=\"%d\",event_type=%q,policy=%q} %g\n", metric.name, s.ID, s.EventType, s.Policy, metric.value(s))
+		}
+	}
+}
+
+// writeThreatFeedMetrics writes threat feed statistics labelled by feed
+func writeThreatFeedMetrics(w http.ResponseWriter, stats []queries.ThreatFeedStats) {
+	metrics := []struct {
+		name, help, kind string
+		value            func(queries.ThreatFeedStats) float64
+	}{
+		{"rate_limiter_threat_feed_entries", "Networks listed by the threat feed", "gauge",
+			func(s queries.ThreatFeedStats) float64 { return float64(s.Entries) }},
+		{"rate_limiter_threat_feed_matches_total", "Requests from networks listed by the threat feed", "counter",
+			func(s queries.ThreatFeedStats) float64 { return float64(s.Matches) }},
+		{"rate_limiter_threat_feed_imports_total", "Imports of the threat feed, including failed ones", "counter",
+			func(s queries.ThreatFeedStats) float64 { return float64(s.Imports) }},
+		{"rate_limiter_threat_feed_import_errors_total", "Failed imports of the threat feed", "counter",
+			func(s queries.ThreatFeedStats) float64 { return float64(s.ImportErrors) }},
+		{"rate_limiter_threat_feed_last_change_timestamp_seconds", "When an import last changed the threat feed's networks, 0 before the first", "gauge",
+			func(s queries.ThreatFeedStats) float64 {
+				if s.LastChangeAt == nil {
+					return 0
+				}
+				return float64(s.LastChangeAt.Unix())
+			}},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{feed=%q,action=%q} %g\n", metric.name, s.Feed, s.Action, metric.value(s))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// History formats, chosen by the format parameter or the Accept header
+const (
+	historyFormatJSON   = "json"
+	historyFormatCSV    = "csv"
+	historyFormatNDJSON = "ndjson"
+)
+
+// historyExportPage is the number of events read per page while exporting
+const historyExportPage = 1000
+
+// historyCSVHeader names the columns of a CSV history export
+var historyCSVHeader = []string{"event_id", "event_type", "client_id", "resource", "timestamp", "request_count", "limit", "is_blocked", "ip_address", "user_agent"}
+
+// historyPager reads the page of at most limit events after the cursor,
+// skipping offset more
+type historyPager func(after *queries.HistoryCursor, limit, offset int) (*queries.RateLimitHistory, error)
+
+// historyFormat returns the format a history is written in. The format
+// parameter takes precedence over the Accept header, and JSON is the default.
+func historyFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case historyFormatJSON, historyFormatCSV, historyFormatNDJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q, expected json, csv or ndjson", format)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv":
+			return historyFormatCSV, nil
+		case "application/x-ndjson", "application/ndjson":
+			return historyFormatNDJSON, nil
+		case "application/json":
+			return historyFormatJSON, nil
+		}
+	}
+	return historyFormatJSON, nil
+}
+
+// parseHistoryCursor returns the cursor in the cursor parameter, if any
+func parseHistoryCursor(r *http.Request) (*queries.HistoryCursor, error) {
+	token := r.URL.Query().Get("cursor")
+	if token == "" {
+		return nil, nil
+	}
+	return queries.ParseHistoryCursor(token)
+}
+
+// parseHistoryFilter returns the filter of the event_type, decision,
+// ip_address and user_agent parameters. Event types are given as a comma
+// separated list or by repeating the parameter.
+func parseHistoryFilter(r *http.Request) (queries.HistoryFilter, error) {
+	params := r.URL.Query()
+	filter := queries.HistoryFilter{
+		Decision:  params.Get("decision"),
+		IPAddress: params.Get("ip_address"),
+		UserAgent: params.Get("user_agent"),
+	}
+	if err := filter.Validate(); err != nil {
+		return filter, err
+	}
+
+	for _, names := range params["event_type"] {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			eventType, err := queries.ParseHistoryEventType(name)
+			if err != nil {
+				return filter, err
+			}
+			filter.EventTypes = append(filter.EventTypes, eventType)
+		}
+	}
+	return filter, nil
+}
+
+// historyEncoder writes the events of a history export
+type historyEncoder interface {
+	Encode(event queries.RateLimitEvent) error
+	Flush() error
+}
+
+// ndjsonHistoryEncoder writes one JSON event per line
+type ndjsonHistoryEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonHistoryEncoder) Encode(event queries.RateLimitEvent) error {
+	return e.encoder.Encode(event)
+}
+
+func (e *ndjsonHistoryEncoder) Flush() error {
+	return nil
+}
+
+// csvHistoryEncoder writes one CSV row per event after a header row
+type csvHistoryEncoder struct {
+	writer *csv.Writer
+}
+
+func newCSVHistoryEncoder(w http.ResponseWriter) (*csvHistoryEncoder, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(historyCSVHeader); err != nil {
+		return nil, err
+	}
+	return &csvHistoryEncoder{writer: writer}, nil
+}
+
+func (e *csvHistoryEncoder) Encode(event queries.RateLimitEvent) error {
+	return e.writer.Write([]string{
+		event.EventID,
+		event.EventType,
+		event.ClientID,
+		event.Resource,
+		event.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(event.RequestCount),
+		strconv.Itoa(event.Limit),
+		strconv.FormatBool(event.IsBlocked),
+		event.IPAddress,
+		event.UserAgent,
+	})
+}
+
+func (e *csvHistoryEncoder) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// streamHistory writes a history as CSV or NDJSON page by page, so that
+// only one page is held in memory however long the history is. Without a
+// limit the whole history is written; with one, and more events left, the
+// cursor to continue from is sent in the X-Next-Cursor trailer.
+func streamHistory(w http.ResponseWriter, format string, pager historyPager, after *queries.HistoryCursor, limit, offset int) {
+	pageLimit := func(written int) int {
+		if limit > 0 && limit-written < historyExportPage {
+			return limit - written
+		}
+		return historyExportPage
+	}
+
+	// Errors of the first page can still be answered with a status
+	history, err := pager(after, pageLimit(0), offset)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	// The export outlives the server's write timeout
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	var encoder historyEncoder
+	if format == historyFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Trailer", "X-Next-Cursor")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if format == historyFormatCSV {
+		if encoder, err = newCSVHistoryEncoder(w); err != nil {
+			return
+		}
+	} else {
+		encoder = &ndjsonHistoryEncoder{encoder: json.NewEncoder(w)}
+	}
+
+	written := 0
+	for {
+		for _, event := range history.Events {
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		}
+		written += len(history.Events)
+		if err := encoder.Flush(); err != nil {
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+
+		if !history.HasMore || history.NextCursor == "" {
+			return
+		}
+		if limit > 0 && written >= limit {
+			w.Header().Set("X-Next-Cursor", history.NextCursor)
+			return
+		}
+
+		if after, err = queries.ParseHistoryCursor(history.NextCursor); err != nil {
+			log.Printf("History export stopped after %d event(s): %v", written, err)
+			return
+		}
+		if history, err = pager(after, pageLimit(written), 0); err != nil {
+			// The status is already sent, so the export ends short
+			log.Printf("History export stopped after %d event(s): %v", written, err)
+			return
+		}
+	}
+}
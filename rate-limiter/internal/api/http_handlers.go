@@ -1,15 +1,27 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
 )
 
 // HTTPHandler provides HTTP endpoints for the rate limiter
 type HTTPHandler struct {
-	service *RateLimiterService
+	service     *RateLimiterService
+	denied      *DeniedResponse
+	deprecation Deprecation // Announced on v1 responses
 }
 
 // NewHTTPHandler creates a new HTTP handler
@@ -19,33 +31,93 @@ func NewHTTPHandler(service *RateLimiterService) *HTTPHandler {
 	}
 }
 
+// WithDeniedTemplates renders the bodies of denied checks from templates
+// instead of the rate limit status
+func (h *HTTPHandler) WithDeniedTemplates(templates *denial.Templates) *HTTPHandler {
+	h.denied = NewDeniedResponse(templates, h.service)
+	return h
+}
+
 // CheckRateLimitHandler handles rate limit check requests
 func (h *HTTPHandler) CheckRateLimitHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
-	var req struct {
-		ClientID  string `json:"client_id"`
-		Resource  string `json:"resource"`
-		IPAddress string `json:"ip_address,omitempty"`
-		UserAgent string `json:"user_agent,omitempty"`
+	req, ok := decodeCheckRequest(w, r)
+	if !ok {
+		return
 	}
+	resource, attrs := req.Resource, req.attributes(r)
 	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	status, err := h.service.CheckRequestRateLimitWithGrant(r.Context(), resource, attrs, req.Grant)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
-	if req.ClientID == "" || req.Resource == "" {
-		http.Error(w, "client_id and resource are required", http.StatusBadRequest)
+	decision := accesslog.DecisionAllowed
+	if !status.IsAllowed {
+		decision = accesslog.DecisionDenied
+	}
+	accesslog.Annotate(r.Context(), attrs.ClientID, resource, decision, status.RemainingQuota, nil)
+	
+	// Set appropriate status code
+	statusCode := http.StatusOK
+	if !status.IsAllowed {
+		statusCode = http.StatusTooManyRequests
+	}
+	WriteRateLimitHeaders(w, status)
+	if status.IsAllowed || !acceptsJSON(r) || !h.denied.Write(r.Context(), w, statusCode, attrs.ClientID, resource, "", status) {
+		WriteNegotiatedStatus(w, r, statusCode, status)
+	}
+	queries.ReleaseStatus(status)
+}
+
+// PeekHandler answers whether a check would be allowed now, without
+// consuming quota or recording events. It takes the body of a check and
+// always answers 200, leaving is_allowed to tell the outcome.
+func (h *HTTPHandler) PeekHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
+	req, ok := decodeCheckRequest(w, r)
+	if !ok {
+		return
+	}
+	
+	status, err := h.service.PeekRateLimit(r.Context(), req.Resource, req.attributes(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	WriteNegotiatedStatus(w, r, http.StatusOK, status)
+	queries.ReleaseStatus(status)
+}
+
+// checkRequest is the body of a check
+type checkRequest struct {
+	ClientID    string            `json:"client_id"`
+	Resource    string            `json:"resource"`
+	IPAddress   string            `json:"ip_address,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	Method      string            `json:"method,omitempty"` // Selects method-specific rules; also used by key templates
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	QueryParams map[string]string `json:"query_params,omitempty"`
+	Grant       int               `json:"grant,omitempty"` // Further requests to count in advance when the check is allowed
+}
+
+// attributes returns the attributes of the checked request, taking the IP
+// address and User-Agent from r when the body leaves them out
+func (req checkRequest) attributes(r *http.Request) keytemplate.Attributes {
 	// Use IP from request if not provided
 	if req.IPAddress == "" {
-		req.IPAddress = r.RemoteAddr
+		req.IPAddress = clientip.FromRequest(r)
 	}
 	
 	// Use User-Agent from request if not provided
@@ -53,41 +125,100 @@ func (h *HTTPHandler) CheckRateLimitHandler(w http.ResponseWriter, r *http.Reque
 		req.UserAgent = r.UserAgent()
 	}
 	
-	status, err := h.service.CheckRateLimit(r.Context(), req.ClientID, req.Resource, req.IPAddress, req.UserAgent)
+	return keytemplate.Attributes{
+		ClientID:  req.ClientID,
+		Resource:  req.Resource,
+		IPAddress: req.IPAddress,
+		UserAgent: req.UserAgent,
+		Method:    req.Method,
+		Path:      req.Path,
+		Header:    keytemplate.HeaderFromMap(req.Headers),
+		Query:     keytemplate.QueryFromMap(req.QueryParams),
+	}
+}
+
+// decodeCheckRequest decodes the body of a check, writing an error response
+// when it is invalid
+func decodeCheckRequest(w http.ResponseWriter, r *http.Request) (checkRequest, bool) {
+	var req checkRequest
+	if !DecodeJSON(w, r, &req) {
+		return req, false
+	}
+	
+	if req.ClientID == "" || req.Resource == "" {
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
+		return req, false
+	}
+	
+	if req.Grant < 0 {
+		httpError(w, r, "grant must not be negative", http.StatusBadRequest)
+		return req, false
+	}
+	
+	return req, true
+}
+
+// CheckAllHandler checks a request against several resources at once. It
+// takes the body of a check with resources instead of resource, and counts
+// the request against every resource when all of them allow it, or against
+// none.
+func (h *HTTPHandler) CheckAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		checkRequest
+		Resources []string `json:"resources"`
+	}
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.ClientID == "" || len(req.Resources) == 0 || slices.Contains(req.Resources, "") {
+		httpError(w, r, "client_id and resources are required", http.StatusBadRequest)
+		return
+	}
+	
+	result, err := h.service.CheckRequestRateLimits(r.Context(), req.Resources, req.attributes(r))
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	
-	// Set appropriate status code
 	statusCode := http.StatusOK
-	if !status.IsAllowed {
+	if !result.IsAllowed {
 		statusCode = http.StatusTooManyRequests
-		
-		// Set rate limit headers
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
-		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.RemainingQuota))
-		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.ResetTime.Unix(), 10))
-		
-		if status.RetryAfter > 0 {
-			w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+	}
+	if status := tightestStatus(result.Statuses); status != nil {
+		WriteRateLimitHeaders(w, status)
+	}
+	if !result.IsAllowed && acceptsJSON(r) && h.denied.Write(r.Context(), w, statusCode, req.ClientID, result.DeniedResource, "", result.Statuses[0]) {
+		return
+	}
+	WriteNegotiatedStatuses(w, r, statusCode, result)
+}
+
+// tightestStatus returns the status of the resource with the least quota
+// left, skipping statuses decided without a rule, or nil when there is none
+func tightestStatus(statuses []*queries.RateLimitStatus) *queries.RateLimitStatus {
+	var tightest *queries.RateLimitStatus
+	for _, status := range statuses {
+		if status.Limit == 0 && status.IsAllowed {
+			continue
+		}
+		if tightest == nil || status.RemainingQuota < tightest.RemainingQuota {
+			tightest = status
 		}
-	} else {
-		// Set rate limit headers for successful requests too
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
-		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.RemainingQuota))
-		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(status.ResetTime.Unix(), 10))
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(status)
+	return tightest
 }
 
 // GetStatusHandler handles rate limit status requests
 func (h *HTTPHandler) GetStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
@@ -95,24 +226,59 @@ func (h *HTTPHandler) GetStatusHandler(w http.ResponseWriter, r *http.Request) {
 	resource := r.URL.Query().Get("resource")
 	
 	if clientID == "" || resource == "" {
-		http.Error(w, "client_id and resource are required", http.StatusBadRequest)
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
 		return
 	}
 	
 	status, err := h.service.GetRateLimitStatus(r.Context(), clientID, resource)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+	
+	WriteNegotiatedStatus(w, r, http.StatusOK, status)
+	queries.ReleaseStatus(status)
+}
+
+// ExplainHandler explains why requests of a client to a resource are
+// allowed or blocked: the rule chosen among the resource's rules, its
+// algorithm parameters, the window math a request would be decided with now
+// and the conditions of the last stored decision. The optional method
+// parameter selects method-specific rules, and key the limit key of rules
+// with a key template.
+func (h *HTTPHandler) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	params := r.URL.Query()
+	clientID := params.Get("client_id")
+	resource := params.Get("resource")
+	
+	if clientID == "" || resource == "" {
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
+		return
+	}
+	
+	explanation, err := h.service.ExplainDecision(r.Context(), clientID, resource, params.Get("method"), params.Get("key"))
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	json.NewEncoder(w).Encode(explanation)
 }
 
-// GetHistoryHandler handles rate limit history requests
+// GetHistoryHandler handles rate limit history requests. The history is
+// returned as JSON pages, or streamed as CSV or NDJSON when asked for by the
+// format parameter or the Accept header. Streamed histories are complete
+// unless a limit is given. Both can be filtered by event type, decision, IP
+// address and user agent.
 func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
@@ -120,7 +286,7 @@ func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request)
 	resource := r.URL.Query().Get("resource")
 	
 	if clientID == "" || resource == "" {
-		http.Error(w, "client_id and resource are required", http.StatusBadRequest)
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
 		return
 	}
 	
@@ -131,7 +297,7 @@ func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request)
 	if startStr := r.URL.Query().Get("start_time"); startStr != "" {
 		startTime, err = time.Parse(time.RFC3339, startStr)
 		if err != nil {
-			http.Error(w, "Invalid start_time format", http.StatusBadRequest)
+			httpError(w, r, "Invalid start_time format", http.StatusBadRequest)
 			return
 		}
 	} else {
@@ -141,14 +307,32 @@ func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request)
 	if endStr := r.URL.Query().Get("end_time"); endStr != "" {
 		endTime, err = time.Parse(time.RFC3339, endStr)
 		if err != nil {
-			http.Error(w, "Invalid end_time format", http.StatusBadRequest)
+			httpError(w, r, "Invalid end_time format", http.StatusBadRequest)
 			return
 		}
 	} else {
 		endTime = time.Now()
 	}
 	
-	limit := 100 // default
+	format, err := historyFormat(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	after, err := parseHistoryCursor(r)
+	if err != nil {
+		httpError(w, r, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	limit := 0 // default: the whole history when streamed
 	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
 		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
 			limit = parsedLimit
@@ -157,31 +341,49 @@ func (h *HTTPHandler) GetHistoryHandler(w http.ResponseWriter, r *http.Request)
 	
 	offset := 0 // default
 	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if RequestAPIVersion(r) == APIv2 {
+			httpError(w, r, "offset is not supported; pass next_cursor as cursor", http.StatusBadRequest)
+			return
+		}
 		if parsedOffset, err := strconv.Atoi(offsetStr); err == nil && parsedOffset >= 0 {
 			offset = parsedOffset
 		}
 	}
 	
-	history, err := h.service.GetRateLimitHistory(r.Context(), clientID, resource, startTime, endTime, limit, offset)
+	if format != historyFormatJSON {
+		streamHistory(w, format, func(after *queries.HistoryCursor, limit, offset int) (*queries.RateLimitHistory, error) {
+			return h.service.GetRateLimitHistory(r.Context(), clientID, resource, startTime, endTime, limit, offset, after, filter)
+		}, after, limit, offset)
+		return
+	}
+	
+	if limit == 0 {
+		limit = 100
+	}
+	history, err := h.service.GetRateLimitHistory(r.Context(), clientID, resource, startTime, endTime, limit, offset, after, filter)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
+	if RequestAPIVersion(r) == APIv2 {
+		json.NewEncoder(w).Encode(page{Data: history.Events, NextCursor: history.NextCursor})
+		return
+	}
 	json.NewEncoder(w).Encode(history)
 }
 
 // GetStatsHandler handles client statistics requests
 func (h *HTTPHandler) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
 	clientID := r.URL.Query().Get("client_id")
 	if clientID == "" {
-		http.Error(w, "client_id is required", http.StatusBadRequest)
+		httpError(w, r, "client_id is required", http.StatusBadRequest)
 		return
 	}
 	
@@ -192,7 +394,7 @@ func (h *HTTPHandler) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	if startStr := r.URL.Query().Get("start_time"); startStr != "" {
 		startTime, err = time.Parse(time.RFC3339, startStr)
 		if err != nil {
-			http.Error(w, "Invalid start_time format", http.StatusBadRequest)
+			httpError(w, r, "Invalid start_time format", http.StatusBadRequest)
 			return
 		}
 	} else {
@@ -202,16 +404,25 @@ func (h *HTTPHandler) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	if endStr := r.URL.Query().Get("end_time"); endStr != "" {
 		endTime, err = time.Parse(time.RFC3339, endStr)
 		if err != nil {
-			http.Error(w, "Invalid end_time format", http.StatusBadRequest)
+			httpError(w, r, "Invalid end_time format", http.StatusBadRequest)
 			return
 		}
 	} else {
 		endTime = time.Now()
 	}
 	
-	stats, err := h.service.GetClientStats(r.Context(), clientID, startTime, endTime)
+	// Without a granularity one suiting the range is selected
+	var granularity queries.StatsGranularity
+	if name := r.URL.Query().Get("granularity"); name != "" {
+		if granularity, err = queries.ParseStatsGranularity(name); err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	
+	stats, err := h.service.GetClientStats(r.Context(), clientID, startTime, endTime, granularity)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	
@@ -219,43 +430,177 @@ func (h *HTTPHandler) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
-// CreateRuleHandler handles rule creation requests
-func (h *HTTPHandler) CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// RulesHandler lists rules on GET and creates them on POST and PUT
+func (h *HTTPHandler) RulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.listRules(w, r)
 		return
 	}
+	h.CreateRuleHandler(w, r)
+}
+
+// listRules lists the rules, of the resource parameter if set, ordered by
+// ID. Up to limit rules (100 by default) are listed per page; next_cursor
+// passed as cursor gets the next page.
+func (h *HTTPHandler) listRules(w http.ResponseWriter, r *http.Request) {
+	var after *queries.RuleCursor
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		var err error
+		if after, err = queries.ParseRuleCursor(token); err != nil {
+			httpError(w, r, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
 	
-	var req struct {
-		Resource  string `json:"resource"`
-		Limit     int    `json:"limit"`
-		Window    string `json:"window"`    // e.g., "1h", "5m", "30s"
-		Algorithm string `json:"algorithm"` // e.g., "sliding_window", "fixed_window"
+	limit := 100 // default
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 && parsedLimit <= 1000 {
+			limit = parsedLimit
+		}
 	}
 	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	rules, err := h.service.ListRules(r.Context(), r.URL.Query().Get("resource"), limit, after)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	
-	if req.Resource == "" || req.Limit <= 0 || req.Window == "" {
-		http.Error(w, "resource, limit, and window are required", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	if RequestAPIVersion(r) == APIv2 {
+		json.NewEncoder(w).Encode(page{Data: rules.Rules, NextCursor: rules.NextCursor})
 		return
 	}
+	json.NewEncoder(w).Encode(rules)
+}
+
+// ruleRequest is the body of rule create, apply and simulate requests
+type ruleRequest struct {
+	Resource      string  `json:"resource"`
+	Method        string  `json:"method,omitempty"` // e.g., "POST"; any method when empty
+	Limit         int     `json:"limit"`
+	Window        string  `json:"window"`                   // e.g., "1h", "5m", "30s"
+	Algorithm     string  `json:"algorithm"`                // e.g., "sliding_window", "fixed_window"
+	KeyTemplate   string  `json:"key_template,omitempty"`   // e.g., "header.X-Api-Key", "{ip}:{path}"
+	SoftThreshold float64 `json:"soft_threshold,omitempty"` // e.g., 0.8 to warn at 80% of limit
 	
-	window, err := time.ParseDuration(req.Window)
-	if err != nil {
-		http.Error(w, "Invalid window format", http.StatusBadRequest)
-		return
+	// e.g., {"token_bucket": {"bucket_size": 50, "refill_rate": 5}}, which sets limit and window
+	Parameters *domain.AlgorithmParameters `json:"parameters,omitempty"`
+	
+	// e.g., [{"limit": 1000, "window": "1h"}] on top of 10 per second
+	Windows []struct {
+		Limit  int    `json:"limit"`
+		Window string `json:"window"`
+	} `json:"windows,omitempty"`
+	
+	Flag string `json:"flag,omitempty"` // e.g., "enforce-strict-login-limits"; enforced only for clients the flag is on for
+	
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`      // e.g., "payments-team"
+	ChangeRef   string `json:"change_ref,omitempty"` // e.g., "CHG-1234"
+}
+
+// settings checks the rule of the request and returns its limit, window and
+// extra windows, or the message of a bad request when it is invalid. The
+// algorithm defaults to the sliding window.
+func (req *ruleRequest) settings() (int, time.Duration, []domain.WindowLimit, string) {
+	var window time.Duration
+	if req.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(req.Window); err != nil {
+			return 0, 0, nil, "Invalid window format"
+		}
 	}
 	
 	if req.Algorithm == "" {
 		req.Algorithm = "sliding_window" // default
 	}
 	
-	err = h.service.CreateRule(r.Context(), req.Resource, req.Limit, window, req.Algorithm)
+	// Bucket parameters may give the limit and window instead
+	limit, window, err := req.Parameters.Resolve(domain.Algorithm(req.Algorithm), req.Limit, window)
+	if err != nil {
+		return 0, 0, nil, "Invalid parameters: " + err.Error()
+	}
+	
+	if req.Resource == "" || limit <= 0 || window <= 0 {
+		return 0, 0, nil, "resource, limit, and window are required"
+	}
+	
+	var windows []domain.WindowLimit
+	for _, extra := range req.Windows {
+		extraWindow, err := time.ParseDuration(extra.Window)
+		if err != nil {
+			return 0, 0, nil, "Invalid window format in windows"
+		}
+		windows = append(windows, domain.WindowLimit{Limit: extra.Limit, Window: extraWindow})
+	}
+	if err := domain.ValidateWindows(window, windows); err != nil {
+		return 0, 0, nil, "Invalid windows: " + err.Error()
+	}
+	
+	if req.KeyTemplate != "" {
+		if _, err := keytemplate.Parse(req.KeyTemplate); err != nil {
+			return 0, 0, nil, err.Error()
+		}
+	}
+	
+	if req.SoftThreshold < 0 || req.SoftThreshold > 1 {
+		return 0, 0, nil, "soft_threshold must be between 0 and 1"
+	}
+	return limit, window, windows, ""
+}
+
+// CreateRuleHandler handles rule creation requests. POST always creates a
+// rule while PUT creates or replaces the rule for the resource and method.
+func (h *HTTPHandler) CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req ruleRequest
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	limit, window, windows, message := req.settings()
+	if message != "" {
+		httpError(w, r, message, http.StatusBadRequest)
+		return
+	}
+	
+	spec := RuleSpec{
+		Resource:      req.Resource,
+		Method:        req.Method,
+		Limit:         limit,
+		Window:        window,
+		Algorithm:     req.Algorithm,
+		KeyTemplate:   req.KeyTemplate,
+		SoftThreshold: req.SoftThreshold,
+		Parameters:    req.Parameters,
+		Windows:       windows,
+		Flag:          req.Flag,
+		Annotations: domain.RuleAnnotations{
+			Description: req.Description,
+			Owner:       req.Owner,
+			ChangeRef:   req.ChangeRef,
+		},
+	}
+	
+	if r.Method == http.MethodPut {
+		err := h.service.ApplyRule(r.Context(), spec)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "applied"})
+		return
+	}
+	
+	err := h.service.CreateRule(r.Context(), spec)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	
@@ -266,7 +611,7 @@ func (h *HTTPHandler) CreateRuleHandler(w http.ResponseWriter, r *http.Request)
 // ResetHandler handles rate limit reset requests
 func (h *HTTPHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	
@@ -275,19 +620,18 @@ func (h *HTTPHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
 		Resource string `json:"resource"`
 	}
 	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !DecodeJSON(w, r, &req) {
 		return
 	}
 	
 	if req.ClientID == "" || req.Resource == "" {
-		http.Error(w, "client_id and resource are required", http.StatusBadRequest)
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
 		return
 	}
 	
 	err := h.service.ResetRateLimit(r.Context(), req.ClientID, req.Resource)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	
@@ -295,16 +639,575 @@ func (h *HTTPHandler) ResetHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
 }
 
+// RefundHandler gives back the quota of a client's most recent allowed
+// request when the operation it protected failed before doing real work
+func (h *HTTPHandler) RefundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		ClientID string `json:"client_id"`
+		Resource string `json:"resource"`
+		Method   string `json:"method,omitempty"` // e.g., "POST"; selects method-specific rules
+		Key      string `json:"key,omitempty"`    // Rendered limit key for rules with a key template; client_id when empty
+		Reason   string `json:"reason,omitempty"`
+	}
+	
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.ClientID == "" || req.Resource == "" {
+		httpError(w, r, "client_id and resource are required", http.StatusBadRequest)
+		return
+	}
+	
+	key := req.ClientID
+	if req.Key != "" {
+		key = req.Key
+	}
+	
+	refund, err := h.service.RefundRateLimit(r.Context(), key, req.Resource, req.Method, req.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrNothingToRefund):
+			httpError(w, r, err.Error(), http.StatusConflict)
+		case errors.Is(err, domain.ErrRefundLimitReached):
+			httpError(w, r, err.Error(), http.StatusTooManyRequests)
+		default:
+			writeError(w, r, err)
+		}
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
+
+// OverridesHandler handles per-client override requests. POST grants a
+// client a temporary limit, GET lists the overrides in effect and DELETE
+// revokes one.
+func (h *HTTPHandler) OverridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.createOverride(w, r)
+	case http.MethodGet:
+		h.listOverrides(w, r)
+	case http.MethodDelete:
+		h.deleteOverride(w, r)
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createOverride grants a client a temporary limit for a resource
+func (h *HTTPHandler) createOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ClientID  string    `json:"client_id"`
+		Resource  string    `json:"resource"`
+		Method    string    `json:"method,omitempty"` // e.g., "POST"; any method when empty
+		Limit     int       `json:"limit"`
+		Window    string    `json:"window,omitempty"`     // e.g., "1m"; the rule's window when empty
+		TTL       string    `json:"ttl,omitempty"`        // e.g., "2h"; or set expires_at
+		ExpiresAt time.Time `json:"expires_at,omitempty"` // RFC 3339
+		Reason    string    `json:"reason,omitempty"`
+	}
+	
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.ClientID == "" || req.Resource == "" || req.Limit <= 0 {
+		httpError(w, r, "client_id, resource, and limit are required", http.StatusBadRequest)
+		return
+	}
+	
+	var window time.Duration
+	if req.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(req.Window); err != nil || window <= 0 {
+			httpError(w, r, "Invalid window format", http.StatusBadRequest)
+			return
+		}
+	}
+	
+	expiresAt := req.ExpiresAt
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			httpError(w, r, "Invalid ttl format", http.StatusBadRequest)
+			return
+		}
+		expiresAt = h.service.clock.Now().Add(ttl)
+	}
+	if !expiresAt.After(h.service.clock.Now()) {
+		httpError(w, r, "ttl or a future expires_at is required", http.StatusBadRequest)
+		return
+	}
+	
+	override, err := h.service.CreateOverride(r.Context(), req.ClientID, req.Resource, req.Method, req.Limit, window, expiresAt, req.Reason)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(override)
+}
+
+// listOverrides lists the overrides in effect, filtered by the optional
+// client_id and resource parameters
+func (h *HTTPHandler) listOverrides(w http.ResponseWriter, r *http.Request) {
+	overrides, err := h.service.ListOverrides(r.Context(), r.URL.Query().Get("client_id"), r.URL.Query().Get("resource"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"overrides": overrides})
+}
+
+// deleteOverride revokes the override with the id parameter
+func (h *HTTPHandler) deleteOverride(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, r, "id is required", http.StatusBadRequest)
+		return
+	}
+	
+	if err := h.service.DeleteOverride(r.Context(), id); err != nil {
+		if errors.Is(err, domain.ErrOverrideNotFound) {
+			httpError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err)
+		return
+	}
+	
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// FreezesHandler handles freeze requests. POST schedules a freeze of a
+// resource, or of every resource, GET lists the freezes in effect or
+// scheduled and DELETE lifts one.
+func (h *HTTPHandler) FreezesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.createFreeze(w, r)
+	case http.MethodGet:
+		h.listFreezes(w, r)
+	case http.MethodDelete:
+		h.liftFreeze(w, r)
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createFreeze schedules a freeze
+func (h *HTTPHandler) createFreeze(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Resource string    `json:"resource,omitempty"` // Every resource when empty
+		Mode     string    `json:"mode"`               // "deny_all" or "allow_all"
+		Reason   string    `json:"reason,omitempty"`
+		StartsAt time.Time `json:"starts_at,omitempty"` // RFC 3339; now when empty
+		EndsAt   time.Time `json:"ends_at,omitempty"`   // RFC 3339; until lifted when empty
+	}
+	
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if _, err := domain.ParseFreezeMode(req.Mode); err != nil {
+		httpError(w, r, "mode must be deny_all or allow_all", http.StatusBadRequest)
+		return
+	}
+	
+	now := h.service.clock.Now()
+	if !req.EndsAt.IsZero() && (!req.EndsAt.After(now) || !req.EndsAt.After(req.StartsAt)) {
+		httpError(w, r, "ends_at must be in the future and after starts_at", http.StatusBadRequest)
+		return
+	}
+	
+	freeze, err := h.service.CreateFreeze(r.Context(), req.Resource, req.Mode, req.Reason, req.StartsAt, req.EndsAt)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(freeze)
+}
+
+// listFreezes lists the freezes in effect or scheduled, only those covering
+// the optional resource parameter
+func (h *HTTPHandler) listFreezes(w http.ResponseWriter, r *http.Request) {
+	freezes, err := h.service.ListFreezes(r.Context(), r.URL.Query().Get("resource"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"freezes": freezes})
+}
+
+// liftFreeze lifts the freeze with the id parameter
+func (h *HTTPHandler) liftFreeze(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, r, "id is required", http.StatusBadRequest)
+		return
+	}
+	
+	if err := h.service.LiftFreeze(r.Context(), id); err != nil {
+		if errors.Is(err, domain.ErrFreezeNotFound) {
+			httpError(w, r, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err)
+		return
+	}
+	
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "lifted"})
+}
+
+// RolloutsHandler handles rule rollout requests. POST starts rolling out a
+// change of a rule and GET lists the rollouts, or returns the one with the
+// id parameter.
+func (h *HTTPHandler) RolloutsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.startRollout(w, r)
+	case http.MethodGet:
+		h.listRollouts(w, r)
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startRollout starts rolling out a change of a rule
+func (h *HTTPHandler) startRollout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RuleID           string   `json:"rule_id"`
+		Limit            int      `json:"limit,omitempty"`          // The rule's limit when zero
+		Window           string   `json:"window,omitempty"`         // e.g., "1m"; the rule's window when empty
+		Algorithm        string   `json:"algorithm,omitempty"`      // The rule's algorithm when empty
+		SoftThreshold    *float64 `json:"soft_threshold,omitempty"` // The rule's soft threshold when absent
+		Stages           []int    `json:"stages,omitempty"`         // e.g., [5, 25, 50]; the default when empty
+		StageDuration    string   `json:"stage_duration,omitempty"` // e.g., "10m"
+		MaxDenyRateDelta float64  `json:"max_deny_rate_delta,omitempty"`
+		MinRequests      int64    `json:"min_requests,omitempty"`
+	}
+	
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.RuleID == "" {
+		httpError(w, r, "rule_id is required", http.StatusBadRequest)
+		return
+	}
+	
+	var window, stageDuration time.Duration
+	if req.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(req.Window); err != nil || window <= 0 {
+			httpError(w, r, "Invalid window format", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.StageDuration != "" {
+		var err error
+		if stageDuration, err = time.ParseDuration(req.StageDuration); err != nil || stageDuration <= 0 {
+			httpError(w, r, "Invalid stage_duration format", http.StatusBadRequest)
+			return
+		}
+	}
+	
+	rollout, err := h.service.StartRollout(r.Context(), req.RuleID, req.Limit, window, req.Algorithm, req.SoftThreshold, RolloutSettings{
+		Stages:           req.Stages,
+		StageDuration:    stageDuration,
+		MaxDenyRateDelta: req.MaxDenyRateDelta,
+		MinRequests:      req.MinRequests,
+	})
+	if err != nil {
+		writeRolloutError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rollout)
+}
+
+// listRollouts lists the rollouts, newest first, filtered by the optional
+// rule_id and status parameters, or returns the one with the id parameter
+func (h *HTTPHandler) listRollouts(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("id"); id != "" {
+		rollout, err := h.service.GetRollout(r.Context(), id)
+		if err != nil {
+			writeRolloutError(w, r, err)
+			return
+		}
+		
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rollout)
+		return
+	}
+	
+	rollouts, err := h.service.ListRollouts(r.Context(), r.URL.Query().Get("rule_id"), r.URL.Query().Get("status"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rollouts": rollouts})
+}
+
+// PromoteRolloutHandler replaces the rule of the rollout with the id
+// parameter with its candidate
+func (h *HTTPHandler) PromoteRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	h.endRollout(w, r, h.service.PromoteRollout)
+}
+
+// RollBackRolloutHandler ends the rollout with the id parameter, keeping
+// its rule
+func (h *HTTPHandler) RollBackRolloutHandler(w http.ResponseWriter, r *http.Request) {
+	h.endRollout(w, r, h.service.RollBackRollout)
+}
+
+// endRollout promotes or rolls back the rollout with the id parameter, for
+// the reason in the optional request body
+func (h *HTTPHandler) endRollout(w http.ResponseWriter, r *http.Request, end func(ctx context.Context, rolloutID, reason string) (*domain.RuleRollout, error)) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		httpError(w, r, "id is required", http.StatusBadRequest)
+		return
+	}
+	
+	var req struct {
+		Reason string `json:"reason,omitempty"`
+	}
+	if r.ContentLength != 0 && !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	rollout, err := end(r.Context(), id, req.Reason)
+	if err != nil {
+		writeRolloutError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rollout)
+}
+
+// writeRolloutError maps a rollout error to an HTTP error response
+func writeRolloutError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, domain.ErrRuleNotFound), errors.Is(err, domain.ErrRolloutNotFound):
+		httpError(w, r, err.Error(), http.StatusNotFound)
+	case errors.Is(err, domain.ErrInvalidRollout):
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, domain.ErrRolloutInProgress), errors.Is(err, domain.ErrRolloutEnded):
+		httpError(w, r, err.Error(), http.StatusConflict)
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// LeasesHandler handles token lease requests. POST leases a client tokens
+// of its quota and GET lists the active leases, or returns the one with the
+// id parameter.
+func (h *HTTPHandler) LeasesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.grantLease(w, r)
+	case http.MethodGet:
+		h.listLeases(w, r)
+	default:
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// grantLease leases the client of the request described by a check body
+// the tokens it asks for. The response carries the lease and the status
+// after it, or only the status with 429 when no tokens are left.
+func (h *HTTPHandler) grantLease(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		checkRequest
+		Tokens int    `json:"tokens"`
+		TTL    string `json:"ttl,omitempty"` // e.g., "10s"; the longest term when empty
+	}
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.ClientID == "" || req.Resource == "" || req.Tokens <= 0 {
+		httpError(w, r, "client_id, resource, and tokens are required", http.StatusBadRequest)
+		return
+	}
+	
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			httpError(w, r, "Invalid ttl format", http.StatusBadRequest)
+			return
+		}
+	}
+	
+	lease, status, err := h.service.GrantLease(r.Context(), req.Resource, req.attributes(r), req.Tokens, ttl)
+	if err != nil {
+		writeLeaseError(w, r, err)
+		return
+	}
+	
+	statusCode := http.StatusCreated
+	switch {
+	case !status.IsAllowed:
+		statusCode = http.StatusTooManyRequests
+	case lease == nil:
+		statusCode = http.StatusOK
+	}
+	writeLease(w, statusCode, lease, status)
+}
+
+// listLeases lists the active leases, oldest first, filtered by the
+// optional client_id and resource parameters, or returns the one with the
+// id parameter
+func (h *HTTPHandler) listLeases(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("id"); id != "" {
+		lease, err := h.service.GetLease(r.Context(), id)
+		if err != nil {
+			writeLeaseError(w, r, err)
+			return
+		}
+		
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lease)
+		return
+	}
+	
+	leases, err := h.service.ListLeases(r.Context(), r.URL.Query().Get("client_id"), r.URL.Query().Get("resource"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"leases": leases})
+}
+
+// RenewLeaseHandler reports the tokens of a lease used and renews it for
+// the tokens asked for, or releases it when they are zero. The lease is
+// null in the response once released, and with 429 when no tokens are left.
+func (h *HTTPHandler) RenewLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var req struct {
+		ID     string `json:"id"`
+		Used   int    `json:"used"`             // Tokens of the current term used
+		Tokens int    `json:"tokens,omitempty"` // Tokens of the next term; releases the lease when zero
+	}
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+	
+	if req.ID == "" {
+		httpError(w, r, "id is required", http.StatusBadRequest)
+		return
+	}
+	
+	lease, status, err := h.service.RenewLease(r.Context(), req.ID, req.Used, req.Tokens)
+	if err != nil {
+		writeLeaseError(w, r, err)
+		return
+	}
+	
+	statusCode := http.StatusOK
+	if !status.IsAllowed {
+		statusCode = http.StatusTooManyRequests
+	}
+	writeLease(w, statusCode, lease, status)
+}
+
+// writeLease writes a lease and the status after it, with the rate limit
+// headers of the status
+func writeLease(w http.ResponseWriter, code int, lease *domain.Lease, status *queries.RateLimitStatus) {
+	WriteRateLimitHeaders(w, status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"lease": lease, "status": status})
+}
+
+// writeLeaseError maps a lease error to an HTTP error response
+func writeLeaseError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, domain.ErrLeaseNotFound):
+		httpError(w, r, err.Error(), http.StatusNotFound)
+	case errors.Is(err, domain.ErrLeaseExpired):
+		httpError(w, r, err.Error(), http.StatusGone)
+	case errors.Is(err, domain.ErrInvalidLease):
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, domain.ErrRuleNotEnforced):
+		httpError(w, r, err.Error(), http.StatusConflict)
+	default:
+		writeError(w, r, err)
+	}
+}
+
 // SetupRoutes sets up HTTP routes
 func (h *HTTPHandler) SetupRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 	
-	mux.HandleFunc("/api/v1/ratelimit/check", h.CheckRateLimitHandler)
-	mux.HandleFunc("/api/v1/ratelimit/status", h.GetStatusHandler)
-	mux.HandleFunc("/api/v1/ratelimit/history", h.GetHistoryHandler)
-	mux.HandleFunc("/api/v1/ratelimit/stats", h.GetStatsHandler)
-	mux.HandleFunc("/api/v1/ratelimit/rules", h.CreateRuleHandler)
-	mux.HandleFunc("/api/v1/ratelimit/reset", h.ResetHandler)
+	h.RegisterDataRoutes(mux)
+	h.RegisterAdminRoutes(mux)
 	
 	return mux
 }
+
+// RegisterDataRoutes adds the endpoints that clients call to enforce limits
+// on their requests to mux: checks, refunds and leases, under both
+// /api/v1 and /api/v2
+func (h *HTTPHandler) RegisterDataRoutes(mux *http.ServeMux) {
+	h.handleVersions(mux, "/ratelimit/check", h.CheckRateLimitHandler)
+	h.handleVersions(mux, "/ratelimit/check-all", h.CheckAllHandler)
+	h.handleVersions(mux, "/ratelimit/peek", h.PeekHandler)
+	h.handleVersions(mux, "/ratelimit/refund", h.RefundHandler)
+	h.handleVersions(mux, "/ratelimit/leases", h.LeasesHandler)
+	h.handleVersions(mux, "/ratelimit/leases/renew", h.RenewLeaseHandler)
+}
+
+// RegisterAdminRoutes adds the endpoints that operators call to query state
+// and manage rules to mux, under both /api/v1 and /api/v2
+func (h *HTTPHandler) RegisterAdminRoutes(mux *http.ServeMux) {
+	h.handleVersions(mux, "/ratelimit/status", h.GetStatusHandler)
+	h.handleVersions(mux, "/ratelimit/explain", h.ExplainHandler)
+	h.handleVersions(mux, "/ratelimit/history", h.GetHistoryHandler)
+	h.handleVersions(mux, "/ratelimit/stats", h.GetStatsHandler)
+	h.handleVersions(mux, "/ratelimit/rules", h.RulesHandler)
+	h.handleVersions(mux, "/ratelimit/rules/simulate", h.SimulateRuleHandler)
+	h.handleVersions(mux, "/ratelimit/reset", h.ResetHandler)
+	h.handleVersions(mux, "/ratelimit/overrides", h.OverridesHandler)
+	h.handleVersions(mux, "/ratelimit/freezes", h.FreezesHandler)
+	h.handleVersions(mux, "/ratelimit/rollouts", h.RolloutsHandler)
+	h.handleVersions(mux, "/ratelimit/rollouts/promote", h.PromoteRolloutHandler)
+	h.handleVersions(mux, "/ratelimit/rollouts/rollback", h.RollBackRolloutHandler)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listen listens on addr, which is a TCP host:port, a Unix socket path
+// prefixed with "unix:", or "systemd" for a socket passed by systemd socket
+// activation ("systemd:name" for the one with FileDescriptorName=name).
+// Unix sockets are created with mode, replacing a stale socket left by an
+// instance that did not shut down cleanly.
+func Listen(ctx context.Context, addr string, tcpKeepAlive time.Duration, mode os.FileMode) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenUnix(ctx, path, mode)
+	}
+	if addr == "systemd" || strings.HasPrefix(addr, "systemd:") {
+		return activatedListener(strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":"))
+	}
+
+	lc := net.ListenConfig{KeepAlive: tcpKeepAlive}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// listenUnix listens on the Unix socket at path
+func listenUnix(ctx context.Context, path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// A socket nobody accepts on is left over from an earlier run
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// activated holds the sockets passed by systemd, which are read from the
+// environment once and handed out once each
+var activated struct {
+	once      sync.Once
+	listeners []net.Listener
+	names     []string
+	err       error
+	mutex     sync.Mutex
+}
+
+// listenFDsStart is the first file descriptor systemd passes sockets from
+const listenFDsStart = 3
+
+// activatedListener returns the socket passed by systemd under name, or the
+// first socket not yet taken when name is empty
+func activatedListener(name string) (net.Listener, error) {
+	activated.once.Do(func() {
+		activated.listeners, activated.names, activated.err = activatedListeners()
+	})
+	if activated.err != nil {
+		return nil, activated.err
+	}
+
+	activated.mutex.Lock()
+	defer activated.mutex.Unlock()
+
+	for i, listener := range activated.listeners {
+		if listener == nil || (name != "" && activated.names[i] != name) {
+			continue
+		}
+		activated.listeners[i] = nil
+		return listener, nil
+	}
+	if name == "" {
+		return nil, errors.New("no socket passed by systemd is left")
+	}
+	return nil, fmt.Errorf("no socket named %q passed by systemd is left", name)
+}
+
+// activatedListeners reads the sockets passed by systemd as set out in
+// sd_listen_fds(3), and unsets its variables so child processes do not take
+// them for their own
+func activatedListeners() ([]net.Listener, []string, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := make([]string, n)
+	if raw := os.Getenv("LISTEN_FDNAMES"); raw != "" {
+		copy(names, strings.Split(raw, ":"))
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		file := os.NewFile(uintptr(listenFDsStart+i), names[i])
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners[:i] {
+				listener.Close()
+			}
+			return nil, nil, fmt.Errorf("socket %d passed by systemd: %w", listenFDsStart+i, err)
+		}
+		listeners[i] = listener
+	}
+	return listeners, names, nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
+)
+
+// maxPrivacyLookupValues bounds the values of a single lookup
+const maxPrivacyLookupValues = 1000
+
+// PrivacyHTTPHandler provides the admin endpoint mapping client IDs, IP
+// addresses and user agents to the pseudonyms stored in privacy mode, e.g.
+// to find a person's events in an export when they ask for them
+type PrivacyHTTPHandler struct {
+	pseudonymizer *privacy.Pseudonymizer
+	token         string
+}
+
+// PrivacyLookup lists the values to look up, and the pseudonyms of each in
+// the response
+type PrivacyLookup struct {
+	ClientIDs   []string `json:"client_ids,omitempty"`
+	IPAddresses []string `json:"ip_addresses,omitempty"`
+	UserAgents  []string `json:"user_agents,omitempty"`
+}
+
+// PrivacyLookupResult maps each looked up value to its pseudonym
+type PrivacyLookupResult struct {
+	ClientIDs   map[string]string `json:"client_ids,omitempty"`
+	IPAddresses map[string]string `json:"ip_addresses,omitempty"`
+	UserAgents  map[string]string `json:"user_agents,omitempty"`
+}
+
+// NewPrivacyHTTPHandler creates a privacy admin handler answering lookups
+// authorized by the bearer token
+func NewPrivacyHTTPHandler(pseudonymizer *privacy.Pseudonymizer, token string) *PrivacyHTTPHandler {
+	return &PrivacyHTTPHandler{
+		pseudonymizer: pseudonymizer,
+		token:         token,
+	}
+}
+
+// LookupHandler returns the pseudonyms of the posted values. Values are
+// posted rather than passed in the URL so that they stay out of access logs.
+func (h *PrivacyHTTPHandler) LookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="privacy"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var lookup PrivacyLookup
+	if !DecodeJSON(w, r, &lookup) {
+		return
+	}
+	count := len(lookup.ClientIDs) + len(lookup.IPAddresses) + len(lookup.UserAgents)
+	if count == 0 || count > maxPrivacyLookupValues {
+		http.Error(w, "between 1 and 1000 client_ids, ip_addresses and user_agents are required", http.StatusBadRequest)
+		return
+	}
+
+	// Audit who looked up how much, without the values themselves
+	log.Printf("Privacy lookup of %d value(s) from %s", count, clientip.FromRequest(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(PrivacyLookupResult{
+		ClientIDs:   h.pseudonyms(privacy.KindClientID, lookup.ClientIDs),
+		IPAddresses: h.pseudonyms(privacy.KindIPAddress, lookup.IPAddresses),
+		UserAgents:  h.pseudonyms(privacy.KindUserAgent, lookup.UserAgents),
+	})
+}
+
+// authorized reports whether the request carries the lookup token
+func (h *PrivacyHTTPHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// pseudonyms maps values of kind to their pseudonyms
+func (h *PrivacyHTTPHandler) pseudonyms(kind string, values []string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	pseudonyms := make(map[string]string, len(values))
+	for _, value := range values {
+		pseudonyms[value] = h.pseudonymizer.Pseudonym(kind, value)
+	}
+	return pseudonyms
+}
+
+// RegisterRoutes adds the privacy admin endpoint to mux
+func (h *PrivacyHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/admin/privacy/lookup", h.LookupHandler)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/simulate"
+)
+
+// defaultSimulatedClients is the number of clients a rule simulation
+// reports unless asked otherwise
+const defaultSimulatedClients = 100
+
+// errRuleSimulationDisabled is returned by simulations of a service without
+// recorded decisions to replay
+var errRuleSimulationDisabled = errors.New("rule simulation is not enabled")
+
+// WithRuleSimulation lets proposed rules be simulated by replaying the
+// decisions recorded in history through them
+func (s *RateLimiterService) WithRuleSimulation(history EventSelector) *RateLimiterService {
+	s.history = history
+	return s
+}
+
+// SimulateRule replays the requests decided under the resource and method
+// in [startTime, endTime) through the proposed rule, and reports how many
+// of them it would have denied for each client compared to what was
+// decided. The rule in force is left as it is.
+func (s *RateLimiterService) SimulateRule(ctx context.Context, resource, method string, limit int, window time.Duration, algorithm string, softThreshold float64, parameters *domain.AlgorithmParameters, windows []domain.WindowLimit, startTime, endTime time.Time) (*simulate.RuleImpact, error) {
+	if s.history == nil {
+		return nil, errRuleSimulationDisabled
+	}
+
+	proposed := domain.RateLimitRule{
+		Resource:      resource,
+		Method:        strings.ToUpper(method),
+		Limit:         limit,
+		Window:        window,
+		Algorithm:     domain.Algorithm(algorithm),
+		SoftThreshold: softThreshold,
+		Parameters:    parameters,
+		Windows:       windows,
+	}
+
+	events, err := s.history.SelectEvents(ctx, "", startTime, endTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recorded decisions: %w", err)
+	}
+	impact, err := simulate.ReplayRule(ctx, proposed, simulate.RecordedRequests(events, proposed.StateResource()))
+	if err != nil {
+		return nil, err
+	}
+	impact.StartTime = startTime
+	impact.EndTime = endTime
+
+	rules, err := s.getRules(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.StateResource() == proposed.StateResource() {
+			impact.CurrentRuleID = rule.ID
+		}
+	}
+	return &impact, nil
+}
+
+// SimulateRuleHandler handles simulations of a proposed rule, or of a change
+// of the rule of its resource and method, against recorded traffic. The body
+// is that of rule creation with the time range to replay: start_time and
+// end_time in RFC3339, end_time defaulting to now, or since, a duration
+// before now. max_clients bounds the clients reported, 100 by default.
+func (h *HTTPHandler) SimulateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ruleRequest
+		StartTime  string `json:"start_time,omitempty"` // e.g., "2024-01-01T00:00:00Z"
+		EndTime    string `json:"end_time,omitempty"`
+		Since      string `json:"since,omitempty"` // e.g., "1h", instead of start_time
+		MaxClients int    `json:"max_clients,omitempty"`
+	}
+	if !DecodeJSON(w, r, &req) {
+		return
+	}
+
+	limit, window, windows, message := req.settings()
+	if message != "" {
+		httpError(w, r, message, http.StatusBadRequest)
+		return
+	}
+
+	endTime := h.service.clock.Now()
+	if req.EndTime != "" {
+		parsed, err := time.Parse(time.RFC3339, req.EndTime)
+		if err != nil {
+			httpError(w, r, "Invalid end_time format", http.StatusBadRequest)
+			return
+		}
+		endTime = parsed
+	}
+
+	var startTime time.Time
+	switch {
+	case req.StartTime != "" && req.Since != "":
+		httpError(w, r, "start_time and since are exclusive", http.StatusBadRequest)
+		return
+	case req.StartTime != "":
+		parsed, err := time.Parse(time.RFC3339, req.StartTime)
+		if err != nil {
+			httpError(w, r, "Invalid start_time format", http.StatusBadRequest)
+			return
+		}
+		startTime = parsed
+	case req.Since != "":
+		since, err := time.ParseDuration(req.Since)
+		if err != nil || since <= 0 {
+			httpError(w, r, "since must be a positive duration, e.g. 1h", http.StatusBadRequest)
+			return
+		}
+		startTime = endTime.Add(-since)
+	default:
+		httpError(w, r, "start_time or since is required", http.StatusBadRequest)
+		return
+	}
+	if !startTime.Before(endTime) {
+		httpError(w, r, "start_time must be before end_time", http.StatusBadRequest)
+		return
+	}
+
+	maxClients := defaultSimulatedClients
+	if req.MaxClients < 0 {
+		httpError(w, r, "max_clients must not be negative", http.StatusBadRequest)
+		return
+	} else if req.MaxClients > 0 {
+		maxClients = req.MaxClients
+	}
+
+	impact, err := h.service.SimulateRule(r.Context(), req.Resource, req.Method, limit, window, req.Algorithm, req.SoftThreshold, req.Parameters, windows, startTime, endTime)
+	if errors.Is(err, errRuleSimulationDisabled) {
+		httpError(w, r, "Rule simulation is not enabled", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(impact.ByClient) > maxClients {
+		impact.ByClient = impact.ByClient[:maxClients]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(impact)
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+)
+
+// Server is an http.Server hardened with the configured timeouts, request
+// limits and client IP resolution
+type Server struct {
+	*http.Server
+	resolver      *clientip.Resolver
+	proxyProtocol bool
+	tcpKeepAlive  time.Duration
+	socketMode    os.FileMode
+}
+
+// NewServer creates a new server for handler
+func NewServer(cfg config.ServerConfig, handler http.Handler) (*Server, error) {
+	resolver, err := clientip.NewResolver(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	handler = BodyLimitMiddleware(cfg.MaxBodyBytes, handler)
+	handler = RequestTimeoutMiddleware(cfg.RequestTimeout, handler)
+	handler = principal.Middleware(resolver, cfg.PrincipalHeader, handler)
+	handler = clientip.Middleware(resolver, handler)
+	if cfg.H2C {
+		handler = h2cHandler(cfg, handler)
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	server.SetKeepAlivesEnabled(cfg.KeepAlives)
+
+	return &Server{
+		Server:        server,
+		resolver:      resolver,
+		proxyProtocol: cfg.ProxyProtocol,
+		tcpKeepAlive:  cfg.TCPKeepAlive,
+		socketMode:    cfg.SocketMode,
+	}, nil
+}
+
+// h2cHandler serves HTTP/2 without TLS to clients that speak it by prior
+// knowledge or upgrade to it, and HTTP/1.1 to the others. Streams of a
+// connection share its idle timeout; requests on them go through handler
+// like any other.
+func h2cHandler(cfg config.ServerConfig, handler http.Handler) http.Handler {
+	handler = h2c.NewHandler(handler, &http2.Server{
+		MaxConcurrentStreams: cfg.MaxConcurrentStreams,
+		IdleTimeout:          cfg.IdleTimeout,
+	})
+	// The body of an upgraded request is read into memory before handler
+	// sees it
+	if cfg.MaxBodyBytes > 0 {
+		handler = http.MaxBytesHandler(handler, cfg.MaxBodyBytes)
+	}
+	return handler
+}
+
+// ListenAndServe listens on the configured address, a TCP address, Unix
+// socket or socket passed by systemd as Listen takes, decoding PROXY
+// protocol headers when enabled
+func (s *Server) ListenAndServe() error {
+	listener, err := Listen(context.Background(), s.Addr, s.tcpKeepAlive, s.socketMode)
+	if err != nil {
+		return err
+	}
+
+	if s.proxyProtocol {
+		listener = clientip.NewProxyProtocolListener(listener, s.resolver)
+	}
+
+	return s.Serve(listener)
+}
+
+// BodyLimitMiddleware caps the size of every request body
+func BodyLimitMiddleware(limit int64, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestTimeoutMiddleware attaches a deadline to the request context so that
+// storage calls made on behalf of the request give up once it expires.
+// The server-sent event stream is long-lived by design and gets no deadline;
+// it is recognized by its route, not by headers the client controls.
+func RequestTimeoutMiddleware(timeout time.Duration, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == eventStreamPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AdminAuthMiddleware requires the bearer token on every request to the
+// admin listener but those to the public paths, such as readiness probes
+// that load balancers make without credentials and endpoints authorized by
+// tokens of their own. Requests pass unchecked when token is empty.
+func AdminAuthMiddleware(token string, public []string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(public, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DecodeJSON decodes the request body into dst. On failure it writes the
+// error response itself and returns false.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			httpError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+			return false
+		}
+		httpError(w, r, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// WriteError maps a service error to an HTTP error response
+func WriteError(w http.ResponseWriter, err error) {
+	message, code := errorResponse(err)
+	http.Error(w, message, code)
+}
+
+// errorResponse returns the message and status code answering err
+func errorResponse(err error) (string, int) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Request timed out", http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		return "Request canceled", http.StatusServiceUnavailable
+	default:
+		return "Internal server error", http.StatusInternalServerError
+	}
+}
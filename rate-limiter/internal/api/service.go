@@ -2,11 +2,19 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
 	"github.com/NickChunglolz/rate-limiter/internal/commands"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
 	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
 	"github.com/NickChunglolz/rate-limiter/internal/queries"
 )
 
@@ -14,6 +22,35 @@ import (
 type RateLimiterService struct {
 	commandHandler handlers.CommandHandler
 	queryHandler   handlers.QueryHandler
+	templates      sync.Map // Parsed key templates by text
+	clock          domain.Clock
+	decisions      DecisionRecorder
+	privacy        *privacy.Pseudonymizer
+	blocked        BlockedCache
+	maxGrant       int           // Largest budget grant; grants are disabled when zero
+	grantTTL       time.Duration
+	maxLease       int           // Largest token lease; leases are disabled when zero
+	maxLeaseTTL    time.Duration
+	failure        FailurePolicy   // Decides checks while storage is unavailable
+	deadline       time.Duration   // Longest a decision may take; unbounded when zero
+	failures       *failureCounts
+	ruleIndex      RuleIndex       // Resources with rules, which failures are counted by
+	history        EventSelector // Decisions rule simulations replay; simulations are disabled when nil
+}
+
+// DecisionRecorder records every decision of the service, such as for
+// metrics
+type DecisionRecorder interface {
+	RecordDecision(ctx context.Context, clientID, resource, method string, allowed bool)
+}
+
+// BlockedCache remembers the denials of blocked clients until their blocks
+// end, so that their further requests are denied before any query or command
+type BlockedCache interface {
+	Blocked(clientID, resource string, now time.Time) *queries.RateLimitStatus
+	Block(clientID, resource string, status *queries.RateLimitStatus, now time.Time)
+	Invalidate(clientID string)
+	Clear()
 }
 
 // NewRateLimiterService creates a new rate limiter service
@@ -21,55 +58,142 @@ func NewRateLimiterService(commandHandler handlers.CommandHandler, queryHandler
 	return &RateLimiterService{
 		commandHandler: commandHandler,
 		queryHandler:   queryHandler,
+		clock:          domain.SystemClock{},
+		failures:       newFailureCounts(),
 	}
 }
 
+// WithClock sets the clock that checks and commands are timed with
+func (s *RateLimiterService) WithClock(clock domain.Clock) *RateLimiterService {
+	s.clock = clock
+	return s
+}
+
+// WithDecisionRecorder records every decision, including those of blocked,
+// disabled and frozen clients that store no event
+func (s *RateLimiterService) WithDecisionRecorder(decisions DecisionRecorder) *RateLimiterService {
+	s.decisions = decisions
+	return s
+}
+
+// WithPseudonymizer replaces limit keys, IP addresses and user agents with
+// pseudonyms before they reach commands and queries, so that events,
+// history and statistics hold none of them in the clear. Client registry
+// entries keep their IDs.
+func (s *RateLimiterService) WithPseudonymizer(pseudonymizer *privacy.Pseudonymizer) *RateLimiterService {
+	s.privacy = pseudonymizer
+	return s
+}
+
+// WithBlockedCache denies the requests of clients blocked by an earlier
+// decision from cache until their blocks end. Resets, refunds and erasures
+// of a client drop its cached denials, and changes of rules, overrides,
+// freezes and rollouts drop all of them.
+func (s *RateLimiterService) WithBlockedCache(blocked BlockedCache) *RateLimiterService {
+	s.blocked = blocked
+	return s
+}
+
+// WithBudgetGrants lets checks ask for a budget grant of up to maxRequests
+// further requests, which are counted with the check so that the client can
+// make them without checking each. Grants may be used for ttl, at most
+// until the window resets.
+func (s *RateLimiterService) WithBudgetGrants(maxRequests int, ttl time.Duration) *RateLimiterService {
+	s.maxGrant = maxRequests
+	s.grantTTL = ttl
+	return s
+}
+
+// WithLeases lets clients lease up to maxTokens tokens of their quota at a
+// time, for terms of at most maxTTL
+func (s *RateLimiterService) WithLeases(maxTokens int, maxTTL time.Duration) *RateLimiterService {
+	s.maxLease = maxTokens
+	s.maxLeaseTTL = maxTTL
+	return s
+}
+
 // CheckRateLimit checks if a request is allowed and applies the rate limit
+// of the resource's rule for any method
 func (s *RateLimiterService) CheckRateLimit(ctx context.Context, clientID, resource, ipAddress, userAgent string) (*queries.RateLimitStatus, error) {
-	// First, check current status
-	statusQuery := &queries.GetRateLimitStatusQuery{
-		BaseQuery: queries.BaseQuery{
-			ID:   fmt.Sprintf("status-%d", time.Now().UnixNano()),
-			Type: "GetRateLimitStatus",
-			Time: time.Now(),
-		},
-		ClientID: clientID,
-		Resource: resource,
-	}
+	checkCtx, cancel := s.DecisionContext(ctx)
+	defer cancel()
 	
-	result, err := s.queryHandler.Handle(ctx, statusQuery)
+	status, err := s.checkClientRateLimit(checkCtx, clientID, resource, ipAddress, userAgent)
+	s.recordDecision(ctx, clientID, resource, "", status, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get rate limit status: %w", err)
+		if degraded := s.DecideUnavailable(ctx, clientID, resource, "", err); degraded != nil {
+			return degraded, nil
+		}
+	}
+	return status, err
+}
+
+// checkClientRateLimit checks a request of a client that is not disabled
+// against the resource's rule for any method
+func (s *RateLimiterService) checkClientRateLimit(ctx context.Context, clientID, resource, ipAddress, userAgent string) (*queries.RateLimitStatus, error) {
+	if status, err := s.disabledStatus(ctx, clientID, resource); err != nil || status != nil {
+		return status, err
 	}
 	
-	currentStatus := result.(*queries.RateLimitStatus)
+	return s.checkRateLimit(ctx, clientID, resource, "", ipAddress, userAgent, false)
+}
+
+// recordDecision records the decision of a check that did not fail
+func (s *RateLimiterService) recordDecision(ctx context.Context, clientID, resource, method string, status *queries.RateLimitStatus, err error) {
+	if s.decisions == nil || err != nil || status == nil {
+		return
+	}
+	s.decisions.RecordDecision(ctx, clientID, resource, method, status.IsAllowed)
+}
+
+// checkRateLimit checks a request against the resource's rule for method,
+// or its rule for any method when method is empty. A dry run decides the
+// request without counting it.
+func (s *RateLimiterService) checkRateLimit(ctx context.Context, clientID, resource, method, ipAddress, userAgent string, dryRun bool) (*queries.RateLimitStatus, error) {
+	// The request is timed once, for the status query, command and answer
+	now := s.clock.Now()
+	clientID = s.privacy.ClientID(clientID)
 	
-	// If already blocked, return current status
-	if currentStatus.IsBlocked && time.Now().Before(currentStatus.BlockedUntil) {
-		return currentStatus, nil
+	if status, err := s.decidedStatus(ctx, clientID, resource, method, now); err != nil || status != nil {
+		return status, err
 	}
 	
-	// Apply rate limit (this will update the state)
+	// Apply rate limit (this will update the state). Like the decision
+	// queries, the command carries no ID
 	applyCmd := &commands.ApplyRateLimitCommand{
 		BaseCommand: commands.BaseCommand{
-			ID:   fmt.Sprintf("apply-%d", time.Now().UnixNano()),
 			Type: "ApplyRateLimit",
-			Time: time.Now(),
+			Time: now,
 		},
 		ClientID:    clientID,
 		Resource:    resource,
-		RequestedAt: time.Now(),
-		IPAddress:   ipAddress,
-		UserAgent:   userAgent,
+		Method:      method,
+		RequestedAt: now,
+		IPAddress:   s.privacy.IPAddress(ipAddress),
+		UserAgent:   s.privacy.UserAgent(userAgent),
+		DryRun:      dryRun,
 	}
 	
-	err = s.commandHandler.Handle(ctx, applyCmd)
+	err := s.commandHandler.Handle(ctx, applyCmd)
 	if err != nil {
 		return nil, fmt.Errorf("failed to apply rate limit: %w", err)
 	}
 	
+	// Build the status from the decision itself, since the read model is
+	// updated asynchronously
+	if status := decisionStatus(applyCmd, now); status != nil {
+		if !dryRun {
+			s.block(clientID, resource, method, status, now)
+		}
+		return status, nil
+	}
+	
 	// Get updated status
-	result, err = s.queryHandler.Handle(ctx, statusQuery)
+	result, err := s.queryHandler.Handle(ctx, &queries.GetRateLimitStatusQuery{
+		BaseQuery: decisionQuery("GetRateLimitStatus", now),
+		ClientID:  clientID,
+		Resource:  domain.ScopedResource(resource, method),
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get updated rate limit status: %w", err)
 	}
@@ -77,13 +201,537 @@ func (s *RateLimiterService) CheckRateLimit(ctx context.Context, clientID, resou
 	return result.(*queries.RateLimitStatus), nil
 }
 
-// GetRateLimitStatus gets the current rate limit status for a client/resource
+// decisionStatus builds the status of the decision recorded by cmd, or
+// returns nil when cmd recorded none. The status of a rule with extra
+// windows combines the decisions of its windows; windows that allowed a
+// request another window denied do not count it. Requests no rule was
+// enforced for are allowed with the reason.
+func decisionStatus(cmd *commands.ApplyRateLimitCommand, now time.Time) *queries.RateLimitStatus {
+	if cmd.Unenforced != "" {
+		return &queries.RateLimitStatus{
+			ClientID:  cmd.ClientID,
+			Resource:  domain.ScopedResource(cmd.Resource, cmd.Method),
+			IsAllowed: true,
+			Reason:    cmd.Unenforced,
+		}
+	}
+	if len(cmd.Windows) == 0 {
+		return queries.StatusFromEvent(cmd.Result, now)
+	}
+	
+	limits := make([]domain.WindowLimit, len(cmd.Windows))
+	statuses := make([]*queries.RateLimitStatus, len(cmd.Windows))
+	for i, decision := range cmd.Windows {
+		limits[i] = decision.Limit
+		if statuses[i] = queries.StatusFromEvent(decision.Event, now); statuses[i] == nil {
+			for _, status := range statuses[:i] {
+				queries.ReleaseStatus(status)
+			}
+			return queries.StatusFromEvent(cmd.Result, now)
+		}
+	}
+	
+	if last := statuses[len(statuses)-1]; !last.IsAllowed {
+		for _, status := range statuses[:len(statuses)-1] {
+			status.RequestCount--
+			status.RemainingQuota++
+		}
+	}
+	return queries.CombineWindows(limits, statuses)
+}
+
+// decidedStatus returns the status of a request decided before the rule of
+// resource is applied, by a freeze or by an earlier denial still in effect,
+// or nil when the rule decides it
+func (s *RateLimiterService) decidedStatus(ctx context.Context, clientID, resource, method string, now time.Time) (*queries.RateLimitStatus, error) {
+	// A client blocked by an earlier decision is denied at once
+	if s.blocked != nil {
+		if status := s.blocked.Blocked(clientID, domain.ScopedResource(resource, method), now); status != nil {
+			return status, nil
+		}
+	}
+	
+	// A freeze decides every request to the resource while it is in effect
+	if status, err := s.frozenStatus(ctx, clientID, resource, method); err != nil || status != nil {
+		return status, err
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, &queries.GetRateLimitStatusQuery{
+		BaseQuery: decisionQuery("GetRateLimitStatus", now),
+		ClientID:  clientID,
+		Resource:  domain.ScopedResource(resource, method),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate limit status: %w", err)
+	}
+	
+	currentStatus := result.(*queries.RateLimitStatus)
+	
+	// If already blocked, return current status
+	if currentStatus.IsBlocked && now.Before(currentStatus.BlockedUntil) {
+		s.block(clientID, resource, method, currentStatus, now)
+		return currentStatus, nil
+	}
+	queries.ReleaseStatus(currentStatus)
+	return nil, nil
+}
+
+// block caches a decision of the rule of resource that blocks the client
+func (s *RateLimiterService) block(clientID, resource, method string, status *queries.RateLimitStatus, now time.Time) {
+	if s.blocked != nil {
+		s.blocked.Block(clientID, domain.ScopedResource(resource, method), status, now)
+	}
+}
+
+// unblock drops the cached denials of clientID, or of every client when
+// clientID is empty, unless the command that may have lifted them failed
+// with err. It returns err.
+func (s *RateLimiterService) unblock(clientID string, err error) error {
+	if s.blocked == nil || err != nil {
+		return err
+	}
+	if clientID == "" {
+		s.blocked.Clear()
+	} else {
+		s.blocked.Invalidate(clientID)
+	}
+	return nil
+}
+
+// decisionQuery returns the base of a query made while deciding a request.
+// Decisions are not traced by query, so it carries no ID, which spares every
+// request formatting one.
+func decisionQuery(queryType string, now time.Time) queries.BaseQuery {
+	return queries.BaseQuery{Type: queryType, Time: now}
+}
+
+// disabledStatus denies every request of a disabled client, or returns nil
+// when the client is enabled or not registered
+func (s *RateLimiterService) disabledStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
+	result, err := s.queryHandler.Handle(ctx, &queries.GetClientQuery{
+		BaseQuery: decisionQuery("GetClient", s.clock.Now()),
+		ClientID:  clientID,
+	})
+	if errors.Is(err, domain.ErrClientNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	if client := result.(*domain.Client); !client.Disabled {
+		return nil, nil
+	}
+	
+	return &queries.RateLimitStatus{
+		ClientID:  clientID,
+		Resource:  resource,
+		IsBlocked: true,
+		Reason:    "client disabled",
+	}, nil
+}
+
+// frozenStatus returns the decision of the freeze in effect for resource, or
+// nil when there is none
+func (s *RateLimiterService) frozenStatus(ctx context.Context, clientID, resource, method string) (*queries.RateLimitStatus, error) {
+	now := s.clock.Now()
+	result, err := s.queryHandler.Handle(ctx, &queries.GetFreezesQuery{
+		BaseQuery: decisionQuery("GetFreezes", now),
+		Resource:  resource,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get freezes: %w", err)
+	}
+	
+	freeze, ok := domain.SelectFreeze(result.([]domain.Freeze), resource, now)
+	if !ok {
+		return nil, nil
+	}
+	
+	status := &queries.RateLimitStatus{
+		ClientID: clientID,
+		Resource: domain.ScopedResource(resource, method),
+		Reason:   freeze.Describe(),
+	}
+	accesslog.AnnotateReason(ctx, status.Reason, nil)
+	if freeze.Mode == domain.FreezeAllowAll {
+		status.IsAllowed = true
+		return status, nil
+	}
+	
+	status.IsBlocked = true
+	if !freeze.EndsAt.IsZero() {
+		status.BlockedUntil = freeze.EndsAt
+		status.ResetTime = freeze.EndsAt
+		status.RetryAfter = queries.RetryAfterSeconds(freeze.EndsAt, now)
+	}
+	return status, nil
+}
+
+// CheckRequestRateLimit checks a request to resource described by attrs
+// against the resource's rule for the request method, keying it with the
+// rule's key template
+func (s *RateLimiterService) CheckRequestRateLimit(ctx context.Context, resource string, attrs keytemplate.Attributes) (*queries.RateLimitStatus, error) {
+	checkCtx, cancel := s.DecisionContext(ctx)
+	defer cancel()
+	
+	status, err := s.checkRequestRateLimit(checkCtx, resource, attrs, false)
+	s.recordDecision(ctx, attrs.ClientID, resource, attrs.Method, status, err)
+	if err != nil {
+		if degraded := s.DecideUnavailable(ctx, attrs.ClientID, resource, attrs.Method, err); degraded != nil {
+			return degraded, nil
+		}
+	}
+	return status, err
+}
+
+// CheckRequestRateLimitWithGrant checks a request as CheckRequestRateLimit
+// and, when it is allowed, grants the client up to grant further requests.
+// They are counted now, one decision each, so that the client may make them
+// until the grant expires without checking them; requests it does not make
+// are not given back. Grants are capped by the quota left and the largest
+// grant configured, and none is made to requests decided without a rule.
+func (s *RateLimiterService) CheckRequestRateLimitWithGrant(ctx context.Context, resource string, attrs keytemplate.Attributes, grant int) (*queries.RateLimitStatus, error) {
+	status, err := s.CheckRequestRateLimit(ctx, resource, attrs)
+	if err != nil || !status.IsAllowed || status.Limit == 0 {
+		return status, err
+	}
+	
+	grant = min(grant, s.maxGrant, status.RemainingQuota)
+	if grant <= 0 {
+		return status, nil
+	}
+	
+	key, method, err := s.requestKey(ctx, resource, attrs)
+	if err != nil {
+		return nil, err
+	}
+	key = s.privacy.ClientID(key)
+	
+	now := s.clock.Now()
+	for status.Granted < grant {
+		cmd := &commands.ApplyRateLimitCommand{
+			BaseCommand: commands.BaseCommand{
+				Type: "ApplyRateLimit",
+				Time: now,
+			},
+			ClientID:    key,
+			Resource:    resource,
+			Method:      method,
+			RequestedAt: now,
+			IPAddress:   s.privacy.IPAddress(attrs.IPAddress),
+			UserAgent:   s.privacy.UserAgent(attrs.UserAgent),
+		}
+		// The check itself was allowed, so a failure only makes the grant
+		// smaller
+		if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+			log.Printf("Failed to grant budget to %s for %s: %v", key, resource, err)
+			break
+		}
+		granted := decisionStatus(cmd, now)
+		if granted == nil {
+			break
+		}
+		s.recordDecision(ctx, attrs.ClientID, resource, method, granted, nil)
+		if !granted.IsAllowed {
+			// A concurrent check took the quota first
+			s.block(key, resource, method, granted, now)
+			queries.ReleaseStatus(granted)
+			break
+		}
+		
+		status.Granted++
+		status.RequestCount = granted.RequestCount
+		status.RemainingQuota = granted.RemainingQuota
+		status.Warning = granted.Warning
+		queries.ReleaseStatus(granted)
+	}
+	
+	if status.Granted > 0 {
+		expiresAt := now.Add(s.grantTTL)
+		if status.ResetTime.After(now) && status.ResetTime.Before(expiresAt) {
+			expiresAt = status.ResetTime
+		}
+		status.GrantExpiresAt = &expiresAt
+	}
+	return status, nil
+}
+
+// PeekRateLimit decides a request to resource described by attrs as
+// CheckRequestRateLimit would now, without counting it, storing events or
+// recording the decision. The remaining quota is what would be left after
+// the request.
+func (s *RateLimiterService) PeekRateLimit(ctx context.Context, resource string, attrs keytemplate.Attributes) (*queries.RateLimitStatus, error) {
+	return s.checkRequestRateLimit(ctx, resource, attrs, true)
+}
+
+// checkRequestRateLimit checks a request to resource described by attrs,
+// as CheckRequestRateLimit without recording the decision, or decides it
+// without counting it in a dry run
+func (s *RateLimiterService) checkRequestRateLimit(ctx context.Context, resource string, attrs keytemplate.Attributes, dryRun bool) (*queries.RateLimitStatus, error) {
+	if status, err := s.disabledStatus(ctx, attrs.ClientID, resource); err != nil || status != nil {
+		return status, err
+	}
+	
+	key, method, err := s.requestKey(ctx, resource, attrs)
+	if err != nil {
+		return nil, err
+	}
+	
+	return s.checkRateLimit(ctx, key, resource, method, attrs.IPAddress, attrs.UserAgent, dryRun)
+}
+
+// CheckRequestRateLimits checks a request described by attrs against the
+// rules of several resources at once, such as a "search" and a "global"
+// budget. The request is allowed only when every resource allows it, and is
+// then counted against all of them; otherwise it is counted against none.
+func (s *RateLimiterService) CheckRequestRateLimits(ctx context.Context, resources []string, attrs keytemplate.Attributes) (*queries.MultiRateLimitStatus, error) {
+	checkCtx, cancel := s.DecisionContext(ctx)
+	defer cancel()
+	
+	result, err := s.checkRequestRateLimits(checkCtx, resources, attrs)
+	if err != nil {
+		return s.degradedStatuses(ctx, resources, attrs, err)
+	}
+	
+	if !result.IsAllowed {
+		s.recordDecision(ctx, attrs.ClientID, result.DeniedResource, attrs.Method, result.Statuses[0], nil)
+		return result, nil
+	}
+	for i, status := range result.Statuses {
+		s.recordDecision(ctx, attrs.ClientID, resources[i], attrs.Method, status, nil)
+	}
+	return result, nil
+}
+
+// checkRequestRateLimits checks a request against several resources, as
+// CheckRequestRateLimits without recording the decisions. Requests decided
+// by a freeze or an earlier denial are decided before any quota is
+// consumed; the rules of the other resources are applied in one command.
+func (s *RateLimiterService) checkRequestRateLimits(ctx context.Context, resources []string, attrs keytemplate.Attributes) (*queries.MultiRateLimitStatus, error) {
+	status, err := s.disabledStatus(ctx, attrs.ClientID, resources[0])
+	if err != nil {
+		return nil, err
+	}
+	if status != nil {
+		return deniedBy(resources[0], status), nil
+	}
+	
+	now := s.clock.Now()
+	statuses := make([]*queries.RateLimitStatus, len(resources))
+	checks := make([]*commands.ApplyRateLimitCommand, 0, len(resources))
+	checked := make([]int, 0, len(resources)) // Resource index of each check
+	
+	for i, resource := range resources {
+		// Key templates see the resource being checked
+		attrs.Resource = resource
+		key, method, err := s.requestKey(ctx, resource, attrs)
+		if err != nil {
+			return nil, err
+		}
+		key = s.privacy.ClientID(key)
+		
+		status, err := s.decidedStatus(ctx, key, resource, method, now)
+		if err != nil {
+			return nil, err
+		}
+		if status != nil && !status.IsAllowed {
+			return deniedBy(resource, status), nil
+		}
+		if status != nil {
+			// An allow-all freeze admits the request without counting it
+			statuses[i] = status
+			continue
+		}
+		
+		checks = append(checks, &commands.ApplyRateLimitCommand{
+			BaseCommand: commands.BaseCommand{
+				Type: "ApplyRateLimit",
+				Time: now,
+			},
+			ClientID:    key,
+			Resource:    resource,
+			Method:      method,
+			RequestedAt: now,
+			IPAddress:   s.privacy.IPAddress(attrs.IPAddress),
+			UserAgent:   s.privacy.UserAgent(attrs.UserAgent),
+		})
+		checked = append(checked, i)
+	}
+	
+	cmd := &commands.ApplyRateLimitsCommand{
+		BaseCommand: commands.BaseCommand{
+			Type: "ApplyRateLimits",
+			Time: now,
+		},
+		Checks: checks,
+	}
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, fmt.Errorf("failed to apply rate limits: %w", err)
+	}
+	
+	for j, check := range checks {
+		status := decisionStatus(check, now)
+		if status == nil {
+			break
+		}
+		if !status.IsAllowed {
+			s.block(checks[j].ClientID, checks[j].Resource, checks[j].Method, status, now)
+			return deniedBy(resources[checked[j]], status), nil
+		}
+		statuses[checked[j]] = status
+	}
+	
+	return &queries.MultiRateLimitStatus{IsAllowed: true, Statuses: statuses}, nil
+}
+
+// deniedBy returns the decision of a request that resource denied with
+// status
+func deniedBy(resource string, status *queries.RateLimitStatus) *queries.MultiRateLimitStatus {
+	return &queries.MultiRateLimitStatus{
+		DeniedResource: resource,
+		Statuses:       []*queries.RateLimitStatus{status},
+	}
+}
+
+// requestKey returns the limit key and the rule method a request to resource
+// described by attrs is checked with. Without a rule for the request method
+// it returns attrs.ClientID and no method, leaving the command handler to
+// report the missing rule.
+func (s *RateLimiterService) requestKey(ctx context.Context, resource string, attrs keytemplate.Attributes) (string, string, error) {
+	rules, err := s.getRules(ctx, resource)
+	if err != nil {
+		return "", "", err
+	}
+	
+	rule, ok := domain.SelectRule(rules, attrs.Method)
+	if !ok {
+		return attrs.ClientID, "", nil
+	}
+	
+	key, err := s.resolveKey(rule, attrs)
+	if err != nil {
+		return "", "", err
+	}
+	return key, rule.Method, nil
+}
+
+// resolveKey returns the rate limit key for a request: the rule's key
+// template rendered with attrs, or attrs.ClientID when the rule has no
+// template or the request lacks a field the template uses
+func (s *RateLimiterService) resolveKey(rule domain.RateLimitRule, attrs keytemplate.Attributes) (string, error) {
+	if rule.KeyTemplate == "" {
+		return attrs.ClientID, nil
+	}
+	
+	tmpl, err := s.keyTemplate(rule.KeyTemplate)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := tmpl.Render(attrs); ok {
+		return key, nil
+	}
+	return attrs.ClientID, nil
+}
+
+// ListRules lists up to limit rules, of one resource if set, ordered by ID
+// and starting after the cursor when after is set
+func (s *RateLimiterService) ListRules(ctx context.Context, resource string, limit int, after *queries.RuleCursor) (*queries.RuleList, error) {
+	query := &queries.ListRulesQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("list-rules-%d", time.Now().UnixNano()),
+			Type: "ListRules",
+			Time: s.clock.Now(),
+		},
+		Resource: resource,
+		Limit:    limit,
+		After:    after,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	
+	return result.(*queries.RuleList), nil
+}
+
+// getRules returns the rules of a resource. Checks resolving their key
+// look the rules up, so like the decision queries it carries no ID.
+func (s *RateLimiterService) getRules(ctx context.Context, resource string) ([]domain.RateLimitRule, error) {
+	query := &queries.GetActiveRulesQuery{
+		BaseQuery: decisionQuery("GetActiveRules", s.clock.Now()),
+		Resource:  resource,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules: %w", err)
+	}
+	
+	var rules []domain.RateLimitRule
+	for _, existing := range result.([]interface{}) {
+		if rule, ok := existing.(domain.RateLimitRule); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// keyTemplate returns the parsed key template, caching it by text
+func (s *RateLimiterService) keyTemplate(text string) (*keytemplate.Template, error) {
+	if cached, ok := s.templates.Load(text); ok {
+		return cached.(*keytemplate.Template), nil
+	}
+	
+	tmpl, err := keytemplate.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidKeyTemplate, err)
+	}
+	s.templates.Store(text, tmpl)
+	return tmpl, nil
+}
+
+// GetRateLimitStatus gets the current rate limit status for a client/resource.
+// The status of a rule with extra windows combines those of its windows.
 func (s *RateLimiterService) GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
+	clientID = s.privacy.LookupClientID(clientID)
+	status, err := s.getStatus(ctx, clientID, resource)
+	if err != nil {
+		return nil, err
+	}
+	
+	rules, err := s.getRules(ctx, resource)
+	if err != nil {
+		queries.ReleaseStatus(status)
+		return nil, err
+	}
+	rule, ok := domain.SelectRule(rules, "")
+	if !ok || len(rule.Windows) == 0 {
+		return status, nil
+	}
+	
+	statuses := []*queries.RateLimitStatus{status}
+	for _, window := range rule.WindowRules() {
+		windowStatus, err := s.getStatus(ctx, clientID, window.StateResource())
+		if err != nil {
+			for _, status := range statuses {
+				queries.ReleaseStatus(status)
+			}
+			return nil, err
+		}
+		statuses = append(statuses, windowStatus)
+	}
+	return queries.CombineWindows(rule.Limits(), statuses), nil
+}
+
+// getStatus gets the current rate limit status of a client's state for
+// resource
+func (s *RateLimiterService) getStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
 	query := &queries.GetRateLimitStatusQuery{
 		BaseQuery: queries.BaseQuery{
 			ID:   fmt.Sprintf("status-%d", time.Now().UnixNano()),
 			Type: "GetRateLimitStatus",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
 		ClientID: clientID,
 		Resource: resource,
@@ -97,20 +745,53 @@ func (s *RateLimiterService) GetRateLimitStatus(ctx context.Context, clientID, r
 	return result.(*queries.RateLimitStatus), nil
 }
 
-// GetRateLimitHistory gets the rate limit history for a client/resource
-func (s *RateLimiterService) GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int) (*queries.RateLimitHistory, error) {
+// ExplainDecision explains how a request of a client to a resource would be
+// decided now and how its last stored decision was made. method selects
+// method-specific rules, and key is the limit key rendered from the rule's
+// key template, clientID when empty.
+func (s *RateLimiterService) ExplainDecision(ctx context.Context, clientID, resource, method, key string) (*queries.DecisionExplanation, error) {
+	if key == "" {
+		key = clientID
+	}
+	key = s.privacy.LookupClientID(key)
+	
+	query := &queries.ExplainDecisionQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("explain-%d", time.Now().UnixNano()),
+			Type: "ExplainDecision",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
+		Resource: resource,
+		Method:   method,
+		Key:      key,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain decision: %w", err)
+	}
+	
+	return result.(*queries.DecisionExplanation), nil
+}
+
+// GetRateLimitHistory gets the rate limit history for a client/resource,
+// selected by filter
+func (s *RateLimiterService) GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor, filter queries.HistoryFilter) (*queries.RateLimitHistory, error) {
 	query := &queries.GetRateLimitHistoryQuery{
 		BaseQuery: queries.BaseQuery{
 			ID:   fmt.Sprintf("history-%d", time.Now().UnixNano()),
 			Type: "GetRateLimitHistory",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
-		ClientID:  clientID,
+		ClientID:  s.privacy.LookupClientID(clientID),
 		Resource:  resource,
 		StartTime: startTime,
 		EndTime:   endTime,
 		Limit:     limit,
 		Offset:    offset,
+		After:     after,
+		Filter:    s.privateHistoryFilter(filter),
 	}
 	
 	result, err := s.queryHandler.Handle(ctx, query)
@@ -121,17 +802,35 @@ func (s *RateLimiterService) GetRateLimitHistory(ctx context.Context, clientID,
 	return result.(*queries.RateLimitHistory), nil
 }
 
-// GetClientStats gets statistics for a client
-func (s *RateLimiterService) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time) (*queries.ClientStats, error) {
+// privateHistoryFilter returns filter for histories stored in privacy mode,
+// where IP addresses and user agents only match whole values through their
+// pseudonyms
+func (s *RateLimiterService) privateHistoryFilter(filter queries.HistoryFilter) queries.HistoryFilter {
+	if !s.privacy.Enabled() {
+		return filter
+	}
+	if filter.IPAddress != "" {
+		filter.IPAddress = s.privacy.LookupIPAddress(filter.IPAddress)
+	}
+	if filter.UserAgent != "" {
+		filter.UserAgent = s.privacy.LookupUserAgent(filter.UserAgent)
+	}
+	return filter
+}
+
+// GetClientStats gets statistics for a client with a time series of
+// granularity, or of the granularity suiting the range when empty
+func (s *RateLimiterService) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error) {
 	query := &queries.GetClientStatsQuery{
 		BaseQuery: queries.BaseQuery{
 			ID:   fmt.Sprintf("stats-%d", time.Now().UnixNano()),
 			Type: "GetClientStats",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
-		ClientID:  clientID,
-		StartTime: startTime,
-		EndTime:   endTime,
+		ClientID:    clientID,
+		StartTime:   startTime,
+		EndTime:     endTime,
+		Granularity: granularity,
 	}
 	
 	result, err := s.queryHandler.Handle(ctx, query)
@@ -142,39 +841,104 @@ func (s *RateLimiterService) GetClientStats(ctx context.Context, clientID string
 	return result.(*queries.ClientStats), nil
 }
 
-// CreateRule creates a new rate limit rule
-func (s *RateLimiterService) CreateRule(ctx context.Context, resource string, limit int, window time.Duration, algorithm string) error {
+// RuleSpec is a rate limit rule as it is created, updated or applied
+type RuleSpec struct {
+	Resource  string
+	Method    string // Empty for any method
+	Limit     int
+	Window    time.Duration
+	Algorithm string
+	
+	// Template of the key requests are counted under, e.g.
+	// "header.X-Api-Key" or "ip+path"; the client ID when empty
+	KeyTemplate string
+	
+	// Fraction of the limit at which clients are warned once; zero disables
+	// the warning
+	SoftThreshold float64
+	
+	// Settings of the algorithm beyond limit and window, which may set
+	// them instead, in which case they are left zero
+	Parameters *domain.AlgorithmParameters
+	
+	// Further limits over other windows, which requests must pass as well
+	Windows []domain.WindowLimit
+	
+	// Feature flag gating the rule, which is then enforced only for the
+	// clients the flag is on for
+	Flag string
+	
+	// Description, owner and change reference of the rule
+	Annotations domain.RuleAnnotations
+}
+
+// CreateRule creates a new rate limit rule as spec sets it out. The change
+// is attributed to the principal of ctx.
+func (s *RateLimiterService) CreateRule(ctx context.Context, spec RuleSpec) error {
 	cmd := &commands.CreateRuleCommand{
 		BaseCommand: commands.BaseCommand{
 			ID:   fmt.Sprintf("create-rule-%d", time.Now().UnixNano()),
 			Type: "CreateRule",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
-		Resource:  resource,
-		Limit:     limit,
-		Window:    window,
-		Algorithm: algorithm,
+		Resource:      spec.Resource,
+		Method:        spec.Method,
+		Limit:         spec.Limit,
+		Window:        spec.Window,
+		Algorithm:     spec.Algorithm,
+		KeyTemplate:   spec.KeyTemplate,
+		SoftThreshold: spec.SoftThreshold,
+		Parameters:    spec.Parameters,
+		Windows:       spec.Windows,
+		Flag:          spec.Flag,
+		Annotations:   spec.Annotations,
 	}
 	
-	return s.commandHandler.Handle(ctx, cmd)
+	return s.unblock("", s.commandHandler.Handle(ctx, cmd))
 }
 
-// UpdateRule updates an existing rate limit rule
-func (s *RateLimiterService) UpdateRule(ctx context.Context, ruleID, resource string, limit int, window time.Duration, algorithm string) error {
+// UpdateRule updates an existing rate limit rule to spec, replacing its
+// description, owner and change reference with those of spec.Annotations
+func (s *RateLimiterService) UpdateRule(ctx context.Context, ruleID string, spec RuleSpec) error {
 	cmd := &commands.UpdateRuleCommand{
 		BaseCommand: commands.BaseCommand{
 			ID:   fmt.Sprintf("update-rule-%d", time.Now().UnixNano()),
 			Type: "UpdateRule",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
-		RuleID:    ruleID,
-		Resource:  resource,
-		Limit:     limit,
-		Window:    window,
-		Algorithm: algorithm,
+		RuleID:        ruleID,
+		Resource:      spec.Resource,
+		Method:        spec.Method,
+		Limit:         spec.Limit,
+		Window:        spec.Window,
+		Algorithm:     spec.Algorithm,
+		KeyTemplate:   spec.KeyTemplate,
+		SoftThreshold: spec.SoftThreshold,
+		Parameters:    spec.Parameters,
+		Windows:       spec.Windows,
+		Flag:          spec.Flag,
+		Annotations:   spec.Annotations,
 	}
 	
-	return s.commandHandler.Handle(ctx, cmd)
+	return s.unblock("", s.commandHandler.Handle(ctx, cmd))
+}
+
+// ApplyRule creates the rate limit rule for a resource and method, or updates
+// it when one already exists, so that applying the same rule twice is
+// idempotent
+func (s *RateLimiterService) ApplyRule(ctx context.Context, spec RuleSpec) error {
+	rules, err := s.getRules(ctx, spec.Resource)
+	if err != nil {
+		return err
+	}
+	
+	for _, rule := range rules {
+		if strings.EqualFold(rule.Method, spec.Method) {
+			return s.UpdateRule(ctx, rule.ID, spec)
+		}
+	}
+	
+	return s.CreateRule(ctx, spec)
 }
 
 // ResetRateLimit resets the rate limit for a client/resource
@@ -183,11 +947,585 @@ func (s *RateLimiterService) ResetRateLimit(ctx context.Context, clientID, resou
 		BaseCommand: commands.BaseCommand{
 			ID:   fmt.Sprintf("reset-%d", time.Now().UnixNano()),
 			Type: "ResetRateLimit",
-			Time: time.Now(),
+			Time: s.clock.Now(),
 		},
-		ClientID: clientID,
+		ClientID: s.privacy.ClientID(clientID),
+		Resource: resource,
+	}
+	
+	return s.unblock(cmd.ClientID, s.commandHandler.Handle(ctx, cmd))
+}
+
+// RefundRateLimit gives back the quota of the most recent allowed request of
+// a client to resource with method, or with any method when method is
+// empty, because the operation it protected failed before doing real work.
+// For rules with a key template clientID is the rendered limit key.
+func (s *RateLimiterService) RefundRateLimit(ctx context.Context, clientID, resource, method, reason string) (*domain.RateLimitRefundedEvent, error) {
+	cmd := &commands.RefundRateLimitCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("refund-%d", time.Now().UnixNano()),
+			Type: "RefundRateLimit",
+			Time: s.clock.Now(),
+		},
+		ClientID: s.privacy.ClientID(clientID),
 		Resource: resource,
+		Method:   method,
+		Reason:   reason,
+	}
+	
+	if err := s.unblock(cmd.ClientID, s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// CreateOverride grants a client a temporary limit for requests to resource
+// with method, or with any method when method is empty. The override takes
+// precedence over the resource's rule until expiresAt; a zero window keeps
+// the rule's window.
+func (s *RateLimiterService) CreateOverride(ctx context.Context, clientID, resource, method string, limit int, window time.Duration, expiresAt time.Time, reason string) (*domain.RateLimitOverride, error) {
+	cmd := &commands.CreateOverrideCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("create-override-%d", time.Now().UnixNano()),
+			Type: "CreateOverride",
+			Time: s.clock.Now(),
+		},
+		ClientID:  s.privacy.ClientID(clientID),
+		Resource:  resource,
+		Method:    method,
+		Limit:     limit,
+		Window:    window,
+		Reason:    reason,
+		ExpiresAt: expiresAt,
+	}
+	
+	if err := s.unblock(cmd.ClientID, s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// ListOverrides lists the overrides in effect, of one client and/or
+// resource when they are not empty
+func (s *RateLimiterService) ListOverrides(ctx context.Context, clientID, resource string) ([]domain.RateLimitOverride, error) {
+	query := &queries.GetOverridesQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("overrides-%d", time.Now().UnixNano()),
+			Type: "GetOverrides",
+			Time: s.clock.Now(),
+		},
+		ClientID: s.privacy.LookupClientID(clientID),
+		Resource: resource,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get overrides: %w", err)
+	}
+	
+	return result.([]domain.RateLimitOverride), nil
+}
+
+// DeleteOverride revokes an override before it expires
+func (s *RateLimiterService) DeleteOverride(ctx context.Context, overrideID string) error {
+	cmd := &commands.DeleteOverrideCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("delete-override-%d", time.Now().UnixNano()),
+			Type: "DeleteOverride",
+			Time: s.clock.Now(),
+		},
+		OverrideID: overrideID,
+	}
+	
+	return s.unblock("", s.commandHandler.Handle(ctx, cmd))
+}
+
+// CreateFreeze schedules a freeze of resource, or of every resource when
+// resource is empty, in mode "deny_all" or "allow_all". A zero startsAt
+// starts it now and a zero endsAt keeps it until it is lifted.
+func (s *RateLimiterService) CreateFreeze(ctx context.Context, resource, mode, reason string, startsAt, endsAt time.Time) (*domain.Freeze, error) {
+	cmd := &commands.CreateFreezeCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("create-freeze-%d", time.Now().UnixNano()),
+			Type: "CreateFreeze",
+			Time: s.clock.Now(),
+		},
+		Resource: resource,
+		Mode:     mode,
+		Reason:   reason,
+		StartsAt: startsAt,
+		EndsAt:   endsAt,
+	}
+	
+	if err := s.unblock("", s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// ListFreezes lists the freezes in effect or scheduled, only those covering
+// resource when it is not empty
+func (s *RateLimiterService) ListFreezes(ctx context.Context, resource string) ([]domain.Freeze, error) {
+	query := &queries.GetFreezesQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("freezes-%d", time.Now().UnixNano()),
+			Type: "GetFreezes",
+			Time: s.clock.Now(),
+		},
+		Resource: resource,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get freezes: %w", err)
+	}
+	
+	return result.([]domain.Freeze), nil
+}
+
+// LiftFreeze ends a freeze, or cancels it before it starts
+func (s *RateLimiterService) LiftFreeze(ctx context.Context, freezeID string) error {
+	cmd := &commands.LiftFreezeCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("lift-freeze-%d", time.Now().UnixNano()),
+			Type: "LiftFreeze",
+			Time: s.clock.Now(),
+		},
+		FreezeID: freezeID,
+	}
+	
+	return s.unblock("", s.commandHandler.Handle(ctx, cmd))
+}
+
+// RolloutSettings are the optional settings of a rule rollout. Zero values
+// use the defaults: stages of 5%, 25% and 50% of clients lasting 10 minutes
+// each, rolled back when the canary deny rate exceeds the baseline's by more
+// than 0.05 once each cohort made 100 decisions.
+type RolloutSettings struct {
+	Stages           []int
+	StageDuration    time.Duration
+	MaxDenyRateDelta float64
+	MinRequests      int64
+}
+
+// StartRollout starts rolling out a change of a rule to a growing percentage
+// of clients. Zero limit, window and algorithm and a nil soft threshold keep
+// the rule's settings.
+func (s *RateLimiterService) StartRollout(ctx context.Context, ruleID string, limit int, window time.Duration, algorithm string, softThreshold *float64, settings RolloutSettings) (*domain.RuleRollout, error) {
+	cmd := &commands.StartRolloutCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("start-rollout-%d", time.Now().UnixNano()),
+			Type: "StartRollout",
+			Time: s.clock.Now(),
+		},
+		RuleID:           ruleID,
+		Limit:            limit,
+		Window:           window,
+		Algorithm:        algorithm,
+		SoftThreshold:    softThreshold,
+		Stages:           settings.Stages,
+		StageDuration:    settings.StageDuration,
+		MaxDenyRateDelta: settings.MaxDenyRateDelta,
+		MinRequests:      settings.MinRequests,
+	}
+	
+	if err := s.unblock("", s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// ListRollouts lists the rule rollouts, newest first, of one rule and/or
+// with one status when they are not empty
+func (s *RateLimiterService) ListRollouts(ctx context.Context, ruleID, status string) ([]domain.RuleRollout, error) {
+	query := &queries.GetRolloutsQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("rollouts-%d", time.Now().UnixNano()),
+			Type: "GetRollouts",
+			Time: s.clock.Now(),
+		},
+		RuleID: ruleID,
+		Status: status,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rollouts: %w", err)
+	}
+	
+	return result.([]domain.RuleRollout), nil
+}
+
+// GetRollout returns a rule rollout with its cohorts' decisions
+func (s *RateLimiterService) GetRollout(ctx context.Context, rolloutID string) (*domain.RuleRollout, error) {
+	query := &queries.GetRolloutsQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("rollout-%d", time.Now().UnixNano()),
+			Type: "GetRollouts",
+			Time: s.clock.Now(),
+		},
+		RolloutID: rolloutID,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rollout: %w", err)
+	}
+	
+	rollouts := result.([]domain.RuleRollout)
+	if len(rollouts) == 0 {
+		return nil, fmt.Errorf("%w: %s", domain.ErrRolloutNotFound, rolloutID)
+	}
+	return &rollouts[0], nil
+}
+
+// PromoteRollout replaces a rule with the candidate of its running rollout,
+// skipping any remaining stages
+func (s *RateLimiterService) PromoteRollout(ctx context.Context, rolloutID, reason string) (*domain.RuleRollout, error) {
+	cmd := &commands.PromoteRolloutCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("promote-rollout-%d", time.Now().UnixNano()),
+			Type: "PromoteRollout",
+			Time: s.clock.Now(),
+		},
+		RolloutID: rolloutID,
+		Reason:    reason,
+	}
+	
+	if err := s.unblock("", s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// RollBackRollout ends a running rollout, keeping its rule
+func (s *RateLimiterService) RollBackRollout(ctx context.Context, rolloutID, reason string) (*domain.RuleRollout, error) {
+	cmd := &commands.RollBackRolloutCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("roll-back-rollout-%d", time.Now().UnixNano()),
+			Type: "RollBackRollout",
+			Time: s.clock.Now(),
+		},
+		RolloutID: rolloutID,
+		Reason:    reason,
+	}
+	
+	if err := s.unblock("", s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// EvaluateRollouts advances, promotes or rolls back the running rollouts by
+// the deny rates of their cohorts, and returns those that advanced or ended
+func (s *RateLimiterService) EvaluateRollouts(ctx context.Context) ([]domain.RuleRollout, error) {
+	cmd := &commands.EvaluateRolloutsCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("evaluate-rollouts-%d", time.Now().UnixNano()),
+			Type: "EvaluateRollouts",
+			Time: s.clock.Now(),
+		},
+	}
+	
+	err := s.commandHandler.Handle(ctx, cmd)
+	if len(cmd.Result) > 0 {
+		// Rollouts that advanced or ended moved clients to another rule
+		s.unblock("", nil)
+	}
+	return cmd.Result, err
+}
+
+// GrantLease leases the client of a request to resource described by attrs
+// up to tokens of its quota, keyed like the request, for a term of ttl, or
+// the longest term when ttl is zero. Tokens and term are capped by the
+// configured limits and the quota left. The status is that after the lease;
+// no lease is made when it is denied, or decided by a freeze.
+func (s *RateLimiterService) GrantLease(ctx context.Context, resource string, attrs keytemplate.Attributes, tokens int, ttl time.Duration) (*domain.Lease, *queries.RateLimitStatus, error) {
+	if s.maxLease == 0 {
+		return nil, nil, fmt.Errorf("%w: leases are disabled", domain.ErrInvalidLease)
+	}
+	if tokens <= 0 || ttl < 0 {
+		return nil, nil, fmt.Errorf("%w: tokens must be positive", domain.ErrInvalidLease)
+	}
+	tokens = min(tokens, s.maxLease)
+	if ttl == 0 || ttl > s.maxLeaseTTL {
+		ttl = s.maxLeaseTTL
+	}
+	
+	if status, err := s.disabledStatus(ctx, attrs.ClientID, resource); err != nil || status != nil {
+		return nil, status, err
+	}
+	
+	key, method, err := s.requestKey(ctx, resource, attrs)
+	if err != nil {
+		return nil, nil, err
+	}
+	key = s.privacy.ClientID(key)
+	
+	now := s.clock.Now()
+	if status, err := s.decidedStatus(ctx, key, resource, method, now); err != nil || status != nil {
+		return nil, status, err
+	}
+	
+	cmd := &commands.GrantLeaseCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("grant-lease-%d", time.Now().UnixNano()),
+			Type: "GrantLease",
+			Time: now,
+		},
+		ClientID: key,
+		Resource: resource,
+		Method:   method,
+		Tokens:   tokens,
+		TTL:      ttl,
+	}
+	
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, nil, err
+	}
+	
+	status := queries.StatusFromEvent(cmd.Event, now)
+	if cmd.Result == nil {
+		s.block(key, resource, method, status, now)
+	}
+	return cmd.Result, status, nil
+}
+
+// RenewLease reports the tokens of a lease's current term the client used,
+// giving back the others, and leases it up to tokens for its next term.
+// Renewing no tokens releases the lease. The returned lease is nil once it
+// was released, or when no tokens are left for the next term.
+func (s *RateLimiterService) RenewLease(ctx context.Context, leaseID string, used, tokens int) (*domain.Lease, *queries.RateLimitStatus, error) {
+	now := s.clock.Now()
+	cmd := &commands.RenewLeaseCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("renew-lease-%d", time.Now().UnixNano()),
+			Type: "RenewLease",
+			Time: now,
+		},
+		LeaseID: leaseID,
+		Used:    used,
+		Tokens:  min(tokens, s.maxLease),
+	}
+	
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, nil, err
+	}
+	
+	status := queries.StatusFromEvent(cmd.Event, now)
+	if status.IsAllowed {
+		// Unused tokens given back may lift a denial
+		s.unblock(status.ClientID, nil)
+	} else {
+		// The status is of the rule's state resource, which is already scoped
+		s.block(status.ClientID, status.Resource, "", status, now)
+	}
+	return cmd.Result, status, nil
+}
+
+// ListLeases lists the active token leases, of one client and/or resource
+// when they are not empty
+func (s *RateLimiterService) ListLeases(ctx context.Context, clientID, resource string) ([]domain.Lease, error) {
+	query := &queries.GetLeasesQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("leases-%d", time.Now().UnixNano()),
+			Type: "GetLeases",
+			Time: s.clock.Now(),
+		},
+		ClientID: s.privacy.LookupClientID(clientID),
+		Resource: resource,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get leases: %w", err)
+	}
+	
+	return result.([]domain.Lease), nil
+}
+
+// GetLease returns a token lease, which may have lapsed but not yet been
+// expired
+func (s *RateLimiterService) GetLease(ctx context.Context, leaseID string) (*domain.Lease, error) {
+	query := &queries.GetLeasesQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("lease-%d", time.Now().UnixNano()),
+			Type: "GetLeases",
+			Time: s.clock.Now(),
+		},
+		LeaseID: leaseID,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", err)
+	}
+	
+	leases := result.([]domain.Lease)
+	if len(leases) == 0 {
+		return nil, fmt.Errorf("%w: %s", domain.ErrLeaseNotFound, leaseID)
+	}
+	return &leases[0], nil
+}
+
+// ExpireLeases expires the token leases that were neither renewed nor
+// released in time, and returns them
+func (s *RateLimiterService) ExpireLeases(ctx context.Context) ([]domain.Lease, error) {
+	cmd := &commands.ExpireLeasesCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("expire-leases-%d", time.Now().UnixNano()),
+			Type: "ExpireLeases",
+			Time: s.clock.Now(),
+		},
+	}
+	
+	err := s.commandHandler.Handle(ctx, cmd)
+	return cmd.Result, err
+}
+
+// RegisterClient adds a client to the registry
+func (s *RateLimiterService) RegisterClient(ctx context.Context, clientID, name, tier string, tags []string, contact string) (*domain.Client, error) {
+	cmd := &commands.RegisterClientCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("register-client-%d", time.Now().UnixNano()),
+			Type: "RegisterClient",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
+		Name:     name,
+		Tier:     tier,
+		Tags:     tags,
+		Contact:  contact,
+	}
+	
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// UpdateClient replaces a registered client's metadata
+func (s *RateLimiterService) UpdateClient(ctx context.Context, clientID, name, tier string, tags []string, contact string) (*domain.Client, error) {
+	cmd := &commands.UpdateClientCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("update-client-%d", time.Now().UnixNano()),
+			Type: "UpdateClient",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
+		Name:     name,
+		Tier:     tier,
+		Tags:     tags,
+		Contact:  contact,
+	}
+	
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// SetClientDisabled disables a registered client, denying all of its
+// requests, or re-enables it
+func (s *RateLimiterService) SetClientDisabled(ctx context.Context, clientID string, disabled bool) (*domain.Client, error) {
+	cmd := &commands.SetClientDisabledCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("set-client-disabled-%d", time.Now().UnixNano()),
+			Type: "SetClientDisabled",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
+		Disabled: disabled,
+	}
+	
+	if err := s.commandHandler.Handle(ctx, cmd); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// DeleteClient removes a client from the registry
+func (s *RateLimiterService) DeleteClient(ctx context.Context, clientID string) error {
+	cmd := &commands.DeleteClientCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("delete-client-%d", time.Now().UnixNano()),
+			Type: "DeleteClient",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
 	}
 	
 	return s.commandHandler.Handle(ctx, cmd)
 }
+
+// EraseClientData erases a client's events, history, statistics and
+// overrides, returning the tombstone that records the erasure. Registry
+// entries are kept; DeleteClient removes them.
+func (s *RateLimiterService) EraseClientData(ctx context.Context, clientID string) (*domain.ClientDataErasedEvent, error) {
+	cmd := &commands.EraseClientDataCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("erase-client-data-%d", time.Now().UnixNano()),
+			Type: "EraseClientData",
+			Time: s.clock.Now(),
+		},
+		ClientID: s.privacy.ClientID(clientID),
+	}
+	
+	if err := s.unblock(cmd.ClientID, s.commandHandler.Handle(ctx, cmd)); err != nil {
+		return nil, err
+	}
+	
+	return cmd.Result, nil
+}
+
+// GetClient gets a registered client. The error wraps
+// domain.ErrClientNotFound when the client is not registered.
+func (s *RateLimiterService) GetClient(ctx context.Context, clientID string) (*domain.Client, error) {
+	query := &queries.GetClientQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("client-%d", time.Now().UnixNano()),
+			Type: "GetClient",
+			Time: s.clock.Now(),
+		},
+		ClientID: clientID,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client: %w", err)
+	}
+	
+	return result.(*domain.Client), nil
+}
+
+// ListClients lists registered clients and clients discovered from their
+// traffic, sorted by ID or, newest first, by sort "first_seen" or
+// "last_seen". Filtering by tier or tag lists registered clients only.
+func (s *RateLimiterService) ListClients(ctx context.Context, tier, tag, sort string) ([]queries.ClientListing, error) {
+	query := &queries.ListClientsQuery{
+		BaseQuery: queries.BaseQuery{
+			ID:   fmt.Sprintf("clients-%d", time.Now().UnixNano()),
+			Type: "ListClients",
+			Time: s.clock.Now(),
+		},
+		Tier: tier,
+		Tag:  tag,
+		Sort: sort,
+	}
+	
+	result, err := s.queryHandler.Handle(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clients: %w", err)
+	}
+	
+	return result.([]queries.ClientListing), nil
+}
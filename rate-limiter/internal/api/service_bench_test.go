@@ -0,0 +1,173 @@
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+	"github.com/NickChunglolz/rate-limiter/internal/sidecar"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// resource is the resource the benchmark rule limits
+const resource = "bench"
+
+// historyDepth is the number of decisions a client makes before the check
+// benchmarks move on to a new client. Every decision replays the client's
+// event history, so without a bound the cost per decision would grow with
+// the number of iterations.
+const historyDepth = 100
+
+// newService wires a rate limiter over eventStore like the server does by
+// default, deciding through an aggregate cache of 10000 aggregates, and
+// creates the benchmark rule
+func newService(b *testing.B, eventStore handlers.EventStore) *api.RateLimiterService {
+	ruleRepository := infrastructure.NewInMemoryRuleRepository()
+	readModel := infrastructure.NewInMemoryReadModel()
+
+	commandHandler := handlers.NewRateLimitCommandHandler(eventStore, ruleRepository).
+		WithEventPublisher(infrastructure.NewReadModelPublisher(readModel)).
+		WithAggregateCache(infrastructure.NewAggregateCache(10000))
+	queryHandler := handlers.NewRateLimitQueryHandler(readModel, ruleRepository)
+	service := api.NewRateLimiterService(commandHandler, queryHandler)
+
+	if err := service.CreateRule(context.Background(), api.RuleSpec{Resource: resource, Limit: 1000000, Window: time.Second, Algorithm: "fixed_window"}); err != nil {
+		b.Fatalf("creating rule: %v", err)
+	}
+	return service
+}
+
+// BenchmarkCheck measures sequential decisions against the in-memory event
+// store and against the Redis event store, which keeps its events encoded in
+// process memory rather than in a Redis server, and so measures encoding and
+// decoding events without network round trips
+func BenchmarkCheck(b *testing.B) {
+	b.Run("store=memory", func(b *testing.B) {
+		benchmarkCheck(b, infrastructure.NewInMemoryEventStore(), historyDepth)
+	})
+	b.Run("store=encoded", func(b *testing.B) {
+		benchmarkCheck(b, infrastructure.NewRedisEventStore(infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())), historyDepth)
+	})
+}
+
+// BenchmarkCheckNewClients measures the first decision of every client
+func BenchmarkCheckNewClients(b *testing.B) {
+	benchmarkCheck(b, infrastructure.NewInMemoryEventStore(), 1)
+}
+
+// benchmarkCheck measures sequential decisions against eventStore, moving
+// on to a new client every depth decisions
+func benchmarkCheck(b *testing.B, eventStore handlers.EventStore, depth int) {
+	service := newService(b, eventStore)
+	ctx := context.Background()
+	clients := clientIDs(b.N/depth + 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		status, err := service.CheckRateLimit(ctx, clients[i/depth], resource, "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Hand the answer back like the HTTP handlers do
+		queries.ReleaseStatus(status)
+	}
+}
+
+// clientIDs returns the IDs of n clients, formatted ahead of the timed
+// decisions so that the benchmarks measure the decisions alone
+func clientIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("client-%d", i)
+	}
+	return ids
+}
+
+// BenchmarkCheckParallel measures decisions from GOMAXPROCS goroutines,
+// spread round robin over a number of concurrently active clients
+func BenchmarkCheckParallel(b *testing.B) {
+	for _, clients := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			service := newService(b, infrastructure.NewInMemoryEventStore())
+			ctx := context.Background()
+			ids := clientIDs(clients * (b.N/(clients*historyDepth) + 2))
+			var next atomic.Int64
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(next.Add(1))
+					clientID := ids[i%clients+clients*(i/(clients*historyDepth))]
+					status, err := service.CheckRateLimit(ctx, clientID, resource, "", "")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					queries.ReleaseStatus(status)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkEncodeStatus measures encoding the answer of a check as the HTTP
+// handlers write it
+func BenchmarkEncodeStatus(b *testing.B) {
+	service := newService(b, infrastructure.NewInMemoryEventStore())
+	status, err := service.CheckRateLimit(context.Background(), "client-0", resource, "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = status.AppendJSON(buf[:0])
+	}
+}
+
+// BenchmarkSidecarCheck measures decisions made by a client over the
+// sidecar protocol on a Unix socket, round trip included, and reports their
+// 99th percentile latency
+func BenchmarkSidecarCheck(b *testing.B) {
+	listener, err := net.Listen("unix", filepath.Join(b.TempDir(), "sidecar.sock"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := sidecar.NewServer(config.SidecarConfig{}, newService(b, infrastructure.NewInMemoryEventStore()))
+	go server.Serve(listener)
+	defer listener.Close()
+
+	client := ratelimit.NewSidecar("unix:"+listener.Addr().String(), 1)
+	defer client.Close()
+	ctx := context.Background()
+	clients := clientIDs(b.N/historyDepth + 1)
+	latencies := make([]time.Duration, b.N)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		started := time.Now()
+		if _, err := client.Allow(ctx, clients[i/historyDepth], resource); err != nil {
+			b.Fatal(err)
+		}
+		latencies[i] = time.Since(started)
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+}
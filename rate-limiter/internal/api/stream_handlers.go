@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// eventStreamPath is the path of the event stream, which is exempt from the
+// request timeout
+const eventStreamPath = "/api/v1/events/stream"
+
+// EventStream subscribes live viewers to the events published on the bus
+type EventStream interface {
+	SubscribeLive(eventType string) <-chan domain.Event
+	Unsubscribe(ch <-chan domain.Event)
+}
+
+// EventStreamHTTPHandler streams published events, such as every decision,
+// as server-sent events
+type EventStreamHTTPHandler struct {
+	events    EventStream
+	heartbeat time.Duration
+}
+
+// NewEventStreamHTTPHandler creates a new event stream handler
+func NewEventStreamHTTPHandler(events EventStream) *EventStreamHTTPHandler {
+	return &EventStreamHTTPHandler{
+		events:    events,
+		heartbeat: 15 * time.Second,
+	}
+}
+
+// StreamHandler streams the events of the type in the optional type
+// parameter, or of every type, until the client disconnects. A comment is
+// sent when no event was for a while, so proxies keep the stream open. A
+// viewer too slow to keep up misses the oldest events rather than holding
+// up decisions.
+func (h *EventStreamHTTPHandler) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	eventType := r.URL.Query().Get("type")
+	if eventType == "" {
+		eventType = "*"
+	}
+
+	// The stream outlives the server's write timeout
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := h.events.SubscribeLive(eventType)
+	defer h.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.EventID(), event.EventType(), data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// RegisterRoutes adds the event stream endpoint to mux
+func (h *EventStreamHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET "+eventStreamPath, h.StreamHandler)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+	"github.com/NickChunglolz/rate-limiter/internal/threatfeed"
+)
+
+// ThreatFeedMonitor reports the import state and match counts of threat
+// feeds
+type ThreatFeedMonitor interface {
+	Stats(ctx context.Context) []queries.ThreatFeedStats
+}
+
+// ThreatFeedService imports threat feeds and tells which feeds list an
+// address
+type ThreatFeedService interface {
+	ThreatFeedMonitor
+	Import(ctx context.Context, name string) (queries.ThreatFeedStats, error)
+	Lookup(ip string) ([]queries.ThreatFeedEntry, error)
+}
+
+// ThreatFeedHTTPHandler provides the threat feed admin endpoints
+type ThreatFeedHTTPHandler struct {
+	feeds ThreatFeedService
+}
+
+// NewThreatFeedHTTPHandler creates a threat feed admin handler
+func NewThreatFeedHTTPHandler(feeds ThreatFeedService) *ThreatFeedHTTPHandler {
+	return &ThreatFeedHTTPHandler{feeds: feeds}
+}
+
+// ListHandler returns the state of every feed
+func (h *ThreatFeedHTTPHandler) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.feeds.Stats(r.Context()))
+}
+
+// LookupHandler returns the listings of the networks containing the ip
+// query parameter, with the feeds they come from
+func (h *ThreatFeedHTTPHandler) LookupHandler(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		http.Error(w, "ip is required", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.feeds.Lookup(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ip":       ip,
+		"listed":   len(entries) > 0,
+		"listings": entries,
+	})
+}
+
+// ImportHandler imports a feed now rather than at its next interval
+func (h *ThreatFeedHTTPHandler) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.feeds.Import(r.Context(), r.PathValue("name"))
+	switch {
+	case errors.Is(err, threatfeed.ErrUnknownFeed):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil && r.Context().Err() != nil:
+		WriteError(w, r.Context().Err())
+		return
+	case err != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// RegisterRoutes adds the threat feed endpoints to mux
+func (h *ThreatFeedHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/threat-feeds", h.ListHandler)
+	mux.HandleFunc("GET /api/v1/threat-feeds/lookup", h.LookupHandler)
+	mux.HandleFunc("POST /api/v1/threat-feeds/{name}/import", h.ImportHandler)
+}
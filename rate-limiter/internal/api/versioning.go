@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// APIVersion is a version of the HTTP API. Both versions are served by the
+// same handlers, which tell them apart by RequestAPIVersion where their
+// responses differ: v2 answers errors with a JSON envelope, pages lists by
+// cursor only and answers checks with typed decisions.
+type APIVersion int
+
+const (
+	APIv1 APIVersion = 1
+	APIv2 APIVersion = 2
+)
+
+type apiVersionKey struct{}
+
+// RequestAPIVersion returns the version of the API r was made to
+func RequestAPIVersion(r *http.Request) APIVersion {
+	if version, ok := r.Context().Value(apiVersionKey{}).(APIVersion); ok {
+		return version
+	}
+	return APIv1
+}
+
+// Deprecation is when v1 endpoints with a v2 successor were deprecated and
+// when they will be removed, announced on each of their responses
+type Deprecation struct {
+	At     time.Time // Deprecation header (RFC 9745); none when zero
+	Sunset time.Time // Sunset header (RFC 8594); none when zero
+}
+
+// announce sets the deprecation headers of a v1 response whose successor
+// is at successor
+func (d Deprecation) announce(header http.Header, successor string) {
+	if !d.At.IsZero() {
+		header.Set("Deprecation", "@"+strconv.FormatInt(d.At.Unix(), 10))
+	}
+	if !d.Sunset.IsZero() {
+		header.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	header.Add("Link", "<"+successor+`>; rel="successor-version"`)
+}
+
+// WithV1Deprecation announces the deprecation of the v1 endpoints that
+// have a v2 successor on their responses
+func (h *HTTPHandler) WithV1Deprecation(deprecation Deprecation) *HTTPHandler {
+	h.deprecation = deprecation
+	return h
+}
+
+// handleVersions serves handler at path under /api/v1, announcing its
+// deprecation, and under /api/v2
+func (h *HTTPHandler) handleVersions(mux *http.ServeMux, path string, handler http.HandlerFunc) {
+	successor := "/api/v2" + path
+	mux.HandleFunc("/api/v1"+path, func(w http.ResponseWriter, r *http.Request) {
+		h.deprecation.announce(w.Header(), successor)
+		handler(w, r)
+	})
+	mux.HandleFunc(successor, func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, APIv2)))
+	})
+}
+
+// errorCodes are the codes of the v2 error envelope by status code
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorEnvelope is the body of v2 error responses
+type errorEnvelope struct {
+	Error struct {
+		Code    string `json:"code"`    // Stable name of the kind of error, e.g. invalid_request
+		Message string `json:"message"` // Human-readable detail
+	} `json:"error"`
+}
+
+// httpError answers r with an error: in plain text as http.Error does on
+// v1, and in the error envelope on v2
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if RequestAPIVersion(r) == APIv1 {
+		http.Error(w, message, code)
+		return
+	}
+
+	var envelope errorEnvelope
+	envelope.Error.Code = errorCodes[code]
+	if envelope.Error.Code == "" {
+		envelope.Error.Code = "error"
+	}
+	envelope.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(envelope)
+}
+
+// writeError maps a service error to an error response to r, as
+// WriteError does on v1
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	message, code := errorResponse(err)
+	httpError(w, r, message, code)
+}
+
+// Decision is the outcome of a check as v2 answers it
+type Decision string
+
+const (
+	DecisionAllow Decision = "allow" // The request is allowed
+	DecisionDeny  Decision = "deny"  // The request is over the limit
+	DecisionBlock Decision = "block" // The client is blocked until blocked_until
+)
+
+// decisionOf returns the decision status records
+func decisionOf(status *queries.RateLimitStatus) Decision {
+	switch {
+	case status.IsAllowed:
+		return DecisionAllow
+	case status.IsBlocked:
+		return DecisionBlock
+	default:
+		return DecisionDeny
+	}
+}
+
+// writeDecision writes status as the body of a v2 JSON response with
+// code: its decision, and the status it was made with
+func writeDecision(w http.ResponseWriter, code int, status *queries.RateLimitStatus) {
+	buf := statusBuffers.Get().(*[]byte)
+	b := append((*buf)[:0], `{"decision":"`...)
+	b = append(b, decisionOf(status)...)
+	b = append(b, `","status":`...)
+	b = status.AppendJSON(b)
+	b = append(b, "}\n"...)
+	*buf = b
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+	w.Write(b)
+	statusBuffers.Put(buf)
+}
+
+// writeDecisions writes the statuses of a check of several resources as
+// the body of a v2 JSON response with code
+func writeDecisions(w http.ResponseWriter, code int, result *queries.MultiRateLimitStatus) {
+	decision := DecisionAllow
+	if !result.IsAllowed {
+		decision = DecisionDeny
+		if len(result.Statuses) > 0 {
+			decision = decisionOf(result.Statuses[0])
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Decision       Decision                   `json:"decision"`
+		DeniedResource string                     `json:"denied_resource,omitempty"`
+		Statuses       []*queries.RateLimitStatus `json:"statuses"`
+	}{decision, result.DeniedResource, result.Statuses})
+}
+
+// page is a page of a list as v2 answers it. The page after it is got by
+// passing NextCursor as the cursor parameter.
+type page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"` // Empty on the last page
+}
@@ -0,0 +1,317 @@
+// Package challenge issues and verifies the challenges of challenge rule
+// actions. Rather than being denied, a client matched by a challenge rule
+// is asked to prove it is a person, by solving a JavaScript proof of work or
+// a captcha; clients that do are exempt from challenges for a while.
+package challenge
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// Challenge kinds
+const (
+	KindJS      = "js"      // A proof of work solved by JavaScript in the browser
+	KindCaptcha = "captcha" // A captcha on a page the client is redirected to
+)
+
+var (
+	// ErrInvalidToken is returned for a token this service did not issue
+	ErrInvalidToken = errors.New("invalid challenge token")
+	// ErrExpired is returned for a token past its expiry
+	ErrExpired = errors.New("challenge expired")
+	// ErrUnsolved is returned for a wrong solution
+	ErrUnsolved = errors.New("challenge not solved")
+)
+
+// maxPasses is the number of passes held before expired ones are dropped
+const maxPasses = 100000
+
+// Config holds the settings of challenges
+type Config struct {
+	Secret           []byte        // Signs tokens; tokens of other secrets are rejected
+	Kind             string        // Kind of challenge actions that name none
+	TTL              time.Duration // How long a challenge may be solved
+	PassTTL          time.Duration // How long a solved challenge exempts the client
+	Difficulty       int           // Leading zero bits of a JS proof of work's hash
+	CaptchaURL       string        // Page showing the captcha, given the token as ?challenge=
+	CaptchaVerifyURL string        // siteverify endpoint of the captcha provider
+	CaptchaSecret    string        // Secret key at the captcha provider
+}
+
+// Challenge is what a challenged client must solve
+type Challenge struct {
+	Kind       string    `json:"kind"`
+	Token      string    `json:"token"`
+	Difficulty int       `json:"difficulty,omitempty"` // JS challenges
+	URL        string    `json:"url,omitempty"`        // Captcha challenges: where to send the client
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Solution is a client's answer to a challenge
+type Solution struct {
+	Token    string `json:"token"`
+	Nonce    string `json:"nonce,omitempty"`    // JS challenges: makes sha256(token + nonce) start with difficulty zero bits
+	Response string `json:"response,omitempty"` // Captcha challenges: the captcha widget's response
+}
+
+// Pass exempts a client from challenges until a time
+type Pass struct {
+	ClientID string    `json:"client_id"`
+	Until    time.Time `json:"until"`
+}
+
+// tokenClaims are the signed contents of a token
+type tokenClaims struct {
+	ClientID   string `json:"c"`
+	Kind       string `json:"k"`
+	Difficulty int    `json:"d,omitempty"`
+	ExpiresAt  int64  `json:"e"`
+	Nonce      string `json:"n"` // Makes every token unique
+}
+
+// Service issues challenges and remembers the clients that solved one
+type Service struct {
+	config     Config
+	httpClient *http.Client
+	clock      domain.Clock
+
+	mutex  sync.Mutex
+	passes map[string]time.Time
+}
+
+// NewService creates a challenge service. Without a secret it signs with a
+// random one, so its tokens are only valid on this instance until restart.
+func NewService(config Config) *Service {
+	if len(config.Secret) == 0 {
+		config.Secret = make([]byte, 32)
+		rand.Read(config.Secret)
+	}
+	if config.Kind == "" {
+		config.Kind = KindJS
+	}
+	return &Service{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		clock:      domain.SystemClock{},
+		passes:     make(map[string]time.Time),
+	}
+}
+
+// WithClock sets the clock challenges and passes expire by
+func (s *Service) WithClock(clock domain.Clock) *Service {
+	s.clock = clock
+	return s
+}
+
+// WithHTTPClient sets the client captcha responses are verified with
+func (s *Service) WithHTTPClient(httpClient *http.Client) *Service {
+	s.httpClient = httpClient
+	return s
+}
+
+// Issue creates a challenge for a client. An empty kind is the configured
+// default, and captchas fall back to JS challenges when no captcha is
+// configured.
+func (s *Service) Issue(clientID, kind string) *Challenge {
+	if kind == "" {
+		kind = s.config.Kind
+	}
+	if kind == KindCaptcha && (s.config.CaptchaURL == "" || s.config.CaptchaVerifyURL == "") {
+		kind = KindJS
+	}
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	claims := tokenClaims{
+		ClientID:  clientID,
+		Kind:      kind,
+		ExpiresAt: s.clock.Now().Add(s.config.TTL).Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	if kind == KindJS {
+		claims.Difficulty = s.config.Difficulty
+	}
+
+	challenge := &Challenge{
+		Kind:       kind,
+		Token:      s.sign(claims),
+		Difficulty: claims.Difficulty,
+		ExpiresAt:  time.Unix(claims.ExpiresAt, 0).UTC(),
+	}
+	if kind == KindCaptcha {
+		challenge.URL = withQuery(s.config.CaptchaURL, "challenge", challenge.Token)
+	}
+	return challenge
+}
+
+// Passed reports whether a client solved a challenge recently enough to be
+// exempt from challenges
+func (s *Service) Passed(clientID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	until, ok := s.passes[clientID]
+	return ok && s.clock.Now().Before(until)
+}
+
+// Verify checks a solution, and exempts the client the challenge was issued
+// to from challenges for the pass ttl. remoteIP is passed on to the captcha
+// provider.
+func (s *Service) Verify(ctx context.Context, solution Solution, remoteIP string) (*Pass, error) {
+	claims, err := s.parse(solution.Token)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+
+	switch claims.Kind {
+	case KindJS:
+		if len(solution.Nonce) > 64 || leadingZeroBits(sha256.Sum256([]byte(solution.Token+solution.Nonce))) < claims.Difficulty {
+			return nil, ErrUnsolved
+		}
+	case KindCaptcha:
+		if err := s.verifyCaptcha(ctx, solution.Response, remoteIP); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	pass := &Pass{ClientID: claims.ClientID, Until: now.Add(s.config.PassTTL)}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.passes) >= maxPasses {
+		for clientID, until := range s.passes {
+			if !now.Before(until) {
+				delete(s.passes, clientID)
+			}
+		}
+	}
+	s.passes[pass.ClientID] = pass.Until
+	return pass, nil
+}
+
+// verifyCaptcha asks the captcha provider whether a response is genuine,
+// using the siteverify protocol reCAPTCHA, hCaptcha and Turnstile share
+func (s *Service) verifyCaptcha(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return ErrUnsolved
+	}
+
+	form := url.Values{"secret": {s.config.CaptchaSecret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.CaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("verify captcha: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("verify captcha: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("verify captcha: %s returned %s", s.config.CaptchaVerifyURL, resp.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("verify captcha: %w", err)
+	}
+	if !result.Success {
+		return ErrUnsolved
+	}
+	return nil
+}
+
+// sign encodes claims as a token: base64 JSON, a dot and its base64 HMAC
+func (s *Service) sign(claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded))
+}
+
+// parse checks a token's signature and decodes its claims
+func (s *Service) parse(token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return claims, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.NewDecoder(bytes.NewReader(payload)).Decode(&claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// mac returns the HMAC-SHA256 of a token's encoded claims
+func (s *Service) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, s.config.Secret)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
+
+// leadingZeroBits counts the zero bits a hash starts with
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// withQuery adds a query parameter to a URL
+func withQuery(rawURL, name, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,179 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver determines the real client IP of a request, honouring forwarding
+// headers only when the immediate peer is a trusted proxy
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a resolver trusting the given IPs or CIDR ranges
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// IsTrusted reports whether ip belongs to a trusted proxy
+func (r *Resolver) IsTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromTrustedProxy reports whether the immediate peer of req is a trusted
+// proxy
+func (r *Resolver) FromTrustedProxy(req *http.Request) bool {
+	return r.IsTrusted(net.ParseIP(peerHost(req.RemoteAddr)))
+}
+
+// Resolve returns the client IP for the request. Forwarding headers are
+// consulted in order Forwarded, X-Forwarded-For, X-Real-IP, walking proxy
+// chains from the right and stopping at the first untrusted hop.
+func (r *Resolver) Resolve(req *http.Request) string {
+	peer := peerHost(req.RemoteAddr)
+	if !r.IsTrusted(net.ParseIP(peer)) {
+		return peer
+	}
+
+	if hops := parseForwarded(req.Header.Values("Forwarded")); len(hops) > 0 {
+		return r.rightmostUntrusted(hops, peer)
+	}
+
+	if hops := parseXForwardedFor(req.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return r.rightmostUntrusted(hops, peer)
+	}
+
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
+}
+
+// rightmostUntrusted walks hops from the nearest proxy outwards and returns
+// the first address that is not a trusted proxy
+func (r *Resolver) rightmostUntrusted(hops []string, peer string) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Garbage in the chain; nothing left of it can be trusted
+			return peer
+		}
+		if !r.IsTrusted(ip) || i == 0 {
+			return hops[i]
+		}
+	}
+	return peer
+}
+
+// parseXForwardedFor splits X-Forwarded-For headers into hop addresses
+func parseXForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				hops = append(hops, hostOnly(part))
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwarded extracts the for= parameters of RFC 7239 Forwarded headers
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				hops = append(hops, hostOnly(val))
+			}
+		}
+	}
+	return hops
+}
+
+// unixPeer is the address of peers connected over a Unix socket, which are
+// on this host; trusting it trusts the forwarding headers they send
+const unixPeer = "127.0.0.1"
+
+// peerHost returns the host of the address of a request's immediate peer.
+// Peers on a Unix socket have no address of their own ("@" or empty) and
+// are given unixPeer.
+func peerHost(remoteAddr string) string {
+	if remoteAddr == "" || remoteAddr == "@" {
+		return unixPeer
+	}
+	return hostOnly(remoteAddr)
+}
+
+// hostOnly strips the port and IPv6 brackets from an address
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+type contextKey struct{}
+
+// Middleware resolves the client IP once per request and stores it in the
+// request context for handlers and other middleware
+func Middleware(resolver *Resolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolver.Resolve(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, ip)))
+	})
+}
+
+// FromRequest returns the IP stored by Middleware, falling back to the peer
+// address when the request did not pass through it
+func FromRequest(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKey{}).(string); ok {
+		return ip
+	}
+	return peerHost(r.RemoteAddr)
+}
@@ -0,0 +1,170 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature prefixes every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener decodes HAProxy PROXY protocol (v1 and v2) headers
+// sent by trusted load balancers, so RemoteAddr reports the original client
+type ProxyProtocolListener struct {
+	net.Listener
+	resolver      *Resolver
+	headerTimeout time.Duration
+}
+
+// NewProxyProtocolListener wraps inner. Headers are only honoured when the
+// connecting peer is trusted by resolver.
+func NewProxyProtocolListener(inner net.Listener, resolver *Resolver) *ProxyProtocolListener {
+	return &ProxyProtocolListener{
+		Listener:      inner,
+		resolver:      resolver,
+		headerTimeout: 5 * time.Second,
+	}
+}
+
+// Accept waits for the next connection. The PROXY header is parsed lazily on
+// first use so that a slow peer cannot stall the accept loop.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if peer == nil || !l.resolver.IsTrusted(peer.IP) {
+		return conn, nil
+	}
+
+	return &proxyConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// proxyConn is a connection whose first bytes may carry a PROXY header
+type proxyConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	remoteAddr    net.Addr
+	err           error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader consumes a PROXY header if one is present
+func (c *proxyConn) readHeader() {
+	if c.headerTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	peek, err := c.reader.Peek(len(proxyV2Signature))
+	if err != nil && len(peek) == 0 {
+		c.err = err
+		return
+	}
+
+	switch {
+	case bytes.HasPrefix(peek, proxyV2Signature):
+		c.remoteAddr, c.err = readProxyV2(c.reader)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		c.remoteAddr, c.err = readProxyV1(c.reader)
+	}
+}
+
+// readProxyV1 parses a text header such as
+// "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY v1 header: %w", err)
+	}
+	if len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses a binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	if versionCommand&0x0F == 0 {
+		// LOCAL command: health check from the proxy itself
+		return nil, nil
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
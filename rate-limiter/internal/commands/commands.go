@@ -2,6 +2,8 @@ package commands
 
 import (
 	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
 )
 
 // Command represents a command in the CQRS pattern
@@ -37,28 +39,95 @@ type ApplyRateLimitCommand struct {
 	BaseCommand
 	ClientID     string    `json:"client_id"`
 	Resource     string    `json:"resource"`
+	Method       string    `json:"method,omitempty"` // Selects a method-specific rule
 	RequestedAt  time.Time `json:"requested_at"`
 	IPAddress    string    `json:"ip_address"`
 	UserAgent    string    `json:"user_agent"`
+	DryRun       bool      `json:"dry_run,omitempty"` // Decide without counting the request or storing the decision
+	
+	// Result is set by the handler to the event recording the decision
+	Result domain.Event `json:"-"`
+	
+	// Windows is set by the handler for rules with extra windows to the
+	// decision of each window, the rule's own first, up to the first that
+	// denied the request. Result is then that denial.
+	Windows []WindowDecision `json:"-"`
+	
+	// Unenforced is set by the handler to why no rule decided the request
+	// when every rule that could is gated by a feature flag that is off for
+	// the client. The request is then allowed without being counted, and
+	// Result is nil.
+	Unenforced string `json:"-"`
+}
+
+// WindowDecision is the decision of one window of a rule with several
+type WindowDecision struct {
+	Limit domain.WindowLimit
+	Event domain.Event
+}
+
+// ApplyRateLimitsCommand - Command for applying the rate limits of several
+// resources to one request, counting it against every resource or none
+type ApplyRateLimitsCommand struct {
+	BaseCommand
+	// Checks are applied in order, up to the first denied one. The handler
+	// sets the Result of each applied check.
+	Checks []*ApplyRateLimitCommand `json:"checks"`
 }
 
 // CreateRuleCommand - Command for creating rate limit rules
 type CreateRuleCommand struct {
 	BaseCommand
-	Resource  string        `json:"resource"`
-	Limit     int           `json:"limit"`
-	Window    time.Duration `json:"window"`
-	Algorithm string        `json:"algorithm"`
+	Resource      string        `json:"resource"`
+	Method        string        `json:"method,omitempty"`
+	Limit         int           `json:"limit"`
+	Window        time.Duration `json:"window"`
+	Algorithm     string        `json:"algorithm"`
+	KeyTemplate   string        `json:"key_template,omitempty"`
+	SoftThreshold float64       `json:"soft_threshold,omitempty"`
+	
+	// Settings of the algorithm beyond limit and window, which may set
+	// them instead, e.g. the bucket size and refill rate of a token bucket
+	Parameters *domain.AlgorithmParameters `json:"parameters,omitempty"`
+	
+	// Further limits over other windows, e.g. 1000 per hour on top of 10
+	// per second
+	Windows []domain.WindowLimit `json:"windows,omitempty"`
+	
+	// Feature flag gating the rule, e.g. "enforce-strict-login-limits"
+	Flag string `json:"flag,omitempty"`
+	
+	// Description, owner and change reference of the rule; the principal
+	// making the change is taken from the context
+	Annotations domain.RuleAnnotations `json:"annotations"`
 }
 
 // UpdateRuleCommand - Command for updating rate limit rules
 type UpdateRuleCommand struct {
 	BaseCommand
-	RuleID    string        `json:"rule_id"`
-	Resource  string        `json:"resource"`
-	Limit     int           `json:"limit"`
-	Window    time.Duration `json:"window"`
-	Algorithm string        `json:"algorithm"`
+	RuleID        string        `json:"rule_id"`
+	Resource      string        `json:"resource"`
+	Method        string        `json:"method,omitempty"`
+	Limit         int           `json:"limit"`
+	Window        time.Duration `json:"window"`
+	Algorithm     string        `json:"algorithm"`
+	KeyTemplate   string        `json:"key_template,omitempty"`
+	SoftThreshold float64       `json:"soft_threshold,omitempty"`
+	
+	// Settings of the algorithm beyond limit and window, which may set
+	// them instead, e.g. the bucket size and refill rate of a token bucket
+	Parameters *domain.AlgorithmParameters `json:"parameters,omitempty"`
+	
+	// Further limits over other windows, e.g. 1000 per hour on top of 10
+	// per second
+	Windows []domain.WindowLimit `json:"windows,omitempty"`
+	
+	// Feature flag gating the rule, e.g. "enforce-strict-login-limits"
+	Flag string `json:"flag,omitempty"`
+	
+	// Description, owner and change reference of the rule; the principal
+	// making the change is taken from the context
+	Annotations domain.RuleAnnotations `json:"annotations"`
 }
 
 // ResetRateLimitCommand - Command for resetting rate limits
@@ -67,3 +136,198 @@ type ResetRateLimitCommand struct {
 	ClientID string `json:"client_id"`
 	Resource string `json:"resource"`
 }
+
+// RefundRateLimitCommand - Command for giving back the quota of a request
+// whose protected operation failed before doing real work
+type RefundRateLimitCommand struct {
+	BaseCommand
+	ClientID string `json:"client_id"`
+	Resource string `json:"resource"`
+	Method   string `json:"method,omitempty"` // Selects a method-specific rule
+	Reason   string `json:"reason,omitempty"`
+	
+	// Result is set by the handler to the event recording the refund
+	Result *domain.RateLimitRefundedEvent `json:"-"`
+}
+
+// CreateOverrideCommand - Command for granting a client a temporary limit
+type CreateOverrideCommand struct {
+	BaseCommand
+	ClientID  string        `json:"client_id"`
+	Resource  string        `json:"resource"`
+	Method    string        `json:"method,omitempty"`
+	Limit     int           `json:"limit"`
+	Window    time.Duration `json:"window,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	
+	// Result is set by the handler to the created override
+	Result *domain.RateLimitOverride `json:"-"`
+}
+
+// DeleteOverrideCommand - Command for revoking an override before it expires
+type DeleteOverrideCommand struct {
+	BaseCommand
+	OverrideID string `json:"override_id"`
+}
+
+// CreateFreezeCommand - Command for scheduling a freeze of one resource or
+// every resource
+type CreateFreezeCommand struct {
+	BaseCommand
+	Resource string    `json:"resource,omitempty"`
+	Mode     string    `json:"mode"`
+	Reason   string    `json:"reason,omitempty"`
+	StartsAt time.Time `json:"starts_at,omitempty"`
+	EndsAt   time.Time `json:"ends_at,omitempty"`
+	
+	// Result is set by the handler to the created freeze
+	Result *domain.Freeze `json:"-"`
+}
+
+// LiftFreezeCommand - Command for ending or cancelling a freeze
+type LiftFreezeCommand struct {
+	BaseCommand
+	FreezeID string `json:"freeze_id"`
+}
+
+// StartRolloutCommand - Command for rolling out a change of a rule's limit,
+// window, algorithm or soft threshold to a growing percentage of clients.
+// Unset fields keep the rule's settings or use the rollout defaults.
+type StartRolloutCommand struct {
+	BaseCommand
+	RuleID           string        `json:"rule_id"`
+	Limit            int           `json:"limit,omitempty"`
+	Window           time.Duration `json:"window,omitempty"`
+	Algorithm        string        `json:"algorithm,omitempty"`
+	SoftThreshold    *float64      `json:"soft_threshold,omitempty"`
+	Stages           []int         `json:"stages,omitempty"`
+	StageDuration    time.Duration `json:"stage_duration,omitempty"`
+	MaxDenyRateDelta float64       `json:"max_deny_rate_delta,omitempty"`
+	MinRequests      int64         `json:"min_requests,omitempty"`
+	
+	// Result is set by the handler to the started rollout
+	Result *domain.RuleRollout `json:"-"`
+}
+
+// PromoteRolloutCommand - Command for replacing a rule with the candidate of
+// its rollout, skipping any remaining stages
+type PromoteRolloutCommand struct {
+	BaseCommand
+	RolloutID string `json:"rollout_id"`
+	Reason    string `json:"reason,omitempty"`
+	
+	// Result is set by the handler to the promoted rollout
+	Result *domain.RuleRollout `json:"-"`
+}
+
+// RollBackRolloutCommand - Command for ending a rollout, keeping the rule
+type RollBackRolloutCommand struct {
+	BaseCommand
+	RolloutID string `json:"rollout_id"`
+	Reason    string `json:"reason,omitempty"`
+	
+	// Result is set by the handler to the rolled back rollout
+	Result *domain.RuleRollout `json:"-"`
+}
+
+// EvaluateRolloutsCommand - Command for advancing, promoting or rolling back
+// the running rollouts by the deny rates of their cohorts
+type EvaluateRolloutsCommand struct {
+	BaseCommand
+	
+	// Result is set by the handler to the rollouts that advanced or ended
+	Result []domain.RuleRollout `json:"-"`
+}
+
+// GrantLeaseCommand - Command for leasing a client tokens of its quota to
+// spend locally until the lease expires
+type GrantLeaseCommand struct {
+	BaseCommand
+	ClientID string        `json:"client_id"`
+	Resource string        `json:"resource"`
+	Method   string        `json:"method,omitempty"` // Selects a method-specific rule
+	Tokens   int           `json:"tokens"`
+	TTL      time.Duration `json:"ttl"`
+	
+	// Result is set by the handler to the lease, or left nil when no tokens
+	// are left to lease; Event to the event recording the decision
+	Result *domain.Lease `json:"-"`
+	Event  domain.Event  `json:"-"`
+}
+
+// RenewLeaseCommand - Command for reporting the tokens of a lease used and
+// leasing the next term's tokens, or releasing the lease when Tokens is zero
+type RenewLeaseCommand struct {
+	BaseCommand
+	LeaseID string `json:"lease_id"`
+	Used    int    `json:"used"`
+	Tokens  int    `json:"tokens"`
+	
+	// Result is set by the handler to the renewed lease, or left nil when it
+	// was released or no tokens are left to lease; Event to the event
+	// recording the last decision
+	Result *domain.Lease `json:"-"`
+	Event  domain.Event  `json:"-"`
+}
+
+// ExpireLeasesCommand - Command for expiring the leases that were neither
+// renewed nor released in time
+type ExpireLeasesCommand struct {
+	BaseCommand
+	
+	// Result is set by the handler to the leases expired
+	Result []domain.Lease `json:"-"`
+}
+
+// RegisterClientCommand - Command for registering a client
+type RegisterClientCommand struct {
+	BaseCommand
+	ClientID string   `json:"client_id"`
+	Name     string   `json:"name,omitempty"`
+	Tier     string   `json:"tier,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Contact  string   `json:"contact,omitempty"`
+	
+	// Result is set by the handler to the registered client
+	Result *domain.Client `json:"-"`
+}
+
+// UpdateClientCommand - Command for replacing a client's metadata
+type UpdateClientCommand struct {
+	BaseCommand
+	ClientID string   `json:"client_id"`
+	Name     string   `json:"name,omitempty"`
+	Tier     string   `json:"tier,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Contact  string   `json:"contact,omitempty"`
+	
+	// Result is set by the handler to the updated client
+	Result *domain.Client `json:"-"`
+}
+
+// SetClientDisabledCommand - Command for disabling or re-enabling a client
+type SetClientDisabledCommand struct {
+	BaseCommand
+	ClientID string `json:"client_id"`
+	Disabled bool   `json:"disabled"`
+	
+	// Result is set by the handler to the updated client
+	Result *domain.Client `json:"-"`
+}
+
+// DeleteClientCommand - Command for removing a client from the registry
+type DeleteClientCommand struct {
+	BaseCommand
+	ClientID string `json:"client_id"`
+}
+
+// EraseClientDataCommand - Command for erasing a client's events, history,
+// statistics and overrides, e.g. for a right to erasure request
+type EraseClientDataCommand struct {
+	BaseCommand
+	ClientID string `json:"client_id"`
+	
+	// Result is set by the handler to the tombstone recording the erasure
+	Result *domain.ClientDataErasedEvent `json:"-"`
+}
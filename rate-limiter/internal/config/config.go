@@ -0,0 +1,1692 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerConfig holds the HTTP server settings shared by both binaries
+type ServerConfig struct {
+	Addr              string        `json:"addr"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	RequestTimeout    time.Duration `json:"request_timeout"` // Deadline applied to each request context
+	MaxBodyBytes      int64         `json:"max_body_bytes"`  // Upper bound for JSON request bodies
+	TrustedProxies    []string      `json:"trusted_proxies"` // IPs/CIDRs allowed to set forwarding headers
+	ProxyProtocol     bool          `json:"proxy_protocol"`  // Accept HAProxy PROXY headers from trusted proxies
+	KeepAlives        bool          `json:"keep_alives"`     // Reuse connections for several requests
+	TCPKeepAlive      time.Duration `json:"tcp_keep_alive"`  // Period of TCP keep-alive probes on accepted connections
+	SocketMode        os.FileMode   `json:"socket_mode"`     // Permissions of a Unix socket listened on
+
+	// Header in which trusted proxies name the authenticated caller, whom
+	// rule changes are attributed to; ignored when empty
+	PrincipalHeader string `json:"principal_header"`
+
+	// HTTP/2 without TLS (h2c), for internal callers that multiplex checks
+	// over a few connections
+	H2C                  bool   `json:"h2c"`
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams"` // Per HTTP/2 connection
+}
+
+// DefaultServerConfig returns conservative defaults listening on addr
+func DefaultServerConfig(addr string) ServerConfig {
+	return ServerConfig{
+		Addr:              addr,
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		RequestTimeout:    5 * time.Second,
+		MaxBodyBytes:      1 << 20, // 1 MiB
+		KeepAlives:        true,
+		TCPKeepAlive:      15 * time.Second,
+		SocketMode:        0o660,
+
+		MaxConcurrentStreams: 250,
+	}
+}
+
+// LoadServerConfig builds a ServerConfig from environment variables,
+// falling back to DefaultServerConfig(defaultAddr) for anything unset
+func LoadServerConfig(defaultAddr string) (ServerConfig, error) {
+	cfg := DefaultServerConfig(defaultAddr)
+
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+	if err := listenAddrFromEnv("HTTP_LISTEN", &cfg.Addr); err != nil {
+		return cfg, err
+	}
+	if err := socketModeFromEnv(&cfg.SocketMode); err != nil {
+		return cfg, err
+	}
+
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", &cfg.ReadTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", &cfg.ReadHeaderTimeout},
+		{"HTTP_WRITE_TIMEOUT", &cfg.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", &cfg.IdleTimeout},
+		{"HTTP_REQUEST_TIMEOUT", &cfg.RequestTimeout},
+		{"HTTP_TCP_KEEPALIVE", &cfg.TCPKeepAlive},
+	}
+	for _, d := range durations {
+		if err := durationFromEnv(d.env, d.dst); err != nil {
+			return cfg, err
+		}
+	}
+
+	if raw := os.Getenv("HTTP_MAX_BODY_BYTES"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid HTTP_MAX_BODY_BYTES %q", raw)
+		}
+		cfg.MaxBodyBytes = n
+	}
+
+	if raw := os.Getenv("TRUSTED_PROXIES"); raw != "" {
+		cfg.TrustedProxies = strings.Split(raw, ",")
+	}
+
+	cfg.PrincipalHeader = os.Getenv("PRINCIPAL_HEADER")
+
+	if raw := os.Getenv("PROXY_PROTOCOL"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PROXY_PROTOCOL %q", raw)
+		}
+		cfg.ProxyProtocol = enabled
+	}
+
+	if raw := os.Getenv("HTTP_KEEPALIVES"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid HTTP_KEEPALIVES %q", raw)
+		}
+		cfg.KeepAlives = enabled
+	}
+
+	if raw := os.Getenv("HTTP_H2C"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid HTTP_H2C %q", raw)
+		}
+		cfg.H2C = enabled
+	}
+
+	if raw := os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil || n == 0 {
+			return cfg, fmt.Errorf("invalid HTTP2_MAX_CONCURRENT_STREAMS %q", raw)
+		}
+		cfg.MaxConcurrentStreams = uint32(n)
+	}
+
+	return cfg, nil
+}
+
+// AdminServerConfig holds the settings of the optional admin listener,
+// which serves the admin and query endpoints apart from the checks so that
+// it can be firewalled off from the data plane
+type AdminServerConfig struct {
+	ServerConfig        // Addr is empty when every endpoint is served on one listener
+	Token        string `json:"-"` // Bearer token required by the admin listener; none when empty
+}
+
+// LoadAdminServerConfig builds an AdminServerConfig from environment
+// variables. The admin listener is enabled by ADMIN_PORT or ADMIN_LISTEN and
+// shares the settings of the data listener, server, except for the timeouts
+// set by ADMIN_HTTP_* variables.
+func LoadAdminServerConfig(server ServerConfig) (AdminServerConfig, error) {
+	cfg := AdminServerConfig{
+		ServerConfig: server,
+		Token:        os.Getenv("ADMIN_TOKEN"),
+	}
+	cfg.Addr = ""
+
+	if port := os.Getenv("ADMIN_PORT"); port != "" {
+		cfg.Addr = ":" + port
+		if cfg.Addr == server.Addr {
+			return cfg, fmt.Errorf("ADMIN_PORT %q is the port of the data listener", port)
+		}
+	}
+	if err := listenAddrFromEnv("ADMIN_LISTEN", &cfg.Addr); err != nil {
+		return cfg, err
+	}
+	if cfg.Addr != "" && cfg.Addr == server.Addr {
+		return cfg, fmt.Errorf("ADMIN_LISTEN %q is the address of the data listener", cfg.Addr)
+	}
+
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"ADMIN_HTTP_READ_TIMEOUT", &cfg.ReadTimeout},
+		{"ADMIN_HTTP_WRITE_TIMEOUT", &cfg.WriteTimeout},
+		{"ADMIN_HTTP_IDLE_TIMEOUT", &cfg.IdleTimeout},
+		{"ADMIN_HTTP_REQUEST_TIMEOUT", &cfg.RequestTimeout},
+	}
+	for _, d := range durations {
+		if err := durationFromEnv(d.env, d.dst); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.Token != "" && cfg.Addr == "" {
+		return cfg, fmt.Errorf("ADMIN_TOKEN requires ADMIN_PORT or ADMIN_LISTEN")
+	}
+
+	return cfg, nil
+}
+
+// listenAddrFromEnv sets dst to the listen address in env when the variable
+// is set: a TCP host:port, "unix:" followed by a socket path, or "systemd"
+// or "systemd:name" for a socket passed by systemd socket activation
+func listenAddrFromEnv(env string, dst *string) error {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(raw, "unix:"):
+		if strings.TrimPrefix(raw, "unix:") == "" {
+			return fmt.Errorf("invalid %s %q: no socket path", env, raw)
+		}
+	case raw == "systemd" || strings.HasPrefix(raw, "systemd:"):
+	default:
+		if _, _, err := net.SplitHostPort(raw); err != nil {
+			return fmt.Errorf("invalid %s %q", env, raw)
+		}
+	}
+
+	*dst = raw
+	return nil
+}
+
+// socketModeFromEnv parses the octal UNIX_SOCKET_MODE into dst when the
+// variable is set
+func socketModeFromEnv(dst *os.FileMode) error {
+	raw := os.Getenv("UNIX_SOCKET_MODE")
+	if raw == "" {
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("invalid UNIX_SOCKET_MODE %q", raw)
+	}
+
+	*dst = os.FileMode(mode)
+	return nil
+}
+
+// durationFromEnv parses env into dst when the variable is set
+func durationFromEnv(env string, dst *time.Duration) error {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid %s %q", env, raw)
+	}
+
+	*dst = d
+	return nil
+}
+
+// AccessLogConfig holds the access log settings
+type AccessLogConfig struct {
+	SampleRate float64 `json:"sample_rate"` // Fraction of allowed requests that are logged
+}
+
+// LoadAccessLogConfig builds an AccessLogConfig from environment variables
+func LoadAccessLogConfig() (AccessLogConfig, error) {
+	cfg := AccessLogConfig{SampleRate: 1}
+
+	if raw := os.Getenv("ACCESS_LOG_SAMPLE_RATE"); raw != "" {
+		rate, err := strconv.ParseFloat(raw, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return cfg, fmt.Errorf("invalid ACCESS_LOG_SAMPLE_RATE %q", raw)
+		}
+		cfg.SampleRate = rate
+	}
+
+	return cfg, nil
+}
+
+// CounterConfig selects the shared counter backend used by the fixed window
+// and sliding window counter algorithms
+type CounterConfig struct {
+	Backend          string   `json:"backend"` // "", "memory" or "memcached"
+	MemcachedServers []string `json:"memcached_servers"`
+}
+
+// LoadCounterConfig builds a CounterConfig from environment variables
+func LoadCounterConfig() (CounterConfig, error) {
+	cfg := CounterConfig{Backend: os.Getenv("COUNTER_BACKEND")}
+
+	switch cfg.Backend {
+	case "", "memory":
+	case "memcached":
+		raw := os.Getenv("MEMCACHED_SERVERS")
+		if raw == "" {
+			return cfg, fmt.Errorf("MEMCACHED_SERVERS is required when COUNTER_BACKEND=memcached")
+		}
+		cfg.MemcachedServers = strings.Split(raw, ",")
+	default:
+		return cfg, fmt.Errorf("invalid COUNTER_BACKEND %q", cfg.Backend)
+	}
+
+	return cfg, nil
+}
+
+// AnalyticsConfig holds the settings of the optional ClickHouse analytics sink
+type AnalyticsConfig struct {
+	ClickHouseURL string        `json:"clickhouse_url"` // Empty disables the sink
+	Table         string        `json:"table"`
+	RetentionDays int           `json:"retention_days"`
+	BatchSize     int           `json:"batch_size"`
+	FlushInterval time.Duration `json:"flush_interval"`
+}
+
+// LoadAnalyticsConfig builds an AnalyticsConfig from environment variables
+func LoadAnalyticsConfig() (AnalyticsConfig, error) {
+	cfg := AnalyticsConfig{
+		ClickHouseURL: os.Getenv("CLICKHOUSE_URL"),
+		Table:         "rate_limit_events",
+		RetentionDays: 90,
+		BatchSize:     1000,
+		FlushInterval: 5 * time.Second,
+	}
+
+	if table := os.Getenv("CLICKHOUSE_TABLE"); table != "" {
+		cfg.Table = table
+	}
+
+	ints := []struct {
+		env string
+		dst *int
+	}{
+		{"ANALYTICS_RETENTION_DAYS", &cfg.RetentionDays},
+		{"ANALYTICS_BATCH_SIZE", &cfg.BatchSize},
+	}
+	for _, i := range ints {
+		raw := os.Getenv(i.env)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid %s %q", i.env, raw)
+		}
+		*i.dst = n
+	}
+
+	if err := durationFromEnv("ANALYTICS_FLUSH_INTERVAL", &cfg.FlushInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.FlushInterval <= 0 {
+		return cfg, fmt.Errorf("invalid ANALYTICS_FLUSH_INTERVAL %q", os.Getenv("ANALYTICS_FLUSH_INTERVAL"))
+	}
+
+	return cfg, nil
+}
+
+// RemoteWriteConfig holds the settings of the optional exporter pushing
+// decision counters to a Prometheus remote-write endpoint
+type RemoteWriteConfig struct {
+	URL         string            `json:"url"` // Empty disables the exporter
+	Interval    time.Duration     `json:"interval"`
+	Username    string            `json:"username,omitempty"` // Basic auth, with Password
+	Password    string            `json:"-"`
+	BearerToken string            `json:"-"`
+	Labels      map[string]string `json:"labels"` // Added to every series; instance defaults to the host name
+}
+
+// LoadRemoteWriteConfig builds a RemoteWriteConfig from environment
+// variables. REMOTE_WRITE_LABELS lists extra labels as "name=value" pairs
+// separated by commas.
+func LoadRemoteWriteConfig() (RemoteWriteConfig, error) {
+	cfg := RemoteWriteConfig{
+		URL:         os.Getenv("REMOTE_WRITE_URL"),
+		Interval:    30 * time.Second,
+		Username:    os.Getenv("REMOTE_WRITE_USERNAME"),
+		Password:    os.Getenv("REMOTE_WRITE_PASSWORD"),
+		BearerToken: os.Getenv("REMOTE_WRITE_BEARER_TOKEN"),
+		Labels:      make(map[string]string),
+	}
+
+	if cfg.URL != "" && !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return cfg, fmt.Errorf("invalid REMOTE_WRITE_URL %q", cfg.URL)
+	}
+	if err := durationFromEnv("REMOTE_WRITE_INTERVAL", &cfg.Interval); err != nil {
+		return cfg, err
+	}
+	if cfg.Interval <= 0 {
+		return cfg, fmt.Errorf("invalid REMOTE_WRITE_INTERVAL %q", os.Getenv("REMOTE_WRITE_INTERVAL"))
+	}
+	if cfg.BearerToken != "" && cfg.Username != "" {
+		return cfg, fmt.Errorf("REMOTE_WRITE_BEARER_TOKEN and REMOTE_WRITE_USERNAME are exclusive")
+	}
+
+	if raw := os.Getenv("REMOTE_WRITE_LABELS"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !validLabelName(name) || value == "" {
+				return cfg, fmt.Errorf("invalid REMOTE_WRITE_LABELS entry %q", pair)
+			}
+			cfg.Labels[name] = value
+		}
+	}
+	if _, ok := cfg.Labels["instance"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			cfg.Labels["instance"] = hostname
+		}
+	}
+
+	return cfg, nil
+}
+
+// validLabelName reports whether name is a Prometheus label name that is not
+// reserved for internal use
+func validLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '_' && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ForwardAuthConfig holds the settings of the reverse proxy forward auth endpoint
+type ForwardAuthConfig struct {
+	ClientIDHeader  string `json:"client_id_header"` // Falls back to the session, then the client IP when absent
+	DefaultResource string `json:"default_resource"` // Used when the request has no resource query parameter
+	SessionClients  bool   `json:"session_clients"`  // Identify clients without the client header by their hashed session token
+	SessionCookie   string `json:"session_cookie"`   // Cookie holding the session; empty tries a bearer token, then common session cookies
+}
+
+// LoadForwardAuthConfig builds a ForwardAuthConfig from environment variables
+func LoadForwardAuthConfig() (ForwardAuthConfig, error) {
+	cfg := ForwardAuthConfig{
+		ClientIDHeader:  "X-Client-ID",
+		DefaultResource: "api",
+	}
+
+	if header := os.Getenv("FORWARD_AUTH_CLIENT_HEADER"); header != "" {
+		cfg.ClientIDHeader = header
+	}
+	if resource := os.Getenv("FORWARD_AUTH_RESOURCE"); resource != "" {
+		cfg.DefaultResource = resource
+	}
+	if raw := os.Getenv("FORWARD_AUTH_SESSION_CLIENTS"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid FORWARD_AUTH_SESSION_CLIENTS %q", raw)
+		}
+		cfg.SessionClients = enabled
+	}
+	cfg.SessionCookie = os.Getenv("FORWARD_AUTH_SESSION_COOKIE")
+
+	return cfg, nil
+}
+
+// RuleSyncConfig holds the settings of the Kubernetes rule syncer
+type RuleSyncConfig struct {
+	LimiterURL     string        `json:"limiter_url"`
+	KubeAPIURL     string        `json:"kube_api_url"` // Empty uses the in-cluster service account
+	Namespace      string        `json:"namespace"`    // Empty watches all namespaces
+	ResyncInterval time.Duration `json:"resync_interval"`
+}
+
+// LoadRuleSyncConfig builds a RuleSyncConfig from environment variables
+func LoadRuleSyncConfig() (RuleSyncConfig, error) {
+	cfg := RuleSyncConfig{
+		LimiterURL:     "http://localhost:8081",
+		KubeAPIURL:     os.Getenv("KUBE_API_URL"),
+		Namespace:      os.Getenv("WATCH_NAMESPACE"),
+		ResyncInterval: 5 * time.Minute,
+	}
+
+	if limiterURL := os.Getenv("LIMITER_URL"); limiterURL != "" {
+		cfg.LimiterURL = limiterURL
+	}
+
+	if err := durationFromEnv("RESYNC_INTERVAL", &cfg.ResyncInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.ResyncInterval < time.Second {
+		return cfg, fmt.Errorf("invalid RESYNC_INTERVAL %q", os.Getenv("RESYNC_INTERVAL"))
+	}
+
+	return cfg, nil
+}
+
+// ThrottleConfig holds the settings of throttle rule actions
+type ThrottleConfig struct {
+	MaxDelay    time.Duration `json:"max_delay"`    // Upper bound on any delay a rule asks for
+	InjectDelay bool          `json:"inject_delay"` // Sleep in forward auth before allowing throttled requests
+}
+
+// LoadThrottleConfig builds a ThrottleConfig from environment variables
+func LoadThrottleConfig() (ThrottleConfig, error) {
+	cfg := ThrottleConfig{
+		MaxDelay:    2 * time.Second,
+		InjectDelay: true,
+	}
+
+	if err := durationFromEnv("THROTTLE_MAX_DELAY", &cfg.MaxDelay); err != nil {
+		return cfg, err
+	}
+
+	if raw := os.Getenv("THROTTLE_INJECT_DELAY"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid THROTTLE_INJECT_DELAY %q", raw)
+		}
+		cfg.InjectDelay = enabled
+	}
+
+	return cfg, nil
+}
+
+// AlertConfig holds the settings of rule log and alert actions
+type AlertConfig struct {
+	WebhookURL   string        `json:"webhook_url"` // Empty only logs alerts
+	DedupeWindow time.Duration `json:"dedupe_window"`
+}
+
+// LoadAlertConfig builds an AlertConfig from environment variables
+func LoadAlertConfig() (AlertConfig, error) {
+	cfg := AlertConfig{
+		WebhookURL:   os.Getenv("ALERT_WEBHOOK_URL"),
+		DedupeWindow: 5 * time.Minute,
+	}
+
+	if err := durationFromEnv("ALERT_DEDUPE_WINDOW", &cfg.DedupeWindow); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// OutboxConfig holds the settings of the event outbox and its relay
+type OutboxConfig struct {
+	Enabled       bool          `json:"enabled"` // Publish stored events through the outbox
+	RelayInterval time.Duration `json:"relay_interval"`
+	BatchSize     int           `json:"batch_size"`
+}
+
+// LoadOutboxConfig builds an OutboxConfig from environment variables
+func LoadOutboxConfig() (OutboxConfig, error) {
+	cfg := OutboxConfig{
+		RelayInterval: 50 * time.Millisecond,
+		BatchSize:     500,
+	}
+
+	if raw := os.Getenv("EVENT_OUTBOX"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid EVENT_OUTBOX %q", raw)
+		}
+		cfg.Enabled = enabled
+	}
+
+	if err := durationFromEnv("OUTBOX_RELAY_INTERVAL", &cfg.RelayInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.RelayInterval <= 0 {
+		return cfg, fmt.Errorf("invalid OUTBOX_RELAY_INTERVAL %q", os.Getenv("OUTBOX_RELAY_INTERVAL"))
+	}
+
+	if raw := os.Getenv("OUTBOX_BATCH_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid OUTBOX_BATCH_SIZE %q", raw)
+		}
+		cfg.BatchSize = n
+	}
+
+	return cfg, nil
+}
+
+// WriteBatchConfig holds the settings of batching event saves
+type WriteBatchConfig struct {
+	Enabled       bool          `json:"enabled"`        // Save the events of many decisions in one round trip
+	FlushInterval time.Duration `json:"flush_interval"` // Longest a save waits for its batch
+	MaxBatch      int           `json:"max_batch"`      // Saves that fill a batch, which is then saved at once
+}
+
+// LoadWriteBatchConfig builds a WriteBatchConfig from environment variables
+func LoadWriteBatchConfig() (WriteBatchConfig, error) {
+	cfg := WriteBatchConfig{
+		FlushInterval: 2 * time.Millisecond,
+		MaxBatch:      256,
+	}
+
+	if raw := os.Getenv("EVENT_WRITE_BATCHING"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid EVENT_WRITE_BATCHING %q", raw)
+		}
+		cfg.Enabled = enabled
+	}
+
+	if err := durationFromEnv("EVENT_WRITE_BATCH_INTERVAL", &cfg.FlushInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.FlushInterval <= 0 {
+		return cfg, fmt.Errorf("invalid EVENT_WRITE_BATCH_INTERVAL %q", os.Getenv("EVENT_WRITE_BATCH_INTERVAL"))
+	}
+
+	if raw := os.Getenv("EVENT_WRITE_BATCH_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid EVENT_WRITE_BATCH_SIZE %q", raw)
+		}
+		cfg.MaxBatch = n
+	}
+
+	return cfg, nil
+}
+
+// ProjectionConfig holds the settings of the read model projection
+type ProjectionConfig struct {
+	PollInterval         time.Duration `json:"poll_interval"`      // Fallback when no event notification arrives
+	CatchUpThreshold     uint64        `json:"catch_up_threshold"` // Pending events that switch to bulk catch-up
+	CatchUpBatchSize     int           `json:"catch_up_batch_size"`
+	MaxReadyLag          time.Duration `json:"max_ready_lag"`          // Lag beyond which /readyz fails
+	CacheTTL             time.Duration `json:"cache_ttl"`              // Status and stats query caching; disabled when zero
+	UnknownEvents        string        `json:"unknown_events"`         // "skip" or "fail" for events the read model does not know
+	StatsRetention       time.Duration `json:"stats_retention"`        // Client stats kept by the minute before they are rolled up by the hour
+	HourlyStatsRetention time.Duration `json:"hourly_stats_retention"` // Client stats kept by the hour before they are rolled up by the day
+	DailyStatsRetention  time.Duration `json:"daily_stats_retention"`  // Client stats kept by the day before they are dropped
+	StatsRollupInterval  time.Duration `json:"stats_rollup_interval"`
+}
+
+// LoadProjectionConfig builds a ProjectionConfig from environment variables
+func LoadProjectionConfig() (ProjectionConfig, error) {
+	cfg := ProjectionConfig{
+		PollInterval:         time.Second,
+		CatchUpThreshold:     100,
+		CatchUpBatchSize:     1000,
+		MaxReadyLag:          5 * time.Second,
+		CacheTTL:             time.Second,
+		UnknownEvents:        "skip",
+		StatsRetention:       24 * time.Hour,
+		HourlyStatsRetention: 30 * 24 * time.Hour,
+		DailyStatsRetention:  365 * 24 * time.Hour,
+		StatsRollupInterval:  time.Minute,
+	}
+
+	if err := durationFromEnv("PROJECTION_POLL_INTERVAL", &cfg.PollInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.PollInterval <= 0 {
+		return cfg, fmt.Errorf("invalid PROJECTION_POLL_INTERVAL %q", os.Getenv("PROJECTION_POLL_INTERVAL"))
+	}
+	if err := durationFromEnv("READYZ_MAX_PROJECTION_LAG", &cfg.MaxReadyLag); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READ_MODEL_CACHE_TTL", &cfg.CacheTTL); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READ_MODEL_STATS_RETENTION", &cfg.StatsRetention); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READ_MODEL_HOURLY_STATS_RETENTION", &cfg.HourlyStatsRetention); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READ_MODEL_DAILY_STATS_RETENTION", &cfg.DailyStatsRetention); err != nil {
+		return cfg, err
+	}
+	if err := durationFromEnv("READ_MODEL_STATS_ROLLUP_INTERVAL", &cfg.StatsRollupInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.StatsRollupInterval <= 0 {
+		return cfg, fmt.Errorf("invalid READ_MODEL_STATS_ROLLUP_INTERVAL %q", os.Getenv("READ_MODEL_STATS_ROLLUP_INTERVAL"))
+	}
+
+	if raw := os.Getenv("PROJECTION_CATCH_UP_THRESHOLD"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PROJECTION_CATCH_UP_THRESHOLD %q", raw)
+		}
+		cfg.CatchUpThreshold = n
+	}
+	if raw := os.Getenv("PROJECTION_CATCH_UP_BATCH_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid PROJECTION_CATCH_UP_BATCH_SIZE %q", raw)
+		}
+		cfg.CatchUpBatchSize = n
+	}
+
+	if raw := os.Getenv("READ_MODEL_UNKNOWN_EVENTS"); raw != "" {
+		switch raw {
+		case "skip", "fail":
+			cfg.UnknownEvents = raw
+		default:
+			return cfg, fmt.Errorf("invalid READ_MODEL_UNKNOWN_EVENTS %q", raw)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ReadReplicaConfig holds the replicas of the read model and the staleness
+// each type of query accepts from them
+type ReadReplicaConfig struct {
+	Replicas     int                      `json:"replicas"`      // Replicas tailing the event store; disabled when zero
+	PollInterval time.Duration            `json:"poll_interval"` // How often replicas read new events
+	LagInterval  time.Duration            `json:"lag_interval"`  // How often the lag of replicas is measured
+	MaxStaleness map[string]time.Duration `json:"max_staleness"` // By query type; types not listed are answered by the primary
+}
+
+// replicaQueries are the types of queries that may be answered by replicas.
+// Status queries gate decisions and are always answered by the primary.
+var replicaQueries = []string{"history", "stats", "activity"}
+
+// LoadReadReplicaConfig builds a ReadReplicaConfig from environment
+// variables. READ_REPLICA_QUERIES lists "query=staleness" pairs separated by
+// commas.
+func LoadReadReplicaConfig() (ReadReplicaConfig, error) {
+	cfg := ReadReplicaConfig{
+		PollInterval: time.Second,
+		LagInterval:  time.Second,
+		MaxStaleness: map[string]time.Duration{
+			"history":  5 * time.Second,
+			"stats":    30 * time.Second,
+			"activity": 30 * time.Second,
+		},
+	}
+
+	if raw := os.Getenv("READ_REPLICAS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid READ_REPLICAS %q", raw)
+		}
+		cfg.Replicas = n
+	}
+
+	if err := durationFromEnv("READ_REPLICA_POLL_INTERVAL", &cfg.PollInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.PollInterval <= 0 {
+		return cfg, fmt.Errorf("invalid READ_REPLICA_POLL_INTERVAL %q", os.Getenv("READ_REPLICA_POLL_INTERVAL"))
+	}
+	if err := durationFromEnv("READ_REPLICA_LAG_INTERVAL", &cfg.LagInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.LagInterval <= 0 {
+		return cfg, fmt.Errorf("invalid READ_REPLICA_LAG_INTERVAL %q", os.Getenv("READ_REPLICA_LAG_INTERVAL"))
+	}
+
+	if raw, ok := os.LookupEnv("READ_REPLICA_QUERIES"); ok {
+		cfg.MaxStaleness = make(map[string]time.Duration)
+		for _, pair := range strings.Split(raw, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			query, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if query == "status" {
+				return cfg, fmt.Errorf("invalid READ_REPLICA_QUERIES entry %q: status queries gate decisions and are answered by the primary", pair)
+			}
+			staleness, err := time.ParseDuration(value)
+			if !ok || !slices.Contains(replicaQueries, query) || err != nil || staleness <= 0 {
+				return cfg, fmt.Errorf("invalid READ_REPLICA_QUERIES entry %q", pair)
+			}
+			cfg.MaxStaleness[query] = staleness
+		}
+	}
+
+	return cfg, nil
+}
+
+// EventBusConfig holds the default subscriber settings of the event bus
+type EventBusConfig struct {
+	BufferSize   int           `json:"buffer_size"`
+	Policy       string        `json:"policy"`        // "drop", "ring" or "block"
+	BlockTimeout time.Duration `json:"block_timeout"` // "block" only
+}
+
+// LoadEventBusConfig builds an EventBusConfig from environment variables
+func LoadEventBusConfig() (EventBusConfig, error) {
+	cfg := EventBusConfig{
+		BufferSize:   100,
+		Policy:       "drop",
+		BlockTimeout: 100 * time.Millisecond,
+	}
+
+	if raw := os.Getenv("EVENT_BUS_BUFFER_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid EVENT_BUS_BUFFER_SIZE %q", raw)
+		}
+		cfg.BufferSize = n
+	}
+
+	if raw := os.Getenv("EVENT_BUS_POLICY"); raw != "" {
+		switch raw {
+		case "drop", "ring", "block":
+			cfg.Policy = raw
+		default:
+			return cfg, fmt.Errorf("invalid EVENT_BUS_POLICY %q", raw)
+		}
+	}
+
+	if err := durationFromEnv("EVENT_BUS_BLOCK_TIMEOUT", &cfg.BlockTimeout); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// KeyLimitConfig holds the limit on client:resource keys the in-memory event
+// store holds
+type KeyLimitConfig struct {
+	MaxKeys int `json:"max_keys"` // Least recently used keys beyond it are evicted; unlimited when zero
+}
+
+// LoadKeyLimitConfig builds a KeyLimitConfig from environment variables
+func LoadKeyLimitConfig() (KeyLimitConfig, error) {
+	var cfg KeyLimitConfig
+
+	if raw := os.Getenv("MAX_AGGREGATE_KEYS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid MAX_AGGREGATE_KEYS %q", raw)
+		}
+		cfg.MaxKeys = n
+	}
+
+	return cfg, nil
+}
+
+// RefundConfig holds the limit on refunds of consumed quota
+type RefundConfig struct {
+	MaxPerWindow int `json:"max_per_window"` // Refunds a client may make per window of a rule; refunds are disabled when zero
+}
+
+// LoadRefundConfig builds a RefundConfig from environment variables
+func LoadRefundConfig() (RefundConfig, error) {
+	cfg := RefundConfig{MaxPerWindow: 10}
+
+	if raw := os.Getenv("MAX_REFUNDS_PER_WINDOW"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid MAX_REFUNDS_PER_WINDOW %q", raw)
+		}
+		cfg.MaxPerWindow = n
+	}
+
+	return cfg, nil
+}
+
+// GrantConfig holds the limits on budget grants, the further requests a
+// check may count in advance so that the client makes them without checking
+type GrantConfig struct {
+	MaxRequests int           `json:"max_requests"` // Largest grant; grants are disabled when zero
+	TTL         time.Duration `json:"ttl"`          // Time a grant may be used for, at most until the window resets
+}
+
+// LoadGrantConfig builds a GrantConfig from environment variables
+func LoadGrantConfig() (GrantConfig, error) {
+	cfg := GrantConfig{MaxRequests: 100, TTL: 5 * time.Second}
+
+	if raw := os.Getenv("BUDGET_GRANT_MAX_REQUESTS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid BUDGET_GRANT_MAX_REQUESTS %q", raw)
+		}
+		cfg.MaxRequests = n
+	}
+
+	if err := durationFromEnv("BUDGET_GRANT_TTL", &cfg.TTL); err != nil {
+		return cfg, err
+	}
+	if cfg.TTL <= 0 {
+		return cfg, fmt.Errorf("invalid BUDGET_GRANT_TTL %q", os.Getenv("BUDGET_GRANT_TTL"))
+	}
+
+	return cfg, nil
+}
+
+// LeaseConfig holds the limits on token leases, which lend clients tokens of
+// their quota to spend locally, and how often lapsed leases are expired
+type LeaseConfig struct {
+	MaxTokens      int           `json:"max_tokens"`      // Largest lease; leases are disabled when zero
+	MaxTTL         time.Duration `json:"max_ttl"`         // Longest term, also used when a lease asks for none
+	ExpiryInterval time.Duration `json:"expiry_interval"` // How often lapsed leases are expired
+}
+
+// LoadLeaseConfig builds a LeaseConfig from environment variables
+func LoadLeaseConfig() (LeaseConfig, error) {
+	cfg := LeaseConfig{MaxTokens: 1000, MaxTTL: 30 * time.Second, ExpiryInterval: 5 * time.Second}
+
+	if raw := os.Getenv("LEASE_MAX_TOKENS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid LEASE_MAX_TOKENS %q", raw)
+		}
+		cfg.MaxTokens = n
+	}
+
+	if err := durationFromEnv("LEASE_MAX_TTL", &cfg.MaxTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxTTL <= 0 {
+		return cfg, fmt.Errorf("invalid LEASE_MAX_TTL %q", os.Getenv("LEASE_MAX_TTL"))
+	}
+
+	if err := durationFromEnv("LEASE_EXPIRY_INTERVAL", &cfg.ExpiryInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.ExpiryInterval <= 0 {
+		return cfg, fmt.Errorf("invalid LEASE_EXPIRY_INTERVAL %q", os.Getenv("LEASE_EXPIRY_INTERVAL"))
+	}
+
+	return cfg, nil
+}
+
+// BlockedCacheConfig holds the size of the cache of blocked clients
+type BlockedCacheConfig struct {
+	Size int `json:"size"` // Denials held at once; the cache is disabled when zero
+}
+
+// LoadBlockedCacheConfig builds a BlockedCacheConfig from environment
+// variables
+func LoadBlockedCacheConfig() (BlockedCacheConfig, error) {
+	cfg := BlockedCacheConfig{Size: 10000}
+
+	if raw := os.Getenv("BLOCKED_CACHE_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid BLOCKED_CACHE_SIZE %q", raw)
+		}
+		cfg.Size = n
+	}
+
+	return cfg, nil
+}
+
+// AggregateCacheConfig holds the size of the cache of rebuilt aggregates
+type AggregateCacheConfig struct {
+	Size int `json:"size"` // Aggregates held at once; the cache is disabled when zero
+}
+
+// LoadAggregateCacheConfig builds an AggregateCacheConfig from environment
+// variables
+func LoadAggregateCacheConfig() (AggregateCacheConfig, error) {
+	cfg := AggregateCacheConfig{Size: 10000}
+
+	if raw := os.Getenv("AGGREGATE_CACHE_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid AGGREGATE_CACHE_SIZE %q", raw)
+		}
+		cfg.Size = n
+	}
+
+	return cfg, nil
+}
+
+// DeniedResponseConfig holds the templates of the bodies of denied responses
+type DeniedResponseConfig struct {
+	Templates string `json:"templates"` // JSON file of templates by resource and tenant; denials show the rate limit status when empty
+}
+
+// LoadDeniedResponseConfig builds a DeniedResponseConfig from environment
+// variables
+func LoadDeniedResponseConfig() (DeniedResponseConfig, error) {
+	cfg := DeniedResponseConfig{Templates: os.Getenv("DENIED_RESPONSE_TEMPLATES")}
+
+	if cfg.Templates != "" {
+		if _, err := os.Stat(cfg.Templates); err != nil {
+			return cfg, fmt.Errorf("invalid DENIED_RESPONSE_TEMPLATES %q: %w", cfg.Templates, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// GRPCConfig holds the settings of the gRPC server
+type GRPCConfig struct {
+	Addr              string        `json:"addr"`                // Disabled when empty
+	SocketMode        os.FileMode   `json:"socket_mode"`         // Permissions of a Unix socket listened on
+	KeepaliveTime     time.Duration `json:"keepalive_time"`      // Idle time before the server pings a client
+	KeepaliveTimeout  time.Duration `json:"keepalive_timeout"`   // Wait for a ping ack before closing the connection
+	KeepaliveMinTime  time.Duration `json:"keepalive_min_time"`  // Shortest client ping interval tolerated
+	MaxConnectionIdle time.Duration `json:"max_connection_idle"` // Idle connections are closed after it; never when zero
+}
+
+// LoadGRPCConfig builds a GRPCConfig from environment variables
+func LoadGRPCConfig() (GRPCConfig, error) {
+	cfg := GRPCConfig{
+		KeepaliveTime:    30 * time.Second,
+		KeepaliveTimeout: 10 * time.Second,
+		KeepaliveMinTime: 10 * time.Second,
+		SocketMode:       0o660,
+	}
+
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		cfg.Addr = ":" + port
+	}
+	if err := listenAddrFromEnv("GRPC_LISTEN", &cfg.Addr); err != nil {
+		return cfg, err
+	}
+	if err := socketModeFromEnv(&cfg.SocketMode); err != nil {
+		return cfg, err
+	}
+
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"GRPC_KEEPALIVE_TIME", &cfg.KeepaliveTime},
+		{"GRPC_KEEPALIVE_TIMEOUT", &cfg.KeepaliveTimeout},
+		{"GRPC_KEEPALIVE_MIN_TIME", &cfg.KeepaliveMinTime},
+		{"GRPC_MAX_CONNECTION_IDLE", &cfg.MaxConnectionIdle},
+	}
+	for _, d := range durations {
+		if err := durationFromEnv(d.env, d.dst); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// SidecarConfig holds the settings of the sidecar listener, which answers
+// checks from a co-located process over the binary protocol of
+// proto/ratelimit/v1/sidecar.proto
+type SidecarConfig struct {
+	Addr       string      `json:"addr"`        // Disabled when empty
+	SocketMode os.FileMode `json:"socket_mode"` // Permissions of a Unix socket listened on
+}
+
+// LoadSidecarConfig builds a SidecarConfig from environment variables
+func LoadSidecarConfig() (SidecarConfig, error) {
+	cfg := SidecarConfig{SocketMode: 0o660}
+
+	if err := listenAddrFromEnv("SIDECAR_LISTEN", &cfg.Addr); err != nil {
+		return cfg, err
+	}
+	if err := socketModeFromEnv(&cfg.SocketMode); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// NoticeConfig holds where notices about clients starting to be denied and
+// being let through again are published, besides the gRPC streams of the
+// gateways watching them
+type NoticeConfig struct {
+	RedisAddr          string `json:"redis_addr"` // Not published on Redis when empty
+	RedisPassword      string `json:"-"`
+	RedisChannelPrefix string `json:"redis_channel_prefix"` // Followed by the client ID in channel names
+}
+
+// LoadNoticeConfig builds a NoticeConfig from environment variables
+func LoadNoticeConfig() (NoticeConfig, error) {
+	cfg := NoticeConfig{
+		RedisAddr:          os.Getenv("NOTICE_REDIS_ADDR"),
+		RedisPassword:      os.Getenv("NOTICE_REDIS_PASSWORD"),
+		RedisChannelPrefix: "ratelimit:notices:",
+	}
+
+	if raw, ok := os.LookupEnv("NOTICE_REDIS_CHANNEL_PREFIX"); ok {
+		cfg.RedisChannelPrefix = raw
+	}
+	if cfg.RedisAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.RedisAddr); err != nil {
+			return cfg, fmt.Errorf("invalid NOTICE_REDIS_ADDR %q", cfg.RedisAddr)
+		}
+	}
+
+	return cfg, nil
+}
+
+// APIConfig holds the settings of the HTTP API versions
+type APIConfig struct {
+	V1DeprecatedAt time.Time `json:"v1_deprecated_at"` // When v1 was deprecated in favor of v2
+	V1Sunset       time.Time `json:"v1_sunset"`        // When v1 will be removed; unannounced when zero
+}
+
+// LoadAPIConfig builds an APIConfig from environment variables. Times are
+// RFC 3339 timestamps or dates.
+func LoadAPIConfig() (APIConfig, error) {
+	cfg := APIConfig{V1DeprecatedAt: time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)}
+
+	if err := timeFromEnv("API_V1_DEPRECATED_AT", &cfg.V1DeprecatedAt); err != nil {
+		return cfg, err
+	}
+	if err := timeFromEnv("API_V1_SUNSET", &cfg.V1Sunset); err != nil {
+		return cfg, err
+	}
+	if !cfg.V1Sunset.IsZero() && !cfg.V1Sunset.After(cfg.V1DeprecatedAt) {
+		return cfg, fmt.Errorf("API_V1_SUNSET %s must be after API_V1_DEPRECATED_AT %s",
+			cfg.V1Sunset.Format(time.RFC3339), cfg.V1DeprecatedAt.Format(time.RFC3339))
+	}
+
+	return cfg, nil
+}
+
+// timeFromEnv parses env, an RFC 3339 timestamp or a date, into dst if set
+func timeFromEnv(env string, dst *time.Time) error {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, raw); err != nil {
+			return fmt.Errorf("invalid %s %q", env, raw)
+		}
+	}
+	*dst = t
+	return nil
+}
+
+// LockConfig selects the distributed lock backend that elects the instance
+// running background jobs
+type LockConfig struct {
+	Backend       string        `json:"backend"` // "memory", "redis", "etcd", "postgres" or "kubernetes"
+	Addrs         []string      `json:"addrs"`   // Redis nodes, etcd endpoints, a postgres:// URL or a Kubernetes API URL
+	RedisPassword string        `json:"-"`
+	Namespace     string        `json:"namespace"` // Namespace of Kubernetes leases; empty uses the pod's namespace
+	Identity      string        `json:"identity"`  // Name this instance stands for election as
+	TTL           time.Duration `json:"ttl"`       // Time a holder keeps the lock after it stops refreshing it
+}
+
+// LoadLockConfig builds a LockConfig from environment variables
+func LoadLockConfig() (LockConfig, error) {
+	cfg := LockConfig{
+		Backend:       os.Getenv("LOCK_BACKEND"),
+		RedisPassword: os.Getenv("LOCK_REDIS_PASSWORD"),
+		Namespace:     os.Getenv("LOCK_NAMESPACE"),
+		Identity:      os.Getenv("LOCK_IDENTITY"),
+		TTL:           15 * time.Second,
+	}
+
+	raw := os.Getenv("LOCK_ADDRS")
+	if raw != "" {
+		cfg.Addrs = strings.Split(raw, ",")
+	}
+
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = "memory"
+	case "memory", "kubernetes":
+	case "redis", "etcd", "postgres":
+		if raw == "" {
+			return cfg, fmt.Errorf("LOCK_ADDRS is required when LOCK_BACKEND=%s", cfg.Backend)
+		}
+	default:
+		return cfg, fmt.Errorf("invalid LOCK_BACKEND %q", cfg.Backend)
+	}
+
+	if cfg.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return cfg, fmt.Errorf("LOCK_IDENTITY is required when the hostname is unknown: %w", err)
+		}
+		cfg.Identity = hostname
+	}
+
+	if err := durationFromEnv("LOCK_TTL", &cfg.TTL); err != nil {
+		return cfg, err
+	}
+	if cfg.TTL < 3*time.Second {
+		return cfg, fmt.Errorf("invalid LOCK_TTL %q", os.Getenv("LOCK_TTL"))
+	}
+
+	return cfg, nil
+}
+
+// EnrichmentConfig selects the enrichers that add fields to requests before
+// security rules are evaluated, in the order they run
+type EnrichmentConfig struct {
+	Enrichers       []EnricherConfig `json:"enrichers"`
+	GeoIPDatabase   string           `json:"geoip_database"`    // CSV of network,country[,asn]
+	ReputationURL   string           `json:"reputation_url"`    // Lookup service of the reputation enricher
+	AccountFlagsURL string           `json:"account_flags_url"` // Lookup service of the account enricher
+
+	// CrawlerVerification is how long the useragent enricher remembers
+	// whether an address of a known crawler is genuine; zero disables
+	// verification
+	CrawlerVerification time.Duration `json:"crawler_verification"`
+}
+
+// EnricherConfig is one enricher of the chain with its timeout
+type EnricherConfig struct {
+	Name    string        `json:"name"` // useragent, geoip, device, reputation or account
+	Timeout time.Duration `json:"timeout"`
+}
+
+// LoadEnrichmentConfig builds an EnrichmentConfig from environment
+// variables. ENRICHERS lists the enrichers in order, each optionally with
+// its own timeout, e.g. "geoip:5ms,device,reputation:50ms"; the others get
+// ENRICHER_TIMEOUT. Without ENRICHERS only the useragent enricher runs, as
+// the default security rules need its ua_class; set it empty to run none.
+func LoadEnrichmentConfig() (EnrichmentConfig, error) {
+	cfg := EnrichmentConfig{
+		GeoIPDatabase:   os.Getenv("GEOIP_DATABASE"),
+		ReputationURL:   os.Getenv("REPUTATION_URL"),
+		AccountFlagsURL: os.Getenv("ACCOUNT_FLAGS_URL"),
+	}
+
+	timeout := 100 * time.Millisecond
+	if err := durationFromEnv("ENRICHER_TIMEOUT", &timeout); err != nil {
+		return cfg, err
+	}
+
+	if err := durationFromEnv("CRAWLER_VERIFICATION_TTL", &cfg.CrawlerVerification); err != nil {
+		return cfg, err
+	}
+
+	raw, ok := os.LookupEnv("ENRICHERS")
+	if !ok {
+		raw = "useragent"
+	}
+	if strings.TrimSpace(raw) == "" {
+		return cfg, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		name, rawTimeout, hasTimeout := strings.Cut(strings.TrimSpace(entry), ":")
+		enricher := EnricherConfig{Name: name, Timeout: timeout}
+		if hasTimeout {
+			d, err := time.ParseDuration(rawTimeout)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("invalid ENRICHERS timeout %q", entry)
+			}
+			enricher.Timeout = d
+		}
+
+		switch name {
+		case "useragent", "device":
+		case "geoip":
+			if cfg.GeoIPDatabase == "" {
+				return cfg, fmt.Errorf("GEOIP_DATABASE is required by the geoip enricher")
+			}
+		case "reputation":
+			if cfg.ReputationURL == "" {
+				return cfg, fmt.Errorf("REPUTATION_URL is required by the reputation enricher")
+			}
+		case "account":
+			if cfg.AccountFlagsURL == "" {
+				return cfg, fmt.Errorf("ACCOUNT_FLAGS_URL is required by the account enricher")
+			}
+		default:
+			return cfg, fmt.Errorf("invalid ENRICHERS entry %q", entry)
+		}
+		if seen[name] {
+			return cfg, fmt.Errorf("invalid ENRICHERS entry %q: listed twice", entry)
+		}
+		seen[name] = true
+
+		cfg.Enrichers = append(cfg.Enrichers, enricher)
+	}
+
+	return cfg, nil
+}
+
+// RuleCacheConfig holds the settings of the rule result cache
+type RuleCacheConfig struct {
+	TTL        time.Duration `json:"ttl"`         // How long results of identical requests are reused; zero disables the cache
+	MaxEntries int           `json:"max_entries"` // Requests whose results are held at once
+}
+
+// LoadRuleCacheConfig builds a RuleCacheConfig from environment variables
+func LoadRuleCacheConfig() (RuleCacheConfig, error) {
+	cfg := RuleCacheConfig{MaxEntries: 10000}
+
+	if err := durationFromEnv("RULE_RESULT_CACHE_TTL", &cfg.TTL); err != nil {
+		return cfg, err
+	}
+	if raw := os.Getenv("RULE_RESULT_CACHE_SIZE"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid RULE_RESULT_CACHE_SIZE %q", raw)
+		}
+		cfg.MaxEntries = n
+	}
+
+	return cfg, nil
+}
+
+// ThreatFeedConfig selects the IP threat feeds imported into blacklist and
+// whitelist rules, and how often the ban list is swept of expired entries
+type ThreatFeedConfig struct {
+	Feeds                []FeedConfig  `json:"feeds"`
+	BanListSweepInterval time.Duration `json:"ban_list_sweep_interval"`
+}
+
+// FeedConfig is one threat feed
+type FeedConfig struct {
+	Name     string        `json:"name"`
+	URL      string        `json:"url"`    // http(s) URL, file:// URL or file path
+	Format   string        `json:"format"` // spamhaus-drop, abuseipdb or list
+	Action   string        `json:"action"` // deny or allow
+	Interval time.Duration `json:"interval"`
+	Header   string        `json:"header,omitempty"` // "Name: value" sent with each download
+}
+
+// LoadThreatFeedConfig builds a ThreatFeedConfig from environment
+// variables. THREAT_FEEDS names the feeds, e.g. "spamhaus,abuseipdb,partners",
+// each configured by THREAT_FEED_<NAME>_URL, _FORMAT, _ACTION, _INTERVAL and
+// _HEADER. The format defaults to spamhaus-drop for a feed named spamhaus,
+// abuseipdb for one named abuseipdb and list otherwise, the action to deny
+// and the interval to THREAT_FEED_INTERVAL. BAN_LIST_SWEEP_INTERVAL, 1m
+// by default, sets how often expired ban list entries are removed.
+func LoadThreatFeedConfig() (ThreatFeedConfig, error) {
+	cfg := ThreatFeedConfig{BanListSweepInterval: time.Minute}
+
+	if err := durationFromEnv("BAN_LIST_SWEEP_INTERVAL", &cfg.BanListSweepInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.BanListSweepInterval <= 0 {
+		return cfg, fmt.Errorf("invalid BAN_LIST_SWEEP_INTERVAL %q", os.Getenv("BAN_LIST_SWEEP_INTERVAL"))
+	}
+
+	interval := time.Hour
+	if err := durationFromEnv("THREAT_FEED_INTERVAL", &interval); err != nil {
+		return cfg, err
+	}
+	if interval <= 0 {
+		return cfg, fmt.Errorf("invalid THREAT_FEED_INTERVAL %q", os.Getenv("THREAT_FEED_INTERVAL"))
+	}
+
+	raw := os.Getenv("THREAT_FEEDS")
+	if raw == "" {
+		return cfg, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if !validFeedName(name) {
+			return cfg, fmt.Errorf("invalid THREAT_FEEDS entry %q", name)
+		}
+		if seen[name] {
+			return cfg, fmt.Errorf("invalid THREAT_FEEDS entry %q: listed twice", name)
+		}
+		seen[name] = true
+
+		prefix := "THREAT_FEED_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		feed := FeedConfig{
+			Name:     name,
+			URL:      os.Getenv(prefix + "URL"),
+			Format:   os.Getenv(prefix + "FORMAT"),
+			Action:   os.Getenv(prefix + "ACTION"),
+			Interval: interval,
+			Header:   os.Getenv(prefix + "HEADER"),
+		}
+
+		if feed.Format == "" {
+			switch name {
+			case "spamhaus":
+				feed.Format = "spamhaus-drop"
+			case "abuseipdb":
+				feed.Format = "abuseipdb"
+			default:
+				feed.Format = "list"
+			}
+		}
+		switch feed.Format {
+		case "spamhaus-drop", "abuseipdb", "list":
+		default:
+			return cfg, fmt.Errorf("invalid %sFORMAT %q", prefix, feed.Format)
+		}
+		if feed.URL == "" {
+			if feed.Format != "spamhaus-drop" {
+				return cfg, fmt.Errorf("%sURL is required by the %s threat feed", prefix, name)
+			}
+			feed.URL = "https://www.spamhaus.org/drop/drop_v4.json"
+		}
+
+		switch feed.Action {
+		case "":
+			feed.Action = "deny"
+		case "deny", "allow":
+		default:
+			return cfg, fmt.Errorf("invalid %sACTION %q", prefix, feed.Action)
+		}
+		if err := durationFromEnv(prefix+"INTERVAL", &feed.Interval); err != nil {
+			return cfg, err
+		}
+		if feed.Interval <= 0 {
+			return cfg, fmt.Errorf("invalid %sINTERVAL %q", prefix, os.Getenv(prefix+"INTERVAL"))
+		}
+		if feed.Header != "" && !strings.Contains(feed.Header, ":") {
+			return cfg, fmt.Errorf("invalid %sHEADER: expected \"Name: value\"", prefix)
+		}
+
+		cfg.Feeds = append(cfg.Feeds, feed)
+	}
+
+	return cfg, nil
+}
+
+// validFeedName reports whether name is lowercase letters, digits and
+// dashes, so it maps to environment variables and rule IDs
+func validFeedName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// ChallengeConfig holds the settings of challenge rule actions
+type ChallengeConfig struct {
+	Secret           string        `json:"-"`    // Signs challenge tokens; share it across instances
+	Kind             string        `json:"kind"` // Kind of challenge actions that name none: js or captcha
+	TTL              time.Duration `json:"ttl"`
+	PassTTL          time.Duration `json:"pass_ttl"` // How long a solved challenge exempts the client
+	Difficulty       int           `json:"difficulty"`
+	CaptchaURL       string        `json:"captcha_url"`
+	CaptchaVerifyURL string        `json:"captcha_verify_url"`
+	CaptchaSecret    string        `json:"-"`
+}
+
+// LoadChallengeConfig builds a ChallengeConfig from environment variables
+func LoadChallengeConfig() (ChallengeConfig, error) {
+	cfg := ChallengeConfig{
+		Secret:           os.Getenv("CHALLENGE_SECRET"),
+		Kind:             "js",
+		TTL:              5 * time.Minute,
+		PassTTL:          30 * time.Minute,
+		Difficulty:       18,
+		CaptchaURL:       os.Getenv("CHALLENGE_CAPTCHA_URL"),
+		CaptchaVerifyURL: os.Getenv("CHALLENGE_CAPTCHA_VERIFY_URL"),
+		CaptchaSecret:    os.Getenv("CHALLENGE_CAPTCHA_SECRET"),
+	}
+
+	if raw := os.Getenv("CHALLENGE_KIND"); raw != "" {
+		if raw != "js" && raw != "captcha" {
+			return cfg, fmt.Errorf("invalid CHALLENGE_KIND %q", raw)
+		}
+		cfg.Kind = raw
+	}
+	if cfg.Kind == "captcha" && (cfg.CaptchaURL == "" || cfg.CaptchaVerifyURL == "") {
+		return cfg, fmt.Errorf("CHALLENGE_CAPTCHA_URL and CHALLENGE_CAPTCHA_VERIFY_URL are required by CHALLENGE_KIND captcha")
+	}
+
+	if err := durationFromEnv("CHALLENGE_TTL", &cfg.TTL); err != nil {
+		return cfg, err
+	}
+	if cfg.TTL <= 0 {
+		return cfg, fmt.Errorf("invalid CHALLENGE_TTL %q", os.Getenv("CHALLENGE_TTL"))
+	}
+	if err := durationFromEnv("CHALLENGE_PASS_TTL", &cfg.PassTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.PassTTL <= 0 {
+		return cfg, fmt.Errorf("invalid CHALLENGE_PASS_TTL %q", os.Getenv("CHALLENGE_PASS_TTL"))
+	}
+
+	if raw := os.Getenv("CHALLENGE_DIFFICULTY"); raw != "" {
+		difficulty, err := strconv.Atoi(raw)
+		if err != nil || difficulty < 0 || difficulty > 32 {
+			return cfg, fmt.Errorf("invalid CHALLENGE_DIFFICULTY %q", raw)
+		}
+		cfg.Difficulty = difficulty
+	}
+
+	return cfg, nil
+}
+
+// PrivacyConfig holds the settings of privacy mode, which stores client IDs,
+// IP addresses and user agents as keyed hashes
+type PrivacyConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Key         string `json:"-"` // Keys the hashes; the same on every instance
+	LookupToken string `json:"-"` // Bearer token of admins allowed to look up pseudonyms; empty disables lookups
+}
+
+// minPrivacyKeyLength is the shortest PRIVACY_KEY accepted, so that
+// pseudonyms cannot be reversed by guessing the key
+const minPrivacyKeyLength = 16
+
+// LoadPrivacyConfig builds a PrivacyConfig from environment variables
+func LoadPrivacyConfig() (PrivacyConfig, error) {
+	cfg := PrivacyConfig{
+		Key:         os.Getenv("PRIVACY_KEY"),
+		LookupToken: os.Getenv("PRIVACY_LOOKUP_TOKEN"),
+	}
+
+	if raw := os.Getenv("PRIVACY_MODE"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PRIVACY_MODE %q", raw)
+		}
+		cfg.Enabled = enabled
+	}
+	if cfg.Enabled && len(cfg.Key) < minPrivacyKeyLength {
+		return cfg, fmt.Errorf("PRIVACY_KEY of at least %d bytes is required by PRIVACY_MODE", minPrivacyKeyLength)
+	}
+
+	return cfg, nil
+}
+
+// RolloutConfig holds the settings of rule rollouts
+type RolloutConfig struct {
+	EvaluationInterval time.Duration `json:"evaluation_interval"` // How often running rollouts are advanced, promoted or rolled back
+}
+
+// LoadRolloutConfig builds a RolloutConfig from environment variables
+func LoadRolloutConfig() (RolloutConfig, error) {
+	cfg := RolloutConfig{EvaluationInterval: 10 * time.Second}
+
+	if err := durationFromEnv("ROLLOUT_EVALUATION_INTERVAL", &cfg.EvaluationInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.EvaluationInterval <= 0 {
+		return cfg, fmt.Errorf("invalid ROLLOUT_EVALUATION_INTERVAL %q", os.Getenv("ROLLOUT_EVALUATION_INTERVAL"))
+	}
+
+	return cfg, nil
+}
+
+// RuleApprovalConfig holds the settings of the two-person approval of
+// high-impact rule engine rule changes
+type RuleApprovalConfig struct {
+	Enabled           bool `json:"enabled"`            // Hold high-impact rule changes pending approval
+	PriorityThreshold int  `json:"priority_threshold"` // Rules of a higher priority are high-impact, as are rules denying every request
+}
+
+// LoadRuleApprovalConfig builds a RuleApprovalConfig from environment
+// variables
+func LoadRuleApprovalConfig() (RuleApprovalConfig, error) {
+	cfg := RuleApprovalConfig{PriorityThreshold: 200}
+
+	if raw := os.Getenv("RULE_APPROVAL_ENABLED"); raw != "" {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RULE_APPROVAL_ENABLED %q", raw)
+		}
+		cfg.Enabled = enabled
+	}
+
+	if raw := os.Getenv("RULE_APPROVAL_PRIORITY_THRESHOLD"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RULE_APPROVAL_PRIORITY_THRESHOLD %q", raw)
+		}
+		cfg.PriorityThreshold = n
+	}
+
+	return cfg, nil
+}
+
+// WarmStartConfig holds the settings of the warm start, which loads hot
+// state into memory before an instance reports ready
+type WarmStartConfig struct {
+	Window  time.Duration `json:"window"`   // Aggregates with events this recent are preloaded
+	MaxKeys int           `json:"max_keys"` // Most aggregates preloaded; aggregates are not preloaded when zero
+	Timeout time.Duration `json:"timeout"`  // Readiness is reported after this long even when loading is not done
+}
+
+// LoadWarmStartConfig builds a WarmStartConfig from environment variables
+func LoadWarmStartConfig() (WarmStartConfig, error) {
+	cfg := WarmStartConfig{
+		Window:  15 * time.Minute,
+		MaxKeys: 10000,
+		Timeout: 30 * time.Second,
+	}
+
+	if err := durationFromEnv("WARM_START_WINDOW", &cfg.Window); err != nil {
+		return cfg, err
+	}
+
+	if raw := os.Getenv("WARM_START_MAX_KEYS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid WARM_START_MAX_KEYS %q", raw)
+		}
+		cfg.MaxKeys = n
+	}
+
+	if err := durationFromEnv("WARM_START_TIMEOUT", &cfg.Timeout); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeout <= 0 {
+		return cfg, fmt.Errorf("invalid WARM_START_TIMEOUT %q", os.Getenv("WARM_START_TIMEOUT"))
+	}
+
+	return cfg, nil
+}
+
+// StorageFailureConfig holds how checks are decided when the storage they
+// need fails or the decision deadline passes
+type StorageFailureConfig struct {
+	Mode      string            `json:"mode"`      // "error", "open" or "closed"
+	Resources map[string]string `json:"resources"` // Modes of single resources, overriding Mode
+}
+
+// LoadStorageFailureConfig builds a StorageFailureConfig from environment
+// variables. STORAGE_FAILURE_RESOURCES lists "resource=mode" pairs
+// separated by commas.
+func LoadStorageFailureConfig() (StorageFailureConfig, error) {
+	cfg := StorageFailureConfig{
+		Mode:      "error",
+		Resources: make(map[string]string),
+	}
+
+	if raw := os.Getenv("STORAGE_FAILURE_MODE"); raw != "" {
+		if !validFailureMode(raw) {
+			return cfg, fmt.Errorf("invalid STORAGE_FAILURE_MODE %q", raw)
+		}
+		cfg.Mode = raw
+	}
+
+	if raw := os.Getenv("STORAGE_FAILURE_RESOURCES"); raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			resource, mode, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || resource == "" || !validFailureMode(mode) {
+				return cfg, fmt.Errorf("invalid STORAGE_FAILURE_RESOURCES entry %q", pair)
+			}
+			cfg.Resources[resource] = mode
+		}
+	}
+
+	return cfg, nil
+}
+
+// DecisionConfig holds the end-to-end deadline of rate limit decisions
+type DecisionConfig struct {
+	Deadline time.Duration `json:"deadline"` // Longest a decision may take before the failure policy decides it; unbounded when zero
+}
+
+// LoadDecisionConfig builds a DecisionConfig from environment variables
+func LoadDecisionConfig() (DecisionConfig, error) {
+	var cfg DecisionConfig
+
+	if err := durationFromEnv("DECISION_DEADLINE", &cfg.Deadline); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// validFailureMode reports whether mode is a storage failure mode
+func validFailureMode(mode string) bool {
+	switch mode {
+	case "error", "open", "closed":
+		return true
+	}
+	return false
+}
+
+// FeatureFlagConfig selects the feature flag provider that the flags gating
+// rate limit rules are evaluated with: a JSON file of flags, or a flag
+// service speaking the OpenFeature Remote Evaluation Protocol (OFREP)
+type FeatureFlagConfig struct {
+	File            string        `json:"file,omitempty"`
+	RefreshInterval time.Duration `json:"refresh_interval"` // How often the file is read again
+	OFREPURL        string        `json:"ofrep_url,omitempty"`
+	OFREPToken      string        `json:"-"`
+	Timeout         time.Duration `json:"timeout"`   // Longest an OFREP evaluation may take
+	CacheTTL        time.Duration `json:"cache_ttl"` // How long OFREP evaluations are reused; not cached when zero
+}
+
+// LoadFeatureFlagConfig builds a FeatureFlagConfig from environment
+// variables. FEATURE_FLAGS_FILE and FEATURE_FLAGS_OFREP_URL are exclusive;
+// without either, rules gated by a flag are not enforced.
+func LoadFeatureFlagConfig() (FeatureFlagConfig, error) {
+	cfg := FeatureFlagConfig{
+		File:            os.Getenv("FEATURE_FLAGS_FILE"),
+		RefreshInterval: 30 * time.Second,
+		OFREPURL:        os.Getenv("FEATURE_FLAGS_OFREP_URL"),
+		OFREPToken:      os.Getenv("FEATURE_FLAGS_OFREP_TOKEN"),
+		Timeout:         200 * time.Millisecond,
+		CacheTTL:        10 * time.Second,
+	}
+
+	if cfg.File != "" && cfg.OFREPURL != "" {
+		return cfg, fmt.Errorf("FEATURE_FLAGS_FILE and FEATURE_FLAGS_OFREP_URL are exclusive")
+	}
+	if cfg.OFREPURL != "" && !strings.HasPrefix(cfg.OFREPURL, "http://") && !strings.HasPrefix(cfg.OFREPURL, "https://") {
+		return cfg, fmt.Errorf("invalid FEATURE_FLAGS_OFREP_URL %q", cfg.OFREPURL)
+	}
+	if err := durationFromEnv("FEATURE_FLAGS_REFRESH_INTERVAL", &cfg.RefreshInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.RefreshInterval <= 0 {
+		return cfg, fmt.Errorf("invalid FEATURE_FLAGS_REFRESH_INTERVAL %q", os.Getenv("FEATURE_FLAGS_REFRESH_INTERVAL"))
+	}
+	if err := durationFromEnv("FEATURE_FLAGS_TIMEOUT", &cfg.Timeout); err != nil {
+		return cfg, err
+	}
+	if cfg.Timeout <= 0 {
+		return cfg, fmt.Errorf("invalid FEATURE_FLAGS_TIMEOUT %q", os.Getenv("FEATURE_FLAGS_TIMEOUT"))
+	}
+	if err := durationFromEnv("FEATURE_FLAGS_CACHE_TTL", &cfg.CacheTTL); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
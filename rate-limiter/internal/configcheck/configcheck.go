@@ -0,0 +1,264 @@
+// Package configcheck validates the configuration of a server without
+// serving: it loads the environment, reaches the storage and services the
+// configuration names and checks rules files, collecting what it finds in
+// a report, so that configuration changes can be gated in CI.
+package configcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/featureflags"
+)
+
+// dialTimeout bounds each connectivity check
+const dialTimeout = 3 * time.Second
+
+// Check is the outcome of one check
+type Check struct {
+	Name   string
+	Err    error  // Why the check failed; nil when it passed
+	Detail string // What was found, when the check passed
+}
+
+// Report collects the outcomes of checks in the order they ran
+type Report struct {
+	Checks []Check
+}
+
+// Add records the outcome of the check called name
+func (r *Report) Add(name string, err error, detail string) {
+	r.Checks = append(r.Checks, Check{Name: name, Err: err, Detail: detail})
+}
+
+// Failed reports whether any check failed
+func (r *Report) Failed() bool {
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes a line per check and a summary to w
+func (r *Report) Print(w io.Writer) {
+	failed := 0
+	for _, check := range r.Checks {
+		switch {
+		case check.Err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", check.Name, check.Err)
+		case check.Detail != "":
+			fmt.Fprintf(w, "ok    %s: %s\n", check.Name, check.Detail)
+		default:
+			fmt.Fprintf(w, "ok    %s\n", check.Name)
+		}
+	}
+	fmt.Fprintf(w, "%d checks, %d failed\n", len(r.Checks), failed)
+}
+
+// Environment is the configuration loaded from the environment that names
+// storage and services to reach. A field is nil when its configuration is
+// invalid.
+type Environment struct {
+	Counter        *config.CounterConfig
+	Analytics      *config.AnalyticsConfig
+	RemoteWrite    *config.RemoteWriteConfig
+	Alert          *config.AlertConfig
+	Lock           *config.LockConfig
+	Enrichment     *config.EnrichmentConfig
+	ThreatFeed     *config.ThreatFeedConfig
+	DeniedResponse *config.DeniedResponseConfig
+	Notice         *config.NoticeConfig
+	FeatureFlags   *config.FeatureFlagConfig
+}
+
+// CheckEnvironment loads every configuration from the environment, as the
+// servers do at startup, with defaultAddr as the default listen address
+func CheckEnvironment(r *Report, defaultAddr string) Environment {
+	server := load(r, "server", func() (config.ServerConfig, error) { return config.LoadServerConfig(defaultAddr) })
+	if server != nil {
+		load(r, "admin server", func() (config.AdminServerConfig, error) { return config.LoadAdminServerConfig(*server) })
+	}
+	load(r, "gRPC", config.LoadGRPCConfig)
+	load(r, "sidecar", config.LoadSidecarConfig)
+	load(r, "API", config.LoadAPIConfig)
+	load(r, "access log", config.LoadAccessLogConfig)
+	load(r, "forward auth", config.LoadForwardAuthConfig)
+	load(r, "rule sync", config.LoadRuleSyncConfig)
+	load(r, "throttle", config.LoadThrottleConfig)
+	load(r, "outbox", config.LoadOutboxConfig)
+	load(r, "write batching", config.LoadWriteBatchConfig)
+	load(r, "projection", config.LoadProjectionConfig)
+	load(r, "read replicas", config.LoadReadReplicaConfig)
+	load(r, "event bus", config.LoadEventBusConfig)
+	load(r, "key limit", config.LoadKeyLimitConfig)
+	load(r, "refund", config.LoadRefundConfig)
+	load(r, "grant", config.LoadGrantConfig)
+	load(r, "lease", config.LoadLeaseConfig)
+	load(r, "blocked cache", config.LoadBlockedCacheConfig)
+	load(r, "aggregate cache", config.LoadAggregateCacheConfig)
+	load(r, "rule cache", config.LoadRuleCacheConfig)
+	load(r, "challenge", config.LoadChallengeConfig)
+	load(r, "privacy", config.LoadPrivacyConfig)
+	load(r, "rollout", config.LoadRolloutConfig)
+	load(r, "rule approval", config.LoadRuleApprovalConfig)
+	load(r, "warm start", config.LoadWarmStartConfig)
+	load(r, "storage failure", config.LoadStorageFailureConfig)
+	load(r, "decision", config.LoadDecisionConfig)
+
+	return Environment{
+		Counter:        load(r, "counter", config.LoadCounterConfig),
+		Analytics:      load(r, "analytics", config.LoadAnalyticsConfig),
+		RemoteWrite:    load(r, "remote write", config.LoadRemoteWriteConfig),
+		Alert:          load(r, "alert", config.LoadAlertConfig),
+		Lock:           load(r, "lock", config.LoadLockConfig),
+		Enrichment:     load(r, "enrichment", config.LoadEnrichmentConfig),
+		ThreatFeed:     load(r, "threat feed", config.LoadThreatFeedConfig),
+		DeniedResponse: load(r, "denied response", config.LoadDeniedResponseConfig),
+		Notice:         load(r, "notice", config.LoadNoticeConfig),
+		FeatureFlags:   load(r, "feature flag", config.LoadFeatureFlagConfig),
+	}
+}
+
+// load records the outcome of loader as the check of the configuration
+// called name, returning the configuration when it is valid
+func load[T any](r *Report, name string, loader func() (T, error)) *T {
+	cfg, err := loader()
+	r.Add(name+" configuration", err, "")
+	if err != nil {
+		return nil
+	}
+	return &cfg
+}
+
+// CheckConnectivity reaches the storage, services and files env names:
+// network addresses are dialed, and files are opened or loaded
+func CheckConnectivity(ctx context.Context, r *Report, env Environment) {
+	if cfg := env.Counter; cfg != nil && cfg.Backend == "memcached" {
+		for _, server := range cfg.MemcachedServers {
+			checkDial(ctx, r, "memcached", server)
+		}
+	}
+	if cfg := env.Analytics; cfg != nil && cfg.ClickHouseURL != "" {
+		checkURL(ctx, r, "ClickHouse", cfg.ClickHouseURL)
+	}
+	if cfg := env.RemoteWrite; cfg != nil && cfg.URL != "" {
+		checkURL(ctx, r, "remote write", cfg.URL)
+	}
+	if cfg := env.Alert; cfg != nil && cfg.WebhookURL != "" {
+		checkURL(ctx, r, "alert webhook", cfg.WebhookURL)
+	}
+	if cfg := env.Notice; cfg != nil && cfg.RedisAddr != "" {
+		checkDial(ctx, r, "notice Redis", cfg.RedisAddr)
+	}
+
+	if cfg := env.Lock; cfg != nil {
+		switch cfg.Backend {
+		case "redis", "etcd":
+			for _, addr := range cfg.Addrs {
+				checkDial(ctx, r, cfg.Backend+" lock", strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://"))
+			}
+		case "postgres", "kubernetes":
+			if len(cfg.Addrs) > 0 {
+				checkURL(ctx, r, cfg.Backend+" lock", cfg.Addrs[0])
+			}
+		}
+	}
+
+	if cfg := env.Enrichment; cfg != nil {
+		if cfg.GeoIPDatabase != "" {
+			checkFile(r, "GeoIP database", cfg.GeoIPDatabase)
+		}
+		if cfg.ReputationURL != "" {
+			checkURL(ctx, r, "reputation service", cfg.ReputationURL)
+		}
+		if cfg.AccountFlagsURL != "" {
+			checkURL(ctx, r, "account flags service", cfg.AccountFlagsURL)
+		}
+	}
+
+	if cfg := env.ThreatFeed; cfg != nil {
+		for _, feed := range cfg.Feeds {
+			checkURL(ctx, r, "threat feed "+feed.Name, feed.URL)
+		}
+	}
+
+	if cfg := env.DeniedResponse; cfg != nil && cfg.Templates != "" {
+		_, err := denial.Load(cfg.Templates)
+		r.Add("denied response templates "+cfg.Templates, err, "loaded")
+	}
+
+	if cfg := env.FeatureFlags; cfg != nil {
+		if cfg.File != "" {
+			_, err := featureflags.NewFileProvider(cfg.File)
+			r.Add("feature flags "+cfg.File, err, "loaded")
+		}
+		if cfg.OFREPURL != "" {
+			checkURL(ctx, r, "feature flag service", cfg.OFREPURL)
+		}
+	}
+}
+
+// checkURL reaches the service at rawURL: the host of a network URL is
+// dialed, and a file:// URL or path is opened
+func checkURL(ctx context.Context, r *Report, name, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		r.Add(name, fmt.Errorf("invalid URL: %w", err), "")
+		return
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		checkFile(r, name, u.Path)
+		return
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "postgres": "5432", "postgresql": "5432"}[u.Scheme]
+		if port == "" {
+			r.Add(name+" "+u.Host, fmt.Errorf("no port in %s URL", u.Scheme), "")
+			return
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	checkDial(ctx, r, name, addr)
+}
+
+// checkDial dials addr over TCP
+func checkDial(ctx context.Context, r *Report, name, addr string) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	started := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		r.Add(name+" "+addr, err, "")
+		return
+	}
+	conn.Close()
+	r.Add(name+" "+addr, nil, fmt.Sprintf("reachable in %s", time.Since(started).Round(time.Millisecond)))
+}
+
+// checkFile opens the file at path
+func checkFile(r *Report, name, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		r.Add(name+" "+path, err, "")
+		return
+	}
+	file.Close()
+	r.Add(name+" "+path, nil, "readable")
+}
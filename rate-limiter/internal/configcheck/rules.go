@@ -0,0 +1,278 @@
+package configcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+	ruleEngine "github.com/NickChunglolz/rule-engine/engine"
+	ruleInfra "github.com/NickChunglolz/rule-engine/infrastructure"
+)
+
+// algorithms are the rate limiting algorithms rules may name
+var algorithms = []domain.Algorithm{
+	domain.TokenBucket,
+	domain.SlidingWindow,
+	domain.FixedWindow,
+	domain.LeakyBucket,
+	domain.SlidingWindowCounter,
+}
+
+// RateLimitRule is a rate limit rule of a rules file, as the body of
+// POST /api/v1/ratelimit/rules
+type RateLimitRule struct {
+	Resource      string  `json:"resource"`
+	Method        string  `json:"method,omitempty"`
+	Limit         int     `json:"limit"`
+	Window        string  `json:"window"`
+	Algorithm     string  `json:"algorithm"`
+	KeyTemplate   string  `json:"key_template,omitempty"`
+	SoftThreshold float64 `json:"soft_threshold,omitempty"`
+
+	Parameters *domain.AlgorithmParameters `json:"parameters,omitempty"`
+	Windows    []WindowLimit               `json:"windows,omitempty"`
+}
+
+// WindowLimit is an extra window of a rate limit rule of a rules file
+type WindowLimit struct {
+	Limit  int    `json:"limit"`
+	Window string `json:"window"`
+}
+
+// CheckRateLimitRules checks the rules file at path, a JSON array of rate
+// limit rules. Every rule must have a resource, a positive limit and
+// window, which bucket parameters may give instead, a known algorithm with
+// valid parameters, extra windows of their own with positive limits, a
+// valid key template and soft threshold, and be the only rule of its
+// resource and method.
+func CheckRateLimitRules(r *Report, path string) {
+	var rules []RateLimitRule
+	if !readRules(r, path, &rules) {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		key := strings.TrimSpace(strings.ToUpper(rule.Method) + " " + rule.Resource)
+		name := fmt.Sprintf("%s rule %d (%s)", path, i, key)
+		if seen[key] {
+			r.Add(name, errors.New("another rule of the file has the same resource and method"), "")
+			continue
+		}
+		seen[key] = true
+
+		if rule.Resource == "" {
+			r.Add(name, errors.New("resource is required"), "")
+			continue
+		}
+		window, err := time.ParseDuration(rule.Window)
+		if err != nil && rule.Window != "" {
+			r.Add(name, fmt.Errorf("invalid window %q", rule.Window), "")
+			continue
+		}
+		limit, window, err := resolveParameters(rule.Parameters, rule.Algorithm, rule.Limit, window)
+		if err != nil {
+			r.Add(name, err, "")
+			continue
+		}
+		windows, err := parseWindows(rule.Windows)
+		if err == nil {
+			err = checkWindows(window, windows)
+		}
+		if err != nil {
+			r.Add(name, err, "")
+			continue
+		}
+		err = checkLimit(limit, window, rule.Algorithm, rule.KeyTemplate, rule.SoftThreshold)
+		r.Add(name, err, describeLimits(limit, window, windows))
+	}
+}
+
+// parseWindows converts the extra windows of a rule of a rules file
+func parseWindows(extra []WindowLimit) ([]domain.WindowLimit, error) {
+	var windows []domain.WindowLimit
+	for _, w := range extra {
+		window, err := time.ParseDuration(w.Window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %q in windows", w.Window)
+		}
+		windows = append(windows, domain.WindowLimit{Limit: w.Limit, Window: window})
+	}
+	return windows, nil
+}
+
+// checkWindows checks the extra windows of a limit over window
+func checkWindows(window time.Duration, windows []domain.WindowLimit) error {
+	if err := domain.ValidateWindows(window, windows); err != nil {
+		return fmt.Errorf("invalid windows: %w", err)
+	}
+	return nil
+}
+
+// describeLimits describes a limit and its extra windows, e.g.
+// "10 per 1s, 1000 per 1h0m0s"
+func describeLimits(limit int, window time.Duration, windows []domain.WindowLimit) string {
+	described := fmt.Sprintf("%d per %s", limit, window)
+	for _, w := range windows {
+		described += fmt.Sprintf(", %d per %s", w.Limit, w.Window)
+	}
+	return described
+}
+
+// CheckSecurityRules checks the rules file at path, a JSON array of rule
+// engine rules as the body of POST /api/v1/rules. Every rule must pass the
+// rule engine's validation and have an ID of its own, and its rate_limit
+// actions must set a limit the rate limiter takes: such actions are skipped
+// when a request matches them otherwise.
+func CheckSecurityRules(r *Report, path string) {
+	var rules []ruleDomain.Rule
+	if !readRules(r, path, &rules) {
+		return
+	}
+
+	engine := ruleEngine.NewRuleEngine(ruleInfra.NewInMemoryRuleRepository(), ruleInfra.NewSimpleEventPublisher())
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		name := fmt.Sprintf("%s rule %d (%s)", path, i, rule.Name)
+		if rule.ID != "" {
+			name = fmt.Sprintf("%s rule %s", path, rule.ID)
+			if seen[rule.ID] {
+				r.Add(name, errors.New("another rule of the file has the same ID"), "")
+				continue
+			}
+			seen[rule.ID] = true
+		}
+
+		if err := engine.ValidateRule(rule); err != nil {
+			r.Add(name, err, "")
+			continue
+		}
+		r.Add(name, checkActions(rule.Actions), "")
+	}
+}
+
+// checkActions checks the rate_limit actions of a rule engine rule
+func checkActions(actions []ruleDomain.RuleAction) error {
+	for i, action := range actions {
+		if action.Type != "rate_limit" {
+			continue
+		}
+
+		limit, err := intParameter(action.Parameters["limit"])
+		if err != nil {
+			return fmt.Errorf("action %d: invalid limit: %w", i, err)
+		}
+		window, err := durationParameter(action.Parameters["window"])
+		if err != nil {
+			return fmt.Errorf("action %d: invalid window: %w", i, err)
+		}
+		algorithm, _ := action.Parameters["algorithm"].(string)
+		keyTemplate, _ := action.Parameters["key"].(string)
+		softThreshold, _ := action.Parameters["soft_threshold"].(float64)
+		parameters, err := domain.ParseAlgorithmParameters(action.Parameters["parameters"])
+		if err != nil {
+			return fmt.Errorf("action %d: invalid parameters: %w", i, err)
+		}
+		if _, _, err := resolveParameters(parameters, algorithm, limit, window); err != nil {
+			return fmt.Errorf("action %d: %w", i, err)
+		}
+		windows, err := domain.ParseWindowLimits(action.Parameters["windows"])
+		if err != nil {
+			return fmt.Errorf("action %d: invalid windows: %w", i, err)
+		}
+		if err := checkWindows(window, windows); err != nil {
+			return fmt.Errorf("action %d: %w", i, err)
+		}
+		if err := checkLimit(limit, window, algorithm, keyTemplate, softThreshold); err != nil {
+			return fmt.Errorf("action %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// checkLimit checks the settings of a rate limit
+func checkLimit(limit int, window time.Duration, algorithm, keyTemplate string, softThreshold float64) error {
+	switch {
+	case limit <= 0:
+		return fmt.Errorf("limit %d must be positive", limit)
+	case window <= 0:
+		return errors.New("window must be positive")
+	case algorithm != "" && !slices.Contains(algorithms, domain.Algorithm(algorithm)):
+		return fmt.Errorf("unknown algorithm %q", algorithm)
+	case softThreshold < 0 || softThreshold > 1:
+		return fmt.Errorf("soft threshold %g must be between 0 and 1", softThreshold)
+	}
+	if keyTemplate != "" {
+		if _, err := keytemplate.Parse(keyTemplate); err != nil {
+			return fmt.Errorf("invalid key template: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveParameters checks the algorithm parameters of a limit and returns
+// the limit and window they resolve to. Limits without an algorithm use the
+// sliding window, as the rate limiter does.
+func resolveParameters(parameters *domain.AlgorithmParameters, algorithm string, limit int, window time.Duration) (int, time.Duration, error) {
+	if algorithm == "" {
+		algorithm = string(domain.SlidingWindow)
+	}
+	limit, window, err := parameters.Resolve(domain.Algorithm(algorithm), limit, window)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid parameters: %w", err)
+	}
+	return limit, window, nil
+}
+
+// intParameter converts a limit as applyDynamicRateLimiting does
+func intParameter(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, errors.New("missing")
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("unexpected %T", v)
+}
+
+// durationParameter converts a window as applyDynamicRateLimiting does:
+// strings are durations and numbers seconds
+func durationParameter(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, errors.New("missing")
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		return time.ParseDuration(v)
+	}
+	return 0, fmt.Errorf("unexpected %T", v)
+}
+
+// readRules decodes the JSON array of rules in the file at path into
+// rules, recording a failed check when it cannot
+func readRules(r *Report, path string, rules interface{}) bool {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, rules)
+	}
+	if err != nil {
+		r.Add(path, err, "")
+		return false
+	}
+	return true
+}
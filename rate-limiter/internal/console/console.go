@@ -0,0 +1,28 @@
+// Package console serves the admin web console, a single page app embedded
+// in the binary. It runs entirely against the public APIs: the event stream
+// for live decisions, GraphQL for lookups and REST for changes.
+package console
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the console's files with the /console/ prefix stripped
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // The directory is embedded at build time
+	}
+	return http.StripPrefix("/console/", http.FileServer(http.FS(files)))
+}
+
+// RegisterRoutes adds the console to mux at /console
+func RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /console/", Handler())
+	mux.Handle("GET /console", http.RedirectHandler("/console/", http.StatusMovedPermanently))
+}
@@ -0,0 +1,483 @@
+// Admin console of the rate limiter. Everything shown comes from the public
+// APIs: /api/v1/events/stream for live decisions, /graphql for lookups and
+// the REST endpoints for changes. Values from the server are only ever
+// inserted as text.
+"use strict";
+
+const MAX_ROWS = 200;
+const BUCKET_MS = 10 * 1000;
+const BUCKETS = 30;
+
+// el creates an element with attributes and text or element children
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [name, value] of Object.entries(attrs || {})) {
+    if (name === "class") {
+      node.className = value;
+    } else if (name.startsWith("on")) {
+      node.addEventListener(name.slice(2), value);
+    } else {
+      node.setAttribute(name, value);
+    }
+  }
+  for (const child of children) {
+    if (child === null || child === undefined) {
+      continue;
+    }
+    node.append(child instanceof Node ? child : String(child));
+  }
+  return node;
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleTimeString() : "";
+}
+
+async function graphql(query, variables) {
+  const response = await fetch("/graphql", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ query, variables }),
+  });
+  if (!response.ok) {
+    throw new Error(await response.text());
+  }
+  const result = await response.json();
+  if (result.errors && result.errors.length) {
+    throw new Error(result.errors.map((e) => e.message).join("; "));
+  }
+  return result.data;
+}
+
+async function send(method, url, body) {
+  const response = await fetch(url, {
+    method,
+    headers: { "Content-Type": "application/json" },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const text = await response.text();
+  if (!response.ok) {
+    throw new Error(text.trim() || response.statusText);
+  }
+  return text ? JSON.parse(text) : null;
+}
+
+function showResult(node, error, message) {
+  node.textContent = error ? error.message : message;
+  node.className = error ? "result error" : "result";
+}
+
+// Tabs
+
+document.querySelectorAll("nav button").forEach((button) => {
+  button.addEventListener("click", () => {
+    document.querySelectorAll("nav button, .tab").forEach((n) => n.classList.remove("active"));
+    button.classList.add("active");
+    document.getElementById(button.dataset.tab).classList.add("active");
+    if (button.dataset.tab === "charts") {
+      drawCharts();
+    }
+  });
+});
+
+// Live decisions
+
+const live = {
+  rows: document.getElementById("live-rows"),
+  filter: document.getElementById("live-filter"),
+  blockedOnly: document.getElementById("live-blocked"),
+  paused: false,
+};
+
+function decision(type, event) {
+  const blocked = type === "RateLimitExceeded";
+  return {
+    time: event.timestamp,
+    clientID: event.client_id,
+    resource: event.resource,
+    blocked,
+    count: event.request_count,
+    limit: event.limit,
+    remaining: blocked ? 0 : event.remaining_quota,
+  };
+}
+
+function matches(d) {
+  const filter = live.filter.value.trim().toLowerCase();
+  if (live.blockedOnly.checked && !d.blocked) {
+    return false;
+  }
+  return !filter || d.clientID.toLowerCase().includes(filter) || d.resource.toLowerCase().includes(filter);
+}
+
+function addRow(d) {
+  if (live.paused || !matches(d)) {
+    return;
+  }
+  live.rows.prepend(el("tr", { class: d.blocked ? "blocked" : "" },
+    el("td", {}, formatTime(d.time)),
+    el("td", {}, d.clientID),
+    el("td", {}, d.resource),
+    el("td", {}, d.blocked ? "blocked" : "allowed"),
+    el("td", {}, d.count ?? ""),
+    el("td", {}, d.limit ?? ""),
+    el("td", {}, d.remaining ?? ""),
+  ));
+  while (live.rows.rows.length > MAX_ROWS) {
+    live.rows.lastChild.remove();
+  }
+}
+
+document.getElementById("live-pause").addEventListener("click", (e) => {
+  live.paused = !live.paused;
+  e.target.textContent = live.paused ? "Resume" : "Pause";
+});
+document.getElementById("live-clear").addEventListener("click", () => live.rows.replaceChildren());
+
+// Resource charts
+
+const buckets = new Map(); // resource -> Map(bucket start -> {allowed, blocked})
+
+function count(d) {
+  const start = Math.floor(Date.parse(d.time) / BUCKET_MS) * BUCKET_MS;
+  if (!buckets.has(d.resource)) {
+    buckets.set(d.resource, new Map());
+  }
+  const series = buckets.get(d.resource);
+  const bucket = series.get(start) || { allowed: 0, blocked: 0 };
+  bucket[d.blocked ? "blocked" : "allowed"]++;
+  series.set(start, bucket);
+}
+
+function drawCharts() {
+  const list = document.getElementById("chart-list");
+  if (!list.closest(".tab").classList.contains("active")) {
+    return;
+  }
+
+  const now = Math.floor(Date.now() / BUCKET_MS) * BUCKET_MS;
+  const first = now - (BUCKETS - 1) * BUCKET_MS;
+  const resources = [...buckets.keys()].sort();
+  if (!resources.length) {
+    list.replaceChildren(el("p", { class: "hint" }, "No decisions seen yet."));
+    return;
+  }
+
+  list.replaceChildren(...resources.map((resource) => {
+    const series = buckets.get(resource);
+    for (const start of series.keys()) {
+      if (start < first) {
+        series.delete(start);
+      }
+    }
+
+    let allowed = 0;
+    let blocked = 0;
+    const values = [];
+    for (let start = first; start <= now; start += BUCKET_MS) {
+      const bucket = series.get(start) || { allowed: 0, blocked: 0 };
+      allowed += bucket.allowed;
+      blocked += bucket.blocked;
+      values.push(bucket);
+    }
+
+    const canvas = el("canvas", { width: 900, height: 120 });
+    drawBars(canvas, values);
+    return el("div", { class: "chart" },
+      el("h3", {}, resource),
+      el("div", { class: "legend" },
+        el("span", { class: "allowed" }, `■ allowed ${allowed}`),
+        el("span", { class: "blocked" }, `■ blocked ${blocked}`),
+      ),
+      canvas,
+    );
+  }));
+}
+
+function drawBars(canvas, values) {
+  const ctx = canvas.getContext("2d");
+  const max = Math.max(1, ...values.map((v) => v.allowed + v.blocked));
+  const width = canvas.width / values.length;
+  const scale = (canvas.height - 14) / max;
+
+  ctx.font = "10px system-ui";
+  ctx.fillStyle = "#57606a";
+  ctx.fillText(String(max), 2, 10);
+  values.forEach((v, i) => {
+    const x = i * width + 1;
+    const allowedHeight = v.allowed * scale;
+    const blockedHeight = v.blocked * scale;
+    ctx.fillStyle = "#2da44e";
+    ctx.fillRect(x, canvas.height - allowedHeight, width - 2, allowedHeight);
+    ctx.fillStyle = "#cf222e";
+    ctx.fillRect(x, canvas.height - allowedHeight - blockedHeight, width - 2, blockedHeight);
+  });
+}
+
+setInterval(drawCharts, 1000);
+
+// Event stream
+
+function connect() {
+  const state = document.getElementById("stream-state");
+  const source = new EventSource("/api/v1/events/stream");
+  source.onopen = () => {
+    state.textContent = "live";
+    state.className = "state live";
+  };
+  source.onerror = () => {
+    state.textContent = "reconnecting";
+    state.className = "state down";
+  };
+  for (const type of ["RateLimitApplied", "RateLimitExceeded"]) {
+    source.addEventListener(type, (message) => {
+      const d = decision(type, JSON.parse(message.data));
+      count(d);
+      addRow(d);
+    });
+  }
+}
+
+connect();
+
+// Rules
+
+const ruleForm = document.getElementById("rule-form");
+const ruleFields = ruleForm.elements; // Not ruleForm itself, whose method property is the form's
+const ruleResult = document.getElementById("rule-result");
+
+async function showRules(resource) {
+  const rows = document.getElementById("rule-rows");
+  try {
+    const data = await graphql(`query ($resource: String!) {
+      rules(resource: $resource) {
+        resource method limit window windows { limit window } algorithm parameters key_template soft_threshold flag description owner change_ref updated_at last_modified_by
+      }
+    }`, { resource });
+    if (!data.rules.length) {
+      rows.replaceChildren(el("tr", {}, el("td", { colspan: 12 }, `No rules for ${resource}.`)));
+      return;
+    }
+    rows.replaceChildren(...data.rules.map((rule) => el("tr", { class: "selectable", onclick: () => editRule(rule) },
+      el("td", {}, rule.resource),
+      el("td", {}, rule.method || "any"),
+      el("td", {}, rule.limit),
+      el("td", {}, rule.window),
+      el("td", {}, formatWindows(rule.windows)),
+      el("td", { title: rule.parameters || "" }, rule.algorithm),
+      el("td", {}, rule.key_template || ""),
+      el("td", {}, rule.soft_threshold || ""),
+      el("td", {}, rule.flag || ""),
+      el("td", { title: rule.description || "" }, rule.owner || ""),
+      el("td", { title: rule.change_ref || "" }, formatTime(rule.updated_at)),
+      el("td", {}, rule.last_modified_by || ""),
+    )));
+  } catch (error) {
+    rows.replaceChildren(el("tr", {}, el("td", { colspan: 12, class: "result error" }, error.message)));
+  }
+}
+
+function editRule(rule) {
+  ruleFields.resource.value = rule.resource;
+  ruleFields.method.value = rule.method || "";
+  ruleFields.limit.value = rule.limit;
+  ruleFields.window.value = rule.window;
+  ruleFields.algorithm.value = rule.algorithm;
+  ruleFields.parameters.value = rule.parameters || "";
+  ruleFields.windows.value = formatWindows(rule.windows);
+  ruleFields.key_template.value = rule.key_template || "";
+  ruleFields.soft_threshold.value = rule.soft_threshold || "";
+  ruleFields.flag.value = rule.flag || "";
+  ruleFields.description.value = rule.description || "";
+  ruleFields.owner.value = rule.owner || "";
+  ruleFields.change_ref.value = ""; // Each change gets its own reference
+}
+
+// formatWindows lists the extra windows of a rule as "limit/window" pairs,
+// the form the rule form takes them in
+function formatWindows(windows) {
+  return (windows || []).map((w) => `${w.limit}/${w.window}`).join(", ");
+}
+
+// parseWindows reads the extra windows of the rule form, e.g. "1000/1h, 20000/24h"
+function parseWindows(text) {
+  return text.split(",").map((pair) => pair.trim()).filter(Boolean).map((pair) => {
+    const [limit, window] = pair.split("/").map((part) => part.trim());
+    if (!Number(limit) || !window) {
+      throw new Error(`Extra window "${pair}" is not of the form limit/window, e.g. 1000/1h`);
+    }
+    return { limit: Number(limit), window };
+  });
+}
+
+document.getElementById("rule-lookup").addEventListener("submit", (e) => {
+  e.preventDefault();
+  showRules(e.target.resource.value.trim());
+});
+
+ruleForm.addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const method = e.submitter ? e.submitter.value : "PUT";
+  let parameters;
+  try {
+    parameters = ruleFields.parameters.value.trim() ? JSON.parse(ruleFields.parameters.value) : undefined;
+  } catch (error) {
+    showResult(ruleResult, new Error(`Parameters are not valid JSON: ${error.message}`));
+    return;
+  }
+  let windows;
+  try {
+    windows = parseWindows(ruleFields.windows.value);
+  } catch (error) {
+    showResult(ruleResult, error);
+    return;
+  }
+  const rule = {
+    resource: ruleFields.resource.value.trim(),
+    method: ruleFields.method.value.trim(),
+    limit: Number(ruleFields.limit.value),
+    window: ruleFields.window.value.trim(),
+    algorithm: ruleFields.algorithm.value,
+    parameters,
+    windows,
+    key_template: ruleFields.key_template.value.trim(),
+    soft_threshold: Number(ruleFields.soft_threshold.value) || 0,
+    flag: ruleFields.flag.value.trim(),
+    description: ruleFields.description.value.trim(),
+    owner: ruleFields.owner.value.trim(),
+    change_ref: ruleFields.change_ref.value.trim(),
+  };
+  try {
+    await send(method, "/api/v1/ratelimit/rules", rule);
+    showResult(ruleResult, null, method === "PUT" ? "Rule applied." : "Rule created.");
+    document.getElementById("rule-lookup").resource.value = rule.resource;
+    showRules(rule.resource);
+  } catch (error) {
+    showResult(ruleResult, error);
+  }
+});
+
+// Clients
+
+const clientDetail = document.getElementById("client-detail");
+
+async function showClient(id) {
+  try {
+    const data = await graphql(`query ($id: String!) {
+      client(id: $id) {
+        id registered name tier tags contact disabled first_seen last_seen
+        total_requests blocked_requests allowed_requests
+        resources {
+          resource total_requests blocked_rate
+          status { limit remaining_quota reset_time is_blocked blocked_until request_rate exhausts_at warning }
+          history(limit: 10) { events { event_type timestamp request_count limit is_blocked } }
+          rules { method limit window algorithm }
+        }
+      }
+    }`, { id });
+    if (!data.client) {
+      clientDetail.replaceChildren(el("p", { class: "hint" }, `No client ${id} is registered or has been seen.`));
+      return;
+    }
+    clientDetail.replaceChildren(clientCard(data.client), ...data.client.resources.map(resourceCard));
+  } catch (error) {
+    clientDetail.replaceChildren(el("p", { class: "result error" }, error.message));
+  }
+}
+
+function details(pairs) {
+  const list = el("dl");
+  for (const [name, value] of pairs) {
+    if (value !== null && value !== undefined && value !== "") {
+      list.append(el("dt", {}, name), el("dd", {}, value));
+    }
+  }
+  return list;
+}
+
+function clientCard(client) {
+  const result = el("p", { class: "result" });
+  const toggle = client.registered
+    ? el("button", {
+      onclick: async () => {
+        try {
+          await send("POST", `/api/v1/clients/${encodeURIComponent(client.id)}/${client.disabled ? "enable" : "disable"}`);
+          showClient(client.id);
+        } catch (error) {
+          showResult(result, error);
+        }
+      },
+    }, client.disabled ? "Enable" : "Disable")
+    : null;
+
+  return el("div", { class: "card" },
+    el("h3", {}, client.id),
+    details([
+      ["Registered", client.registered ? "yes" : "no"],
+      ["Name", client.name],
+      ["Tier", client.tier],
+      ["Tags", (client.tags || []).join(", ")],
+      ["Contact", client.contact],
+      ["Disabled", client.registered ? (client.disabled ? "yes" : "no") : null],
+      ["First seen", client.first_seen && new Date(client.first_seen).toLocaleString()],
+      ["Last seen", client.last_seen && new Date(client.last_seen).toLocaleString()],
+      ["Requests (24h)", `${client.total_requests} (${client.blocked_requests} blocked)`],
+    ]),
+    toggle,
+    result,
+  );
+}
+
+function resourceCard(resource) {
+  const status = resource.status || {};
+  const events = (resource.history && resource.history.events) || [];
+  return el("div", { class: "card" },
+    el("h3", {}, resource.resource),
+    details([
+      ["Rules", resource.rules.map((r) => `${r.limit} per ${r.window} (${r.algorithm}${r.method ? ", " + r.method : ""})`).join("; ") || "none"],
+      ["Quota", `${status.remaining_quota} of ${status.limit} remaining`],
+      ["Resets", formatTime(status.reset_time)],
+      ["Blocked until", status.is_blocked ? formatTime(status.blocked_until) : null],
+      ["Request rate", status.request_rate ? `${status.request_rate.toFixed(2)}/s` : null],
+      ["Exhausts at", formatTime(status.exhausts_at)],
+      ["Warning", status.warning],
+      ["Blocked rate", `${(resource.blocked_rate * 100).toFixed(1)}%`],
+    ]),
+    el("table", {},
+      el("thead", {}, el("tr", {}, el("th", {}, "Time"), el("th", {}, "Event"), el("th", {}, "Count"), el("th", {}, "Limit"))),
+      el("tbody", {}, ...events.map((e) => el("tr", { class: e.is_blocked ? "blocked" : "" },
+        el("td", {}, formatTime(e.timestamp)),
+        el("td", {}, e.event_type),
+        el("td", {}, e.request_count ?? ""),
+        el("td", {}, e.limit ?? ""),
+      ))),
+    ),
+  );
+}
+
+async function listClients() {
+  try {
+    const data = await graphql(`{ clients(sort: "last_seen") { id registered tier last_seen total_requests blocked_requests } }`);
+    clientDetail.replaceChildren(el("table", {},
+      el("thead", {}, el("tr", {},
+        el("th", {}, "Client"), el("th", {}, "Registered"), el("th", {}, "Tier"),
+        el("th", {}, "Last seen"), el("th", {}, "Requests (24h)"), el("th", {}, "Blocked"))),
+      el("tbody", {}, ...data.clients.map((c) => el("tr", { class: "selectable", onclick: () => showClient(c.id) },
+        el("td", {}, c.id),
+        el("td", {}, c.registered ? "yes" : "no"),
+        el("td", {}, c.tier || ""),
+        el("td", {}, formatTime(c.last_seen)),
+        el("td", {}, c.total_requests),
+        el("td", {}, c.blocked_requests),
+      ))),
+    ));
+  } catch (error) {
+    clientDetail.replaceChildren(el("p", { class: "result error" }, error.message));
+  }
+}
+
+document.getElementById("client-lookup").addEventListener("submit", (e) => {
+  e.preventDefault();
+  showClient(e.target.client_id.value.trim());
+});
+document.getElementById("client-list").addEventListener("click", listClients);
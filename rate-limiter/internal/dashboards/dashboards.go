@@ -0,0 +1,248 @@
+package dashboards
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DefaultDatasource is the Prometheus datasource the dashboards query unless
+// another is chosen when importing them
+const DefaultDatasource = "Prometheus"
+
+// Dashboard is a Grafana dashboard, in the JSON model Grafana imports
+type Dashboard struct {
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Tags          []string   `json:"tags"`
+	Timezone      string     `json:"timezone"`
+	Refresh       string     `json:"refresh"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Time          TimeRange  `json:"time"`
+	Templating    Templating `json:"templating"`
+	Panels        []Panel    `json:"panels"`
+}
+
+// TimeRange is the default time range of a dashboard
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Templating holds the variables of a dashboard
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+// Variable is a dashboard variable, either the datasource or the values of
+// a metric label
+type Variable struct {
+	Name       string      `json:"name"`
+	Label      string      `json:"label"`
+	Type       string      `json:"type"`
+	Query      string      `json:"query"`
+	Datasource *Datasource `json:"datasource,omitempty"`
+	Current    *Current    `json:"current,omitempty"`
+	Refresh    int         `json:"refresh,omitempty"`
+	Multi      bool        `json:"multi,omitempty"`
+	IncludeAll bool        `json:"includeAll,omitempty"`
+	AllValue   string      `json:"allValue,omitempty"`
+}
+
+// Current is the selected value of a variable
+type Current struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// Datasource refers to a datasource, or to the datasource variable
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// Panel is a dashboard panel
+type Panel struct {
+	ID          int         `json:"id"`
+	Title       string      `json:"title"`
+	Description string      `json:"description,omitempty"`
+	Type        string      `json:"type"`
+	Datasource  *Datasource `json:"datasource,omitempty"`
+	GridPos     GridPos     `json:"gridPos"`
+	Targets     []Target    `json:"targets,omitempty"`
+	FieldConfig FieldConfig `json:"fieldConfig"`
+}
+
+// GridPos places a panel on the 24 column grid of a dashboard
+type GridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// Target is a Prometheus query of a panel
+type Target struct {
+	RefID        string      `json:"refId"`
+	Expr         string      `json:"expr"`
+	LegendFormat string      `json:"legendFormat"`
+	Datasource   *Datasource `json:"datasource,omitempty"`
+}
+
+// FieldConfig sets how a panel shows its values
+type FieldConfig struct {
+	Defaults FieldDefaults `json:"defaults"`
+	// Overrides are always empty, but Grafana expects the list
+	Overrides []any `json:"overrides"`
+}
+
+// FieldDefaults are the unit and bounds of the values of a panel
+type FieldDefaults struct {
+	Unit string   `json:"unit,omitempty"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+}
+
+// Builder returns a dashboard
+type Builder func() Dashboard
+
+// registry holds the dashboards that can be exported, by name
+var registry = map[string]Builder{
+	"decisions": Decisions,
+	"internals": Internals,
+}
+
+// Names returns the names of the dashboards, sorted
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the dashboard named name
+func Get(name string) (Dashboard, error) {
+	build, ok := registry[name]
+	if !ok {
+		return Dashboard{}, fmt.Errorf("unknown dashboard %q", name)
+	}
+	return build(), nil
+}
+
+// Export returns the dashboard as indented JSON, querying the Prometheus
+// datasource named datasource by default
+func Export(dashboard Dashboard, datasource string) ([]byte, error) {
+	if datasource == "" {
+		datasource = DefaultDatasource
+	}
+	for i, variable := range dashboard.Templating.List {
+		if variable.Type == "datasource" {
+			dashboard.Templating.List[i].Current = &Current{Text: datasource, Value: datasource}
+		}
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// datasourceRef refers panels and variables to the datasource variable
+var datasourceRef = &Datasource{Type: "prometheus", UID: "${datasource}"}
+
+// newDashboard creates a dashboard with the datasource variable
+func newDashboard(uid, title string) Dashboard {
+	return Dashboard{
+		UID:           uid,
+		Title:         title,
+		Tags:          []string{"rate-limiter"},
+		Timezone:      "browser",
+		Refresh:       "30s",
+		SchemaVersion: 39,
+		Time:          TimeRange{From: "now-1h", To: "now"},
+		Templating: Templating{List: []Variable{{
+			Name:  "datasource",
+			Label: "Datasource",
+			Type:  "datasource",
+			Query: "prometheus",
+		}}},
+	}
+}
+
+// labelVariable creates a variable over the values of a label of metric,
+// allowing several or all of them to be selected
+func labelVariable(name, label, metric string) Variable {
+	return Variable{
+		Name:       name,
+		Label:      label,
+		Type:       "query",
+		Query:      fmt.Sprintf("label_values(%s, %s)", metric, name),
+		Datasource: datasourceRef,
+		Refresh:    2,
+		Multi:      true,
+		IncludeAll: true,
+		AllValue:   ".*",
+	}
+}
+
+// panelLayout places panels in rows of the given width
+type panelLayout struct {
+	panels []Panel
+	x, y   int
+	height int
+}
+
+// add places a panel of width w and height h after the previous one, on a
+// new row if it does not fit
+func (l *panelLayout) add(panel Panel, w, h int) {
+	if l.x+w > 24 {
+		l.x = 0
+		l.y += l.height
+		l.height = 0
+	}
+	panel.ID = len(l.panels) + 1
+	panel.Datasource = datasourceRef
+	panel.GridPos = GridPos{X: l.x, Y: l.y, W: w, H: h}
+	if panel.FieldConfig.Overrides == nil {
+		panel.FieldConfig.Overrides = []any{}
+	}
+	for i := range panel.Targets {
+		panel.Targets[i].RefID = string(rune('A' + i))
+		panel.Targets[i].Datasource = datasourceRef
+	}
+	l.panels = append(l.panels, panel)
+	l.x += w
+	l.height = max(l.height, h)
+}
+
+// timeseries creates a time series panel of the queries
+func timeseries(title, description, unit string, targets ...Target) Panel {
+	return Panel{
+		Title:       title,
+		Description: description,
+		Type:        "timeseries",
+		Targets:     targets,
+		FieldConfig: FieldConfig{Defaults: FieldDefaults{Unit: unit}},
+	}
+}
+
+// stat creates a single value panel of the query
+func stat(title, description, unit string, target Target) Panel {
+	return Panel{
+		Title:       title,
+		Description: description,
+		Type:        "stat",
+		Targets:     []Target{target},
+		FieldConfig: FieldConfig{Defaults: FieldDefaults{Unit: unit}},
+	}
+}
+
+// query creates a target with the legend format
+func query(expr, legend string) Target {
+	return Target{Expr: expr, LegendFormat: legend}
+}
+
+// bounded sets the minimum and maximum values of a panel
+func bounded(panel Panel, min, max float64) Panel {
+	panel.FieldConfig.Defaults.Min = &min
+	panel.FieldConfig.Defaults.Max = &max
+	return panel
+}
@@ -0,0 +1,87 @@
+package dashboards
+
+// decisionsMetric counts rate limit decisions by resource, tenant,
+// algorithm and decision
+const decisionsMetric = "rate_limiter_decisions_total"
+
+// decisionSelector selects the decisions of the resources, tenants and
+// algorithms chosen in the dashboard variables
+const decisionSelector = `resource=~"$resource", tenant=~"$tenant", algorithm=~"$algorithm"`
+
+// Decisions returns the dashboard of rate limit decisions, broken down by
+// resource, tenant, algorithm and decision
+func Decisions() Dashboard {
+	dashboard := newDashboard("rate-limiter-decisions", "Rate Limiter / Decisions")
+	dashboard.Templating.List = append(dashboard.Templating.List,
+		labelVariable("resource", "Resource", decisionsMetric),
+		labelVariable("tenant", "Tenant", decisionsMetric),
+		labelVariable("algorithm", "Algorithm", decisionsMetric),
+	)
+
+	var layout panelLayout
+	layout.add(stat("Decisions per second", "Rate of all decisions of the selection.", "reqps",
+		query(`sum(rate(`+decisionsMetric+`{`+decisionSelector+`}[$__rate_interval]))`, "decisions")), 6, 4)
+	layout.add(stat("Allowed per second", "Rate of allowed decisions of the selection.", "reqps",
+		query(`sum(rate(`+decisionsMetric+`{`+decisionSelector+`, decision="allowed"}[$__rate_interval]))`, "allowed")), 6, 4)
+	layout.add(stat("Blocked per second", "Rate of blocked decisions of the selection.", "reqps",
+		query(`sum(rate(`+decisionsMetric+`{`+decisionSelector+`, decision="blocked"}[$__rate_interval]))`, "blocked")), 6, 4)
+	layout.add(bounded(stat("Blocked ratio", "Share of the decisions of the selection that were blocked.", "percentunit",
+		query(blockedRatio(""), "blocked")), 0, 1), 6, 4)
+
+	layout.add(timeseries("Decisions by decision", "Allowed and blocked decisions per second.", "reqps",
+		query(`sum by (decision) (rate(`+decisionsMetric+`{`+decisionSelector+`}[$__rate_interval]))`, "{{decision}}")), 12, 8)
+	layout.add(bounded(timeseries("Blocked ratio by resource", "Share of the decisions of each resource that were blocked.", "percentunit",
+		query(blockedRatio("resource"), "{{resource}}")), 0, 1), 12, 8)
+
+	layout.add(timeseries("Decisions by resource", "Decisions per second of each resource and decision.", "reqps",
+		query(`sum by (resource, decision) (rate(`+decisionsMetric+`{`+decisionSelector+`}[$__rate_interval]))`, "{{resource}} {{decision}}")), 12, 8)
+	layout.add(timeseries("Blocked by tenant", "Blocked decisions per second of each tenant, the tier of the client.", "reqps",
+		query(`sum by (tenant) (rate(`+decisionsMetric+`{`+decisionSelector+`, decision="blocked"}[$__rate_interval]))`, "{{tenant}}")), 12, 8)
+
+	layout.add(timeseries("Decisions by tenant", "Decisions per second of each tenant and decision.", "reqps",
+		query(`sum by (tenant, decision) (rate(`+decisionsMetric+`{`+decisionSelector+`}[$__rate_interval]))`, "{{tenant}} {{decision}}")), 12, 8)
+	layout.add(timeseries("Decisions by algorithm", "Decisions per second of each algorithm and decision.", "reqps",
+		query(`sum by (algorithm, decision) (rate(`+decisionsMetric+`{`+decisionSelector+`}[$__rate_interval]))`, "{{algorithm}} {{decision}}")), 12, 8)
+
+	dashboard.Panels = layout.panels
+	return dashboard
+}
+
+// blockedRatio returns the query of the share of decisions blocked, by the
+// label if one is given
+func blockedRatio(by string) string {
+	sum := "sum"
+	if by != "" {
+		sum = "sum by (" + by + ")"
+	}
+	return sum + ` (rate(` + decisionsMetric + `{` + decisionSelector + `, decision="blocked"}[$__rate_interval]))` +
+		` / ` + sum + ` (rate(` + decisionsMetric + `{` + decisionSelector + `}[$__rate_interval]))`
+}
+
+// Internals returns the dashboard of the event store, event bus and
+// projection behind the decisions
+func Internals() Dashboard {
+	dashboard := newDashboard("rate-limiter-internals", "Rate Limiter / Internals")
+
+	var layout panelLayout
+	layout.add(timeseries("Projection lag", "Age of the oldest event not yet projected into the read model.", "s",
+		query(`max(rate_limiter_projection_lag_seconds)`, "lag")), 12, 8)
+	layout.add(timeseries("Projection backlog", "Events stored but not yet projected.", "short",
+		query(`max(rate_limiter_projection_pending_events)`, "pending"),
+		query(`max(rate_limiter_projection_catching_up)`, "catching up")), 12, 8)
+
+	layout.add(timeseries("Event bus delivery", "Events delivered to and dropped by subscribers per second.", "ops",
+		query(`sum(rate(rate_limiter_event_bus_delivered_total[$__rate_interval]))`, "delivered"),
+		query(`sum(rate(rate_limiter_event_bus_dropped_total[$__rate_interval]))`, "dropped")), 12, 8)
+	layout.add(timeseries("Event bus queue", "Events queued for subscribers.", "short",
+		query(`sum(rate_limiter_event_bus_queued_events)`, "queued")), 12, 8)
+
+	layout.add(timeseries("Aggregate keys", "Rate limit keys held in the event store, against the limit.", "short",
+		query(`sum(rate_limiter_aggregate_keys)`, "keys"),
+		query(`sum(rate_limiter_aggregate_keys_max)`, "max")), 12, 8)
+	layout.add(timeseries("Key evictions", "Least recently used keys evicted per second.", "ops",
+		query(`sum(rate(rate_limiter_aggregate_key_evictions_total[$__rate_interval]))`, "evictions")), 12, 8)
+
+	dashboard.Panels = layout.panels
+	return dashboard
+}
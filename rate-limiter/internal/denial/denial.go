@@ -0,0 +1,246 @@
+// Package denial renders the bodies of responses to denied requests from
+// templates configured by operators, such as a JSON error in the format of
+// their API or an HTML page pointing to their support, instead of the raw
+// rate limit status. Templates are chosen by resource and client tier.
+package denial
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+)
+
+// Template formats
+const (
+	FormatJSON = "json" // A JSON document, written as application/json
+	FormatHTML = "html" // An HTML page, written as text/html
+)
+
+// Vars are what a denied response is rendered with
+type Vars struct {
+	ClientID   string
+	Resource   string
+	Tenant     string // The tier of a registered client
+	Limit      int
+	Remaining  int
+	RetryAfter int // Seconds
+	ResetAt    time.Time
+	Reason     string
+	ContactURL string // Set from the template's configuration
+}
+
+// data returns the variables templates see, named as in the rate limit status
+func (v Vars) data() map[string]interface{} {
+	resetAt := ""
+	if !v.ResetAt.IsZero() {
+		resetAt = v.ResetAt.UTC().Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"client_id":   v.ClientID,
+		"resource":    v.Resource,
+		"tenant":      v.Tenant,
+		"limit":       v.Limit,
+		"remaining":   v.Remaining,
+		"retry_after": v.RetryAfter,
+		"reset_at":    resetAt,
+		"reason":      v.Reason,
+		"contact_url": v.ContactURL,
+	}
+}
+
+// executor is what text and HTML templates have in common
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// Template renders the body of denied responses
+type Template struct {
+	format     string
+	contactURL string
+	executor   executor
+}
+
+// funcs are the functions of JSON templates; json quotes a value, so that
+// strings such as the reason cannot break the document
+var funcs = texttemplate.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Parse parses a template of format, which must render valid JSON for
+// FormatJSON. HTML templates escape variables as HTML. contactURL is
+// rendered as contact_url.
+func Parse(format, text, contactURL string) (*Template, error) {
+	t := &Template{format: format, contactURL: contactURL}
+	var err error
+	switch format {
+	case FormatJSON:
+		t.executor, err = texttemplate.New("denied").Funcs(funcs).Option("missingkey=error").Parse(text)
+	case FormatHTML:
+		t.executor, err = htmltemplate.New("denied").Option("missingkey=error").Parse(text)
+	default:
+		return nil, fmt.Errorf("unknown template format %q, expected json or html", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Render a sample, so that unknown variables and invalid JSON fail here
+	// rather than on the first denial
+	sample := Vars{ClientID: "client", Resource: "resource", Limit: 1, RetryAfter: 1, ResetAt: time.Unix(0, 0), Reason: "rate limit exceeded"}
+	if _, err := t.Render(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ContentType returns the content type of rendered bodies
+func (t *Template) ContentType() string {
+	if t.format == FormatHTML {
+		return "text/html; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// Render renders the body of a denied response with vars
+func (t *Template) Render(vars Vars) ([]byte, error) {
+	vars.ContactURL = t.contactURL
+
+	var buf bytes.Buffer
+	if err := t.executor.Execute(&buf, vars.data()); err != nil {
+		return nil, fmt.Errorf("failed to render denied response: %w", err)
+	}
+	if t.format == FormatJSON && !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("denied response template rendered invalid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// Write renders the response with vars and writes it with statusCode. It
+// returns false without writing anything when rendering fails, so that the
+// caller can fall back to its default body.
+func (t *Template) Write(w http.ResponseWriter, statusCode int, vars Vars) bool {
+	body, err := t.Render(vars)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", t.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+	w.Write(body)
+	return true
+}
+
+// Templates are the templates of denied responses by resource and tenant.
+// A nil *Templates has none.
+type Templates struct {
+	templates map[scope]*Template
+	tenants   bool
+}
+
+// scope is what a template applies to; empty fields match everything
+type scope struct {
+	resource string
+	tenant   string
+}
+
+// Select returns the template of a denial of resource for a client of
+// tenant, or nil when there is none. A template of both the resource and
+// the tenant is preferred to one of the resource, then to one of the tenant,
+// then to the default template of neither.
+func (t *Templates) Select(resource, tenant string) *Template {
+	if t == nil {
+		return nil
+	}
+	for _, s := range []scope{{resource, tenant}, {resource, ""}, {"", tenant}, {"", ""}} {
+		if template, ok := t.templates[s]; ok {
+			return template
+		}
+	}
+	return nil
+}
+
+// Tenanted reports whether any template is chosen by tenant, i.e. whether
+// callers need to look up the tenant of denied clients
+func (t *Templates) Tenanted() bool {
+	return t != nil && t.tenants
+}
+
+// file is the configuration file of templates
+type file struct {
+	ContactURL string      `json:"contact_url"` // Default of templates without their own
+	Templates  []fileEntry `json:"templates"`
+}
+
+// fileEntry configures one template. Its text is either inline in Body or
+// in File, relative to the configuration file.
+type fileEntry struct {
+	Resource   string `json:"resource,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	Format     string `json:"format,omitempty"` // Defaults to html for .html files and json otherwise
+	Body       string `json:"body,omitempty"`
+	File       string `json:"file,omitempty"`
+	ContactURL string `json:"contact_url,omitempty"`
+}
+
+// Load loads templates from the JSON configuration file at path
+func Load(path string) (*Templates, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read denied response templates: %w", err)
+	}
+	var config file
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("invalid denied response templates %s: %w", path, err)
+	}
+
+	templates := &Templates{templates: make(map[scope]*Template)}
+	for i, entry := range config.Templates {
+		text := entry.Body
+		if entry.File != "" {
+			name := entry.File
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			b, err := os.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("template %d: %w", i, err)
+			}
+			text = string(b)
+		}
+
+		format := entry.Format
+		if format == "" {
+			format = FormatJSON
+			if ext := filepath.Ext(entry.File); ext == ".html" || ext == ".htm" {
+				format = FormatHTML
+			}
+		}
+		contactURL := entry.ContactURL
+		if contactURL == "" {
+			contactURL = config.ContactURL
+		}
+
+		template, err := Parse(format, text, contactURL)
+		if err != nil {
+			return nil, fmt.Errorf("template %d: %w", i, err)
+		}
+		s := scope{resource: entry.Resource, tenant: entry.Tenant}
+		if _, exists := templates.templates[s]; exists {
+			return nil, fmt.Errorf("template %d: duplicate template for resource %q and tenant %q", i, entry.Resource, entry.Tenant)
+		}
+		templates.templates[s] = template
+		templates.tenants = templates.tenants || entry.Tenant != ""
+	}
+	return templates, nil
+}
@@ -1,18 +1,161 @@
 package domain
 
 import (
+	"errors"
+	"math"
+	"strings"
 	"time"
 )
 
+// ErrRuleNotFound is returned for a rule that does not exist
+var ErrRuleNotFound = errors.New("rule not found")
+
 // RateLimitRule defines the rate limiting configuration
 type RateLimitRule struct {
-	ID           string        `json:"id"`
-	Resource     string        `json:"resource"`
-	Limit        int           `json:"limit"`
-	Window       time.Duration `json:"window"`
-	Algorithm    Algorithm     `json:"algorithm"`
-	CreatedAt    time.Time     `json:"created_at"`
-	UpdatedAt    time.Time     `json:"updated_at"`
+	ID            string               `json:"id"`
+	Resource      string               `json:"resource"`
+	Limit         int                  `json:"limit"`
+	Window        time.Duration        `json:"window"`
+	Algorithm     Algorithm            `json:"algorithm"`
+	Method        string               `json:"method,omitempty"`         // HTTP method the rule applies to; any method when empty
+	KeyTemplate   string               `json:"key_template,omitempty"`   // Builds the limit key from request attributes; client_id when empty
+	SoftThreshold float64              `json:"soft_threshold,omitempty"` // Fraction of Limit at which clients are warned, e.g. 0.8; no warning when zero
+	Parameters    *AlgorithmParameters `json:"parameters,omitempty"`     // Settings of the algorithm beyond Limit and Window; resolved into them for buckets
+	Windows       []WindowLimit        `json:"windows,omitempty"`        // Further limits over other windows, enforced with Limit per Window
+	Flag          string               `json:"flag,omitempty"`           // Feature flag gating the rule, enforced only for clients the flag is on for; always enforced when empty
+	CreatedAt     time.Time            `json:"created_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
+	
+	RuleAnnotations
+}
+
+// RuleAnnotations describe who answers for a rule and who changed it last
+// and why, for audits
+type RuleAnnotations struct {
+	Description    string `json:"description,omitempty"`
+	Owner          string `json:"owner,omitempty"`            // Team or person answerable for the rule
+	ChangeRef      string `json:"change_ref,omitempty"`       // Ticket or change request of the last change
+	CreatedBy      string `json:"created_by,omitempty"`       // Authenticated principal that created the rule
+	LastModifiedBy string `json:"last_modified_by,omitempty"` // Authenticated principal of the last change
+}
+
+// StateResource returns the resource the rule's counters are kept under
+func (r RateLimitRule) StateResource() string {
+	return ScopedResource(r.Resource, r.Method)
+}
+
+// SoftLimit returns the number of requests in the quota at which the rule's
+// soft threshold is reached, or 0 when the rule has none
+func (r RateLimitRule) SoftLimit() int {
+	if r.SoftThreshold <= 0 || r.Limit <= 0 {
+		return 0
+	}
+	return int(math.Ceil(r.SoftThreshold * float64(r.Limit)))
+}
+
+// ReachesSoftLimit reports whether the request recorded by event took the
+// usage of its quota to the soft limit. Every allowed request uses one
+// request of the quota, so only the request crossing the threshold reaches
+// it; usage has to fall below the threshold before it is reached again.
+func ReachesSoftLimit(event *RateLimitAppliedEvent) bool {
+	return event.SoftLimit > 0 && event.Limit-event.RemainingQuota == event.SoftLimit
+}
+
+// ScopedResource returns the resource limited by a method-specific rule, e.g.
+// "orders:POST", or the resource itself when method is empty
+func ScopedResource(resource, method string) string {
+	if method == "" {
+		return resource
+	}
+	return resource + ":" + strings.ToUpper(method)
+}
+
+// SelectRule picks the rule of a resource that applies to method: the rule
+// for exactly that method, or else the rule for any method
+func SelectRule(rules []RateLimitRule, method string) (RateLimitRule, bool) {
+	i := SelectRuleIndex(rules, method)
+	if i < 0 {
+		return RateLimitRule{}, false
+	}
+	return rules[i], true
+}
+
+// SelectRuleIndex returns the index of the rule SelectRule picks, or -1 when
+// none applies. The first of several rules for the same method wins.
+func SelectRuleIndex(rules []RateLimitRule, method string) int {
+	fallback := -1
+	for i := range rules {
+		switch {
+		case method != "" && strings.EqualFold(rules[i].Method, method):
+			return i
+		case rules[i].Method == "" && fallback < 0:
+			fallback = i
+		}
+	}
+	return fallback
+}
+
+// ErrOverrideNotFound is returned for an override that does not exist
+var ErrOverrideNotFound = errors.New("override not found")
+
+// RateLimitOverride grants one client a higher or lower limit for a
+// resource until it expires, taking precedence over the resource's rule
+type RateLimitOverride struct {
+	ID        string        `json:"id"`
+	ClientID  string        `json:"client_id"`
+	Resource  string        `json:"resource"`
+	Method    string        `json:"method,omitempty"` // Overrides requests with this method only; any method when empty
+	Limit     int           `json:"limit"`
+	Window    time.Duration `json:"window,omitempty"` // The rule's window when zero
+	Reason    string        `json:"reason,omitempty"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// ActiveAt reports whether the override is in effect at now
+func (o RateLimitOverride) ActiveAt(now time.Time) bool {
+	return now.Before(o.ExpiresAt)
+}
+
+// Apply returns rule with the override's limit and window, which replace
+// the extra windows of the rule too
+func (o RateLimitOverride) Apply(rule RateLimitRule) RateLimitRule {
+	rule.Limit = o.Limit
+	rule.Windows = nil
+	if o.Window > 0 {
+		rule.Window = o.Window
+	}
+	return rule
+}
+
+// SelectOverride picks the override in effect at now for requests with
+// method: the newest override for exactly that method, or else the newest
+// override for any method
+func SelectOverride(overrides []RateLimitOverride, method string, now time.Time) (RateLimitOverride, bool) {
+	var exact, fallback *RateLimitOverride
+	for i := range overrides {
+		o := &overrides[i]
+		if !o.ActiveAt(now) {
+			continue
+		}
+		switch {
+		case method != "" && strings.EqualFold(o.Method, method):
+			if exact == nil || o.CreatedAt.After(exact.CreatedAt) {
+				exact = o
+			}
+		case o.Method == "":
+			if fallback == nil || o.CreatedAt.After(fallback.CreatedAt) {
+				fallback = o
+			}
+		}
+	}
+	if exact != nil {
+		return *exact, true
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return RateLimitOverride{}, false
 }
 
 // Algorithm represents different rate limiting algorithms
@@ -23,6 +166,10 @@ const (
 	SlidingWindow   Algorithm = "sliding_window"
 	FixedWindow     Algorithm = "fixed_window"
 	LeakyBucket     Algorithm = "leaky_bucket"
+	
+	// SlidingWindowCounter approximates a sliding window by weighting the
+	// previous fixed window's count, so only two counters are stored per key
+	SlidingWindowCounter Algorithm = "sliding_window_counter"
 )
 
 // RateLimitState represents the current state of rate limiting for a client
@@ -30,6 +177,7 @@ type RateLimitState struct {
 	ClientID       string    `json:"client_id"`
 	Resource       string    `json:"resource"`
 	RequestCount   int       `json:"request_count"`
+	PreviousCount  int       `json:"previous_count"`
 	WindowStart    time.Time `json:"window_start"`
 	WindowEnd      time.Time `json:"window_end"`
 	RemainingQuota int       `json:"remaining_quota"`
@@ -37,8 +185,21 @@ type RateLimitState struct {
 	IsBlocked      bool      `json:"is_blocked"`
 	BlockedUntil   time.Time `json:"blocked_until"`
 	Version        int       `json:"version"`
+	
+	// RequestLog holds the most recent allowed request times (sliding window)
+	RequestLog []time.Time `json:"request_log,omitempty"`
+	// Tokens is the bucket level at LastRefill (token and leaky bucket)
+	Tokens     float64   `json:"tokens,omitempty"`
+	LastRefill time.Time `json:"last_refill,omitempty"`
+	// Refunds counts the refunds in the window starting at RefundWindowStart
+	Refunds           int       `json:"refunds,omitempty"`
+	RefundWindowStart time.Time `json:"refund_window_start,omitempty"`
 }
 
+// ErrConcurrencyConflict is returned by event stores when the events of an
+// aggregate are saved at a version it has moved past
+var ErrConcurrencyConflict = errors.New("concurrency conflict")
+
 // RateLimitAggregate represents the domain aggregate
 type RateLimitAggregate struct {
 	ID       string         `json:"id"`
@@ -48,10 +209,17 @@ type RateLimitAggregate struct {
 	Version  int           `json:"version"`
 }
 
-// NewRateLimitAggregate creates a new rate limit aggregate
+// AggregateID returns the ID of the aggregate of a client's counts on
+// resource
+func AggregateID(clientID, resource string) string {
+	return clientID + ":" + resource
+}
+
+// NewRateLimitAggregate creates a new rate limit aggregate. Its Events and
+// request log are only allocated once events are applied to it.
 func NewRateLimitAggregate(clientID, resource string) *RateLimitAggregate {
 	return &RateLimitAggregate{
-		ID: clientID + ":" + resource,
+		ID: AggregateID(clientID, resource),
 		State: RateLimitState{
 			ClientID:       clientID,
 			Resource:       resource,
@@ -60,48 +228,146 @@ func NewRateLimitAggregate(clientID, resource string) *RateLimitAggregate {
 			IsBlocked:      false,
 			Version:        0,
 		},
-		Events:  make([]Event, 0),
 		Version: 0,
 	}
 }
 
 // ApplyEvent applies an event to the aggregate
 func (a *RateLimitAggregate) ApplyEvent(event Event) {
+	a.apply(event)
+	a.Events = append(a.Events, event)
+}
+
+// LoadFromHistory rebuilds the aggregate from its stored events. Unlike
+// ApplyEvent it does not collect them in Events, and it sizes the request
+// log once, so replaying a history does not grow slices event by event.
+func (a *RateLimitAggregate) LoadFromHistory(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	if a.State.RequestLog == nil {
+		a.State.RequestLog = make([]time.Time, 0, len(events))
+	}
+	for _, event := range events {
+		a.apply(event)
+	}
+}
+
+// apply updates the state and version of the aggregate with an event
+func (a *RateLimitAggregate) apply(event Event) {
 	switch e := event.(type) {
 	case *RateLimitAppliedEvent:
 		a.State.RequestCount = e.RequestCount
+		a.State.PreviousCount = e.PreviousCount
 		a.State.WindowStart = e.WindowStart
 		a.State.WindowEnd = e.WindowEnd
 		a.State.RemainingQuota = e.RemainingQuota
-		a.State.LastRequestAt = time.Now()
+		a.State.LastRequestAt = e.Time
+		a.State.IsBlocked = false
+		a.State.Tokens = e.Tokens
+		a.State.LastRefill = e.Time
+		
+		// Only the last Limit entries can decide a sliding window request
+		a.State.RequestLog = append(a.State.RequestLog, e.Time)
+		if e.Limit > 0 && len(a.State.RequestLog) > e.Limit {
+			a.State.RequestLog = a.State.RequestLog[len(a.State.RequestLog)-e.Limit:]
+		}
 	case *RateLimitExceededEvent:
 		a.State.IsBlocked = true
 		a.State.BlockedUntil = e.BlockedUntil
 		a.State.RequestCount = e.RequestCount
+		a.State.PreviousCount = e.PreviousCount
+		a.State.WindowStart = e.WindowStart
+		a.State.WindowEnd = e.WindowEnd
+		a.State.Tokens = e.Tokens
+		a.State.LastRefill = e.Time
+	case *RateLimitRefundedEvent:
+		a.State.RequestCount = e.RequestCount
+		a.State.RemainingQuota = e.RemainingQuota
+		a.State.IsBlocked = false
+		a.State.BlockedUntil = time.Time{}
+		a.State.Tokens = e.Tokens
+		a.State.LastRefill = e.Time
+		a.State.Refunds = e.Refunds
+		a.State.RefundWindowStart = e.WindowStart
+		
+		// The refunded request is the most recent one logged
+		if n := len(a.State.RequestLog); n > 0 {
+			a.State.RequestLog = a.State.RequestLog[:n-1]
+		}
+	case *TokensLeasedEvent:
+		a.State.RequestCount = e.RequestCount
+		a.State.PreviousCount = e.PreviousCount
+		a.State.WindowStart = e.WindowStart
+		a.State.WindowEnd = e.WindowEnd
+		a.State.RemainingQuota = e.RemainingQuota
+		a.State.LastRequestAt = e.Time
+		a.State.IsBlocked = false
+		a.State.Tokens = e.Tokens
+		a.State.LastRefill = e.Time
+		
+		// Leased tokens are logged as requests made when they were leased
+		for i := 0; i < e.Leased; i++ {
+			a.State.RequestLog = append(a.State.RequestLog, e.Time)
+		}
+		if e.Limit > 0 && len(a.State.RequestLog) > e.Limit {
+			a.State.RequestLog = a.State.RequestLog[len(a.State.RequestLog)-e.Limit:]
+		}
+	case *LeaseSettledEvent:
+		a.State.RequestCount = e.RequestCount
+		a.State.PreviousCount = e.PreviousCount
+		a.State.WindowStart = e.WindowStart
+		a.State.RemainingQuota = e.RemainingQuota
+		a.State.Tokens = e.Tokens
+		a.State.LastRefill = e.Time
+		if e.Returned > 0 {
+			a.State.IsBlocked = false
+			a.State.BlockedUntil = time.Time{}
+		}
+		
+		// Drop the log entries of the returned tokens
+		returned := e.Returned
+		log := a.State.RequestLog[:0]
+		for _, at := range a.State.RequestLog {
+			if returned > 0 && at.Equal(e.LeasedAt) {
+				returned--
+				continue
+			}
+			log = append(log, at)
+		}
+		a.State.RequestLog = log
 	case *RateLimitWindowResetEvent:
 		a.State.RequestCount = 0
+		a.State.PreviousCount = 0
 		a.State.WindowStart = e.WindowStart
 		a.State.IsBlocked = false
 		a.State.BlockedUntil = time.Time{}
+		a.State.RequestLog = a.State.RequestLog[:0]
+		a.State.Tokens = 0
+		a.State.LastRefill = time.Time{}
+		a.State.Refunds = 0
+		a.State.RefundWindowStart = time.Time{}
 	}
 	a.Version++
-	a.Events = append(a.Events, event)
 }
 
-// CanMakeRequest checks if a request can be made based on current state
-func (a *RateLimitAggregate) CanMakeRequest(rule RateLimitRule) bool {
-	now := time.Now()
-	
-	// Check if currently blocked
-	if a.State.IsBlocked && now.Before(a.State.BlockedUntil) {
-		return false
-	}
+// CanMakeRequest checks if a request can be made at now based on current state
+func (a *RateLimitAggregate) CanMakeRequest(rule RateLimitRule, now time.Time) bool {
+	return a.Decide(rule, now).Allowed
+}
+
+// SlidingWindowCounts returns the start of the fixed window containing now
+// together with the request counts of the previous and current windows
+func (a *RateLimitAggregate) SlidingWindowCounts(window time.Duration, now time.Time) (time.Time, int, int) {
+	windowStart := now.Truncate(window)
 	
-	// Check if window has expired
-	if now.After(a.State.WindowEnd) {
-		return true // New window, allow request
+	switch {
+	case a.State.WindowStart.Equal(windowStart):
+		return windowStart, a.State.PreviousCount, a.State.RequestCount
+	case a.State.WindowStart.Equal(windowStart.Add(-window)):
+		// The stored window just ended and becomes the previous window
+		return windowStart, a.State.RequestCount, 0
+	default:
+		return windowStart, 0, 0
 	}
-	
-	// Check if within quota
-	return a.State.RemainingQuota > 0
 }
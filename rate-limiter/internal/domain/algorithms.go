@@ -0,0 +1,289 @@
+package domain
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+var (
+	// ErrNothingToRefund is returned when a client refunds a request but its
+	// window counts none
+	ErrNothingToRefund = errors.New("no request to refund")
+	// ErrRefundLimitReached is returned when a client has used up the
+	// refunds of its window
+	ErrRefundLimitReached = errors.New("refund limit reached")
+)
+
+// SlidingWindowCounterEstimate approximates the number of requests in the
+// sliding window ending at now. The previous window's count is weighted by
+// how much of it still overlaps the sliding window.
+func SlidingWindowCounterEstimate(previousCount, currentCount int, windowStart time.Time, window time.Duration, now time.Time) float64 {
+	elapsed := now.Sub(windowStart)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if elapsed > window {
+		elapsed = window
+	}
+
+	weight := 1 - float64(elapsed)/float64(window)
+	return float64(previousCount)*weight + float64(currentCount)
+}
+
+// SlidingWindowCounterRetryAt returns the earliest time at which one more
+// request fits under limit, assuming no further requests arrive
+func SlidingWindowCounterRetryAt(previousCount, currentCount, limit int, windowStart time.Time, window time.Duration, now time.Time) time.Time {
+	windowEnd := windowStart.Add(window)
+
+	if currentCount+1 > limit {
+		// The current window alone is over budget. Once it becomes the
+		// previous window its weight decays linearly from currentCount.
+		if currentCount == 0 {
+			return windowEnd
+		}
+		fraction := 1 - float64(limit-1)/float64(currentCount)
+		return windowEnd.Add(time.Duration(math.Ceil(fraction * float64(window))))
+	}
+
+	if previousCount == 0 {
+		return now
+	}
+
+	// Solve previousCount*(1-elapsed/window) + currentCount + 1 <= limit
+	fraction := 1 - float64(limit-currentCount-1)/float64(previousCount)
+	retryAt := windowStart.Add(time.Duration(math.Ceil(fraction * float64(window))))
+	if retryAt.Before(now) {
+		return now
+	}
+	return retryAt
+}
+
+// Decision is the outcome of evaluating one request against a rule
+type Decision struct {
+	Allowed      bool
+	RequestCount int       // Requests counted in the window, including this one when allowed
+	Remaining    int       // Requests still allowed after this one
+	WindowStart  time.Time
+	WindowEnd    time.Time // When the quota is fully restored
+	RetryAt      time.Time // Earliest time a denied request would be allowed
+	Tokens       float64   // Bucket level after the decision (token and leaky bucket)
+
+	// PreviousCount is the previous fixed window's count (sliding window
+	// counter); set by leases, which record it
+	PreviousCount int
+}
+
+// Decide evaluates one request at now using the rule's algorithm. Denials
+// carry the algorithm's own next-allowed time in RetryAt. The sliding window
+// counter is decided by the command handler because it may be backed by
+// shared counters.
+func (a *RateLimitAggregate) Decide(rule RateLimitRule, now time.Time) Decision {
+	switch rule.Algorithm {
+	case SlidingWindow:
+		return a.decideSlidingLog(rule, now)
+	case TokenBucket, LeakyBucket:
+		return a.decideBucket(rule, now)
+	default:
+		return a.decideFixedWindow(rule, now)
+	}
+}
+
+// decideFixedWindow counts requests in the fixed window containing now
+func (a *RateLimitAggregate) decideFixedWindow(rule RateLimitRule, now time.Time) Decision {
+	windowStart := now.Truncate(rule.Window)
+	windowEnd := windowStart.Add(rule.Window)
+
+	count := 0
+	if a.State.WindowStart.Equal(windowStart) {
+		count = a.State.RequestCount
+	}
+
+	if count < rule.Limit {
+		return Decision{
+			Allowed:      true,
+			RequestCount: count + 1,
+			Remaining:    rule.Limit - count - 1,
+			WindowStart:  windowStart,
+			WindowEnd:    windowEnd,
+		}
+	}
+	return Decision{
+		RequestCount: count,
+		WindowStart:  windowStart,
+		WindowEnd:    windowEnd,
+		RetryAt:      windowEnd,
+	}
+}
+
+// decideSlidingLog counts the logged requests in the window ending at now.
+// A denied request may retry once the entry that fills the window expires.
+// Entries expire a window after they were logged, rounded up to the rule's
+// precision.
+func (a *RateLimitAggregate) decideSlidingLog(rule RateLimitRule, now time.Time) Decision {
+	windowStart := now.Add(-rule.Window)
+
+	var log []time.Time
+	for _, at := range a.State.RequestLog {
+		if rule.inLog(at, now) {
+			log = append(log, at)
+		}
+	}
+
+	if len(log) < rule.Limit {
+		return Decision{
+			Allowed:      true,
+			RequestCount: len(log) + 1,
+			Remaining:    rule.Limit - len(log) - 1,
+			WindowStart:  windowStart,
+			WindowEnd:    rule.logExpiry(now),
+		}
+	}
+	return Decision{
+		RequestCount: len(log),
+		WindowStart:  windowStart,
+		WindowEnd:    rule.logExpiry(log[len(log)-1]),
+		RetryAt:      rule.logExpiry(log[len(log)-rule.Limit]),
+	}
+}
+
+// decideBucket refills a bucket of Limit tokens at Limit per Window and
+// spends one token per request. A leaky bucket used as a meter admits
+// exactly the same requests, so both algorithms share this implementation.
+func (a *RateLimitAggregate) decideBucket(rule RateLimitRule, now time.Time) Decision {
+	capacity := float64(rule.Limit)
+	perToken := float64(rule.Window) / capacity
+	tokens := a.bucketLevel(rule, now)
+
+	if tokens >= 1 {
+		tokens--
+		return Decision{
+			Allowed:      true,
+			RequestCount: rule.Limit - int(math.Floor(tokens)),
+			Remaining:    int(math.Floor(tokens)),
+			WindowStart:  now,
+			WindowEnd:    now.Add(time.Duration(math.Ceil((capacity - tokens) * perToken))),
+			Tokens:       tokens,
+		}
+	}
+	return Decision{
+		RequestCount: rule.Limit,
+		WindowStart:  now,
+		WindowEnd:    now.Add(time.Duration(math.Ceil((capacity - tokens) * perToken))),
+		RetryAt:      now.Add(time.Duration(math.Ceil((1 - tokens) * perToken))),
+		Tokens:       tokens,
+	}
+}
+
+// bucketLevel returns the tokens in a bucket of Limit tokens refilled at
+// Limit per Window, which starts full
+func (a *RateLimitAggregate) bucketLevel(rule RateLimitRule, now time.Time) float64 {
+	capacity := float64(rule.Limit)
+	if a.State.LastRefill.IsZero() {
+		return capacity
+	}
+
+	elapsed := now.Sub(a.State.LastRefill)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	perToken := float64(rule.Window) / capacity
+	return math.Min(capacity, a.State.Tokens+float64(elapsed)/perToken)
+}
+
+// Refund gives back the quota of the most recent allowed request at now
+// using the rule's algorithm, returning the requests counted and remaining
+// afterwards, or false when there is no request to give back. Refunds of
+// counters in the shared counter store are made by the command handler.
+func (a *RateLimitAggregate) Refund(rule RateLimitRule, now time.Time) (Decision, bool) {
+	switch rule.Algorithm {
+	case SlidingWindow:
+		return a.refundSlidingLog(rule, now)
+	case TokenBucket, LeakyBucket:
+		return a.refundBucket(rule, now)
+	case SlidingWindowCounter:
+		return a.refundSlidingWindowCounter(rule, now)
+	default:
+		return a.refundFixedWindow(rule, now)
+	}
+}
+
+// refundFixedWindow uncounts a request of the fixed window containing now
+func (a *RateLimitAggregate) refundFixedWindow(rule RateLimitRule, now time.Time) (Decision, bool) {
+	windowStart := now.Truncate(rule.Window)
+	if !a.State.WindowStart.Equal(windowStart) || a.State.RequestCount == 0 {
+		return Decision{}, false
+	}
+
+	count := a.State.RequestCount - 1
+	return Decision{
+		Allowed:      true,
+		RequestCount: count,
+		Remaining:    max(rule.Limit-count, 0),
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(rule.Window),
+	}, true
+}
+
+// refundSlidingWindowCounter uncounts a request of the current fixed window,
+// leaving the previous window's weight as it is
+func (a *RateLimitAggregate) refundSlidingWindowCounter(rule RateLimitRule, now time.Time) (Decision, bool) {
+	windowStart, previous, current := a.SlidingWindowCounts(rule.Window, now)
+	if current == 0 {
+		return Decision{}, false
+	}
+
+	current--
+	estimate := SlidingWindowCounterEstimate(previous, current, windowStart, rule.Window, now)
+	return Decision{
+		Allowed:      true,
+		RequestCount: current,
+		Remaining:    max(int(math.Floor(float64(rule.Limit)-estimate)), 0),
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(rule.Window),
+	}, true
+}
+
+// refundSlidingLog drops the most recent logged request, provided it is
+// still in the window ending at now
+func (a *RateLimitAggregate) refundSlidingLog(rule RateLimitRule, now time.Time) (Decision, bool) {
+	windowStart := now.Add(-rule.Window)
+	log := a.State.RequestLog
+	if len(log) == 0 || !rule.inLog(log[len(log)-1], now) {
+		return Decision{}, false
+	}
+
+	count := 0
+	for _, at := range log[:len(log)-1] {
+		if rule.inLog(at, now) {
+			count++
+		}
+	}
+	return Decision{
+		Allowed:      true,
+		RequestCount: count,
+		Remaining:    max(rule.Limit-count, 0),
+		WindowStart:  windowStart,
+		WindowEnd:    rule.logExpiry(now),
+	}, true
+}
+
+// refundBucket puts a token back into the bucket, unless it is already full
+func (a *RateLimitAggregate) refundBucket(rule RateLimitRule, now time.Time) (Decision, bool) {
+	capacity := float64(rule.Limit)
+	tokens := a.bucketLevel(rule, now)
+	if tokens >= capacity {
+		return Decision{}, false
+	}
+
+	tokens = math.Min(capacity, tokens+1)
+	perToken := float64(rule.Window) / capacity
+	return Decision{
+		Allowed:      true,
+		RequestCount: rule.Limit - int(math.Floor(tokens)),
+		Remaining:    int(math.Floor(tokens)),
+		WindowStart:  now,
+		WindowEnd:    now.Add(time.Duration(math.Ceil((capacity - tokens) * perToken))),
+		Tokens:       tokens,
+	}, true
+}
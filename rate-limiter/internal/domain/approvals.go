@@ -0,0 +1,19 @@
+package domain
+
+import "errors"
+
+// ErrRuleChangePending is returned when a rule is changed while another
+// change of it awaits approval
+var ErrRuleChangePending = errors.New("rule has a pending change")
+
+// ErrPrincipalRequired is returned when a change needing approval is
+// requested or reviewed by an unknown principal, which could not be told
+// apart from any other
+var ErrPrincipalRequired = errors.New("authenticated principal required")
+
+// PendingChangeError is the error of a change held pending approval instead
+// of being applied, which handlers answer with 202 and the change held
+type PendingChangeError interface {
+	error
+	PendingChange() interface{}
+}
@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Client registry errors
+var (
+	ErrClientNotFound = errors.New("client not found")
+	ErrClientExists   = errors.New("client already exists")
+)
+
+// Client is a registered API client. Requests are still keyed by client ID;
+// registering a client annotates it and lets it be disabled.
+type Client struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Tier       string     `json:"tier,omitempty"` // e.g., "free", "pro"
+	Tags       []string   `json:"tags,omitempty"`
+	Contact    string     `json:"contact,omitempty"`
+	Disabled   bool       `json:"disabled"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// HasTag reports whether the client has tag
+func (c Client) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attributes returns the client's fields as rule engine metadata, so rules
+// can match on client.name, client.tier and client.tags
+func (c Client) Attributes() map[string]string {
+	return map[string]string{
+		"client.name": c.Name,
+		"client.tier": c.Tier,
+		"client.tags": strings.Join(c.Tags, ","),
+	}
+}
@@ -0,0 +1,19 @@
+package domain
+
+import (
+	"time"
+)
+
+// Clock tells the current time. Handlers, stores and the service take one so
+// that tests can control window boundaries with a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by time.Now
+type SystemClock struct{}
+
+// Now returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,39 @@
+// Package clocktest provides a fake domain.Clock for deterministic tests.
+package clocktest
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when told to. It is safe for concurrent use.
+type Fake struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+// NewFake creates a fake clock reading start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Set moves the clock to t
+func (f *Fake) Set(t time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = t
+}
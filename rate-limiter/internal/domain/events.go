@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -14,11 +15,12 @@ type Event interface {
 
 // BaseEvent provides common event functionality
 type BaseEvent struct {
-	ID          string    `json:"id"`
-	Type        string    `json:"type"`
-	Time        time.Time `json:"timestamp"`
-	AggrID      string    `json:"aggregate_id"`
-	Version     int       `json:"version"`
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"timestamp"`
+	AggrID        string    `json:"aggregate_id"`
+	Version       int       `json:"version"`
+	SchemaVersion int       `json:"schema_version,omitempty"` // Payload schema, stamped by the event store
 }
 
 func (e BaseEvent) EventID() string     { return e.ID }
@@ -26,6 +28,25 @@ func (e BaseEvent) EventType() string   { return e.Type }
 func (e BaseEvent) Timestamp() time.Time { return e.Time }
 func (e BaseEvent) AggregateID() string { return e.AggrID }
 
+// NewEventID returns the ID of an event of kind recorded at t, such as
+// "applied-1700000000000000000". It is formatted without fmt, since every
+// decision records an event.
+func NewEventID(kind string, t time.Time) string {
+	var buf [48]byte
+	id := append(buf[:0], kind...)
+	id = append(id, '-')
+	return string(strconv.AppendInt(id, t.UnixNano(), 10))
+}
+
+// EventSchemaVersion returns the payload schema version of the event, 1 for
+// events that predate versioning
+func (e BaseEvent) EventSchemaVersion() int {
+	if e.SchemaVersion == 0 {
+		return 1
+	}
+	return e.SchemaVersion
+}
+
 // RateLimitRequestedEvent - Command side event
 type RateLimitRequestedEvent struct {
 	BaseEvent
@@ -44,20 +65,198 @@ type RateLimitAppliedEvent struct {
 	WindowStart    time.Time `json:"window_start"`
 	WindowEnd      time.Time `json:"window_end"`
 	RequestCount   int       `json:"request_count"`
+	PreviousCount  int       `json:"previous_count,omitempty"` // Sliding window counter only
 	Limit          int       `json:"limit"`
 	RemainingQuota int       `json:"remaining_quota"`
+	Tokens         float64   `json:"tokens,omitempty"`     // Token and leaky bucket only
+	SoftLimit      int       `json:"soft_limit,omitempty"` // Usage at which the rule's soft threshold is reached
+	IPAddress      string    `json:"ip_address,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
 }
 
 // RateLimitExceededEvent - Command side event
 type RateLimitExceededEvent struct {
+	BaseEvent
+	ClientID      string    `json:"client_id"`
+	Resource      string    `json:"resource"`
+	RequestCount  int       `json:"request_count"`
+	PreviousCount int       `json:"previous_count,omitempty"` // Sliding window counter only
+	Limit         int       `json:"limit"`
+	WindowStart   time.Time `json:"window_start"`
+	WindowEnd     time.Time `json:"window_end"`
+	BlockedUntil  time.Time `json:"blocked_until"`
+	Tokens        float64   `json:"tokens,omitempty"` // Token and leaky bucket only
+	IPAddress     string    `json:"ip_address,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+// RateLimitThresholdReachedEvent - Command side event recorded after the
+// allowed request that takes a client's usage to the rule's soft threshold
+type RateLimitThresholdReachedEvent struct {
 	BaseEvent
 	ClientID     string    `json:"client_id"`
 	Resource     string    `json:"resource"`
 	RequestCount int       `json:"request_count"`
 	Limit        int       `json:"limit"`
+	SoftLimit    int       `json:"soft_limit"`
 	WindowStart  time.Time `json:"window_start"`
 	WindowEnd    time.Time `json:"window_end"`
-	BlockedUntil time.Time `json:"blocked_until"`
+	IPAddress    string    `json:"ip_address,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+}
+
+// RateLimitRefundedEvent - Command side event recorded when a client gives
+// back the quota of its most recent allowed request, because the operation
+// it protected failed before doing real work
+type RateLimitRefundedEvent struct {
+	BaseEvent
+	ClientID       string    `json:"client_id"`
+	Resource       string    `json:"resource"`
+	WindowStart    time.Time `json:"window_start"` // The window refunds are counted in
+	WindowEnd      time.Time `json:"window_end"`
+	RequestCount   int       `json:"request_count"` // Requests counted after the refund
+	Limit          int       `json:"limit"`
+	RemainingQuota int       `json:"remaining_quota"`
+	Tokens         float64   `json:"tokens,omitempty"` // Token and leaky bucket only
+	Refunds        int       `json:"refunds"`          // Refunds in the window, including this one
+	Reason         string    `json:"reason,omitempty"`
+	// Compensation marks the undoing of a request of a multi-resource check
+	// that another resource denied, which is not counted as a refund
+	Compensation bool `json:"compensation,omitempty"`
+}
+
+// TokensLeasedEvent - Command side event recorded when a client leases
+// tokens of its quota, which count against it like as many allowed requests
+type TokensLeasedEvent struct {
+	BaseEvent
+	ClientID       string    `json:"client_id"`
+	Resource       string    `json:"resource"`
+	LeaseID        string    `json:"lease_id"`
+	Leased         int       `json:"leased"` // Tokens leased, at most those requested
+	WindowStart    time.Time `json:"window_start"`
+	WindowEnd      time.Time `json:"window_end"`
+	RequestCount   int       `json:"request_count"`
+	PreviousCount  int       `json:"previous_count,omitempty"` // Sliding window counter only
+	Limit          int       `json:"limit"`
+	RemainingQuota int       `json:"remaining_quota"`
+	Tokens         float64   `json:"tokens,omitempty"` // Token and leaky bucket only
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// LeaseSettledEvent - Command side event recorded when a client renews or
+// releases a lease, reporting the tokens of its term it used. The unused
+// tokens still counted in the window are given back.
+type LeaseSettledEvent struct {
+	BaseEvent
+	ClientID       string    `json:"client_id"`
+	Resource       string    `json:"resource"`
+	LeaseID        string    `json:"lease_id"`
+	Leased         int       `json:"leased"`   // Tokens of the settled term
+	Used           int       `json:"used"`     // Tokens the client reported used
+	Returned       int       `json:"returned"` // Unused tokens given back
+	LeasedAt       time.Time `json:"leased_at"`
+	WindowStart    time.Time `json:"window_start"`
+	WindowEnd      time.Time `json:"window_end"`
+	RequestCount   int       `json:"request_count"` // Requests counted after giving back
+	PreviousCount  int       `json:"previous_count,omitempty"`
+	Limit          int       `json:"limit"`
+	RemainingQuota int       `json:"remaining_quota"`
+	Tokens         float64   `json:"tokens,omitempty"` // Token and leaky bucket only
+}
+
+// LeaseExpiredEvent - Recorded when a lease expires without being renewed or
+// released. Its tokens stay counted, as the client may have used them all.
+type LeaseExpiredEvent struct {
+	BaseEvent
+	ClientID string `json:"client_id"`
+	Resource string `json:"resource"`
+	LeaseID  string `json:"lease_id"`
+	Leased   int    `json:"leased"`
+}
+
+// RateLimitKeyEvictedEvent - Recorded when an event store that limits its
+// number of client:resource keys evicts the least recently used one. The
+// key's history is dropped, so its next request starts a fresh window.
+type RateLimitKeyEvictedEvent struct {
+	BaseEvent
+	ClientID     string    `json:"client_id"`
+	Resource     string    `json:"resource"`
+	LastActivity time.Time `json:"last_activity"`
+	Events       int       `json:"events"` // Events dropped with the key
+}
+
+// ClientDataErasedEvent - Tombstone recorded when every event of a client is
+// erased from the event store, e.g. for a right to erasure request.
+// Projections and exporters drop what they hold of the client when they
+// receive it.
+type ClientDataErasedEvent struct {
+	BaseEvent
+	ClientID  string `json:"client_id"`
+	Keys      int    `json:"keys"`      // Client:resource keys erased
+	Events    int    `json:"events"`    // Events erased
+	Overrides int    `json:"overrides"` // Overrides deleted
+}
+
+// EventErasedEvent - Takes the place of an erased event in the log of every
+// event, so that positions in the log stay valid. It keeps nothing of the
+// erased event but its ID and time.
+type EventErasedEvent struct {
+	BaseEvent
+}
+
+// RuleChangeRequestedEvent - Published when a change of a high-impact rule
+// engine rule is held pending until another principal approves it
+type RuleChangeRequestedEvent struct {
+	BaseEvent
+	ChangeID    string `json:"change_id"`
+	RuleID      string `json:"rule_id"`
+	Reason      string `json:"reason"` // Why the change needs approval
+	RequestedBy string `json:"requested_by"`
+}
+
+// RuleChangeApprovedEvent - Published when a pending rule change is approved
+// and applied
+type RuleChangeApprovedEvent struct {
+	BaseEvent
+	ChangeID    string `json:"change_id"`
+	RuleID      string `json:"rule_id"`
+	RequestedBy string `json:"requested_by"`
+	ApprovedBy  string `json:"approved_by"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// RuleChangeRejectedEvent - Published when a pending rule change is rejected,
+// or withdrawn by its requester, leaving the rule as it is
+type RuleChangeRejectedEvent struct {
+	BaseEvent
+	ChangeID    string `json:"change_id"`
+	RuleID      string `json:"rule_id"`
+	RequestedBy string `json:"requested_by"`
+	RejectedBy  string `json:"rejected_by"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// BanListEntryAddedEvent - Published when a network is added to the ban
+// list, or its entry is replaced with a different action, reason or expiry
+type BanListEntryAddedEvent struct {
+	BaseEvent
+	Network   string     `json:"network"`
+	Action    string     `json:"action"` // "deny" or "allow"
+	Reason    string     `json:"reason,omitempty"`
+	AddedBy   string     `json:"added_by,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// BanListEntryRemovedEvent - Published when a network leaves the ban list,
+// because it was deleted, expired or left out of an import replacing the
+// list
+type BanListEntryRemovedEvent struct {
+	BaseEvent
+	Network   string `json:"network"`
+	Action    string `json:"action"`
+	Cause     string `json:"cause"` // "deleted", "expired" or "replaced"
+	RemovedBy string `json:"removed_by,omitempty"`
 }
 
 // RateLimitWindowResetEvent - Query side optimization event
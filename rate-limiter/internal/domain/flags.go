@@ -0,0 +1,15 @@
+package domain
+
+import "errors"
+
+// ErrRuleNotEnforced is returned when every rule that could decide a request
+// is gated by a feature flag that is off for the client
+var ErrRuleNotEnforced = errors.New("no rule is enforced")
+
+// FlagContext is what the feature flag gating a rule is evaluated for
+type FlagContext struct {
+	TargetingKey string // The limit key: the client ID unless the rule has a key template
+	Tenant       string // Tier of the registered client; empty for unregistered clients
+	Resource     string
+	Method       string
+}
@@ -0,0 +1,102 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrFreezeNotFound is returned for a freeze that does not exist
+var ErrFreezeNotFound = errors.New("freeze not found")
+
+// FreezeMode decides every request to a frozen resource
+type FreezeMode string
+
+const (
+	// FreezeDenyAll denies every request, e.g. during incident response
+	FreezeDenyAll FreezeMode = "deny_all"
+
+	// FreezeAllowAll allows and logs every request without counting it,
+	// e.g. while the limits of a resource are being migrated
+	FreezeAllowAll FreezeMode = "allow_all"
+)
+
+// ParseFreezeMode returns the freeze mode with the given name
+func ParseFreezeMode(name string) (FreezeMode, error) {
+	switch mode := FreezeMode(name); mode {
+	case FreezeDenyAll, FreezeAllowAll:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown freeze mode: %q", name)
+	}
+}
+
+// Freeze suspends normal rate limiting of one resource, or of every resource
+// when Resource is empty, between StartsAt and EndsAt
+type Freeze struct {
+	ID        string     `json:"id"`
+	Resource  string     `json:"resource,omitempty"` // Every resource when empty
+	Mode      FreezeMode `json:"mode"`
+	Reason    string     `json:"reason,omitempty"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    time.Time  `json:"ends_at,omitempty"` // Until lifted when zero
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ActiveAt reports whether the freeze is in effect at now
+func (f Freeze) ActiveAt(now time.Time) bool {
+	return !now.Before(f.StartsAt) && !f.EndedAt(now)
+}
+
+// EndedAt reports whether the freeze is over at now
+func (f Freeze) EndedAt(now time.Time) bool {
+	return !f.EndsAt.IsZero() && !now.Before(f.EndsAt)
+}
+
+// Covers reports whether the freeze applies to resource
+func (f Freeze) Covers(resource string) bool {
+	return f.Resource == "" || f.Resource == resource
+}
+
+// Describe returns the reason recorded on decisions made by the freeze
+func (f Freeze) Describe() string {
+	scope := "global freeze"
+	if f.Resource != "" {
+		scope = "freeze of " + f.Resource
+	}
+	if f.Reason == "" {
+		return fmt.Sprintf("%s (%s)", scope, f.Mode)
+	}
+	return fmt.Sprintf("%s (%s): %s", scope, f.Mode, f.Reason)
+}
+
+// SelectFreeze picks the freeze in effect for resource at now. Deny-all
+// freezes take precedence over allow-all ones, then freezes of the resource
+// over global ones, then newer freezes over older ones.
+func SelectFreeze(freezes []Freeze, resource string, now time.Time) (Freeze, bool) {
+	var selected *Freeze
+	for i := range freezes {
+		f := &freezes[i]
+		if !f.ActiveAt(now) || !f.Covers(resource) {
+			continue
+		}
+		if selected == nil || f.precedes(*selected) {
+			selected = f
+		}
+	}
+	if selected == nil {
+		return Freeze{}, false
+	}
+	return *selected, true
+}
+
+// precedes reports whether f takes precedence over other
+func (f Freeze) precedes(other Freeze) bool {
+	if (f.Mode == FreezeDenyAll) != (other.Mode == FreezeDenyAll) {
+		return f.Mode == FreezeDenyAll
+	}
+	if (f.Resource != "") != (other.Resource != "") {
+		return f.Resource != ""
+	}
+	return f.CreatedAt.After(other.CreatedAt)
+}
@@ -0,0 +1,260 @@
+package domain
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrLeaseNotFound is returned for a lease that does not exist, or was
+// released or expired
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// ErrLeaseExpired is returned when a lease is renewed after it expired
+var ErrLeaseExpired = errors.New("lease expired")
+
+// ErrInvalidLease is returned for a lease of no tokens, or a renewal
+// reporting more tokens used than were leased
+var ErrInvalidLease = errors.New("invalid lease")
+
+// Lease lends a client tokens of its quota for a resource, so that it can
+// admit that many requests locally instead of checking each one. The tokens
+// are counted against the quota when they are leased. When the client renews
+// or releases the lease it reports how many it used, and the unused ones are
+// given back; the tokens of a lease left to expire stay counted.
+type Lease struct {
+	ID            string    `json:"id"`
+	ClientID      string    `json:"client_id"` // The limit key
+	Resource      string    `json:"resource"`
+	Method        string    `json:"method,omitempty"`
+	StateResource string    `json:"-"`         // The resource the counts of the lease's rule are kept under
+	Tokens        int       `json:"tokens"`    // Tokens leased for the current term
+	Renewals      int       `json:"renewals"`  // Terms after the first
+	LeasedAt      time.Time `json:"leased_at"` // Start of the current term
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// TTL is how long each term lasts, unless the window its tokens count
+	// in ends first
+	TTL time.Duration `json:"ttl"`
+}
+
+// ActiveAt reports whether the lease's tokens may be spent at now
+func (l Lease) ActiveAt(now time.Time) bool {
+	return now.Before(l.ExpiresAt)
+}
+
+// LeaseWindowEnd returns when tokens leased at now stop counting against the
+// rule's quota, which a lease may not outlive: the end of the fixed window
+// containing now for the windowed algorithms, and one window after now for
+// the others. A lease spanning windows would let its tokens be spent on top
+// of the next window's quota.
+func LeaseWindowEnd(rule RateLimitRule, now time.Time) time.Time {
+	switch rule.Algorithm {
+	case FixedWindow, SlidingWindowCounter:
+		return now.Truncate(rule.Window).Add(rule.Window)
+	default:
+		return now.Add(rule.Window)
+	}
+}
+
+// Lease takes up to tokens from the quota at now using the rule's algorithm,
+// as if that many requests were allowed at once. It returns the decision
+// after them and the number taken, which is less than tokens when less of
+// the quota is left. A decision taking none is denied like a request would
+// be. Leases of counters in the shared counter store are made by the
+// command handler.
+func (a *RateLimitAggregate) Lease(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	switch rule.Algorithm {
+	case SlidingWindow:
+		return a.leaseSlidingLog(rule, tokens, now)
+	case TokenBucket, LeakyBucket:
+		return a.leaseBucket(rule, tokens, now)
+	case SlidingWindowCounter:
+		return a.leaseSlidingWindowCounter(rule, tokens, now)
+	default:
+		return a.leaseFixedWindow(rule, tokens, now)
+	}
+}
+
+// leaseFixedWindow counts the tokens as requests of the fixed window
+// containing now
+func (a *RateLimitAggregate) leaseFixedWindow(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	windowStart := now.Truncate(rule.Window)
+	count := 0
+	if a.State.WindowStart.Equal(windowStart) {
+		count = a.State.RequestCount
+	}
+
+	n := min(tokens, max(rule.Limit-count, 0))
+	if n == 0 {
+		return a.decideFixedWindow(rule, now), 0
+	}
+	return Decision{
+		Allowed:      true,
+		RequestCount: count + n,
+		Remaining:    rule.Limit - count - n,
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(rule.Window),
+	}, n
+}
+
+// leaseSlidingWindowCounter counts the tokens as requests of the current
+// fixed window, up to what the weighted estimate leaves of the quota
+func (a *RateLimitAggregate) leaseSlidingWindowCounter(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	windowStart, previous, current := a.SlidingWindowCounts(rule.Window, now)
+	estimate := SlidingWindowCounterEstimate(previous, current, windowStart, rule.Window, now)
+
+	n := min(tokens, max(int(math.Floor(float64(rule.Limit)-estimate)), 0))
+	decision := Decision{
+		Allowed:       n > 0,
+		RequestCount:  current + n,
+		Remaining:     max(int(math.Floor(float64(rule.Limit)-estimate))-n, 0),
+		WindowStart:   windowStart,
+		WindowEnd:     windowStart.Add(rule.Window),
+		PreviousCount: previous,
+	}
+	if n == 0 {
+		decision.RetryAt = SlidingWindowCounterRetryAt(previous, current, rule.Limit, windowStart, rule.Window, now)
+	}
+	return decision, n
+}
+
+// leaseSlidingLog logs the tokens as requests made at now
+func (a *RateLimitAggregate) leaseSlidingLog(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	windowStart := now.Add(-rule.Window)
+	count := 0
+	for _, at := range a.State.RequestLog {
+		if rule.inLog(at, now) {
+			count++
+		}
+	}
+
+	n := min(tokens, max(rule.Limit-count, 0))
+	if n == 0 {
+		return a.decideSlidingLog(rule, now), 0
+	}
+	return Decision{
+		Allowed:      true,
+		RequestCount: count + n,
+		Remaining:    rule.Limit - count - n,
+		WindowStart:  windowStart,
+		WindowEnd:    rule.logExpiry(now),
+	}, n
+}
+
+// leaseBucket takes whole tokens out of the bucket
+func (a *RateLimitAggregate) leaseBucket(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	level := a.bucketLevel(rule, now)
+	n := min(tokens, int(math.Floor(level)))
+	if n == 0 {
+		return a.decideBucket(rule, now), 0
+	}
+	return bucketDecision(rule, level-float64(n), now), n
+}
+
+// ReturnLeased gives back up to tokens leased at leasedAt to the quota at
+// now, returning the decision afterwards and the number given back. Tokens
+// only count against the window they were leased in, so those of a fixed
+// window or sliding window counter lease are no longer given back once that
+// window ended, nor those of a sliding window lease once it left the window.
+func (a *RateLimitAggregate) ReturnLeased(rule RateLimitRule, tokens int, leasedAt, now time.Time) (Decision, int) {
+	switch rule.Algorithm {
+	case SlidingWindow:
+		return a.returnSlidingLog(rule, tokens, leasedAt, now)
+	case TokenBucket, LeakyBucket:
+		return a.returnBucket(rule, tokens, now)
+	case SlidingWindowCounter:
+		return a.returnSlidingWindowCounter(rule, tokens, leasedAt, now)
+	default:
+		return a.returnFixedWindow(rule, tokens, leasedAt, now)
+	}
+}
+
+// returnFixedWindow uncounts tokens of the fixed window containing now
+func (a *RateLimitAggregate) returnFixedWindow(rule RateLimitRule, tokens int, leasedAt, now time.Time) (Decision, int) {
+	windowStart := now.Truncate(rule.Window)
+	count := 0
+	if a.State.WindowStart.Equal(windowStart) {
+		count = a.State.RequestCount
+	}
+
+	n := 0
+	if !leasedAt.Before(windowStart) {
+		n = min(tokens, count)
+	}
+	return Decision{
+		Allowed:      true,
+		RequestCount: count - n,
+		Remaining:    max(rule.Limit-count+n, 0),
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(rule.Window),
+	}, n
+}
+
+// returnSlidingWindowCounter uncounts tokens of the current fixed window,
+// leaving the previous window's weight as it is
+func (a *RateLimitAggregate) returnSlidingWindowCounter(rule RateLimitRule, tokens int, leasedAt, now time.Time) (Decision, int) {
+	windowStart, previous, current := a.SlidingWindowCounts(rule.Window, now)
+
+	n := 0
+	if !leasedAt.Before(windowStart) {
+		n = min(tokens, current)
+	}
+	estimate := SlidingWindowCounterEstimate(previous, current-n, windowStart, rule.Window, now)
+	return Decision{
+		Allowed:       true,
+		RequestCount:  current - n,
+		Remaining:     max(int(math.Floor(float64(rule.Limit)-estimate)), 0),
+		WindowStart:   windowStart,
+		WindowEnd:     windowStart.Add(rule.Window),
+		PreviousCount: previous,
+	}, n
+}
+
+// returnSlidingLog drops log entries of the lease, which were all logged at
+// leasedAt, provided they are still in the window ending at now
+func (a *RateLimitAggregate) returnSlidingLog(rule RateLimitRule, tokens int, leasedAt, now time.Time) (Decision, int) {
+	windowStart := now.Add(-rule.Window)
+	count, leased := 0, 0
+	for _, at := range a.State.RequestLog {
+		if !rule.inLog(at, now) {
+			continue
+		}
+		count++
+		if at.Equal(leasedAt) {
+			leased++
+		}
+	}
+
+	n := min(tokens, leased)
+	return Decision{
+		Allowed:      true,
+		RequestCount: count - n,
+		Remaining:    max(rule.Limit-count+n, 0),
+		WindowStart:  windowStart,
+		WindowEnd:    rule.logExpiry(now),
+	}, n
+}
+
+// returnBucket puts whole tokens back into the bucket, as far as it is not
+// already refilled
+func (a *RateLimitAggregate) returnBucket(rule RateLimitRule, tokens int, now time.Time) (Decision, int) {
+	level := a.bucketLevel(rule, now)
+	n := min(tokens, int(math.Floor(float64(rule.Limit)-level)))
+	return bucketDecision(rule, level+float64(n), now), n
+}
+
+// bucketDecision returns the allowed decision leaving the bucket at level
+func bucketDecision(rule RateLimitRule, level float64, now time.Time) Decision {
+	capacity := float64(rule.Limit)
+	perToken := float64(rule.Window) / capacity
+	return Decision{
+		Allowed:      true,
+		RequestCount: rule.Limit - int(math.Floor(level)),
+		Remaining:    int(math.Floor(level)),
+		WindowStart:  now,
+		WindowEnd:    now.Add(time.Duration(math.Ceil((capacity - level) * perToken))),
+		Tokens:       level,
+	}
+}
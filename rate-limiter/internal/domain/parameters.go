@@ -0,0 +1,144 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// AlgorithmParameters tune the algorithm of a rule beyond its limit and
+// window. Only the parameters of the rule's algorithm may be set.
+type AlgorithmParameters struct {
+	TokenBucket   *TokenBucketParameters   `json:"token_bucket,omitempty"`
+	LeakyBucket   *LeakyBucketParameters   `json:"leaky_bucket,omitempty"`
+	SlidingWindow *SlidingWindowParameters `json:"sliding_window,omitempty"`
+}
+
+// TokenBucketParameters size a token bucket and set its refill rate, which
+// are otherwise a bucket of Limit tokens refilled at Limit per Window
+type TokenBucketParameters struct {
+	BucketSize int     `json:"bucket_size,omitempty"` // Tokens the bucket holds, the largest burst; becomes the rule's limit
+	RefillRate float64 `json:"refill_rate,omitempty"` // Tokens added per second; sets the rule's window to the time to fill the bucket
+}
+
+// LeakyBucketParameters size a leaky bucket and set its drain rate, which
+// are otherwise a bucket of Limit requests drained at Limit per Window
+type LeakyBucketParameters struct {
+	BucketSize int     `json:"bucket_size,omitempty"` // Requests the bucket holds; becomes the rule's limit
+	DrainRate  float64 `json:"drain_rate,omitempty"`  // Requests drained per second; sets the rule's window to the time to drain the bucket
+}
+
+// SlidingWindowParameters set the precision of a sliding window log
+type SlidingWindowParameters struct {
+	// Precision divides the window into as many slots; logged requests
+	// leave the window at the end of the slot their window ends in, rather
+	// than exactly a window after they were made. Exact when zero.
+	Precision int `json:"precision,omitempty"`
+}
+
+// ParseAlgorithmParameters converts the parameters of a rule given as a
+// decoded JSON object, as in the parameters of rule engine actions
+func ParseAlgorithmParameters(v interface{}) (*AlgorithmParameters, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var p AlgorithmParameters
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Resolve validates the parameters for algorithm and returns the limit and
+// window of the rule they are set on. A bucket size is the limit and a rate
+// determines the window, so either may be left zero; when both are given
+// they must agree.
+func (p *AlgorithmParameters) Resolve(algorithm Algorithm, limit int, window time.Duration) (int, time.Duration, error) {
+	if p == nil {
+		return limit, window, nil
+	}
+	for _, c := range []struct {
+		algorithm Algorithm
+		set       bool
+	}{
+		{TokenBucket, p.TokenBucket != nil},
+		{LeakyBucket, p.LeakyBucket != nil},
+		{SlidingWindow, p.SlidingWindow != nil},
+	} {
+		if c.set && c.algorithm != algorithm {
+			return 0, 0, fmt.Errorf("%s parameters do not apply to the %s algorithm", c.algorithm, algorithm)
+		}
+	}
+
+	switch {
+	case p.TokenBucket != nil:
+		return resolveBucket(limit, window, p.TokenBucket.BucketSize, p.TokenBucket.RefillRate, "refill_rate", "fill")
+	case p.LeakyBucket != nil:
+		return resolveBucket(limit, window, p.LeakyBucket.BucketSize, p.LeakyBucket.DrainRate, "drain_rate", "drain")
+	case p.SlidingWindow != nil:
+		precision := p.SlidingWindow.Precision
+		if precision < 0 || (window > 0 && time.Duration(precision) > window) {
+			return 0, 0, fmt.Errorf("precision %d must be between 0 and the window in nanoseconds", precision)
+		}
+	}
+	return limit, window, nil
+}
+
+// resolveBucket returns the limit and window of a bucket of size requests
+// refilled or drained at rate per second
+func resolveBucket(limit int, window time.Duration, size int, rate float64, rateName, verb string) (int, time.Duration, error) {
+	if size < 0 {
+		return 0, 0, fmt.Errorf("bucket_size %d must not be negative", size)
+	}
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, 0, fmt.Errorf("%s %g must be a positive number", rateName, rate)
+	}
+
+	if size > 0 {
+		if limit != 0 && limit != size {
+			return 0, 0, fmt.Errorf("limit %d differs from bucket_size %d", limit, size)
+		}
+		limit = size
+	}
+	if rate > 0 && limit > 0 {
+		derived := time.Duration(math.Round(float64(limit) / rate * float64(time.Second)))
+		if derived <= 0 {
+			return 0, 0, fmt.Errorf("%s %g is too high", rateName, rate)
+		}
+		if window != 0 && window != derived {
+			return 0, 0, fmt.Errorf("window %s differs from %s, the time to %s the bucket at a %s of %g; set one or the other", window, derived, verb, rateName, rate)
+		}
+		window = derived
+	}
+	return limit, window, nil
+}
+
+// logExpiry returns when a request logged at leaves the sliding window log
+// of the rule: a window after it was made, rounded up to the rule's
+// precision
+func (r RateLimitRule) logExpiry(at time.Time) time.Time {
+	expiry := at.Add(r.Window)
+	if r.Parameters == nil || r.Parameters.SlidingWindow == nil || r.Parameters.SlidingWindow.Precision <= 0 {
+		return expiry
+	}
+
+	slot := r.Window / time.Duration(r.Parameters.SlidingWindow.Precision)
+	if slot <= 0 {
+		return expiry
+	}
+	if rounded := expiry.Truncate(slot); rounded.Before(expiry) {
+		return rounded.Add(slot)
+	}
+	return expiry
+}
+
+// inLog reports whether a request logged at is still in the rule's sliding
+// window at now
+func (r RateLimitRule) inLog(at, now time.Time) bool {
+	return r.logExpiry(at).After(now)
+}
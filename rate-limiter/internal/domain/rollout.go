@@ -0,0 +1,211 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// ErrRolloutNotFound is returned for a rollout that does not exist
+var ErrRolloutNotFound = errors.New("rollout not found")
+
+// ErrRolloutInProgress is returned when a rollout is started for a rule that
+// already has one running
+var ErrRolloutInProgress = errors.New("rule already has a rollout in progress")
+
+// ErrInvalidRollout is returned for a rollout with invalid settings, or one
+// that would not change its rule
+var ErrInvalidRollout = errors.New("invalid rollout")
+
+// ErrRolloutEnded is returned when a rollout that was already promoted or
+// rolled back is promoted or rolled back
+var ErrRolloutEnded = errors.New("rollout has already ended")
+
+// RolloutStatus is the state of a rule rollout
+type RolloutStatus string
+
+const (
+	// RolloutRunning applies the candidate rule to the canary cohort
+	RolloutRunning RolloutStatus = "running"
+
+	// RolloutPromoted replaced the rule with the candidate for every client
+	RolloutPromoted RolloutStatus = "promoted"
+
+	// RolloutRolledBack left the rule unchanged
+	RolloutRolledBack RolloutStatus = "rolled_back"
+)
+
+// RolloutAction is what an evaluation of a rollout does next
+type RolloutAction string
+
+const (
+	// RolloutHold keeps the rollout at its stage
+	RolloutHold RolloutAction = "hold"
+
+	// RolloutAdvance moves the rollout to its next stage
+	RolloutAdvance RolloutAction = "advance"
+
+	// RolloutPromote ends the rollout, replacing the rule with the candidate
+	RolloutPromote RolloutAction = "promote"
+
+	// RolloutRollBack ends the rollout, keeping the rule
+	RolloutRollBack RolloutAction = "roll_back"
+)
+
+// RolloutCohort counts the decisions made for one cohort of a rollout stage
+type RolloutCohort struct {
+	Requests int64 `json:"requests"`
+	Denied   int64 `json:"denied"`
+}
+
+// DenyRate returns the fraction of the cohort's requests that were denied
+func (c RolloutCohort) DenyRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return float64(c.Denied) / float64(c.Requests)
+}
+
+// Record counts one decision
+func (c *RolloutCohort) Record(denied bool) {
+	c.Requests++
+	if denied {
+		c.Denied++
+	}
+}
+
+// RuleRollout applies a changed rule to a growing percentage of clients,
+// stage by stage, comparing the deny rate of the clients on the candidate
+// (the canary cohort) with that of the clients on the rule (the baseline
+// cohort). Clients are assigned by a hash of their ID, so each client stays
+// in its cohort, and clients in the canary cohort stay there as it grows.
+type RuleRollout struct {
+	ID               string        `json:"id"`
+	RuleID           string        `json:"rule_id"`
+	Candidate        RateLimitRule `json:"candidate"`           // The changed rule; keeps the ID, resource, method and key template of the rule
+	Stages           []int         `json:"stages"`              // Percentages of clients on the candidate, stage by stage, e.g. [5, 25, 50]
+	Stage            int           `json:"stage"`               // Index of the current stage
+	StageDuration    time.Duration `json:"stage_duration"`      // Time a healthy stage runs before the rollout advances
+	MaxDenyRateDelta float64       `json:"max_deny_rate_delta"` // Rolled back when the canary deny rate exceeds the baseline's by more, e.g. 0.05
+	MinRequests      int64         `json:"min_requests"`        // Requests each cohort needs before the deny rates are compared
+	Baseline         RolloutCohort `json:"baseline"`            // Decisions of the current stage on the rule
+	Canary           RolloutCohort `json:"canary"`              // Decisions of the current stage on the candidate
+	Status           RolloutStatus `json:"status"`
+	Reason           string        `json:"reason,omitempty"` // Why the rollout was promoted or rolled back
+	StageStartedAt   time.Time     `json:"stage_started_at"`
+	CreatedAt        time.Time     `json:"created_at"`
+	EndedAt          time.Time     `json:"ended_at,omitempty"`
+}
+
+// Percent returns the percentage of clients on the candidate: that of the
+// current stage while running, all of them once promoted and none once
+// rolled back
+func (r RuleRollout) Percent() int {
+	switch r.Status {
+	case RolloutRunning:
+		return r.Stages[r.Stage]
+	case RolloutPromoted:
+		return 100
+	default:
+		return 0
+	}
+}
+
+// InCanary reports whether the candidate decides the requests of clientID
+func (r RuleRollout) InCanary(clientID string) bool {
+	return RolloutBucket(r.ID, clientID) < r.Percent()
+}
+
+// Apply returns rule with the limit, window, algorithm, algorithm
+// parameters and soft threshold of the candidate, keeping the rule's other
+// settings even if they were changed since the rollout started
+func (r RuleRollout) Apply(rule RateLimitRule) RateLimitRule {
+	rule.Limit = r.Candidate.Limit
+	rule.Window = r.Candidate.Window
+	rule.Algorithm = r.Candidate.Algorithm
+	rule.Parameters = r.Candidate.Parameters
+	rule.SoftThreshold = r.Candidate.SoftThreshold
+	return rule
+}
+
+// RolloutBucket deterministically assigns clientID one of 100 buckets of
+// the rollout with the given ID. A client is in the canary cohort while its
+// bucket is below the rollout's percentage.
+func RolloutBucket(rolloutID, clientID string) int {
+	h := fnv.New64a()
+	h.Write([]byte(rolloutID))
+	h.Write([]byte{0})
+	h.Write([]byte(clientID))
+
+	// FNV barely mixes the last bytes, in which sequential client IDs
+	// differ, so the hash is finalized like MurmurHash3's
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return int(sum % 100)
+}
+
+// Evaluate decides what the rollout does next at now. Once both cohorts
+// made MinRequests decisions, a canary deny rate exceeding the baseline's by
+// more than MaxDenyRateDelta rolls the rollout back. A stage that stayed
+// healthy for StageDuration advances to the next one, and the last stage
+// promotes the candidate.
+func (r RuleRollout) Evaluate(now time.Time) (RolloutAction, string) {
+	if r.Status != RolloutRunning {
+		return RolloutHold, ""
+	}
+	if r.Canary.Requests < r.MinRequests || r.Baseline.Requests < r.MinRequests {
+		return RolloutHold, ""
+	}
+
+	canary, baseline := r.Canary.DenyRate(), r.Baseline.DenyRate()
+	if canary-baseline > r.MaxDenyRateDelta {
+		return RolloutRollBack, fmt.Sprintf("canary deny rate %.2f%% exceeds baseline deny rate %.2f%% by more than %.2f%% at %d%%",
+			canary*100, baseline*100, r.MaxDenyRateDelta*100, r.Percent())
+	}
+	if now.Before(r.StageStartedAt.Add(r.StageDuration)) {
+		return RolloutHold, ""
+	}
+	if r.Stage < len(r.Stages)-1 {
+		return RolloutAdvance, ""
+	}
+	return RolloutPromote, fmt.Sprintf("canary deny rate %.2f%% within %.2f%% of baseline deny rate %.2f%% after %d stage(s)",
+		canary*100, r.MaxDenyRateDelta*100, baseline*100, len(r.Stages))
+}
+
+// Advance moves the rollout to its next stage at now, counting its cohorts
+// afresh
+func (r *RuleRollout) Advance(now time.Time) {
+	r.Stage++
+	r.Baseline, r.Canary = RolloutCohort{}, RolloutCohort{}
+	r.StageStartedAt = now
+}
+
+// End ends the rollout at now with status, recording why
+func (r *RuleRollout) End(status RolloutStatus, reason string, now time.Time) {
+	r.Status = status
+	r.Reason = reason
+	r.EndedAt = now
+}
+
+// ValidateRolloutStages checks that stages are percentages strictly between
+// 0 and 100 in increasing order, so that the baseline cohort keeps clients
+// to compare with until the candidate is promoted
+func ValidateRolloutStages(stages []int) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("at least one stage is required")
+	}
+	for i, percent := range stages {
+		if percent <= 0 || percent >= 100 {
+			return fmt.Errorf("stage %d%% is not between 0%% and 100%%", percent)
+		}
+		if i > 0 && percent <= stages[i-1] {
+			return fmt.Errorf("stages must increase, got %d%% after %d%%", percent, stages[i-1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WindowLimit is a limit of requests per window. Rules may enforce several
+// at once, e.g. 10 per second against bursts and 1000 per hour overall.
+type WindowLimit struct {
+	Limit  int           `json:"limit"`
+	Window time.Duration `json:"window"`
+}
+
+// Limits returns every limit the rule enforces: its own limit and window
+// first, then its extra windows
+func (r RateLimitRule) Limits() []WindowLimit {
+	limits := make([]WindowLimit, 0, 1+len(r.Windows))
+	limits = append(limits, WindowLimit{Limit: r.Limit, Window: r.Window})
+	return append(limits, r.Windows...)
+}
+
+// WindowRules returns a rule for each extra window of r, deciding the
+// window's limit with r's algorithm. Their counters are kept under the
+// WindowResource of r's state resource, apart from r's own; bucket
+// parameters, which resolve into r's own limit and window, and r's soft
+// threshold do not apply to them.
+func (r RateLimitRule) WindowRules() []RateLimitRule {
+	rules := make([]RateLimitRule, 0, len(r.Windows))
+	for _, w := range r.Windows {
+		rule := RateLimitRule{
+			ID:        r.ID,
+			Resource:  WindowResource(r.StateResource(), w.Window),
+			Limit:     w.Limit,
+			Window:    w.Window,
+			Algorithm: r.Algorithm,
+		}
+		if r.Parameters != nil && r.Parameters.SlidingWindow != nil {
+			rule.Parameters = &AlgorithmParameters{SlidingWindow: r.Parameters.SlidingWindow}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ParseWindowLimits converts the extra windows of a rule given as decoded
+// JSON, as in the parameters of rule engine actions: a list of objects with
+// a limit and a window, which is a duration or a number of seconds
+func ParseWindowLimits(v interface{}) ([]WindowLimit, error) {
+	if v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("windows must be a list, not %T", v)
+	}
+
+	windows := make([]WindowLimit, 0, len(items))
+	for i, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("window %d must be an object, not %T", i, item)
+		}
+
+		var w WindowLimit
+		switch limit := fields["limit"].(type) {
+		case int:
+			w.Limit = limit
+		case float64:
+			w.Limit = int(limit)
+		default:
+			return nil, fmt.Errorf("window %d: limit must be a number", i)
+		}
+		switch window := fields["window"].(type) {
+		case string:
+			var err error
+			if w.Window, err = time.ParseDuration(window); err != nil {
+				return nil, fmt.Errorf("window %d: %w", i, err)
+			}
+		case int:
+			w.Window = time.Duration(window) * time.Second
+		case float64:
+			w.Window = time.Duration(window) * time.Second
+		default:
+			return nil, fmt.Errorf("window %d: window must be a duration or a number of seconds", i)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// ValidateWindows checks the extra windows of a rule with the given window:
+// each needs a positive limit, and no two limits of the rule may share a
+// window
+func ValidateWindows(window time.Duration, windows []WindowLimit) error {
+	seen := map[time.Duration]bool{window: true}
+	for _, w := range windows {
+		if w.Limit <= 0 || w.Window <= 0 {
+			return fmt.Errorf("window %s: limit and window must be positive", FormatWindow(w.Window))
+		}
+		if seen[w.Window] {
+			return fmt.Errorf("window %s is set more than once", FormatWindow(w.Window))
+		}
+		seen[w.Window] = true
+	}
+	return nil
+}
+
+// WindowResource returns the resource the counters of an extra window of a
+// rule are kept under, e.g. "orders:POST@1h"
+func WindowResource(stateResource string, window time.Duration) string {
+	return stateResource + "@" + FormatWindow(window)
+}
+
+// FormatWindow formats a window as time.Duration does, without zero
+// minutes and seconds, e.g. "1h" rather than "1h0m0s"
+func FormatWindow(window time.Duration) string {
+	s := window.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
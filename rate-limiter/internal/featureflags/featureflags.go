@@ -0,0 +1,61 @@
+// Package featureflags evaluates the feature flags that gate rate limit
+// rules at decision time. Flags are evaluated by a provider, as in
+// OpenFeature: a JSON file of flags, or an existing flag service speaking
+// the OpenFeature Remote Evaluation Protocol (OFREP).
+package featureflags
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// ErrFlagNotFound is returned by providers for a flag they do not know
+var ErrFlagNotFound = errors.New("flag not found")
+
+// Provider evaluates boolean feature flags for a client
+type Provider interface {
+	BooleanValue(ctx context.Context, flag string, flagCtx domain.FlagContext) (bool, error)
+}
+
+// Evaluator evaluates the flags gating rules with a provider. Flags the
+// provider fails to evaluate are off, so their rules are not enforced;
+// failures are logged when a flag starts and stops failing.
+type Evaluator struct {
+	provider Provider
+	failing  map[string]bool
+	mutex    sync.Mutex
+}
+
+// NewEvaluator creates an evaluator of the flags of provider
+func NewEvaluator(provider Provider) *Evaluator {
+	return &Evaluator{
+		provider: provider,
+		failing:  make(map[string]bool),
+	}
+}
+
+// Enabled reports whether flag is on for flagCtx
+func (e *Evaluator) Enabled(ctx context.Context, flag string, flagCtx domain.FlagContext) bool {
+	on, err := e.provider.BooleanValue(ctx, flag, flagCtx)
+	e.report(flag, err)
+	return err == nil && on
+}
+
+// report logs the first failure of flag and its recovery
+func (e *Evaluator) report(flag string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	switch {
+	case err != nil && !e.failing[flag]:
+		e.failing[flag] = true
+		log.Printf("feature flags: %s is off: %v", flag, err)
+	case err == nil && e.failing[flag]:
+		delete(e.failing, flag)
+		log.Printf("feature flags: %s is evaluated again", flag)
+	}
+}
@@ -0,0 +1,111 @@
+package featureflags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// Flag is a boolean feature flag of a flags file. An enabled flag is on for
+// the targeting keys and tenants it lists and the percentage of other keys;
+// when it lists none and has no percentage, it is on for everyone.
+type Flag struct {
+	Enabled    bool     `json:"enabled"`              // Off for everyone when false
+	Keys       []string `json:"keys,omitempty"`       // e.g., ["customer-42"]
+	Tenants    []string `json:"tenants,omitempty"`    // Client tiers, e.g., ["free"]
+	Percentage int      `json:"percentage,omitempty"` // Of the other keys, 0 to 100
+}
+
+// On reports whether the flag named name is on for flagCtx. Keys are
+// assigned to a percentage by a hash of the flag and the key, so each key
+// is decided consistently and keys stay on as the percentage grows.
+func (f Flag) On(name string, flagCtx domain.FlagContext) bool {
+	switch {
+	case !f.Enabled:
+		return false
+	case len(f.Keys) == 0 && len(f.Tenants) == 0 && f.Percentage == 0:
+		return true
+	case slices.Contains(f.Keys, flagCtx.TargetingKey):
+		return true
+	case flagCtx.Tenant != "" && slices.Contains(f.Tenants, flagCtx.Tenant):
+		return true
+	}
+	return domain.RolloutBucket(name, flagCtx.TargetingKey) < f.Percentage
+}
+
+// FileProvider evaluates the flags of a JSON file, an object of flags by
+// name, which is read again periodically
+type FileProvider struct {
+	path  string
+	flags map[string]Flag
+	mutex sync.RWMutex
+}
+
+// NewFileProvider creates a provider of the flags of the file at path,
+// which must be readable
+func NewFileProvider(path string) (*FileProvider, error) {
+	p := &FileProvider{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Run reads the file again every interval until ctx is done. Flags are kept
+// as they were when the file cannot be read.
+func (p *FileProvider) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.Reload(); err != nil {
+			log.Printf("feature flags: %v", err)
+		}
+	}
+}
+
+// Reload reads the flags of the file
+func (p *FileProvider) Reload() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read flags: %w", err)
+	}
+	var flags map[string]Flag
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return fmt.Errorf("invalid flags file %s: %w", p.path, err)
+	}
+	for name, flag := range flags {
+		if flag.Percentage < 0 || flag.Percentage > 100 {
+			return fmt.Errorf("invalid flags file %s: percentage %d of %s must be between 0 and 100", p.path, flag.Percentage, name)
+		}
+	}
+
+	p.mutex.Lock()
+	p.flags = flags
+	p.mutex.Unlock()
+	return nil
+}
+
+// BooleanValue evaluates flag for flagCtx
+func (p *FileProvider) BooleanValue(ctx context.Context, flag string, flagCtx domain.FlagContext) (bool, error) {
+	p.mutex.RLock()
+	f, ok := p.flags[flag]
+	p.mutex.RUnlock()
+
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrFlagNotFound, flag)
+	}
+	return f.On(flag, flagCtx), nil
+}
@@ -0,0 +1,138 @@
+package featureflags
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// maxCachedEvaluations bounds the evaluations an OFREP provider caches; the
+// cache is emptied when it is full
+const maxCachedEvaluations = 10000
+
+// maxEvaluationSize bounds the body of an OFREP evaluation response
+const maxEvaluationSize = 1 << 20
+
+// OFREPProvider evaluates flags with a flag service speaking the OpenFeature
+// Remote Evaluation Protocol, such as flagd or GO Feature Flag. Evaluations,
+// failed ones included, are reused for the cache TTL, so that decisions do
+// not wait on the service for every request.
+type OFREPProvider struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	ttl     time.Duration
+	cache   map[evaluationKey]evaluation
+	mutex   sync.Mutex
+}
+
+// evaluationKey identifies a cached evaluation
+type evaluationKey struct {
+	flag    string
+	flagCtx domain.FlagContext
+}
+
+// evaluation is a cached evaluation
+type evaluation struct {
+	value     bool
+	err       error
+	expiresAt time.Time
+}
+
+// NewOFREPProvider creates a provider evaluating flags with the service at
+// baseURL, sending token as a bearer token when set. Evaluations time out
+// after timeout and are reused for ttl.
+func NewOFREPProvider(baseURL, token string, timeout, ttl time.Duration) *OFREPProvider {
+	return &OFREPProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+		ttl:     ttl,
+		cache:   make(map[evaluationKey]evaluation),
+	}
+}
+
+// BooleanValue evaluates flag for flagCtx
+func (p *OFREPProvider) BooleanValue(ctx context.Context, flag string, flagCtx domain.FlagContext) (bool, error) {
+	key := evaluationKey{flag: flag, flagCtx: flagCtx}
+	now := time.Now()
+	if p.ttl > 0 {
+		p.mutex.Lock()
+		cached, ok := p.cache[key]
+		p.mutex.Unlock()
+		if ok && now.Before(cached.expiresAt) {
+			return cached.value, cached.err
+		}
+	}
+
+	value, err := p.evaluate(ctx, flag, flagCtx)
+	if p.ttl > 0 && ctx.Err() == nil {
+		p.mutex.Lock()
+		if len(p.cache) >= maxCachedEvaluations {
+			clear(p.cache)
+		}
+		p.cache[key] = evaluation{value: value, err: err, expiresAt: now.Add(p.ttl)}
+		p.mutex.Unlock()
+	}
+	return value, err
+}
+
+// evaluate asks the service for the value of flag for flagCtx
+func (p *OFREPProvider) evaluate(ctx context.Context, flag string, flagCtx domain.FlagContext) (bool, error) {
+	evalCtx := map[string]string{"targetingKey": flagCtx.TargetingKey, "resource": flagCtx.Resource}
+	if flagCtx.Tenant != "" {
+		evalCtx["tenant"] = flagCtx.Tenant
+	}
+	if flagCtx.Method != "" {
+		evalCtx["method"] = flagCtx.Method
+	}
+	body, err := json.Marshal(map[string]interface{}{"context": evalCtx})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/ofrep/v1/evaluate/flags/"+url.PathEscape(flag), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate %s: %w", flag, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Value        interface{} `json:"value"`
+		ErrorCode    string      `json:"errorCode"`
+		ErrorDetails string      `json:"errorDetails"`
+	}
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxEvaluationSize)).Decode(&result)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, fmt.Errorf("%w: %s", ErrFlagNotFound, flag)
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("failed to evaluate %s: %s %s %s", flag, resp.Status, result.ErrorCode, result.ErrorDetails)
+	case decodeErr != nil:
+		return false, fmt.Errorf("failed to evaluate %s: %w", flag, decodeErr)
+	}
+
+	value, ok := result.Value.(bool)
+	if !ok {
+		return false, fmt.Errorf("flag %s is not a boolean flag", flag)
+	}
+	return value, nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// AnalyticsStore defines the interface for long-term decision history storage
+type AnalyticsStore interface {
+	GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor) (*queries.RateLimitHistory, error)
+	GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, interval time.Duration) (*queries.ClientStats, error)
+}
+
+// AnalyticsQueryHandler serves long-range history and statistics queries
+// from the analytics store, keeping them off the primary read model
+type AnalyticsQueryHandler struct {
+	analyticsStore AnalyticsStore
+}
+
+// NewAnalyticsQueryHandler creates a new analytics query handler
+func NewAnalyticsQueryHandler(analyticsStore AnalyticsStore) *AnalyticsQueryHandler {
+	return &AnalyticsQueryHandler{
+		analyticsStore: analyticsStore,
+	}
+}
+
+// Handle processes analytics queries
+func (h *AnalyticsQueryHandler) Handle(ctx context.Context, query queries.Query) (interface{}, error) {
+	switch q := query.(type) {
+	case *queries.GetAnalyticsHistoryQuery:
+		history, err := h.analyticsStore.GetRateLimitHistory(ctx, q.ClientID, q.Resource, q.StartTime, q.EndTime, q.Limit, q.Offset, q.After)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get analytics history: %w", err)
+		}
+		return history, nil
+	case *queries.GetAnalyticsStatsQuery:
+		interval := q.Interval
+		if interval <= 0 {
+			interval = defaultAnalyticsInterval(q.EndTime.Sub(q.StartTime))
+		}
+		stats, err := h.analyticsStore.GetClientStats(ctx, q.ClientID, q.StartTime, q.EndTime, interval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get analytics stats: %w", err)
+		}
+		return stats, nil
+	default:
+		return nil, fmt.Errorf("unknown query type: %T", query)
+	}
+}
+
+// defaultAnalyticsInterval picks a bucket size that keeps time series to a
+// few hundred points for the requested range
+func defaultAnalyticsInterval(span time.Duration) time.Duration {
+	switch {
+	case span <= 6*time.Hour:
+		return time.Minute
+	case span <= 7*24*time.Hour:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
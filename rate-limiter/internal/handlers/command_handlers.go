@@ -2,11 +2,19 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/NickChunglolz/rate-limiter/internal/commands"
 	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
 )
 
 // CommandHandler handles commands in the CQRS pattern
@@ -20,40 +28,206 @@ type EventStore interface {
 	GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error)
 }
 
+// ClientEraser is an event store that can erase every event of a client,
+// recording a tombstone in their place
+type ClientEraser interface {
+	EraseClient(ctx context.Context, clientID string, tombstone *domain.ClientDataErasedEvent) error
+}
+
 // RuleRepository defines the interface for rule storage
 type RuleRepository interface {
 	Save(ctx context.Context, rule domain.RateLimitRule) error
 	GetByResource(ctx context.Context, resource string) ([]domain.RateLimitRule, error)
 	GetByID(ctx context.Context, id string) (*domain.RateLimitRule, error)
+	List(ctx context.Context) ([]domain.RateLimitRule, error) // Ordered by ID
 	Update(ctx context.Context, rule domain.RateLimitRule) error
 	Delete(ctx context.Context, id string) error
 }
 
+// OverrideRepository defines the interface for per-client override storage.
+// Expired overrides may be returned; callers check ActiveAt.
+type OverrideRepository interface {
+	Save(ctx context.Context, override domain.RateLimitOverride) error
+	GetByClient(ctx context.Context, clientID, resource string) ([]domain.RateLimitOverride, error)
+	List(ctx context.Context) ([]domain.RateLimitOverride, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// FreezeRepository defines the interface for freeze storage. Ended freezes
+// may be returned; callers check ActiveAt.
+type FreezeRepository interface {
+	Save(ctx context.Context, freeze domain.Freeze) error
+	List(ctx context.Context) ([]domain.Freeze, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// ClientRepository defines the interface for client registry storage
+type ClientRepository interface {
+	Save(ctx context.Context, client domain.Client) error
+	GetByID(ctx context.Context, id string) (*domain.Client, error)
+	List(ctx context.Context) ([]domain.Client, error)
+	Update(ctx context.Context, client domain.Client) error
+	Delete(ctx context.Context, id string) error
+}
+
+// CounterStore defines the interface for shared windowed counters
+type CounterStore interface {
+	Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	Decrement(ctx context.Context, key string, delta int64) (int64, error)
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+// AggregateCache holds rebuilt aggregates at the version of the events they
+// were rebuilt from, so that decisions on recently decided aggregates skip
+// loading their events
+type AggregateCache interface {
+	Get(aggregateID string) (*domain.RateLimitAggregate, bool)
+	Put(aggregate *domain.RateLimitAggregate)
+	Advance(aggregateID string, expectedVersion int, events []domain.Event)
+	Invalidate(aggregateID string)
+	InvalidateClient(clientID string)
+}
+
+// EventPublisher defines the interface for publishing stored events to
+// projections and exporters
+type EventPublisher interface {
+	Publish(event domain.Event)
+}
+
 // RateLimitCommandHandler handles rate limiting commands
 type RateLimitCommandHandler struct {
 	eventStore     EventStore
-	ruleRepository RuleRepository
+	ruleRepository     RuleRepository
+	overrideRepository OverrideRepository
+	freezeRepository   FreezeRepository
+	rolloutRepository  RolloutRepository
+	leaseRepository    LeaseRepository
+	clientRepository   ClientRepository
+	counterStore       CounterStore
+	aggregateCache     AggregateCache
+	eventPublisher     EventPublisher
+	flags              FlagEvaluator
+	clock              domain.Clock
+	maxRefunds         int
 }
 
+// defaultMaxRefunds is the number of refunds a client may make per window
+// of a rule unless set otherwise
+const defaultMaxRefunds = 10
+
 // NewRateLimitCommandHandler creates a new command handler
 func NewRateLimitCommandHandler(eventStore EventStore, ruleRepository RuleRepository) *RateLimitCommandHandler {
 	return &RateLimitCommandHandler{
 		eventStore:     eventStore,
 		ruleRepository: ruleRepository,
+		clock:          domain.SystemClock{},
+		maxRefunds:     defaultMaxRefunds,
 	}
 }
 
+// WithCounterStore makes fixed window and sliding window counter decisions
+// use the shared counter store instead of the local event history, so that
+// several instances enforce one budget
+func (h *RateLimitCommandHandler) WithCounterStore(counterStore CounterStore) *RateLimitCommandHandler {
+	h.counterStore = counterStore
+	return h
+}
+
+// WithAggregateCache keeps the aggregates of recent decisions in cache, so
+// that deciding them again skips loading and replaying their events. Saves
+// advance the cached aggregates, and a decision on a cached aggregate the
+// store moved past is made again from the store.
+func (h *RateLimitCommandHandler) WithAggregateCache(aggregateCache AggregateCache) *RateLimitCommandHandler {
+	h.aggregateCache = aggregateCache
+	return h
+}
+
+// WithOverrideRepository lets active per-client overrides take precedence
+// over the limit and window of the resource's rule
+func (h *RateLimitCommandHandler) WithOverrideRepository(overrideRepository OverrideRepository) *RateLimitCommandHandler {
+	h.overrideRepository = overrideRepository
+	return h
+}
+
+// WithFreezeRepository enables scheduling freezes
+func (h *RateLimitCommandHandler) WithFreezeRepository(freezeRepository FreezeRepository) *RateLimitCommandHandler {
+	h.freezeRepository = freezeRepository
+	return h
+}
+
+// WithClientRepository enables the client registry
+func (h *RateLimitCommandHandler) WithClientRepository(clientRepository ClientRepository) *RateLimitCommandHandler {
+	h.clientRepository = clientRepository
+	return h
+}
+
+// WithEventPublisher publishes every event after it has been stored
+func (h *RateLimitCommandHandler) WithEventPublisher(eventPublisher EventPublisher) *RateLimitCommandHandler {
+	h.eventPublisher = eventPublisher
+	return h
+}
+
+// WithMaxRefunds sets the number of refunds a client may make per window of
+// a rule, so that refunds cannot lift its limit indefinitely. Zero disables
+// refunds.
+func (h *RateLimitCommandHandler) WithMaxRefunds(maxRefunds int) *RateLimitCommandHandler {
+	h.maxRefunds = maxRefunds
+	return h
+}
+
+// WithClock sets the clock that decisions, rules and resets are timed with
+func (h *RateLimitCommandHandler) WithClock(clock domain.Clock) *RateLimitCommandHandler {
+	h.clock = clock
+	return h
+}
+
 // Handle processes different types of commands
 func (h *RateLimitCommandHandler) Handle(ctx context.Context, cmd commands.Command) error {
 	switch c := cmd.(type) {
 	case *commands.ApplyRateLimitCommand:
 		return h.handleApplyRateLimit(ctx, c)
+	case *commands.ApplyRateLimitsCommand:
+		return h.handleApplyRateLimits(ctx, c)
 	case *commands.CreateRuleCommand:
 		return h.handleCreateRule(ctx, c)
 	case *commands.UpdateRuleCommand:
 		return h.handleUpdateRule(ctx, c)
 	case *commands.ResetRateLimitCommand:
 		return h.handleResetRateLimit(ctx, c)
+	case *commands.RefundRateLimitCommand:
+		return h.handleRefundRateLimit(ctx, c)
+	case *commands.CreateOverrideCommand:
+		return h.handleCreateOverride(ctx, c)
+	case *commands.DeleteOverrideCommand:
+		return h.handleDeleteOverride(ctx, c)
+	case *commands.CreateFreezeCommand:
+		return h.handleCreateFreeze(ctx, c)
+	case *commands.LiftFreezeCommand:
+		return h.handleLiftFreeze(ctx, c)
+	case *commands.StartRolloutCommand:
+		return h.handleStartRollout(ctx, c)
+	case *commands.PromoteRolloutCommand:
+		return h.handlePromoteRollout(ctx, c)
+	case *commands.RollBackRolloutCommand:
+		return h.handleRollBackRollout(ctx, c)
+	case *commands.EvaluateRolloutsCommand:
+		return h.handleEvaluateRollouts(ctx, c)
+	case *commands.GrantLeaseCommand:
+		return h.handleGrantLease(ctx, c)
+	case *commands.RenewLeaseCommand:
+		return h.handleRenewLease(ctx, c)
+	case *commands.ExpireLeasesCommand:
+		return h.handleExpireLeases(ctx, c)
+	case *commands.RegisterClientCommand:
+		return h.handleRegisterClient(ctx, c)
+	case *commands.UpdateClientCommand:
+		return h.handleUpdateClient(ctx, c)
+	case *commands.SetClientDisabledCommand:
+		return h.handleSetClientDisabled(ctx, c)
+	case *commands.DeleteClientCommand:
+		return h.handleDeleteClient(ctx, c)
+	case *commands.EraseClientDataCommand:
+		return h.handleEraseClientData(ctx, c)
 	default:
 		return fmt.Errorf("unknown command type: %T", cmd)
 	}
@@ -61,126 +235,1048 @@ func (h *RateLimitCommandHandler) Handle(ctx context.Context, cmd commands.Comma
 
 // handleApplyRateLimit processes rate limit application
 func (h *RateLimitCommandHandler) handleApplyRateLimit(ctx context.Context, cmd *commands.ApplyRateLimitCommand) error {
-	aggregateID := cmd.ClientID + ":" + cmd.Resource
+	return h.applyRateLimit(ctx, cmd, h.clock.Now())
+}
+
+// applyRateLimit decides the request of cmd at now and stores the decision
+func (h *RateLimitCommandHandler) applyRateLimit(ctx context.Context, cmd *commands.ApplyRateLimitCommand, now time.Time) error {
+	rule, assignment, err := h.selectRule(ctx, cmd.ClientID, cmd.Resource, cmd.Method, now)
+	if errors.Is(err, domain.ErrRuleNotEnforced) {
+		// Allowed without being counted, as though the resource had no rule
+		cmd.Result = nil
+		cmd.Windows = nil
+		cmd.Unenforced = err.Error()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	
-	// Get existing events for the aggregate
-	events, err := h.eventStore.GetEvents(ctx, aggregateID)
+	event, err := h.applyRule(ctx, cmd, rule, now)
 	if err != nil {
-		return fmt.Errorf("failed to get events: %w", err)
+		return err
 	}
 	
-	// Reconstruct aggregate from events
-	aggregate := domain.NewRateLimitAggregate(cmd.ClientID, cmd.Resource)
-	for _, event := range events {
-		aggregate.ApplyEvent(event)
+	cmd.Result = event
+	cmd.Windows = nil
+	if len(rule.Windows) > 0 {
+		err = h.applyWindows(ctx, cmd, rule, now)
 	}
 	
+	// Count the decision towards its cohort of the rule's rollout, if any
+	if err == nil && !cmd.DryRun {
+		h.recordRolloutDecision(ctx, assignment, cmd.Result)
+	}
+	return err
+}
+
+// errStaleAggregate is returned when a decision made on a cached aggregate
+// is not saved because the store moved past it
+var errStaleAggregate = errors.New("cached aggregate is stale")
+
+// applyRule decides the request of cmd at now against one rule, or one
+// window of a rule, and stores the decision unless it is a dry run
+func (h *RateLimitCommandHandler) applyRule(ctx context.Context, cmd *commands.ApplyRateLimitCommand, rule domain.RateLimitRule, now time.Time) (domain.Event, error) {
+	event, err := h.decideRule(ctx, cmd, rule, now, true)
+	if errors.Is(err, errStaleAggregate) {
+		// The cached aggregate was behind the store, e.g. its key was evicted
+		event, err = h.decideRule(ctx, cmd, rule, now, false)
+	}
+	return event, err
+}
+
+// decideRule decides the request of cmd at now against one rule, or one
+// window of a rule, on its aggregate from the cache when cached is true, or
+// else from the store
+func (h *RateLimitCommandHandler) decideRule(ctx context.Context, cmd *commands.ApplyRateLimitCommand, rule domain.RateLimitRule, now time.Time, cached bool) (domain.Event, error) {
+	// Method-specific rules keep their own state
+	resource := rule.StateResource()
+	
+	// Get the aggregate, rebuilt from its events unless it is cached. Rules
+	// counted in the shared counters skip the cache: instances sharing the
+	// counters leave each other's cached aggregates behind, and a decision
+	// already counted cannot be made again.
+	aggregate, cached, err := h.loadCachedAggregate(ctx, cmd.ClientID, resource, cached && !h.usesCounters(rule))
+	if err != nil {
+		return nil, err
+	}
+	
+	// A decision records at most the decision and a threshold warning
+	newEvents := make([]domain.Event, 0, 2)
+	
+	if h.counterStore != nil && (rule.Algorithm == domain.FixedWindow || rule.Algorithm == domain.SlidingWindowCounter) {
+		event, err := h.applyWithCounters(ctx, aggregate, rule, cmd, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply counters: %w", err)
+		}
+		newEvents = append(newEvents, event)
+	} else if rule.Algorithm == domain.SlidingWindowCounter {
+		newEvents = append(newEvents, h.applySlidingWindowCounter(aggregate, rule, cmd, now))
+	} else {
+		newEvents = append(newEvents, h.applyDecision(aggregate, rule, cmd, now))
+	}
+	
+	// A dry run reports the decision without storing it
+	if cmd.DryRun {
+		return newEvents[0], nil
+	}
+	
+	// Warn once when the request takes the client to the soft threshold
+	if applied, ok := newEvents[0].(*domain.RateLimitAppliedEvent); ok && domain.ReachesSoftLimit(applied) {
+		newEvents = append(newEvents, thresholdReachedEvent(applied, cmd))
+	}
+	
+	// Save events. A decision made on a stale cached aggregate is made again.
+	if err := h.saveEvents(ctx, aggregate.ID, newEvents, aggregate.Version); err != nil {
+		if cached && errors.Is(err, domain.ErrConcurrencyConflict) {
+			return nil, fmt.Errorf("%w: %w", errStaleAggregate, err)
+		}
+		return nil, err
+	}
+	
+	return newEvents[0], nil
+}
+
+// applyWindows decides a request that the rule's own window decided against
+// each of the rule's extra windows in turn, and records every decision in
+// cmd.Windows. When a window denies the request, the requests the windows
+// before it counted are given back, so that the request is counted against
+// every window or none, and the denial becomes the result.
+func (h *RateLimitCommandHandler) applyWindows(ctx context.Context, cmd *commands.ApplyRateLimitCommand, rule domain.RateLimitRule, now time.Time) error {
+	limits := rule.Limits()
+	cmd.Windows = append(make([]commands.WindowDecision, 0, len(limits)), commands.WindowDecision{Limit: limits[0], Event: cmd.Result})
+	if _, allowed := cmd.Result.(*domain.RateLimitAppliedEvent); !allowed {
+		return nil
+	}
+	
+	applied := []domain.RateLimitRule{rule}
+	for i, window := range rule.WindowRules() {
+		event, err := h.applyRule(ctx, cmd, window, now)
+		if err == nil {
+			cmd.Windows = append(cmd.Windows, commands.WindowDecision{Limit: limits[i+1], Event: event})
+			if _, allowed := event.(*domain.RateLimitAppliedEvent); allowed {
+				applied = append(applied, window)
+				continue
+			}
+			cmd.Result = event
+		}
+		if cmd.DryRun {
+			return err
+		}
+		
+		reason := "compensation: the " + domain.FormatWindow(window.Window) + " window denied the request"
+		if err != nil {
+			reason = "compensation: the " + domain.FormatWindow(window.Window) + " window failed"
+		}
+		if compensateErr := h.compensateRules(ctx, cmd.ClientID, applied, reason, now); compensateErr != nil {
+			return errors.Join(err, compensateErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// compensationAttempts is how often undoing a request of a multi-resource
+// check is attempted, since a concurrent decision on the same key makes the
+// save conflict
+const compensationAttempts = 3
+
+// handleApplyRateLimits applies the checks in order, all at the same time,
+// and stops at the first one that is denied or fails. The requests the
+// checks before it counted are then undone by compensation events, so the
+// request is counted against every resource or none.
+func (h *RateLimitCommandHandler) handleApplyRateLimits(ctx context.Context, cmd *commands.ApplyRateLimitsCommand) error {
+	now := h.clock.Now()
+	for i, check := range cmd.Checks {
+		err := h.applyRateLimit(ctx, check, now)
+		if _, allowed := check.Result.(*domain.RateLimitAppliedEvent); err == nil && (allowed || check.Unenforced != "") {
+			continue
+		}
+		
+		reason := "compensation: " + check.Resource + " denied the request"
+		if err != nil {
+			reason = "compensation: " + check.Resource + " failed"
+		}
+		if compensateErr := h.compensate(ctx, cmd.Checks[:i], reason, now); compensateErr != nil {
+			return errors.Join(err, compensateErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// compensate undoes the requests counted by applied checks
+func (h *RateLimitCommandHandler) compensate(ctx context.Context, applied []*commands.ApplyRateLimitCommand, reason string, now time.Time) error {
+	var errs []error
+	for _, check := range applied {
+		rule, _, err := h.selectRule(ctx, check.ClientID, check.Resource, check.Method, now)
+		if errors.Is(err, domain.ErrRuleNotEnforced) {
+			continue // Nothing was counted
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to compensate %s: %w", check.Resource, err))
+			continue
+		}
+		if err := h.compensateRules(ctx, check.ClientID, append([]domain.RateLimitRule{rule}, rule.WindowRules()...), reason, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compensateRules undoes the request of a client that rules, the windows
+// of one rule, each counted at now
+func (h *RateLimitCommandHandler) compensateRules(ctx context.Context, clientID string, rules []domain.RateLimitRule, reason string, now time.Time) error {
+	var errs []error
+	for _, rule := range rules {
+		var err error
+		for attempt := 0; attempt < compensationAttempts; attempt++ {
+			if _, err = h.refundRule(ctx, clientID, rule, reason, now, true); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to compensate %s: %w", rule.StateResource(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selectRule returns the rule deciding a client's requests to resource with
+// method, with the candidate of the rule's rollout and the client's active
+// override at now applied, and the rollout cohort the decision counts towards
+func (h *RateLimitCommandHandler) selectRule(ctx context.Context, clientID, resource, method string, now time.Time) (domain.RateLimitRule, rolloutAssignment, error) {
 	// Get applicable rules
-	rules, err := h.ruleRepository.GetByResource(ctx, cmd.Resource)
+	rules, err := h.ruleRepository.GetByResource(ctx, resource)
 	if err != nil {
-		return fmt.Errorf("failed to get rules: %w", err)
+		return domain.RateLimitRule{}, rolloutAssignment{}, fmt.Errorf("failed to get rules: %w", err)
 	}
 	
 	if len(rules) == 0 {
-		return fmt.Errorf("no rules found for resource: %s", cmd.Resource)
+		return domain.RateLimitRule{}, rolloutAssignment{}, fmt.Errorf("no rules found for resource: %s", resource)
 	}
 	
-	// Apply the most restrictive rule
-	rule := rules[0] // For simplicity, using first rule
+	// Rules gated by a feature flag that is off for the client are passed
+	// over. Method-specific rules take precedence over rules for any method.
+	enforced, off := enforcedRules(ctx, h.flags, h.clientRepository, rules, clientID, resource, method)
+	rule, ok := domain.SelectRule(enforced, method)
+	if !ok && len(off) > 0 {
+		return domain.RateLimitRule{}, rolloutAssignment{}, notEnforced(resource, off)
+	}
+	if !ok {
+		return domain.RateLimitRule{}, rolloutAssignment{}, fmt.Errorf("no rules found for resource %s and method %s", resource, method)
+	}
+	
+	// Clients in the canary cohort of a rollout are decided by its candidate
+	assignment, err := h.assignRollout(ctx, &rule, clientID)
+	if err != nil {
+		return domain.RateLimitRule{}, rolloutAssignment{}, err
+	}
 	
-	var newEvents []domain.Event
+	// Active overrides take precedence over the rule's limit, keeping its
+	// state. Their decisions say nothing about the rule, so they count
+	// towards no rollout cohort.
+	if h.overrideRepository != nil {
+		overrides, err := h.overrideRepository.GetByClient(ctx, clientID, resource)
+		if err != nil {
+			return domain.RateLimitRule{}, rolloutAssignment{}, fmt.Errorf("failed to get overrides: %w", err)
+		}
+		if override, ok := domain.SelectOverride(overrides, method, now); ok {
+			rule = override.Apply(rule)
+			assignment = rolloutAssignment{}
+		}
+	}
 	
-	if aggregate.CanMakeRequest(rule) {
-		// Allow the request and update state
-		event := &domain.RateLimitAppliedEvent{
+	return rule, assignment, nil
+}
+
+// thresholdReachedEvent returns the event recording that the request of
+// applied reached the soft threshold of its rule
+func thresholdReachedEvent(applied *domain.RateLimitAppliedEvent, cmd *commands.ApplyRateLimitCommand) *domain.RateLimitThresholdReachedEvent {
+	return &domain.RateLimitThresholdReachedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("threshold", applied.Time),
+			Type:    "RateLimitThresholdReached",
+			Time:    applied.Time,
+			AggrID:  applied.AggrID,
+			Version: applied.Version + 1,
+		},
+		ClientID:     applied.ClientID,
+		Resource:     applied.Resource,
+		RequestCount: applied.RequestCount,
+		Limit:        applied.Limit,
+		SoftLimit:    applied.SoftLimit,
+		WindowStart:  applied.WindowStart,
+		WindowEnd:    applied.WindowEnd,
+		IPAddress:    cmd.IPAddress,
+		UserAgent:    cmd.UserAgent,
+	}
+}
+
+// applyDecision decides a request with the rule's algorithm and returns the
+// resulting event
+func (h *RateLimitCommandHandler) applyDecision(aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, cmd *commands.ApplyRateLimitCommand, now time.Time) domain.Event {
+	decision := aggregate.Decide(rule, now)
+	
+	if decision.Allowed {
+		return &domain.RateLimitAppliedEvent{
 			BaseEvent: domain.BaseEvent{
-				ID:      fmt.Sprintf("applied-%d", time.Now().UnixNano()),
+				ID:      domain.NewEventID("applied", now),
 				Type:    "RateLimitApplied",
-				Time:    time.Now(),
-				AggrID:  aggregateID,
+				Time:    now,
+				AggrID:  aggregate.ID,
 				Version: aggregate.Version + 1,
 			},
 			ClientID:       cmd.ClientID,
-			Resource:       cmd.Resource,
-			WindowStart:    time.Now().Truncate(rule.Window),
-			WindowEnd:      time.Now().Truncate(rule.Window).Add(rule.Window),
-			RequestCount:   aggregate.State.RequestCount + 1,
+			IPAddress:      cmd.IPAddress,
+			UserAgent:      cmd.UserAgent,
+			Resource:       aggregate.State.Resource,
+			WindowStart:    decision.WindowStart,
+			WindowEnd:      decision.WindowEnd,
+			RequestCount:   decision.RequestCount,
 			Limit:          rule.Limit,
-			RemainingQuota: rule.Limit - (aggregate.State.RequestCount + 1),
+			RemainingQuota: decision.Remaining,
+			Tokens:         decision.Tokens,
+			SoftLimit:      rule.SoftLimit(),
 		}
-		newEvents = append(newEvents, event)
-	} else {
-		// Block the request
-		event := &domain.RateLimitExceededEvent{
+	}
+	
+	return &domain.RateLimitExceededEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("exceeded", now),
+			Type:    "RateLimitExceeded",
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:     cmd.ClientID,
+		IPAddress:    cmd.IPAddress,
+		UserAgent:    cmd.UserAgent,
+		Resource:     aggregate.State.Resource,
+		RequestCount: decision.RequestCount,
+		Limit:        rule.Limit,
+		WindowStart:  decision.WindowStart,
+		WindowEnd:    decision.WindowEnd,
+		BlockedUntil: decision.RetryAt,
+		Tokens:       decision.Tokens,
+	}
+}
+
+// applySlidingWindowCounter decides a request using the two-bucket sliding
+// window approximation and returns the resulting event
+func (h *RateLimitCommandHandler) applySlidingWindowCounter(aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, cmd *commands.ApplyRateLimitCommand, now time.Time) domain.Event {
+	aggregateID := aggregate.ID
+	windowStart, previous, current := aggregate.SlidingWindowCounts(rule.Window, now)
+	windowEnd := windowStart.Add(rule.Window)
+	
+	estimate := domain.SlidingWindowCounterEstimate(previous, current, windowStart, rule.Window, now)
+	if estimate+1 <= float64(rule.Limit) {
+		remaining := int(math.Floor(float64(rule.Limit) - (estimate + 1)))
+		return &domain.RateLimitAppliedEvent{
 			BaseEvent: domain.BaseEvent{
-				ID:      fmt.Sprintf("exceeded-%d", time.Now().UnixNano()),
-				Type:    "RateLimitExceeded",
-				Time:    time.Now(),
+				ID:      domain.NewEventID("applied", now),
+				Type:    "RateLimitApplied",
+				Time:    now,
 				AggrID:  aggregateID,
 				Version: aggregate.Version + 1,
 			},
-			ClientID:     cmd.ClientID,
-			Resource:     cmd.Resource,
-			RequestCount: aggregate.State.RequestCount + 1,
-			Limit:        rule.Limit,
-			WindowStart:  aggregate.State.WindowStart,
-			WindowEnd:    aggregate.State.WindowEnd,
-			BlockedUntil: aggregate.State.WindowEnd,
+			ClientID:       cmd.ClientID,
+			IPAddress:      cmd.IPAddress,
+			UserAgent:      cmd.UserAgent,
+			Resource:       aggregate.State.Resource,
+			WindowStart:    windowStart,
+			WindowEnd:      windowEnd,
+			RequestCount:   current + 1,
+			PreviousCount:  previous,
+			Limit:          rule.Limit,
+			RemainingQuota: remaining,
+			SoftLimit:      rule.SoftLimit(),
 		}
-		newEvents = append(newEvents, event)
 	}
 	
-	// Save events
-	return h.eventStore.SaveEvents(ctx, aggregateID, newEvents, aggregate.Version)
+	// Denied requests are not counted against the window
+	return &domain.RateLimitExceededEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("exceeded", now),
+			Type:    "RateLimitExceeded",
+			Time:    now,
+			AggrID:  aggregateID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:      cmd.ClientID,
+		IPAddress:     cmd.IPAddress,
+		UserAgent:     cmd.UserAgent,
+		Resource:      aggregate.State.Resource,
+		RequestCount:  current,
+		PreviousCount: previous,
+		Limit:         rule.Limit,
+		WindowStart:   windowStart,
+		WindowEnd:     windowEnd,
+		BlockedUntil:  domain.SlidingWindowCounterRetryAt(previous, current, rule.Limit, windowStart, rule.Window, now),
+	}
+}
+
+// applyWithCounters decides a request against the shared counter store. The
+// current window's counter is incremented first and rolled back if the
+// request turns out to be over the limit. A dry run reads the counter and
+// decides as if it had been incremented.
+func (h *RateLimitCommandHandler) applyWithCounters(ctx context.Context, aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, cmd *commands.ApplyRateLimitCommand, now time.Time) (domain.Event, error) {
+	windowStart := now.Truncate(rule.Window)
+	windowEnd := windowStart.Add(rule.Window)
+	currentKey := counterKey(aggregate.ID, windowStart)
+	
+	// Keep counters for two windows so the sliding counter can read the previous one
+	var current int64
+	var err error
+	if cmd.DryRun {
+		current, err = h.counterStore.Get(ctx, currentKey)
+		current++
+	} else {
+		current, err = h.counterStore.Increment(ctx, currentKey, 1, 2*rule.Window)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	var previous int64
+	estimate := float64(current)
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		previous, err = h.counterStore.Get(ctx, counterKey(aggregate.ID, windowStart.Add(-rule.Window)))
+		if err != nil {
+			return nil, err
+		}
+		estimate = domain.SlidingWindowCounterEstimate(int(previous), int(current), windowStart, rule.Window, now)
+	}
+	
+	if estimate <= float64(rule.Limit) {
+		return &domain.RateLimitAppliedEvent{
+			BaseEvent: domain.BaseEvent{
+				ID:      domain.NewEventID("applied", now),
+				Type:    "RateLimitApplied",
+				Time:    now,
+				AggrID:  aggregate.ID,
+				Version: aggregate.Version + 1,
+			},
+			ClientID:       cmd.ClientID,
+			IPAddress:      cmd.IPAddress,
+			UserAgent:      cmd.UserAgent,
+			Resource:       aggregate.State.Resource,
+			WindowStart:    windowStart,
+			WindowEnd:      windowEnd,
+			RequestCount:   int(current),
+			PreviousCount:  int(previous),
+			Limit:          rule.Limit,
+			RemainingQuota: int(math.Floor(float64(rule.Limit) - estimate)),
+			SoftLimit:      rule.SoftLimit(),
+		}, nil
+	}
+	
+	// Denied requests are not counted against the window
+	if cmd.DryRun {
+		current--
+	} else if current, err = h.counterStore.Decrement(ctx, currentKey, 1); err != nil {
+		return nil, err
+	}
+	
+	blockedUntil := windowEnd
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		blockedUntil = domain.SlidingWindowCounterRetryAt(int(previous), int(current), rule.Limit, windowStart, rule.Window, now)
+	}
+	
+	return &domain.RateLimitExceededEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("exceeded", now),
+			Type:    "RateLimitExceeded",
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:      cmd.ClientID,
+		IPAddress:     cmd.IPAddress,
+		UserAgent:     cmd.UserAgent,
+		Resource:      aggregate.State.Resource,
+		RequestCount:  int(current),
+		PreviousCount: int(previous),
+		Limit:         rule.Limit,
+		WindowStart:   windowStart,
+		WindowEnd:     windowEnd,
+		BlockedUntil:  blockedUntil,
+	}, nil
+}
+
+// counterKey builds a counter key that is safe for text protocols such as
+// Memcached's (no whitespace, at most 250 bytes)
+func counterKey(aggregateID string, windowStart time.Time) string {
+	key := fmt.Sprintf("rl:%s:%d", url.PathEscape(aggregateID), windowStart.Unix())
+	if len(key) > 250 {
+		sum := sha1.Sum([]byte(aggregateID))
+		key = fmt.Sprintf("rl:%s:%d", hex.EncodeToString(sum[:]), windowStart.Unix())
+	}
+	return key
 }
 
 // handleCreateRule creates a new rate limit rule
 func (h *RateLimitCommandHandler) handleCreateRule(ctx context.Context, cmd *commands.CreateRuleCommand) error {
+	if err := validateKeyTemplate(cmd.KeyTemplate); err != nil {
+		return err
+	}
+	if err := validateSoftThreshold(cmd.SoftThreshold); err != nil {
+		return err
+	}
+	limit, window, err := resolveParameters(cmd.Parameters, cmd.Algorithm, cmd.Limit, cmd.Window)
+	if err != nil {
+		return err
+	}
+	if err := validateWindows(window, cmd.Windows); err != nil {
+		return err
+	}
+	
 	rule := domain.RateLimitRule{
-		ID:        fmt.Sprintf("rule-%d", time.Now().UnixNano()),
-		Resource:  cmd.Resource,
-		Limit:     cmd.Limit,
-		Window:    cmd.Window,
-		Algorithm: domain.Algorithm(cmd.Algorithm),
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:            fmt.Sprintf("rule-%d", time.Now().UnixNano()),
+		Resource:      cmd.Resource,
+		Method:        strings.ToUpper(cmd.Method),
+		Limit:         limit,
+		Window:        window,
+		Algorithm:     domain.Algorithm(cmd.Algorithm),
+		KeyTemplate:   cmd.KeyTemplate,
+		SoftThreshold: cmd.SoftThreshold,
+		Parameters:    cmd.Parameters,
+		Windows:       cmd.Windows,
+		Flag:          cmd.Flag,
+		CreatedAt:     h.clock.Now(),
+		UpdatedAt:     h.clock.Now(),
 	}
+	rule.RuleAnnotations = cmd.Annotations
+	rule.CreatedBy = principal.FromContext(ctx)
+	rule.LastModifiedBy = rule.CreatedBy
 	
 	return h.ruleRepository.Save(ctx, rule)
 }
 
 // handleUpdateRule updates an existing rate limit rule
 func (h *RateLimitCommandHandler) handleUpdateRule(ctx context.Context, cmd *commands.UpdateRuleCommand) error {
+	if err := validateKeyTemplate(cmd.KeyTemplate); err != nil {
+		return err
+	}
+	if err := validateSoftThreshold(cmd.SoftThreshold); err != nil {
+		return err
+	}
+	limit, window, err := resolveParameters(cmd.Parameters, cmd.Algorithm, cmd.Limit, cmd.Window)
+	if err != nil {
+		return err
+	}
+	if err := validateWindows(window, cmd.Windows); err != nil {
+		return err
+	}
+	
 	rule, err := h.ruleRepository.GetByID(ctx, cmd.RuleID)
 	if err != nil {
 		return fmt.Errorf("failed to get rule: %w", err)
 	}
 	
 	rule.Resource = cmd.Resource
-	rule.Limit = cmd.Limit
-	rule.Window = cmd.Window
+	rule.Method = strings.ToUpper(cmd.Method)
+	rule.Limit = limit
+	rule.Window = window
 	rule.Algorithm = domain.Algorithm(cmd.Algorithm)
-	rule.UpdatedAt = time.Now()
+	rule.KeyTemplate = cmd.KeyTemplate
+	rule.SoftThreshold = cmd.SoftThreshold
+	rule.Parameters = cmd.Parameters
+	rule.Windows = cmd.Windows
+	rule.Flag = cmd.Flag
+	rule.UpdatedAt = h.clock.Now()
+	rule.Description = cmd.Annotations.Description
+	rule.Owner = cmd.Annotations.Owner
+	rule.ChangeRef = cmd.Annotations.ChangeRef
+	rule.LastModifiedBy = principal.FromContext(ctx)
 	
 	return h.ruleRepository.Update(ctx, *rule)
 }
 
-// handleResetRateLimit resets rate limit for a client/resource
+// validateKeyTemplate checks a rule's optional key template
+func validateKeyTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+	if _, err := keytemplate.Parse(text); err != nil {
+		return fmt.Errorf("invalid key template: %w", err)
+	}
+	return nil
+}
+
+// validateSoftThreshold checks a rule's optional soft threshold
+func validateSoftThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return fmt.Errorf("invalid soft threshold %g: must be between 0 and 1", threshold)
+	}
+	return nil
+}
+
+// resolveParameters checks a rule's optional algorithm parameters and
+// returns the limit and window they resolve to
+func resolveParameters(parameters *domain.AlgorithmParameters, algorithm string, limit int, window time.Duration) (int, time.Duration, error) {
+	limit, window, err := parameters.Resolve(domain.Algorithm(algorithm), limit, window)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid algorithm parameters: %w", err)
+	}
+	return limit, window, nil
+}
+
+// validateWindows checks the optional extra windows of a rule with the
+// given window
+func validateWindows(window time.Duration, windows []domain.WindowLimit) error {
+	if err := domain.ValidateWindows(window, windows); err != nil {
+		return fmt.Errorf("invalid windows: %w", err)
+	}
+	return nil
+}
+
+// handleCreateOverride grants a client a temporary limit for a resource
+func (h *RateLimitCommandHandler) handleCreateOverride(ctx context.Context, cmd *commands.CreateOverrideCommand) error {
+	if h.overrideRepository == nil {
+		return fmt.Errorf("overrides are not enabled")
+	}
+	
+	now := h.clock.Now()
+	if !cmd.ExpiresAt.After(now) {
+		return fmt.Errorf("override must expire in the future")
+	}
+	
+	override := domain.RateLimitOverride{
+		ID:        fmt.Sprintf("override-%d", time.Now().UnixNano()),
+		ClientID:  cmd.ClientID,
+		Resource:  cmd.Resource,
+		Method:    strings.ToUpper(cmd.Method),
+		Limit:     cmd.Limit,
+		Window:    cmd.Window,
+		Reason:    cmd.Reason,
+		ExpiresAt: cmd.ExpiresAt,
+		CreatedAt: now,
+	}
+	
+	if err := h.overrideRepository.Save(ctx, override); err != nil {
+		return fmt.Errorf("failed to save override: %w", err)
+	}
+	
+	cmd.Result = &override
+	return nil
+}
+
+// handleDeleteOverride revokes an override before it expires
+func (h *RateLimitCommandHandler) handleDeleteOverride(ctx context.Context, cmd *commands.DeleteOverrideCommand) error {
+	if h.overrideRepository == nil {
+		return fmt.Errorf("overrides are not enabled")
+	}
+	
+	return h.overrideRepository.Delete(ctx, cmd.OverrideID)
+}
+
+// handleCreateFreeze schedules a freeze, starting now unless it has a start
+func (h *RateLimitCommandHandler) handleCreateFreeze(ctx context.Context, cmd *commands.CreateFreezeCommand) error {
+	if h.freezeRepository == nil {
+		return fmt.Errorf("freezes are not enabled")
+	}
+	
+	mode, err := domain.ParseFreezeMode(cmd.Mode)
+	if err != nil {
+		return err
+	}
+	
+	now := h.clock.Now()
+	startsAt := cmd.StartsAt
+	if startsAt.IsZero() {
+		startsAt = now
+	}
+	if !cmd.EndsAt.IsZero() && (!cmd.EndsAt.After(startsAt) || !cmd.EndsAt.After(now)) {
+		return fmt.Errorf("freeze must end in the future and after it starts")
+	}
+	
+	freeze := domain.Freeze{
+		ID:        fmt.Sprintf("freeze-%d", time.Now().UnixNano()),
+		Resource:  cmd.Resource,
+		Mode:      mode,
+		Reason:    cmd.Reason,
+		StartsAt:  startsAt,
+		EndsAt:    cmd.EndsAt,
+		CreatedAt: now,
+	}
+	
+	if err := h.freezeRepository.Save(ctx, freeze); err != nil {
+		return fmt.Errorf("failed to save freeze: %w", err)
+	}
+	
+	cmd.Result = &freeze
+	return nil
+}
+
+// handleLiftFreeze ends a freeze, or cancels it before it starts
+func (h *RateLimitCommandHandler) handleLiftFreeze(ctx context.Context, cmd *commands.LiftFreezeCommand) error {
+	if h.freezeRepository == nil {
+		return fmt.Errorf("freezes are not enabled")
+	}
+	
+	return h.freezeRepository.Delete(ctx, cmd.FreezeID)
+}
+
+// handleRegisterClient adds a client to the registry
+func (h *RateLimitCommandHandler) handleRegisterClient(ctx context.Context, cmd *commands.RegisterClientCommand) error {
+	if h.clientRepository == nil {
+		return fmt.Errorf("client registry is not enabled")
+	}
+	
+	now := h.clock.Now()
+	client := domain.Client{
+		ID:        cmd.ClientID,
+		Name:      cmd.Name,
+		Tier:      cmd.Tier,
+		Tags:      cmd.Tags,
+		Contact:   cmd.Contact,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	
+	if err := h.clientRepository.Save(ctx, client); err != nil {
+		return fmt.Errorf("failed to save client: %w", err)
+	}
+	
+	cmd.Result = &client
+	return nil
+}
+
+// handleUpdateClient replaces a client's metadata, keeping its state
+func (h *RateLimitCommandHandler) handleUpdateClient(ctx context.Context, cmd *commands.UpdateClientCommand) error {
+	if h.clientRepository == nil {
+		return fmt.Errorf("client registry is not enabled")
+	}
+	
+	client, err := h.clientRepository.GetByID(ctx, cmd.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to get client: %w", err)
+	}
+	
+	client.Name = cmd.Name
+	client.Tier = cmd.Tier
+	client.Tags = cmd.Tags
+	client.Contact = cmd.Contact
+	client.UpdatedAt = h.clock.Now()
+	
+	if err := h.clientRepository.Update(ctx, *client); err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+	
+	cmd.Result = client
+	return nil
+}
+
+// handleSetClientDisabled disables or re-enables a client
+func (h *RateLimitCommandHandler) handleSetClientDisabled(ctx context.Context, cmd *commands.SetClientDisabledCommand) error {
+	if h.clientRepository == nil {
+		return fmt.Errorf("client registry is not enabled")
+	}
+	
+	client, err := h.clientRepository.GetByID(ctx, cmd.ClientID)
+	if err != nil {
+		return fmt.Errorf("failed to get client: %w", err)
+	}
+	
+	now := h.clock.Now()
+	if cmd.Disabled && !client.Disabled {
+		client.DisabledAt = &now
+	}
+	if !cmd.Disabled {
+		client.DisabledAt = nil
+	}
+	client.Disabled = cmd.Disabled
+	client.UpdatedAt = now
+	
+	if err := h.clientRepository.Update(ctx, *client); err != nil {
+		return fmt.Errorf("failed to update client: %w", err)
+	}
+	
+	cmd.Result = client
+	return nil
+}
+
+// handleDeleteClient removes a client from the registry
+func (h *RateLimitCommandHandler) handleDeleteClient(ctx context.Context, cmd *commands.DeleteClientCommand) error {
+	if h.clientRepository == nil {
+		return fmt.Errorf("client registry is not enabled")
+	}
+	
+	return h.clientRepository.Delete(ctx, cmd.ClientID)
+}
+
+// handleEraseClientData deletes a client's overrides and leases and erases
+// its events from the event store, then publishes the tombstone so that
+// projections and exporters drop the client too. Registry entries are kept.
+func (h *RateLimitCommandHandler) handleEraseClientData(ctx context.Context, cmd *commands.EraseClientDataCommand) error {
+	eraser, ok := h.eventStore.(ClientEraser)
+	if !ok {
+		return fmt.Errorf("event store cannot erase client data")
+	}
+	
+	now := h.clock.Now()
+	tombstone := &domain.ClientDataErasedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("erased", now),
+			Type:    "ClientDataErased",
+			Time:    now,
+			AggrID:  cmd.ClientID,
+			Version: 1,
+		},
+		ClientID: cmd.ClientID,
+	}
+	
+	if h.overrideRepository != nil {
+		overrides, err := h.overrideRepository.GetByClient(ctx, cmd.ClientID, "")
+		if err != nil {
+			return fmt.Errorf("failed to get overrides: %w", err)
+		}
+		for _, override := range overrides {
+			if err := h.overrideRepository.Delete(ctx, override.ID); err != nil {
+				return fmt.Errorf("failed to delete override: %w", err)
+			}
+			tombstone.Overrides++
+		}
+	}
+	if h.leaseRepository != nil {
+		if err := h.deleteClientLeases(ctx, cmd.ClientID); err != nil {
+			return err
+		}
+	}
+	
+	if err := eraser.EraseClient(ctx, cmd.ClientID, tombstone); err != nil {
+		return fmt.Errorf("failed to erase events: %w", err)
+	}
+	if h.aggregateCache != nil {
+		h.aggregateCache.InvalidateClient(cmd.ClientID)
+	}
+	if h.eventPublisher != nil {
+		h.eventPublisher.Publish(tombstone)
+	}
+	
+	cmd.Result = tombstone
+	return nil
+}
+
+// handleResetRateLimit resets rate limit for a client/resource, and the
+// extra windows of its rule
 func (h *RateLimitCommandHandler) handleResetRateLimit(ctx context.Context, cmd *commands.ResetRateLimitCommand) error {
-	aggregateID := cmd.ClientID + ":" + cmd.Resource
+	now := h.clock.Now()
+	if err := h.resetWindow(ctx, cmd.ClientID, cmd.Resource, now); err != nil {
+		return err
+	}
+	
+	// The state of a method-specific rule is kept under "resource:METHOD"
+	resources := []string{cmd.Resource}
+	if i := strings.LastIndex(cmd.Resource, ":"); i > 0 {
+		resources = append(resources, cmd.Resource[:i])
+	}
+	for _, resource := range resources {
+		rules, err := h.ruleRepository.GetByResource(ctx, resource)
+		if err != nil {
+			return fmt.Errorf("failed to get rules: %w", err)
+		}
+		for _, rule := range rules {
+			if rule.StateResource() != cmd.Resource {
+				continue
+			}
+			for _, window := range rule.WindowRules() {
+				if err := h.resetWindow(ctx, cmd.ClientID, window.StateResource(), now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resetWindow starts a new window of a client's state for resource at now.
+// The reset is appended after the events in the store, bypassing the
+// aggregate cache.
+func (h *RateLimitCommandHandler) resetWindow(ctx context.Context, clientID, resource string, now time.Time) error {
+	aggregate, _, err := h.loadCachedAggregate(ctx, clientID, resource, false)
+	if err != nil {
+		return err
+	}
 	
 	event := &domain.RateLimitWindowResetEvent{
 		BaseEvent: domain.BaseEvent{
 			ID:      fmt.Sprintf("reset-%d", time.Now().UnixNano()),
 			Type:    "RateLimitWindowReset",
-			Time:    time.Now(),
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:    clientID,
+		Resource:    resource,
+		WindowStart: now,
+	}
+	
+	return h.saveEvents(ctx, aggregate.ID, []domain.Event{event}, aggregate.Version)
+}
+
+// handleRefundRateLimit gives back the quota of a client's most recent
+// allowed request, at most maxRefunds times per window of the rule
+func (h *RateLimitCommandHandler) handleRefundRateLimit(ctx context.Context, cmd *commands.RefundRateLimitCommand) error {
+	event, err := h.refund(ctx, cmd.ClientID, cmd.Resource, cmd.Method, cmd.Reason, h.clock.Now(), false)
+	if err != nil {
+		return err
+	}
+	
+	cmd.Result = event
+	return nil
+}
+
+// refund gives back the quota of the most recent allowed request of a client
+// at now. A compensation is not counted against the refunds of the window.
+// The request is given back to the extra windows of the rule too, except
+// those that no longer count it.
+func (h *RateLimitCommandHandler) refund(ctx context.Context, clientID, resource, method, reason string, now time.Time, compensation bool) (*domain.RateLimitRefundedEvent, error) {
+	rule, _, err := h.selectRule(ctx, clientID, resource, method, now)
+	if err != nil {
+		return nil, err
+	}
+	
+	event, err := h.refundRule(ctx, clientID, rule, reason, now, compensation)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Only the refund of the rule's own window counts against its refunds
+	var errs []error
+	for _, window := range rule.WindowRules() {
+		if _, err := h.refundRule(ctx, clientID, window, reason, now, true); err != nil && !errors.Is(err, domain.ErrNothingToRefund) {
+			errs = append(errs, fmt.Errorf("failed to refund %s: %w", window.StateResource(), err))
+		}
+	}
+	return event, errors.Join(errs...)
+}
+
+// refundRule gives back the quota of the most recent allowed request of a
+// client to one rule, or one window of a rule, at now
+func (h *RateLimitCommandHandler) refundRule(ctx context.Context, clientID string, rule domain.RateLimitRule, reason string, now time.Time, compensation bool) (*domain.RateLimitRefundedEvent, error) {
+	stateResource := rule.StateResource()
+	aggregateID := clientID + ":" + stateResource
+	
+	// Refunds given back to the shared counters skip the aggregate cache,
+	// as decisions counted in them do
+	aggregate, _, err := h.loadCachedAggregate(ctx, clientID, stateResource, !h.usesCounters(rule))
+	if err != nil {
+		return nil, err
+	}
+	
+	// Refunds are counted per fixed window of the rule, whatever its algorithm
+	windowStart := now.Truncate(rule.Window)
+	refunds := 0
+	if aggregate.State.RefundWindowStart.Equal(windowStart) {
+		refunds = aggregate.State.Refunds
+	}
+	if !compensation {
+		if refunds >= h.maxRefunds {
+			return nil, fmt.Errorf("%w: %d refunds per window", domain.ErrRefundLimitReached, h.maxRefunds)
+		}
+		refunds++
+	}
+	
+	var refund domain.Decision
+	var ok bool
+	counted := h.counterStore != nil && (rule.Algorithm == domain.FixedWindow || rule.Algorithm == domain.SlidingWindowCounter)
+	if counted {
+		refund, ok, err = h.refundCounters(ctx, aggregate, rule, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to refund counters: %w", err)
+		}
+	} else {
+		refund, ok = aggregate.Refund(rule, now)
+	}
+	if !ok {
+		return nil, domain.ErrNothingToRefund
+	}
+	
+	event := &domain.RateLimitRefundedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("refunded", now),
+			Type:    "RateLimitRefunded",
+			Time:    now,
 			AggrID:  aggregateID,
-			Version: 1,
+			Version: aggregate.Version + 1,
 		},
-		ClientID:    cmd.ClientID,
-		Resource:    cmd.Resource,
-		WindowStart: time.Now(),
+		ClientID:       clientID,
+		Resource:       stateResource,
+		WindowStart:    windowStart,
+		WindowEnd:      windowStart.Add(rule.Window),
+		RequestCount:   refund.RequestCount,
+		Limit:          rule.Limit,
+		RemainingQuota: refund.Remaining,
+		Tokens:         refund.Tokens,
+		Refunds:        refunds,
+		Reason:         reason,
+		Compensation:   compensation,
+	}
+	
+	if err := h.saveEvents(ctx, aggregateID, []domain.Event{event}, aggregate.Version); err != nil {
+		return nil, err
+	}
+	
+	// The shared counter is given back once the refund is stored, so that a
+	// refund retried after a conflicting save does not give it back twice
+	if counted {
+		if _, err := h.counterStore.Decrement(ctx, counterKey(aggregate.ID, windowStart), 1); err != nil {
+			return nil, fmt.Errorf("failed to refund counters: %w", err)
+		}
+	}
+	
+	return event, nil
+}
+
+// refundCounters returns the counts of the current window's counter in the
+// shared counter store after giving back a request, or false when the
+// counter counts none. The counter itself is decremented by the caller.
+func (h *RateLimitCommandHandler) refundCounters(ctx context.Context, aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, now time.Time) (domain.Decision, bool, error) {
+	windowStart := now.Truncate(rule.Window)
+	current, err := h.counterStore.Get(ctx, counterKey(aggregate.ID, windowStart))
+	if err != nil || current == 0 {
+		return domain.Decision{}, false, err
+	}
+	current--
+	
+	estimate := float64(current)
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		previous, err := h.counterStore.Get(ctx, counterKey(aggregate.ID, windowStart.Add(-rule.Window)))
+		if err != nil {
+			return domain.Decision{}, false, err
+		}
+		estimate = domain.SlidingWindowCounterEstimate(int(previous), int(current), windowStart, rule.Window, now)
+	}
+	
+	return domain.Decision{
+		Allowed:      true,
+		RequestCount: int(current),
+		Remaining:    max(int(math.Floor(float64(rule.Limit)-estimate)), 0),
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(rule.Window),
+	}, true, nil
+}
+
+// saveEvents stores events and publishes them once they are persisted
+func (h *RateLimitCommandHandler) saveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	if err := h.eventStore.SaveEvents(ctx, aggregateID, events, expectedVersion); err != nil {
+		// The cached aggregate may be behind the store
+		if h.aggregateCache != nil {
+			h.aggregateCache.Invalidate(aggregateID)
+		}
+		return err
+	}
+	if h.aggregateCache != nil {
+		h.aggregateCache.Advance(aggregateID, expectedVersion, events)
+	}
+	
+	if h.eventPublisher != nil {
+		for _, event := range events {
+			h.eventPublisher.Publish(event)
+		}
 	}
 	
-	return h.eventStore.SaveEvents(ctx, aggregateID, []domain.Event{event}, 0)
+	return nil
 }
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// EventReader reads the stored events of an aggregate
+type EventReader interface {
+	GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error)
+}
+
+// WithEventStore enables explain queries, which replay the events of a
+// client's key to show the window math of its next decision
+func (h *RateLimitQueryHandler) WithEventStore(eventStore EventReader) *RateLimitQueryHandler {
+	h.eventStore = eventStore
+	return h
+}
+
+// handleExplainDecision explains how a request of the client to the
+// resource would be decided now, following the checks of the service in
+// order, and the conditions of the last stored decision
+func (h *RateLimitQueryHandler) handleExplainDecision(ctx context.Context, query *queries.ExplainDecisionQuery) (*queries.DecisionExplanation, error) {
+	if h.eventStore == nil {
+		return nil, fmt.Errorf("explanations are not enabled")
+	}
+
+	now := h.clock.Now()
+	explanation := &queries.DecisionExplanation{
+		ClientID:      query.ClientID,
+		Resource:      query.Resource,
+		Method:        strings.ToUpper(query.Method),
+		Key:           query.Key,
+		StateResource: domain.ScopedResource(query.Resource, query.Method),
+		EvaluatedAt:   now,
+		Candidates:    []queries.RuleCandidate{},
+		Checks:        []queries.Condition{},
+	}
+	if explanation.Key == "" {
+		explanation.Key = query.ClientID
+	}
+
+	if err := h.explainClient(ctx, explanation); err != nil {
+		return nil, err
+	}
+	if err := h.explainFreeze(ctx, explanation, now); err != nil {
+		return nil, err
+	}
+
+	rules, err := h.ruleRepository.GetByResource(ctx, query.Resource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules: %w", err)
+	}
+	enforced, off := enforcedRules(ctx, h.flags, h.clientRepository, rules, explanation.Key, query.Resource, query.Method)
+	rule, ok := explainRuleSelection(explanation, enforced, off, query.Method)
+	if !ok {
+		decideExplanation(explanation)
+		return explanation, nil
+	}
+	explainFlag(explanation, rule)
+
+	if err := h.explainRollout(ctx, explanation, &rule); err != nil {
+		return nil, err
+	}
+	if err := h.explainOverride(ctx, explanation, &rule, query.Method, now); err != nil {
+		return nil, err
+	}
+	explanation.Rule = &rule
+	explanation.StateResource = rule.StateResource()
+	explanation.Parameters = algorithmParameters(rule)
+
+	if err := h.explainBlock(ctx, explanation, now); err != nil {
+		return nil, err
+	}
+
+	events, err := h.eventStore.GetEvents(ctx, explanation.Key+":"+explanation.StateResource)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events: %w", err)
+	}
+	aggregate := domain.NewRateLimitAggregate(explanation.Key, explanation.StateResource)
+	aggregate.LoadFromHistory(events)
+
+	window, condition := windowMath(aggregate, rule, now)
+	explanation.Window = window
+	addCheck(explanation, condition, "blocked")
+	explanation.LastDecision = lastDecision(events, rule.Algorithm)
+	decideExplanation(explanation)
+
+	return explanation, nil
+}
+
+// explainClient checks that the client is not disabled. Unregistered
+// clients are limited like any other.
+func (h *RateLimitQueryHandler) explainClient(ctx context.Context, explanation *queries.DecisionExplanation) error {
+	if h.clientRepository == nil {
+		return nil
+	}
+
+	client, err := h.clientRepository.GetByID(ctx, explanation.ClientID)
+	condition := queries.Condition{Check: "client is not disabled", Expression: "client is not registered", Passed: true}
+	switch {
+	case errors.Is(err, domain.ErrClientNotFound):
+	case err != nil:
+		return fmt.Errorf("failed to get client: %w", err)
+	default:
+		condition.Expression = fmt.Sprintf("disabled = %t", client.Disabled)
+		condition.Passed = !client.Disabled
+	}
+	addCheck(explanation, condition, "blocked")
+	return nil
+}
+
+// explainRuleSelection lists the rules of the resource with why each was or
+// was not chosen for method, the rules whose feature flag is off for the
+// client last, and returns the chosen one
+func explainRuleSelection(explanation *queries.DecisionExplanation, rules, off []domain.RateLimitRule, method string) (domain.RateLimitRule, bool) {
+	selected := domain.SelectRuleIndex(rules, method)
+	for i, rule := range rules {
+		candidate := queries.RuleCandidate{Rule: rule, Selected: i == selected}
+		switch {
+		case i == selected && rule.Method != "":
+			candidate.Reason = fmt.Sprintf("the rule for %s requests applies before any rule for any method", rule.Method)
+		case i == selected && method == "":
+			candidate.Reason = "checks without a method are decided by the first rule for any method"
+		case i == selected:
+			candidate.Reason = fmt.Sprintf("the resource has no rule for %s requests, so the first rule for any method applies", strings.ToUpper(method))
+		case rule.Method != "" && !strings.EqualFold(rule.Method, method):
+			candidate.Reason = fmt.Sprintf("applies to %s requests only", rule.Method)
+		case rule.Method != "":
+			candidate.Reason = fmt.Sprintf("an earlier rule for %s requests takes precedence", rule.Method)
+		case selected >= 0 && rules[selected].Method != "":
+			candidate.Reason = fmt.Sprintf("the rule for %s requests takes precedence", rules[selected].Method)
+		default:
+			candidate.Reason = "an earlier rule for any method takes precedence"
+		}
+		explanation.Candidates = append(explanation.Candidates, candidate)
+	}
+	for _, rule := range off {
+		explanation.Candidates = append(explanation.Candidates, queries.RuleCandidate{
+			Rule:   rule,
+			Reason: fmt.Sprintf("its feature flag %s is off for the client", rule.Flag),
+		})
+	}
+
+	// Checks of a resource without a rule fail with an error, while those
+	// whose rules are all off for the client are allowed without counting
+	condition := queries.Condition{Check: "a rule applies to the request", Passed: selected >= 0}
+	decision := "error"
+	switch {
+	case selected >= 0:
+		condition.Expression = fmt.Sprintf("rule %s of %d", rules[selected].ID, len(rules)+len(off))
+	case len(off) > 0:
+		condition.Expression = fmt.Sprintf("feature flag %s is off, so the request is not counted", off[0].Flag)
+		decision = "allowed"
+	case method == "":
+		condition.Expression = fmt.Sprintf("none of %d rules is for any method", len(rules))
+	default:
+		condition.Expression = fmt.Sprintf("none of %d rules is for %s requests or any method", len(rules), strings.ToUpper(method))
+	}
+	addCheck(explanation, condition, decision)
+
+	if selected < 0 {
+		return domain.RateLimitRule{}, false
+	}
+	return rules[selected], true
+}
+
+// explainFreeze checks whether a freeze decides every request to the
+// resource
+func (h *RateLimitQueryHandler) explainFreeze(ctx context.Context, explanation *queries.DecisionExplanation, now time.Time) error {
+	if h.freezeRepository == nil {
+		return nil
+	}
+
+	freezes, err := h.freezeRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get freezes: %w", err)
+	}
+
+	// An allow-all freeze allows every request without counting it
+	condition := queries.Condition{Check: "no freeze is in effect", Expression: "no freeze covers the resource", Passed: true}
+	decision := "blocked"
+	if freeze, ok := domain.SelectFreeze(freezes, explanation.Resource, now); ok {
+		condition.Expression = freeze.Describe()
+		condition.Passed = false
+		if freeze.Mode == domain.FreezeAllowAll {
+			decision = "allowed"
+		}
+	}
+	addCheck(explanation, condition, decision)
+	return nil
+}
+
+// explainOverride applies the override in effect for the key, if any, to
+// rule. Like decisions, overrides are looked up by the limit key.
+func (h *RateLimitQueryHandler) explainOverride(ctx context.Context, explanation *queries.DecisionExplanation, rule *domain.RateLimitRule, method string, now time.Time) error {
+	if h.overrideRepository == nil {
+		return nil
+	}
+
+	overrides, err := h.overrideRepository.GetByClient(ctx, explanation.Key, explanation.Resource)
+	if err != nil {
+		return fmt.Errorf("failed to get overrides: %w", err)
+	}
+	if override, ok := domain.SelectOverride(overrides, method, now); ok {
+		explanation.Override = &override
+		*rule = override.Apply(*rule)
+	}
+	return nil
+}
+
+// explainBlock checks whether an earlier denial still blocks the key, in
+// which case requests are denied without being counted
+func (h *RateLimitQueryHandler) explainBlock(ctx context.Context, explanation *queries.DecisionExplanation, now time.Time) error {
+	status, err := h.readModel.GetRateLimitStatus(ctx, explanation.Key, explanation.StateResource)
+	if err != nil {
+		return fmt.Errorf("failed to get rate limit status: %w", err)
+	}
+	blocked, blockedUntil := status.IsBlocked, status.BlockedUntil
+	queries.ReleaseStatus(status)
+
+	condition := queries.Condition{Check: "not blocked by an earlier denial", Expression: "not blocked", Passed: true}
+	if blocked {
+		condition.Expression = fmt.Sprintf("blocked until %s <= now %s", blockedUntil.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano))
+		condition.Passed = !now.Before(blockedUntil)
+	}
+	addCheck(explanation, condition, "blocked")
+	return nil
+}
+
+// addCheck adds a check to the explanation. The first failing check decides
+// the request with decision.
+func addCheck(explanation *queries.DecisionExplanation, condition queries.Condition, decision string) {
+	explanation.Checks = append(explanation.Checks, condition)
+	if !condition.Passed && explanation.Decision == "" {
+		explanation.Decision = decision
+	}
+}
+
+// decideExplanation allows the request when every check passed
+func decideExplanation(explanation *queries.DecisionExplanation) {
+	if explanation.Decision == "" {
+		explanation.Decision = "allowed"
+	}
+}
+
+// algorithmParameters returns the parameters of the algorithm of rule
+func algorithmParameters(rule domain.RateLimitRule) *queries.AlgorithmParameters {
+	parameters := &queries.AlgorithmParameters{
+		Algorithm:   string(rule.Algorithm),
+		Limit:       rule.Limit,
+		Window:      rule.Window.String(),
+		SoftLimit:   rule.SoftLimit(),
+		KeyTemplate: rule.KeyTemplate,
+	}
+	if (rule.Algorithm == domain.TokenBucket || rule.Algorithm == domain.LeakyBucket) && rule.Limit > 0 {
+		parameters.Capacity = rule.Limit
+		parameters.RefillPerSecond = float64(rule.Limit) / rule.Window.Seconds()
+		parameters.SecondsPerToken = rule.Window.Seconds() / float64(rule.Limit)
+	}
+	return parameters
+}
+
+// windowMath returns the window of the key as a request at now would be
+// decided against it, and the condition the request would be decided on
+func windowMath(aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, now time.Time) (*queries.WindowMath, queries.Condition) {
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		windowStart, previous, current := aggregate.SlidingWindowCounts(rule.Window, now)
+		weight := previousWeight(windowStart, rule.Window, now)
+		estimate := domain.SlidingWindowCounterEstimate(previous, current, windowStart, rule.Window, now)
+		window := &queries.WindowMath{
+			WindowStart:    windowStart,
+			WindowEnd:      windowStart.Add(rule.Window),
+			RequestCount:   current,
+			PreviousCount:  previous,
+			PreviousWeight: weight,
+			Estimate:       &estimate,
+		}
+		condition := limitCondition(rule.Algorithm, rule.Limit, current, previous, weight, 0)
+		if condition.Passed {
+			window.Remaining = int(math.Floor(float64(rule.Limit) - (estimate + 1)))
+		} else {
+			retryAt := domain.SlidingWindowCounterRetryAt(previous, current, rule.Limit, windowStart, rule.Window, now)
+			window.RetryAt = &retryAt
+		}
+		return window, condition
+	}
+
+	decision := aggregate.Decide(rule, now)
+	window := &queries.WindowMath{
+		WindowStart:  decision.WindowStart,
+		WindowEnd:    decision.WindowEnd,
+		RequestCount: decision.RequestCount,
+		Remaining:    decision.Remaining,
+	}
+	if decision.Allowed {
+		window.RequestCount--
+	} else {
+		window.RetryAt = &decision.RetryAt
+	}
+
+	var tokens float64
+	if rule.Algorithm == domain.TokenBucket || rule.Algorithm == domain.LeakyBucket {
+		tokens = decision.Tokens
+		if decision.Allowed {
+			tokens++
+		}
+		window.Tokens = &tokens
+	}
+	return window, limitCondition(rule.Algorithm, rule.Limit, window.RequestCount, 0, 0, tokens)
+}
+
+// lastDecision traces the last stored decision of the key, evaluating its
+// recorded counts with algorithm, the algorithm of the rule now in effect
+func lastDecision(events []domain.Event, algorithm domain.Algorithm) *queries.DecisionTrace {
+	for i := len(events) - 1; i >= 0; i-- {
+		switch e := events[i].(type) {
+		case *domain.RateLimitAppliedEvent:
+			// Allowed requests are counted in the event; the decision
+			// was made on the count before them
+			weight := previousWeight(e.WindowStart, e.WindowEnd.Sub(e.WindowStart), e.Timestamp())
+			trace := &queries.DecisionTrace{
+				EventID:      e.EventID(),
+				Timestamp:    e.Timestamp(),
+				Allowed:      true,
+				RequestCount: e.RequestCount,
+				Limit:        e.Limit,
+				WindowStart:  e.WindowStart,
+				WindowEnd:    e.WindowEnd,
+			}
+			trace.Conditions = []queries.Condition{limitCondition(algorithm, e.Limit, e.RequestCount-1, e.PreviousCount, weight, e.Tokens+1)}
+			return trace
+		case *domain.RateLimitExceededEvent:
+			weight := previousWeight(e.WindowStart, e.WindowEnd.Sub(e.WindowStart), e.Timestamp())
+			blockedUntil := e.BlockedUntil
+			trace := &queries.DecisionTrace{
+				EventID:      e.EventID(),
+				Timestamp:    e.Timestamp(),
+				RequestCount: e.RequestCount,
+				Limit:        e.Limit,
+				WindowStart:  e.WindowStart,
+				WindowEnd:    e.WindowEnd,
+				BlockedUntil: &blockedUntil,
+			}
+			trace.Conditions = []queries.Condition{limitCondition(algorithm, e.Limit, e.RequestCount, e.PreviousCount, weight, e.Tokens)}
+			return trace
+		}
+	}
+	return nil
+}
+
+// previousWeight returns the share of the previous window that still
+// overlaps the sliding window ending at now
+func previousWeight(windowStart time.Time, window time.Duration, now time.Time) float64 {
+	if window <= 0 {
+		return 0
+	}
+	elapsed := min(max(now.Sub(windowStart), 0), window)
+	return 1 - float64(elapsed)/float64(window)
+}
+
+// limitCondition returns the condition algorithm decides a request on,
+// given the requests counted before it, or the bucket level for token and
+// leaky buckets
+func limitCondition(algorithm domain.Algorithm, limit, count, previous int, weight, tokens float64) queries.Condition {
+	switch algorithm {
+	case domain.SlidingWindowCounter:
+		estimate := float64(previous)*weight + float64(count)
+		return queries.Condition{
+			Check:      "previous_count * previous_weight + request_count + 1 <= limit",
+			Expression: fmt.Sprintf("%d * %.4f + %d + 1 = %.4f <= %d", previous, weight, count, estimate+1, limit),
+			Passed:     estimate+1 <= float64(limit),
+		}
+	case domain.TokenBucket, domain.LeakyBucket:
+		return queries.Condition{
+			Check:      "tokens >= 1",
+			Expression: fmt.Sprintf("%.4f >= 1", tokens),
+			Passed:     tokens >= 1,
+		}
+	case domain.SlidingWindow:
+		return queries.Condition{
+			Check:      "requests in the sliding window < limit",
+			Expression: fmt.Sprintf("%d < %d", count, limit),
+			Passed:     count < limit,
+		}
+	default:
+		return queries.Condition{
+			Check:      "requests in the fixed window < limit",
+			Expression: fmt.Sprintf("%d < %d", count, limit),
+			Passed:     count < limit,
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// FlagEvaluator evaluates the feature flags gating rules, such as through an
+// OpenFeature provider. Flags that cannot be evaluated are off.
+type FlagEvaluator interface {
+	Enabled(ctx context.Context, flag string, flagCtx domain.FlagContext) bool
+}
+
+// WithFlagEvaluator evaluates the feature flags of gated rules at decision
+// time, so that they are enforced only for the clients their flag is on
+// for. Without it gated rules are never enforced.
+func (h *RateLimitCommandHandler) WithFlagEvaluator(flags FlagEvaluator) *RateLimitCommandHandler {
+	h.flags = flags
+	return h
+}
+
+// WithFlagEvaluator shows whether the feature flags of gated rules are on
+// for the client in explanations
+func (h *RateLimitQueryHandler) WithFlagEvaluator(flags FlagEvaluator) *RateLimitQueryHandler {
+	h.flags = flags
+	return h
+}
+
+// enforcedRules splits rules into those that may decide the requests of key
+// to resource with method and the rules for method whose feature flag is
+// off for key. Only the flags of rules for method are evaluated, and the
+// tenant of key is looked up only when one of them is gated.
+func enforcedRules(ctx context.Context, flags FlagEvaluator, clients ClientRepository, rules []domain.RateLimitRule, key, resource, method string) ([]domain.RateLimitRule, []domain.RateLimitRule) {
+	gated := false
+	for _, rule := range rules {
+		if rule.Flag != "" && appliesToMethod(rule, method) {
+			gated = true
+			break
+		}
+	}
+	if !gated {
+		return rules, nil
+	}
+
+	flagCtx := domain.FlagContext{
+		TargetingKey: key,
+		Tenant:       clientTenant(ctx, clients, key),
+		Resource:     resource,
+		Method:       strings.ToUpper(method),
+	}
+	enforced := make([]domain.RateLimitRule, 0, len(rules))
+	var off []domain.RateLimitRule
+	for _, rule := range rules {
+		if rule.Flag == "" || !appliesToMethod(rule, method) || (flags != nil && flags.Enabled(ctx, rule.Flag, flagCtx)) {
+			enforced = append(enforced, rule)
+		} else {
+			off = append(off, rule)
+		}
+	}
+	return enforced, off
+}
+
+// appliesToMethod reports whether rule may decide requests with method
+func appliesToMethod(rule domain.RateLimitRule, method string) bool {
+	return rule.Method == "" || strings.EqualFold(rule.Method, method)
+}
+
+// clientTenant returns the tier of the registered client with the ID key,
+// or nothing when there is none
+func clientTenant(ctx context.Context, clients ClientRepository, key string) string {
+	if clients == nil {
+		return ""
+	}
+	client, err := clients.GetByID(ctx, key)
+	if err != nil {
+		return ""
+	}
+	return client.Tier
+}
+
+// notEnforced returns the error of a request that no rule decides because
+// the feature flags of the rules in off are off for the client
+func notEnforced(resource string, off []domain.RateLimitRule) error {
+	return fmt.Errorf("%w for %s: feature flag %s is off", domain.ErrRuleNotEnforced, resource, off[0].Flag)
+}
+
+// explainFlag checks that the feature flag of the selected rule, if gated,
+// is on for the client
+func explainFlag(explanation *queries.DecisionExplanation, rule domain.RateLimitRule) {
+	if rule.Flag == "" {
+		return
+	}
+	addCheck(explanation, queries.Condition{
+		Check:      "the rule's feature flag is on for the client",
+		Expression: rule.Flag + " is on",
+		Passed:     true,
+	}, "allowed")
+}
@@ -0,0 +1,491 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/commands"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// LeaseRepository defines the interface for token lease storage. Expired
+// leases are kept until they are expired by ExpireLeasesCommand.
+type LeaseRepository interface {
+	Save(ctx context.Context, lease domain.Lease) error // Creates or replaces the lease
+	GetByID(ctx context.Context, id string) (*domain.Lease, error)
+	List(ctx context.Context) ([]domain.Lease, error) // Oldest first
+	Delete(ctx context.Context, id string) error
+}
+
+// WithLeaseRepository enables token leases, which let clients admit a
+// number of requests locally instead of checking each one
+func (h *RateLimitCommandHandler) WithLeaseRepository(leaseRepository LeaseRepository) *RateLimitCommandHandler {
+	h.leaseRepository = leaseRepository
+	return h
+}
+
+// WithLeaseRepository enables queries for token leases
+func (h *RateLimitQueryHandler) WithLeaseRepository(leaseRepository LeaseRepository) *RateLimitQueryHandler {
+	h.leaseRepository = leaseRepository
+	return h
+}
+
+// handleGrantLease leases a client up to the requested tokens of its quota
+// for a resource. When none are left the decision is recorded as a denied
+// request and no lease is made.
+func (h *RateLimitCommandHandler) handleGrantLease(ctx context.Context, cmd *commands.GrantLeaseCommand) error {
+	if h.leaseRepository == nil {
+		return fmt.Errorf("leases are not enabled")
+	}
+	if cmd.Tokens <= 0 || cmd.TTL <= 0 {
+		return fmt.Errorf("%w: tokens and ttl must be positive", domain.ErrInvalidLease)
+	}
+
+	now := h.clock.Now()
+	rule, _, err := h.selectRule(ctx, cmd.ClientID, cmd.Resource, cmd.Method, now)
+	if err != nil {
+		return err
+	}
+
+	lease := domain.Lease{
+		ID:            fmt.Sprintf("lease-%d", time.Now().UnixNano()),
+		ClientID:      cmd.ClientID,
+		Resource:      cmd.Resource,
+		Method:        strings.ToUpper(cmd.Method),
+		StateResource: rule.StateResource(),
+		TTL:           cmd.TTL,
+		CreatedAt:     now,
+	}
+	aggregate, err := h.loadAggregate(ctx, lease.ClientID, lease.StateResource)
+	if err != nil {
+		return err
+	}
+
+	event, leased, err := h.leaseTokens(ctx, aggregate, rule, &lease, cmd.Tokens, now)
+	if err != nil {
+		return fmt.Errorf("failed to lease tokens: %w", err)
+	}
+	if err := h.saveEvents(ctx, aggregate.ID, []domain.Event{event}, aggregate.Version); err != nil {
+		return err
+	}
+	cmd.Event = event
+
+	if leased == 0 {
+		return nil
+	}
+	if err := h.leaseRepository.Save(ctx, lease); err != nil {
+		return fmt.Errorf("failed to save lease: %w", err)
+	}
+	cmd.Result = &lease
+	return nil
+}
+
+// handleRenewLease settles the current term of a lease, giving back the
+// tokens the client did not use, and leases the tokens of its next term in
+// the same save. Renewing no tokens releases the lease, as does a renewal
+// finding none left.
+func (h *RateLimitCommandHandler) handleRenewLease(ctx context.Context, cmd *commands.RenewLeaseCommand) error {
+	if h.leaseRepository == nil {
+		return fmt.Errorf("leases are not enabled")
+	}
+
+	lease, err := h.leaseRepository.GetByID(ctx, cmd.LeaseID)
+	if err != nil {
+		return err
+	}
+	now := h.clock.Now()
+	if !lease.ActiveAt(now) {
+		return domain.ErrLeaseExpired
+	}
+	if cmd.Used < 0 || cmd.Used > lease.Tokens {
+		return fmt.Errorf("%w: used must be between 0 and the %d tokens leased", domain.ErrInvalidLease, lease.Tokens)
+	}
+	if cmd.Tokens < 0 {
+		return fmt.Errorf("%w: tokens must not be negative", domain.ErrInvalidLease)
+	}
+
+	rule, _, err := h.selectRule(ctx, lease.ClientID, lease.Resource, lease.Method, now)
+	if err != nil {
+		return err
+	}
+	aggregate, err := h.loadAggregate(ctx, lease.ClientID, lease.StateResource)
+	if err != nil {
+		return err
+	}
+	version := aggregate.Version
+
+	var settlement domain.Decision
+	var returned int
+	unused := lease.Tokens - cmd.Used
+	if h.usesCounters(rule) {
+		if settlement, returned, err = h.returnCounters(ctx, aggregate, rule, unused, lease.LeasedAt, now); err != nil {
+			return fmt.Errorf("failed to return tokens: %w", err)
+		}
+	} else {
+		settlement, returned = aggregate.ReturnLeased(rule, unused, lease.LeasedAt, now)
+	}
+
+	settled := &domain.LeaseSettledEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("settled", now),
+			Type:    "LeaseSettled",
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:       lease.ClientID,
+		Resource:       lease.StateResource,
+		LeaseID:        lease.ID,
+		Leased:         lease.Tokens,
+		Used:           cmd.Used,
+		Returned:       returned,
+		LeasedAt:       lease.LeasedAt,
+		WindowStart:    settlement.WindowStart,
+		WindowEnd:      settlement.WindowEnd,
+		RequestCount:   settlement.RequestCount,
+		PreviousCount:  settlement.PreviousCount,
+		Limit:          rule.Limit,
+		RemainingQuota: settlement.Remaining,
+		Tokens:         settlement.Tokens,
+	}
+	events := []domain.Event{settled}
+
+	// The next term is leased from what is left after settling this one
+	leased := 0
+	if cmd.Tokens > 0 {
+		aggregate.ApplyEvent(settled)
+		event, n, err := h.leaseTokens(ctx, aggregate, rule, lease, cmd.Tokens, now)
+		if err != nil {
+			return fmt.Errorf("failed to lease tokens: %w", err)
+		}
+		events = append(events, event)
+		leased = n
+	}
+
+	if err := h.saveEvents(ctx, aggregate.ID, events, version); err != nil {
+		return err
+	}
+	cmd.Event = events[len(events)-1]
+
+	if leased == 0 {
+		if err := h.leaseRepository.Delete(ctx, lease.ID); err != nil {
+			return fmt.Errorf("failed to delete lease: %w", err)
+		}
+		return nil
+	}
+	lease.Renewals++
+	if err := h.leaseRepository.Save(ctx, *lease); err != nil {
+		return fmt.Errorf("failed to save lease: %w", err)
+	}
+	cmd.Result = lease
+	return nil
+}
+
+// handleExpireLeases expires the leases whose terms ended without a renewal.
+// Their tokens stay counted. A lease whose expiry cannot be recorded is left
+// for the next run.
+func (h *RateLimitCommandHandler) handleExpireLeases(ctx context.Context, cmd *commands.ExpireLeasesCommand) error {
+	if h.leaseRepository == nil {
+		return nil
+	}
+
+	leases, err := h.leaseRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get leases: %w", err)
+	}
+
+	now := h.clock.Now()
+	var errs []error
+	for _, lease := range leases {
+		if lease.ActiveAt(now) {
+			continue
+		}
+		if err := h.expireLease(ctx, lease, now); err != nil {
+			errs = append(errs, fmt.Errorf("failed to expire lease %s: %w", lease.ID, err))
+			continue
+		}
+		cmd.Result = append(cmd.Result, lease)
+	}
+	return errors.Join(errs...)
+}
+
+// expireLease records the expiry of a lease and deletes it
+func (h *RateLimitCommandHandler) expireLease(ctx context.Context, lease domain.Lease, now time.Time) error {
+	aggregate, err := h.loadAggregate(ctx, lease.ClientID, lease.StateResource)
+	if err != nil {
+		return err
+	}
+
+	event := &domain.LeaseExpiredEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("lease-expired", now),
+			Type:    "LeaseExpired",
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID: lease.ClientID,
+		Resource: lease.StateResource,
+		LeaseID:  lease.ID,
+		Leased:   lease.Tokens,
+	}
+	if err := h.saveEvents(ctx, aggregate.ID, []domain.Event{event}, aggregate.Version); err != nil {
+		return err
+	}
+	return h.leaseRepository.Delete(ctx, lease.ID)
+}
+
+// deleteClientLeases deletes every lease of a client
+func (h *RateLimitCommandHandler) deleteClientLeases(ctx context.Context, clientID string) error {
+	leases, err := h.leaseRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get leases: %w", err)
+	}
+	for _, lease := range leases {
+		if lease.ClientID != clientID {
+			continue
+		}
+		if err := h.leaseRepository.Delete(ctx, lease.ID); err != nil {
+			return fmt.Errorf("failed to delete lease: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadAggregate rebuilds the aggregate of a client's counts on resource,
+// or takes it from the aggregate cache
+func (h *RateLimitCommandHandler) loadAggregate(ctx context.Context, clientID, resource string) (*domain.RateLimitAggregate, error) {
+	aggregate, _, err := h.loadCachedAggregate(ctx, clientID, resource, true)
+	return aggregate, err
+}
+
+// loadCachedAggregate returns the aggregate of a client's counts on
+// resource from the aggregate cache when useCache is true and it holds it,
+// reporting whether it did, or else rebuilds it from its events and caches
+// it
+func (h *RateLimitCommandHandler) loadCachedAggregate(ctx context.Context, clientID, resource string, useCache bool) (*domain.RateLimitAggregate, bool, error) {
+	// A cached aggregate is returned without building one to replay into
+	if h.aggregateCache != nil && useCache {
+		if cached, ok := h.aggregateCache.Get(domain.AggregateID(clientID, resource)); ok {
+			return cached, true, nil
+		}
+	}
+
+	aggregate := domain.NewRateLimitAggregate(clientID, resource)
+
+	events, err := h.eventStore.GetEvents(ctx, aggregate.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get events: %w", err)
+	}
+	aggregate.LoadFromHistory(events)
+	if h.aggregateCache != nil {
+		h.aggregateCache.Put(aggregate)
+	}
+	return aggregate, false, nil
+}
+
+// usesCounters reports whether the rule's counts are kept in the shared
+// counter store
+func (h *RateLimitCommandHandler) usesCounters(rule domain.RateLimitRule) bool {
+	return h.counterStore != nil && (rule.Algorithm == domain.FixedWindow || rule.Algorithm == domain.SlidingWindowCounter)
+}
+
+// leaseTokens leases up to tokens of the quota at now for the next term of
+// lease, which lasts its TTL but not beyond the window the tokens count in.
+// It returns the event recording the decision, which is a RateLimitExceeded
+// event when no tokens are left, and the number of tokens leased.
+func (h *RateLimitCommandHandler) leaseTokens(ctx context.Context, aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, lease *domain.Lease, tokens int, now time.Time) (domain.Event, int, error) {
+	var decision domain.Decision
+	var leased int
+	if h.usesCounters(rule) {
+		var err error
+		if decision, leased, err = h.leaseCounters(ctx, aggregate, rule, tokens, now); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		decision, leased = aggregate.Lease(rule, tokens, now)
+	}
+
+	if leased == 0 {
+		return &domain.RateLimitExceededEvent{
+			BaseEvent: domain.BaseEvent{
+				ID:      domain.NewEventID("exceeded", now),
+				Type:    "RateLimitExceeded",
+				Time:    now,
+				AggrID:  aggregate.ID,
+				Version: aggregate.Version + 1,
+			},
+			ClientID:      lease.ClientID,
+			Resource:      aggregate.State.Resource,
+			RequestCount:  decision.RequestCount,
+			PreviousCount: decision.PreviousCount,
+			Limit:         rule.Limit,
+			WindowStart:   decision.WindowStart,
+			WindowEnd:     decision.WindowEnd,
+			BlockedUntil:  decision.RetryAt,
+			Tokens:        decision.Tokens,
+		}, 0, nil
+	}
+
+	lease.Tokens = leased
+	lease.LeasedAt = now
+	lease.ExpiresAt = now.Add(lease.TTL)
+	if windowEnd := domain.LeaseWindowEnd(rule, now); windowEnd.Before(lease.ExpiresAt) {
+		lease.ExpiresAt = windowEnd
+	}
+
+	return &domain.TokensLeasedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("leased", now),
+			Type:    "TokensLeased",
+			Time:    now,
+			AggrID:  aggregate.ID,
+			Version: aggregate.Version + 1,
+		},
+		ClientID:       lease.ClientID,
+		Resource:       aggregate.State.Resource,
+		LeaseID:        lease.ID,
+		Leased:         leased,
+		WindowStart:    decision.WindowStart,
+		WindowEnd:      decision.WindowEnd,
+		RequestCount:   decision.RequestCount,
+		PreviousCount:  decision.PreviousCount,
+		Limit:          rule.Limit,
+		RemainingQuota: decision.Remaining,
+		Tokens:         decision.Tokens,
+		ExpiresAt:      lease.ExpiresAt,
+	}, leased, nil
+}
+
+// leaseCounters leases up to tokens against the current window's counter in
+// the shared counter store. Like a request, the counter is incremented
+// first, by every token, and the tokens over the limit are given back.
+func (h *RateLimitCommandHandler) leaseCounters(ctx context.Context, aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, tokens int, now time.Time) (domain.Decision, int, error) {
+	windowStart := now.Truncate(rule.Window)
+	windowEnd := windowStart.Add(rule.Window)
+	currentKey := counterKey(aggregate.ID, windowStart)
+
+	current, err := h.counterStore.Increment(ctx, currentKey, int64(tokens), 2*rule.Window)
+	if err != nil {
+		return domain.Decision{}, 0, err
+	}
+
+	var previous int64
+	estimate := float64(current)
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		previous, err = h.counterStore.Get(ctx, counterKey(aggregate.ID, windowStart.Add(-rule.Window)))
+		if err != nil {
+			return domain.Decision{}, 0, err
+		}
+		estimate = domain.SlidingWindowCounterEstimate(int(previous), int(current), windowStart, rule.Window, now)
+	}
+
+	over := min(max(int(math.Ceil(estimate-float64(rule.Limit))), 0), tokens)
+	if over > 0 {
+		if current, err = h.counterStore.Decrement(ctx, currentKey, int64(over)); err != nil {
+			return domain.Decision{}, 0, err
+		}
+		estimate -= float64(over)
+	}
+
+	leased := tokens - over
+	decision := domain.Decision{
+		Allowed:       leased > 0,
+		RequestCount:  int(current),
+		Remaining:     max(int(math.Floor(float64(rule.Limit)-estimate)), 0),
+		WindowStart:   windowStart,
+		WindowEnd:     windowEnd,
+		PreviousCount: int(previous),
+	}
+	if leased == 0 {
+		decision.RetryAt = windowEnd
+		if rule.Algorithm == domain.SlidingWindowCounter {
+			decision.RetryAt = domain.SlidingWindowCounterRetryAt(int(previous), int(current), rule.Limit, windowStart, rule.Window, now)
+		}
+	}
+	return decision, leased, nil
+}
+
+// returnCounters gives back up to tokens leased at leasedAt to the current
+// window's counter in the shared counter store. Tokens leased in an earlier
+// window are not given back, as they no longer count.
+func (h *RateLimitCommandHandler) returnCounters(ctx context.Context, aggregate *domain.RateLimitAggregate, rule domain.RateLimitRule, tokens int, leasedAt, now time.Time) (domain.Decision, int, error) {
+	windowStart := now.Truncate(rule.Window)
+	currentKey := counterKey(aggregate.ID, windowStart)
+
+	current, err := h.counterStore.Get(ctx, currentKey)
+	if err != nil {
+		return domain.Decision{}, 0, err
+	}
+
+	returned := 0
+	if !leasedAt.Before(windowStart) {
+		returned = min(tokens, int(current))
+	}
+	if returned > 0 {
+		if current, err = h.counterStore.Decrement(ctx, currentKey, int64(returned)); err != nil {
+			return domain.Decision{}, 0, err
+		}
+	}
+
+	var previous int64
+	estimate := float64(current)
+	if rule.Algorithm == domain.SlidingWindowCounter {
+		previous, err = h.counterStore.Get(ctx, counterKey(aggregate.ID, windowStart.Add(-rule.Window)))
+		if err != nil {
+			return domain.Decision{}, 0, err
+		}
+		estimate = domain.SlidingWindowCounterEstimate(int(previous), int(current), windowStart, rule.Window, now)
+	}
+
+	return domain.Decision{
+		Allowed:       true,
+		RequestCount:  int(current),
+		Remaining:     max(int(math.Floor(float64(rule.Limit)-estimate)), 0),
+		WindowStart:   windowStart,
+		WindowEnd:     windowStart.Add(rule.Window),
+		PreviousCount: int(previous),
+	}, returned, nil
+}
+
+// handleGetLeases retrieves one lease, or the active leases oldest first,
+// filtered by client and resource. Without lease storage there are none.
+func (h *RateLimitQueryHandler) handleGetLeases(ctx context.Context, query *queries.GetLeasesQuery) ([]domain.Lease, error) {
+	if h.leaseRepository == nil {
+		return []domain.Lease{}, nil
+	}
+
+	if query.LeaseID != "" {
+		lease, err := h.leaseRepository.GetByID(ctx, query.LeaseID)
+		if err != nil {
+			return nil, err
+		}
+		return []domain.Lease{*lease}, nil
+	}
+
+	leases, err := h.leaseRepository.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get leases: %w", err)
+	}
+
+	now := h.clock.Now()
+	result := make([]domain.Lease, 0, len(leases))
+	for _, lease := range leases {
+		if !lease.ActiveAt(now) {
+			continue
+		}
+		if query.ClientID != "" && lease.ClientID != query.ClientID {
+			continue
+		}
+		if query.Resource != "" && lease.Resource != query.Resource {
+			continue
+		}
+		result = append(result, lease)
+	}
+	return result, nil
+}
@@ -2,9 +2,13 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/privacy"
 	"github.com/NickChunglolz/rate-limiter/internal/queries"
 )
 
@@ -16,15 +20,25 @@ type QueryHandler interface {
 // ReadModel defines the interface for read model storage
 type ReadModel interface {
 	GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error)
-	GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int) (*queries.RateLimitHistory, error)
-	GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time) (*queries.ClientStats, error)
+	GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor, filter queries.HistoryFilter) (*queries.RateLimitHistory, error)
+	GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error)
+	GetClientActivity(ctx context.Context) (map[string]queries.ClientActivity, error)
 	UpdateFromEvent(ctx context.Context, event interface{}) error
 }
 
 // RateLimitQueryHandler handles rate limiting queries
 type RateLimitQueryHandler struct {
-	readModel      ReadModel
-	ruleRepository RuleRepository
+	readModel          ReadModel
+	ruleRepository     RuleRepository
+	overrideRepository OverrideRepository
+	freezeRepository   FreezeRepository
+	rolloutRepository  RolloutRepository
+	leaseRepository    LeaseRepository
+	clientRepository   ClientRepository
+	eventStore         EventReader
+	flags              FlagEvaluator
+	clock              domain.Clock
+	privacy            *privacy.Pseudonymizer
 }
 
 // NewRateLimitQueryHandler creates a new query handler
@@ -32,9 +46,43 @@ func NewRateLimitQueryHandler(readModel ReadModel, ruleRepository RuleRepository
 	return &RateLimitQueryHandler{
 		readModel:      readModel,
 		ruleRepository: ruleRepository,
+		clock:          domain.SystemClock{},
 	}
 }
 
+// WithOverrideRepository enables queries for per-client overrides
+func (h *RateLimitQueryHandler) WithOverrideRepository(overrideRepository OverrideRepository) *RateLimitQueryHandler {
+	h.overrideRepository = overrideRepository
+	return h
+}
+
+// WithFreezeRepository enables queries for freezes
+func (h *RateLimitQueryHandler) WithFreezeRepository(freezeRepository FreezeRepository) *RateLimitQueryHandler {
+	h.freezeRepository = freezeRepository
+	return h
+}
+
+// WithClientRepository enables client registry queries and adds registry
+// entries to client statistics
+func (h *RateLimitQueryHandler) WithClientRepository(clientRepository ClientRepository) *RateLimitQueryHandler {
+	h.clientRepository = clientRepository
+	return h
+}
+
+// WithPseudonymizer joins registry entries, which keep their client IDs, to
+// the statistics and activity stored under the clients' pseudonyms
+func (h *RateLimitQueryHandler) WithPseudonymizer(pseudonymizer *privacy.Pseudonymizer) *RateLimitQueryHandler {
+	h.privacy = pseudonymizer
+	return h
+}
+
+// WithClock sets the clock that decides which overrides and freezes are in
+// effect
+func (h *RateLimitQueryHandler) WithClock(clock domain.Clock) *RateLimitQueryHandler {
+	h.clock = clock
+	return h
+}
+
 // Handle processes different types of queries
 func (h *RateLimitQueryHandler) Handle(ctx context.Context, query queries.Query) (interface{}, error) {
 	switch q := query.(type) {
@@ -44,8 +92,24 @@ func (h *RateLimitQueryHandler) Handle(ctx context.Context, query queries.Query)
 		return h.handleGetRateLimitHistory(ctx, q)
 	case *queries.GetActiveRulesQuery:
 		return h.handleGetActiveRules(ctx, q)
+	case *queries.ListRulesQuery:
+		return h.handleListRules(ctx, q)
 	case *queries.GetClientStatsQuery:
 		return h.handleGetClientStats(ctx, q)
+	case *queries.GetOverridesQuery:
+		return h.handleGetOverrides(ctx, q)
+	case *queries.GetFreezesQuery:
+		return h.handleGetFreezes(ctx, q)
+	case *queries.GetRolloutsQuery:
+		return h.handleGetRollouts(ctx, q)
+	case *queries.GetLeasesQuery:
+		return h.handleGetLeases(ctx, q)
+	case *queries.GetClientQuery:
+		return h.handleGetClient(ctx, q)
+	case *queries.ListClientsQuery:
+		return h.handleListClients(ctx, q)
+	case *queries.ExplainDecisionQuery:
+		return h.handleExplainDecision(ctx, q)
 	default:
 		return nil, fmt.Errorf("unknown query type: %T", query)
 	}
@@ -63,7 +127,7 @@ func (h *RateLimitQueryHandler) handleGetRateLimitStatus(ctx context.Context, qu
 
 // handleGetRateLimitHistory retrieves rate limit history
 func (h *RateLimitQueryHandler) handleGetRateLimitHistory(ctx context.Context, query *queries.GetRateLimitHistoryQuery) (*queries.RateLimitHistory, error) {
-	history, err := h.readModel.GetRateLimitHistory(ctx, query.ClientID, query.Resource, query.StartTime, query.EndTime, query.Limit, query.Offset)
+	history, err := h.readModel.GetRateLimitHistory(ctx, query.ClientID, query.Resource, query.StartTime, query.EndTime, query.Limit, query.Offset, query.After, query.Filter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get rate limit history: %w", err)
 	}
@@ -92,12 +156,208 @@ func (h *RateLimitQueryHandler) handleGetActiveRules(ctx context.Context, query
 	return rules, nil
 }
 
-// handleGetClientStats retrieves client statistics
+// handleListRules retrieves a page of rules, of one resource if set
+func (h *RateLimitQueryHandler) handleListRules(ctx context.Context, query *queries.ListRulesQuery) (*queries.RuleList, error) {
+	var rules []domain.RateLimitRule
+	var err error
+	if query.Resource != "" {
+		rules, err = h.ruleRepository.GetByResource(ctx, query.Resource)
+	} else {
+		rules, err = h.ruleRepository.List(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules: %w", err)
+	}
+	
+	// Rules are ordered by ID, so the page starts at the first ID after the
+	// cursor's whether or not the cursor's rule still exists
+	if query.After != nil {
+		start := sort.Search(len(rules), func(i int) bool { return rules[i].ID > query.After.ID })
+		rules = rules[start:]
+	}
+	
+	list := &queries.RuleList{Rules: rules}
+	if list.Rules == nil {
+		list.Rules = []domain.RateLimitRule{}
+	}
+	if query.Limit > 0 && len(rules) > query.Limit {
+		list.Rules = rules[:query.Limit]
+		list.NextCursor = queries.RuleCursor{ID: list.Rules[query.Limit-1].ID}.String()
+	}
+	return list, nil
+}
+
+// handleGetClientStats retrieves client statistics, at the granularity
+// suiting the requested range unless the query sets one
 func (h *RateLimitQueryHandler) handleGetClientStats(ctx context.Context, query *queries.GetClientStatsQuery) (*queries.ClientStats, error) {
-	stats, err := h.readModel.GetClientStats(ctx, query.ClientID, query.StartTime, query.EndTime)
+	granularity := query.Granularity
+	if granularity == "" {
+		granularity = queries.SelectStatsGranularity(query.StartTime, query.EndTime)
+	}
+	
+	stats, err := h.readModel.GetClientStats(ctx, h.privacy.LookupClientID(query.ClientID), query.StartTime, query.EndTime, granularity)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get client stats: %w", err)
 	}
 	
+	if h.clientRepository != nil {
+		client, err := h.clientRepository.GetByID(ctx, query.ClientID)
+		switch {
+		case err == nil:
+			stats.Client = client
+		case !errors.Is(err, domain.ErrClientNotFound):
+			return nil, fmt.Errorf("failed to get client: %w", err)
+		}
+	}
+	
 	return stats, nil
 }
+
+// handleGetOverrides retrieves the overrides in effect
+func (h *RateLimitQueryHandler) handleGetOverrides(ctx context.Context, query *queries.GetOverridesQuery) ([]domain.RateLimitOverride, error) {
+	if h.overrideRepository == nil {
+		return nil, fmt.Errorf("overrides are not enabled")
+	}
+	
+	var overrides []domain.RateLimitOverride
+	var err error
+	if query.ClientID != "" {
+		overrides, err = h.overrideRepository.GetByClient(ctx, query.ClientID, query.Resource)
+	} else {
+		overrides, err = h.overrideRepository.List(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get overrides: %w", err)
+	}
+	
+	now := h.clock.Now()
+	active := make([]domain.RateLimitOverride, 0, len(overrides))
+	for _, override := range overrides {
+		if !override.ActiveAt(now) {
+			continue
+		}
+		if query.Resource != "" && override.Resource != query.Resource {
+			continue
+		}
+		active = append(active, override)
+	}
+	
+	return active, nil
+}
+
+// handleGetFreezes retrieves the freezes in effect or scheduled. Without
+// freeze storage there are none.
+func (h *RateLimitQueryHandler) handleGetFreezes(ctx context.Context, query *queries.GetFreezesQuery) ([]domain.Freeze, error) {
+	if h.freezeRepository == nil {
+		return []domain.Freeze{}, nil
+	}
+	
+	freezes, err := h.freezeRepository.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get freezes: %w", err)
+	}
+	
+	now := h.clock.Now()
+	current := make([]domain.Freeze, 0, len(freezes))
+	for _, freeze := range freezes {
+		if freeze.EndedAt(now) {
+			continue
+		}
+		if query.Resource != "" && !freeze.Covers(query.Resource) {
+			continue
+		}
+		current = append(current, freeze)
+	}
+	
+	return current, nil
+}
+
+// handleGetClient retrieves a registered client
+func (h *RateLimitQueryHandler) handleGetClient(ctx context.Context, query *queries.GetClientQuery) (*domain.Client, error) {
+	if h.clientRepository == nil {
+		return nil, fmt.Errorf("%w: %s", domain.ErrClientNotFound, query.ClientID)
+	}
+	
+	return h.clientRepository.GetByID(ctx, query.ClientID)
+}
+
+// handleListClients retrieves registered clients and clients discovered
+// from their traffic. Filtering by tier or tag lists registered clients only.
+func (h *RateLimitQueryHandler) handleListClients(ctx context.Context, query *queries.ListClientsQuery) ([]queries.ClientListing, error) {
+	var clients []domain.Client
+	if h.clientRepository != nil {
+		var err error
+		if clients, err = h.clientRepository.List(ctx); err != nil {
+			return nil, fmt.Errorf("failed to list clients: %w", err)
+		}
+	}
+	
+	activity, err := h.readModel.GetClientActivity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client activity: %w", err)
+	}
+	
+	filtered := query.Tier != "" || query.Tag != ""
+	result := make([]queries.ClientListing, 0, len(clients)+len(activity))
+	for i := range clients {
+		client := &clients[i]
+		if query.Tier != "" && client.Tier != query.Tier {
+			continue
+		}
+		if query.Tag != "" && !client.HasTag(query.Tag) {
+			continue
+		}
+		
+		listing := queries.ClientListing{ID: client.ID, Registered: true, Client: client}
+		if observed, exists := activity[h.privacy.ClientID(client.ID)]; exists {
+			listing.Activity = &observed
+		}
+		result = append(result, listing)
+	}
+	
+	if !filtered {
+		registered := make(map[string]bool, len(clients))
+		for _, client := range clients {
+			registered[h.privacy.ClientID(client.ID)] = true
+		}
+		for clientID, observed := range activity {
+			if registered[clientID] {
+				continue
+			}
+			observed := observed
+			result = append(result, queries.ClientListing{ID: clientID, Activity: &observed})
+		}
+	}
+	
+	if err := sortClientListings(result, query.Sort); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sortClientListings orders listings by ID, or newest first by when their
+// traffic was first or last seen. Clients without traffic come last.
+func sortClientListings(listings []queries.ClientListing, by string) error {
+	sort.Slice(listings, func(i, j int) bool { return listings[i].ID < listings[j].ID })
+	
+	var seen func(activity *queries.ClientActivity) time.Time
+	switch by {
+	case "", "id":
+		return nil
+	case "first_seen":
+		seen = func(activity *queries.ClientActivity) time.Time { return activity.FirstSeen }
+	case "last_seen":
+		seen = func(activity *queries.ClientActivity) time.Time { return activity.LastSeen }
+	default:
+		return fmt.Errorf("unknown client sort: %q", by)
+	}
+	
+	sort.SliceStable(listings, func(i, j int) bool {
+		a, b := listings[i].Activity, listings[j].Activity
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return seen(a).After(seen(b))
+	})
+	return nil
+}
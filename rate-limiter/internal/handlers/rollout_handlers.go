@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/commands"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// RolloutRepository defines the interface for rule rollout storage. A rule
+// has at most one running rollout.
+type RolloutRepository interface {
+	Save(ctx context.Context, rollout domain.RuleRollout) error
+	GetByID(ctx context.Context, id string) (*domain.RuleRollout, error)
+	GetRunning(ctx context.Context, ruleID string) (*domain.RuleRollout, error) // Nil when the rule has none
+	List(ctx context.Context) ([]domain.RuleRollout, error)
+	Update(ctx context.Context, id string, update func(rollout *domain.RuleRollout) error) error
+}
+
+// Defaults of the settings a rollout is started without
+var defaultRolloutStages = []int{5, 25, 50}
+
+const (
+	defaultRolloutStageDuration    = 10 * time.Minute
+	defaultRolloutMaxDenyRateDelta = 0.05
+	defaultRolloutMinRequests      = 100
+)
+
+// WithRolloutRepository enables rule rollouts, which apply a changed rule
+// to a growing percentage of clients before it replaces the rule
+func (h *RateLimitCommandHandler) WithRolloutRepository(rolloutRepository RolloutRepository) *RateLimitCommandHandler {
+	h.rolloutRepository = rolloutRepository
+	return h
+}
+
+// WithRolloutRepository enables queries for rule rollouts
+func (h *RateLimitQueryHandler) WithRolloutRepository(rolloutRepository RolloutRepository) *RateLimitQueryHandler {
+	h.rolloutRepository = rolloutRepository
+	return h
+}
+
+// rolloutAssignment is the cohort of a running rollout a decision counts
+// towards
+type rolloutAssignment struct {
+	rolloutID string // Empty when the decision counts towards no rollout
+	stage     int
+	canary    bool
+}
+
+// assignRollout applies the candidate of the rule's running rollout to rule
+// when the client is in its canary cohort, and returns the cohort
+func (h *RateLimitCommandHandler) assignRollout(ctx context.Context, rule *domain.RateLimitRule, clientID string) (rolloutAssignment, error) {
+	if h.rolloutRepository == nil {
+		return rolloutAssignment{}, nil
+	}
+
+	rollout, err := h.rolloutRepository.GetRunning(ctx, rule.ID)
+	if err != nil {
+		return rolloutAssignment{}, fmt.Errorf("failed to get rollout: %w", err)
+	}
+	if rollout == nil {
+		return rolloutAssignment{}, nil
+	}
+
+	assignment := rolloutAssignment{rolloutID: rollout.ID, stage: rollout.Stage, canary: rollout.InCanary(clientID)}
+	if assignment.canary {
+		*rule = rollout.Apply(*rule)
+	}
+	return assignment, nil
+}
+
+// recordRolloutDecision counts decision towards the cohort of assignment.
+// Decisions made before the rollout moved on to another stage or ended are
+// not counted.
+func (h *RateLimitCommandHandler) recordRolloutDecision(ctx context.Context, assignment rolloutAssignment, decision domain.Event) {
+	if assignment.rolloutID == "" {
+		return
+	}
+
+	_, denied := decision.(*domain.RateLimitExceededEvent)
+	// A lost count only delays the rollout's evaluation, so errors are ignored
+	_ = h.rolloutRepository.Update(ctx, assignment.rolloutID, func(rollout *domain.RuleRollout) error {
+		if rollout.Status != domain.RolloutRunning || rollout.Stage != assignment.stage {
+			return nil
+		}
+		if assignment.canary {
+			rollout.Canary.Record(denied)
+		} else {
+			rollout.Baseline.Record(denied)
+		}
+		return nil
+	})
+}
+
+// handleStartRollout starts rolling out a change of a rule at the first
+// stage of the rollout
+func (h *RateLimitCommandHandler) handleStartRollout(ctx context.Context, cmd *commands.StartRolloutCommand) error {
+	if h.rolloutRepository == nil {
+		return fmt.Errorf("rollouts are not enabled")
+	}
+
+	rule, err := h.ruleRepository.GetByID(ctx, cmd.RuleID)
+	if err != nil {
+		return fmt.Errorf("failed to get rule: %w", err)
+	}
+
+	candidate := *rule
+	if cmd.Limit != 0 {
+		candidate.Limit = cmd.Limit
+	}
+	if cmd.Window != 0 {
+		candidate.Window = cmd.Window
+	}
+	if cmd.Algorithm != "" && domain.Algorithm(cmd.Algorithm) != candidate.Algorithm {
+		// The parameters of the rule's algorithm do not apply to another
+		candidate.Algorithm = domain.Algorithm(cmd.Algorithm)
+		candidate.Parameters = nil
+	}
+	if cmd.SoftThreshold != nil {
+		candidate.SoftThreshold = *cmd.SoftThreshold
+	}
+	if (cmd.Limit != 0 || cmd.Window != 0) && candidate.Parameters != nil && candidate.Parameters.SlidingWindow == nil {
+		// Bucket parameters resolve into the limit and window replaced
+		candidate.Parameters = nil
+	}
+	if err := validateCandidate(candidate); err != nil {
+		return fmt.Errorf("%w: %v", domain.ErrInvalidRollout, err)
+	}
+	if reflect.DeepEqual(candidate, *rule) {
+		return fmt.Errorf("%w: the candidate equals rule %s", domain.ErrInvalidRollout, rule.ID)
+	}
+
+	stages := cmd.Stages
+	if len(stages) == 0 {
+		stages = defaultRolloutStages
+	}
+	if err := domain.ValidateRolloutStages(stages); err != nil {
+		return fmt.Errorf("%w: %v", domain.ErrInvalidRollout, err)
+	}
+	if cmd.StageDuration < 0 || cmd.MinRequests < 0 || cmd.MaxDenyRateDelta < 0 || cmd.MaxDenyRateDelta > 1 {
+		return fmt.Errorf("%w: stage duration and min requests must not be negative, and max deny rate delta must be between 0 and 1", domain.ErrInvalidRollout)
+	}
+
+	now := h.clock.Now()
+	rollout := domain.RuleRollout{
+		ID:               fmt.Sprintf("rollout-%d", time.Now().UnixNano()),
+		RuleID:           rule.ID,
+		Candidate:        candidate,
+		Stages:           append([]int(nil), stages...),
+		StageDuration:    cmd.StageDuration,
+		MaxDenyRateDelta: cmd.MaxDenyRateDelta,
+		MinRequests:      cmd.MinRequests,
+		Status:           domain.RolloutRunning,
+		StageStartedAt:   now,
+		CreatedAt:        now,
+	}
+	if rollout.StageDuration == 0 {
+		rollout.StageDuration = defaultRolloutStageDuration
+	}
+	if rollout.MaxDenyRateDelta == 0 {
+		rollout.MaxDenyRateDelta = defaultRolloutMaxDenyRateDelta
+	}
+	if rollout.MinRequests == 0 {
+		rollout.MinRequests = defaultRolloutMinRequests
+	}
+
+	if err := h.rolloutRepository.Save(ctx, rollout); err != nil {
+		return fmt.Errorf("failed to save rollout: %w", err)
+	}
+
+	cmd.Result = &rollout
+	return nil
+}
+
+// validateCandidate checks the settings a rollout changes
+func validateCandidate(candidate domain.RateLimitRule) error {
+	if candidate.Limit <= 0 || candidate.Window <= 0 {
+		return fmt.Errorf("limit and window must be positive")
+	}
+	switch candidate.Algorithm {
+	case domain.TokenBucket, domain.SlidingWindow, domain.FixedWindow, domain.LeakyBucket, domain.SlidingWindowCounter:
+	default:
+		return fmt.Errorf("unknown algorithm %q", candidate.Algorithm)
+	}
+	if _, _, err := resolveParameters(candidate.Parameters, string(candidate.Algorithm), candidate.Limit, candidate.Window); err != nil {
+		return err
+	}
+	if err := validateWindows(candidate.Window, candidate.Windows); err != nil {
+		return err
+	}
+	return validateSoftThreshold(candidate.SoftThreshold)
+}
+
+// handlePromoteRollout replaces a rule with the candidate of its rollout
+func (h *RateLimitCommandHandler) handlePromoteRollout(ctx context.Context, cmd *commands.PromoteRolloutCommand) error {
+	if h.rolloutRepository == nil {
+		return fmt.Errorf("rollouts are not enabled")
+	}
+
+	reason := cmd.Reason
+	if reason == "" {
+		reason = "promoted manually"
+	}
+	rollout, err := h.endRollout(ctx, cmd.RolloutID, domain.RolloutPromoted, reason, h.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	cmd.Result = rollout
+	return nil
+}
+
+// handleRollBackRollout ends a rollout, keeping its rule
+func (h *RateLimitCommandHandler) handleRollBackRollout(ctx context.Context, cmd *commands.RollBackRolloutCommand) error {
+	if h.rolloutRepository == nil {
+		return fmt.Errorf("rollouts are not enabled")
+	}
+
+	reason := cmd.Reason
+	if reason == "" {
+		reason = "rolled back manually"
+	}
+	rollout, err := h.endRollout(ctx, cmd.RolloutID, domain.RolloutRolledBack, reason, h.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	cmd.Result = rollout
+	return nil
+}
+
+// handleEvaluateRollouts advances, promotes or rolls back each running
+// rollout as its cohorts' deny rates decide. Rollouts whose rule was deleted
+// are rolled back.
+func (h *RateLimitCommandHandler) handleEvaluateRollouts(ctx context.Context, cmd *commands.EvaluateRolloutsCommand) error {
+	if h.rolloutRepository == nil {
+		return nil
+	}
+
+	rollouts, err := h.rolloutRepository.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get rollouts: %w", err)
+	}
+
+	now := h.clock.Now()
+	var errs []error
+	for _, rollout := range rollouts {
+		if rollout.Status != domain.RolloutRunning {
+			continue
+		}
+
+		action, reason := rollout.Evaluate(now)
+		if _, err := h.ruleRepository.GetByID(ctx, rollout.RuleID); err != nil {
+			action, reason = domain.RolloutRollBack, "rule no longer exists"
+		}
+
+		var changed *domain.RuleRollout
+		switch action {
+		case domain.RolloutAdvance:
+			changed, err = h.advanceRollout(ctx, rollout.ID, now)
+		case domain.RolloutPromote:
+			changed, err = h.endRollout(ctx, rollout.ID, domain.RolloutPromoted, reason, now)
+		case domain.RolloutRollBack:
+			changed, err = h.endRollout(ctx, rollout.ID, domain.RolloutRolledBack, reason, now)
+		default:
+			continue
+		}
+		// A rollout ended meanwhile by the API needs no evaluation
+		if err != nil && !errors.Is(err, domain.ErrRolloutEnded) {
+			errs = append(errs, fmt.Errorf("failed to apply %s to rollout %s: %w", action, rollout.ID, err))
+			continue
+		}
+		if changed != nil {
+			cmd.Result = append(cmd.Result, *changed)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// advanceRollout moves a running rollout to its next stage
+func (h *RateLimitCommandHandler) advanceRollout(ctx context.Context, id string, now time.Time) (*domain.RuleRollout, error) {
+	var advanced domain.RuleRollout
+	err := h.rolloutRepository.Update(ctx, id, func(rollout *domain.RuleRollout) error {
+		if rollout.Status != domain.RolloutRunning {
+			return fmt.Errorf("%w: %s", domain.ErrRolloutEnded, id)
+		}
+		rollout.Advance(now)
+		advanced = *rollout
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &advanced, nil
+}
+
+// endRollout ends a running rollout with status. Promoting it replaces the
+// rule's settings with the candidate's in the same update, so that a
+// rollout is never recorded as promoted without its rule being changed.
+func (h *RateLimitCommandHandler) endRollout(ctx context.Context, id string, status domain.RolloutStatus, reason string, now time.Time) (*domain.RuleRollout, error) {
+	var ended domain.RuleRollout
+	err := h.rolloutRepository.Update(ctx, id, func(rollout *domain.RuleRollout) error {
+		if rollout.Status != domain.RolloutRunning {
+			return fmt.Errorf("%w: %s", domain.ErrRolloutEnded, id)
+		}
+
+		if status == domain.RolloutPromoted {
+			rule, err := h.ruleRepository.GetByID(ctx, rollout.RuleID)
+			if err != nil {
+				return fmt.Errorf("failed to get rule: %w", err)
+			}
+			promoted := rollout.Apply(*rule)
+			promoted.UpdatedAt = now
+			promoted.ChangeRef = rollout.ID
+			promoted.LastModifiedBy = principal.FromContext(ctx)
+			if err := h.ruleRepository.Update(ctx, promoted); err != nil {
+				return fmt.Errorf("failed to update rule: %w", err)
+			}
+		}
+
+		rollout.End(status, reason, now)
+		ended = *rollout
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ended, nil
+}
+
+// handleGetRollouts retrieves the rollouts, newest first, filtered by rule
+// and status. Without rollout storage there are none.
+func (h *RateLimitQueryHandler) handleGetRollouts(ctx context.Context, query *queries.GetRolloutsQuery) ([]domain.RuleRollout, error) {
+	if h.rolloutRepository == nil {
+		return []domain.RuleRollout{}, nil
+	}
+
+	if query.RolloutID != "" {
+		rollout, err := h.rolloutRepository.GetByID(ctx, query.RolloutID)
+		if err != nil {
+			return nil, err
+		}
+		return []domain.RuleRollout{*rollout}, nil
+	}
+
+	rollouts, err := h.rolloutRepository.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rollouts: %w", err)
+	}
+
+	result := make([]domain.RuleRollout, 0, len(rollouts))
+	for i := len(rollouts) - 1; i >= 0; i-- {
+		rollout := rollouts[i]
+		if query.RuleID != "" && rollout.RuleID != query.RuleID {
+			continue
+		}
+		if query.Status != "" && string(rollout.Status) != query.Status {
+			continue
+		}
+		result = append(result, rollout)
+	}
+	return result, nil
+}
+
+// explainRollout applies the candidate of the rule's running rollout to rule
+// when the key is in its canary cohort, like decisions do
+func (h *RateLimitQueryHandler) explainRollout(ctx context.Context, explanation *queries.DecisionExplanation, rule *domain.RateLimitRule) error {
+	if h.rolloutRepository == nil {
+		return nil
+	}
+
+	rollout, err := h.rolloutRepository.GetRunning(ctx, rule.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get rollout: %w", err)
+	}
+	if rollout == nil {
+		return nil
+	}
+
+	explanation.Rollout = &queries.RolloutExplanation{
+		RolloutID: rollout.ID,
+		Percent:   rollout.Percent(),
+		Bucket:    domain.RolloutBucket(rollout.ID, explanation.Key),
+		Canary:    rollout.InCanary(explanation.Key),
+	}
+	if explanation.Rollout.Canary {
+		*rule = rollout.Apply(*rule)
+	}
+	return nil
+}
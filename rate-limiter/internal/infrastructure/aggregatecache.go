@@ -0,0 +1,323 @@
+package infrastructure
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// decodedCache holds the decoded events of the most recently used
+// aggregates of an event store, so that loading them skips decoding. An
+// entry records the number of events it holds, which is the version of the
+// aggregate it is current for.
+type decodedCache struct {
+	maxKeys int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+	mutex   sync.Mutex
+}
+
+// decodedEntry is the decoded history of one aggregate
+type decodedEntry struct {
+	aggregateID string
+	events      []domain.Event
+}
+
+func newDecodedCache(maxKeys int) *decodedCache {
+	return &decodedCache{
+		maxKeys: maxKeys,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns a copy of the cached history of an aggregate
+func (c *decodedCache) get(aggregateID string) ([]domain.Event, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[aggregateID]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return append([]domain.Event(nil), element.Value.(*decodedEntry).events...), true
+}
+
+// put caches the history of an aggregate, evicting the least recently used
+// aggregate when the cache is full
+func (c *decodedCache) put(aggregateID string, events []domain.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[aggregateID]; ok {
+		element.Value.(*decodedEntry).events = events
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.maxKeys {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decodedEntry).aggregateID)
+	}
+	c.entries[aggregateID] = c.order.PushFront(&decodedEntry{aggregateID: aggregateID, events: events})
+}
+
+// appendSaved adds events saved at expectedVersion to the cached history of
+// an aggregate. A history of another version is dropped, as it is stale.
+func (c *decodedCache) appendSaved(aggregateID string, events []domain.Event, expectedVersion int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[aggregateID]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*decodedEntry)
+	if len(entry.events) != expectedVersion {
+		c.order.Remove(element)
+		delete(c.entries, aggregateID)
+		return
+	}
+	entry.events = append(entry.events[:len(entry.events):len(entry.events)], events...)
+}
+
+// remove drops the cached history of an aggregate
+func (c *decodedCache) remove(aggregateID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[aggregateID]; ok {
+		c.order.Remove(element)
+		delete(c.entries, aggregateID)
+	}
+}
+
+// WithDecodedCache keeps the decoded events of up to maxKeys of the most
+// recently used aggregates in memory, so that loading them, as every
+// decision does, skips decoding their history. Saved events are decoded and
+// added to the cached history.
+func (s *RedisEventStore) WithDecodedCache(maxKeys int) *RedisEventStore {
+	if maxKeys > 0 {
+		s.decoded = newDecodedCache(maxKeys)
+	}
+	return s
+}
+
+// RecentAggregates returns the IDs of up to limit aggregates with events
+// saved since the given time, most recently active first. The log is read
+// from its end until an older event.
+func (s *RedisEventStore) RecentAggregates(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	s.mutex.RLock()
+	records := s.log
+	s.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var aggregateIDs []string
+	for i := len(records) - 1; i >= 0 && len(aggregateIDs) < limit; i-- {
+		if err := ctx.Err(); err != nil {
+			return aggregateIDs, err
+		}
+		event, err := s.codec.Decode(records[i])
+		if err != nil {
+			return aggregateIDs, fmt.Errorf("failed to decode event: %w", err)
+		}
+		if event.Timestamp().Before(since) {
+			break
+		}
+		if id := event.AggregateID(); !seen[id] {
+			seen[id] = true
+			aggregateIDs = append(aggregateIDs, id)
+		}
+	}
+	return aggregateIDs, nil
+}
+
+// Preload decodes the events of the aggregates, most recently active first,
+// into the decoded cache and returns the number of aggregates loaded.
+// Aggregates without events, such as those of erased clients, are skipped.
+func (s *RedisEventStore) Preload(ctx context.Context, aggregateIDs []string) (int, error) {
+	if s.decoded == nil {
+		return 0, fmt.Errorf("event store has no decoded cache")
+	}
+
+	// Loaded least recently active first, so that the cache evicts those first
+	loaded := 0
+	for i := len(aggregateIDs) - 1; i >= 0; i-- {
+		events, err := s.GetEvents(ctx, aggregateIDs[i])
+		if err != nil {
+			return loaded, err
+		}
+		if len(events) > 0 {
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+// AggregateCache holds the state of the most recently decided aggregates,
+// each at the version of the events it was rebuilt from, so that deciding
+// them again skips loading and replaying their events. A save at the
+// version of a cached aggregate advances it with the saved events; any
+// other save, or a failed one, drops it. Each instance keeps its own cache:
+// an aggregate another instance moved past is found out when saving at its
+// cached version conflicts.
+type AggregateCache struct {
+	shards        [shardCount]aggregateCacheShard
+	maxEntries    int // Per shard
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+// aggregateCacheShard holds the cached aggregates of one shard
+type aggregateCacheShard struct {
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+	mutex   sync.Mutex
+}
+
+// NewAggregateCache creates a cache holding up to size aggregates
+func NewAggregateCache(size int) *AggregateCache {
+	c := &AggregateCache{maxEntries: max(size/shardCount, 1)}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*list.Element)
+		c.shards[i].order = list.New()
+	}
+	return c
+}
+
+// Get returns a copy of the cached aggregate with the ID aggregateID
+func (c *AggregateCache) Get(aggregateID string) (*domain.RateLimitAggregate, bool) {
+	shard := &c.shards[shardOf(aggregateID)]
+	shard.mutex.Lock()
+	element, ok := shard.entries[aggregateID]
+	var aggregate *domain.RateLimitAggregate
+	if ok {
+		shard.order.MoveToFront(element)
+		aggregate = copyAggregate(element.Value.(*domain.RateLimitAggregate))
+	}
+	shard.mutex.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return aggregate, true
+}
+
+// Put caches a copy of an aggregate rebuilt from the store, unless a later
+// version of it is cached, evicting the least recently used aggregate of
+// its shard when the shard is full
+func (c *AggregateCache) Put(aggregate *domain.RateLimitAggregate) {
+	shard := &c.shards[shardOf(aggregate.ID)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if element, ok := shard.entries[aggregate.ID]; ok {
+		if element.Value.(*domain.RateLimitAggregate).Version <= aggregate.Version {
+			element.Value = copyAggregate(aggregate)
+		}
+		shard.order.MoveToFront(element)
+		return
+	}
+	if shard.order.Len() >= c.maxEntries {
+		oldest := shard.order.Back()
+		shard.order.Remove(oldest)
+		delete(shard.entries, oldest.Value.(*domain.RateLimitAggregate).ID)
+	}
+	shard.entries[aggregate.ID] = shard.order.PushFront(copyAggregate(aggregate))
+}
+
+// Advance applies events saved at expectedVersion to the cached aggregate
+// with the ID aggregateID. An aggregate cached at another version is
+// dropped, as it is stale.
+func (c *AggregateCache) Advance(aggregateID string, expectedVersion int, events []domain.Event) {
+	shard := &c.shards[shardOf(aggregateID)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	element, ok := shard.entries[aggregateID]
+	if !ok {
+		return
+	}
+	aggregate := element.Value.(*domain.RateLimitAggregate)
+	if aggregate.Version != expectedVersion {
+		shard.remove(element)
+		c.invalidations.Add(1)
+		return
+	}
+	aggregate.LoadFromHistory(events)
+}
+
+// Invalidate drops the cached aggregate with the ID aggregateID
+func (c *AggregateCache) Invalidate(aggregateID string) {
+	shard := &c.shards[shardOf(aggregateID)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if element, ok := shard.entries[aggregateID]; ok {
+		shard.remove(element)
+		c.invalidations.Add(1)
+	}
+}
+
+// InvalidateClient drops the cached aggregates of a client, such as when
+// its data is erased
+func (c *AggregateCache) InvalidateClient(clientID string) {
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		for _, element := range shard.entries {
+			if element.Value.(*domain.RateLimitAggregate).State.ClientID == clientID {
+				shard.remove(element)
+				c.invalidations.Add(1)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// Stats reports the size and lookups of the cache
+func (c *AggregateCache) Stats() queries.AggregateCacheStats {
+	stats := queries.AggregateCacheStats{
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		stats.Entries += len(shard.entries)
+		shard.mutex.Unlock()
+	}
+	return stats
+}
+
+// remove drops the aggregate of element. The caller holds the shard's lock.
+func (s *aggregateCacheShard) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*domain.RateLimitAggregate).ID)
+}
+
+// copyAggregate returns a copy of the state and version of aggregate that
+// shares no memory with it, as applying events changes the request log in
+// place
+func copyAggregate(aggregate *domain.RateLimitAggregate) *domain.RateLimitAggregate {
+	copied := &domain.RateLimitAggregate{
+		ID:      aggregate.ID,
+		State:   aggregate.State,
+		Version: aggregate.Version,
+	}
+	if aggregate.State.RequestLog != nil {
+		copied.State.RequestLog = append(make([]time.Time, 0, len(aggregate.State.RequestLog)), aggregate.State.RequestLog...)
+	}
+	return copied
+}
@@ -0,0 +1,172 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// EventWrite is a save of the events of one aggregate at the version it was
+// loaded at
+type EventWrite struct {
+	AggregateID     string
+	Events          []domain.Event
+	ExpectedVersion int
+}
+
+// BatchEventStore is an event store that saves the events of many
+// aggregates in one round trip, such as a Redis pipeline or a multi-row SQL
+// insert. Each write is checked against its expected version on its own, in
+// order, and the error of each is returned at its index.
+type BatchEventStore interface {
+	SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error
+	GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error)
+	SaveEventBatch(ctx context.Context, writes []EventWrite) []error
+}
+
+// clientEraser is an event store that can erase the events of a client
+type clientEraser interface {
+	EraseClient(ctx context.Context, clientID string, tombstone *domain.ClientDataErasedEvent) error
+}
+
+// WriteBatcher groups the saves of decisions on many aggregates into batches
+// saved in one round trip to its store. A batch is saved at most the flush
+// interval after its first save, or as soon as it is full. Each save waits
+// for its batch and returns the outcome of its own version check, so callers
+// see what saving directly would give them, for a bounded added latency.
+type WriteBatcher struct {
+	store    BatchEventStore
+	interval time.Duration
+	maxBatch int
+	pending  []pendingWrite
+	timer    *time.Timer // Flushes the pending batch; nil when it is empty
+	mutex    sync.Mutex
+	batches  atomic.Uint64
+	writes   atomic.Uint64
+}
+
+// pendingWrite is a save waiting for its batch
+type pendingWrite struct {
+	ctx    context.Context
+	write  EventWrite
+	result chan error
+}
+
+// NewWriteBatcher creates a batcher saving to store in batches of up to
+// maxBatch writes, each saved at most interval after its first write
+func NewWriteBatcher(store BatchEventStore, interval time.Duration, maxBatch int) *WriteBatcher {
+	return &WriteBatcher{
+		store:    store,
+		interval: interval,
+		maxBatch: maxBatch,
+	}
+}
+
+// SaveEvents adds the events of an aggregate to the pending batch and waits
+// until the batch is saved
+func (b *WriteBatcher) SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	b.mutex.Lock()
+	b.pending = append(b.pending, pendingWrite{
+		ctx:    ctx,
+		write:  EventWrite{AggregateID: aggregateID, Events: events, ExpectedVersion: expectedVersion},
+		result: result,
+	})
+	var full []pendingWrite
+	if len(b.pending) >= b.maxBatch {
+		full = b.take()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.flushPending)
+	}
+	b.mutex.Unlock()
+
+	// The save filling the batch saves it rather than wait for the timer
+	if full != nil {
+		b.flush(full)
+	}
+	return <-result
+}
+
+// GetEvents loads the events of an aggregate from the store. Saves return
+// once they are stored, so a decision loads the events of those before it.
+func (b *WriteBatcher) GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error) {
+	return b.store.GetEvents(ctx, aggregateID)
+}
+
+// EraseClient erases the events of a client through the store
+func (b *WriteBatcher) EraseClient(ctx context.Context, clientID string, tombstone *domain.ClientDataErasedEvent) error {
+	eraser, ok := b.store.(clientEraser)
+	if !ok {
+		return fmt.Errorf("event store cannot erase client data")
+	}
+	return eraser.EraseClient(ctx, clientID, tombstone)
+}
+
+// Stats reports the batches saved and the writes waiting for one
+func (b *WriteBatcher) Stats() queries.WriteBatchStats {
+	b.mutex.Lock()
+	pending := len(b.pending)
+	b.mutex.Unlock()
+
+	return queries.WriteBatchStats{
+		Batches: b.batches.Load(),
+		Writes:  b.writes.Load(),
+		Pending: pending,
+	}
+}
+
+// flushPending saves the pending batch
+func (b *WriteBatcher) flushPending() {
+	b.mutex.Lock()
+	batch := b.take()
+	b.mutex.Unlock()
+
+	b.flush(batch)
+}
+
+// take removes the pending batch and stops its timer. The caller holds the
+// lock.
+func (b *WriteBatcher) take() []pendingWrite {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// flush saves batch in one round trip and hands each write its outcome.
+// Writes whose caller gave up waiting are not saved, so that no caller is
+// told a save failed that was made.
+func (b *WriteBatcher) flush(batch []pendingWrite) {
+	writes := make([]EventWrite, 0, len(batch))
+	saved := make([]pendingWrite, 0, len(batch))
+	for _, p := range batch {
+		if err := p.ctx.Err(); err != nil {
+			p.result <- err
+			continue
+		}
+		writes = append(writes, p.write)
+		saved = append(saved, p)
+	}
+	if len(writes) == 0 {
+		return
+	}
+
+	errs := b.store.SaveEventBatch(context.Background(), writes)
+	b.batches.Add(1)
+	b.writes.Add(uint64(len(writes)))
+	for i, p := range saved {
+		p.result <- errs[i]
+	}
+}
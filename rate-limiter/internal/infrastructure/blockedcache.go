@@ -0,0 +1,191 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// BlockedCache remembers the denials of blocked clients until their blocks
+// end, so that the further requests of a client hammering a resource are
+// denied without querying the read model or loading its events.
+// Each instance keeps its own cache. Resets, refunds and evictions of a
+// client drop its denials, whichever instance they were made on, once they
+// reach the instance's event bus through Watch.
+type BlockedCache struct {
+	shards     [shardCount]blockedCacheShard
+	maxEntries int // Per shard
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+// blockedCacheShard holds the denials of the clients of one shard, by client
+// and then by resource
+type blockedCacheShard struct {
+	clients map[string]map[string]queries.RateLimitStatus
+	entries int
+	mutex   sync.Mutex
+}
+
+// NewBlockedCache creates a cache holding up to size denials
+func NewBlockedCache(size int) *BlockedCache {
+	c := &BlockedCache{maxEntries: max(size/shardCount, 1)}
+	for i := range c.shards {
+		c.shards[i].clients = make(map[string]map[string]queries.RateLimitStatus)
+	}
+	return c
+}
+
+// Blocked returns the cached denial of a client's requests to resource with
+// its retry delay as of now, or nil when the client is not known to be
+// blocked. The status is drawn from the status pool.
+func (c *BlockedCache) Blocked(clientID, resource string, now time.Time) *queries.RateLimitStatus {
+	shard := &c.shards[shardOf(clientID)]
+	shard.mutex.Lock()
+	cached, ok := shard.clients[clientID][resource]
+	if ok && !now.Before(cached.BlockedUntil) {
+		shard.remove(clientID, resource)
+		ok = false
+	}
+	shard.mutex.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+	status := queries.AcquireStatus()
+	*status = cached
+	status.RetryAfter = queries.RetryAfterSeconds(cached.BlockedUntil, now)
+	return status
+}
+
+// Block caches the status of a client's request to resource when it denies
+// the request until a time after now. A full shard first drops its expired
+// denials; denials that still find no room are not cached.
+func (c *BlockedCache) Block(clientID, resource string, status *queries.RateLimitStatus, now time.Time) {
+	if !status.IsBlocked || !status.BlockedUntil.After(now) {
+		return
+	}
+
+	shard := &c.shards[shardOf(clientID)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, exists := shard.clients[clientID][resource]; !exists {
+		if shard.entries >= c.maxEntries {
+			shard.removeExpired(now)
+		}
+		if shard.entries >= c.maxEntries {
+			return
+		}
+		shard.entries++
+	}
+	resources, exists := shard.clients[clientID]
+	if !exists {
+		resources = make(map[string]queries.RateLimitStatus)
+		shard.clients[clientID] = resources
+	}
+	resources[resource] = *status
+}
+
+// Invalidate drops the cached denials of a client
+func (c *BlockedCache) Invalidate(clientID string) {
+	shard := &c.shards[shardOf(clientID)]
+	shard.mutex.Lock()
+	shard.entries -= len(shard.clients[clientID])
+	delete(shard.clients, clientID)
+	shard.mutex.Unlock()
+}
+
+// Clear drops every cached denial, such as after a rule change that may
+// lift them
+func (c *BlockedCache) Clear() {
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		shard.clients = make(map[string]map[string]queries.RateLimitStatus)
+		shard.entries = 0
+		shard.mutex.Unlock()
+	}
+}
+
+// Stats reports the number of cached denials and the hits and misses of
+// lookups so far
+func (c *BlockedCache) Stats() queries.BlockedCacheStats {
+	stats := queries.BlockedCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		stats.Entries += shard.entries
+		shard.mutex.Unlock()
+	}
+	return stats
+}
+
+// Watch drops the denials of the clients of events that may lift them until
+// events is closed or ctx is cancelled
+func (c *BlockedCache) Watch(ctx context.Context, events <-chan domain.Event) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if clientID, lifts := LiftedClient(event); lifts {
+				c.Invalidate(clientID)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LiftedClient returns the client of an event that may lift its denials, or
+// false for other events
+func LiftedClient(event domain.Event) (string, bool) {
+	switch e := event.(type) {
+	case *domain.RateLimitWindowResetEvent:
+		return e.ClientID, true
+	case *domain.RateLimitRefundedEvent:
+		return e.ClientID, true
+	case *domain.LeaseSettledEvent:
+		return e.ClientID, e.Returned > 0
+	case *domain.RateLimitKeyEvictedEvent:
+		return e.ClientID, true
+	case *domain.ClientDataErasedEvent:
+		return e.ClientID, true
+	default:
+		return "", false
+	}
+}
+
+// remove drops the denial of a client's requests to resource; the caller
+// holds the shard lock
+func (s *blockedCacheShard) remove(clientID, resource string) {
+	resources := s.clients[clientID]
+	if _, exists := resources[resource]; !exists {
+		return
+	}
+	delete(resources, resource)
+	s.entries--
+	if len(resources) == 0 {
+		delete(s.clients, clientID)
+	}
+}
+
+// removeExpired drops the denials that ended by now; the caller holds the
+// shard lock
+func (s *blockedCacheShard) removeExpired(now time.Time) {
+	for clientID, resources := range s.clients {
+		for resource, status := range resources {
+			if !now.Before(status.BlockedUntil) {
+				s.remove(clientID, resource)
+			}
+		}
+	}
+}
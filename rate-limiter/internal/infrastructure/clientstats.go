@@ -0,0 +1,243 @@
+package infrastructure
+
+import (
+	"sort"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// clientStatsBucketSize is the size of the buckets decisions are counted
+// in; time ranges are widened to whole buckets
+const clientStatsBucketSize = time.Minute
+
+// statsTiers are the bucket sizes of client stats, finest first. Buckets
+// past their tier's retention are rolled up into the next tier.
+var statsTiers = [...]time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// StatsRetention sets how long client stats are kept at each granularity.
+// Minute buckets older than Minutes are rolled up into hour buckets, hour
+// buckets older than Hours into day buckets, and day buckets older than
+// Days are dropped. Zero keeps a tier's buckets for all time.
+type StatsRetention struct {
+	Minutes time.Duration
+	Hours   time.Duration
+	Days    time.Duration
+}
+
+// tier returns the retention of tier i of statsTiers
+func (r StatsRetention) tier(i int) time.Duration {
+	return [...]time.Duration{r.Minutes, r.Hours, r.Days}[i]
+}
+
+// decisionCounts counts the decisions on a client and resource
+type decisionCounts struct {
+	allowed int
+	blocked int
+}
+
+// clientStatsBucket counts the decisions on a client in one bucket, by
+// resource
+type clientStatsBucket struct {
+	start     time.Time
+	resources map[string]*decisionCounts
+}
+
+// clientStats holds the decisions on a client in buckets of each tier,
+// oldest first. Every decision is counted in exactly one bucket, so the
+// tiers never overlap in what they count.
+type clientStats struct {
+	tiers [len(statsTiers)][]clientStatsBucket
+}
+
+// record counts a decision at at, then rolls up the buckets past retention
+func (s *clientStats) record(resource string, allowed bool, at time.Time, retention StatsRetention) {
+	counts := s.bucket(0, at).counts(resource)
+	if allowed {
+		counts.allowed++
+	} else {
+		counts.blocked++
+	}
+	s.rollUp(at, retention)
+}
+
+// bucket returns the bucket of tier holding at, adding it if needed
+func (s *clientStats) bucket(tier int, at time.Time) clientStatsBucket {
+	start := at.Truncate(statsTiers[tier])
+	buckets := s.tiers[tier]
+
+	// Decisions mostly arrive in order, so the bucket is searched from the end
+	i := len(buckets)
+	for i > 0 && buckets[i-1].start.After(start) {
+		i--
+	}
+	if i > 0 && buckets[i-1].start.Equal(start) {
+		return buckets[i-1]
+	}
+
+	bucket := clientStatsBucket{start: start, resources: make(map[string]*decisionCounts)}
+	buckets = append(buckets, clientStatsBucket{})
+	copy(buckets[i+1:], buckets[i:])
+	buckets[i] = bucket
+	s.tiers[tier] = buckets
+	return bucket
+}
+
+// counts returns the counts of resource in the bucket, adding them if needed
+func (b clientStatsBucket) counts(resource string) *decisionCounts {
+	counts, exists := b.resources[resource]
+	if !exists {
+		counts = &decisionCounts{}
+		b.resources[resource] = counts
+	}
+	return counts
+}
+
+// rollUp merges the buckets that ended longer than their tier's retention
+// before now into the next tier, and drops those of the last tier. It
+// returns the number of buckets rolled up and dropped.
+func (s *clientStats) rollUp(now time.Time, retention StatsRetention) (rolledUp, dropped int) {
+	for tier := range statsTiers {
+		keep := retention.tier(tier)
+		if keep <= 0 {
+			continue
+		}
+		cutoff := now.Add(-keep)
+
+		expired := 0
+		for expired < len(s.tiers[tier]) && !s.tiers[tier][expired].start.Add(statsTiers[tier]).After(cutoff) {
+			expired++
+		}
+		if expired == 0 {
+			continue
+		}
+
+		if tier+1 < len(statsTiers) {
+			for _, bucket := range s.tiers[tier][:expired] {
+				coarser := s.bucket(tier+1, bucket.start)
+				for resource, counts := range bucket.resources {
+					merged := coarser.counts(resource)
+					merged.allowed += counts.allowed
+					merged.blocked += counts.blocked
+				}
+			}
+			rolledUp += expired
+		} else {
+			dropped += expired
+		}
+		s.tiers[tier] = append(s.tiers[tier][:0], s.tiers[tier][expired:]...)
+	}
+	return rolledUp, dropped
+}
+
+// empty reports whether no bucket is left
+func (s *clientStats) empty() bool {
+	for _, buckets := range s.tiers {
+		if len(buckets) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregate sums the buckets overlapping startTime to endTime into the
+// stats of clientID, with time series points of granularity, or of the
+// bucket size where only coarser buckets are held. A zero time leaves that
+// end of the range open.
+func (s *clientStats) aggregate(clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) *queries.ClientStats {
+	stats := emptyClientStats(clientID)
+	stats.Granularity = granularity
+	resources := make(map[string]*queries.ResourceStats)
+	points := make(map[time.Time]*queries.TimeSeriesDataPoint)
+	var first, last time.Time
+
+	for tier, buckets := range s.tiers {
+		size := max(statsTiers[tier], granularity.Duration())
+		for _, bucket := range buckets {
+			end := bucket.start.Add(statsTiers[tier])
+			if !startTime.IsZero() && !end.After(startTime) {
+				continue
+			}
+			if !endTime.IsZero() && !bucket.start.Before(endTime) {
+				break
+			}
+			if first.IsZero() || bucket.start.Before(first) {
+				first = bucket.start
+			}
+			if end.After(last) {
+				last = end
+			}
+
+			pointStart := bucket.start.Truncate(size)
+			point, exists := points[pointStart]
+			if !exists {
+				point = &queries.TimeSeriesDataPoint{Timestamp: pointStart}
+				points[pointStart] = point
+			}
+			for resource, counts := range bucket.resources {
+				point.AllowedRequests += counts.allowed
+				point.BlockedRequests += counts.blocked
+				point.TotalRequests += counts.allowed + counts.blocked
+
+				rs, exists := resources[resource]
+				if !exists {
+					rs = &queries.ResourceStats{Resource: resource}
+					resources[resource] = rs
+				}
+				rs.AllowedRequests += counts.allowed
+				rs.BlockedRequests += counts.blocked
+			}
+		}
+	}
+
+	for _, point := range points {
+		stats.AllowedRequests += point.AllowedRequests
+		stats.BlockedRequests += point.BlockedRequests
+		stats.TotalRequests += point.TotalRequests
+		stats.TimeSeriesData = append(stats.TimeSeriesData, *point)
+	}
+	sort.Slice(stats.TimeSeriesData, func(i, j int) bool {
+		return stats.TimeSeriesData[i].Timestamp.Before(stats.TimeSeriesData[j].Timestamp)
+	})
+
+	for _, rs := range resources {
+		rs.TotalRequests = rs.AllowedRequests + rs.BlockedRequests
+		if rs.TotalRequests > 0 {
+			rs.BlockedRate = float64(rs.BlockedRequests) / float64(rs.TotalRequests)
+		}
+		stats.ResourceStats = append(stats.ResourceStats, *rs)
+	}
+	sort.Slice(stats.ResourceStats, func(i, j int) bool {
+		return stats.ResourceStats[i].Resource < stats.ResourceStats[j].Resource
+	})
+
+	// An open range spans the buckets it holds
+	if startTime.IsZero() {
+		startTime = first
+	}
+	if endTime.IsZero() {
+		endTime = last
+	}
+	stats.SetRange(startTime, endTime)
+	return stats
+}
+
+// clientStatsRange widens a time range to whole buckets, the range the
+// stats of any time range within it cover
+func clientStatsRange(startTime, endTime time.Time) (time.Time, time.Time) {
+	start := startTime.Truncate(clientStatsBucketSize)
+	end := endTime.Truncate(clientStatsBucketSize)
+	if end.Before(endTime) {
+		end = end.Add(clientStatsBucketSize)
+	}
+	return start, end
+}
+
+// emptyClientStats returns the stats of a client without decisions
+func emptyClientStats(clientID string) *queries.ClientStats {
+	return &queries.ClientStats{
+		ClientID:       clientID,
+		ResourceStats:  make([]queries.ResourceStats, 0),
+		TimeSeriesData: make([]queries.TimeSeriesDataPoint, 0),
+	}
+}
@@ -0,0 +1,301 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// EventCodec serializes domain events for persistent event stores
+type EventCodec interface {
+	Encode(event domain.Event) ([]byte, error)
+	Decode(data []byte) (domain.Event, error)
+	ContentType() string
+}
+
+// Upcaster rewrites the payload fields of an event from one schema version
+// to the next
+type Upcaster func(fields map[string]any) (map[string]any, error)
+
+// registeredEvent is an event type known to a registry
+type registeredEvent struct {
+	version int
+	factory func() domain.Event
+}
+
+// upcasterKey identifies the upcaster from one version of an event type
+type upcasterKey struct {
+	eventType   string
+	fromVersion int
+}
+
+// EventRegistry maps event types to their Go types and current schema
+// versions, and upcasts payloads written with older versions
+type EventRegistry struct {
+	events    map[string]registeredEvent
+	upcasters map[upcasterKey]Upcaster
+	mutex     sync.RWMutex
+}
+
+// NewEventRegistry creates an empty event registry
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		events:    make(map[string]registeredEvent),
+		upcasters: make(map[upcasterKey]Upcaster),
+	}
+}
+
+// NewDefaultEventRegistry creates a registry of the rate limiter's events
+func NewDefaultEventRegistry() *EventRegistry {
+	return NewEventRegistry().
+		Register("RateLimitRequested", 1, func() domain.Event { return &domain.RateLimitRequestedEvent{} }).
+		Register("RateLimitApplied", 1, func() domain.Event { return &domain.RateLimitAppliedEvent{} }).
+		Register("RateLimitExceeded", 1, func() domain.Event { return &domain.RateLimitExceededEvent{} }).
+		Register("RateLimitWindowReset", 1, func() domain.Event { return &domain.RateLimitWindowResetEvent{} }).
+		Register("RateLimitThresholdReached", 1, func() domain.Event { return &domain.RateLimitThresholdReachedEvent{} }).
+		Register("RateLimitRefunded", 1, func() domain.Event { return &domain.RateLimitRefundedEvent{} }).
+		Register("TokensLeased", 1, func() domain.Event { return &domain.TokensLeasedEvent{} }).
+		Register("LeaseSettled", 1, func() domain.Event { return &domain.LeaseSettledEvent{} }).
+		Register("LeaseExpired", 1, func() domain.Event { return &domain.LeaseExpiredEvent{} }).
+		Register("RateLimitKeyEvicted", 1, func() domain.Event { return &domain.RateLimitKeyEvictedEvent{} }).
+		Register("ClientDataErased", 1, func() domain.Event { return &domain.ClientDataErasedEvent{} }).
+		Register("EventErased", 1, func() domain.Event { return &domain.EventErasedEvent{} })
+}
+
+// Register adds an event type at its current schema version. factory must
+// return a pointer to a new, empty event.
+func (r *EventRegistry) Register(eventType string, version int, factory func() domain.Event) *EventRegistry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events[eventType] = registeredEvent{version: version, factory: factory}
+	return r
+}
+
+// RegisterUpcaster adds the upcaster from fromVersion to fromVersion+1 of
+// an event type. Payloads are upcast one version at a time until they reach
+// the registered version.
+func (r *EventRegistry) RegisterUpcaster(eventType string, fromVersion int, upcast Upcaster) *EventRegistry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.upcasters[upcasterKey{eventType: eventType, fromVersion: fromVersion}] = upcast
+	return r
+}
+
+// SchemaVersion returns the current schema version of an event type
+func (r *EventRegistry) SchemaVersion(eventType string) (int, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	registered, exists := r.events[eventType]
+	return registered.version, exists
+}
+
+// fields returns the payload fields of an event and its schema version
+func (r *EventRegistry) fields(event domain.Event) (map[string]any, int, error) {
+	version, exists := r.SchemaVersion(event.EventType())
+	if !exists {
+		return nil, 0, fmt.Errorf("unregistered event type: %s", event.EventType())
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal event fields: %w", err)
+	}
+	fields["schema_version"] = version
+	return fields, version, nil
+}
+
+// event upcasts payload fields written with version to the current schema
+// and builds the event from them
+func (r *EventRegistry) event(eventType string, version int, fields map[string]any) (domain.Event, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	registered, exists := r.events[eventType]
+	if !exists {
+		return nil, fmt.Errorf("unregistered event type: %s", eventType)
+	}
+	if version == 0 {
+		// Written before events carried a schema version
+		version = 1
+	}
+	if version > registered.version {
+		return nil, fmt.Errorf("event %s has schema version %d, newer than %d", eventType, version, registered.version)
+	}
+
+	for ; version < registered.version; version++ {
+		upcast, exists := r.upcasters[upcasterKey{eventType: eventType, fromVersion: version}]
+		if !exists {
+			return nil, fmt.Errorf("no upcaster for event %s from schema version %d", eventType, version)
+		}
+
+		var err error
+		if fields, err = upcast(fields); err != nil {
+			return nil, fmt.Errorf("failed to upcast event %s from schema version %d: %w", eventType, version, err)
+		}
+	}
+
+	fields["schema_version"] = registered.version
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event fields: %w", err)
+	}
+
+	event := registered.factory()
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event %s: %w", eventType, err)
+	}
+	return event, nil
+}
+
+// jsonEnvelope is the JSON encoding of an event
+type jsonEnvelope struct {
+	Type          string         `json:"type"`
+	SchemaVersion int            `json:"schema_version"`
+	Payload       map[string]any `json:"payload"`
+}
+
+// JSONEventCodec encodes events as JSON envelopes
+type JSONEventCodec struct {
+	registry *EventRegistry
+}
+
+// NewJSONEventCodec creates a JSON codec for the events in registry
+func NewJSONEventCodec(registry *EventRegistry) *JSONEventCodec {
+	return &JSONEventCodec{registry: registry}
+}
+
+// ContentType returns the media type of encoded events
+func (c *JSONEventCodec) ContentType() string {
+	return "application/json"
+}
+
+// Encode serializes an event with its type and schema version
+func (c *JSONEventCodec) Encode(event domain.Event) ([]byte, error) {
+	fields, version, err := c.registry.fields(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonEnvelope{
+		Type:          event.EventType(),
+		SchemaVersion: version,
+		Payload:       fields,
+	})
+}
+
+// Decode deserializes an event, upcasting it to the current schema
+func (c *JSONEventCodec) Decode(data []byte) (domain.Event, error) {
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event envelope: %w", err)
+	}
+
+	return c.registry.event(envelope.Type, envelope.SchemaVersion, envelope.Payload)
+}
+
+// Field numbers of the protobuf event envelope:
+//
+//	message EventEnvelope {
+//	  string type = 1;
+//	  int32 schema_version = 2;
+//	  google.protobuf.Struct payload = 3;
+//	}
+const (
+	envelopeTypeField          protowire.Number = 1
+	envelopeSchemaVersionField protowire.Number = 2
+	envelopePayloadField       protowire.Number = 3
+)
+
+// ProtobufEventCodec encodes events as protobuf envelopes
+type ProtobufEventCodec struct {
+	registry *EventRegistry
+}
+
+// NewProtobufEventCodec creates a protobuf codec for the events in registry
+func NewProtobufEventCodec(registry *EventRegistry) *ProtobufEventCodec {
+	return &ProtobufEventCodec{registry: registry}
+}
+
+// ContentType returns the media type of encoded events
+func (c *ProtobufEventCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// Encode serializes an event with its type and schema version
+func (c *ProtobufEventCodec) Encode(event domain.Event) ([]byte, error) {
+	fields, version, err := c.registry.fields(event)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert event payload: %w", err)
+	}
+	payloadBytes, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event payload: %w", err)
+	}
+
+	var data []byte
+	data = protowire.AppendTag(data, envelopeTypeField, protowire.BytesType)
+	data = protowire.AppendString(data, event.EventType())
+	data = protowire.AppendTag(data, envelopeSchemaVersionField, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(version))
+	data = protowire.AppendTag(data, envelopePayloadField, protowire.BytesType)
+	data = protowire.AppendBytes(data, payloadBytes)
+	return data, nil
+}
+
+// Decode deserializes an event, upcasting it to the current schema
+func (c *ProtobufEventCodec) Decode(data []byte) (domain.Event, error) {
+	var eventType string
+	var version int
+	payload := &structpb.Struct{}
+
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("failed to read event envelope: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case number == envelopeTypeField && wireType == protowire.BytesType:
+			eventType, n = protowire.ConsumeString(data)
+		case number == envelopeSchemaVersionField && wireType == protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(data)
+			version = int(value)
+		case number == envelopePayloadField && wireType == protowire.BytesType:
+			var payloadBytes []byte
+			if payloadBytes, n = protowire.ConsumeBytes(data); n >= 0 {
+				if err := proto.Unmarshal(payloadBytes, payload); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal event payload: %w", err)
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("failed to read event envelope: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+
+	return c.registry.event(eventType, version, payload.AsMap())
+}
@@ -0,0 +1,110 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// counterEntry is a single counter with its expiry
+type counterEntry struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// InMemoryCounterStore implements CounterStore interface for testing/development
+type InMemoryCounterStore struct {
+	counters  map[string]*counterEntry
+	lastSweep time.Time
+	clock     domain.Clock
+	mutex     sync.Mutex
+}
+
+// NewInMemoryCounterStore creates a new in-memory counter store
+func NewInMemoryCounterStore() *InMemoryCounterStore {
+	return &InMemoryCounterStore{
+		counters: make(map[string]*counterEntry),
+		clock:    domain.SystemClock{},
+	}
+}
+
+// WithClock sets the clock that counter expiry is timed with
+func (s *InMemoryCounterStore) WithClock(clock domain.Clock) *InMemoryCounterStore {
+	s.clock = clock
+	return s
+}
+
+// Increment adds delta to the counter, creating it with the given ttl if it
+// does not exist yet
+func (s *InMemoryCounterStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	entry, exists := s.counters[key]
+	if !exists || now.After(entry.expiresAt) {
+		entry = &counterEntry{expiresAt: now.Add(ttl)}
+		s.counters[key] = entry
+		s.evictExpired(now)
+	}
+
+	entry.value += delta
+	return entry.value, nil
+}
+
+// Decrement subtracts delta from the counter without going below zero
+func (s *InMemoryCounterStore) Decrement(ctx context.Context, key string, delta int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, exists := s.counters[key]
+	if !exists || s.clock.Now().After(entry.expiresAt) {
+		return 0, nil
+	}
+
+	entry.value -= delta
+	if entry.value < 0 {
+		entry.value = 0
+	}
+	return entry.value, nil
+}
+
+// Get returns the current counter value, or zero if it does not exist
+func (s *InMemoryCounterStore) Get(ctx context.Context, key string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, exists := s.counters[key]
+	if !exists || s.clock.Now().After(entry.expiresAt) {
+		return 0, nil
+	}
+	return entry.value, nil
+}
+
+// evictExpired periodically drops expired counters; callers must hold the mutex
+func (s *InMemoryCounterStore) evictExpired(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, entry := range s.counters {
+		if now.After(entry.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+}
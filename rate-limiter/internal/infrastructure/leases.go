@@ -0,0 +1,51 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// LeaseExpiration expires the token leases that were neither renewed nor
+// released in time, returning those it expired
+type LeaseExpiration interface {
+	ExpireLeases(ctx context.Context) ([]domain.Lease, error)
+}
+
+// LeaseExpirer expires lapsed token leases on an interval, so that they are
+// recorded and no longer listed
+type LeaseExpirer struct {
+	leases   LeaseExpiration
+	interval time.Duration
+}
+
+// NewLeaseExpirer creates an expirer. Call Run to start it.
+func NewLeaseExpirer(leases LeaseExpiration, interval time.Duration) *LeaseExpirer {
+	return &LeaseExpirer{
+		leases:   leases,
+		interval: interval,
+	}
+}
+
+// Run expires the lapsed leases every interval until ctx is cancelled
+func (e *LeaseExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			expired, err := e.leases.ExpireLeases(ctx)
+			if err != nil {
+				log.Printf("Error expiring token leases: %v", err)
+			}
+			for _, lease := range expired {
+				log.Printf("Lease %s of %d tokens of %s for %s expired", lease.ID, lease.Tokens, lease.ClientID, lease.Resource)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcachedCounterStore implements CounterStore interface on a Memcached
+// fleet with gomemcache, counting with its incr and decr commands. Keys are
+// spread over the configured servers by CRC32 hash.
+type MemcachedCounterStore struct {
+	client *memcache.Client
+}
+
+// memcachedTimeout bounds every read and write to a server, as gomemcache
+// takes no context
+const memcachedTimeout = time.Second
+
+// NewMemcachedCounterStore creates a counter store for the given servers
+func NewMemcachedCounterStore(addrs []string) (*MemcachedCounterStore, error) {
+	var servers []string
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			servers = append(servers, addr)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("at least one memcached server is required")
+	}
+
+	selector := new(memcache.ServerList)
+	if err := selector.SetServers(servers...); err != nil {
+		return nil, fmt.Errorf("memcached: %w", err)
+	}
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = memcachedTimeout
+	client.MaxIdleConns = 16
+	return &MemcachedCounterStore{client: client}, nil
+}
+
+// Increment adds delta to the counter, creating it with the given ttl if it
+// does not exist yet. Memcached does not extend the expiry on incr.
+func (s *MemcachedCounterStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	if delta < 0 {
+		return 0, fmt.Errorf("memcached: negative delta %d", delta)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		value, err := withContext(ctx, func() (uint64, error) {
+			return s.client.Increment(key, uint64(delta))
+		})
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return int64(value), memcachedError(err)
+		}
+
+		// Counter missing: create it. If another instance wins the race the
+		// add fails and the next incr succeeds.
+		_, err = withContext(ctx, func() (uint64, error) {
+			return 0, s.client.Add(&memcache.Item{
+				Key:        key,
+				Value:      []byte(strconv.FormatInt(delta, 10)),
+				Expiration: int32(math.Ceil(ttl.Seconds())),
+			})
+		})
+		if err == nil {
+			return delta, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, memcachedError(err)
+		}
+	}
+	return 0, fmt.Errorf("memcached: failed to increment %s", key)
+}
+
+// Decrement subtracts delta from the counter. Memcached clamps at zero.
+func (s *MemcachedCounterStore) Decrement(ctx context.Context, key string, delta int64) (int64, error) {
+	if delta < 0 {
+		return 0, fmt.Errorf("memcached: negative delta %d", delta)
+	}
+
+	value, err := withContext(ctx, func() (uint64, error) {
+		return s.client.Decrement(key, uint64(delta))
+	})
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, nil
+	}
+	return int64(value), memcachedError(err)
+}
+
+// Get returns the current counter value, or zero if it does not exist
+func (s *MemcachedCounterStore) Get(ctx context.Context, key string) (int64, error) {
+	var item *memcache.Item
+	_, err := withContext(ctx, func() (uint64, error) {
+		var err error
+		item, err = s.client.Get(key)
+		return 0, err
+	})
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, memcachedError(err)
+	}
+
+	// incr leaves the value padded with spaces when its digits shrink
+	value, err := strconv.ParseInt(strings.TrimSpace(string(item.Value)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("memcached: counter %s is not a number: %w", key, err)
+	}
+	return value, nil
+}
+
+// withContext runs op, returning early with the error of ctx when it is
+// done first. gomemcache takes no context, so an op given up on still runs
+// until memcachedTimeout.
+func withContext(ctx context.Context, op func() (uint64, error)) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ctx.Done() == nil {
+		return op()
+	}
+
+	type result struct {
+		value uint64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := op()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// memcachedError marks errors of gomemcache as memcached's, leaving those
+// of the context as they are
+func memcachedError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("memcached: %w", err)
+}
@@ -0,0 +1,125 @@
+package infrastructure
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// RuleLookup finds the rules of a resource
+type RuleLookup interface {
+	GetByResource(ctx context.Context, resource string) ([]domain.RateLimitRule, error)
+}
+
+// ClientLookup finds a registered client
+type ClientLookup interface {
+	GetByID(ctx context.Context, id string) (*domain.Client, error)
+}
+
+// noTenant labels decisions of clients that are unregistered or have no tier
+const noTenant = "none"
+
+// DecisionMetrics counts rate limit decisions by resource, tenant, algorithm
+// and decision. The tenant of a decision is the tier of its registered
+// client, and its algorithm that of the rule the request was decided by,
+// looked up when the decision is counted.
+type DecisionMetrics struct {
+	rules   RuleLookup
+	clients ClientLookup
+	counts  map[decisionLabels]uint64
+	mutex   sync.Mutex
+}
+
+// decisionLabels are the metric labels a decision is counted under
+type decisionLabels struct {
+	resource  string
+	tenant    string
+	algorithm string
+	decision  string
+}
+
+// NewDecisionMetrics creates decision metrics labelled from rules and
+// clients
+func NewDecisionMetrics(rules RuleLookup, clients ClientLookup) *DecisionMetrics {
+	return &DecisionMetrics{
+		rules:   rules,
+		clients: clients,
+		counts:  make(map[decisionLabels]uint64),
+	}
+}
+
+// RecordDecision counts a decision of a request by clientID to resource
+// with method, which is empty for checks against the rule for any method
+func (m *DecisionMetrics) RecordDecision(ctx context.Context, clientID, resource, method string, allowed bool) {
+	labels := decisionLabels{
+		resource:  resource,
+		tenant:    m.tenant(ctx, clientID),
+		algorithm: m.algorithm(ctx, resource, method),
+		decision:  "allowed",
+	}
+	if !allowed {
+		labels.decision = "blocked"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.counts[labels]++
+}
+
+// Counts returns the decisions counted so far, ordered by labels
+func (m *DecisionMetrics) Counts() []queries.DecisionCount {
+	m.mutex.Lock()
+	counts := make([]queries.DecisionCount, 0, len(m.counts))
+	for labels, count := range m.counts {
+		counts = append(counts, queries.DecisionCount{
+			Resource:  labels.resource,
+			Tenant:    labels.tenant,
+			Algorithm: labels.algorithm,
+			Decision:  labels.decision,
+			Count:     count,
+		})
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Algorithm != b.Algorithm {
+			return a.Algorithm < b.Algorithm
+		}
+		return a.Decision < b.Decision
+	})
+	return counts
+}
+
+// tenant returns the tier of a registered client, or noTenant
+func (m *DecisionMetrics) tenant(ctx context.Context, clientID string) string {
+	client, err := m.clients.GetByID(ctx, clientID)
+	if err != nil || client.Tier == "" {
+		return noTenant
+	}
+	return client.Tier
+}
+
+// algorithm returns the algorithm of the rule a request to resource with
+// method is decided by, or "unknown" when it has none
+func (m *DecisionMetrics) algorithm(ctx context.Context, resource, method string) string {
+	rules, err := m.rules.GetByResource(ctx, resource)
+	if err != nil {
+		return "unknown"
+	}
+	rule, ok := domain.SelectRule(rules, method)
+	if !ok {
+		return "unknown"
+	}
+	return string(rule.Algorithm)
+}
@@ -0,0 +1,199 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// WebhookNotifier implements the rule engine's ActionDispatcher. It writes
+// log and alert actions as JSON lines and delivers alerts to a webhook,
+// suppressing repeats of the same dedupe key within the dedupe window.
+type WebhookNotifier struct {
+	out          io.Writer
+	outMutex     sync.Mutex
+	webhookURL   string // Empty only logs alerts
+	httpClient   *http.Client
+	dedupeWindow time.Duration
+	lastSent     map[string]time.Time
+	sentMutex    sync.Mutex
+	alerts       chan ruleDomain.ActionEvent
+	dropped      uint64
+	done         chan struct{}
+}
+
+// NewWebhookNotifier creates a new notifier. Call Run to deliver alerts.
+func NewWebhookNotifier(out io.Writer, webhookURL string, dedupeWindow time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{
+		out:          out,
+		webhookURL:   webhookURL,
+		httpClient:   &http.Client{Timeout: 5 * time.Second},
+		dedupeWindow: dedupeWindow,
+		lastSent:     make(map[string]time.Time),
+		alerts:       make(chan ruleDomain.ActionEvent, 256),
+		done:         make(chan struct{}),
+	}
+}
+
+// Dispatch writes the event and queues alerts for delivery without blocking
+// the caller. Alerts are dropped and counted when the queue is full.
+func (n *WebhookNotifier) Dispatch(ctx context.Context, event ruleDomain.ActionEvent) error {
+	if err := n.write(event); err != nil {
+		return fmt.Errorf("failed to write %s action: %w", event.Type, err)
+	}
+
+	if event.Type != "alert" || n.webhookURL == "" || n.duplicate(event) {
+		return nil
+	}
+
+	select {
+	case n.alerts <- event:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+	}
+	return nil
+}
+
+// Dropped returns the number of alerts discarded because the queue was full
+func (n *WebhookNotifier) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// Run delivers queued alerts until ctx is cancelled
+func (n *WebhookNotifier) Run(ctx context.Context) {
+	defer close(n.done)
+
+	for {
+		select {
+		case event := <-n.alerts:
+			if err := n.deliver(ctx, event); err != nil {
+				log.Printf("Error delivering alert for rule %s: %v", event.RuleID, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NotifyThresholds dispatches an alert for every soft threshold reached on
+// events until the channel is closed or ctx is cancelled, so integrations
+// can throttle themselves before they are denied
+func (n *WebhookNotifier) NotifyThresholds(ctx context.Context, events <-chan domain.Event) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			reached, ok := event.(*domain.RateLimitThresholdReachedEvent)
+			if !ok {
+				continue
+			}
+			if err := n.Dispatch(ctx, thresholdAlert(reached)); err != nil {
+				log.Printf("Error dispatching soft threshold alert for %s: %v", reached.AggregateID(), err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// thresholdAlert builds the alert for a soft threshold reached by a client
+func thresholdAlert(event *domain.RateLimitThresholdReachedEvent) ruleDomain.ActionEvent {
+	return ruleDomain.ActionEvent{
+		Type:      "alert",
+		RuleID:    "rate-limit-soft-threshold",
+		RuleName:  "Rate Limit Soft Threshold",
+		Severity:  "warning",
+		Message:   fmt.Sprintf("%s reached the soft limit of %s: %d of %d requests used", event.ClientID, event.Resource, event.SoftLimit, event.Limit),
+		DedupeKey: event.ClientID + ":" + event.Resource,
+		ClientID:  event.ClientID,
+		Resource:  event.Resource,
+		IPAddress: event.IPAddress,
+		UserAgent: event.UserAgent,
+		Metadata: map[string]string{
+			"soft_limit":   strconv.Itoa(event.SoftLimit),
+			"window_start": event.WindowStart.Format(time.RFC3339),
+			"window_end":   event.WindowEnd.Format(time.RFC3339),
+		},
+		Time: event.Timestamp(),
+	}
+}
+
+// Done is closed once Run has returned
+func (n *WebhookNotifier) Done() <-chan struct{} {
+	return n.done
+}
+
+// write appends the event to the output as one JSON line
+func (n *WebhookNotifier) write(event ruleDomain.ActionEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	n.outMutex.Lock()
+	defer n.outMutex.Unlock()
+
+	_, err = n.out.Write(append(line, '\n'))
+	return err
+}
+
+// duplicate reports whether an alert with the same dedupe key was sent within
+// the dedupe window, recording this one as sent otherwise
+func (n *WebhookNotifier) duplicate(event ruleDomain.ActionEvent) bool {
+	n.sentMutex.Lock()
+	defer n.sentMutex.Unlock()
+
+	if last, ok := n.lastSent[event.DedupeKey]; ok && event.Time.Sub(last) < n.dedupeWindow {
+		return true
+	}
+	n.lastSent[event.DedupeKey] = event.Time
+
+	// Forget keys whose window has passed so the map stays bounded
+	if len(n.lastSent) > 10000 {
+		for key, last := range n.lastSent {
+			if event.Time.Sub(last) >= n.dedupeWindow {
+				delete(n.lastSent, key)
+			}
+		}
+	}
+	return false
+}
+
+// deliver posts one alert to the webhook
+func (n *WebhookNotifier) deliver(ctx context.Context, event ruleDomain.ActionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// OutboxEntry is a stored event awaiting publication
+type OutboxEntry struct {
+	Sequence uint64
+	Event    domain.Event
+}
+
+// Outbox is the queue of stored events to publish. Event stores write it in
+// the same atomic step as the events, so an event is never stored without
+// being queued.
+type Outbox interface {
+	Pending(ctx context.Context, limit int) ([]OutboxEntry, error)
+	Acknowledge(ctx context.Context, sequence uint64) error
+}
+
+// EventPublisher publishes relayed events, e.g. to the EventBus
+type EventPublisher interface {
+	Publish(event domain.Event)
+}
+
+// outboxQueue holds outbox records in sequence order. Its owner guards it
+// with the lock of the events it is written with.
+type outboxQueue[T any] struct {
+	records []outboxRecord[T]
+	next    uint64
+}
+
+// outboxRecord is a queued event as its store keeps it
+type outboxRecord[T any] struct {
+	sequence uint64
+	event    T
+}
+
+// push queues events
+func (q *outboxQueue[T]) push(events ...T) {
+	for _, event := range events {
+		q.next++
+		q.records = append(q.records, outboxRecord[T]{sequence: q.next, event: event})
+	}
+}
+
+// pending returns up to limit of the oldest records
+func (q *outboxQueue[T]) pending(limit int) []outboxRecord[T] {
+	if limit <= 0 || limit > len(q.records) {
+		limit = len(q.records)
+	}
+	return append([]outboxRecord[T](nil), q.records[:limit]...)
+}
+
+// acknowledge removes the records up to and including sequence
+func (q *outboxQueue[T]) acknowledge(sequence uint64) {
+	i := 0
+	for i < len(q.records) && q.records[i].sequence <= sequence {
+		i++
+	}
+	q.records = q.records[i:]
+}
+
+// remove drops the records of the events matched by match, such as events
+// erased before they were published
+func (q *outboxQueue[T]) remove(match func(event T) bool) {
+	kept := q.records[:0]
+	for _, record := range q.records {
+		if !match(record.event) {
+			kept = append(kept, record)
+		}
+	}
+	q.records = kept
+}
+
+// OutboxRelay publishes outbox entries and acknowledges them once published.
+// Entries published just before a crash are published again on restart, so
+// delivery is at least once.
+type OutboxRelay struct {
+	outbox    Outbox
+	publisher EventPublisher
+	interval  time.Duration
+	batchSize int
+	done      chan struct{}
+}
+
+// NewOutboxRelay creates a relay polling outbox every interval. Call Run to
+// start it.
+func NewOutboxRelay(outbox Outbox, publisher EventPublisher, interval time.Duration, batchSize int) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:    outbox,
+		publisher: publisher,
+		interval:  interval,
+		batchSize: batchSize,
+		done:      make(chan struct{}),
+	}
+}
+
+// Run relays entries until ctx is cancelled, then relays what is left
+func (r *OutboxRelay) Run(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if _, err := r.Relay(context.Background()); err != nil {
+				log.Printf("Error relaying outbox: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if _, err := r.Relay(ctx); err != nil {
+				log.Printf("Error relaying outbox: %v", err)
+			}
+		}
+	}
+}
+
+// Done is closed once Run has returned
+func (r *OutboxRelay) Done() <-chan struct{} {
+	return r.done
+}
+
+// Relay publishes pending entries in batches until the outbox is empty and
+// returns how many were published
+func (r *OutboxRelay) Relay(ctx context.Context) (int, error) {
+	published := 0
+	for {
+		entries, err := r.outbox.Pending(ctx, r.batchSize)
+		if err != nil {
+			return published, fmt.Errorf("failed to read outbox: %w", err)
+		}
+		if len(entries) == 0 {
+			return published, nil
+		}
+
+		for _, entry := range entries {
+			r.publisher.Publish(entry.Event)
+		}
+		if err := r.outbox.Acknowledge(ctx, entries[len(entries)-1].Sequence); err != nil {
+			return published, fmt.Errorf("failed to acknowledge outbox entries: %w", err)
+		}
+		published += len(entries)
+	}
+}
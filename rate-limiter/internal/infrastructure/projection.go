@@ -0,0 +1,195 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// EventStream is the ordered log of every event in an event store
+type EventStream interface {
+	ReadAll(ctx context.Context, from uint64, limit int) ([]domain.Event, error)
+	Head(ctx context.Context) (uint64, error)
+}
+
+// ProjectedReadModel is a read model that a projection applies events to,
+// such as InMemoryReadModel or a CachedReadModel in front of it
+type ProjectedReadModel interface {
+	UpdateFromEvent(ctx context.Context, event interface{}) error
+	UpdateFromEvents(ctx context.Context, events []domain.Event) error
+}
+
+// ReadModelProjection tails an event store into a read model. Live events
+// are applied one at a time; a backlog, such as after a restart, is applied
+// in bulk batches until the projection has caught up.
+type ReadModelProjection struct {
+	stream           EventStream
+	readModel        ProjectedReadModel
+	interval         time.Duration
+	catchUpThreshold uint64
+	catchUpBatchSize int
+	notifications    <-chan domain.Event
+	clock            domain.Clock
+	position         atomic.Uint64
+	catchingUp       atomic.Bool
+	done             chan struct{}
+}
+
+// NewReadModelProjection creates a projection polling stream every
+// interval. Call Run to start it.
+func NewReadModelProjection(stream EventStream, readModel ProjectedReadModel, interval time.Duration) *ReadModelProjection {
+	return &ReadModelProjection{
+		stream:           stream,
+		readModel:        readModel,
+		interval:         interval,
+		catchUpThreshold: 100,
+		catchUpBatchSize: 1000,
+		clock:            domain.SystemClock{},
+		done:             make(chan struct{}),
+	}
+}
+
+// WithCatchUp switches to bulk batches of batchSize events while more than
+// threshold events are pending
+func (p *ReadModelProjection) WithCatchUp(threshold uint64, batchSize int) *ReadModelProjection {
+	p.catchUpThreshold = threshold
+	p.catchUpBatchSize = batchSize
+	return p
+}
+
+// WithNotifications syncs as soon as an event arrives on events instead of
+// waiting for the next poll. The events only wake the projection; it still
+// reads them from the stream.
+func (p *ReadModelProjection) WithNotifications(events <-chan domain.Event) *ReadModelProjection {
+	p.notifications = events
+	return p
+}
+
+// WithClock sets the clock that lag is measured with
+func (p *ReadModelProjection) WithClock(clock domain.Clock) *ReadModelProjection {
+	p.clock = clock
+	return p
+}
+
+// Run catches up with the stream, then keeps the read model in sync until
+// ctx is cancelled
+func (p *ReadModelProjection) Run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error projecting events to read model: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.notifications:
+		}
+	}
+}
+
+// Done is closed once Run has returned
+func (p *ReadModelProjection) Done() <-chan struct{} {
+	return p.done
+}
+
+// Sync applies every pending event and returns how many were applied
+func (p *ReadModelProjection) Sync(ctx context.Context) (int, error) {
+	head, err := p.stream.Head(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event stream head: %w", err)
+	}
+
+	position := p.position.Load()
+	if head <= position {
+		return 0, nil
+	}
+	if head-position > p.catchUpThreshold {
+		return p.catchUp(ctx, head)
+	}
+
+	events, err := p.stream.ReadAll(ctx, position, int(head-position))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event stream: %w", err)
+	}
+	for i, event := range events {
+		if err := p.readModel.UpdateFromEvent(ctx, event); err != nil {
+			// Stop at an event the read model refuses, to retry it later
+			if errors.Is(err, ErrUnknownEvent) {
+				return i, fmt.Errorf("read model stopped at event %s: %w", event.EventID(), err)
+			}
+			log.Printf("Error updating read model from event %s: %v", event.EventID(), err)
+		}
+		p.position.Add(1)
+	}
+	return len(events), nil
+}
+
+// catchUp applies events in bulk batches until head is reached
+func (p *ReadModelProjection) catchUp(ctx context.Context, head uint64) (int, error) {
+	p.catchingUp.Store(true)
+	defer p.catchingUp.Store(false)
+
+	applied := 0
+	for position := p.position.Load(); position < head; position = p.position.Load() {
+		events, err := p.stream.ReadAll(ctx, position, p.catchUpBatchSize)
+		if err != nil {
+			return applied, fmt.Errorf("failed to read event stream: %w", err)
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		if err := p.readModel.UpdateFromEvents(ctx, events); err != nil {
+			if ctx.Err() != nil {
+				return applied, err
+			}
+			if errors.Is(err, ErrUnknownEvent) {
+				return applied, fmt.Errorf("read model stopped at event batch from %d: %w", position, err)
+			}
+			log.Printf("Error updating read model from event batch: %v", err)
+		}
+		p.position.Add(uint64(len(events)))
+		applied += len(events)
+	}
+	return applied, nil
+}
+
+// Lag reports how far the read model is behind the event store
+func (p *ReadModelProjection) Lag(ctx context.Context) (*queries.ProjectionLag, error) {
+	head, err := p.stream.Head(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event stream head: %w", err)
+	}
+
+	position := p.position.Load()
+	lag := &queries.ProjectionLag{
+		Position:   position,
+		Head:       head,
+		CatchingUp: p.catchingUp.Load(),
+	}
+	if head <= position {
+		return lag, nil
+	}
+	lag.Pending = head - position
+
+	oldest, err := p.stream.ReadAll(ctx, position, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event stream: %w", err)
+	}
+	if len(oldest) > 0 {
+		lag.LagSeconds = p.clock.Now().Sub(oldest[0].Timestamp()).Seconds()
+	}
+	return lag, nil
+}
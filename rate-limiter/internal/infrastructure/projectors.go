@@ -0,0 +1,111 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// ErrUnknownEvent is returned by a read model failing fast on an event it
+// has no projector for
+var ErrUnknownEvent = errors.New("unknown event type")
+
+// UnknownEventPolicy decides what a read model does with events it has no
+// projector for, such as events introduced by a newer version of the
+// service during a rolling upgrade
+type UnknownEventPolicy string
+
+const (
+	// SkipUnknownEvents counts the event and leaves the read model unchanged
+	SkipUnknownEvents UnknownEventPolicy = "skip"
+	// FailOnUnknownEvents returns ErrUnknownEvent, so that a projection stops
+	// at the event until a version that knows it takes over
+	FailOnUnknownEvents UnknownEventPolicy = "fail"
+)
+
+// ParseUnknownEventPolicy validates a policy name
+func ParseUnknownEventPolicy(name string) (UnknownEventPolicy, error) {
+	switch policy := UnknownEventPolicy(name); policy {
+	case SkipUnknownEvents, FailOnUnknownEvents:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown unknown-event policy: %s", name)
+	}
+}
+
+// eventProjector projects one type of event into the read model
+type eventProjector struct {
+	key   func(event domain.Event) (clientID, resource string)
+	apply func(r *InMemoryReadModel, shard *readModelShard, event domain.Event) error
+}
+
+// eventProjectors maps the Go types of events to their projectors. An event
+// type is projected once it is added here; until then it is unknown to the
+// read model, which handles it by its UnknownEventPolicy.
+var eventProjectors = map[reflect.Type]eventProjector{
+	reflect.TypeFor[*domain.RateLimitAppliedEvent](): project(
+		func(e *domain.RateLimitAppliedEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromRateLimitApplied),
+	reflect.TypeFor[*domain.RateLimitExceededEvent](): project(
+		func(e *domain.RateLimitExceededEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromRateLimitExceeded),
+	reflect.TypeFor[*domain.RateLimitWindowResetEvent](): project(
+		func(e *domain.RateLimitWindowResetEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromWindowReset),
+	reflect.TypeFor[*domain.RateLimitThresholdReachedEvent](): project(
+		func(e *domain.RateLimitThresholdReachedEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromThresholdReached),
+	reflect.TypeFor[*domain.RateLimitRefundedEvent](): project(
+		func(e *domain.RateLimitRefundedEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromRefunded),
+	reflect.TypeFor[*domain.TokensLeasedEvent](): project(
+		func(e *domain.TokensLeasedEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromTokensLeased),
+	reflect.TypeFor[*domain.LeaseSettledEvent](): project(
+		func(e *domain.LeaseSettledEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromLeaseSettled),
+	reflect.TypeFor[*domain.LeaseExpiredEvent](): project(
+		func(e *domain.LeaseExpiredEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromLeaseExpired),
+	reflect.TypeFor[*domain.RateLimitKeyEvictedEvent](): project(
+		func(e *domain.RateLimitKeyEvictedEvent) (string, string) { return e.ClientID, e.Resource },
+		(*InMemoryReadModel).updateFromKeyEvicted),
+	reflect.TypeFor[*domain.ClientDataErasedEvent](): project(
+		func(e *domain.ClientDataErasedEvent) (string, string) { return e.ClientID, "" },
+		(*InMemoryReadModel).updateFromClientDataErased),
+
+	// Known, but erased events leave nothing to project
+	reflect.TypeFor[*domain.EventErasedEvent](): {},
+}
+
+// project builds the projector of events of type E from the function
+// returning their client and resource and the function applying them
+func project[E domain.Event](key func(E) (string, string), apply func(*InMemoryReadModel, *readModelShard, E) error) eventProjector {
+	return eventProjector{
+		key: func(event domain.Event) (string, string) {
+			return key(event.(E))
+		},
+		apply: func(r *InMemoryReadModel, shard *readModelShard, event domain.Event) error {
+			return apply(r, shard, event.(E))
+		},
+	}
+}
+
+// projectorOf returns the projector of event, or false for unknown events
+func projectorOf(event interface{}) (eventProjector, bool) {
+	if _, ok := event.(domain.Event); !ok {
+		return eventProjector{}, false
+	}
+	projector, ok := eventProjectors[reflect.TypeOf(event)]
+	return projector, ok
+}
+
+// eventTypeName names the type of event in errors and metrics
+func eventTypeName(event interface{}) string {
+	if e, ok := event.(domain.Event); ok && e.EventType() != "" {
+		return e.EventType()
+	}
+	return fmt.Sprintf("%T", event)
+}
@@ -0,0 +1,205 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// CachedReadModel answers status and client stats queries from a short-lived
+// cache in front of an in-memory read model, so dashboards polling the same
+// clients do not each take the read model lock. Applying an event drops the
+// cached answers of its client, so a cached answer only lags in fields that
+// change with time alone, such as the request rate, and by at most the TTL.
+// Keys without recorded decisions are cached as unknown, so polling clients
+// that never made a request does not copy a default status into the cache.
+type CachedReadModel struct {
+	*InMemoryReadModel
+	ttl     time.Duration
+	clock   domain.Clock
+	clients map[string]*clientCache
+	mutex   sync.Mutex
+}
+
+// clientCache holds the cached answers of one client. The generation is
+// bumped by every invalidation, so an answer read before an event was
+// applied is not cached after it.
+type clientCache struct {
+	generation uint64
+	statuses   map[string]cachedStatus // By resource
+	stats      *cachedStats
+}
+
+// cachedStatus is a cached status query answer. Unknown keys are answered
+// with a default status as of the query instead of the cached status.
+type cachedStatus struct {
+	status    queries.RateLimitStatus
+	known     bool
+	expiresAt time.Time
+}
+
+// cachedStats is a cached client stats query answer. Stats are bucketed,
+// so the answer serves every time range widening to the same buckets at the
+// same granularity.
+type cachedStats struct {
+	stats       queries.ClientStats
+	start       time.Time
+	end         time.Time
+	granularity queries.StatsGranularity
+	expiresAt   time.Time
+}
+
+// NewCachedReadModel caches the answers of readModel for ttl. A ttl of zero
+// disables caching.
+func NewCachedReadModel(readModel *InMemoryReadModel, ttl time.Duration) *CachedReadModel {
+	return &CachedReadModel{
+		InMemoryReadModel: readModel,
+		ttl:               ttl,
+		clock:             domain.SystemClock{},
+		clients:           make(map[string]*clientCache),
+	}
+}
+
+// WithClock sets the clock that cached answers expire by
+func (c *CachedReadModel) WithClock(clock domain.Clock) *CachedReadModel {
+	c.clock = clock
+	return c
+}
+
+// GetRateLimitStatus retrieves the current rate limit status, from the cache
+// when it holds a fresh answer
+func (c *CachedReadModel) GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
+	if c.ttl <= 0 {
+		return c.InMemoryReadModel.GetRateLimitStatus(ctx, clientID, resource)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := c.clock.Now()
+	c.mutex.Lock()
+	cache := c.client(clientID)
+	if cached, ok := cache.statuses[resource]; ok && now.Before(cached.expiresAt) {
+		if !cached.known {
+			c.mutex.Unlock()
+			return defaultStatus(clientID, resource, now), nil
+		}
+		status := queries.AcquireStatus()
+		*status = cached.status
+		c.mutex.Unlock()
+		return status, nil
+	}
+	generation := cache.generation
+	c.mutex.Unlock()
+
+	status, known, err := c.InMemoryReadModel.lookupStatus(ctx, clientID, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cache := c.client(clientID); cache.generation == generation {
+		cached := cachedStatus{known: known, expiresAt: c.clock.Now().Add(c.ttl)}
+		if known {
+			cached.status = *status
+		}
+		cache.statuses[resource] = cached
+	}
+	return status, nil
+}
+
+// GetClientStats retrieves client statistics, from the cache when it holds a
+// fresh answer
+func (c *CachedReadModel) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error) {
+	if c.ttl <= 0 {
+		return c.InMemoryReadModel.GetClientStats(ctx, clientID, startTime, endTime, granularity)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start, end := clientStatsRange(startTime, endTime)
+	c.mutex.Lock()
+	cache := c.client(clientID)
+	if cached := cache.stats; cached != nil && c.clock.Now().Before(cached.expiresAt) && cached.start.Equal(start) && cached.end.Equal(end) && cached.granularity == granularity {
+		stats := cached.stats
+		c.mutex.Unlock()
+		if !startTime.IsZero() && !endTime.IsZero() {
+			stats.SetRange(startTime, endTime)
+		}
+		return &stats, nil
+	}
+	generation := cache.generation
+	c.mutex.Unlock()
+
+	stats, err := c.InMemoryReadModel.GetClientStats(ctx, clientID, startTime, endTime, granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cache := c.client(clientID); cache.generation == generation {
+		cache.stats = &cachedStats{stats: *stats, start: start, end: end, granularity: granularity, expiresAt: c.clock.Now().Add(c.ttl)}
+	}
+	return stats, nil
+}
+
+// UpdateFromEvent updates the read model from an event and drops the cached
+// answers of its client
+func (c *CachedReadModel) UpdateFromEvent(ctx context.Context, event interface{}) error {
+	err := c.InMemoryReadModel.UpdateFromEvent(ctx, event)
+	c.invalidate(event)
+	return err
+}
+
+// UpdateFromEvents updates the read model from a batch of events and drops
+// the cached answers of their clients
+func (c *CachedReadModel) UpdateFromEvents(ctx context.Context, events []domain.Event) error {
+	err := c.InMemoryReadModel.UpdateFromEvents(ctx, events)
+	for _, event := range events {
+		c.invalidate(event)
+	}
+	return err
+}
+
+// client returns the cache of a client, creating it if needed. The caller
+// holds the mutex.
+func (c *CachedReadModel) client(clientID string) *clientCache {
+	cache, exists := c.clients[clientID]
+	if !exists {
+		cache = &clientCache{statuses: make(map[string]cachedStatus)}
+		c.clients[clientID] = cache
+	}
+	return cache
+}
+
+// invalidate drops the cached answers of the client an event belongs to
+func (c *CachedReadModel) invalidate(event interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	clientID, ok := eventClientID(event)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Without an entry no query can be about to cache an answer
+	cache, exists := c.clients[clientID]
+	if !exists {
+		return
+	}
+	cache.generation++
+	cache.statuses = make(map[string]cachedStatus)
+	cache.stats = nil
+}
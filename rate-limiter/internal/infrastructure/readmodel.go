@@ -3,6 +3,8 @@ package infrastructure
 import (
 	"context"
 	"fmt"
+	"log"
+	"math"
 	"sync"
 	"time"
 
@@ -10,73 +12,232 @@ import (
 	"github.com/NickChunglolz/rate-limiter/internal/queries"
 )
 
-// InMemoryReadModel implements ReadModel interface for testing/development
+// InMemoryReadModel implements ReadModel interface for testing/development.
+// Clients are sharded so that updates and queries of different clients do
+// not contend for one lock.
 type InMemoryReadModel struct {
+	shards        [shardCount]*readModelShard
+	clock          domain.Clock
+	statsRetention StatsRetention
+	unknownPolicy  UnknownEventPolicy
+	unknownEvents map[string]uint64 // Skipped unknown events by type
+	unknownMutex  sync.Mutex
+}
+
+// readModelShard holds the read model of the clients hashed to it
+type readModelShard struct {
 	statuses map[string]*queries.RateLimitStatus
 	history  map[string][]queries.RateLimitEvent
-	stats    map[string]*queries.ClientStats
+	stats    map[string]*clientStats
+	activity map[string]*queries.ClientActivity
+	rates    map[string]*requestRate
 	mutex    sync.RWMutex
 }
 
+// requestRateSmoothing is the weight of the newest interval between requests
+// in a request rate
+const requestRateSmoothing = 0.3
+
+// requestRate tracks the recent request rate of a client on a resource as
+// an exponentially weighted moving average of the intervals between requests
+type requestRate struct {
+	last     time.Time
+	interval float64 // Seconds; 0 until two requests have been seen
+}
+
+// observe records a request at at
+func (rate *requestRate) observe(at time.Time) {
+	if !rate.last.IsZero() && at.After(rate.last) {
+		interval := at.Sub(rate.last).Seconds()
+		if rate.interval == 0 {
+			rate.interval = interval
+		} else {
+			rate.interval = requestRateSmoothing*interval + (1-requestRateSmoothing)*rate.interval
+		}
+	}
+	if at.After(rate.last) {
+		rate.last = at
+	}
+}
+
+// forecast sets the request rate of status and, when the remaining quota
+// runs out at that rate before the window resets, when it does
+func (rate *requestRate) forecast(status *queries.RateLimitStatus, now time.Time) {
+	if rate.interval == 0 {
+		return
+	}
+	
+	// A client that has been idle for longer than its interval is slowing down
+	interval := math.Max(rate.interval, now.Sub(rate.last).Seconds())
+	status.RequestRate = 1 / interval
+	if !status.IsAllowed || status.RemainingQuota <= 0 {
+		return
+	}
+	
+	exhaustsAt := now.Add(time.Duration(float64(status.RemainingQuota) * interval * float64(time.Second)))
+	if exhaustsAt.Before(status.ResetTime) {
+		status.ExhaustsAt = &exhaustsAt
+	}
+}
+
+// maxFingerprintValues caps the distinct IP addresses and user agents kept
+// per client
+const maxFingerprintValues = 10
+
 // NewInMemoryReadModel creates a new in-memory read model
 func NewInMemoryReadModel() *InMemoryReadModel {
-	return &InMemoryReadModel{
-		statuses: make(map[string]*queries.RateLimitStatus),
-		history:  make(map[string][]queries.RateLimitEvent),
-		stats:    make(map[string]*queries.ClientStats),
+	r := &InMemoryReadModel{
+		clock:          domain.SystemClock{},
+		statsRetention: StatsRetention{Minutes: 24 * time.Hour, Hours: 30 * 24 * time.Hour, Days: 365 * 24 * time.Hour},
+		unknownPolicy:  SkipUnknownEvents,
+		unknownEvents:  make(map[string]uint64),
 	}
+	for i := range r.shards {
+		r.shards[i] = &readModelShard{
+			statuses: make(map[string]*queries.RateLimitStatus),
+			history:  make(map[string][]queries.RateLimitEvent),
+			stats:    make(map[string]*clientStats),
+			activity: make(map[string]*queries.ClientActivity),
+			rates:    make(map[string]*requestRate),
+		}
+	}
+	return r
+}
+
+// WithClock sets the clock that statuses and statistics are timed with
+func (r *InMemoryReadModel) WithClock(clock domain.Clock) *InMemoryReadModel {
+	r.clock = clock
+	return r
+}
+
+// WithStatsRetention sets how long client stats are kept by the minute, by
+// the hour and by the day. By default minutes are kept for a day, hours for
+// 30 days and days for a year.
+func (r *InMemoryReadModel) WithStatsRetention(retention StatsRetention) *InMemoryReadModel {
+	r.statsRetention = retention
+	return r
+}
+
+// WithUnknownEventPolicy sets what happens to events the read model has no
+// projector for. By default they are skipped and counted.
+func (r *InMemoryReadModel) WithUnknownEventPolicy(policy UnknownEventPolicy) *InMemoryReadModel {
+	r.unknownPolicy = policy
+	return r
+}
+
+// UnknownEvents returns the number of unknown events skipped, by event type
+func (r *InMemoryReadModel) UnknownEvents() map[string]uint64 {
+	r.unknownMutex.Lock()
+	defer r.unknownMutex.Unlock()
+	
+	counts := make(map[string]uint64, len(r.unknownEvents))
+	for eventType, count := range r.unknownEvents {
+		counts[eventType] = count
+	}
+	return counts
+}
+
+// unknownEvent handles an event without a projector by the unknown event
+// policy, returning an error when failing fast
+func (r *InMemoryReadModel) unknownEvent(event interface{}) error {
+	eventType := eventTypeName(event)
+	if r.unknownPolicy == FailOnUnknownEvents {
+		return fmt.Errorf("%w: %s", ErrUnknownEvent, eventType)
+	}
+	
+	r.unknownMutex.Lock()
+	r.unknownEvents[eventType]++
+	first := r.unknownEvents[eventType] == 1
+	r.unknownMutex.Unlock()
+	
+	if first {
+		log.Printf("Skipping events of unknown type %s in the read model", eventType)
+	}
+	return nil
+}
+
+// shard returns the shard holding clientID
+func (r *InMemoryReadModel) shard(clientID string) *readModelShard {
+	return r.shards[shardOf(clientID)]
 }
 
 // GetRateLimitStatus retrieves current rate limit status
 func (r *InMemoryReadModel) GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+	status, _, err := r.lookupStatus(ctx, clientID, resource)
+	return status, err
+}
+
+// lookupStatus retrieves the current rate limit status, reporting whether
+// the read model knows the client's key. Statuses are taken from the status
+// pool, and unknown keys are answered with the default status.
+func (r *InMemoryReadModel) lookupStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	
+	shard := r.shard(clientID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 	
 	key := clientID + ":" + resource
-	status, exists := r.statuses[key]
+	status, exists := shard.statuses[key]
 	if !exists {
-		// Return default status
-		return &queries.RateLimitStatus{
-			ClientID:       clientID,
-			Resource:       resource,
-			IsAllowed:      true,
-			RequestCount:   0,
-			Limit:          0,
-			RemainingQuota: 0,
-			WindowStart:    time.Now(),
-			WindowEnd:      time.Now().Add(time.Hour),
-			ResetTime:      time.Now().Add(time.Hour),
-			IsBlocked:      false,
-		}, nil
+		return defaultStatus(clientID, resource, r.clock.Now()), false, nil
 	}
 	
-	// Deep copy to avoid race conditions
-	result := *status
-	return &result, nil
+	// Copy to avoid race conditions
+	result := queries.AcquireStatus()
+	*result = *status
+	if rate, exists := shard.rates[key]; exists {
+		rate.forecast(result, r.clock.Now())
+	}
+	return result, true, nil
 }
 
-// GetRateLimitHistory retrieves rate limit history
-func (r *InMemoryReadModel) GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int) (*queries.RateLimitHistory, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+// defaultStatus returns the status of a key without recorded decisions,
+// taken from the status pool
+func defaultStatus(clientID, resource string, now time.Time) *queries.RateLimitStatus {
+	status := queries.AcquireStatus()
+	status.ClientID = clientID
+	status.Resource = resource
+	status.IsAllowed = true
+	status.WindowStart = now
+	status.WindowEnd = now.Add(time.Hour)
+	status.ResetTime = now.Add(time.Hour)
+	return status
+}
+
+// GetRateLimitHistory retrieves the rate limit history selected by filter,
+// after the cursor when after is set
+func (r *InMemoryReadModel) GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor, filter queries.HistoryFilter) (*queries.RateLimitHistory, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	shard := r.shard(clientID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 	
 	key := clientID + ":" + resource
-	allEvents := r.history[key]
+	allEvents := shard.history[key]
 	
-	// Filter by time range
+	// Filter by time range and filter
 	var filteredEvents []queries.RateLimitEvent
 	for _, event := range allEvents {
-		if event.Timestamp.After(startTime) && event.Timestamp.Before(endTime) {
+		if event.Timestamp.After(startTime) && event.Timestamp.Before(endTime) && filter.Matches(event) {
 			filteredEvents = append(filteredEvents, event)
 		}
 	}
 	
-	// Apply pagination
+	// Events before the cursor count towards the total but are not paged
 	totalCount := len(filteredEvents)
+	filteredEvents = eventsAfter(filteredEvents, after)
+	
+	// Apply pagination
 	start := offset
 	end := offset + limit
 	
-	if start >= totalCount {
+	if start >= len(filteredEvents) {
 		return &queries.RateLimitHistory{
 			Events:     make([]queries.RateLimitEvent, 0),
 			TotalCount: totalCount,
@@ -84,78 +245,190 @@ func (r *InMemoryReadModel) GetRateLimitHistory(ctx context.Context, clientID, r
 		}, nil
 	}
 	
-	if end > totalCount {
-		end = totalCount
+	if end > len(filteredEvents) {
+		end = len(filteredEvents)
 	}
 	
 	pagedEvents := filteredEvents[start:end]
-	hasMore := end < totalCount
-	
-	return &queries.RateLimitHistory{
+	history := &queries.RateLimitHistory{
 		Events:     pagedEvents,
 		TotalCount: totalCount,
-		HasMore:    hasMore,
-	}, nil
+		HasMore:    end < len(filteredEvents),
+	}
+	if history.HasMore && len(pagedEvents) > 0 {
+		history.NextCursor = queries.NewHistoryCursor(pagedEvents[len(pagedEvents)-1]).String()
+	}
+	return history, nil
 }
 
-// GetClientStats retrieves client statistics
-func (r *InMemoryReadModel) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time) (*queries.ClientStats, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+// eventsAfter returns the events following the cursor. History is kept in
+// the order events were recorded, which is not strictly by time, so the
+// cursor's event is looked up first and the time order is only used once it
+// has been trimmed from the history.
+func eventsAfter(events []queries.RateLimitEvent, after *queries.HistoryCursor) []queries.RateLimitEvent {
+	if after == nil {
+		return events
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].EventID == after.EventID {
+			return events[i+1:]
+		}
+	}
 	
-	stats, exists := r.stats[clientID]
+	remaining := make([]queries.RateLimitEvent, 0, len(events))
+	for _, event := range events {
+		if after.Precedes(event) {
+			remaining = append(remaining, event)
+		}
+	}
+	return remaining
+}
+
+// GetClientStats retrieves client statistics with a time series of
+// granularity
+func (r *InMemoryReadModel) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	shard := r.shard(clientID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	
+	stats, exists := shard.stats[clientID]
 	if !exists {
-		// Return default stats
-		return &queries.ClientStats{
-			ClientID:        clientID,
-			TotalRequests:   0,
-			BlockedRequests: 0,
-			AllowedRequests: 0,
-			ResourceStats:   make([]queries.ResourceStats, 0),
-			TimeSeriesData:  make([]queries.TimeSeriesDataPoint, 0),
-		}, nil
+		result := emptyClientStats(clientID)
+		result.Granularity = granularity
+		result.SetRange(startTime, endTime)
+		return result, nil
+	}
+	
+	return stats.aggregate(clientID, startTime, endTime, granularity), nil
+}
+
+// RollUpStats rolls the client stats past their retention at now up into
+// coarser buckets, and drops those past the last retention, including the
+// stats of clients that made no decision since. It returns the number of
+// buckets rolled up and dropped.
+func (r *InMemoryReadModel) RollUpStats(ctx context.Context, now time.Time) (rolledUp, dropped int, err error) {
+	for _, shard := range r.shards {
+		if err := ctx.Err(); err != nil {
+			return rolledUp, dropped, err
+		}
+		
+		shard.mutex.Lock()
+		for clientID, stats := range shard.stats {
+			up, gone := stats.rollUp(now, r.statsRetention)
+			rolledUp += up
+			dropped += gone
+			if stats.empty() {
+				delete(shard.stats, clientID)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return rolledUp, dropped, nil
+}
+
+// GetClientActivity retrieves the traffic observed from every client, by
+// client ID
+func (r *InMemoryReadModel) GetClientActivity(ctx context.Context) (map[string]queries.ClientActivity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	result := make(map[string]queries.ClientActivity)
+	for _, shard := range r.shards {
+		shard.mutex.RLock()
+		for clientID, activity := range shard.activity {
+			observed := *activity
+			observed.IPAddresses = append([]string(nil), activity.IPAddresses...)
+			observed.UserAgents = append([]string(nil), activity.UserAgents...)
+			result[clientID] = observed
+		}
+		shard.mutex.RUnlock()
 	}
 	
-	// Deep copy to avoid race conditions
-	result := *stats
-	return &result, nil
+	return result, nil
 }
 
 // UpdateFromEvent updates the read model from domain events
 func (r *InMemoryReadModel) UpdateFromEvent(ctx context.Context, event interface{}) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	projector, ok := projectorOf(event)
+	if !ok {
+		return r.unknownEvent(event)
+	}
+	if projector.apply == nil {
+		return nil
+	}
+	
+	clientID, _ := projector.key(event.(domain.Event))
+	shard := r.shard(clientID)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	
+	return projector.apply(r, shard, event.(domain.Event))
+}
+
+// UpdateFromEvents applies a batch of events, taking each shard's lock once
+// per batch, skipping events that fail and returning the first failure.
+// Events of one client are applied in the order of the batch. When failing
+// fast on unknown events, a batch holding one is not applied at all.
+func (r *InMemoryReadModel) UpdateFromEvents(ctx context.Context, events []domain.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	type projected struct {
+		event     domain.Event
+		projector eventProjector
+	}
+	
+	var batches [shardCount][]projected
+	for _, event := range events {
+		projector, ok := projectorOf(event)
+		if !ok {
+			if err := r.unknownEvent(event); err != nil {
+				return err
+			}
+			continue
+		}
+		if projector.apply == nil {
+			continue
+		}
+		clientID, _ := projector.key(event)
+		i := shardOf(clientID)
+		batches[i] = append(batches[i], projected{event: event, projector: projector})
+	}
 	
-	switch e := event.(type) {
-	case *domain.RateLimitAppliedEvent:
-		return r.updateFromRateLimitApplied(e)
-	case *domain.RateLimitExceededEvent:
-		return r.updateFromRateLimitExceeded(e)
-	case *domain.RateLimitWindowResetEvent:
-		return r.updateFromWindowReset(e)
-	default:
-		return fmt.Errorf("unknown event type: %T", event)
+	var firstErr error
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		shard := r.shards[i]
+		shard.mutex.Lock()
+		for _, p := range batch {
+			if err := p.projector.apply(r, shard, p.event); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		shard.mutex.Unlock()
 	}
+	return firstErr
 }
 
 // updateFromRateLimitApplied updates read model from RateLimitAppliedEvent
-func (r *InMemoryReadModel) updateFromRateLimitApplied(event *domain.RateLimitAppliedEvent) error {
+func (r *InMemoryReadModel) updateFromRateLimitApplied(shard *readModelShard, event *domain.RateLimitAppliedEvent) error {
 	key := event.ClientID + ":" + event.Resource
 	
 	// Update status
-	status := &queries.RateLimitStatus{
-		ClientID:       event.ClientID,
-		Resource:       event.Resource,
-		IsAllowed:      true,
-		RequestCount:   event.RequestCount,
-		Limit:          event.Limit,
-		RemainingQuota: event.RemainingQuota,
-		WindowStart:    event.WindowStart,
-		WindowEnd:      event.WindowEnd,
-		ResetTime:      event.WindowEnd,
-		IsBlocked:      false,
-	}
-	r.statuses[key] = status
+	status := queries.StatusFromEvent(event, r.clock.Now())
+	shard.statuses[key] = status
 	
 	// Add to history
 	historyEvent := queries.RateLimitEvent{
@@ -167,41 +440,27 @@ func (r *InMemoryReadModel) updateFromRateLimitApplied(event *domain.RateLimitAp
 		RequestCount: event.RequestCount,
 		Limit:        event.Limit,
 		IsBlocked:    false,
+		IPAddress:    event.IPAddress,
+		UserAgent:    event.UserAgent,
 	}
-	r.history[key] = append(r.history[key], historyEvent)
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	shard.observeRequest(key, event.Timestamp())
 	
 	// Update client stats
-	r.updateClientStats(event.ClientID, event.Resource, true)
+	shard.updateClientStats(event.ClientID, event.Resource, true, event.Timestamp(), r.statsRetention)
+	shard.observeClient(event.ClientID, event.IPAddress, event.UserAgent, event.Timestamp())
 	
 	return nil
 }
 
 // updateFromRateLimitExceeded updates read model from RateLimitExceededEvent
-func (r *InMemoryReadModel) updateFromRateLimitExceeded(event *domain.RateLimitExceededEvent) error {
+func (r *InMemoryReadModel) updateFromRateLimitExceeded(shard *readModelShard, event *domain.RateLimitExceededEvent) error {
 	key := event.ClientID + ":" + event.Resource
 	
-	// Calculate retry after in seconds
-	retryAfter := int(time.Until(event.BlockedUntil).Seconds())
-	if retryAfter < 0 {
-		retryAfter = 0
-	}
-	
 	// Update status
-	status := &queries.RateLimitStatus{
-		ClientID:       event.ClientID,
-		Resource:       event.Resource,
-		IsAllowed:      false,
-		RequestCount:   event.RequestCount,
-		Limit:          event.Limit,
-		RemainingQuota: 0,
-		WindowStart:    event.WindowStart,
-		WindowEnd:      event.WindowEnd,
-		ResetTime:      event.WindowEnd,
-		IsBlocked:      true,
-		BlockedUntil:   event.BlockedUntil,
-		RetryAfter:     retryAfter,
-	}
-	r.statuses[key] = status
+	status := queries.StatusFromEvent(event, r.clock.Now())
+	shard.statuses[key] = status
 	
 	// Add to history
 	historyEvent := queries.RateLimitEvent{
@@ -213,27 +472,33 @@ func (r *InMemoryReadModel) updateFromRateLimitExceeded(event *domain.RateLimitE
 		RequestCount: event.RequestCount,
 		Limit:        event.Limit,
 		IsBlocked:    true,
+		IPAddress:    event.IPAddress,
+		UserAgent:    event.UserAgent,
 	}
-	r.history[key] = append(r.history[key], historyEvent)
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	shard.observeRequest(key, event.Timestamp())
 	
 	// Update client stats
-	r.updateClientStats(event.ClientID, event.Resource, false)
+	shard.updateClientStats(event.ClientID, event.Resource, false, event.Timestamp(), r.statsRetention)
+	shard.observeClient(event.ClientID, event.IPAddress, event.UserAgent, event.Timestamp())
 	
 	return nil
 }
 
 // updateFromWindowReset updates read model from RateLimitWindowResetEvent
-func (r *InMemoryReadModel) updateFromWindowReset(event *domain.RateLimitWindowResetEvent) error {
+func (r *InMemoryReadModel) updateFromWindowReset(shard *readModelShard, event *domain.RateLimitWindowResetEvent) error {
 	key := event.ClientID + ":" + event.Resource
 	
 	// Reset status
-	if status, exists := r.statuses[key]; exists {
+	if status, exists := shard.statuses[key]; exists {
 		status.RequestCount = 0
 		status.RemainingQuota = status.Limit
 		status.WindowStart = event.WindowStart
 		status.IsBlocked = false
 		status.BlockedUntil = time.Time{}
 		status.RetryAfter = 0
+		status.Warning = ""
 	}
 	
 	// Add to history
@@ -245,89 +510,241 @@ func (r *InMemoryReadModel) updateFromWindowReset(event *domain.RateLimitWindowR
 		Timestamp: event.Timestamp(),
 		IsBlocked: false,
 	}
-	r.history[key] = append(r.history[key], historyEvent)
+	shard.history[key] = append(shard.history[key], historyEvent)
 	
 	return nil
 }
 
-// updateClientStats updates client statistics
-func (r *InMemoryReadModel) updateClientStats(clientID, resource string, allowed bool) {
-	stats, exists := r.stats[clientID]
-	if !exists {
-		stats = &queries.ClientStats{
-			ClientID:        clientID,
-			TotalRequests:   0,
-			BlockedRequests: 0,
-			AllowedRequests: 0,
-			ResourceStats:   make([]queries.ResourceStats, 0),
-			TimeSeriesData:  make([]queries.TimeSeriesDataPoint, 0),
-		}
-		r.stats[clientID] = stats
+// updateFromThresholdReached records RateLimitThresholdReachedEvent in the
+// history. The status already carries the warning of the applied event.
+func (r *InMemoryReadModel) updateFromThresholdReached(shard *readModelShard, event *domain.RateLimitThresholdReachedEvent) error {
+	key := event.ClientID + ":" + event.Resource
+	
+	historyEvent := queries.RateLimitEvent{
+		EventID:      event.EventID(),
+		EventType:    event.EventType(),
+		ClientID:     event.ClientID,
+		Resource:     event.Resource,
+		Timestamp:    event.Timestamp(),
+		RequestCount: event.RequestCount,
+		Limit:        event.Limit,
+		IsBlocked:    false,
+		IPAddress:    event.IPAddress,
+		UserAgent:    event.UserAgent,
 	}
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	return nil
+}
+
+// updateFromRefunded updates read model from RateLimitRefundedEvent. A
+// refund lifts a denial in effect, since the quota it gives back allows the
+// next request.
+func (r *InMemoryReadModel) updateFromRefunded(shard *readModelShard, event *domain.RateLimitRefundedEvent) error {
+	key := event.ClientID + ":" + event.Resource
 	
-	// Update total stats
-	stats.TotalRequests++
-	if allowed {
-		stats.AllowedRequests++
-	} else {
-		stats.BlockedRequests++
+	if status, exists := shard.statuses[key]; exists {
+		status.RequestCount = event.RequestCount
+		status.RemainingQuota = event.RemainingQuota
+		status.IsBlocked = false
+		status.BlockedUntil = time.Time{}
+		status.RetryAfter = 0
 	}
 	
-	// Update resource-specific stats
-	var resourceStats *queries.ResourceStats
-	for i := range stats.ResourceStats {
-		if stats.ResourceStats[i].Resource == resource {
-			resourceStats = &stats.ResourceStats[i]
-			break
-		}
+	historyEvent := queries.RateLimitEvent{
+		EventID:      event.EventID(),
+		EventType:    event.EventType(),
+		ClientID:     event.ClientID,
+		Resource:     event.Resource,
+		Timestamp:    event.Timestamp(),
+		RequestCount: event.RequestCount,
+		Limit:        event.Limit,
+		IsBlocked:    false,
 	}
+	shard.history[key] = append(shard.history[key], historyEvent)
 	
-	if resourceStats == nil {
-		stats.ResourceStats = append(stats.ResourceStats, queries.ResourceStats{
-			Resource:        resource,
-			TotalRequests:   0,
-			BlockedRequests: 0,
-			AllowedRequests: 0,
-		})
-		resourceStats = &stats.ResourceStats[len(stats.ResourceStats)-1]
+	return nil
+}
+
+// updateFromTokensLeased updates read model from TokensLeasedEvent. The
+// leased tokens are not requests, so client statistics are left as they are.
+func (r *InMemoryReadModel) updateFromTokensLeased(shard *readModelShard, event *domain.TokensLeasedEvent) error {
+	key := event.ClientID + ":" + event.Resource
+	
+	status := queries.StatusFromEvent(event, r.clock.Now())
+	shard.statuses[key] = status
+	
+	historyEvent := queries.RateLimitEvent{
+		EventID:      event.EventID(),
+		EventType:    event.EventType(),
+		ClientID:     event.ClientID,
+		Resource:     event.Resource,
+		Timestamp:    event.Timestamp(),
+		RequestCount: event.RequestCount,
+		Limit:        event.Limit,
+		IsBlocked:    false,
 	}
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	return nil
+}
+
+// updateFromLeaseSettled updates read model from LeaseSettledEvent. Like a
+// refund, giving back unused tokens lifts a denial in effect.
+func (r *InMemoryReadModel) updateFromLeaseSettled(shard *readModelShard, event *domain.LeaseSettledEvent) error {
+	key := event.ClientID + ":" + event.Resource
 	
-	resourceStats.TotalRequests++
-	if allowed {
-		resourceStats.AllowedRequests++
-	} else {
-		resourceStats.BlockedRequests++
+	if status, exists := shard.statuses[key]; exists {
+		status.RequestCount = event.RequestCount
+		status.RemainingQuota = event.RemainingQuota
+		if event.Returned > 0 {
+			status.IsBlocked = false
+			status.BlockedUntil = time.Time{}
+			status.RetryAfter = 0
+		}
 	}
 	
-	// Calculate blocked rate
-	if resourceStats.TotalRequests > 0 {
-		resourceStats.BlockedRate = float64(resourceStats.BlockedRequests) / float64(resourceStats.TotalRequests)
+	historyEvent := queries.RateLimitEvent{
+		EventID:      event.EventID(),
+		EventType:    event.EventType(),
+		ClientID:     event.ClientID,
+		Resource:     event.Resource,
+		Timestamp:    event.Timestamp(),
+		RequestCount: event.RequestCount,
+		Limit:        event.Limit,
+		IsBlocked:    false,
+	}
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	return nil
+}
+
+// updateFromLeaseExpired records LeaseExpiredEvent in the history. The
+// expired tokens stay counted, so the status is unchanged.
+func (r *InMemoryReadModel) updateFromLeaseExpired(shard *readModelShard, event *domain.LeaseExpiredEvent) error {
+	key := event.ClientID + ":" + event.Resource
+	
+	historyEvent := queries.RateLimitEvent{
+		EventID:   event.EventID(),
+		EventType: event.EventType(),
+		ClientID:  event.ClientID,
+		Resource:  event.Resource,
+		Timestamp: event.Timestamp(),
+		IsBlocked: false,
 	}
+	shard.history[key] = append(shard.history[key], historyEvent)
+	
+	return nil
+}
+
+// updateFromKeyEvicted drops the status, history and request rate of an
+// evicted key. The client's statistics and activity are kept.
+func (r *InMemoryReadModel) updateFromKeyEvicted(shard *readModelShard, event *domain.RateLimitKeyEvictedEvent) error {
+	key := event.ClientID + ":" + event.Resource
 	
-	// Update time series data (simplified - could be more sophisticated)
-	now := time.Now().Truncate(time.Minute) // Group by minute
-	var dataPoint *queries.TimeSeriesDataPoint
-	for i := range stats.TimeSeriesData {
-		if stats.TimeSeriesData[i].Timestamp.Equal(now) {
-			dataPoint = &stats.TimeSeriesData[i]
-			break
+	delete(shard.statuses, key)
+	delete(shard.history, key)
+	delete(shard.rates, key)
+	
+	return nil
+}
+
+// updateFromClientDataErased drops everything held of a client whose data
+// was erased: the statuses, history and request rates of its keys, its
+// statistics and its activity
+func (r *InMemoryReadModel) updateFromClientDataErased(shard *readModelShard, event *domain.ClientDataErasedEvent) error {
+	// Keys are matched by client rather than by prefix, as client IDs may
+	// contain colons
+	for key, status := range shard.statuses {
+		if status.ClientID == event.ClientID {
+			delete(shard.statuses, key)
+			delete(shard.rates, key)
+		}
+	}
+	for key, history := range shard.history {
+		if len(history) > 0 && history[0].ClientID == event.ClientID {
+			delete(shard.history, key)
+			delete(shard.rates, key)
 		}
 	}
+	delete(shard.stats, event.ClientID)
+	delete(shard.activity, event.ClientID)
 	
-	if dataPoint == nil {
-		stats.TimeSeriesData = append(stats.TimeSeriesData, queries.TimeSeriesDataPoint{
-			Timestamp:       now,
-			TotalRequests:   0,
-			BlockedRequests: 0,
-			AllowedRequests: 0,
-		})
-		dataPoint = &stats.TimeSeriesData[len(stats.TimeSeriesData)-1]
+	return nil
+}
+
+// observeRequest updates the request rate of a client on a resource
+func (s *readModelShard) observeRequest(key string, at time.Time) {
+	rate, exists := s.rates[key]
+	if !exists {
+		rate = &requestRate{}
+		s.rates[key] = rate
+	}
+	rate.observe(at)
+}
+
+// observeClient records a request from a client, discovering it on its first
+// request
+func (s *readModelShard) observeClient(clientID, ipAddress, userAgent string, at time.Time) {
+	activity, exists := s.activity[clientID]
+	if !exists {
+		activity = &queries.ClientActivity{FirstSeen: at}
+		s.activity[clientID] = activity
 	}
 	
-	dataPoint.TotalRequests++
-	if allowed {
-		dataPoint.AllowedRequests++
-	} else {
-		dataPoint.BlockedRequests++
+	// Events can be applied out of order while catching up
+	if at.Before(activity.FirstSeen) {
+		activity.FirstSeen = at
+	}
+	if at.After(activity.LastSeen) {
+		activity.LastSeen = at
+	}
+	activity.TotalRequests++
+	activity.IPAddresses = appendFingerprint(activity.IPAddresses, ipAddress)
+	activity.UserAgents = appendFingerprint(activity.UserAgents, userAgent)
+}
+
+// appendFingerprint adds value to a client's distinct values until the cap
+// is reached
+func appendFingerprint(values []string, value string) []string {
+	if value == "" || len(values) >= maxFingerprintValues {
+		return values
+	}
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// updateClientStats counts a decision on a client, at the time it was made,
+// in its stats
+func (s *readModelShard) updateClientStats(clientID, resource string, allowed bool, at time.Time, retention StatsRetention) {
+	stats, exists := s.stats[clientID]
+	if !exists {
+		stats = &clientStats{}
+		s.stats[clientID] = stats
+	}
+	stats.record(resource, allowed, at, retention)
+}
+
+// ReadModelPublisher implements EventPublisher interface by applying events
+// to a read model synchronously, for single-process deployments
+type ReadModelPublisher struct {
+	readModel *InMemoryReadModel
+}
+
+// NewReadModelPublisher creates a new synchronous read model publisher
+func NewReadModelPublisher(readModel *InMemoryReadModel) *ReadModelPublisher {
+	return &ReadModelPublisher{
+		readModel: readModel,
+	}
+}
+
+// Publish applies the event to the read model
+func (p *ReadModelPublisher) Publish(event domain.Event) {
+	if err := p.readModel.UpdateFromEvent(context.Background(), event); err != nil {
+		log.Printf("Error updating read model from event: %v", err)
 	}
 }
@@ -0,0 +1,178 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// DecisionCounter reports the decisions counted so far
+type DecisionCounter interface {
+	Counts() []queries.DecisionCount
+}
+
+// RemoteWriteExporter pushes decision counters to a Prometheus remote-write
+// endpoint, such as Prometheus, VictoriaMetrics, Mimir or Thanos, on an
+// interval. The counters are cumulative, so a failed push loses no
+// decisions; the next one carries them.
+type RemoteWriteExporter struct {
+	url         string
+	interval    time.Duration
+	counts      DecisionCounter
+	labels      map[string]string
+	username    string
+	password    string
+	bearerToken string
+	client      *http.Client
+}
+
+// NewRemoteWriteExporter creates an exporter pushing the counts to url.
+// Call Run to start it.
+func NewRemoteWriteExporter(url string, interval time.Duration, counts DecisionCounter) *RemoteWriteExporter {
+	return &RemoteWriteExporter{
+		url:      url,
+		interval: interval,
+		counts:   counts,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WithLabels adds labels to every series, e.g. the instance pushing them
+func (e *RemoteWriteExporter) WithLabels(labels map[string]string) *RemoteWriteExporter {
+	e.labels = labels
+	return e
+}
+
+// WithBasicAuth authenticates pushes with a username and password
+func (e *RemoteWriteExporter) WithBasicAuth(username, password string) *RemoteWriteExporter {
+	e.username, e.password = username, password
+	return e
+}
+
+// WithBearerToken authenticates pushes with a bearer token
+func (e *RemoteWriteExporter) WithBearerToken(token string) *RemoteWriteExporter {
+	e.bearerToken = token
+	return e
+}
+
+// Run pushes the counters every interval until ctx is cancelled, then
+// pushes them once more
+func (e *RemoteWriteExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.Push(ctx); err != nil {
+				log.Printf("Error pushing decision metrics to remote write: %v", err)
+			}
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := e.Push(shutdownCtx); err != nil {
+				log.Printf("Error pushing decision metrics to remote write: %v", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Push sends the current counters as one remote-write request
+func (e *RemoteWriteExporter) Push(ctx context.Context) error {
+	counts := e.counts.Counts()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	body := s2.EncodeSnappy(nil, e.writeRequest(counts, time.Now()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "rate-limiter")
+	switch {
+	case e.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+e.bearerToken)
+	case e.username != "":
+		req.SetBasicAuth(e.username, e.password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("remote write returned %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// remoteWriteLabel is a label of a series
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// writeRequest encodes the counts as a remote-write WriteRequest protobuf
+// message, with one sample at now per series
+func (e *RemoteWriteExporter) writeRequest(counts []queries.DecisionCount, now time.Time) []byte {
+	timestamp := now.UnixMilli()
+
+	var request []byte
+	for _, count := range counts {
+		labels := []remoteWriteLabel{
+			{"__name__", "rate_limiter_decisions_total"},
+			{"resource", count.Resource},
+			{"tenant", count.Tenant},
+			{"algorithm", count.Algorithm},
+			{"decision", count.Decision},
+		}
+		for name, value := range e.labels {
+			labels = append(labels, remoteWriteLabel{name, value})
+		}
+		// Receivers expect labels sorted by name
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		var series []byte
+		for _, label := range labels {
+			var encoded []byte
+			encoded = protowire.AppendTag(encoded, 1, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.name)
+			encoded = protowire.AppendTag(encoded, 2, protowire.BytesType)
+			encoded = protowire.AppendString(encoded, label.value)
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, encoded)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(float64(count.Count)))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
@@ -0,0 +1,266 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// ReadQuery is a type of read model query, routed to the primary read model
+// or to its replicas by type
+type ReadQuery string
+
+const (
+	StatusReadQuery   ReadQuery = "status" // Gates decisions, so always answered by the primary
+	HistoryReadQuery  ReadQuery = "history"
+	StatsReadQuery    ReadQuery = "stats"
+	ActivityReadQuery ReadQuery = "activity"
+)
+
+// readQueries are the query types in the order their counts are reported
+var readQueries = []ReadQuery{StatusReadQuery, HistoryReadQuery, StatsReadQuery, ActivityReadQuery}
+
+// QueryReadModel is a read model answering queries, such as a replica of
+// the read model
+type QueryReadModel interface {
+	GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error)
+	GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor, filter queries.HistoryFilter) (*queries.RateLimitHistory, error)
+	GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error)
+	GetClientActivity(ctx context.Context) (map[string]queries.ClientActivity, error)
+}
+
+// PrimaryReadModel is the read model that events are applied to and that
+// answers the queries no replica may answer
+type PrimaryReadModel interface {
+	QueryReadModel
+	UpdateFromEvent(ctx context.Context, event interface{}) error
+}
+
+// ReplicaLag measures how far a replica is behind the event store, such as
+// the projection filling an in-process replica or the replication lag of a
+// SQL or Redis replica
+type ReplicaLag interface {
+	Lag(ctx context.Context) (*queries.ProjectionLag, error)
+}
+
+// ReadReplica is a replica of the read model and the measure of its lag
+type ReadReplica struct {
+	Name      string
+	ReadModel QueryReadModel
+	Lag       ReplicaLag
+}
+
+// ReplicatedReadModel spreads the queries that tolerate stale answers over
+// replicas of the read model, so that dashboards and history exports scale
+// out instead of loading the read model decisions depend on. Each query type
+// routed to replicas has a staleness bound: its queries go round robin to
+// the replicas whose lag is within it, and to the primary when none is.
+// Status queries gate decisions and are always answered by the primary.
+type ReplicatedReadModel struct {
+	primary      PrimaryReadModel
+	replicas     []*replicaState
+	maxStaleness map[ReadQuery]time.Duration
+	clock        domain.Clock
+	next         atomic.Uint64
+	counts       map[ReadQuery]*readQueryCounts
+}
+
+// replicaState is a replica and its last measured lag
+type replicaState struct {
+	ReadReplica
+	lag     atomic.Pointer[measuredLag] // Nil until first measured
+	queries atomic.Uint64
+}
+
+// measuredLag is a measure of the lag of a replica
+type measuredLag struct {
+	seconds    float64
+	measuredAt time.Time
+	available  bool
+}
+
+// readQueryCounts counts the queries of a type by where they were answered
+type readQueryCounts struct {
+	primary atomic.Uint64
+	replica atomic.Uint64
+}
+
+// NewReplicatedReadModel routes the queries of the types in maxStaleness to
+// replicas lagging by at most their staleness bound. Call Run to measure the
+// lag of the replicas; until it is measured, every query is answered by the
+// primary.
+func NewReplicatedReadModel(primary PrimaryReadModel, replicas []ReadReplica, maxStaleness map[ReadQuery]time.Duration) *ReplicatedReadModel {
+	m := &ReplicatedReadModel{
+		primary:      primary,
+		maxStaleness: make(map[ReadQuery]time.Duration),
+		clock:        domain.SystemClock{},
+		counts:       make(map[ReadQuery]*readQueryCounts),
+	}
+	for _, replica := range replicas {
+		m.replicas = append(m.replicas, &replicaState{ReadReplica: replica})
+	}
+	for query, staleness := range maxStaleness {
+		if query != StatusReadQuery {
+			m.maxStaleness[query] = staleness
+		}
+	}
+	for _, query := range readQueries {
+		m.counts[query] = &readQueryCounts{}
+	}
+	return m
+}
+
+// WithClock sets the clock that the staleness of replicas is measured with
+func (m *ReplicatedReadModel) WithClock(clock domain.Clock) *ReplicatedReadModel {
+	m.clock = clock
+	return m
+}
+
+// Run measures the lag of the replicas every interval until ctx is done
+func (m *ReplicatedReadModel) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.MeasureLag(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MeasureLag measures the lag of every replica. Replicas whose lag cannot
+// be measured answer no queries until it can.
+func (m *ReplicatedReadModel) MeasureLag(ctx context.Context) {
+	for _, replica := range m.replicas {
+		lag, err := replica.Lag.Lag(ctx)
+		if err != nil {
+			if previous := replica.lag.Load(); previous == nil || previous.available {
+				log.Printf("read replica %s: failed to measure lag: %v", replica.Name, err)
+			}
+			replica.lag.Store(&measuredLag{measuredAt: m.clock.Now()})
+			continue
+		}
+		replica.lag.Store(&measuredLag{seconds: lag.LagSeconds, measuredAt: m.clock.Now(), available: true})
+	}
+}
+
+// GetRateLimitStatus retrieves the current rate limit status from the
+// primary
+func (m *ReplicatedReadModel) GetRateLimitStatus(ctx context.Context, clientID, resource string) (*queries.RateLimitStatus, error) {
+	m.counts[StatusReadQuery].primary.Add(1)
+	return m.primary.GetRateLimitStatus(ctx, clientID, resource)
+}
+
+// GetRateLimitHistory retrieves the rate limit history selected by filter
+// from a replica within the staleness bound of history queries
+func (m *ReplicatedReadModel) GetRateLimitHistory(ctx context.Context, clientID, resource string, startTime, endTime time.Time, limit, offset int, after *queries.HistoryCursor, filter queries.HistoryFilter) (*queries.RateLimitHistory, error) {
+	return routeQuery(ctx, m, HistoryReadQuery, func(readModel QueryReadModel) (*queries.RateLimitHistory, error) {
+		return readModel.GetRateLimitHistory(ctx, clientID, resource, startTime, endTime, limit, offset, after, filter)
+	})
+}
+
+// GetClientStats retrieves client statistics from a replica within the
+// staleness bound of stats queries
+func (m *ReplicatedReadModel) GetClientStats(ctx context.Context, clientID string, startTime, endTime time.Time, granularity queries.StatsGranularity) (*queries.ClientStats, error) {
+	return routeQuery(ctx, m, StatsReadQuery, func(readModel QueryReadModel) (*queries.ClientStats, error) {
+		return readModel.GetClientStats(ctx, clientID, startTime, endTime, granularity)
+	})
+}
+
+// GetClientActivity retrieves the traffic observed from every client from a
+// replica within the staleness bound of activity queries
+func (m *ReplicatedReadModel) GetClientActivity(ctx context.Context) (map[string]queries.ClientActivity, error) {
+	return routeQuery(ctx, m, ActivityReadQuery, func(readModel QueryReadModel) (map[string]queries.ClientActivity, error) {
+		return readModel.GetClientActivity(ctx)
+	})
+}
+
+// UpdateFromEvent updates the primary from an event. Replicas are kept
+// current by their own projection or replication.
+func (m *ReplicatedReadModel) UpdateFromEvent(ctx context.Context, event interface{}) error {
+	return m.primary.UpdateFromEvent(ctx, event)
+}
+
+// Stats reports the lag of the replicas and where queries were answered
+func (m *ReplicatedReadModel) Stats() queries.ReadReplicaStats {
+	now := m.clock.Now()
+	stats := queries.ReadReplicaStats{
+		Replicas: make([]queries.ReplicaStats, 0, len(m.replicas)),
+		Queries:  make([]queries.ReadQueryCount, 0, 2*len(readQueries)),
+	}
+	for _, replica := range m.replicas {
+		staleness, available := replica.staleness(now)
+		stats.Replicas = append(stats.Replicas, queries.ReplicaStats{
+			Name:       replica.Name,
+			LagSeconds: staleness.Seconds(),
+			Available:  available,
+			Queries:    replica.queries.Load(),
+		})
+	}
+	for _, query := range readQueries {
+		counts := m.counts[query]
+		stats.Queries = append(stats.Queries,
+			queries.ReadQueryCount{Query: string(query), Target: "primary", Count: counts.primary.Load()},
+			queries.ReadQueryCount{Query: string(query), Target: "replica", Count: counts.replica.Load()},
+		)
+	}
+	return stats
+}
+
+// routeQuery answers a query of a type with read on a replica within the
+// type's staleness bound, or on the primary when there is none. A replica
+// failing the query is not queried again until its lag is next measured,
+// and the primary answers in its place.
+func routeQuery[T any](ctx context.Context, m *ReplicatedReadModel, query ReadQuery, read func(QueryReadModel) (T, error)) (T, error) {
+	if replica := m.replica(query); replica != nil {
+		result, err := read(replica.ReadModel)
+		if err == nil || ctx.Err() != nil {
+			replica.queries.Add(1)
+			m.counts[query].replica.Add(1)
+			return result, err
+		}
+		log.Printf("read replica %s: %s query failed, answering from the primary: %v", replica.Name, query, err)
+		replica.lag.Store(&measuredLag{measuredAt: m.clock.Now()})
+	}
+
+	m.counts[query].primary.Add(1)
+	return read(m.primary)
+}
+
+// replica picks the next replica, round robin, whose staleness is within
+// the bound of query, or returns nil when queries of the type are answered
+// by the primary or no replica is fresh enough
+func (m *ReplicatedReadModel) replica(query ReadQuery) *replicaState {
+	bound, ok := m.maxStaleness[query]
+	if !ok || len(m.replicas) == 0 {
+		return nil
+	}
+
+	now := m.clock.Now()
+	start := m.next.Add(1)
+	for i := range m.replicas {
+		replica := m.replicas[(start+uint64(i))%uint64(len(m.replicas))]
+		if staleness, available := replica.staleness(now); available && staleness <= bound {
+			return replica
+		}
+	}
+	return nil
+}
+
+// staleness bounds how stale the answers of the replica are at now: its lag
+// when last measured plus the time since. It reports false when the lag is
+// unknown.
+func (r *replicaState) staleness(now time.Time) (time.Duration, bool) {
+	lag := r.lag.Load()
+	if lag == nil || !lag.available {
+		return 0, false
+	}
+	return time.Duration(lag.seconds*float64(time.Second)) + now.Sub(lag.measuredAt), true
+}
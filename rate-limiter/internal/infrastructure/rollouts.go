@@ -0,0 +1,63 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// RolloutEvaluation evaluates the running rule rollouts, returning those
+// that advanced or ended
+type RolloutEvaluation interface {
+	EvaluateRollouts(ctx context.Context) ([]domain.RuleRollout, error)
+}
+
+// RolloutEvaluator advances, promotes or rolls back the running rule
+// rollouts on an interval, as the deny rates of their cohorts decide
+type RolloutEvaluator struct {
+	rollouts RolloutEvaluation
+	interval time.Duration
+}
+
+// NewRolloutEvaluator creates an evaluator. Call Run to start it.
+func NewRolloutEvaluator(rollouts RolloutEvaluation, interval time.Duration) *RolloutEvaluator {
+	return &RolloutEvaluator{
+		rollouts: rollouts,
+		interval: interval,
+	}
+}
+
+// Run evaluates the rollouts every interval until ctx is cancelled
+func (e *RolloutEvaluator) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := e.rollouts.EvaluateRollouts(ctx)
+			if err != nil {
+				log.Printf("Error evaluating rule rollouts: %v", err)
+			}
+			for _, rollout := range changed {
+				logRollout(rollout)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logRollout logs that a rollout advanced or ended
+func logRollout(rollout domain.RuleRollout) {
+	switch rollout.Status {
+	case domain.RolloutRunning:
+		log.Printf("Rollout %s of rule %s advanced to %d%% of clients", rollout.ID, rollout.RuleID, rollout.Percent())
+	case domain.RolloutPromoted:
+		log.Printf("Rollout %s of rule %s promoted: %s", rollout.ID, rollout.RuleID, rollout.Reason)
+	case domain.RolloutRolledBack:
+		log.Printf("Rollout %s of rule %s rolled back: %s", rollout.ID, rollout.RuleID, rollout.Reason)
+	}
+}
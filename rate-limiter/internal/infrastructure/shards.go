@@ -0,0 +1,37 @@
+package infrastructure
+
+import (
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// shardCount is the number of shards the in-memory stores split their maps
+// into, so that requests of different clients rarely wait for one lock
+const shardCount = 64
+
+// shardOf returns the shard of key using FNV-1a
+func shardOf(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % shardCount)
+}
+
+// eventClientID returns the client of a rate limit event, or false for
+// events the read model does not know
+func eventClientID(event interface{}) (string, bool) {
+	clientID, _, ok := eventKey(event)
+	return clientID, ok
+}
+
+// eventKey returns the client and resource of a rate limit event, or false
+// for events the read model does not know
+func eventKey(event interface{}) (clientID, resource string, ok bool) {
+	projector, ok := projectorOf(event)
+	if !ok || projector.key == nil {
+		return "", "", false
+	}
+	clientID, resource = projector.key(event.(domain.Event))
+	return clientID, resource, true
+}
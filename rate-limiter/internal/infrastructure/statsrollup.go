@@ -0,0 +1,54 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// StatsRollup rolls up the client stats of a read model on an interval,
+// so that stats of idle clients are downsampled and dropped too. Clients
+// making decisions have theirs rolled up as they go.
+type StatsRollup struct {
+	readModel *InMemoryReadModel
+	interval  time.Duration
+	clock     domain.Clock
+}
+
+// NewStatsRollup creates a rollup job. Call Run to start it.
+func NewStatsRollup(readModel *InMemoryReadModel, interval time.Duration) *StatsRollup {
+	return &StatsRollup{
+		readModel: readModel,
+		interval:  interval,
+		clock:     domain.SystemClock{},
+	}
+}
+
+// WithClock sets the clock that retention is measured with
+func (j *StatsRollup) WithClock(clock domain.Clock) *StatsRollup {
+	j.clock = clock
+	return j
+}
+
+// Run rolls the stats up every interval until ctx is cancelled
+func (j *StatsRollup) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rolledUp, dropped, err := j.readModel.RollUpStats(ctx, j.clock.Now())
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Error rolling up client stats: %v", err)
+			}
+			if dropped > 0 {
+				log.Printf("Rolled up %d client stats bucket(s) and dropped %d past retention", rolledUp, dropped)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,46 +1,290 @@
 package infrastructure
 
 import (
+	"container/list"
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
 )
 
-// InMemoryEventStore implements EventStore interface for testing/development
+// InMemoryEventStore implements EventStore interface for testing/development.
+// Aggregates are sharded so that saves to different aggregates only contend
+// for the brief append to the global log.
 type InMemoryEventStore struct {
-	events map[string][]domain.Event
-	mutex  sync.RWMutex
+	shards    [shardCount]*eventShard
+	log       []domain.Event // Every event in the order it was saved
+	outbox    *outboxQueue[domain.Event]
+	mutex     sync.RWMutex // Guards log and outbox
+	maxKeys   int          // Aggregates kept per shard; 0 keeps every aggregate
+	evictions atomic.Uint64
+}
+
+// eventShard holds the events of the aggregates hashed to it
+type eventShard struct {
+	events   map[string][]domain.Event
+	recency  *list.List               // Aggregate IDs, most recently saved first
+	elements map[string]*list.Element // Entries of recency by aggregate ID
+	mutex    sync.RWMutex
 }
 
 // NewInMemoryEventStore creates a new in-memory event store
 func NewInMemoryEventStore() *InMemoryEventStore {
-	return &InMemoryEventStore{
-		events: make(map[string][]domain.Event),
+	s := &InMemoryEventStore{}
+	for i := range s.shards {
+		s.shards[i] = &eventShard{events: make(map[string][]domain.Event)}
+	}
+	return s
+}
+
+// WithMaxKeys limits the number of aggregates, that is client:resource keys,
+// the store holds. Saving a new aggregate beyond the limit evicts the least
+// recently saved one and records a RateLimitKeyEvictedEvent in the log. The
+// limit is kept per shard, so it is rounded up to a multiple of the shard
+// count. A limit of zero keeps every aggregate.
+func (s *InMemoryEventStore) WithMaxKeys(maxKeys int) *InMemoryEventStore {
+	s.maxKeys = (maxKeys + shardCount - 1) / shardCount
+	for _, shard := range s.shards {
+		shard.recency = list.New()
+		shard.elements = make(map[string]*list.Element)
+	}
+	return s
+}
+
+// KeyStats reports how many aggregates the store holds and has evicted
+func (s *InMemoryEventStore) KeyStats() queries.KeyStats {
+	stats := queries.KeyStats{
+		MaxKeys:   s.maxKeys * shardCount,
+		Evictions: s.evictions.Load(),
+	}
+	for _, shard := range s.shards {
+		shard.mutex.RLock()
+		stats.Keys += len(shard.events)
+		shard.mutex.RUnlock()
 	}
+	return stats
+}
+
+// WithOutbox queues every saved event for an OutboxRelay
+func (s *InMemoryEventStore) WithOutbox() *InMemoryEventStore {
+	s.outbox = &outboxQueue[domain.Event]{}
+	return s
 }
 
 // SaveEvents saves events for an aggregate
 func (s *InMemoryEventStore) SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	shard := s.shards[shardOf(aggregateID)]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	
+	existingEvents := shard.events[aggregateID]
+	if len(existingEvents) != expectedVersion {
+		return fmt.Errorf("%w: expected version %d, got %d", domain.ErrConcurrencyConflict, expectedVersion, len(existingEvents))
+	}
+	
+	shard.events[aggregateID] = append(existingEvents, events...)
+	
+	// The eviction event goes to the log only, as its aggregate is gone
+	if evicted := s.touch(shard, aggregateID); evicted != nil {
+		events = append(events[:len(events):len(events)], evicted)
+	}
+	
+	// Appending under the shard lock keeps an aggregate's events in version
+	// order in the log
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	
-	existingEvents := s.events[aggregateID]
-	if len(existingEvents) != expectedVersion {
-		return fmt.Errorf("concurrency conflict: expected version %d, got %d", expectedVersion, len(existingEvents))
+	s.log = append(s.log, events...)
+	if s.outbox != nil {
+		s.outbox.push(events...)
+	}
+	return nil
+}
+
+// SaveEventBatch saves the events of many aggregates under one acquisition
+// of the locks, as a batching store does in one round trip. Shards are
+// locked in order, as EraseClient locks them.
+func (s *InMemoryEventStore) SaveEventBatch(ctx context.Context, writes []EventWrite) []error {
+	errs := make([]error, len(writes))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	
+	var locked [shardCount]bool
+	for _, write := range writes {
+		locked[shardOf(write.AggregateID)] = true
+	}
+	for i, shard := range s.shards {
+		if locked[i] {
+			shard.mutex.Lock()
+			defer shard.mutex.Unlock()
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	for i, write := range writes {
+		shard := s.shards[shardOf(write.AggregateID)]
+		existingEvents := shard.events[write.AggregateID]
+		if len(existingEvents) != write.ExpectedVersion {
+			errs[i] = fmt.Errorf("%w: expected version %d, got %d", domain.ErrConcurrencyConflict, write.ExpectedVersion, len(existingEvents))
+			continue
+		}
+		shard.events[write.AggregateID] = append(existingEvents, write.Events...)
+		
+		events := write.Events
+		if evicted := s.touch(shard, write.AggregateID); evicted != nil {
+			events = append(events[:len(events):len(events)], evicted)
+		}
+		s.log = append(s.log, events...)
+		if s.outbox != nil {
+			s.outbox.push(events...)
+		}
+	}
+	return errs
+}
+
+// touch marks an aggregate of shard as the most recently saved and, when
+// the shard then holds more aggregates than the limit, evicts the least
+// recently saved one, returning the event recording the eviction. The
+// caller holds the shard's lock.
+func (s *InMemoryEventStore) touch(shard *eventShard, aggregateID string) domain.Event {
+	if s.maxKeys <= 0 {
+		return nil
+	}
+	
+	if element, exists := shard.elements[aggregateID]; exists {
+		shard.recency.MoveToFront(element)
+		return nil
+	}
+	shard.elements[aggregateID] = shard.recency.PushFront(aggregateID)
+	if shard.recency.Len() <= s.maxKeys {
+		return nil
+	}
+	
+	evictedID := shard.recency.Remove(shard.recency.Back()).(string)
+	delete(shard.elements, evictedID)
+	history := shard.events[evictedID]
+	delete(shard.events, evictedID)
+	s.evictions.Add(1)
+	
+	return keyEvictedEvent(evictedID, history, time.Now())
+}
+
+// keyEvictedEvent records that the aggregate with history was evicted at now
+func keyEvictedEvent(aggregateID string, history []domain.Event, now time.Time) *domain.RateLimitKeyEvictedEvent {
+	event := &domain.RateLimitKeyEvictedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:      domain.NewEventID("evicted", now),
+			Type:    "RateLimitKeyEvicted",
+			Time:    now,
+			AggrID:  aggregateID,
+			Version: len(history) + 1,
+		},
+		Events: len(history),
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if clientID, resource, ok := eventKey(history[i]); ok {
+			event.ClientID, event.Resource = clientID, resource
+			event.LastActivity = history[i].Timestamp()
+			break
+		}
+	}
+	return event
+}
+
+// EraseClient deletes the aggregates of a client and replaces its events in
+// the log with EventErasedEvents, so that positions in the log stay valid.
+// Its unpublished events are dropped from the outbox. The tombstone, its
+// counts filled in, is appended to the log and queued for publication.
+// Saves wait while the log is scanned.
+func (s *InMemoryEventStore) EraseClient(ctx context.Context, clientID string, tombstone *domain.ClientDataErasedEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	// Locks are taken in the order SaveEvents takes them, so that no event
+	// of the client can be saved between erasing its aggregates and its log
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	for _, shard := range s.shards {
+		for aggregateID, events := range shard.events {
+			if len(events) == 0 || !eventOfClient(events[0], clientID) {
+				continue
+			}
+			tombstone.Keys++
+			tombstone.Events += len(events)
+			delete(shard.events, aggregateID)
+			if element, exists := shard.elements[aggregateID]; exists {
+				shard.recency.Remove(element)
+				delete(shard.elements, aggregateID)
+			}
+		}
 	}
 	
-	s.events[aggregateID] = append(existingEvents, events...)
+	for i, event := range s.log {
+		if eventOfClient(event, clientID) {
+			s.log[i] = erasedEvent(event)
+		}
+	}
+	s.log = append(s.log, tombstone)
+	if s.outbox != nil {
+		s.outbox.remove(func(event domain.Event) bool { return eventOfClient(event, clientID) })
+		s.outbox.push(tombstone)
+	}
 	return nil
 }
 
+// eventOfClient reports whether event is a rate limit event of clientID.
+// Tombstones are not, so that erasing a client again keeps the record of
+// the first erasure.
+func eventOfClient(event domain.Event, clientID string) bool {
+	if _, tombstone := event.(*domain.ClientDataErasedEvent); tombstone {
+		return false
+	}
+	eventClient, ok := eventClientID(event)
+	return ok && eventClient == clientID
+}
+
+// erasedEvent returns the placeholder of an erased event
+func erasedEvent(event domain.Event) *domain.EventErasedEvent {
+	return &domain.EventErasedEvent{
+		BaseEvent: domain.BaseEvent{
+			ID:   event.EventID(),
+			Type: "EventErased",
+			Time: event.Timestamp(),
+		},
+	}
+}
+
 // GetEvents retrieves all events for an aggregate
 func (s *InMemoryEventStore) GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	shard := s.shards[shardOf(aggregateID)]
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 	
-	events := s.events[aggregateID]
+	events := shard.events[aggregateID]
 	if events == nil {
 		return make([]domain.Event, 0), nil
 	}
@@ -51,157 +295,1422 @@ func (s *InMemoryEventStore) GetEvents(ctx context.Context, aggregateID string)
 	return result, nil
 }
 
-// InMemoryRuleRepository implements RuleRepository interface for testing/development
+// ReadAll returns up to limit events of all aggregates saved after the
+// first from events, in the order they were saved
+func (s *InMemoryEventStore) ReadAll(ctx context.Context, from uint64, limit int) ([]domain.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	
+	if from >= uint64(len(s.log)) {
+		return make([]domain.Event, 0), nil
+	}
+	events := s.log[from:]
+	if limit > 0 && limit < len(events) {
+		events = events[:limit]
+	}
+	
+	result := make([]domain.Event, len(events))
+	copy(result, events)
+	return result, nil
+}
+
+// Head returns the number of events saved
+func (s *InMemoryEventStore) Head(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	
+	return uint64(len(s.log)), nil
+}
+
+// Restore appends an event copied from another store to the log and, when
+// it is part of the history of its aggregate, to that history. Events kept
+// in the log only, such as evictions and erased events, are restored with
+// inHistory false. Restored events are not queued for publication and never
+// evict aggregates.
+func (s *InMemoryEventStore) Restore(ctx context.Context, event domain.Event, inHistory bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	if inHistory {
+		aggregateID := event.AggregateID()
+		shard := s.shards[shardOf(aggregateID)]
+		shard.mutex.Lock()
+		shard.events[aggregateID] = append(shard.events[aggregateID], event)
+		if s.maxKeys > 0 {
+			if element, exists := shard.elements[aggregateID]; exists {
+				shard.recency.MoveToFront(element)
+			} else {
+				shard.elements[aggregateID] = shard.recency.PushFront(aggregateID)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	s.log = append(s.log, event)
+	return nil
+}
+
+// Pending returns up to limit of the oldest unpublished events
+func (s *InMemoryEventStore) Pending(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	
+	if s.outbox == nil {
+		return nil, fmt.Errorf("event store has no outbox")
+	}
+	
+	records := s.outbox.pending(limit)
+	entries := make([]OutboxEntry, len(records))
+	for i, record := range records {
+		entries[i] = OutboxEntry{Sequence: record.sequence, Event: record.event}
+	}
+	return entries, nil
+}
+
+// Acknowledge removes published events up to and including sequence
+func (s *InMemoryEventStore) Acknowledge(ctx context.Context, sequence uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if s.outbox == nil {
+		return fmt.Errorf("event store has no outbox")
+	}
+	
+	s.outbox.acknowledge(sequence)
+	return nil
+}
+
+// InMemoryRuleRepository implements RuleRepository interface for testing/development.
+// Rules are read on every request but rarely change, so reads use an
+// immutable snapshot indexed by resource and never wait for a lock.
 type InMemoryRuleRepository struct {
-	rules map[string]domain.RateLimitRule
-	mutex sync.RWMutex
+	snapshot atomic.Pointer[ruleSnapshot]
+	mutex    sync.Mutex // Serializes writers
+}
+
+// ruleSnapshot is an immutable view of every rule
+type ruleSnapshot struct {
+	byID       map[string]domain.RateLimitRule
+	byResource map[string][]domain.RateLimitRule // Ordered by ID
+	ordered    []domain.RateLimitRule            // Ordered by ID
 }
 
 // NewInMemoryRuleRepository creates a new in-memory rule repository
 func NewInMemoryRuleRepository() *InMemoryRuleRepository {
-	return &InMemoryRuleRepository{
-		rules: make(map[string]domain.RateLimitRule),
+	r := &InMemoryRuleRepository{}
+	r.snapshot.Store(newRuleSnapshot(make(map[string]domain.RateLimitRule)))
+	return r
+}
+
+// newRuleSnapshot indexes rules, which the snapshot takes ownership of
+func newRuleSnapshot(rules map[string]domain.RateLimitRule) *ruleSnapshot {
+	snapshot := &ruleSnapshot{
+		byID:       rules,
+		byResource: make(map[string][]domain.RateLimitRule),
+		ordered:    make([]domain.RateLimitRule, 0, len(rules)),
+	}
+	for _, rule := range rules {
+		snapshot.byResource[rule.Resource] = append(snapshot.byResource[rule.Resource], rule)
+		snapshot.ordered = append(snapshot.ordered, rule)
 	}
+	for _, resourceRules := range snapshot.byResource {
+		sort.Slice(resourceRules, func(i, j int) bool { return resourceRules[i].ID < resourceRules[j].ID })
+	}
+	sort.Slice(snapshot.ordered, func(i, j int) bool { return snapshot.ordered[i].ID < snapshot.ordered[j].ID })
+	return snapshot
 }
 
 // Save saves a rate limit rule
 func (r *InMemoryRuleRepository) Save(ctx context.Context, rule domain.RateLimitRule) error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	
-	r.rules[rule.ID] = rule
-	return nil
+	return r.modify(func(rules map[string]domain.RateLimitRule) error {
+		rules[rule.ID] = rule
+		return nil
+	})
 }
 
 // GetByResource retrieves rules by resource
 func (r *InMemoryRuleRepository) GetByResource(ctx context.Context, resource string) ([]domain.RateLimitRule, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-	
-	var result []domain.RateLimitRule
-	for _, rule := range r.rules {
-		if rule.Resource == resource {
-			result = append(result, rule)
-		}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	
-	return result, nil
+	rules := r.snapshot.Load().byResource[resource]
+	if rules == nil {
+		return nil, nil
+	}
+	return append([]domain.RateLimitRule(nil), rules...), nil
+}
+
+// HasRules reports whether resource has rules, from the snapshot
+func (r *InMemoryRuleRepository) HasRules(resource string) bool {
+	return len(r.snapshot.Load().byResource[resource]) > 0
 }
 
 // GetByID retrieves a rule by ID
 func (r *InMemoryRuleRepository) GetByID(ctx context.Context, id string) (*domain.RateLimitRule, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	
-	rule, exists := r.rules[id]
+	rule, exists := r.snapshot.Load().byID[id]
 	if !exists {
-		return nil, fmt.Errorf("rule not found: %s", id)
+		return nil, fmt.Errorf("%w: %s", domain.ErrRuleNotFound, id)
 	}
 	
 	return &rule, nil
 }
 
+// List retrieves every rule, ordered by ID
+func (r *InMemoryRuleRepository) List(ctx context.Context) ([]domain.RateLimitRule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	return append([]domain.RateLimitRule(nil), r.snapshot.Load().ordered...), nil
+}
+
 // Update updates an existing rule
 func (r *InMemoryRuleRepository) Update(ctx context.Context, rule domain.RateLimitRule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	return r.modify(func(rules map[string]domain.RateLimitRule) error {
+		if _, exists := rules[rule.ID]; !exists {
+			return fmt.Errorf("%w: %s", domain.ErrRuleNotFound, rule.ID)
+		}
+		rules[rule.ID] = rule
+		return nil
+	})
+}
+
+// Delete deletes a rule
+func (r *InMemoryRuleRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	return r.modify(func(rules map[string]domain.RateLimitRule) error {
+		if _, exists := rules[id]; !exists {
+			return fmt.Errorf("%w: %s", domain.ErrRuleNotFound, id)
+		}
+		delete(rules, id)
+		return nil
+	})
+}
+
+// modify applies change to a copy of the rules and publishes the result as
+// the new snapshot unless change fails
+func (r *InMemoryRuleRepository) modify(change func(rules map[string]domain.RateLimitRule) error) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
-	if _, exists := r.rules[rule.ID]; !exists {
-		return fmt.Errorf("rule not found: %s", rule.ID)
+	current := r.snapshot.Load().byID
+	rules := make(map[string]domain.RateLimitRule, len(current)+1)
+	for id, rule := range current {
+		rules[id] = rule
 	}
 	
-	r.rules[rule.ID] = rule
+	if err := change(rules); err != nil {
+		return err
+	}
+	r.snapshot.Store(newRuleSnapshot(rules))
 	return nil
 }
 
-// Delete deletes a rule
-func (r *InMemoryRuleRepository) Delete(ctx context.Context, id string) error {
+// InMemoryOverrideRepository implements OverrideRepository interface for testing/development
+type InMemoryOverrideRepository struct {
+	overrides map[string]domain.RateLimitOverride
+	mutex     sync.RWMutex
+}
+
+// NewInMemoryOverrideRepository creates a new in-memory override repository
+func NewInMemoryOverrideRepository() *InMemoryOverrideRepository {
+	return &InMemoryOverrideRepository{
+		overrides: make(map[string]domain.RateLimitOverride),
+	}
+}
+
+// Save saves an override, evicting overrides that expired before it was created
+func (r *InMemoryOverrideRepository) Save(ctx context.Context, override domain.RateLimitOverride) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
-	if _, exists := r.rules[id]; !exists {
-		return fmt.Errorf("rule not found: %s", id)
+	for id, existing := range r.overrides {
+		if !existing.ActiveAt(override.CreatedAt) {
+			delete(r.overrides, id)
+		}
 	}
 	
-	delete(r.rules, id)
+	r.overrides[override.ID] = override
 	return nil
 }
 
-// RedisEventStore implements EventStore interface using Redis
-type RedisEventStore struct {
-	// Redis client would be here
-	// For now, just embed the in-memory implementation
-	*InMemoryEventStore
+// GetByClient retrieves the overrides of a client, for one resource unless
+// resource is empty
+func (r *InMemoryOverrideRepository) GetByClient(ctx context.Context, clientID, resource string) ([]domain.RateLimitOverride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	var result []domain.RateLimitOverride
+	for _, override := range r.overrides {
+		if override.ClientID == clientID && (resource == "" || override.Resource == resource) {
+			result = append(result, override)
+		}
+	}
+	
+	return result, nil
 }
 
-// NewRedisEventStore creates a new Redis-based event store
-func NewRedisEventStore() *RedisEventStore {
-	return &RedisEventStore{
-		InMemoryEventStore: NewInMemoryEventStore(),
+// List retrieves every override, oldest first
+func (r *InMemoryOverrideRepository) List(ctx context.Context) ([]domain.RateLimitOverride, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	result := make([]domain.RateLimitOverride, 0, len(r.overrides))
+	for _, override := range r.overrides {
+		result = append(result, override)
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	
+	return result, nil
 }
 
-// PostgreSQLRuleRepository implements RuleRepository interface using PostgreSQL
-type PostgreSQLRuleRepository struct {
-	// Database connection would be here
-	// For now, just embed the in-memory implementation
-	*InMemoryRuleRepository
+// Delete deletes an override
+func (r *InMemoryOverrideRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.overrides[id]; !exists {
+		return fmt.Errorf("%w: %s", domain.ErrOverrideNotFound, id)
+	}
+	
+	delete(r.overrides, id)
+	return nil
 }
 
-// NewPostgreSQLRuleRepository creates a new PostgreSQL-based rule repository
-func NewPostgreSQLRuleRepository() *PostgreSQLRuleRepository {
-	return &PostgreSQLRuleRepository{
-		InMemoryRuleRepository: NewInMemoryRuleRepository(),
-	}
+// InMemoryFreezeRepository implements FreezeRepository interface for testing/development
+type InMemoryFreezeRepository struct {
+	freezes map[string]domain.Freeze
+	mutex   sync.RWMutex
 }
 
-// EventBus handles event publishing and subscription
-type EventBus struct {
-	subscribers map[string][]chan domain.Event
-	mutex       sync.RWMutex
+// NewInMemoryFreezeRepository creates a new in-memory freeze repository
+func NewInMemoryFreezeRepository() *InMemoryFreezeRepository {
+	return &InMemoryFreezeRepository{
+		freezes: make(map[string]domain.Freeze),
+	}
 }
 
-// NewEventBus creates a new event bus
-func NewEventBus() *EventBus {
-	return &EventBus{
-		subscribers: make(map[string][]chan domain.Event),
+// Save saves a freeze, evicting freezes that ended before it was created
+func (r *InMemoryFreezeRepository) Save(ctx context.Context, freeze domain.Freeze) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	for id, existing := range r.freezes {
+		if existing.EndedAt(freeze.CreatedAt) {
+			delete(r.freezes, id)
+		}
 	}
+	
+	r.freezes[freeze.ID] = freeze
+	return nil
 }
 
-// Subscribe subscribes to events of a specific type
-func (b *EventBus) Subscribe(eventType string) <-chan domain.Event {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+// List retrieves every freeze, earliest start first
+func (r *InMemoryFreezeRepository) List(ctx context.Context) ([]domain.Freeze, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	
-	ch := make(chan domain.Event, 100) // Buffered channel
-	b.subscribers[eventType] = append(b.subscribers[eventType], ch)
-	return ch
+	result := make([]domain.Freeze, 0, len(r.freezes))
+	for _, freeze := range r.freezes {
+		result = append(result, freeze)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartsAt.Before(result[j].StartsAt)
+	})
+	
+	return result, nil
 }
 
-// Publish publishes an event
-func (b *EventBus) Publish(event domain.Event) {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+// Delete deletes a freeze
+func (r *InMemoryFreezeRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	
-	eventType := event.EventType()
-	if channels, exists := b.subscribers[eventType]; exists {
-		for _, ch := range channels {
-			select {
-			case ch <- event:
-			default:
-				// Channel is full, skip this subscriber
-			}
-		}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.freezes[id]; !exists {
+		return fmt.Errorf("%w: %s", domain.ErrFreezeNotFound, id)
 	}
 	
-	// Also publish to "all" subscribers
-	if channels, exists := b.subscribers["*"]; exists {
-		for _, ch := range channels {
-			select {
-			case ch <- event:
-			default:
-				// Channel is full, skip this subscriber
-			}
-		}
+	delete(r.freezes, id)
+	return nil
+}
+
+// InMemoryRolloutRepository implements RolloutRepository interface for testing/development
+type InMemoryRolloutRepository struct {
+	rollouts map[string]domain.RuleRollout
+	running  map[string]string // rule ID -> ID of its running rollout
+	mutex    sync.RWMutex
+}
+
+// NewInMemoryRolloutRepository creates a new in-memory rollout repository
+func NewInMemoryRolloutRepository() *InMemoryRolloutRepository {
+	return &InMemoryRolloutRepository{
+		rollouts: make(map[string]domain.RuleRollout),
+		running:  make(map[string]string),
 	}
 }
+
+// Save saves a new rollout, unless its rule already has one running
+func (r *InMemoryRolloutRepository) Save(ctx context.Context, rollout domain.RuleRollout) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if id, exists := r.running[rollout.RuleID]; exists {
+		return fmt.Errorf("%w: %s", domain.ErrRolloutInProgress, id)
+	}
+	
+	r.rollouts[rollout.ID] = rollout
+	if rollout.Status == domain.RolloutRunning {
+		r.running[rollout.RuleID] = rollout.ID
+	}
+	return nil
+}
+
+// GetByID retrieves a rollout by ID
+func (r *InMemoryRolloutRepository) GetByID(ctx context.Context, id string) (*domain.RuleRollout, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	rollout, exists := r.rollouts[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", domain.ErrRolloutNotFound, id)
+	}
+	
+	return &rollout, nil
+}
+
+// GetRunning retrieves the running rollout of a rule, or nil when it has none
+func (r *InMemoryRolloutRepository) GetRunning(ctx context.Context, ruleID string) (*domain.RuleRollout, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	id, exists := r.running[ruleID]
+	if !exists {
+		return nil, nil
+	}
+	
+	rollout := r.rollouts[id]
+	return &rollout, nil
+}
+
+// List retrieves every rollout, oldest first
+func (r *InMemoryRolloutRepository) List(ctx context.Context) ([]domain.RuleRollout, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	result := make([]domain.RuleRollout, 0, len(r.rollouts))
+	for _, rollout := range r.rollouts {
+		result = append(result, rollout)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	
+	return result, nil
+}
+
+// Update changes a rollout with update, atomically with respect to other
+// updates, so that decisions counted meanwhile are not lost. The rollout is
+// left unchanged when update fails.
+func (r *InMemoryRolloutRepository) Update(ctx context.Context, id string, update func(rollout *domain.RuleRollout) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	rollout, exists := r.rollouts[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", domain.ErrRolloutNotFound, id)
+	}
+	
+	if err := update(&rollout); err != nil {
+		return err
+	}
+	
+	r.rollouts[id] = rollout
+	if rollout.Status != domain.RolloutRunning && r.running[rollout.RuleID] == id {
+		delete(r.running, rollout.RuleID)
+	}
+	return nil
+}
+
+// InMemoryLeaseRepository implements LeaseRepository interface for testing/development
+type InMemoryLeaseRepository struct {
+	leases map[string]domain.Lease
+	mutex  sync.RWMutex
+}
+
+// NewInMemoryLeaseRepository creates a new in-memory lease repository
+func NewInMemoryLeaseRepository() *InMemoryLeaseRepository {
+	return &InMemoryLeaseRepository{
+		leases: make(map[string]domain.Lease),
+	}
+}
+
+// Save saves a new lease or replaces a renewed one
+func (r *InMemoryLeaseRepository) Save(ctx context.Context, lease domain.Lease) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	r.leases[lease.ID] = lease
+	return nil
+}
+
+// GetByID retrieves a lease by ID
+func (r *InMemoryLeaseRepository) GetByID(ctx context.Context, id string) (*domain.Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	lease, exists := r.leases[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", domain.ErrLeaseNotFound, id)
+	}
+	
+	return &lease, nil
+}
+
+// List retrieves every lease, oldest first
+func (r *InMemoryLeaseRepository) List(ctx context.Context) ([]domain.Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	result := make([]domain.Lease, 0, len(r.leases))
+	for _, lease := range r.leases {
+		result = append(result, lease)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	
+	return result, nil
+}
+
+// Delete deletes a lease
+func (r *InMemoryLeaseRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.leases[id]; !exists {
+		return fmt.Errorf("%w: %s", domain.ErrLeaseNotFound, id)
+	}
+	
+	delete(r.leases, id)
+	return nil
+}
+
+// InMemoryClientRepository implements ClientRepository interface for testing/development
+type InMemoryClientRepository struct {
+	clients map[string]domain.Client
+	mutex   sync.RWMutex
+}
+
+// NewInMemoryClientRepository creates a new in-memory client repository
+func NewInMemoryClientRepository() *InMemoryClientRepository {
+	return &InMemoryClientRepository{
+		clients: make(map[string]domain.Client),
+	}
+}
+
+// Save registers a new client
+func (r *InMemoryClientRepository) Save(ctx context.Context, client domain.Client) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.clients[client.ID]; exists {
+		return fmt.Errorf("%w: %s", domain.ErrClientExists, client.ID)
+	}
+	
+	r.clients[client.ID] = client
+	return nil
+}
+
+// GetByID retrieves a client by ID
+func (r *InMemoryClientRepository) GetByID(ctx context.Context, id string) (*domain.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	client, exists := r.clients[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", domain.ErrClientNotFound, id)
+	}
+	
+	return &client, nil
+}
+
+// List retrieves every client, ordered by ID
+func (r *InMemoryClientRepository) List(ctx context.Context) ([]domain.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	result := make([]domain.Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		result = append(result, client)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	
+	return result, nil
+}
+
+// Update updates an existing client
+func (r *InMemoryClientRepository) Update(ctx context.Context, client domain.Client) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.clients[client.ID]; !exists {
+		return fmt.Errorf("%w: %s", domain.ErrClientNotFound, client.ID)
+	}
+	
+	r.clients[client.ID] = client
+	return nil
+}
+
+// Delete deletes a client
+func (r *InMemoryClientRepository) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	
+	if _, exists := r.clients[id]; !exists {
+		return fmt.Errorf("%w: %s", domain.ErrClientNotFound, id)
+	}
+	
+	delete(r.clients, id)
+	return nil
+}
+
+// RedisEventStore implements EventStore interface using Redis. Events are
+// stored encoded, so loading them upcasts events written with older schemas.
+type RedisEventStore struct {
+	// Redis client would be here
+	// For now, keep the encoded events in memory
+	records map[string][][]byte
+	log     [][]byte // Every record in the order it was saved
+	outbox  *outboxQueue[[]byte]
+	codec   EventCodec
+	decoded *decodedCache // Nil unless decoded histories are cached
+	mutex   sync.RWMutex
+}
+
+// NewRedisEventStore creates a new Redis-based event store encoding events
+// with codec
+func NewRedisEventStore(codec EventCodec) *RedisEventStore {
+	return &RedisEventStore{
+		records: make(map[string][][]byte),
+		codec:   codec,
+	}
+}
+
+// WithOutbox queues every saved event for an OutboxRelay, in the same
+// transaction as the events
+func (s *RedisEventStore) WithOutbox() *RedisEventStore {
+	s.outbox = &outboxQueue[[]byte]{}
+	return s
+}
+
+// SaveEvents encodes and saves events for an aggregate
+func (s *RedisEventStore) SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	encoded := make([][]byte, 0, len(events))
+	for _, event := range events {
+		record, err := s.codec.Encode(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+		encoded = append(encoded, record)
+	}
+
+	// The cached history holds the events as loading them would return them
+	var saved []domain.Event
+	if s.decoded != nil {
+		saved = make([]domain.Event, 0, len(encoded))
+		for _, record := range encoded {
+			event, err := s.codec.Decode(record)
+			if err != nil {
+				return fmt.Errorf("failed to decode event: %w", err)
+			}
+			saved = append(saved, event)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing := s.records[aggregateID]
+	if len(existing) != expectedVersion {
+		return fmt.Errorf("%w: expected version %d, got %d", domain.ErrConcurrencyConflict, expectedVersion, len(existing))
+	}
+
+	s.records[aggregateID] = append(existing, encoded...)
+	s.log = append(s.log, encoded...)
+	if s.outbox != nil {
+		s.outbox.push(encoded...)
+	}
+	if s.decoded != nil {
+		s.decoded.appendSaved(aggregateID, saved, expectedVersion)
+	}
+	return nil
+}
+
+// SaveEventBatch encodes the events of many aggregates and saves them in
+// one transaction, as a pipeline of checked appends, so that a batch costs
+// one round trip
+func (s *RedisEventStore) SaveEventBatch(ctx context.Context, writes []EventWrite) []error {
+	errs := make([]error, len(writes))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	encoded := make([][][]byte, len(writes))
+	saved := make([][]domain.Event, len(writes))
+	for i, write := range writes {
+		for _, event := range write.Events {
+			record, err := s.codec.Encode(event)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to encode event: %w", err)
+				break
+			}
+			encoded[i] = append(encoded[i], record)
+		}
+		if errs[i] != nil || s.decoded == nil {
+			continue
+		}
+		for _, record := range encoded[i] {
+			event, err := s.codec.Decode(record)
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to decode event: %w", err)
+				break
+			}
+			saved[i] = append(saved[i], event)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, write := range writes {
+		if errs[i] != nil {
+			continue
+		}
+		existing := s.records[write.AggregateID]
+		if len(existing) != write.ExpectedVersion {
+			errs[i] = fmt.Errorf("%w: expected version %d, got %d", domain.ErrConcurrencyConflict, write.ExpectedVersion, len(existing))
+			continue
+		}
+
+		s.records[write.AggregateID] = append(existing, encoded[i]...)
+		s.log = append(s.log, encoded[i]...)
+		if s.outbox != nil {
+			s.outbox.push(encoded[i]...)
+		}
+		if s.decoded != nil {
+			s.decoded.appendSaved(write.AggregateID, saved[i], write.ExpectedVersion)
+		}
+	}
+	return errs
+}
+
+// GetEvents loads and decodes all events for an aggregate, upcasting them
+// to the current schemas
+func (s *RedisEventStore) GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.decoded != nil {
+		if events, ok := s.decoded.get(aggregateID); ok {
+			return events, nil
+		}
+	}
+
+	s.mutex.RLock()
+	records := s.records[aggregateID]
+	s.mutex.RUnlock()
+
+	events := make([]domain.Event, 0, len(records))
+	for _, record := range records {
+		event, err := s.codec.Decode(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	if s.decoded != nil && len(events) > 0 {
+		// Events saved while decoding would make the history stale
+		s.mutex.RLock()
+		if len(s.records[aggregateID]) == len(events) {
+			s.decoded.put(aggregateID, append([]domain.Event(nil), events...))
+		}
+		s.mutex.RUnlock()
+	}
+	return events, nil
+}
+
+// EraseClient deletes the aggregates of a client and replaces its events in
+// the log with EventErasedEvents, so that positions in the log stay valid.
+// Its unpublished events are dropped from the outbox. The tombstone, its
+// counts filled in, is appended to the log and queued for publication.
+func (s *RedisEventStore) EraseClient(ctx context.Context, clientID string, tombstone *domain.ClientDataErasedEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Records are decoded to find the client's, as the client is part of
+	// the payload only
+	erased := make(map[string]bool)
+	match := func(record []byte) (domain.Event, bool, error) {
+		event, err := s.codec.Decode(record)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode event: %w", err)
+		}
+		return event, eventOfClient(event, clientID), nil
+	}
+
+	for aggregateID, records := range s.records {
+		if len(records) == 0 {
+			continue
+		}
+		_, ofClient, err := match(records[0])
+		if err != nil {
+			return err
+		}
+		if ofClient {
+			erased[aggregateID] = true
+			tombstone.Keys++
+			tombstone.Events += len(records)
+		}
+	}
+
+	// The log is rewritten aside, so that a failure leaves it as it was
+	rewritten := make([][]byte, len(s.log), len(s.log)+1)
+	for i, record := range s.log {
+		event, ofClient, err := match(record)
+		if err != nil {
+			return err
+		}
+		if !ofClient {
+			rewritten[i] = record
+			continue
+		}
+		if rewritten[i], err = s.codec.Encode(erasedEvent(event)); err != nil {
+			return fmt.Errorf("failed to encode event: %w", err)
+		}
+	}
+
+	encodedTombstone, err := s.codec.Encode(tombstone)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	var outboxErr error
+	if s.outbox != nil {
+		s.outbox.remove(func(record []byte) bool {
+			_, ofClient, err := match(record)
+			if err != nil && outboxErr == nil {
+				outboxErr = err
+			}
+			return ofClient
+		})
+		s.outbox.push(encodedTombstone)
+	}
+
+	for aggregateID := range erased {
+		delete(s.records, aggregateID)
+		if s.decoded != nil {
+			s.decoded.remove(aggregateID)
+		}
+	}
+	s.log = append(rewritten, encodedTombstone)
+	return outboxErr
+}
+
+// ReadAll decodes up to limit events of all aggregates saved after the
+// first from events, in the order they were saved
+func (s *RedisEventStore) ReadAll(ctx context.Context, from uint64, limit int) ([]domain.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	var records [][]byte
+	if from < uint64(len(s.log)) {
+		records = s.log[from:]
+	}
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	s.mutex.RUnlock()
+
+	events := make([]domain.Event, 0, len(records))
+	for _, record := range records {
+		event, err := s.codec.Decode(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Head returns the number of events saved
+func (s *RedisEventStore) Head(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return uint64(len(s.log)), nil
+}
+
+// Restore encodes an event copied from another store and appends it to the
+// log and, when it is part of the history of its aggregate, to that
+// history, as InMemoryEventStore.Restore does
+func (s *RedisEventStore) Restore(ctx context.Context, event domain.Event, inHistory bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record, err := s.codec.Encode(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if inHistory {
+		aggregateID := event.AggregateID()
+		s.records[aggregateID] = append(s.records[aggregateID], record)
+		if s.decoded != nil {
+			s.decoded.remove(aggregateID)
+		}
+	}
+	s.log = append(s.log, record)
+	return nil
+}
+
+// Pending decodes up to limit of the oldest unpublished events
+func (s *RedisEventStore) Pending(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	if s.outbox == nil {
+		s.mutex.RUnlock()
+		return nil, fmt.Errorf("event store has no outbox")
+	}
+	records := s.outbox.pending(limit)
+	s.mutex.RUnlock()
+
+	entries := make([]OutboxEntry, 0, len(records))
+	for _, record := range records {
+		event, err := s.codec.Decode(record.event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode outbox event %d: %w", record.sequence, err)
+		}
+		entries = append(entries, OutboxEntry{Sequence: record.sequence, Event: event})
+	}
+	return entries, nil
+}
+
+// Acknowledge removes published events up to and including sequence
+func (s *RedisEventStore) Acknowledge(ctx context.Context, sequence uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.outbox == nil {
+		return fmt.Errorf("event store has no outbox")
+	}
+
+	s.outbox.acknowledge(sequence)
+	return nil
+}
+
+// PostgreSQLRuleRepository implements RuleRepository interface using PostgreSQL
+type PostgreSQLRuleRepository struct {
+	// Database connection would be here
+	// For now, just embed the in-memory implementation
+	*InMemoryRuleRepository
+}
+
+// NewPostgreSQLRuleRepository creates a new PostgreSQL-based rule repository
+func NewPostgreSQLRuleRepository() *PostgreSQLRuleRepository {
+	return &PostgreSQLRuleRepository{
+		InMemoryRuleRepository: NewInMemoryRuleRepository(),
+	}
+}
+
+// BackpressurePolicy decides what the EventBus does when a subscriber's
+// buffer is full
+type BackpressurePolicy string
+
+const (
+	// DropNewest discards the event being published and counts it
+	DropNewest BackpressurePolicy = "drop"
+	// DropOldest discards the oldest queued event to make room, keeping the
+	// buffer a ring of the latest events
+	DropOldest BackpressurePolicy = "ring"
+	// BlockWithTimeout waits up to the subscriber's timeout for room, then
+	// drops the event
+	BlockWithTimeout BackpressurePolicy = "block"
+)
+
+// ParseBackpressurePolicy validates a policy name
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch policy := BackpressurePolicy(name); policy {
+	case DropNewest, DropOldest, BlockWithTimeout:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown backpressure policy: %s", name)
+	}
+}
+
+// defaultMaxHeld bounds the events held for a paused subscriber
+const defaultMaxHeld = 10000
+
+// SubscriberOptions configures a subscriber's buffer and backpressure
+type SubscriberOptions struct {
+	BufferSize int
+	Policy     BackpressurePolicy
+	Timeout    time.Duration // BlockWithTimeout only
+	MaxHeld    int           // Events held while paused, 10000 when zero
+}
+
+// subscriber is a subscription with its delivery counters
+type subscriber struct {
+	id        uint64
+	eventType string
+	ch        chan domain.Event
+	options   SubscriberOptions
+	paused    bool
+	held      []domain.Event
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	mutex     sync.Mutex // Orders delivery and guards paused and held
+}
+
+// publish delivers event, or holds it while the subscriber is paused
+func (s *subscriber) publish(event domain.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	if !s.paused {
+		s.deliver(event)
+		return
+	}
+	
+	maxHeld := s.options.MaxHeld
+	if maxHeld <= 0 {
+		maxHeld = defaultMaxHeld
+	}
+	if len(s.held) >= maxHeld {
+		s.dropped.Add(1)
+		return
+	}
+	s.held = append(s.held, event)
+}
+
+// setPaused pauses or resumes delivery. Resuming delivers the held events
+// before any event published afterwards.
+func (s *subscriber) setPaused(paused bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	s.paused = paused
+	if paused {
+		return
+	}
+	for _, event := range s.held {
+		s.deliver(event)
+	}
+	s.held = nil
+}
+
+// deliver sends event according to the subscriber's backpressure policy
+func (s *subscriber) deliver(event domain.Event) {
+	select {
+	case s.ch <- event:
+		s.delivered.Add(1)
+		return
+	default:
+	}
+	
+	switch s.options.Policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+			s.dropped.Add(1)
+		default:
+		}
+		select {
+		case s.ch <- event:
+			s.delivered.Add(1)
+		default:
+			s.dropped.Add(1)
+		}
+	case BlockWithTimeout:
+		timer := time.NewTimer(s.options.Timeout)
+		defer timer.Stop()
+		select {
+		case s.ch <- event:
+			s.delivered.Add(1)
+		case <-timer.C:
+			s.dropped.Add(1)
+		}
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// EventBus handles event publishing and subscription
+type EventBus struct {
+	subscribers map[string][]*subscriber
+	defaults    SubscriberOptions
+	nextID      uint64
+	mutex       sync.RWMutex
+}
+
+// NewEventBus creates a new event bus whose subscribers buffer 100 events
+// and drop new events when full
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[string][]*subscriber),
+		defaults:    SubscriberOptions{BufferSize: 100, Policy: DropNewest},
+	}
+}
+
+// WithSubscriberOptions sets the options of subscribers created by Subscribe
+func (b *EventBus) WithSubscriberOptions(options SubscriberOptions) *EventBus {
+	b.defaults = options
+	return b
+}
+
+// Subscribe subscribes to events of a specific type, or "*" for all events
+func (b *EventBus) Subscribe(eventType string) <-chan domain.Event {
+	return b.SubscribeWith(eventType, b.defaults)
+}
+
+// SubscribeWith subscribes to events of a specific type with its own buffer
+// and backpressure policy
+func (b *EventBus) SubscribeWith(eventType string, options SubscriberOptions) <-chan domain.Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	
+	b.nextID++
+	sub := &subscriber{
+		id:        b.nextID,
+		eventType: eventType,
+		ch:        make(chan domain.Event, options.BufferSize),
+		options:   options,
+	}
+	b.subscribers[eventType] = append(b.subscribers[eventType], sub)
+	return sub.ch
+}
+
+// SubscribeLive subscribes a live viewer, such as a browser, to events of a
+// specific type. Viewers must never hold up publishers, so whatever the bus
+// defaults, a full buffer drops the oldest queued event.
+func (b *EventBus) SubscribeLive(eventType string) <-chan domain.Event {
+	return b.SubscribeWith(eventType, SubscriberOptions{BufferSize: b.defaults.BufferSize, Policy: DropOldest})
+}
+
+// Unsubscribe stops delivery to a subscription and closes its channel
+func (b *EventBus) Unsubscribe(ch <-chan domain.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	
+	for eventType, subs := range b.subscribers {
+		for i, sub := range subs {
+			if (<-chan domain.Event)(sub.ch) != ch {
+				continue
+			}
+			b.subscribers[eventType] = append(subs[:i:i], subs[i+1:]...)
+			if len(b.subscribers[eventType]) == 0 {
+				delete(b.subscribers, eventType)
+			}
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// Stats returns the delivery statistics of every subscriber
+func (b *EventBus) Stats() []queries.SubscriberStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	
+	stats := make([]queries.SubscriberStats, 0)
+	for _, subs := range b.subscribers {
+		for _, sub := range subs {
+			sub.mutex.Lock()
+			paused, held := sub.paused, len(sub.held)
+			sub.mutex.Unlock()
+			
+			stats = append(stats, queries.SubscriberStats{
+				ID:         sub.id,
+				EventType:  sub.eventType,
+				Policy:     string(sub.options.Policy),
+				BufferSize: sub.options.BufferSize,
+				Queued:     len(sub.ch),
+				Delivered:  sub.delivered.Load(),
+				Dropped:    sub.dropped.Load(),
+				Paused:     paused,
+				Held:       held,
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// Publish publishes an event to the subscribers of its type and of "*"
+func (b *EventBus) Publish(event domain.Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	
+	for _, sub := range b.subscribers[event.EventType()] {
+		sub.publish(event)
+	}
+	for _, sub := range b.subscribers["*"] {
+		sub.publish(event)
+	}
+}
+
+// Pause holds events for a subscriber until it is resumed
+func (b *EventBus) Pause(id uint64) error {
+	sub, err := b.subscriber(id)
+	if err != nil {
+		return err
+	}
+	
+	sub.setPaused(true)
+	return nil
+}
+
+// Resume delivers the events held for a subscriber and resumes delivery
+func (b *EventBus) Resume(id uint64) error {
+	sub, err := b.subscriber(id)
+	if err != nil {
+		return err
+	}
+	
+	sub.setPaused(false)
+	return nil
+}
+
+// Replay publishes events to a single subscriber, regardless of their type,
+// and returns how many were replayed. Events replayed while the subscriber
+// is paused are held like any other.
+func (b *EventBus) Replay(ctx context.Context, id uint64, events []domain.Event) (int, error) {
+	sub, err := b.subscriber(id)
+	if err != nil {
+		return 0, err
+	}
+	
+	for i, event := range events {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		sub.publish(event)
+	}
+	return len(events), nil
+}
+
+// subscriber finds a subscriber by ID
+func (b *EventBus) subscriber(id uint64) (*subscriber, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	
+	for _, subs := range b.subscribers {
+		for _, sub := range subs {
+			if sub.id == id {
+				return sub, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("subscriber not found: %d", id)
+}
+
+// replaySource is an event store events can be selected from for replay
+type replaySource interface {
+	GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error)
+	ReadAll(ctx context.Context, from uint64, limit int) ([]domain.Event, error)
+}
+
+// selectEvents returns the events of an aggregate, or of every aggregate
+// when aggregateID is empty, stored in [startTime, endTime). Zero times
+// leave the range open.
+func selectEvents(ctx context.Context, source replaySource, aggregateID string, startTime, endTime time.Time) ([]domain.Event, error) {
+	var candidates []domain.Event
+	var err error
+	if aggregateID != "" {
+		candidates, err = source.GetEvents(ctx, aggregateID)
+	} else {
+		candidates, err = source.ReadAll(ctx, 0, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	events := make([]domain.Event, 0, len(candidates))
+	for _, event := range candidates {
+		if _, erased := event.(*domain.EventErasedEvent); erased {
+			continue
+		}
+		if !startTime.IsZero() && event.Timestamp().Before(startTime) {
+			continue
+		}
+		if !endTime.IsZero() && !event.Timestamp().Before(endTime) {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// SelectEvents returns stored events for replay, in the order they were
+// saved
+func (s *InMemoryEventStore) SelectEvents(ctx context.Context, aggregateID string, startTime, endTime time.Time) ([]domain.Event, error) {
+	return selectEvents(ctx, s, aggregateID, startTime, endTime)
+}
+
+// SelectEvents returns stored events for replay, in the order they were
+// saved
+func (s *RedisEventStore) SelectEvents(ctx context.Context, aggregateID string, startTime, endTime time.Time) ([]domain.Event, error) {
+	return selectEvents(ctx, s, aggregateID, startTime, endTime)
+}
@@ -0,0 +1,66 @@
+package infrastructure_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// historyDepth is the number of events an aggregate is given before the
+// benchmarks move on to a new one, as a decision replays the history of its
+// aggregate
+const historyDepth = 100
+
+// BenchmarkEventStore measures what a decision asks of the in-memory event
+// store and of the Redis event store, which keeps its events encoded in
+// process memory rather than in a Redis server: loading the history of an
+// aggregate and appending an event to it
+func BenchmarkEventStore(b *testing.B) {
+	b.Run("store=memory", func(b *testing.B) {
+		benchmarkEventStore(b, infrastructure.NewInMemoryEventStore())
+	})
+	b.Run("store=encoded", func(b *testing.B) {
+		benchmarkEventStore(b, infrastructure.NewRedisEventStore(infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())))
+	})
+}
+
+// benchmarkEventStore loads and appends to an aggregate of eventStore,
+// moving on to a new aggregate every historyDepth events
+func benchmarkEventStore(b *testing.B, eventStore handlers.EventStore) {
+	ctx := context.Background()
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregateID := fmt.Sprintf("client-%d:bench", i/historyDepth)
+		events, err := eventStore.GetEvents(ctx, aggregateID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		event := &domain.RateLimitAppliedEvent{
+			BaseEvent: domain.BaseEvent{
+				ID:      domain.NewEventID("applied", now),
+				Type:    "RateLimitApplied",
+				Time:    now,
+				AggrID:  aggregateID,
+				Version: len(events) + 1,
+			},
+			ClientID:       fmt.Sprintf("client-%d", i/historyDepth),
+			Resource:       "bench",
+			WindowStart:    now,
+			WindowEnd:      now.Add(time.Second),
+			RequestCount:   len(events) + 1,
+			Limit:          1000000,
+			RemainingQuota: 1000000 - len(events) - 1,
+		}
+		if err := eventStore.SaveEvents(ctx, aggregateID, []domain.Event{event}, len(events)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
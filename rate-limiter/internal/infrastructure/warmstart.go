@@ -0,0 +1,82 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// AggregatePreloader is an event store that can load the histories of
+// recently active aggregates into memory ahead of their next decisions
+type AggregatePreloader interface {
+	RecentAggregates(ctx context.Context, since time.Time, limit int) ([]string, error)
+	Preload(ctx context.Context, aggregateIDs []string) (int, error)
+}
+
+// WarmStart loads state into memory when an instance starts, before it
+// takes traffic, so that the first requests after a deploy do not all
+// replay their histories or compile the rules at once. The instance reports
+// not ready until the warm start is done.
+type WarmStart struct {
+	steps   []warmStep
+	timeout time.Duration
+	done    atomic.Bool
+}
+
+// warmStep loads one kind of state, returning how many items it loaded
+type warmStep struct {
+	name string
+	warm func(ctx context.Context) (int, error)
+}
+
+// NewWarmStart creates a warm start giving up after timeout. Add its steps,
+// then call Run.
+func NewWarmStart(timeout time.Duration) *WarmStart {
+	return &WarmStart{timeout: timeout}
+}
+
+// Add adds a step loading the state called name, which runs after the steps
+// added before it
+func (w *WarmStart) Add(name string, warm func(ctx context.Context) (int, error)) *WarmStart {
+	w.steps = append(w.steps, warmStep{name: name, warm: warm})
+	return w
+}
+
+// Run runs the steps in order until they are done or the timeout passes,
+// and then reports ready. A failed step is logged and skipped: what it did
+// not load is loaded by the first request needing it, as on a cold start.
+func (w *WarmStart) Run(ctx context.Context) {
+	defer w.done.Store(true)
+
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	for _, step := range w.steps {
+		started := time.Now()
+		n, err := step.warm(ctx)
+		if err != nil {
+			log.Printf("Warm start of %s failed after loading %d: %v", step.name, n, err)
+			continue
+		}
+		log.Printf("Warm start loaded %d %s in %s", n, step.name, time.Since(started).Round(time.Millisecond))
+	}
+}
+
+// Ready reports whether the warm start is done
+func (w *WarmStart) Ready() bool {
+	return w.done.Load()
+}
+
+// PreloadRecentAggregates returns a warm start step loading the histories of
+// up to maxKeys aggregates with events in the last window, most recently
+// active first
+func PreloadRecentAggregates(store AggregatePreloader, window time.Duration, maxKeys int) func(ctx context.Context) (int, error) {
+	return func(ctx context.Context) (int, error) {
+		aggregateIDs, err := store.RecentAggregates(ctx, time.Now().Add(-window), maxKeys)
+		if err != nil {
+			return 0, err
+		}
+		return store.Preload(ctx, aggregateIDs)
+	}
+}
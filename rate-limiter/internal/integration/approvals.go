@@ -0,0 +1,435 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rateLimiterDomain "github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// ErrRuleChangeNotFound is returned for a rule change that does not exist
+var ErrRuleChangeNotFound = errors.New("rule change not found")
+
+// ErrRuleChangeNotPending is returned when a rule change that was already
+// approved or rejected is reviewed again
+var ErrRuleChangeNotPending = errors.New("rule change is not pending")
+
+// ErrRuleChangePending is returned when a rule is changed while another
+// change of it awaits approval
+var ErrRuleChangePending = rateLimiterDomain.ErrRuleChangePending
+
+// ErrPrincipalRequired is returned when a change needing approval is
+// requested or reviewed by an unknown principal, which could not be told
+// apart from any other
+var ErrPrincipalRequired = rateLimiterDomain.ErrPrincipalRequired
+
+// ErrSelfApproval is returned when the requester of a rule change approves
+// it
+var ErrSelfApproval = errors.New("rule change must be approved by another principal")
+
+// ErrApprovalRequired is returned by bulk changes that would enable rules
+// needing approval, which have to be enabled one by one
+var ErrApprovalRequired = errors.New("rule change requires approval")
+
+// PendingApprovalError is returned by rule changes that were held pending
+// approval instead of being applied
+type PendingApprovalError struct {
+	Change RuleChange
+}
+
+func (e *PendingApprovalError) Error() string {
+	return fmt.Sprintf("change %s of rule %s awaits approval: %s", e.Change.ID, e.Change.RuleID, e.Change.Reason)
+}
+
+// PendingChange returns the change held, for handlers outside this package
+// to answer with
+func (e *PendingApprovalError) PendingChange() interface{} {
+	return e.Change
+}
+
+// RuleChangeStatus is the state of a rule change in the approval workflow
+type RuleChangeStatus string
+
+const (
+	RuleChangePending  RuleChangeStatus = "pending"
+	RuleChangeApproved RuleChangeStatus = "approved"
+	RuleChangeRejected RuleChangeStatus = "rejected"
+)
+
+// RuleChange is a change of a high-impact rule engine rule held until a
+// principal other than its requester approves it. Approving it applies Rule.
+type RuleChange struct {
+	ID          string           `json:"id"`
+	RuleID      string           `json:"rule_id"`
+	Rule        ruleDomain.Rule  `json:"rule"`   // The rule as it is once the change is applied
+	Reason      string           `json:"reason"` // Why the change needs approval
+	Status      RuleChangeStatus `json:"status"`
+	RequestedBy string           `json:"requested_by"`
+	RequestedAt time.Time        `json:"requested_at"`
+	ReviewedBy  string           `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time       `json:"reviewed_at,omitempty"`
+	Comment     string           `json:"comment,omitempty"` // Left by the reviewer
+
+	apply func(ctx context.Context) error // Applies the change once approved; Rule is created when nil
+}
+
+// ApprovalPolicy decides which rule changes need a second principal's
+// approval: those leaving an enabled rule above the priority threshold, and
+// those leaving an enabled rule denying every request
+type ApprovalPolicy struct {
+	PriorityThreshold int
+}
+
+// Reason returns why applying rule needs approval, or empty when it does not
+func (p ApprovalPolicy) Reason(rule ruleDomain.Rule) string {
+	if !rule.Enabled {
+		return ""
+	}
+	if isDenyAll(rule) {
+		return "the rule denies every request"
+	}
+	if rule.Priority > p.PriorityThreshold {
+		return fmt.Sprintf("the rule's priority %d is above %d", rule.Priority, p.PriorityThreshold)
+	}
+	return ""
+}
+
+// isDenyAll reports whether rule denies or blocks every request: it has a
+// blocking action, applies to all matching clients, and neither its
+// conditions nor its expression narrow it down
+func isDenyAll(rule ruleDomain.Rule) bool {
+	if rule.SampleRate != nil && *rule.SampleRate < 1 {
+		return false
+	}
+	if expression := strings.TrimSpace(rule.Expression); expression != "" && expression != "true" {
+		return false
+	}
+	for _, condition := range rule.Conditions {
+		if !matchesEverything(condition) {
+			return false
+		}
+	}
+	for _, action := range rule.Actions {
+		if action.Type == "deny" || action.Type == "block" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEverything reports whether condition holds for any request, such
+// as a CIDR of every address or a prefix of every path
+func matchesEverything(condition ruleDomain.RuleCondition) bool {
+	value, _ := condition.Value.(string)
+	switch condition.Operator {
+	case "cidr":
+		// A list of ranges matches an address in any of them
+		for _, cidr := range conditionStrings(condition.Value) {
+			if prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err == nil && prefix.Bits() == 0 {
+				return true
+			}
+		}
+		return false
+	case "regex":
+		return value == "" || value == ".*" || value == "^.*$"
+	case "path_prefix":
+		return value == "" || value == "/"
+	case "contains", "starts_with", "ends_with":
+		return condition.Value != nil && value == ""
+	}
+	return false
+}
+
+// conditionStrings returns the strings of a condition value, which is one
+// string or a list of them
+func conditionStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, val := range v {
+			if str, ok := val.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// EventPublisher publishes the events of the rule change approval workflow
+type EventPublisher interface {
+	Publish(event rateLimiterDomain.Event)
+}
+
+// ruleChanges holds the rule changes of the approval workflow in memory
+type ruleChanges struct {
+	changes map[string]*RuleChange
+	mutex   sync.Mutex
+}
+
+// WithRuleApprovals holds changes of rules that policy deems high-impact
+// pending until a principal other than their requester approves them
+func (s *IntegratedRateLimiterService) WithRuleApprovals(policy ApprovalPolicy) *IntegratedRateLimiterService {
+	s.approvalPolicy = &policy
+	s.ruleChanges = &ruleChanges{changes: make(map[string]*RuleChange)}
+	return s
+}
+
+// WithEventPublisher publishes the events of the rule change approval
+// workflow
+func (s *IntegratedRateLimiterService) WithEventPublisher(publisher EventPublisher) *IntegratedRateLimiterService {
+	s.eventPublisher = publisher
+	return s
+}
+
+// holdForApproval records the change to rule as pending and returns a
+// PendingApprovalError when it needs approval, or nil when it may be applied
+// right away. Approving the change creates rule.
+func (s *IntegratedRateLimiterService) holdForApproval(ctx context.Context, rule ruleDomain.Rule) error {
+	return s.HoldRuleChange(ctx, rule, nil)
+}
+
+// HoldRuleChange holds a change leaving rule as given like holdForApproval,
+// for writers keeping rules of their own, such as the ban list. Approving
+// the change runs apply, on behalf of the requester, instead of creating
+// rule.
+func (s *IntegratedRateLimiterService) HoldRuleChange(ctx context.Context, rule ruleDomain.Rule, apply func(ctx context.Context) error) error {
+	if s.approvalPolicy == nil {
+		return nil
+	}
+	reason := s.approvalPolicy.Reason(rule)
+	if reason == "" {
+		return nil
+	}
+
+	requestedBy := principal.FromContext(ctx)
+	if requestedBy == "" {
+		return fmt.Errorf("%w: changes of rule %s need approval", ErrPrincipalRequired, rule.ID)
+	}
+
+	s.ruleChanges.mutex.Lock()
+	defer s.ruleChanges.mutex.Unlock()
+
+	for _, change := range s.ruleChanges.changes {
+		if change.RuleID == rule.ID && change.Status == RuleChangePending {
+			return fmt.Errorf("%w: %s", ErrRuleChangePending, change.ID)
+		}
+	}
+
+	now := time.Now()
+	change := &RuleChange{
+		ID:          fmt.Sprintf("change-%d", now.UnixNano()),
+		RuleID:      rule.ID,
+		Rule:        rule,
+		Reason:      reason,
+		Status:      RuleChangePending,
+		RequestedBy: requestedBy,
+		RequestedAt: now,
+		apply:       apply,
+	}
+	s.ruleChanges.changes[change.ID] = change
+
+	s.publish(&rateLimiterDomain.RuleChangeRequestedEvent{
+		BaseEvent: rateLimiterDomain.BaseEvent{
+			ID:      rateLimiterDomain.NewEventID("requested", now),
+			Type:    "RuleChangeRequested",
+			Time:    now,
+			AggrID:  change.ID,
+			Version: 1,
+		},
+		ChangeID:    change.ID,
+		RuleID:      change.RuleID,
+		Reason:      reason,
+		RequestedBy: requestedBy,
+	})
+	return &PendingApprovalError{Change: *change}
+}
+
+// ListRuleChanges lists the rule changes with status, or all of them when it
+// is empty, latest first
+func (s *IntegratedRateLimiterService) ListRuleChanges(ctx context.Context, status RuleChangeStatus) []RuleChange {
+	if s.ruleChanges == nil {
+		return []RuleChange{}
+	}
+
+	s.ruleChanges.mutex.Lock()
+	defer s.ruleChanges.mutex.Unlock()
+
+	changes := make([]RuleChange, 0, len(s.ruleChanges.changes))
+	for _, change := range s.ruleChanges.changes {
+		if status == "" || change.Status == status {
+			changes = append(changes, *change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].RequestedAt.After(changes[j].RequestedAt)
+	})
+	return changes
+}
+
+// GetRuleChange returns a rule change by ID
+func (s *IntegratedRateLimiterService) GetRuleChange(ctx context.Context, changeID string) (*RuleChange, error) {
+	if s.ruleChanges == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRuleChangeNotFound, changeID)
+	}
+
+	s.ruleChanges.mutex.Lock()
+	defer s.ruleChanges.mutex.Unlock()
+
+	change, ok := s.ruleChanges.changes[changeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRuleChangeNotFound, changeID)
+	}
+	result := *change
+	return &result, nil
+}
+
+// ApproveRuleChange applies a pending rule change on behalf of the
+// principal of ctx, who must not be its requester. The change is applied
+// as the requester's, and so attributed to them.
+func (s *IntegratedRateLimiterService) ApproveRuleChange(ctx context.Context, changeID, comment string) (*RuleChange, error) {
+	approvedBy := principal.FromContext(ctx)
+	if approvedBy == "" {
+		return nil, ErrPrincipalRequired
+	}
+
+	change, err := s.reviewRuleChange(changeID, func(change *RuleChange) error {
+		if change.RequestedBy == approvedBy {
+			return ErrSelfApproval
+		}
+
+		requested := principal.NewContext(ctx, change.RequestedBy)
+		if change.apply != nil {
+			if err := change.apply(requested); err != nil {
+				return err
+			}
+			change.Status = RuleChangeApproved
+			return nil
+		}
+
+		if err := s.ruleEngine.CreateRule(requested, change.Rule); err != nil {
+			return err
+		}
+		change.Status = RuleChangeApproved
+		return nil
+	}, approvedBy, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish(&rateLimiterDomain.RuleChangeApprovedEvent{
+		BaseEvent: rateLimiterDomain.BaseEvent{
+			ID:      rateLimiterDomain.NewEventID("approved", *change.ReviewedAt),
+			Type:    "RuleChangeApproved",
+			Time:    *change.ReviewedAt,
+			AggrID:  change.ID,
+			Version: 1,
+		},
+		ChangeID:    change.ID,
+		RuleID:      change.RuleID,
+		RequestedBy: change.RequestedBy,
+		ApprovedBy:  approvedBy,
+		Comment:     comment,
+	})
+	return change, nil
+}
+
+// RejectRuleChange rejects a pending rule change on behalf of the principal
+// of ctx, leaving the rule as it is. Requesters may reject, and so
+// withdraw, their own changes.
+func (s *IntegratedRateLimiterService) RejectRuleChange(ctx context.Context, changeID, comment string) (*RuleChange, error) {
+	rejectedBy := principal.FromContext(ctx)
+	if rejectedBy == "" {
+		return nil, ErrPrincipalRequired
+	}
+
+	change, err := s.reviewRuleChange(changeID, func(change *RuleChange) error {
+		change.Status = RuleChangeRejected
+		return nil
+	}, rejectedBy, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish(&rateLimiterDomain.RuleChangeRejectedEvent{
+		BaseEvent: rateLimiterDomain.BaseEvent{
+			ID:      rateLimiterDomain.NewEventID("rejected", *change.ReviewedAt),
+			Type:    "RuleChangeRejected",
+			Time:    *change.ReviewedAt,
+			AggrID:  change.ID,
+			Version: 1,
+		},
+		ChangeID:    change.ID,
+		RuleID:      change.RuleID,
+		RequestedBy: change.RequestedBy,
+		RejectedBy:  rejectedBy,
+		Comment:     comment,
+	})
+	return change, nil
+}
+
+// reviewRuleChange settles a pending rule change with review, which sets
+// its status, and records the reviewer. The change stays pending when
+// review fails.
+func (s *IntegratedRateLimiterService) reviewRuleChange(changeID string, review func(change *RuleChange) error, reviewedBy, comment string) (*RuleChange, error) {
+	if s.ruleChanges == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRuleChangeNotFound, changeID)
+	}
+
+	s.ruleChanges.mutex.Lock()
+	defer s.ruleChanges.mutex.Unlock()
+
+	change, ok := s.ruleChanges.changes[changeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRuleChangeNotFound, changeID)
+	}
+	if change.Status != RuleChangePending {
+		return nil, fmt.Errorf("%w: %s is %s", ErrRuleChangeNotPending, change.ID, change.Status)
+	}
+
+	reviewed := *change
+	if err := review(&reviewed); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reviewed.ReviewedBy = reviewedBy
+	reviewed.ReviewedAt = &now
+	reviewed.Comment = comment
+	*change = reviewed
+	return &reviewed, nil
+}
+
+// requireNoApproval returns ErrApprovalRequired when any of rules would need
+// approval once enabled
+func (s *IntegratedRateLimiterService) requireNoApproval(rules []ruleDomain.Rule) error {
+	if s.approvalPolicy == nil {
+		return nil
+	}
+	for _, rule := range rules {
+		rule.Enabled = true
+		if reason := s.approvalPolicy.Reason(rule); reason != "" {
+			return fmt.Errorf("%w: rule %s, since %s; enable it on its own", ErrApprovalRequired, rule.ID, reason)
+		}
+	}
+	return nil
+}
+
+// publish publishes an event of the approval workflow, when a publisher is
+// set
+func (s *IntegratedRateLimiterService) publish(event rateLimiterDomain.Event) {
+	if s.eventPublisher != nil {
+		s.eventPublisher.Publish(event)
+	}
+}
@@ -0,0 +1,107 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+	"github.com/NickChunglolz/rate-limiter/internal/threatfeed"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+	ruleEngine "github.com/NickChunglolz/rule-engine/engine"
+	ruleInfra "github.com/NickChunglolz/rule-engine/infrastructure"
+)
+
+// newApprovalService returns a service over an empty rule engine, holding
+// the rule changes of priority above 200
+func newApprovalService() (*IntegratedRateLimiterService, *ruleEngine.RuleEngine) {
+	engine := ruleEngine.NewRuleEngine(ruleInfra.NewInMemoryRuleRepository(), ruleInfra.NewSimpleEventPublisher()).
+		WithPrincipal(principal.FromContext)
+	service := NewIntegratedRateLimiterService(nil, engine).WithRuleApprovals(ApprovalPolicy{PriorityThreshold: 200})
+	return service, engine
+}
+
+func TestApprovalPolicyReasonDenyAll(t *testing.T) {
+	policy := ApprovalPolicy{PriorityThreshold: 200}
+	deny := []ruleDomain.RuleAction{{Type: "deny"}}
+
+	tests := []struct {
+		name  string
+		value interface{}
+		held  bool
+	}{
+		{"string", "0.0.0.0/0", true},
+		{"IPv6 string", "::/0", true},
+		{"string list", []string{"::/0"}, true},
+		{"decoded list", []interface{}{"10.0.0.0/8", "0.0.0.0/0"}, true},
+		{"narrow string", "10.0.0.0/8", false},
+		{"narrow list", []interface{}{"10.0.0.0/8", "192.168.0.0/16"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := ruleDomain.Rule{
+				ID:         "block",
+				Enabled:    true,
+				Priority:   100,
+				Conditions: []ruleDomain.RuleCondition{{Field: "ip_address", Operator: "cidr", Value: tt.value}},
+				Actions:    deny,
+			}
+			if held := policy.Reason(rule) != ""; held != tt.held {
+				t.Errorf("Reason(%v) held = %v, want %v", tt.value, held, tt.held)
+			}
+		})
+	}
+}
+
+func TestCreateSecurityRuleHeld(t *testing.T) {
+	service, engine := newApprovalService()
+	ctx := principal.NewContext(context.Background(), "alice")
+
+	err := service.CreateSecurityRule(ctx, "block", "", []ruleDomain.RuleCondition{
+		{Field: "ip_address", Operator: "in", Value: []string{"203.0.113.7"}},
+	}, []ruleDomain.RuleAction{{Type: "deny"}}, 250)
+	var pending *PendingApprovalError
+	if !errors.As(err, &pending) {
+		t.Fatalf("CreateSecurityRule() error = %v, want pending approval", err)
+	}
+	if _, err := engine.GetRule(ctx, pending.Change.RuleID); err == nil {
+		t.Errorf("rule %s created before approval", pending.Change.RuleID)
+	}
+}
+
+func TestBanListAddHeld(t *testing.T) {
+	service, engine := newApprovalService()
+	banList := threatfeed.NewBanList(engine).WithApprovals(service)
+	ctx := principal.NewContext(context.Background(), "alice")
+
+	_, err := banList.Add(ctx, threatfeed.BanRequest{Network: "0.0.0.0/0"})
+	var pending *PendingApprovalError
+	if !errors.As(err, &pending) {
+		t.Fatalf("Add() error = %v, want pending approval", err)
+	}
+	denyRule := threatfeed.BanListRuleID(threatfeed.ActionDeny)
+	if _, err := engine.GetRule(ctx, denyRule); err == nil {
+		t.Fatalf("rule %s created before approval", denyRule)
+	}
+	if entries := banList.Entries(""); len(entries) != 0 {
+		t.Fatalf("Entries() = %v before approval, want none", entries)
+	}
+
+	if _, err := service.ApproveRuleChange(ctx, pending.Change.ID, ""); !errors.Is(err, ErrSelfApproval) {
+		t.Fatalf("ApproveRuleChange() by requester error = %v, want %v", err, ErrSelfApproval)
+	}
+	approver := principal.NewContext(context.Background(), "bob")
+	if _, err := service.ApproveRuleChange(approver, pending.Change.ID, ""); err != nil {
+		t.Fatalf("ApproveRuleChange() error = %v", err)
+	}
+	rule, err := engine.GetRule(ctx, denyRule)
+	if err != nil {
+		t.Fatalf("rule %s not created on approval: %v", denyRule, err)
+	}
+	if rule.CreatedBy != "alice" || rule.LastModifiedBy != "alice" {
+		t.Errorf("rule created by %q, last modified by %q, want the requester", rule.CreatedBy, rule.LastModifiedBy)
+	}
+	if entries := banList.Entries(""); len(entries) != 1 {
+		t.Errorf("Entries() = %v after approval, want one", entries)
+	}
+}
@@ -0,0 +1,60 @@
+package integration
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// EvaluationContextFromRequest describes an HTTP request for rule evaluation,
+// filling in its method, path, headers and query parameters
+func EvaluationContextFromRequest(r *http.Request, clientID, resource, ipAddress string) ruleDomain.RuleEvaluationContext {
+	return ruleDomain.RuleEvaluationContext{
+		ClientID:    clientID,
+		Resource:    resource,
+		IPAddress:   ipAddress,
+		UserAgent:   r.UserAgent(),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Headers:     FlattenHeaders(r.Header),
+		QueryParams: FlattenQuery(r.URL.Query()),
+	}
+}
+
+// FlattenHeaders joins repeated header values with ", " as HTTP allows
+func FlattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		flat[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// FlattenQuery keeps the first value of each query parameter
+func FlattenQuery(query url.Values) map[string]string {
+	flat := make(map[string]string, len(query))
+	for name, values := range query {
+		if len(values) > 0 {
+			flat[name] = values[0]
+		}
+	}
+	return flat
+}
+
+// KeyAttributes returns the attributes of an evaluation context that rate
+// limit key templates can use
+func KeyAttributes(evalCtx ruleDomain.RuleEvaluationContext) keytemplate.Attributes {
+	return keytemplate.Attributes{
+		ClientID:  evalCtx.ClientID,
+		Resource:  evalCtx.Resource,
+		IPAddress: evalCtx.IPAddress,
+		UserAgent: evalCtx.UserAgent,
+		Method:    evalCtx.Method,
+		Path:      evalCtx.Path,
+		Header:    keytemplate.HeaderFromMap(evalCtx.Headers),
+		Query:     keytemplate.QueryFromMap(evalCtx.QueryParams),
+	}
+}
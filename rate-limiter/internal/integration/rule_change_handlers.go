@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	rateLimiterAPI "github.com/NickChunglolz/rate-limiter/internal/api"
+)
+
+// ListChangesHandler lists the rule changes of the approval workflow,
+// latest first. The optional status parameter (pending, approved or
+// rejected) narrows the list down.
+func (h *RuleHTTPHandler) ListChangesHandler(w http.ResponseWriter, r *http.Request) {
+	status := RuleChangeStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", RuleChangePending, RuleChangeApproved, RuleChangeRejected:
+	default:
+		http.Error(w, "status must be pending, approved or rejected", http.StatusBadRequest)
+		return
+	}
+
+	changes := h.service.ListRuleChanges(r.Context(), status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
+}
+
+// GetChangeHandler returns a rule change
+func (h *RuleHTTPHandler) GetChangeHandler(w http.ResponseWriter, r *http.Request) {
+	change, err := h.service.GetRuleChange(r.Context(), r.PathValue("id"))
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+// ApproveChangeHandler approves and applies a pending rule change. The
+// approver must be an authenticated principal other than the requester.
+func (h *RuleHTTPHandler) ApproveChangeHandler(w http.ResponseWriter, r *http.Request) {
+	h.reviewChange(w, r, h.service.ApproveRuleChange)
+}
+
+// RejectChangeHandler rejects a pending rule change, leaving the rule as it
+// is
+func (h *RuleHTTPHandler) RejectChangeHandler(w http.ResponseWriter, r *http.Request) {
+	h.reviewChange(w, r, h.service.RejectRuleChange)
+}
+
+// reviewChange approves or rejects the rule change in the path, with the
+// comment in the optional request body
+func (h *RuleHTTPHandler) reviewChange(w http.ResponseWriter, r *http.Request, review func(ctx context.Context, changeID, comment string) (*RuleChange, error)) {
+	var req struct {
+		Comment string `json:"comment,omitempty"`
+	}
+	if r.ContentLength != 0 && !rateLimiterAPI.DecodeJSON(w, r, &req) {
+		return
+	}
+
+	change, err := review(r.Context(), r.PathValue("id"), req.Comment)
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
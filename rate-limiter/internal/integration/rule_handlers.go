@@ -0,0 +1,289 @@
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	rateLimiterAPI "github.com/NickChunglolz/rate-limiter/internal/api"
+	rateLimiterQueries "github.com/NickChunglolz/rate-limiter/internal/queries"
+	ruleEngine "github.com/NickChunglolz/rule-engine/engine"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// RuleHTTPHandler provides endpoints for managing rule engine rules and
+// reading their hit statistics
+type RuleHTTPHandler struct {
+	service *IntegratedRateLimiterService
+}
+
+// NewRuleHTTPHandler creates a new rule engine rule handler
+func NewRuleHTTPHandler(service *IntegratedRateLimiterService) *RuleHTTPHandler {
+	return &RuleHTTPHandler{service: service}
+}
+
+// RegisterRoutes adds the rule engine rule endpoints to mux
+func (h *RuleHTTPHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/v1/rules", h.CreateHandler)
+	mux.HandleFunc("GET /api/v1/rules", h.ListHandler)
+	mux.HandleFunc("PUT /api/v1/rules", h.ApplyHandler)
+	mux.HandleFunc("DELETE /api/v1/rules", h.DeleteHandler)
+	mux.HandleFunc("POST /api/v1/rules/bulk", h.BulkHandler)
+	mux.HandleFunc("GET /api/v1/rules/stats", h.ListStatsHandler)
+	mux.HandleFunc("GET /api/v1/rules/{id}", h.GetHandler)
+	mux.HandleFunc("PUT /api/v1/rules/{id}", h.ApplyHandler)
+	mux.HandleFunc("DELETE /api/v1/rules/{id}", h.DeleteHandler)
+	mux.HandleFunc("POST /api/v1/rules/{id}/enable", h.EnableHandler)
+	mux.HandleFunc("POST /api/v1/rules/{id}/disable", h.DisableHandler)
+	mux.HandleFunc("GET /api/v1/rules/{id}/stats", h.StatsHandler)
+	mux.HandleFunc("GET /api/v1/rule-changes", h.ListChangesHandler)
+	mux.HandleFunc("GET /api/v1/rule-changes/{id}", h.GetChangeHandler)
+	mux.HandleFunc("POST /api/v1/rule-changes/{id}/approve", h.ApproveChangeHandler)
+	mux.HandleFunc("POST /api/v1/rule-changes/{id}/reject", h.RejectChangeHandler)
+}
+
+// CreateHandler adds a rule, answering 409 when its ID is taken
+func (h *RuleHTTPHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	var rule ruleDomain.Rule
+	if !rateLimiterAPI.DecodeJSON(w, r, &rule) {
+		return
+	}
+
+	created, err := h.service.AddSecurityRule(r.Context(), rule)
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// ListHandler lists the rules, enabled or not, ordered by ID. The optional
+// type, tag (comma separated or repeated, matching rules with any of them)
+// and enabled parameters narrow the list down. Up to limit rules (100 by
+// default) are listed per page; next_cursor passed as cursor gets the next
+// page.
+func (h *RuleHTTPHandler) ListHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := ruleEngine.RuleFilter{
+		Type:  ruleDomain.RuleType(query.Get("type")),
+		Limit: 100, // default
+	}
+	for _, tags := range query["tag"] {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				filter.Tags = append(filter.Tags, tag)
+			}
+		}
+	}
+	if enabledStr := query.Get("enabled"); enabledStr != "" {
+		enabled, err := strconv.ParseBool(enabledStr)
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		filter.Enabled = &enabled
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 && parsedLimit <= 1000 {
+			filter.Limit = parsedLimit
+		}
+	}
+	if token := query.Get("cursor"); token != "" {
+		after, err := rateLimiterQueries.ParseRuleCursor(token)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter.After = after.ID
+	}
+
+	rules, more, err := h.service.ListSecurityRules(r.Context(), filter)
+	if err != nil {
+		rateLimiterAPI.WriteError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{"rules": rules}
+	if more {
+		response["next_cursor"] = rateLimiterQueries.RuleCursor{ID: rules[len(rules)-1].ID}.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetHandler returns a rule
+func (h *RuleHTTPHandler) GetHandler(w http.ResponseWriter, r *http.Request) {
+	rule, err := h.service.GetSecurityRule(r.Context(), r.PathValue("id"))
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// ApplyHandler creates or replaces the rule with the ID in the path, or in
+// the body when the path has none
+func (h *RuleHTTPHandler) ApplyHandler(w http.ResponseWriter, r *http.Request) {
+	var rule ruleDomain.Rule
+	if !rateLimiterAPI.DecodeJSON(w, r, &rule) {
+		return
+	}
+
+	if id := r.PathValue("id"); id != "" {
+		if rule.ID != "" && rule.ID != id {
+			http.Error(w, "id does not match the path", http.StatusBadRequest)
+			return
+		}
+		rule.ID = id
+	}
+
+	if err := h.service.ApplySecurityRule(r.Context(), rule); err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "applied"})
+}
+
+// DeleteHandler deletes the rule with the ID in the path, or in the id
+// parameter
+func (h *RuleHTTPHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID := r.PathValue("id")
+	if ruleID == "" {
+		ruleID = r.URL.Query().Get("id")
+	}
+	if ruleID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.DeleteSecurityRule(r.Context(), ruleID); err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnableHandler enables a rule, so that requests are evaluated against it
+func (h *RuleHTTPHandler) EnableHandler(w http.ResponseWriter, r *http.Request) {
+	h.setEnabled(w, r, true)
+}
+
+// DisableHandler disables a rule without deleting it
+func (h *RuleHTTPHandler) DisableHandler(w http.ResponseWriter, r *http.Request) {
+	h.setEnabled(w, r, false)
+}
+
+// BulkHandler enables, disables or deletes every rule with any of the tags
+// of the request, so that a group of rules, such as those created for an
+// incident, is managed in one call. It answers with the IDs of the rules
+// changed.
+func (h *RuleHTTPHandler) BulkHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags   []string `json:"tags"`
+		Action string   `json:"action"` // enable, disable or delete
+	}
+	if !rateLimiterAPI.DecodeJSON(w, r, &req) {
+		return
+	}
+
+	if len(req.Tags) == 0 {
+		http.Error(w, "tags is required", http.StatusBadRequest)
+		return
+	}
+	switch req.Action {
+	case ruleEngine.BulkEnable, ruleEngine.BulkDisable, ruleEngine.BulkDelete:
+	default:
+		http.Error(w, "action must be enable, disable or delete", http.StatusBadRequest)
+		return
+	}
+
+	ruleIDs, err := h.service.UpdateSecurityRulesByTags(r.Context(), req.Tags, req.Action)
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"action":   req.Action,
+		"tags":     req.Tags,
+		"rule_ids": ruleIDs,
+		"count":    len(ruleIDs),
+	})
+}
+
+// ListStatsHandler returns hit statistics for all active rules, least
+// matched first, and those of the result cache when it is enabled
+func (h *RuleHTTPHandler) ListStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.service.ListRuleStats(r.Context())
+	if err != nil {
+		rateLimiterAPI.WriteError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{"rules": stats}
+	if cacheStats := h.service.RuleResultCacheStats(); cacheStats != nil {
+		response["result_cache"] = cacheStats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StatsHandler returns hit statistics for a rule
+func (h *RuleHTTPHandler) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.service.GetRuleStats(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// setEnabled enables or disables the rule in the path
+func (h *RuleHTTPHandler) setEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	rule, err := h.service.SetSecurityRuleEnabled(r.Context(), r.PathValue("id"), enabled)
+	if err != nil {
+		WriteRuleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// WriteRuleError maps rule engine rule errors to status codes. A change
+// held pending approval is answered with 202 and the pending change.
+func WriteRuleError(w http.ResponseWriter, err error) {
+	var pending *PendingApprovalError
+	switch {
+	case errors.As(err, &pending):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(pending.Change)
+	case errors.Is(err, ruleDomain.ErrRuleNotFound), errors.Is(err, ErrRuleChangeNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrRuleExists), errors.Is(err, ErrRuleChangePending), errors.Is(err, ErrRuleChangeNotPending), errors.Is(err, ErrApprovalRequired):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrPrincipalRequired), errors.Is(err, ErrSelfApproval):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrInvalidRule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		rateLimiterAPI.WriteError(w, err)
+	}
+}
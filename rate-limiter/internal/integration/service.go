@@ -2,20 +2,38 @@ package integration
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
+	"github.com/NickChunglolz/rate-limiter/internal/challenge"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
 	rateLimiterAPI "github.com/NickChunglolz/rate-limiter/internal/api"
+	rateLimiterDomain "github.com/NickChunglolz/rate-limiter/internal/domain"
 	rateLimiterQueries "github.com/NickChunglolz/rate-limiter/internal/queries"
 	ruleEngine "github.com/NickChunglolz/rule-engine/engine"
 	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
 )
 
+// ErrInvalidRule is returned when a submitted rule fails validation
+var ErrInvalidRule = errors.New("invalid rule")
+
+// ErrRuleExists is returned when a rule is added with the ID of another
+var ErrRuleExists = errors.New("rule already exists")
+
 // IntegratedRateLimiterService combines rate limiting with rule engine
 type IntegratedRateLimiterService struct {
 	rateLimiterService *rateLimiterAPI.RateLimiterService
 	ruleEngine         *ruleEngine.RuleEngine
+	maxThrottleDelay   time.Duration
+	challenges         *challenge.Service
+	
+	// Approval workflow of high-impact rule changes, off when the policy is nil
+	approvalPolicy *ApprovalPolicy
+	ruleChanges    *ruleChanges
+	eventPublisher EventPublisher
 }
 
 // NewIntegratedRateLimiterService creates a new integrated service
@@ -26,9 +44,28 @@ func NewIntegratedRateLimiterService(
 	return &IntegratedRateLimiterService{
 		rateLimiterService: rateLimiterService,
 		ruleEngine:         ruleEngine,
+		challenges:         challenge.NewService(challenge.Config{TTL: 5 * time.Minute, PassTTL: 30 * time.Minute, Difficulty: 18}),
 	}
 }
 
+// WithMaxThrottleDelay caps the delay recommended by throttle rules
+func (s *IntegratedRateLimiterService) WithMaxThrottleDelay(maxDelay time.Duration) *IntegratedRateLimiterService {
+	s.maxThrottleDelay = maxDelay
+	return s
+}
+
+// WithChallenges sets the service that issues the challenges of challenge
+// rules and remembers the clients that solved one
+func (s *IntegratedRateLimiterService) WithChallenges(challenges *challenge.Service) *IntegratedRateLimiterService {
+	s.challenges = challenges
+	return s
+}
+
+// Challenges returns the service issuing challenges, to verify solutions
+func (s *IntegratedRateLimiterService) Challenges() *challenge.Service {
+	return s.challenges
+}
+
 // CheckRequestWithRules checks a request against both rules and rate limits
 func (s *IntegratedRateLimiterService) CheckRequestWithRules(
 	ctx context.Context,
@@ -48,20 +85,82 @@ func (s *IntegratedRateLimiterService) CheckRequestWithRules(
 		RequestData: requestData,
 	}
 	
+	return s.CheckRequest(ctx, evalCtx)
+}
+
+// CheckRequest checks a request described by a full rule evaluation context,
+// including its method, path, headers and query parameters. The decision
+// deadline covers the whole check; a check overrunning it, or failing for
+// want of storage, is decided by the failure policy.
+func (s *IntegratedRateLimiterService) CheckRequest(ctx context.Context, evalCtx ruleDomain.RuleEvaluationContext) (*RequestCheckResult, error) {
+	if evalCtx.Timestamp.IsZero() {
+		evalCtx.Timestamp = time.Now()
+	}
+	
+	ctx, cancel := s.rateLimiterService.DecisionContext(ctx)
+	defer cancel()
+	
+	// Let rules match on the client's registry entry, which requests cannot
+	// override
+	client, err := s.rateLimiterService.GetClient(ctx, evalCtx.ClientID)
+	switch {
+	case err == nil:
+		metadata := make(map[string]string, len(evalCtx.Metadata)+3)
+		for key, value := range evalCtx.Metadata {
+			metadata[key] = value
+		}
+		for key, value := range client.Attributes() {
+			metadata[key] = value
+		}
+		evalCtx.Metadata = metadata
+	case !errors.Is(err, rateLimiterDomain.ErrClientNotFound):
+		return s.decideUnavailable(ctx, evalCtx, StageRule, fmt.Errorf("failed to get client: %w", err))
+	}
+	
 	// Evaluate rules first
 	ruleResults, err := s.ruleEngine.EvaluateRules(ctx, evalCtx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to evaluate rules: %w", err)
+		return s.decideUnavailable(ctx, evalCtx, StageRule, fmt.Errorf("failed to evaluate rules: %w", err))
 	}
 	
 	// Check for blocking actions
+	trace := s.traceRules(ruleResults)
+	appliedActions := s.ruleEngine.GetMatchedActions(ruleResults)
 	if s.ruleEngine.HasBlockingAction(ruleResults) {
+		blockingRuleIDs := s.getBlockingRuleIDs(ruleResults)
 		return &RequestCheckResult{
 			Allowed:           false,
 			Reason:            "blocked by rule",
 			RuleResults:       ruleResults,
 			RateLimitStatus:   nil,
-			BlockingRuleID:    s.getFirstBlockingRuleID(ruleResults),
+			BlockingRuleID:    blockingRuleIDs[0],
+			BlockingRuleIDs:   blockingRuleIDs,
+			AppliedActions:    appliedActions,
+			Trace: append(trace, DecisionStep{
+				Stage:   StageDecision,
+				Outcome: "blocked",
+				Detail:  fmt.Sprintf("blocked by %d rule(s)", len(blockingRuleIDs)),
+			}),
+		}, nil
+	}
+	
+	// Challenge clients matched by challenge rules, unless they solved a
+	// challenge recently
+	if challengeRuleIDs, kind := s.getChallengeRules(ruleResults); len(challengeRuleIDs) > 0 && !s.challenges.Passed(evalCtx.ClientID) {
+		issued := s.challenges.Issue(evalCtx.ClientID, kind)
+		return &RequestCheckResult{
+			Allowed:         false,
+			Reason:          "challenge required",
+			RuleResults:     ruleResults,
+			BlockingRuleID:  challengeRuleIDs[0],
+			BlockingRuleIDs: challengeRuleIDs,
+			AppliedActions:  appliedActions,
+			Challenge:       issued,
+			Trace: append(trace, DecisionStep{
+				Stage:   StageDecision,
+				Outcome: "challenged",
+				Detail:  fmt.Sprintf("%s challenge required by %d rule(s)", issued.Kind, len(challengeRuleIDs)),
+			}),
 		}, nil
 	}
 	
@@ -69,14 +168,14 @@ func (s *IntegratedRateLimiterService) CheckRequestWithRules(
 	rateLimitActions := s.ruleEngine.GetRateLimitActions(ruleResults)
 	if len(rateLimitActions) > 0 {
 		// Apply dynamic rate limiting based on rule actions
-		err := s.applyDynamicRateLimiting(ctx, rateLimitActions, resource)
+		err := s.applyDynamicRateLimiting(ctx, rateLimitActions, evalCtx.Resource)
 		if err != nil {
-			return nil, fmt.Errorf("failed to apply dynamic rate limiting: %w", err)
+			return s.decideUnavailable(ctx, evalCtx, StageRateLimit, fmt.Errorf("failed to apply dynamic rate limiting: %w", err))
 		}
 	}
 	
 	// Check rate limits
-	rateLimitStatus, err := s.rateLimiterService.CheckRateLimit(ctx, clientID, resource, ipAddress, userAgent)
+	rateLimitStatus, err := s.rateLimiterService.CheckRequestRateLimit(ctx, evalCtx.Resource, KeyAttributes(evalCtx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to check rate limit: %w", err)
 	}
@@ -86,23 +185,124 @@ func (s *IntegratedRateLimiterService) CheckRequestWithRules(
 		Reason:          s.determineReason(rateLimitStatus, ruleResults),
 		RuleResults:     ruleResults,
 		RateLimitStatus: rateLimitStatus,
+		AppliedActions:  appliedActions,
+		Trace:           trace,
+	}
+	if rateLimitStatus.IsAllowed {
+		result.ThrottleDelay = s.throttleDelay(ruleResults)
 	}
 	
+	rateLimitStep := DecisionStep{
+		Stage:   StageRateLimit,
+		Outcome: "allowed",
+		Detail:  fmt.Sprintf("%d of %d remaining for key %q", rateLimitStatus.RemainingQuota, rateLimitStatus.Limit, rateLimitStatus.ClientID),
+	}
+	decisionStep := DecisionStep{
+		Stage:   StageDecision,
+		Outcome: "allowed",
+	}
 	if !rateLimitStatus.IsAllowed {
-		result.Reason = "rate limited"
+		rateLimitStep.Outcome = "denied"
+		rateLimitStep.Detail = fmt.Sprintf("limit of %d reached, retry after %ds", rateLimitStatus.Limit, rateLimitStatus.RetryAfter)
+		decisionStep.Outcome = "rate_limited"
+	}
+	if rateLimitStatus.Reason != "" {
+		rateLimitStep.Detail = rateLimitStatus.Reason
 	}
+	decisionStep.Detail = result.Reason
+	result.Trace = append(result.Trace, rateLimitStep, decisionStep)
 	
 	return result, nil
 }
 
+// decideUnavailable decides a request whose check failed with err at stage,
+// such as when storage is unavailable or the decision deadline passed, by
+// the failure policy, or returns err when the policy fails the check. The
+// rules are not applied to a request decided so.
+func (s *IntegratedRateLimiterService) decideUnavailable(ctx context.Context, evalCtx ruleDomain.RuleEvaluationContext, stage string, err error) (*RequestCheckResult, error) {
+	status := s.rateLimiterService.DecideUnavailable(ctx, evalCtx.ClientID, evalCtx.Resource, evalCtx.Method, err)
+	if status == nil {
+		return nil, err
+	}
+	
+	outcome := "allowed"
+	if !status.IsAllowed {
+		outcome = "denied"
+	}
+	return &RequestCheckResult{
+		Allowed:         status.IsAllowed,
+		Reason:          status.Reason,
+		RateLimitStatus: status,
+		Trace: []DecisionStep{
+			{Stage: stage, Outcome: "failed", Detail: err.Error()},
+			{Stage: StageDecision, Outcome: outcome, Detail: status.Reason + ", " + status.Degraded},
+		},
+	}, nil
+}
+
 // RequestCheckResult contains the result of an integrated request check
 type RequestCheckResult struct {
 	Allowed           bool                              `json:"allowed"`
 	Reason            string                            `json:"reason"`
 	RuleResults       []ruleDomain.RuleEvaluationResult `json:"rule_results"`
 	RateLimitStatus   *rateLimiterQueries.RateLimitStatus `json:"rate_limit_status"`
-	BlockingRuleID    string                            `json:"blocking_rule_id,omitempty"`
+	BlockingRuleID    string                            `json:"blocking_rule_id,omitempty"` // First of BlockingRuleIDs
+	BlockingRuleIDs   []string                          `json:"blocking_rule_ids,omitempty"`
 	AppliedActions    []ruleDomain.RuleAction           `json:"applied_actions"`
+	Trace             []DecisionStep                    `json:"trace"`
+	ThrottleDelay     time.Duration                     `json:"throttle_delay_ns,omitempty"` // Recommended delay before serving an allowed request
+	Challenge         *challenge.Challenge              `json:"challenge,omitempty"`         // What the client must solve to be let through
+}
+
+// Decision trace stages
+const (
+	StageRule      = "rule"
+	StageRateLimit = "rate_limit"
+	StageDecision  = "decision"
+)
+
+// DecisionStep records one step of how a request check reached its decision
+type DecisionStep struct {
+	Stage    string   `json:"stage"`
+	RuleID   string   `json:"rule_id,omitempty"`
+	RuleName string   `json:"rule_name,omitempty"`
+	Actions  []string `json:"actions,omitempty"` // Action types of a matched rule
+	Outcome  string   `json:"outcome"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+// Decision classifies the result for access logging
+func (r *RequestCheckResult) Decision() accesslog.Decision {
+	switch {
+	case r.Allowed:
+		return accesslog.DecisionAllowed
+	case r.Challenge != nil:
+		return accesslog.DecisionChallenged
+	case r.RateLimitStatus == nil:
+		return accesslog.DecisionBlockedByRule
+	default:
+		return accesslog.DecisionDenied
+	}
+}
+
+// MatchedRuleIDs returns the IDs of all rules that matched the request
+func (r *RequestCheckResult) MatchedRuleIDs() []string {
+	var ids []string
+	for _, result := range r.RuleResults {
+		if result.Matched {
+			ids = append(ids, result.RuleID)
+		}
+	}
+	return ids
+}
+
+// RemainingQuota returns the remaining rate limit quota, or 0 when the
+// request never reached the rate limiter
+func (r *RequestCheckResult) RemainingQuota() int {
+	if r.RateLimitStatus == nil {
+		return 0
+	}
+	return r.RateLimitStatus.RemainingQuota
 }
 
 // applyDynamicRateLimiting applies rate limiting rules dynamically
@@ -157,9 +357,46 @@ func (s *IntegratedRateLimiterService) applyDynamicRateLimiting(
 				algorithmStr = "sliding_window" // default
 			}
 			
+			// Optional key template, e.g. "header.X-Api-Key" or "ip+path",
+			// and HTTP method the limit applies to
+			keyTemplate, _ := action.Parameters["key"].(string)
+			method, _ := action.Parameters["method"].(string)
+			
+			// Optional fraction of the limit at which clients are warned
+			softThreshold, _ := action.Parameters["soft_threshold"].(float64)
+			
+			// Optional algorithm parameters, e.g. {"token_bucket": {"refill_rate": 5}}
+			parameters, err := rateLimiterDomain.ParseAlgorithmParameters(action.Parameters["parameters"])
+			if err != nil {
+				continue // Skip invalid action
+			}
+			
+			// Optional extra windows, e.g. [{"limit": 1000, "window": "1h"}]
+			windows, err := rateLimiterDomain.ParseWindowLimits(action.Parameters["windows"])
+			if err != nil {
+				continue // Skip invalid action
+			}
+			
+			// Optional feature flag gating the limit, e.g. "enforce-strict-login-limits"
+			flag, _ := action.Parameters["flag"].(string)
+			
 			if limitInt > 0 && windowDuration > 0 {
 				// Create or update the rate limiting rule
-				err := s.rateLimiterService.CreateRule(ctx, resource, limitInt, windowDuration, algorithmStr)
+				err := s.rateLimiterService.CreateRule(ctx, rateLimiterAPI.RuleSpec{
+					Resource:      resource,
+					Method:        method,
+					Limit:         limitInt,
+					Window:        windowDuration,
+					Algorithm:     algorithmStr,
+					KeyTemplate:   keyTemplate,
+					SoftThreshold: softThreshold,
+					Parameters:    parameters,
+					Windows:       windows,
+					Flag:          flag,
+					Annotations: rateLimiterDomain.RuleAnnotations{
+						Description: "Created by a rate_limit action of the rule engine",
+					},
+				})
 				if err != nil {
 					return fmt.Errorf("failed to create dynamic rate limit rule: %w", err)
 				}
@@ -170,18 +407,86 @@ func (s *IntegratedRateLimiterService) applyDynamicRateLimiting(
 	return nil
 }
 
-// getFirstBlockingRuleID returns the ID of the first blocking rule
-func (s *IntegratedRateLimiterService) getFirstBlockingRuleID(results []ruleDomain.RuleEvaluationResult) string {
+// throttleDelay returns the delay requested by matched throttle rules,
+// capped at the configured maximum
+func (s *IntegratedRateLimiterService) throttleDelay(results []ruleDomain.RuleEvaluationResult) time.Duration {
+	delay := s.ruleEngine.GetThrottleDelay(results)
+	if s.maxThrottleDelay > 0 && delay > s.maxThrottleDelay {
+		return s.maxThrottleDelay
+	}
+	return delay
+}
+
+// getBlockingRuleIDs returns the IDs of all matched rules with a blocking
+// action, in evaluation order
+func (s *IntegratedRateLimiterService) getBlockingRuleIDs(results []ruleDomain.RuleEvaluationResult) []string {
+	var ids []string
 	for _, result := range results {
 		if result.Matched {
 			for _, action := range result.Actions {
 				if action.Type == "deny" || action.Type == "block" {
-					return result.RuleID
+					ids = append(ids, result.RuleID)
+					break
 				}
 			}
 		}
 	}
-	return ""
+	return ids
+}
+
+// getChallengeRules returns the IDs of all matched rules with a challenge
+// action, in evaluation order, and the kind of challenge the first of them
+// asks for
+func (s *IntegratedRateLimiterService) getChallengeRules(results []ruleDomain.RuleEvaluationResult) ([]string, string) {
+	var (
+		ids  []string
+		kind string
+	)
+	for _, result := range results {
+		if !result.Matched {
+			continue
+		}
+		for _, action := range result.Actions {
+			if action.Type == "challenge" {
+				if len(ids) == 0 {
+					kind, _ = action.ChallengeKind()
+				}
+				ids = append(ids, result.RuleID)
+				break
+			}
+		}
+	}
+	return ids, kind
+}
+	
+// traceRules records a trace step for every matched rule
+func (s *IntegratedRateLimiterService) traceRules(results []ruleDomain.RuleEvaluationResult) []DecisionStep {
+	var steps []DecisionStep
+	for _, result := range results {
+		if !result.Matched {
+			continue
+		}
+		
+		step := DecisionStep{
+			Stage:    StageRule,
+			RuleID:   result.RuleID,
+			RuleName: result.RuleName,
+			Outcome:  "matched",
+		}
+		for _, action := range result.Actions {
+			step.Actions = append(step.Actions, action.Type)
+			switch action.Type {
+			case "deny", "block":
+				step.Outcome = "blocked"
+			case "challenge":
+				if step.Outcome != "blocked" {
+					step.Outcome = "challenged"
+				}
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps
 }
 
 // determineReason determines the reason for allowing/blocking a request
@@ -189,6 +494,12 @@ func (s *IntegratedRateLimiterService) determineReason(
 	rateLimitStatus *rateLimiterQueries.RateLimitStatus,
 	ruleResults []ruleDomain.RuleEvaluationResult,
 ) string {
+	// Freezes and the storage failure policy record why they decided the
+	// request
+	if rateLimitStatus.Reason != "" {
+		return rateLimitStatus.Reason
+	}
+	
 	if !rateLimitStatus.IsAllowed {
 		return "rate limited"
 	}
@@ -202,6 +513,8 @@ func (s *IntegratedRateLimiterService) determineReason(
 					return "allowed by rule"
 				case "throttle":
 					return "throttled by rule"
+				case "challenge":
+					return "challenge passed"
 				}
 			}
 		}
@@ -230,9 +543,122 @@ func (s *IntegratedRateLimiterService) CreateSecurityRule(
 		Tags:        []string{"security", "auto-generated"},
 	}
 	
+	return s.createRule(ctx, rule)
+}
+
+// createRule creates or replaces a rule engine rule, unless the change
+// needs approval, in which case it is held pending
+func (s *IntegratedRateLimiterService) createRule(ctx context.Context, rule ruleDomain.Rule) error {
+	if err := s.holdForApproval(ctx, rule); err != nil {
+		return err
+	}
 	return s.ruleEngine.CreateRule(ctx, rule)
 }
 
+// ApplySecurityRule creates or replaces a rule engine rule by ID. The rule
+// engine attributes the change to the principal of ctx; a replaced rule
+// keeps its creator.
+func (s *IntegratedRateLimiterService) ApplySecurityRule(ctx context.Context, rule ruleDomain.Rule) error {
+	if rule.ID == "" {
+		return fmt.Errorf("%w: rule id is required", ErrInvalidRule)
+	}
+	if err := s.ruleEngine.ValidateRule(rule); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	
+	return s.createRule(ctx, rule)
+}
+
+// AddSecurityRule creates a rule engine rule, with a generated ID when it
+// has none, on behalf of the principal of ctx and returns it as stored
+func (s *IntegratedRateLimiterService) AddSecurityRule(ctx context.Context, rule ruleDomain.Rule) (*ruleDomain.Rule, error) {
+	if rule.ID == "" {
+		rule.ID = fmt.Sprintf("rule-%d", time.Now().UnixNano())
+	} else if _, err := s.ruleEngine.GetRule(ctx, rule.ID); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRuleExists, rule.ID)
+	} else if !errors.Is(err, ruleDomain.ErrRuleNotFound) {
+		return nil, err
+	}
+	if err := s.ruleEngine.ValidateRule(rule); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	
+	if err := s.createRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	return s.ruleEngine.GetRule(ctx, rule.ID)
+}
+
+// GetSecurityRule returns a rule engine rule by ID
+func (s *IntegratedRateLimiterService) GetSecurityRule(ctx context.Context, ruleID string) (*ruleDomain.Rule, error) {
+	return s.ruleEngine.GetRule(ctx, ruleID)
+}
+
+// ListSecurityRules lists the rule engine rules matching filter, ordered by
+// ID, and reports whether more follow
+func (s *IntegratedRateLimiterService) ListSecurityRules(ctx context.Context, filter ruleEngine.RuleFilter) ([]ruleDomain.Rule, bool, error) {
+	return s.ruleEngine.ListRules(ctx, filter)
+}
+
+// SetSecurityRuleEnabled enables or disables a rule engine rule without
+// replacing it. Enabling a high-impact rule is held pending approval.
+func (s *IntegratedRateLimiterService) SetSecurityRuleEnabled(ctx context.Context, ruleID string, enabled bool) (*ruleDomain.Rule, error) {
+	if enabled && s.approvalPolicy != nil {
+		rule, err := s.ruleEngine.GetRule(ctx, ruleID)
+		if err != nil {
+			return nil, err
+		}
+		if !rule.Enabled {
+			enabledRule := *rule
+			enabledRule.Enabled = true
+			if err := s.holdForApproval(ctx, enabledRule); err != nil {
+				return nil, err
+			}
+		}
+	}
+	
+	return s.ruleEngine.SetRuleEnabled(ctx, ruleID, enabled, principal.FromContext(ctx))
+}
+
+// UpdateSecurityRulesByTags enables, disables or deletes the rule engine
+// rules with any of tags, returning the IDs of those it changed. Rules
+// needing approval once enabled are not enabled in bulk.
+func (s *IntegratedRateLimiterService) UpdateSecurityRulesByTags(ctx context.Context, tags []string, action string) ([]string, error) {
+	if action == ruleEngine.BulkEnable && s.approvalPolicy != nil {
+		disabled := false
+		rules, _, err := s.ruleEngine.ListRules(ctx, ruleEngine.RuleFilter{Tags: tags, Enabled: &disabled})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.requireNoApproval(rules); err != nil {
+			return nil, err
+		}
+	}
+	
+	return s.ruleEngine.UpdateRulesByTags(ctx, tags, action, principal.FromContext(ctx))
+}
+
+// DeleteSecurityRule deletes a rule engine rule by ID
+func (s *IntegratedRateLimiterService) DeleteSecurityRule(ctx context.Context, ruleID string) error {
+	return s.ruleEngine.DeleteRule(ctx, ruleID)
+}
+
+// GetRuleStats returns hit statistics for a rule engine rule
+func (s *IntegratedRateLimiterService) GetRuleStats(ctx context.Context, ruleID string) (*ruleDomain.RuleStats, error) {
+	return s.ruleEngine.GetRuleStats(ctx, ruleID)
+}
+
+// ListRuleStats returns hit statistics for every active rule engine rule
+func (s *IntegratedRateLimiterService) ListRuleStats(ctx context.Context) ([]ruleDomain.RuleStats, error) {
+	return s.ruleEngine.ListRuleStats(ctx)
+}
+
+// RuleResultCacheStats returns the statistics of the rule result cache, or
+// nil when it is disabled
+func (s *IntegratedRateLimiterService) RuleResultCacheStats() *ruleEngine.ResultCacheStats {
+	return s.ruleEngine.ResultCacheStats()
+}
+
 // CreateIPBasedRule creates an IP-based blocking or rate limiting rule
 func (s *IntegratedRateLimiterService) CreateIPBasedRule(
 	ctx context.Context,
@@ -279,7 +705,7 @@ func (s *IntegratedRateLimiterService) CreateIPBasedRule(
 		Tags:        []string{"ip-based", "auto-generated"},
 	}
 	
-	return s.ruleEngine.CreateRule(ctx, rule)
+	return s.createRule(ctx, rule)
 }
 
 // CreateResourceBasedRule creates a resource-specific rule
@@ -327,5 +753,5 @@ func (s *IntegratedRateLimiterService) CreateResourceBasedRule(
 		Tags:        []string{"resource-based", "auto-generated"},
 	}
 	
-	return s.ruleEngine.CreateRule(ctx, rule)
+	return s.createRule(ctx, rule)
 }
@@ -0,0 +1,202 @@
+package keytemplate
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Field prefixes for request headers and query parameters
+const (
+	HeaderPrefix = "header."
+	QueryPrefix  = "query."
+)
+
+// Attributes are the request attributes a key can be built from
+type Attributes struct {
+	ClientID  string
+	Resource  string
+	IPAddress string
+	UserAgent string
+	Method    string
+	Path      string
+	Header    http.Header
+	Query     url.Values
+}
+
+// FromRequest returns the attributes of an HTTP request
+func FromRequest(r *http.Request, clientID, resource, ipAddress string) Attributes {
+	return Attributes{
+		ClientID:  clientID,
+		Resource:  resource,
+		IPAddress: ipAddress,
+		UserAgent: r.UserAgent(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Header:    r.Header,
+		Query:     r.URL.Query(),
+	}
+}
+
+// HeaderFromMap builds a header from single values keyed by name
+func HeaderFromMap(values map[string]string) http.Header {
+	header := make(http.Header, len(values))
+	for name, value := range values {
+		header.Set(name, value)
+	}
+	return header
+}
+
+// QueryFromMap builds query parameters from single values keyed by name
+func QueryFromMap(values map[string]string) url.Values {
+	query := make(url.Values, len(values))
+	for name, value := range values {
+		query.Set(name, value)
+	}
+	return query
+}
+
+// Template builds rate limit keys from request attributes. Templates are
+// either text with {field} placeholders, e.g. "{ip_address}:{path}", or the
+// shorthand "ip+path", which joins the named fields with ":". Fields are
+// client_id, resource, ip_address (or ip), user_agent, method, path,
+// header.<Name>, query.<name>, and session or session.<cookie>, which hash
+// the request's session token (see Session).
+type Template struct {
+	text  string
+	parts []part
+}
+
+// part is a literal, or a field when field is set
+type part struct {
+	literal string
+	field   string
+	name    string // Header, query parameter or session cookie name
+}
+
+// Parse parses a key template
+func Parse(text string) (*Template, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, fmt.Errorf("key template is empty")
+	}
+
+	t := &Template{text: text}
+	if !strings.ContainsAny(text, "{}") {
+		for i, field := range strings.Split(text, "+") {
+			if i > 0 {
+				t.parts = append(t.parts, part{literal: ":"})
+			}
+			p, err := parseField(strings.TrimSpace(field))
+			if err != nil {
+				return nil, err
+			}
+			t.parts = append(t.parts, p)
+		}
+		return t, nil
+	}
+
+	rest := text
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in key template %q", text)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{literal: rest[:open]})
+		}
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{' in key template %q", text)
+		}
+		p, err := parseField(strings.TrimSpace(rest[open+1 : open+end]))
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, p)
+		rest = rest[open+end+1:]
+	}
+
+	return t, nil
+}
+
+// parseField parses a field reference
+func parseField(field string) (part, error) {
+	switch field {
+	case "client_id", "resource", "ip_address", "user_agent", "method", "path", "session":
+		return part{field: field}, nil
+	case "ip":
+		return part{field: "ip_address"}, nil
+	}
+
+	for _, prefix := range []string{HeaderPrefix, QueryPrefix, SessionPrefix} {
+		if name, ok := strings.CutPrefix(field, prefix); ok {
+			if name == "" {
+				return part{}, fmt.Errorf("key template field %q has no name", field)
+			}
+			if prefix == HeaderPrefix {
+				name = http.CanonicalHeaderKey(name)
+			}
+			return part{field: prefix, name: name}, nil
+		}
+	}
+
+	return part{}, fmt.Errorf("unknown key template field %q", field)
+}
+
+// String returns the template text
+func (t *Template) String() string {
+	return t.text
+}
+
+// Render builds the key for attrs. It reports false when a referenced field
+// is empty, so callers can fall back to another key rather than grouping
+// every request without, say, an API key under one key.
+func (t *Template) Render(attrs Attributes) (string, bool) {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		value := attrs.value(p)
+		if value == "" {
+			return "", false
+		}
+		b.WriteString(value)
+	}
+	return b.String(), true
+}
+
+// value returns the value of a field part
+func (a Attributes) value(p part) string {
+	switch p.field {
+	case "client_id":
+		return a.ClientID
+	case "resource":
+		return a.Resource
+	case "ip_address":
+		return a.IPAddress
+	case "user_agent":
+		return a.UserAgent
+	case "method":
+		return a.Method
+	case "path":
+		return a.Path
+	case HeaderPrefix:
+		return a.Header.Get(p.name)
+	case QueryPrefix:
+		return a.Query.Get(p.name)
+	case "session":
+		return Session(a.Header, "")
+	case SessionPrefix:
+		return Session(a.Header, p.name)
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package keytemplate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// SessionPrefix is the field prefix naming the cookie a session is read from
+const SessionPrefix = "session."
+
+// DefaultSessionCookies are the cookies the session field reads, in order,
+// when the request has no bearer token
+var DefaultSessionCookies = []string{"session", "session_id", "sessionid", "sid", "connect.sid", "JSESSIONID", "PHPSESSID"}
+
+// Session returns the hashed session token of a request: the named cookie,
+// or when cookie is empty the bearer token of the Authorization header or
+// else the first of DefaultSessionCookies. It returns "" when the request
+// has no session.
+func Session(header http.Header, cookie string) string {
+	if cookie != "" {
+		return HashSession(cookieValue(header, cookie))
+	}
+
+	scheme, token, _ := strings.Cut(header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token != "" {
+			return HashSession(token)
+		}
+	}
+	for _, name := range DefaultSessionCookies {
+		if value := cookieValue(header, name); value != "" {
+			return HashSession(value)
+		}
+	}
+	return ""
+}
+
+// HashSession hashes a session token for use in keys, so that tokens never
+// reach storage or logs. Tokens are high entropy, so a plain SHA-256 cannot
+// be reversed, and unlike a keyed hash it is the same on every instance.
+// Empty tokens hash to "".
+func HashSession(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// cookieValue returns the value of a cookie. Cookie headers joined with ", "
+// by proxies or header flattening are split again: cookie values cannot
+// contain commas.
+func cookieValue(header http.Header, name string) string {
+	for _, line := range header.Values("Cookie") {
+		for _, pair := range strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r == ',' }) {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && key == name {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package locks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// Elector elects one leader among the instances sharing a lock provider and
+// runs the registered workers on the leader only. When the leader stops
+// refreshing its lock another instance takes over within the ttl and starts
+// the workers there.
+type Elector struct {
+	provider Provider
+	name     string
+	identity string
+	ttl      time.Duration
+	clock    domain.Clock
+
+	mutex       sync.RWMutex
+	workers     []leaderWorker
+	leader      bool
+	leaderSince time.Time
+	terms       int
+}
+
+// leaderWorker is a job that runs while this instance leads
+type leaderWorker struct {
+	name string
+	job  func(ctx context.Context)
+}
+
+// ElectionStatus is this instance's view of an election
+type ElectionStatus struct {
+	Election    string     `json:"election"`
+	Identity    string     `json:"identity"`
+	Leader      bool       `json:"leader"`
+	LeaderSince *time.Time `json:"leader_since,omitempty"`
+	Terms       int        `json:"terms"` // Times this instance became leader
+	TTL         string     `json:"ttl"`
+	Workers     []string   `json:"workers"`
+}
+
+// NewElector creates an elector for the election name, in which this
+// instance stands as identity
+func NewElector(provider Provider, name, identity string, ttl time.Duration) *Elector {
+	return &Elector{
+		provider: provider,
+		name:     name,
+		identity: identity,
+		ttl:      ttl,
+		clock:    domain.SystemClock{},
+	}
+}
+
+// WithClock sets the clock leadership is timed with
+func (e *Elector) WithClock(clock domain.Clock) *Elector {
+	e.clock = clock
+	return e
+}
+
+// Go registers a worker to run while this instance leads. Its context is
+// cancelled when leadership is lost, and it is started again on the next
+// term, so it must be safe to restart. Workers must be registered before
+// Run.
+func (e *Elector) Go(name string, job func(ctx context.Context)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.workers = append(e.workers, leaderWorker{name: name, job: job})
+}
+
+// Run stands for election until ctx is done, leading whenever this instance
+// holds the election's lock
+func (e *Elector) Run(ctx context.Context) {
+	RunExclusive(ctx, e.provider, e.name, e.ttl, e.lead)
+}
+
+// lead runs the workers for one term, which lasts until ctx is cancelled
+// even if the workers return earlier
+func (e *Elector) lead(ctx context.Context) {
+	e.mutex.Lock()
+	e.leader = true
+	e.leaderSince = e.clock.Now()
+	e.terms++
+	workers := e.workers
+	e.mutex.Unlock()
+
+	defer func() {
+		e.mutex.Lock()
+		e.leader = false
+		e.mutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker leaderWorker) {
+			defer wg.Done()
+			worker.job(ctx)
+		}(worker)
+	}
+	<-ctx.Done()
+	wg.Wait()
+}
+
+// IsLeader reports whether this instance currently leads
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leader
+}
+
+// Status returns this instance's view of the election
+func (e *Elector) Status() ElectionStatus {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	status := ElectionStatus{
+		Election: e.name,
+		Identity: e.identity,
+		Leader:   e.leader,
+		Terms:    e.terms,
+		TTL:      e.ttl.String(),
+		Workers:  make([]string, 0, len(e.workers)),
+	}
+	if e.leader {
+		since := e.leaderSince
+		status.LeaderSince = &since
+	}
+	for _, worker := range e.workers {
+		status.Workers = append(status.Workers, worker.name)
+	}
+	return status
+}
@@ -0,0 +1,184 @@
+package locks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdKeyPrefix namespaces lock keys in etcd
+const etcdKeyPrefix = "/rate-limiter/locks/"
+
+// EtcdProvider grants locks as etcd keys attached to a lease, through the
+// JSON gateway of the v3 API. A key is created only if it does not exist,
+// and disappears with its lease when the holder stops keeping it alive.
+type EtcdProvider struct {
+	endpoints  []string
+	httpClient *http.Client
+}
+
+// NewEtcdProvider creates a provider for the cluster at the given client
+// endpoints, such as http://etcd-0:2379
+func NewEtcdProvider(endpoints []string, httpClient *http.Client) (*EtcdProvider, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	provider := &EtcdProvider{httpClient: httpClient}
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if endpoint == "" {
+			continue
+		}
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		provider.endpoints = append(provider.endpoints, endpoint)
+	}
+	if len(provider.endpoints) == 0 {
+		return nil, fmt.Errorf("at least one etcd endpoint is required")
+	}
+	return provider, nil
+}
+
+// etcdLeaseResponse is the response of granting or keeping alive a lease.
+// The gateway encodes 64 bit integers as strings.
+type etcdLeaseResponse struct {
+	ID    string `json:"ID"`
+	TTL   string `json:"TTL"`
+	Error string `json:"error"`
+}
+
+// etcdKeepAliveResponse wraps the keepalive stream's single response
+type etcdKeepAliveResponse struct {
+	Result etcdLeaseResponse `json:"result"`
+}
+
+// etcdTxnResponse is the response of a transaction
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// TryLock grants a lease of ttl and creates the lock key on it, or revokes
+// the lease and returns ErrLockHeld when the key exists
+func (p *EtcdProvider) TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	var lease etcdLeaseResponse
+	if err := p.call(ctx, "/v3/lease/grant", map[string]any{"TTL": seconds}, &lease); err != nil {
+		return nil, err
+	}
+	if lease.ID == "" {
+		return nil, fmt.Errorf("etcd: lease grant returned no lease: %s", lease.Error)
+	}
+
+	lock := &etcdLock{provider: p, leaseID: lease.ID}
+	key := base64.StdEncoding.EncodeToString([]byte(etcdKeyPrefix + name))
+	txn := map[string]any{
+		"compare": []map[string]any{{
+			"key":             key,
+			"target":          "CREATE",
+			"result":          "EQUAL",
+			"create_revision": "0",
+		}},
+		"success": []map[string]any{{
+			"request_put": map[string]any{
+				"key":   key,
+				"value": base64.StdEncoding.EncodeToString([]byte(newToken())),
+				"lease": lease.ID,
+			},
+		}},
+	}
+
+	var result etcdTxnResponse
+	if err := p.call(ctx, "/v3/kv/txn", txn, &result); err != nil {
+		unlock(lock, name)
+		return nil, err
+	}
+	if !result.Succeeded {
+		unlock(lock, name)
+		return nil, ErrLockHeld
+	}
+	return lock, nil
+}
+
+// call posts a request to the first endpoint that answers and decodes its
+// response into out
+func (p *EtcdProvider) call(ctx context.Context, path string, request, out any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range p.endpoints {
+		lastErr = p.post(ctx, endpoint+path, body, out)
+		if lastErr == nil || ctx.Err() != nil {
+			return lastErr
+		}
+	}
+	return lastErr
+}
+
+// post posts body to url and decodes the response into out
+func (p *EtcdProvider) post(ctx context.Context, url string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("etcd: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("etcd: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("etcd: decode response: %w", err)
+	}
+	return nil
+}
+
+// etcdLock is a lock key held on an etcd lease
+type etcdLock struct {
+	provider *EtcdProvider
+	leaseID  string
+}
+
+// Refresh keeps the lease alive, and returns ErrLockLost once it expired
+func (l *etcdLock) Refresh(ctx context.Context) error {
+	var resp etcdKeepAliveResponse
+	if err := l.provider.call(ctx, "/v3/lease/keepalive", map[string]any{"ID": l.leaseID}, &resp); err != nil {
+		return err
+	}
+	if ttl, err := strconv.ParseInt(resp.Result.TTL, 10, 64); err != nil || ttl <= 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Unlock revokes the lease, deleting the lock key with it
+func (l *etcdLock) Unlock(ctx context.Context) error {
+	var resp etcdLeaseResponse
+	err := l.provider.call(ctx, "/v3/lease/revoke", map[string]any{"ID": l.leaseID}, &resp)
+	if err != nil && strings.Contains(err.Error(), "requested lease not found") {
+		// Already expired, and the key with it
+		return nil
+	}
+	return err
+}
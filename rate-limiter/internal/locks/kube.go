@@ -0,0 +1,260 @@
+package locks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// kubeMicroTime is the layout of the MicroTime fields of a Lease
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// KubeLeaseProvider grants locks as Kubernetes coordination.k8s.io/v1 Lease
+// objects, the mechanism controllers use for leader election. A lease is
+// taken when it is free or its holder has not renewed it within its
+// duration, and every update carries the resourceVersion it read, so of two
+// instances racing for a lease only one succeeds.
+type KubeLeaseProvider struct {
+	baseURL    string
+	token      string
+	namespace  string
+	identity   string
+	httpClient *http.Client
+}
+
+// kubeLease is the part of a Lease object the provider reads and writes
+type kubeLease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   kubeLeaseMeta `json:"metadata"`
+	Spec       kubeLeaseSpec `json:"spec"`
+}
+
+// kubeLeaseMeta is the metadata of a Lease
+type kubeLeaseMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// kubeLeaseSpec is the spec of a Lease
+type kubeLeaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity"`
+	LeaseDurationSeconds int     `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string  `json:"acquireTime,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+	LeaseTransitions     int     `json:"leaseTransitions"`
+}
+
+// NewKubeLeaseProvider creates a provider keeping leases in namespace of the
+// API server at baseURL, held as identity, such as the pod name. The token
+// may be empty, e.g. when talking to `kubectl proxy`, and an empty namespace
+// is the default one.
+func NewKubeLeaseProvider(baseURL, token string, httpClient *http.Client, namespace, identity string) *KubeLeaseProvider {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &KubeLeaseProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		namespace:  namespace,
+		identity:   identity,
+		httpClient: httpClient,
+	}
+}
+
+// TryLock creates the lease name, or takes it over once it is free or
+// expired, and returns ErrLockHeld while another holder renews it
+func (p *KubeLeaseProvider) TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	now := time.Now()
+	lease, status, err := p.request(ctx, http.MethodGet, p.leasePath(name), nil)
+	switch {
+	case status == http.StatusNotFound:
+		lease = &kubeLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kubeLeaseMeta{Name: name, Namespace: p.namespace},
+		}
+		p.hold(lease, ttl, now)
+		created, status, err := p.request(ctx, http.MethodPost, p.leasesPath(), lease)
+		if status == http.StatusConflict {
+			return nil, ErrLockHeld
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &kubeLeaseLock{provider: p, name: name, ttl: ttl, resourceVersion: created.Metadata.ResourceVersion}, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" && !leaseExpired(lease, now) {
+		return nil, ErrLockHeld
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != p.identity {
+		lease.Spec.LeaseTransitions++
+	}
+	p.hold(lease, ttl, now)
+	updated, status, err := p.request(ctx, http.MethodPut, p.leasePath(name), lease)
+	if status == http.StatusConflict {
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kubeLeaseLock{provider: p, name: name, ttl: ttl, resourceVersion: updated.Metadata.ResourceVersion}, nil
+}
+
+// hold sets this instance as the holder of lease from now
+func (p *KubeLeaseProvider) hold(lease *kubeLease, ttl time.Duration, now time.Time) {
+	identity := p.identity
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = int(math.Ceil(ttl.Seconds()))
+	lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+	lease.Spec.RenewTime = lease.Spec.AcquireTime
+}
+
+// leaseExpired reports whether the holder of lease failed to renew it within
+// its duration
+func leaseExpired(lease *kubeLease, now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+	return !now.Before(renewed.Add(duration))
+}
+
+// leasesPath is the path of the leases of the namespace
+func (p *KubeLeaseProvider) leasesPath() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + p.namespace + "/leases"
+}
+
+// leasePath is the path of the lease name
+func (p *KubeLeaseProvider) leasePath(name string) string {
+	return p.leasesPath() + "/" + name
+}
+
+// request sends a lease to path, or none for a GET, and returns the lease
+// in the response with its status code
+func (p *KubeLeaseProvider) request(ctx context.Context, method, path string, lease *kubeLease) (*kubeLease, int, error) {
+	var body io.Reader
+	if lease != nil {
+		data, err := json.Marshal(lease)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if lease != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("kubernetes: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("kubernetes: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, resp.StatusCode, fmt.Errorf("kubernetes: %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var result kubeLease
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("kubernetes: decode lease: %w", err)
+	}
+	return &result, resp.StatusCode, nil
+}
+
+// kubeLeaseLock is a Lease held by this instance
+type kubeLeaseLock struct {
+	provider        *KubeLeaseProvider
+	name            string
+	ttl             time.Duration
+	resourceVersion string
+}
+
+// Refresh renews the lease, and returns ErrLockLost once another holder
+// took it over
+func (l *kubeLeaseLock) Refresh(ctx context.Context) error {
+	p := l.provider
+	lease, err := l.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	lease.Spec.RenewTime = time.Now().UTC().Format(kubeMicroTime)
+	updated, status, err := p.request(ctx, http.MethodPut, p.leasePath(l.name), lease)
+	if status == http.StatusConflict {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	l.resourceVersion = updated.Metadata.ResourceVersion
+	return nil
+}
+
+// Unlock clears the holder of the lease so another instance can take it at
+// once, unless it was already taken over
+func (l *kubeLeaseLock) Unlock(ctx context.Context) error {
+	p := l.provider
+	lease, err := l.current(ctx)
+	if errors.Is(err, ErrLockLost) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lease.Spec.HolderIdentity = nil
+	_, status, err := p.request(ctx, http.MethodPut, p.leasePath(l.name), lease)
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// current reads the lease, or returns ErrLockLost when this lock no longer
+// holds it
+func (l *kubeLeaseLock) current(ctx context.Context) (*kubeLease, error) {
+	p := l.provider
+	lease, status, err := p.request(ctx, http.MethodGet, p.leasePath(l.name), nil)
+	if status == http.StatusNotFound {
+		return nil, ErrLockLost
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	holder := lease.Spec.HolderIdentity
+	if holder == nil || *holder != p.identity || lease.Metadata.ResourceVersion != l.resourceVersion {
+		return nil, ErrLockLost
+	}
+	return lease, nil
+}
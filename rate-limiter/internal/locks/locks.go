@@ -0,0 +1,203 @@
+package locks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// ErrLockHeld is returned when another holder has the lock
+var ErrLockHeld = errors.New("lock held by another instance")
+
+// ErrLockLost is returned when refreshing a lock that expired or was taken
+// over, after which its holder must stop the exclusive work
+var ErrLockLost = errors.New("lock lost")
+
+// Provider grants named locks that are exclusive across every instance
+// sharing its backend
+type Provider interface {
+	// TryLock takes the lock name for ttl, or returns ErrLockHeld when
+	// another instance holds it
+	TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error)
+}
+
+// Lock is a held lock. It expires after its ttl unless refreshed.
+type Lock interface {
+	// Refresh extends the lock by its ttl, or returns ErrLockLost
+	Refresh(ctx context.Context) error
+	// Unlock releases the lock
+	Unlock(ctx context.Context) error
+}
+
+// RunExclusive runs job while this instance holds the lock name, until ctx
+// is done. Instances that do not hold the lock retry every third of ttl and
+// take over once the holder stops refreshing it. The job's context is
+// cancelled when the lock is lost, and the job is started again when the
+// lock is taken back, so it must be safe to restart. A job returning by
+// itself releases the lock and ends the run.
+func RunExclusive(ctx context.Context, provider Provider, name string, ttl time.Duration, job func(ctx context.Context)) {
+	interval := ttl / 3
+	for {
+		lock, err := provider.TryLock(ctx, name, ttl)
+		switch {
+		case err == nil:
+			if finished := holdWhile(ctx, lock, name, interval, job); finished {
+				return
+			}
+		case !errors.Is(err, ErrLockHeld) && ctx.Err() == nil:
+			log.Printf("Error taking lock %s: %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// holdWhile runs job while refreshing lock, and reports whether the job or
+// ctx ended the run rather than the loss of the lock
+func holdWhile(ctx context.Context, lock Lock, name string, interval time.Duration, job func(ctx context.Context)) bool {
+	log.Printf("Took lock %s", name)
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job(jobCtx)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			unlock(lock, name)
+			return true
+		case <-ctx.Done():
+			<-done
+			unlock(lock, name)
+			return true
+		case <-ticker.C:
+			if err := lock.Refresh(ctx); err != nil {
+				log.Printf("Lost lock %s: %v", name, err)
+				cancel()
+				<-done
+				if !errors.Is(err, ErrLockLost) {
+					unlock(lock, name)
+				}
+				return false
+			}
+		}
+	}
+}
+
+// unlock releases lock, even once the run's context is done
+func unlock(lock Lock, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := lock.Unlock(ctx); err != nil {
+		log.Printf("Error releasing lock %s: %v", name, err)
+	}
+}
+
+// newToken returns a random token identifying one holding of a lock
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// InMemoryProvider grants locks within one process. It stands in for a
+// shared backend when a single instance runs.
+type InMemoryProvider struct {
+	mutex sync.Mutex
+	locks map[string]inMemoryEntry
+	clock domain.Clock
+}
+
+// inMemoryEntry is a held lock and when it expires
+type inMemoryEntry struct {
+	token     string
+	expiresAt time.Time
+}
+
+// NewInMemoryProvider creates an in-process lock provider
+func NewInMemoryProvider() *InMemoryProvider {
+	return &InMemoryProvider{
+		locks: make(map[string]inMemoryEntry),
+		clock: domain.SystemClock{},
+	}
+}
+
+// WithClock sets the clock that locks expire by
+func (p *InMemoryProvider) WithClock(clock domain.Clock) *InMemoryProvider {
+	p.clock = clock
+	return p
+}
+
+// TryLock takes the lock name for ttl unless it is held and unexpired
+func (p *InMemoryProvider) TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	if entry, held := p.locks[name]; held && now.Before(entry.expiresAt) {
+		return nil, ErrLockHeld
+	}
+
+	lock := &inMemoryLock{provider: p, name: name, token: newToken(), ttl: ttl}
+	p.locks[name] = inMemoryEntry{token: lock.token, expiresAt: now.Add(ttl)}
+	return lock, nil
+}
+
+// inMemoryLock is a lock held in an InMemoryProvider
+type inMemoryLock struct {
+	provider *InMemoryProvider
+	name     string
+	token    string
+	ttl      time.Duration
+}
+
+// Refresh extends the lock unless it expired or was taken over
+func (l *inMemoryLock) Refresh(ctx context.Context) error {
+	p := l.provider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	entry, held := p.locks[l.name]
+	if !held || entry.token != l.token || !now.Before(entry.expiresAt) {
+		return ErrLockLost
+	}
+	p.locks[l.name] = inMemoryEntry{token: l.token, expiresAt: now.Add(l.ttl)}
+	return nil
+}
+
+// Unlock releases the lock if it is still held
+func (l *inMemoryLock) Unlock(ctx context.Context) error {
+	p := l.provider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if entry, held := p.locks[l.name]; held && entry.token == l.token {
+		delete(p.locks, l.name)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package locks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces lock keys in Redis
+const redisKeyPrefix = "lock:"
+
+// redisRefreshScript extends a lock only while it still holds the token
+var redisRefreshScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
+
+// redisUnlockScript deletes a lock only while it still holds the token
+var redisUnlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+
+// RedisProvider grants locks with the Redlock algorithm over independent
+// Redis nodes. A lock is held once a majority of the nodes store its token
+// within the ttl, less the time taken and an allowance for clock drift. A
+// single node works too, without tolerating its failure.
+type RedisProvider struct {
+	addrs       []string
+	password    string
+	dialTimeout time.Duration
+
+	clientsOnce sync.Once
+	nodes       []*redis.Client
+}
+
+// NewRedisProvider creates a Redlock provider over the given nodes
+func NewRedisProvider(addrs []string) (*RedisProvider, error) {
+	provider := &RedisProvider{dialTimeout: time.Second}
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			provider.addrs = append(provider.addrs, addr)
+		}
+	}
+	if len(provider.addrs) == 0 {
+		return nil, fmt.Errorf("at least one redis node is required")
+	}
+	return provider, nil
+}
+
+// WithPassword sets the password sent with AUTH to every node
+func (p *RedisProvider) WithPassword(password string) *RedisProvider {
+	p.password = password
+	return p
+}
+
+// clients returns a client of each node, created on first use. Lock
+// operations are rare, so each keeps at most one idle connection.
+func (p *RedisProvider) clients() []*redis.Client {
+	p.clientsOnce.Do(func() {
+		for _, addr := range p.addrs {
+			p.nodes = append(p.nodes, redis.NewClient(&redis.Options{
+				Addr:         addr,
+				Password:     p.password,
+				DialTimeout:  p.dialTimeout,
+				MaxIdleConns: 1,
+			}))
+		}
+	})
+	return p.nodes
+}
+
+// TryLock takes the lock name on a majority of the nodes, or releases the
+// nodes it took and returns ErrLockHeld
+func (p *RedisProvider) TryLock(ctx context.Context, name string, ttl time.Duration) (Lock, error) {
+	lock := &redisLock{provider: p, key: redisKeyPrefix + name, token: newToken(), ttl: ttl}
+
+	start := time.Now()
+	acquired, lastErr := p.onNodes(ctx, func(node *redis.Client) (bool, error) {
+		return node.SetNX(ctx, lock.key, lock.token, ttl).Result()
+	})
+
+	drift := ttl/100 + 2*time.Millisecond
+	validity := ttl - time.Since(start) - drift
+	if acquired >= p.quorum() && validity > 0 {
+		return lock, nil
+	}
+
+	unlock(lock, name)
+	if acquired == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrLockHeld
+}
+
+// quorum is the number of nodes that must agree on a lock
+func (p *RedisProvider) quorum() int {
+	return len(p.addrs)/2 + 1
+}
+
+// onNodes runs fn on every node at once and counts the nodes it succeeded
+// on, returning the last error of those it failed on
+func (p *RedisProvider) onNodes(ctx context.Context, fn func(node *redis.Client) (bool, error)) (int, error) {
+	var (
+		wait    sync.WaitGroup
+		mutex   sync.Mutex
+		count   int
+		lastErr error
+	)
+	for _, node := range p.clients() {
+		wait.Add(1)
+		go func(node *redis.Client) {
+			defer wait.Done()
+			ok, err := fn(node)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				lastErr = fmt.Errorf("redis: %s: %w", node.Options().Addr, err)
+			} else if ok {
+				count++
+			}
+		}(node)
+	}
+	wait.Wait()
+	return count, lastErr
+}
+
+// redisLock is a lock held on a majority of the nodes of a RedisProvider
+type redisLock struct {
+	provider *RedisProvider
+	key      string
+	token    string
+	ttl      time.Duration
+}
+
+// Refresh extends the lock on the nodes still holding its token, and
+// returns ErrLockLost once fewer than a majority do
+func (l *redisLock) Refresh(ctx context.Context) error {
+	p := l.provider
+	extended, lastErr := p.onNodes(ctx, func(node *redis.Client) (bool, error) {
+		extended, err := redisRefreshScript.Run(ctx, node, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+		return extended == 1, err
+	})
+	if extended >= p.quorum() {
+		return nil
+	}
+	if extended == 0 && lastErr != nil {
+		return lastErr
+	}
+	return ErrLockLost
+}
+
+// Unlock deletes the lock from every node still holding its token
+func (l *redisLock) Unlock(ctx context.Context) error {
+	p := l.provider
+	_, lastErr := p.onNodes(ctx, func(node *redis.Client) (bool, error) {
+		return true, redisUnlockScript.Run(ctx, node, []string{l.key}, l.token).Err()
+	})
+	return lastErr
+}
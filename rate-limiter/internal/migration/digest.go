@@ -0,0 +1,191 @@
+package migration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// Kinds of the state a digest has a section for
+const (
+	KindEvents    = "events"
+	KindRules     = "rules"
+	KindOverrides = "overrides"
+	KindFreezes   = "freezes"
+	KindRollouts  = "rollouts"
+	KindLeases    = "leases"
+	KindClients   = "clients"
+	KindReadModel = "read_model"
+)
+
+// Section is the number of records of one kind of state and a checksum of
+// them
+type Section struct {
+	Kind     string `json:"kind"`
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+// Digest summarizes the state held by stores, so that stores holding the
+// same state have equal digests. Events are summed in log order; records
+// of other kinds in any order.
+type Digest []Section
+
+// Section returns the section of kind, if the digest has one
+func (d Digest) Section(kind string) (Section, bool) {
+	for _, section := range d {
+		if section.Kind == kind {
+			return section, true
+		}
+	}
+	return Section{}, false
+}
+
+// Mismatches returns the kinds whose sections differ between the digests.
+// Kinds only one digest has a section for, such as the read model of
+// stores without one, are not compared.
+func (d Digest) Mismatches(other Digest) []string {
+	var kinds []string
+	for _, section := range d {
+		if theirs, ok := other.Section(section.Kind); ok && theirs != section {
+			kinds = append(kinds, section.Kind)
+		}
+	}
+	return kinds
+}
+
+// summer sums the records of one kind
+type summer struct {
+	kind    string
+	ordered bool // Whether the order of the records counts
+	records [][]byte
+}
+
+// add adds the JSON encoding of record
+func (s *summer) add(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encoding %s failed: %w", s.kind, err)
+	}
+	s.records = append(s.records, data)
+	return nil
+}
+
+// section returns the count and checksum of the records added
+func (s *summer) section() Section {
+	if !s.ordered {
+		sort.Slice(s.records, func(i, j int) bool {
+			return string(s.records[i]) < string(s.records[j])
+		})
+	}
+	hash := sha256.New()
+	for _, record := range s.records {
+		hash.Write(record)
+		hash.Write([]byte{'\n'})
+	}
+	return Section{Kind: s.kind, Count: len(s.records), Checksum: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// Summarize computes the digest of the state held by stores
+func Summarize(ctx context.Context, stores Stores) (Digest, error) {
+	codec := infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())
+	events := &summer{kind: KindEvents, ordered: true}
+	err := eachEvent(ctx, stores.Events, func(event domain.Event, inHistory bool) error {
+		record, err := eventRecord(codec, event, inHistory)
+		if err != nil {
+			return err
+		}
+		return events.add(record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading events failed: %w", err)
+	}
+	digest := Digest{events.section()}
+
+	kinds := recordKinds
+	if stores.ReadModel != nil {
+		kinds = append(kinds[:len(kinds):len(kinds)], KindReadModel)
+	}
+	for _, kind := range kinds {
+		records, err := listRecords(ctx, stores, kind)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s failed: %w", kind, err)
+		}
+		s := &summer{kind: kind}
+		for _, record := range records {
+			if err := s.add(record); err != nil {
+				return nil, err
+			}
+		}
+		digest = append(digest, s.section())
+	}
+	return digest, nil
+}
+
+// recordKinds are the kinds of state held in repositories, in the order
+// they are exported
+var recordKinds = []string{KindRules, KindOverrides, KindFreezes, KindRollouts, KindLeases, KindClients}
+
+// listRecords returns the records of kind held by stores, as they are
+// exported
+func listRecords(ctx context.Context, stores Stores, kind string) ([]interface{}, error) {
+	switch kind {
+	case KindRules:
+		return listed(stores.Rules.List(ctx))
+	case KindOverrides:
+		return listed(stores.Overrides.List(ctx))
+	case KindFreezes:
+		return listed(stores.Freezes.List(ctx))
+	case KindRollouts:
+		return listed(stores.Rollouts.List(ctx))
+	case KindLeases:
+		leases, err := stores.Leases.List(ctx)
+		records := make([]interface{}, len(leases))
+		for i, lease := range leases {
+			records[i] = leaseRecord{Lease: lease, StateResource: lease.StateResource}
+		}
+		return records, err
+	case KindClients:
+		return listed(stores.Clients.List(ctx))
+	case KindReadModel:
+		return readModelRecords(ctx, stores.ReadModel)
+	}
+	return nil, fmt.Errorf("unknown kind %q", kind)
+}
+
+// listed returns the records a repository listed
+func listed[T any](records []T, err error) ([]interface{}, error) {
+	result := make([]interface{}, len(records))
+	for i, record := range records {
+		result[i] = record
+	}
+	return result, err
+}
+
+// activityRecord is the activity of one client in the read model
+type activityRecord struct {
+	ClientID string `json:"client_id"`
+	queries.ClientActivity
+}
+
+// readModelRecords returns the activity of every client in readModel, the
+// state it projects from every kind of event
+func readModelRecords(ctx context.Context, readModel *infrastructure.InMemoryReadModel) ([]interface{}, error) {
+	activity, err := readModel.GetClientActivity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]interface{}, 0, len(activity))
+	for clientID, a := range activity {
+		records = append(records, activityRecord{ClientID: clientID, ClientActivity: a})
+	}
+	return records, nil
+}
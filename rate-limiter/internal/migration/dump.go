@@ -0,0 +1,117 @@
+package migration
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// dumpLine is a line of an event dump or export file, or an event as the
+// JSON codec encodes it, which has a type rather than a kind
+type dumpLine struct {
+	Type string `json:"type"`
+	line
+}
+
+// EventWriter writes an event dump, one event per line as in export files
+type EventWriter struct {
+	out     *bufio.Writer
+	encoder *json.Encoder
+	codec   *infrastructure.JSONEventCodec
+}
+
+// NewEventWriter creates a writer of an event dump to w
+func NewEventWriter(w io.Writer) *EventWriter {
+	out := bufio.NewWriter(w)
+	return &EventWriter{
+		out:     out,
+		encoder: json.NewEncoder(out),
+		codec:   infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry()),
+	}
+}
+
+// Write writes event, marked as part of the history of its aggregate or
+// kept in the log only
+func (w *EventWriter) Write(event domain.Event, inHistory bool) error {
+	record, err := eventRecord(w.codec, event, inHistory)
+	if err != nil {
+		return err
+	}
+	return w.encoder.Encode(record)
+}
+
+// Flush writes the buffered lines
+func (w *EventWriter) Flush() error {
+	return w.out.Flush()
+}
+
+// WriteEvents writes events to w as an event dump
+func WriteEvents(w io.Writer, events []domain.Event) error {
+	writer := NewEventWriter(w)
+	for _, event := range events {
+		if err := writer.Write(event, historyEvent(event)); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// ReadEvents reads the events of an event dump, or of an export file whose
+// other state is skipped, and calls fn with each in order. Dumps may also
+// list events as the JSON codec encodes them, one per line; these are
+// taken to be part of the history of their aggregate unless they are kept
+// in the log only, as evictions, erasures and erased events are.
+func ReadEvents(r io.Reader, fn func(event domain.Event, inHistory bool) error) error {
+	codec := infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		var l dumpLine
+		if err := json.Unmarshal(raw, &l); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+
+		data, inHistory := l.Data, l.InHistory
+		switch {
+		case l.Kind == KindEvents:
+		case l.Kind != "":
+			continue
+		case l.Type != "":
+			data = raw
+		default:
+			return fmt.Errorf("line %d: neither an event nor a line of an export file", n)
+		}
+
+		event, err := codec.Decode(data)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if l.Kind == "" {
+			inHistory = historyEvent(event)
+		}
+		if err := fn(event, inHistory); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+}
+
+// historyEvent reports whether event is part of the history of its
+// aggregate when stored
+func historyEvent(event domain.Event) bool {
+	switch event.(type) {
+	case *domain.RateLimitKeyEvictedEvent, *domain.ClientDataErasedEvent, *domain.EventErasedEvent:
+		return false
+	}
+	return event.AggregateID() != ""
+}
@@ -0,0 +1,220 @@
+package migration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// FormatVersion is the version of the export file format written
+const FormatVersion = 1
+
+// Kinds of the lines of an export file besides those of state
+const (
+	kindHeader = "header"
+	kindDigest = "digest"
+)
+
+// line is a line of an export file. The file starts with a header, lists
+// the events in log order and the records of each other kind of state, and
+// ends with the digest of the state, which tells a truncated or altered
+// file apart.
+type line struct {
+	Kind      string          `json:"kind"`
+	InHistory bool            `json:"in_history,omitempty"` // Events only
+	Data      json.RawMessage `json:"data"`
+}
+
+// header describes an export file
+type header struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// leaseRecord is a lease as exported, with the resource the counts of its
+// rule are kept under, which is not part of its JSON encoding
+type leaseRecord struct {
+	domain.Lease
+	StateResource string `json:"state_resource"`
+}
+
+// eventRecord returns the line of an event: the envelope the JSON codec
+// encodes it in, and whether it is part of the history of its aggregate
+func eventRecord(codec *infrastructure.JSONEventCodec, event domain.Event, inHistory bool) (line, error) {
+	data, err := codec.Encode(event)
+	if err != nil {
+		return line{}, fmt.Errorf("encoding event %s failed: %w", event.EventID(), err)
+	}
+	return line{Kind: KindEvents, InHistory: inHistory, Data: data}, nil
+}
+
+// Export writes the state held by stores to w as an export file of one
+// JSON object per line, and returns its digest. The stores should not
+// change while they are exported, as during a maintenance window.
+func Export(ctx context.Context, stores Stores, w io.Writer) (Digest, error) {
+	digest, err := Summarize(ctx, stores)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	write := func(kind string, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("encoding %s failed: %w", kind, err)
+		}
+		return encoder.Encode(line{Kind: kind, Data: raw})
+	}
+
+	if err := write(kindHeader, header{Version: FormatVersion, ExportedAt: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+
+	codec := infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())
+	err = eachEvent(ctx, stores.Events, func(event domain.Event, inHistory bool) error {
+		record, err := eventRecord(codec, event, inHistory)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("exporting events failed: %w", err)
+	}
+
+	for _, kind := range recordKinds {
+		records, err := listRecords(ctx, stores, kind)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s failed: %w", kind, err)
+		}
+		for _, record := range records {
+			if err := write(kind, record); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := write(kindDigest, digest); err != nil {
+		return nil, err
+	}
+	if err := out.Flush(); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// Import restores the state of an export file read from r into stores,
+// which should be empty, and projects its events to their read model. The
+// restored state is checked against the digest the file ends with, which
+// is returned.
+func Import(ctx context.Context, r io.Reader, stores Stores) (Digest, error) {
+	codec := infrastructure.NewJSONEventCodec(infrastructure.NewDefaultEventRegistry())
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var digest Digest
+	for n := 1; ; n++ {
+		var l line
+		if err := decoder.Decode(&l); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if n == 1 && l.Kind != kindHeader {
+			return nil, errors.New("not an export file: no header")
+		}
+		if digest != nil {
+			return nil, fmt.Errorf("line %d: %s after the digest", n, l.Kind)
+		}
+
+		if err := restore(ctx, codec, stores, l, &digest); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if digest == nil {
+		return nil, errors.New("export file is truncated: no digest")
+	}
+
+	if err := project(ctx, stores); err != nil {
+		return nil, err
+	}
+	restored, err := Summarize(ctx, stores)
+	if err != nil {
+		return nil, err
+	}
+	if mismatches := digest.Mismatches(restored); len(mismatches) > 0 {
+		return nil, fmt.Errorf("restored state does not match the export file: %v differ", mismatches)
+	}
+	return digest, nil
+}
+
+// restore restores the state of one line of an export file into stores,
+// or reads the digest into digest
+func restore(ctx context.Context, codec *infrastructure.JSONEventCodec, stores Stores, l line, digest *Digest) error {
+	switch l.Kind {
+	case kindHeader:
+		var h header
+		if err := json.Unmarshal(l.Data, &h); err != nil {
+			return err
+		}
+		if h.Version > FormatVersion {
+			return fmt.Errorf("export file has format version %d, newer than %d", h.Version, FormatVersion)
+		}
+		return nil
+	case kindDigest:
+		return json.Unmarshal(l.Data, digest)
+	case KindEvents:
+		event, err := codec.Decode(l.Data)
+		if err != nil {
+			return err
+		}
+		return stores.Events.Restore(ctx, event, l.InHistory)
+	case KindRules:
+		var rule domain.RateLimitRule
+		if err := json.Unmarshal(l.Data, &rule); err != nil {
+			return err
+		}
+		return stores.Rules.Save(ctx, rule)
+	case KindOverrides:
+		var override domain.RateLimitOverride
+		if err := json.Unmarshal(l.Data, &override); err != nil {
+			return err
+		}
+		return stores.Overrides.Save(ctx, override)
+	case KindFreezes:
+		var freeze domain.Freeze
+		if err := json.Unmarshal(l.Data, &freeze); err != nil {
+			return err
+		}
+		return stores.Freezes.Save(ctx, freeze)
+	case KindRollouts:
+		var rollout domain.RuleRollout
+		if err := json.Unmarshal(l.Data, &rollout); err != nil {
+			return err
+		}
+		return stores.Rollouts.Save(ctx, rollout)
+	case KindLeases:
+		var record leaseRecord
+		if err := json.Unmarshal(l.Data, &record); err != nil {
+			return err
+		}
+		lease := record.Lease
+		lease.StateResource = record.StateResource
+		return stores.Leases.Save(ctx, lease)
+	case KindClients:
+		var client domain.Client
+		if err := json.Unmarshal(l.Data, &client); err != nil {
+			return err
+		}
+		return stores.Clients.Save(ctx, client)
+	}
+	return fmt.Errorf("unknown kind %q", l.Kind)
+}
@@ -0,0 +1,202 @@
+// Package migration copies the state of a rate limiter between storage
+// backends during a maintenance window: the event log with the aggregate
+// histories it holds, rules, overrides, freezes, rollouts, leases and
+// registered clients. Read models are projections of the event log, so the
+// destination's is rebuilt from the copied events and compared with the
+// source's. State moves between processes as export files.
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// logPage is the number of events read from a log at once
+const logPage = 1000
+
+// Backends are the names of the backends NewStores creates stores of
+var Backends = []string{"memory", "redis", "postgres"}
+
+// EventLog is an event store whose log is copied in the order it was saved
+type EventLog interface {
+	GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error)
+	ReadAll(ctx context.Context, from uint64, limit int) ([]domain.Event, error)
+	Head(ctx context.Context) (uint64, error)
+	Restore(ctx context.Context, event domain.Event, inHistory bool) error
+}
+
+// Stores are the stores holding the state of a rate limiter. Without a read
+// model, read model state is neither projected nor compared.
+type Stores struct {
+	Events    EventLog
+	Rules     handlers.RuleRepository
+	Overrides handlers.OverrideRepository
+	Freezes   handlers.FreezeRepository
+	Rollouts  handlers.RolloutRepository
+	Leases    handlers.LeaseRepository
+	Clients   handlers.ClientRepository
+	ReadModel *infrastructure.InMemoryReadModel
+}
+
+// NewStores creates empty stores of a backend: "memory" keeps everything in
+// memory, "redis" keeps events in the Redis event store encoded with
+// protobuf and "postgres" keeps rules in the PostgreSQL rule repository
+func NewStores(backend string) (Stores, error) {
+	stores := Stores{
+		Rules:     infrastructure.NewInMemoryRuleRepository(),
+		Overrides: infrastructure.NewInMemoryOverrideRepository(),
+		Freezes:   infrastructure.NewInMemoryFreezeRepository(),
+		Rollouts:  infrastructure.NewInMemoryRolloutRepository(),
+		Leases:    infrastructure.NewInMemoryLeaseRepository(),
+		Clients:   infrastructure.NewInMemoryClientRepository(),
+		ReadModel: infrastructure.NewInMemoryReadModel(),
+	}
+	switch backend {
+	case "memory":
+		stores.Events = infrastructure.NewInMemoryEventStore()
+	case "redis":
+		stores.Events = infrastructure.NewRedisEventStore(infrastructure.NewProtobufEventCodec(infrastructure.NewDefaultEventRegistry()))
+	case "postgres":
+		stores.Events = infrastructure.NewInMemoryEventStore()
+		stores.Rules = infrastructure.NewPostgreSQLRuleRepository()
+	default:
+		return Stores{}, fmt.Errorf("unknown backend %q, expected memory, redis or postgres", backend)
+	}
+	return stores, nil
+}
+
+// Copy copies the state held by src to dst, which should be empty, and
+// projects the copied events to the read model of dst
+func Copy(ctx context.Context, src, dst Stores) error {
+	err := eachEvent(ctx, src.Events, func(event domain.Event, inHistory bool) error {
+		return dst.Events.Restore(ctx, event, inHistory)
+	})
+	if err != nil {
+		return fmt.Errorf("copying events failed: %w", err)
+	}
+
+	rules, err := src.Rules.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing rules failed: %w", err)
+	}
+	for _, rule := range rules {
+		if err := dst.Rules.Save(ctx, rule); err != nil {
+			return fmt.Errorf("copying rule %s failed: %w", rule.ID, err)
+		}
+	}
+
+	overrides, err := src.Overrides.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing overrides failed: %w", err)
+	}
+	for _, override := range overrides {
+		if err := dst.Overrides.Save(ctx, override); err != nil {
+			return fmt.Errorf("copying override %s failed: %w", override.ID, err)
+		}
+	}
+
+	freezes, err := src.Freezes.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing freezes failed: %w", err)
+	}
+	for _, freeze := range freezes {
+		if err := dst.Freezes.Save(ctx, freeze); err != nil {
+			return fmt.Errorf("copying freeze %s failed: %w", freeze.ID, err)
+		}
+	}
+
+	rollouts, err := src.Rollouts.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing rollouts failed: %w", err)
+	}
+	for _, rollout := range rollouts {
+		if err := dst.Rollouts.Save(ctx, rollout); err != nil {
+			return fmt.Errorf("copying rollout %s failed: %w", rollout.ID, err)
+		}
+	}
+
+	leases, err := src.Leases.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing leases failed: %w", err)
+	}
+	for _, lease := range leases {
+		if err := dst.Leases.Save(ctx, lease); err != nil {
+			return fmt.Errorf("copying lease %s failed: %w", lease.ID, err)
+		}
+	}
+
+	clients, err := src.Clients.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing clients failed: %w", err)
+	}
+	for _, client := range clients {
+		if err := dst.Clients.Save(ctx, client); err != nil {
+			return fmt.Errorf("copying client %s failed: %w", client.ID, err)
+		}
+	}
+
+	return project(ctx, dst)
+}
+
+// project applies the events of stores to its read model, if any
+func project(ctx context.Context, stores Stores) error {
+	if stores.ReadModel == nil {
+		return nil
+	}
+
+	projection := infrastructure.NewReadModelProjection(stores.Events, stores.ReadModel, 0).WithCatchUp(0, logPage)
+	if _, err := projection.Sync(ctx); err != nil {
+		return fmt.Errorf("projecting events failed: %w", err)
+	}
+	return nil
+}
+
+// eachEvent calls fn with every event of log in the order it was saved,
+// telling whether the event is part of the history of its aggregate or kept
+// in the log only, as are the events of evicted aggregates, evictions and
+// erased events
+func eachEvent(ctx context.Context, log EventLog, fn func(event domain.Event, inHistory bool) error) error {
+	head, err := log.Head(ctx)
+	if err != nil {
+		return err
+	}
+
+	// IDs of the events in the history of each aggregate seen
+	histories := make(map[string]map[string]struct{})
+	for from := uint64(0); from < head; {
+		events, err := log.ReadAll(ctx, from, logPage)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, event := range events {
+			aggregateID := event.AggregateID()
+			history, seen := histories[aggregateID]
+			if !seen && aggregateID != "" {
+				aggregate, err := log.GetEvents(ctx, aggregateID)
+				if err != nil {
+					return err
+				}
+				history = make(map[string]struct{}, len(aggregate))
+				for _, e := range aggregate {
+					history[e.EventID()] = struct{}{}
+				}
+				histories[aggregateID] = history
+			}
+
+			_, inHistory := history[event.EventID()]
+			if err := fn(event, inHistory); err != nil {
+				return err
+			}
+		}
+		from += uint64(len(events))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Package principal carries the authenticated principal of a request, as
+// named by the authenticating proxy in front of the servers, so that
+// changes can be attributed to whoever made them.
+package principal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+)
+
+type contextKey struct{}
+
+// Middleware stores the principal named by the header in the request
+// context. The header is only honoured from trusted proxies, which
+// authenticated the caller; anyone else could name any principal. An empty
+// header disables the middleware.
+func Middleware(resolver *clientip.Resolver, header string, next http.Handler) http.Handler {
+	if header == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.Header.Get(header))
+		if name == "" || !resolver.FromTrustedProxy(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), name)))
+	})
+}
+
+// NewContext returns ctx carrying name as the authenticated principal
+func NewContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext returns the authenticated principal carried by ctx, or empty
+// when the caller is unknown
+func FromContext(ctx context.Context) string {
+	name, _ := ctx.Value(contextKey{}).(string)
+	return name
+}
@@ -0,0 +1,108 @@
+// Package privacy pseudonymizes the client IDs, IP addresses and user agents
+// the rate limiter stores, so that events, history and statistics hold no
+// personal data in the clear.
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Prefix starts every pseudonym
+const Prefix = "p_"
+
+// Kinds of pseudonymized values. Each kind hashes differently, so a client
+// ID and an IP address with the same text get different pseudonyms.
+const (
+	KindClientID  = "client_id"
+	KindIPAddress = "ip_address"
+	KindUserAgent = "user_agent"
+)
+
+// Pseudonymizer replaces values with keyed hashes: the same value always
+// gets the same pseudonym, so limits, history and statistics work as
+// before, but without the key a pseudonym cannot be traced back to its
+// value, not even by hashing guessed values such as every IPv4 address.
+// A nil Pseudonymizer leaves values as they are.
+type Pseudonymizer struct {
+	key []byte
+}
+
+// NewPseudonymizer creates a pseudonymizer hashing with key. Every instance
+// sharing a store must use the same key.
+func NewPseudonymizer(key []byte) *Pseudonymizer {
+	return &Pseudonymizer{key: key}
+}
+
+// Pseudonym returns the pseudonym of a value of kind. Empty values are
+// returned as they are. Values that look like pseudonyms are hashed like any
+// other, so a client cannot pass another's pseudonym off as its own ID.
+func (p *Pseudonymizer) Pseudonym(kind, value string) string {
+	if p == nil || value == "" {
+		return value
+	}
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	return Prefix + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// ClientID returns the pseudonym of a client ID or rate limit key
+func (p *Pseudonymizer) ClientID(clientID string) string {
+	return p.Pseudonym(KindClientID, clientID)
+}
+
+// IPAddress returns the pseudonym of an IP address
+func (p *Pseudonymizer) IPAddress(ipAddress string) string {
+	return p.Pseudonym(KindIPAddress, ipAddress)
+}
+
+// UserAgent returns the pseudonym of a user agent
+func (p *Pseudonymizer) UserAgent(userAgent string) string {
+	return p.Pseudonym(KindUserAgent, userAgent)
+}
+
+// Lookup returns the pseudonym of a value of kind to look up stored data
+// by, taking values that already are pseudonyms as they are, so pseudonyms
+// found by an admin can be queried. Only admin lookups and queries may use
+// it; decisions and writes use Pseudonym.
+func (p *Pseudonymizer) Lookup(kind, value string) string {
+	if p != nil && IsPseudonym(value) {
+		return value
+	}
+	return p.Pseudonym(kind, value)
+}
+
+// LookupClientID returns the pseudonym to look up a client ID or rate limit
+// key by
+func (p *Pseudonymizer) LookupClientID(clientID string) string {
+	return p.Lookup(KindClientID, clientID)
+}
+
+// LookupIPAddress returns the pseudonym to look up an IP address by
+func (p *Pseudonymizer) LookupIPAddress(ipAddress string) string {
+	return p.Lookup(KindIPAddress, ipAddress)
+}
+
+// LookupUserAgent returns the pseudonym to look up a user agent by
+func (p *Pseudonymizer) LookupUserAgent(userAgent string) string {
+	return p.Lookup(KindUserAgent, userAgent)
+}
+
+// Enabled reports whether values are pseudonymized
+func (p *Pseudonymizer) Enabled() bool {
+	return p != nil
+}
+
+// IsPseudonym reports whether a value has the form of a pseudonym
+func IsPseudonym(value string) bool {
+	hash, ok := strings.CutPrefix(value, Prefix)
+	if !ok || len(hash) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,84 @@
+package queries
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a history cursor that was not issued
+// with a history
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// HistoryCursor is the position after an event of a history. Unlike an
+// offset it stays valid while the history grows or its oldest events are
+// dropped, so large time ranges can be read page by page.
+type HistoryCursor struct {
+	Time    time.Time
+	EventID string
+}
+
+// NewHistoryCursor returns the cursor after event
+func NewHistoryCursor(event RateLimitEvent) HistoryCursor {
+	return HistoryCursor{Time: event.Timestamp, EventID: event.EventID}
+}
+
+// ParseHistoryCursor decodes a cursor from its String form
+func ParseHistoryCursor(token string) (*HistoryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	nanos, eventID, ok := strings.Cut(string(raw), ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &HistoryCursor{Time: time.Unix(0, unixNano).UTC(), EventID: eventID}, nil
+}
+
+// String encodes the cursor as an opaque token
+func (c HistoryCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Time.UnixNano(), 10) + "." + c.EventID))
+}
+
+// Precedes reports whether event comes after the cursor, ordering events by
+// time and then by ID. A nil cursor precedes every event.
+func (c *HistoryCursor) Precedes(event RateLimitEvent) bool {
+	if c == nil {
+		return true
+	}
+	if !event.Timestamp.Equal(c.Time) {
+		return event.Timestamp.After(c.Time)
+	}
+	return event.EventID > c.EventID
+}
+
+// RuleCursor is the position after a rule of a rule listing, which is
+// ordered by rule ID
+type RuleCursor struct {
+	ID string
+}
+
+// ParseRuleCursor decodes a cursor from its String form
+func ParseRuleCursor(token string) (*RuleCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, ok := strings.CutPrefix(string(raw), "rule.")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	return &RuleCursor{ID: id}, nil
+}
+
+// String encodes the cursor as an opaque token
+func (c RuleCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte("rule." + c.ID))
+}
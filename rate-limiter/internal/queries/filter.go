@@ -0,0 +1,85 @@
+package queries
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Decisions a history can be filtered on
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+)
+
+// historyEventTypes maps the short names of history event types to their
+// event types
+var historyEventTypes = map[string]string{
+	"applied":   "RateLimitApplied",
+	"exceeded":  "RateLimitExceeded",
+	"reset":     "RateLimitWindowReset",
+	"threshold": "RateLimitThresholdReached",
+	"refunded":  "RateLimitRefunded",
+	"leased":    "TokensLeased",
+	"settled":   "LeaseSettled",
+	"expired":   "LeaseExpired",
+}
+
+// HistoryFilter selects the events of a history. The zero filter selects
+// every event.
+type HistoryFilter struct {
+	EventTypes []string `json:"event_types,omitempty"` // Any of these event types
+	Decision   string   `json:"decision,omitempty"`    // "allowed" or "denied"; decisions only
+	IPAddress  string   `json:"ip_address,omitempty"`  // Substring of the IP address
+	UserAgent  string   `json:"user_agent,omitempty"`  // Case-insensitive substring of the user agent
+}
+
+// ParseHistoryEventType returns the event type of a history event type
+// name, which is a short name such as "exceeded" or a full event type such
+// as "RateLimitExceeded"
+func ParseHistoryEventType(name string) (string, error) {
+	if eventType, ok := historyEventTypes[strings.ToLower(name)]; ok {
+		return eventType, nil
+	}
+	for _, eventType := range historyEventTypes {
+		if eventType == name {
+			return eventType, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q, expected applied, exceeded, reset, threshold or refunded", name)
+}
+
+// Validate checks the filter's decision
+func (f HistoryFilter) Validate() error {
+	switch f.Decision {
+	case "", DecisionAllowed, DecisionDenied:
+		return nil
+	default:
+		return fmt.Errorf("unknown decision %q, expected allowed or denied", f.Decision)
+	}
+}
+
+// Matches reports whether the filter selects event. Allowed decisions are
+// RateLimitApplied events and denied ones RateLimitExceeded events.
+func (f HistoryFilter) Matches(event RateLimitEvent) bool {
+	if len(f.EventTypes) > 0 && !slices.Contains(f.EventTypes, event.EventType) {
+		return false
+	}
+	switch f.Decision {
+	case DecisionAllowed:
+		if event.EventType != "RateLimitApplied" {
+			return false
+		}
+	case DecisionDenied:
+		if event.EventType != "RateLimitExceeded" {
+			return false
+		}
+	}
+	if f.IPAddress != "" && !strings.Contains(event.IPAddress, f.IPAddress) {
+		return false
+	}
+	if f.UserAgent != "" && !strings.Contains(strings.ToLower(event.UserAgent), strings.ToLower(f.UserAgent)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package queries
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatsGranularity is the bucket size of the time series of client stats
+type StatsGranularity string
+
+// Granularities of client stats, finest first
+const (
+	StatsByMinute StatsGranularity = "minute"
+	StatsByHour   StatsGranularity = "hour"
+	StatsByDay    StatsGranularity = "day"
+)
+
+// maxStatsPoints is the number of time series points above which a coarser
+// granularity is selected
+const maxStatsPoints = 1440
+
+// Duration returns the bucket size of the granularity
+func (g StatsGranularity) Duration() time.Duration {
+	switch g {
+	case StatsByHour:
+		return time.Hour
+	case StatsByDay:
+		return 24 * time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// ParseStatsGranularity validates a granularity name
+func ParseStatsGranularity(name string) (StatsGranularity, error) {
+	switch granularity := StatsGranularity(name); granularity {
+	case StatsByMinute, StatsByHour, StatsByDay:
+		return granularity, nil
+	default:
+		return "", fmt.Errorf("unknown granularity %q, expected minute, hour or day", name)
+	}
+}
+
+// SelectStatsGranularity returns the finest granularity that keeps the time
+// series of startTime to endTime within 1440 points, i.e. minutes for up to
+// a day, hours for up to 60 days and days beyond. An open range is counted
+// in days.
+func SelectStatsGranularity(startTime, endTime time.Time) StatsGranularity {
+	if startTime.IsZero() || endTime.IsZero() {
+		return StatsByDay
+	}
+	for _, granularity := range []StatsGranularity{StatsByMinute, StatsByHour} {
+		if endTime.Sub(startTime) <= maxStatsPoints*granularity.Duration() {
+			return granularity
+		}
+	}
+	return StatsByDay
+}
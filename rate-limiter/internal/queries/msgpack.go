@@ -0,0 +1,160 @@
+package queries
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// AppendMsgpack appends the status to b as a MessagePack map with the keys
+// and fields of its JSON encoding, written out by hand like AppendJSON.
+// Times are MessagePack timestamps.
+func (s *RateLimitStatus) AppendMsgpack(b []byte) []byte {
+	// The eleven fields encoding/json always writes, and those it omits when empty
+	fields := 11
+	for _, set := range []bool{s.RetryAfter != 0, s.Reason != "", s.RequestRate != 0, s.ExhaustsAt != nil, s.Warning != "", s.Granted != 0, s.GrantExpiresAt != nil, s.Degraded != ""} {
+		if set {
+			fields++
+		}
+	}
+
+	b = appendMsgpackMapHeader(b, fields)
+	b = appendMsgpackString(appendMsgpackString(b, "client_id"), s.ClientID)
+	b = appendMsgpackString(appendMsgpackString(b, "resource"), s.Resource)
+	b = appendMsgpackBool(appendMsgpackString(b, "is_allowed"), s.IsAllowed)
+	b = appendMsgpackInt(appendMsgpackString(b, "request_count"), int64(s.RequestCount))
+	b = appendMsgpackInt(appendMsgpackString(b, "limit"), int64(s.Limit))
+	b = appendMsgpackInt(appendMsgpackString(b, "remaining_quota"), int64(s.RemainingQuota))
+	b = appendMsgpackTime(appendMsgpackString(b, "window_start"), s.WindowStart)
+	b = appendMsgpackTime(appendMsgpackString(b, "window_end"), s.WindowEnd)
+	b = appendMsgpackTime(appendMsgpackString(b, "reset_time"), s.ResetTime)
+	b = appendMsgpackBool(appendMsgpackString(b, "is_blocked"), s.IsBlocked)
+	b = appendMsgpackTime(appendMsgpackString(b, "blocked_until"), s.BlockedUntil)
+	if s.RetryAfter != 0 {
+		b = appendMsgpackInt(appendMsgpackString(b, "retry_after"), int64(s.RetryAfter))
+	}
+	if s.Reason != "" {
+		b = appendMsgpackString(appendMsgpackString(b, "reason"), s.Reason)
+	}
+	if s.RequestRate != 0 {
+		b = appendMsgpackFloat(appendMsgpackString(b, "request_rate"), s.RequestRate)
+	}
+	if s.ExhaustsAt != nil {
+		b = appendMsgpackTime(appendMsgpackString(b, "exhausts_at"), *s.ExhaustsAt)
+	}
+	if s.Warning != "" {
+		b = appendMsgpackString(appendMsgpackString(b, "warning"), s.Warning)
+	}
+	if s.Granted != 0 {
+		b = appendMsgpackInt(appendMsgpackString(b, "granted_requests"), int64(s.Granted))
+	}
+	if s.GrantExpiresAt != nil {
+		b = appendMsgpackTime(appendMsgpackString(b, "grant_expires_at"), *s.GrantExpiresAt)
+	}
+	if s.Degraded != "" {
+		b = appendMsgpackString(appendMsgpackString(b, "degraded"), s.Degraded)
+	}
+	return b
+}
+
+// AppendMsgpack appends the status to b as a MessagePack map with the keys
+// of its JSON encoding
+func (m *MultiRateLimitStatus) AppendMsgpack(b []byte) []byte {
+	fields := 2
+	if m.DeniedResource != "" {
+		fields++
+	}
+
+	b = appendMsgpackMapHeader(b, fields)
+	b = appendMsgpackBool(appendMsgpackString(b, "is_allowed"), m.IsAllowed)
+	if m.DeniedResource != "" {
+		b = appendMsgpackString(appendMsgpackString(b, "denied_resource"), m.DeniedResource)
+	}
+	b = appendMsgpackString(b, "statuses")
+	if m.Statuses == nil {
+		return append(b, 0xc0) // nil, as encoding/json writes null
+	}
+	b = appendMsgpackArrayHeader(b, len(m.Statuses))
+	for _, s := range m.Statuses {
+		b = s.AppendMsgpack(b)
+	}
+	return b
+}
+
+// appendMsgpackMapHeader appends the header of a map of n pairs
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+// appendMsgpackArrayHeader appends the header of an array of n elements
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+// appendMsgpackString appends a UTF-8 string
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackBool appends a bool
+func appendMsgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+// appendMsgpackInt appends an integer in its shortest encoding
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= math.MaxInt8:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+// appendMsgpackFloat appends a float64
+func appendMsgpackFloat(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+}
+
+// appendMsgpackTime appends t as a 96-bit timestamp extension, which holds
+// any time, including the zero time encoding/json writes for unset times
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
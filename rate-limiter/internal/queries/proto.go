@@ -0,0 +1,142 @@
+package queries
+
+import (
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of RateLimitStatus in proto/ratelimit/v1/status.proto
+const (
+	protoStatusClientID       protowire.Number = 1
+	protoStatusResource       protowire.Number = 2
+	protoStatusIsAllowed      protowire.Number = 3
+	protoStatusRequestCount   protowire.Number = 4
+	protoStatusLimit          protowire.Number = 5
+	protoStatusRemainingQuota protowire.Number = 6
+	protoStatusWindowStart    protowire.Number = 7
+	protoStatusWindowEnd      protowire.Number = 8
+	protoStatusResetTime      protowire.Number = 9
+	protoStatusIsBlocked      protowire.Number = 10
+	protoStatusBlockedUntil   protowire.Number = 11
+	protoStatusRetryAfter     protowire.Number = 12
+	protoStatusReason         protowire.Number = 13
+	protoStatusRequestRate    protowire.Number = 14
+	protoStatusExhaustsAt     protowire.Number = 15
+	protoStatusWarning        protowire.Number = 16
+	protoStatusGranted        protowire.Number = 17
+	protoStatusGrantExpiresAt protowire.Number = 18
+	protoStatusDegraded       protowire.Number = 19
+)
+
+// Field numbers of MultiRateLimitStatus in proto/ratelimit/v1/status.proto
+const (
+	protoMultiIsAllowed      protowire.Number = 1
+	protoMultiDeniedResource protowire.Number = 2
+	protoMultiStatuses       protowire.Number = 3
+)
+
+// AppendProto appends the status to b as a ratelimit.v1.RateLimitStatus
+// message. Like AppendJSON it is written out by hand, so that answering a
+// check neither reflects over the status nor allocates beyond growing b.
+// Zero fields are left out, as proto3 does.
+func (s *RateLimitStatus) AppendProto(b []byte) []byte {
+	b = appendProtoString(b, protoStatusClientID, s.ClientID)
+	b = appendProtoString(b, protoStatusResource, s.Resource)
+	b = appendProtoBool(b, protoStatusIsAllowed, s.IsAllowed)
+	b = appendProtoInt(b, protoStatusRequestCount, s.RequestCount)
+	b = appendProtoInt(b, protoStatusLimit, s.Limit)
+	b = appendProtoInt(b, protoStatusRemainingQuota, s.RemainingQuota)
+	b = appendProtoTime(b, protoStatusWindowStart, s.WindowStart)
+	b = appendProtoTime(b, protoStatusWindowEnd, s.WindowEnd)
+	b = appendProtoTime(b, protoStatusResetTime, s.ResetTime)
+	b = appendProtoBool(b, protoStatusIsBlocked, s.IsBlocked)
+	b = appendProtoTime(b, protoStatusBlockedUntil, s.BlockedUntil)
+	b = appendProtoInt(b, protoStatusRetryAfter, s.RetryAfter)
+	b = appendProtoString(b, protoStatusReason, s.Reason)
+	if s.RequestRate != 0 {
+		b = protowire.AppendTag(b, protoStatusRequestRate, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(s.RequestRate))
+	}
+	if s.ExhaustsAt != nil {
+		b = appendProtoTime(b, protoStatusExhaustsAt, *s.ExhaustsAt)
+	}
+	b = appendProtoString(b, protoStatusWarning, s.Warning)
+	b = appendProtoInt(b, protoStatusGranted, s.Granted)
+	if s.GrantExpiresAt != nil {
+		b = appendProtoTime(b, protoStatusGrantExpiresAt, *s.GrantExpiresAt)
+	}
+	b = appendProtoString(b, protoStatusDegraded, s.Degraded)
+	return b
+}
+
+// AppendProto appends the status to b as a ratelimit.v1.MultiRateLimitStatus
+// message
+func (m *MultiRateLimitStatus) AppendProto(b []byte) []byte {
+	b = appendProtoBool(b, protoMultiIsAllowed, m.IsAllowed)
+	b = appendProtoString(b, protoMultiDeniedResource, m.DeniedResource)
+
+	var status []byte
+	for _, s := range m.Statuses {
+		status = s.AppendProto(status[:0])
+		b = protowire.AppendTag(b, protoMultiStatuses, protowire.BytesType)
+		b = protowire.AppendBytes(b, status)
+	}
+	return b
+}
+
+// appendProtoString appends a string field unless it is empty
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendProtoBool appends a bool field unless it is false
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// appendProtoInt appends an int64 field unless it is zero
+func appendProtoInt(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+// appendProtoTime appends a google.protobuf.Timestamp field unless t is
+// zero
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	seconds, nanos := uint64(t.Unix()), uint64(t.Nanosecond())
+
+	size := 0
+	if seconds != 0 {
+		size += protowire.SizeTag(1) + protowire.SizeVarint(seconds)
+	}
+	if nanos != 0 {
+		size += protowire.SizeTag(2) + protowire.SizeVarint(nanos)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(size))
+	if seconds != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, seconds)
+	}
+	if nanos != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, nanos)
+	}
+	return b
+}
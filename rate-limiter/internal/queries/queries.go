@@ -2,6 +2,8 @@ package queries
 
 import (
 	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
 )
 
 // Query represents a query in the CQRS pattern
@@ -38,6 +40,10 @@ type GetRateLimitHistoryQuery struct {
 	EndTime   time.Time `json:"end_time"`
 	Limit     int       `json:"limit"`
 	Offset    int       `json:"offset"`
+	// After, if set, starts the history after a previous page's last event,
+	// before Offset is applied
+	After  *HistoryCursor `json:"-"`
+	Filter HistoryFilter  `json:"filter"`
 }
 
 // GetActiveRulesQuery - Query for getting active rate limit rules
@@ -46,28 +52,156 @@ type GetActiveRulesQuery struct {
 	Resource string `json:"resource,omitempty"`
 }
 
+// ListRulesQuery - Query for a page of rate limit rules, ordered by ID
+type ListRulesQuery struct {
+	BaseQuery
+	Resource string `json:"resource,omitempty"`
+	Limit    int    `json:"limit"`
+	// After, if set, starts the page after a previous page's last rule
+	After *RuleCursor `json:"-"`
+}
+
+// GetOverridesQuery - Query for the overrides in effect, optionally of one
+// client and/or resource
+type GetOverridesQuery struct {
+	BaseQuery
+	ClientID string `json:"client_id,omitempty"`
+	Resource string `json:"resource,omitempty"`
+}
+
+// GetFreezesQuery - Query for the freezes in effect or scheduled, optionally
+// only those covering a resource
+type GetFreezesQuery struct {
+	BaseQuery
+	Resource string `json:"resource,omitempty"`
+}
+
+// GetRolloutsQuery - Query for one rule rollout, or for the rollouts,
+// optionally only those of one rule and/or with one status
+type GetRolloutsQuery struct {
+	BaseQuery
+	RolloutID string `json:"rollout_id,omitempty"`
+	RuleID    string `json:"rule_id,omitempty"`
+	Status    string `json:"status,omitempty"`
+}
+
+// GetLeasesQuery - Query for one token lease, or for the active leases,
+// optionally only those of one client and/or resource
+type GetLeasesQuery struct {
+	BaseQuery
+	LeaseID  string `json:"lease_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Resource string `json:"resource,omitempty"`
+}
+
+// GetClientQuery - Query for a registered client
+type GetClientQuery struct {
+	BaseQuery
+	ClientID string `json:"client_id"`
+}
+
+// ListClientsQuery - Query for registered and discovered clients,
+// optionally only registered ones of one tier and/or with one tag
+type ListClientsQuery struct {
+	BaseQuery
+	Tier string `json:"tier,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+	Sort string `json:"sort,omitempty"` // "id" (default), "first_seen" or "last_seen", newest first
+}
+
+// ExplainDecisionQuery - Query for why requests of a client to a resource
+// are decided as they are
+type ExplainDecisionQuery struct {
+	BaseQuery
+	ClientID string `json:"client_id"`
+	Resource string `json:"resource"`
+	Method   string `json:"method,omitempty"` // Selects method-specific rules; the rule for any method when empty
+	Key      string `json:"key,omitempty"`    // Limit key rendered from the rule's key template; ClientID when empty
+}
+
 // GetClientStatsQuery - Query for getting client statistics
 type GetClientStatsQuery struct {
+	BaseQuery
+	ClientID    string           `json:"client_id"`
+	StartTime   time.Time        `json:"start_time"`
+	EndTime     time.Time        `json:"end_time"`
+	Granularity StatsGranularity `json:"granularity,omitempty"` // Selected from the range when empty
+}
+
+// GetAnalyticsHistoryQuery - Query for long-range history served by the analytics store
+type GetAnalyticsHistoryQuery struct {
 	BaseQuery
 	ClientID  string    `json:"client_id"`
+	Resource  string    `json:"resource"`
 	StartTime time.Time `json:"start_time"`
 	EndTime   time.Time `json:"end_time"`
+	Limit     int       `json:"limit"`
+	Offset    int       `json:"offset"`
+	// After, if set, starts the history after a previous page's last event,
+	// before Offset is applied
+	After *HistoryCursor `json:"-"`
+}
+
+// GetAnalyticsStatsQuery - Query for long-range client statistics served by the analytics store
+type GetAnalyticsStatsQuery struct {
+	BaseQuery
+	ClientID  string        `json:"client_id"`
+	StartTime time.Time     `json:"start_time"`
+	EndTime   time.Time     `json:"end_time"`
+	Interval  time.Duration `json:"interval"` // Time series bucket size
 }
 
 // RateLimitStatus - Response for rate limit status queries
 type RateLimitStatus struct {
-	ClientID         string    `json:"client_id"`
-	Resource         string    `json:"resource"`
-	IsAllowed        bool      `json:"is_allowed"`
-	RequestCount     int       `json:"request_count"`
-	Limit            int       `json:"limit"`
-	RemainingQuota   int       `json:"remaining_quota"`
-	WindowStart      time.Time `json:"window_start"`
-	WindowEnd        time.Time `json:"window_end"`
-	ResetTime        time.Time `json:"reset_time"`
-	IsBlocked        bool      `json:"is_blocked"`
-	BlockedUntil     time.Time `json:"blocked_until,omitempty"`
-	RetryAfter       int       `json:"retry_after,omitempty"`
+	ClientID       string     `json:"client_id"`
+	Resource       string     `json:"resource"`
+	IsAllowed      bool       `json:"is_allowed"`
+	RequestCount   int        `json:"request_count"`
+	Limit          int        `json:"limit"`
+	RemainingQuota int        `json:"remaining_quota"`
+	WindowStart    time.Time  `json:"window_start"`
+	WindowEnd      time.Time  `json:"window_end"`
+	ResetTime      time.Time  `json:"reset_time"`
+	IsBlocked      bool       `json:"is_blocked"`
+	BlockedUntil   time.Time  `json:"blocked_until,omitempty"`
+	RetryAfter     int        `json:"retry_after,omitempty"`
+	Reason         string     `json:"reason,omitempty"`       // Set when a freeze decided the request
+	RequestRate    float64    `json:"request_rate,omitempty"` // Recent requests per second, smoothed
+	ExhaustsAt     *time.Time `json:"exhausts_at,omitempty"`  // When the quota runs out at RequestRate, if before ResetTime
+	Warning        string     `json:"warning,omitempty"`      // Set while usage is at or above the rule's soft threshold
+
+	// Set on checks granted a budget: further requests counted in advance,
+	// which the client may make until GrantExpiresAt without checking them
+	Granted        int        `json:"granted_requests,omitempty"`
+	GrantExpiresAt *time.Time `json:"grant_expires_at,omitempty"`
+
+	// Set to "fail-open" or "fail-closed" on checks decided by the storage
+	// failure policy because storage was unavailable
+	Degraded string `json:"degraded,omitempty"`
+
+	// Set for rules with extra windows: the window the status is taken
+	// from, which denied the request or has the least quota left, and the
+	// budget of every window decided
+	BindingWindow string         `json:"binding_window,omitempty"`
+	Windows       []WindowStatus `json:"windows,omitempty"`
+}
+
+// WindowStatus - Budget of one window of a rule with several
+type WindowStatus struct {
+	Window         string    `json:"window"`
+	Limit          int       `json:"limit"`
+	RequestCount   int       `json:"request_count"`
+	RemainingQuota int       `json:"remaining_quota"`
+	ResetTime      time.Time `json:"reset_time"`
+	IsBlocked      bool      `json:"is_blocked,omitempty"`
+}
+
+// MultiRateLimitStatus - Response for a request checked against several
+// resources at once
+type MultiRateLimitStatus struct {
+	IsAllowed      bool               `json:"is_allowed"`
+	DeniedResource string             `json:"denied_resource,omitempty"`
+	Statuses       []*RateLimitStatus `json:"statuses"` // Every resource's status when allowed, or the denying resource's
 }
 
 // RateLimitHistory - Response for rate limit history queries
@@ -75,6 +209,13 @@ type RateLimitHistory struct {
 	Events     []RateLimitEvent `json:"events"`
 	TotalCount int              `json:"total_count"`
 	HasMore    bool             `json:"has_more"`
+	NextCursor string           `json:"next_cursor,omitempty"` // Continues after the last event when HasMore
+}
+
+// RuleList - Response for rule listing queries
+type RuleList struct {
+	Rules      []domain.RateLimitRule `json:"rules"`
+	NextCursor string                 `json:"next_cursor,omitempty"` // Continues after the last rule when there are more
 }
 
 // RateLimitEvent - Individual rate limit event in history
@@ -87,17 +228,38 @@ type RateLimitEvent struct {
 	RequestCount int              `json:"request_count,omitempty"`
 	Limit       int              `json:"limit,omitempty"`
 	IsBlocked   bool             `json:"is_blocked"`
+	IPAddress   string           `json:"ip_address,omitempty"`
+	UserAgent   string           `json:"user_agent,omitempty"`
 	Metadata    map[string]string `json:"metadata,omitempty"`
 }
 
 // ClientStats - Response for client statistics queries
 type ClientStats struct {
 	ClientID          string                `json:"client_id"`
+	Client            *domain.Client        `json:"client,omitempty"` // Registry entry of the client, if registered
 	TotalRequests     int                   `json:"total_requests"`
 	BlockedRequests   int                   `json:"blocked_requests"`
 	AllowedRequests   int                   `json:"allowed_requests"`
 	ResourceStats     []ResourceStats       `json:"resource_stats"`
 	TimeSeriesData    []TimeSeriesDataPoint `json:"time_series_data"`
+	Granularity       StatsGranularity      `json:"granularity"`         // Bucket size of the time series; coarser where only rollups are held
+	StartTime         time.Time             `json:"start_time"`          // Range the stats cover
+	EndTime           time.Time             `json:"end_time"`
+	RequestsPerSecond float64               `json:"requests_per_second"` // Average over the range
+	BlockedRate       float64               `json:"blocked_rate"`
+}
+
+// SetRange records the time range the stats cover and computes their
+// rates over it
+func (s *ClientStats) SetRange(startTime, endTime time.Time) {
+	s.StartTime, s.EndTime = startTime, endTime
+	s.RequestsPerSecond, s.BlockedRate = 0, 0
+	if seconds := endTime.Sub(startTime).Seconds(); seconds > 0 {
+		s.RequestsPerSecond = float64(s.TotalRequests) / seconds
+	}
+	if s.TotalRequests > 0 {
+		s.BlockedRate = float64(s.BlockedRequests) / float64(s.TotalRequests)
+	}
 }
 
 // ResourceStats - Statistics for a specific resource
@@ -116,3 +278,238 @@ type TimeSeriesDataPoint struct {
 	BlockedRequests int       `json:"blocked_requests"`
 	AllowedRequests int       `json:"allowed_requests"`
 }
+
+// ClientActivity - Traffic observed from a client
+type ClientActivity struct {
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	TotalRequests int       `json:"total_requests"`
+	IPAddresses   []string  `json:"ip_addresses,omitempty"` // First distinct addresses seen
+	UserAgents    []string  `json:"user_agents,omitempty"`  // First distinct user agents seen
+}
+
+// ClientListing - A registered client and/or one discovered from its traffic
+type ClientListing struct {
+	ID         string          `json:"id"`
+	Registered bool            `json:"registered"`
+	Client     *domain.Client  `json:"client,omitempty"`   // Registry entry, if registered
+	Activity   *ClientActivity `json:"activity,omitempty"` // Observed traffic, if any
+}
+
+// ProjectionLag - How far the read model is behind the event store
+type ProjectionLag struct {
+	Position   uint64  `json:"position"`    // Events applied to the read model
+	Head       uint64  `json:"head"`        // Events stored
+	Pending    uint64  `json:"pending"`     // Events stored but not yet applied
+	LagSeconds float64 `json:"lag_seconds"` // Age of the oldest pending event
+	CatchingUp bool    `json:"catching_up"` // Processing a backlog in bulk
+}
+
+// DecisionExplanation - Response for explain queries: the rule deciding the
+// requests of a client to a resource, how it was chosen, the window math a
+// request would be decided with now, and the last stored decision
+type DecisionExplanation struct {
+	ClientID      string                    `json:"client_id"`
+	Resource      string                    `json:"resource"`
+	Method        string                    `json:"method,omitempty"`
+	Key           string                    `json:"key"`            // Key the limit is counted under
+	StateResource string                    `json:"state_resource"` // Resource the rule's counters are kept under
+	EvaluatedAt   time.Time                 `json:"evaluated_at"`
+	Rule          *domain.RateLimitRule     `json:"rule,omitempty"` // Rule deciding the requests, with any override applied
+	Candidates    []RuleCandidate           `json:"candidates"`
+	Override      *domain.RateLimitOverride `json:"override,omitempty"`
+	Rollout       *RolloutExplanation       `json:"rollout,omitempty"` // Running rollout of the rule
+	Parameters    *AlgorithmParameters      `json:"parameters,omitempty"`
+	Window        *WindowMath               `json:"window,omitempty"`
+	Checks        []Condition               `json:"checks"` // Evaluated in order for a request now; the first failing one decides
+	Decision      string                    `json:"decision"`
+	LastDecision  *DecisionTrace            `json:"last_decision,omitempty"`
+}
+
+// RolloutExplanation - The cohort of a rule's running rollout the key is in
+type RolloutExplanation struct {
+	RolloutID string `json:"rollout_id"`
+	Percent   int    `json:"percent"` // Percentage of clients on the candidate
+	Bucket    int    `json:"bucket"`  // The key's bucket; the key is on the candidate while it is below Percent
+	Canary    bool   `json:"canary"`
+}
+
+// RuleCandidate - A rule of the resource and why it was or was not chosen
+type RuleCandidate struct {
+	Rule     domain.RateLimitRule `json:"rule"`
+	Selected bool                 `json:"selected"`
+	Reason   string               `json:"reason"`
+}
+
+// AlgorithmParameters - The parameters of the algorithm of a rule
+type AlgorithmParameters struct {
+	Algorithm       string  `json:"algorithm"`
+	Limit           int     `json:"limit"`
+	Window          string  `json:"window"`
+	SoftLimit       int     `json:"soft_limit,omitempty"`
+	KeyTemplate     string  `json:"key_template,omitempty"`
+	Capacity        int     `json:"capacity,omitempty"`          // Token and leaky bucket
+	RefillPerSecond float64 `json:"refill_per_second,omitempty"` // Token and leaky bucket
+	SecondsPerToken float64 `json:"seconds_per_token,omitempty"` // Token and leaky bucket
+}
+
+// WindowMath - The state of a client's window as a request now would see it
+type WindowMath struct {
+	WindowStart    time.Time  `json:"window_start"`
+	WindowEnd      time.Time  `json:"window_end"`
+	RequestCount   int        `json:"request_count"`             // Requests counted, before a request now
+	PreviousCount  int        `json:"previous_count,omitempty"`  // Sliding window counter
+	PreviousWeight float64    `json:"previous_weight,omitempty"` // Sliding window counter
+	Estimate       *float64   `json:"estimate,omitempty"`        // Sliding window counter
+	Tokens         *float64   `json:"tokens,omitempty"`          // Token and leaky bucket level, before a request now
+	Remaining      int        `json:"remaining"`                 // Requests allowed after a request now
+	RetryAt        *time.Time `json:"retry_at,omitempty"`        // When a request would be allowed, if not now
+}
+
+// Condition - One condition of a decision and how it evaluated
+type Condition struct {
+	Check      string `json:"check"`
+	Expression string `json:"expression"` // The check with its values, e.g. "5 < 5"
+	Passed     bool   `json:"passed"`
+}
+
+// DecisionTrace - A stored decision and the conditions it was decided on
+type DecisionTrace struct {
+	EventID      string      `json:"event_id"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Allowed      bool        `json:"allowed"`
+	RequestCount int         `json:"request_count"`
+	Limit        int         `json:"limit"`
+	WindowStart  time.Time   `json:"window_start"`
+	WindowEnd    time.Time   `json:"window_end"`
+	BlockedUntil *time.Time  `json:"blocked_until,omitempty"`
+	Conditions   []Condition `json:"conditions"`
+}
+
+// DecisionCount - Rate limit decisions counted under one set of metric labels
+type DecisionCount struct {
+	Resource  string `json:"resource"`
+	Tenant    string `json:"tenant"` // Tier of the registered client, "none" without one
+	Algorithm string `json:"algorithm"`
+	Decision  string `json:"decision"` // "allowed" or "blocked"
+	Count     uint64 `json:"count"`
+}
+
+// DegradedCount - Checks of a resource decided by the storage failure
+// policy in one mode
+type DegradedCount struct {
+	Resource string `json:"resource"`
+	Mode     string `json:"mode"` // "open" or "closed"
+	Count    uint64 `json:"count"`
+}
+
+// KeyStats - Cardinality of the client:resource keys an event store holds
+type KeyStats struct {
+	Keys      int    `json:"keys"`
+	MaxKeys   int    `json:"max_keys"` // 0 when unlimited
+	Evictions uint64 `json:"evictions"`
+}
+
+// BlockedCacheStats - Size and lookups of the cache of blocked clients
+type BlockedCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// AggregateCacheStats - Size and lookups of the cache of rebuilt aggregates
+type AggregateCacheStats struct {
+	Entries       int    `json:"entries"`
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"` // Aggregates dropped as stale or erased
+}
+
+// WriteBatchStats - Batches of event saves and the saves waiting for one
+type WriteBatchStats struct {
+	Batches uint64 `json:"batches"`
+	Writes  uint64 `json:"writes"` // Saves made in batches
+	Pending int    `json:"pending"`
+}
+
+// ReadReplicaStats - Lag of the replicas of the read model and the queries
+// answered by the primary and the replicas
+type ReadReplicaStats struct {
+	Replicas []ReplicaStats   `json:"replicas"`
+	Queries  []ReadQueryCount `json:"queries"`
+}
+
+// ReplicaStats - Lag of a replica of the read model as last measured
+type ReplicaStats struct {
+	Name       string  `json:"name"`
+	LagSeconds float64 `json:"lag_seconds"` // Lag when measured plus the time since
+	Available  bool    `json:"available"`   // False when its lag could not be measured or a query failed
+	Queries    uint64  `json:"queries"`     // Queries it answered
+}
+
+// ReadQueryCount - Queries of a type answered by the primary or by replicas
+type ReadQueryCount struct {
+	Query  string `json:"query"`  // "status", "history", "stats" or "activity"
+	Target string `json:"target"` // "primary" or "replica"
+	Count  uint64 `json:"count"`
+}
+
+// SubscriberStats - Delivery statistics of an event bus subscriber
+type SubscriberStats struct {
+	ID         uint64 `json:"id"`
+	EventType  string `json:"event_type"` // "*" for every event
+	Policy     string `json:"policy"`
+	BufferSize int    `json:"buffer_size"`
+	Queued     int    `json:"queued"`
+	Delivered  uint64 `json:"delivered"`
+	Dropped    uint64 `json:"dropped"`
+	Paused     bool   `json:"paused"`
+	Held       int    `json:"held"` // Events held while paused
+}
+
+// ThreatFeedStats - Import state and match counts of a threat feed
+type ThreatFeedStats struct {
+	Feed         string     `json:"feed"`
+	Format       string     `json:"format"`
+	Action       string     `json:"action"` // "deny" or "allow"
+	RuleID       string     `json:"rule_id"`
+	Entries      int        `json:"entries"`
+	Added        int        `json:"added"`   // Entries added by the last import that changed the feed
+	Removed      int        `json:"removed"` // Entries removed by the last import that changed the feed
+	Imports      uint64     `json:"imports"`
+	ImportErrors uint64     `json:"import_errors"`
+	Matches      int64      `json:"matches"` // Requests from addresses on the feed
+	LastImportAt *time.Time `json:"last_import_at,omitempty"`
+	LastChangeAt *time.Time `json:"last_change_at,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// ThreatFeedEntry - A network listed by a threat feed, with its provenance
+type ThreatFeedEntry struct {
+	Network   string    `json:"network"`
+	Feed      string    `json:"feed"`
+	Action    string    `json:"action"`
+	Reference string    `json:"reference,omitempty"` // What the feed says about it, e.g. a Spamhaus SBL ID
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// BanListEntry - A network denied or allowed by hand through the ban list
+type BanListEntry struct {
+	Network   string     `json:"network"`
+	Action    string     `json:"action"` // "deny" or "allow"
+	Reason    string     `json:"reason,omitempty"`
+	AddedBy   string     `json:"added_by,omitempty"` // Authenticated principal that added the entry
+	Source    string     `json:"source,omitempty"`   // Who added it upstream, for imported entries
+	AddedAt   time.Time  `json:"added_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Never expires when unset
+}
+
+// BanListImport - What an import changed on the ban list
+type BanListImport struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Removed   int `json:"removed"` // Left out of an import replacing the list
+	Expired   int `json:"expired"` // Skipped, having expired already
+}
@@ -0,0 +1,297 @@
+package queries
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+)
+
+// statusPool holds released statuses, so that answering checks and status
+// queries for many clients does not allocate a status for each answer
+var statusPool = sync.Pool{
+	New: func() interface{} {
+		return new(RateLimitStatus)
+	},
+}
+
+// AcquireStatus returns a zero status, reusing a released one if it can
+func AcquireStatus() *RateLimitStatus {
+	return statusPool.Get().(*RateLimitStatus)
+}
+
+// ReleaseStatus hands a status back for reuse. The caller must hold the only
+// reference to it and must not use it afterwards.
+func ReleaseStatus(status *RateLimitStatus) {
+	*status = RateLimitStatus{}
+	statusPool.Put(status)
+}
+
+// StatusFromEvent builds the rate limit status recorded by a decision event.
+// It returns nil for events that do not record a decision.
+func StatusFromEvent(event domain.Event, now time.Time) *RateLimitStatus {
+	switch e := event.(type) {
+	case *domain.RateLimitAppliedEvent:
+		status := AcquireStatus()
+		*status = RateLimitStatus{
+			ClientID:       e.ClientID,
+			Resource:       e.Resource,
+			IsAllowed:      true,
+			RequestCount:   e.RequestCount,
+			Limit:          e.Limit,
+			RemainingQuota: e.RemainingQuota,
+			WindowStart:    e.WindowStart,
+			WindowEnd:      e.WindowEnd,
+			ResetTime:      e.WindowEnd,
+			IsBlocked:      false,
+			Warning:        softLimitWarning(e),
+		}
+		return status
+	case *domain.RateLimitExceededEvent:
+		status := AcquireStatus()
+		*status = RateLimitStatus{
+			ClientID:       e.ClientID,
+			Resource:       e.Resource,
+			IsAllowed:      false,
+			RequestCount:   e.RequestCount,
+			Limit:          e.Limit,
+			RemainingQuota: 0,
+			WindowStart:    e.WindowStart,
+			WindowEnd:      e.WindowEnd,
+			ResetTime:      e.WindowEnd,
+			IsBlocked:      true,
+			BlockedUntil:   e.BlockedUntil,
+			RetryAfter:     RetryAfterSeconds(e.BlockedUntil, now),
+		}
+		return status
+	case *domain.TokensLeasedEvent:
+		status := AcquireStatus()
+		*status = RateLimitStatus{
+			ClientID:       e.ClientID,
+			Resource:       e.Resource,
+			IsAllowed:      true,
+			RequestCount:   e.RequestCount,
+			Limit:          e.Limit,
+			RemainingQuota: e.RemainingQuota,
+			WindowStart:    e.WindowStart,
+			WindowEnd:      e.WindowEnd,
+			ResetTime:      e.WindowEnd,
+		}
+		return status
+	case *domain.LeaseSettledEvent:
+		status := AcquireStatus()
+		*status = RateLimitStatus{
+			ClientID:       e.ClientID,
+			Resource:       e.Resource,
+			IsAllowed:      true,
+			RequestCount:   e.RequestCount,
+			Limit:          e.Limit,
+			RemainingQuota: e.RemainingQuota,
+			WindowStart:    e.WindowStart,
+			WindowEnd:      e.WindowEnd,
+			ResetTime:      e.WindowEnd,
+		}
+		return status
+	default:
+		return nil
+	}
+}
+
+// softLimitWarning describes the usage of a quota at or above the soft
+// threshold of its rule, or returns "" below it
+func softLimitWarning(event *domain.RateLimitAppliedEvent) string {
+	used := event.Limit - event.RemainingQuota
+	if event.SoftLimit <= 0 || used < event.SoftLimit {
+		return ""
+	}
+	return fmt.Sprintf("soft limit reached: %d of %d requests used", used, event.Limit)
+}
+
+// CombineWindows builds the status of a rule with extra windows from the
+// statuses of its windows, in the order of limits: the rule's own window
+// first. The first window that denies requests, or else the one with the
+// least quota left, binds the status, which lists the budget of every
+// window. Windows without recorded decisions have their whole limit left.
+// The statuses are released.
+func CombineWindows(limits []domain.WindowLimit, statuses []*RateLimitStatus) *RateLimitStatus {
+	binding, denied := 0, -1
+	for i, status := range statuses {
+		if status.Limit == 0 && status.RequestCount == 0 {
+			status.Limit = limits[i].Limit
+			status.RemainingQuota = limits[i].Limit
+		}
+		if !status.IsAllowed && denied < 0 {
+			denied = i
+		}
+		if status.RemainingQuota < statuses[binding].RemainingQuota {
+			binding = i
+		}
+	}
+	if denied >= 0 {
+		binding = denied
+	}
+
+	combined := AcquireStatus()
+	*combined = *statuses[binding]
+	combined.Resource = statuses[0].Resource
+	combined.Warning = statuses[0].Warning
+	combined.BindingWindow = domain.FormatWindow(limits[binding].Window)
+	combined.Windows = make([]WindowStatus, len(statuses))
+	for i, status := range statuses {
+		combined.Windows[i] = WindowStatus{
+			Window:         domain.FormatWindow(limits[i].Window),
+			Limit:          status.Limit,
+			RequestCount:   status.RequestCount,
+			RemainingQuota: status.RemainingQuota,
+			ResetTime:      status.ResetTime,
+			IsBlocked:      status.IsBlocked,
+		}
+		ReleaseStatus(status)
+	}
+	return combined
+}
+
+// RetryAfterSeconds returns the whole seconds until retryAt, rounded up so
+// that a client retrying after that delay is allowed
+func RetryAfterSeconds(retryAt, now time.Time) int {
+	wait := retryAt.Sub(now)
+	if wait <= 0 {
+		return 0
+	}
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+// AppendJSON appends the status to b as encoding/json would marshal it. It
+// is written out by hand so that answering a check does not reflect over
+// the status or allocate beyond growing b.
+func (s *RateLimitStatus) AppendJSON(b []byte) []byte {
+	b = append(b, `{"client_id":`...)
+	b = appendJSONString(b, s.ClientID)
+	b = append(b, `,"resource":`...)
+	b = appendJSONString(b, s.Resource)
+	b = append(b, `,"is_allowed":`...)
+	b = strconv.AppendBool(b, s.IsAllowed)
+	b = append(b, `,"request_count":`...)
+	b = strconv.AppendInt(b, int64(s.RequestCount), 10)
+	b = append(b, `,"limit":`...)
+	b = strconv.AppendInt(b, int64(s.Limit), 10)
+	b = append(b, `,"remaining_quota":`...)
+	b = strconv.AppendInt(b, int64(s.RemainingQuota), 10)
+	b = append(b, `,"window_start":`...)
+	b = appendJSONTime(b, s.WindowStart)
+	b = append(b, `,"window_end":`...)
+	b = appendJSONTime(b, s.WindowEnd)
+	b = append(b, `,"reset_time":`...)
+	b = appendJSONTime(b, s.ResetTime)
+	b = append(b, `,"is_blocked":`...)
+	b = strconv.AppendBool(b, s.IsBlocked)
+	// omitempty does not apply to structs, so blocked_until is always set
+	b = append(b, `,"blocked_until":`...)
+	b = appendJSONTime(b, s.BlockedUntil)
+	if s.RetryAfter != 0 {
+		b = append(b, `,"retry_after":`...)
+		b = strconv.AppendInt(b, int64(s.RetryAfter), 10)
+	}
+	if s.Reason != "" {
+		b = append(b, `,"reason":`...)
+		b = appendJSONString(b, s.Reason)
+	}
+	if s.RequestRate != 0 {
+		b = append(b, `,"request_rate":`...)
+		b = appendJSONFloat(b, s.RequestRate)
+	}
+	if s.ExhaustsAt != nil {
+		b = append(b, `,"exhausts_at":`...)
+		b = appendJSONTime(b, *s.ExhaustsAt)
+	}
+	if s.Warning != "" {
+		b = append(b, `,"warning":`...)
+		b = appendJSONString(b, s.Warning)
+	}
+	if s.Granted != 0 {
+		b = append(b, `,"granted_requests":`...)
+		b = strconv.AppendInt(b, int64(s.Granted), 10)
+	}
+	if s.GrantExpiresAt != nil {
+		b = append(b, `,"grant_expires_at":`...)
+		b = appendJSONTime(b, *s.GrantExpiresAt)
+	}
+	if s.Degraded != "" {
+		b = append(b, `,"degraded":`...)
+		b = appendJSONString(b, s.Degraded)
+	}
+	if s.BindingWindow != "" {
+		b = append(b, `,"binding_window":`...)
+		b = appendJSONString(b, s.BindingWindow)
+	}
+	if len(s.Windows) > 0 {
+		b = append(b, `,"windows":[`...)
+		for i := range s.Windows {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = s.Windows[i].appendJSON(b)
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// appendJSON appends the window status to b as encoding/json would marshal
+// it
+func (w *WindowStatus) appendJSON(b []byte) []byte {
+	b = append(b, `{"window":`...)
+	b = appendJSONString(b, w.Window)
+	b = append(b, `,"limit":`...)
+	b = strconv.AppendInt(b, int64(w.Limit), 10)
+	b = append(b, `,"request_count":`...)
+	b = strconv.AppendInt(b, int64(w.RequestCount), 10)
+	b = append(b, `,"remaining_quota":`...)
+	b = strconv.AppendInt(b, int64(w.RemainingQuota), 10)
+	b = append(b, `,"reset_time":`...)
+	b = appendJSONTime(b, w.ResetTime)
+	if w.IsBlocked {
+		b = append(b, `,"is_blocked":true`...)
+	}
+	return append(b, '}')
+}
+
+// appendJSONString appends str as a JSON string. Strings of printable ASCII
+// that encoding/json leaves unescaped are copied as they are; anything else
+// is left to encoding/json.
+func appendJSONString(b []byte, str string) []byte {
+	for i := 0; i < len(str); i++ {
+		if c := str[i]; c < 0x20 || c > 0x7e || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			quoted, _ := json.Marshal(str)
+			return append(b, quoted...)
+		}
+	}
+	b = append(b, '"')
+	b = append(b, str...)
+	return append(b, '"')
+}
+
+// appendJSONTime appends t as time.Time marshals to JSON
+func appendJSONTime(b []byte, t time.Time) []byte {
+	if y := t.Year(); y < 0 || y > 9999 {
+		quoted, _ := t.MarshalJSON()
+		return append(b, quoted...)
+	}
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendJSONFloat appends f as encoding/json marshals it, leaving the
+// exponent format of very small and very large values to encoding/json
+func appendJSONFloat(b []byte, f float64) []byte {
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		marshaled, _ := json.Marshal(f)
+		return append(b, marshaled...)
+	}
+	return strconv.AppendFloat(b, f, 'f', -1, 64)
+}
@@ -0,0 +1,226 @@
+package rulesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// ObjectMeta holds the metadata fields the syncer needs
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Generation      int64             `json:"generation"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Object is a ConfigMap or custom resource as returned by the API server
+type Object struct {
+	Kind     string            `json:"kind"`
+	Metadata ObjectMeta        `json:"metadata"`
+	Spec     json.RawMessage   `json:"spec,omitempty"`
+	Status   json.RawMessage   `json:"status,omitempty"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// Key identifies the object within its kind
+func (o Object) Key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// ObjectList is a list response from the API server
+type ObjectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []Object `json:"items"`
+}
+
+// WatchEvent is a single event of a watch stream
+type WatchEvent struct {
+	Type   string          `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+// KubeClient is a minimal Kubernetes API client for listing, watching and
+// patching objects
+type KubeClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewKubeClient creates a client for the API server at baseURL. The token may
+// be empty, e.g. when talking to `kubectl proxy`.
+func NewKubeClient(baseURL, token string, httpClient *http.Client) *KubeClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &KubeClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// NewInClusterKubeClient creates a client from the pod's service account
+func NewInClusterKubeClient() (*KubeClient, error) {
+	baseURL, token, httpClient, err := InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewKubeClient(baseURL, token, httpClient), nil
+}
+
+// InClusterConfig returns the API server URL, the service account token and
+// an HTTP client trusting the cluster CA, from the pod's service account
+func InClusterConfig() (string, string, *http.Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", "", nil, fmt.Errorf("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return "", "", nil, fmt.Errorf("failed to parse service account CA")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	baseURL := "https://" + net.JoinHostPort(host, port)
+	return baseURL, strings.TrimSpace(string(token)), &http.Client{Transport: transport}, nil
+}
+
+// InClusterNamespace returns the namespace of the pod's service account
+func InClusterNamespace() string {
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+// List lists the objects at path
+func (c *KubeClient) List(ctx context.Context, path string, params url.Values) (*ObjectList, error) {
+	resp, err := c.do(ctx, http.MethodGet, path, params, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list ObjectList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode list: %w", err)
+	}
+	return &list, nil
+}
+
+// Watch streams changes to the objects at path from resourceVersion until
+// the server closes the stream, ctx is done or handle returns an error
+func (c *KubeClient) Watch(ctx context.Context, path string, params url.Values, handle func(WatchEvent) error) error {
+	watchParams := url.Values{}
+	for key, values := range params {
+		watchParams[key] = values
+	}
+	watchParams.Set("watch", "true")
+	watchParams.Set("allowWatchBookmarks", "true")
+
+	resp, err := c.do(ctx, http.MethodGet, path, watchParams, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var event WatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to decode watch event: %w", err)
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
+
+// MergePatch applies a JSON merge patch to the object at path
+func (c *KubeClient) MergePatch(ctx context.Context, path string, patch interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	resp, err := c.do(ctx, http.MethodPatch, path, nil, "application/merge-patch+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a request and returns the response when it succeeded
+func (c *KubeClient) do(ctx context.Context, method, path string, params url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	target := c.baseURL + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call kubernetes api: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return resp, nil
+}
+
+// APIError is a non-2xx response from the Kubernetes or limiter API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api returned %d: %s", e.StatusCode, e.Message)
+}
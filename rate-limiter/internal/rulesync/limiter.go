@@ -0,0 +1,115 @@
+package rulesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// RateLimitRuleSpec describes a rate limiter rule
+type RateLimitRuleSpec struct {
+	Resource      string  `json:"resource"`
+	Method        string  `json:"method,omitempty"` // e.g., "POST"; any method when empty
+	Limit         int     `json:"limit"`
+	Window        string  `json:"window"`                   // e.g., "1m", "1h"
+	Algorithm     string  `json:"algorithm,omitempty"`      // Defaults to sliding_window on the server
+	KeyTemplate   string  `json:"key_template,omitempty"`   // e.g., "header.X-Api-Key"; defaults to the client ID
+	SoftThreshold float64 `json:"soft_threshold,omitempty"` // e.g., 0.8 to warn clients at 80% of the limit
+
+	// Algorithm parameters, e.g. the bucket size and refill rate of a token
+	// bucket, which may give the limit and window instead
+	Parameters *domain.AlgorithmParameters `json:"parameters,omitempty"`
+
+	// Further limits over other windows, e.g. 1000 per hour on top of 10
+	// per second
+	Windows []WindowLimitSpec `json:"windows,omitempty"`
+
+	// Feature flag gating the rule, which is enforced only for the clients
+	// it is on for
+	Flag string `json:"flag,omitempty"`
+
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`      // e.g., "payments-team"
+	ChangeRef   string `json:"change_ref,omitempty"` // e.g., "CHG-1234"
+}
+
+// WindowLimitSpec describes an extra window of a rate limiter rule
+type WindowLimitSpec struct {
+	Limit  int    `json:"limit"`
+	Window string `json:"window"` // e.g., "1h"
+}
+
+// LimiterClient applies rules through the limiter's HTTP API
+type LimiterClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewLimiterClient creates a client for the limiter at baseURL
+func NewLimiterClient(baseURL string) *LimiterClient {
+	return &LimiterClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ApplyRateLimitRule creates or replaces the rule for spec.Resource and
+// spec.Method
+func (c *LimiterClient) ApplyRateLimitRule(ctx context.Context, spec RateLimitRuleSpec) error {
+	return c.send(ctx, http.MethodPut, "/api/v1/ratelimit/rules", spec)
+}
+
+// ApplySecurityRule creates or replaces a rule engine rule
+func (c *LimiterClient) ApplySecurityRule(ctx context.Context, rule ruleDomain.Rule) error {
+	return c.send(ctx, http.MethodPut, "/api/v1/rules", rule)
+}
+
+// DeleteSecurityRule deletes a rule engine rule
+func (c *LimiterClient) DeleteSecurityRule(ctx context.Context, ruleID string) error {
+	err := c.send(ctx, http.MethodDelete, "/api/v1/rules?id="+url.QueryEscape(ruleID), nil)
+	if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// send issues a request with an optional JSON body
+func (c *LimiterClient) send(ctx context.Context, method, path string, payload interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call limiter: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+// Package rulesync reconciles rate limit and rule engine rules declared as
+// Kubernetes custom resources or ConfigMaps into a running limiter.
+package rulesync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+const (
+	// Group is the API group of the RateLimitRule and SecurityRule resources
+	Group = "ratelimit.nickchunglolz.io"
+	// Version is the served version of the custom resources
+	Version = "v1alpha1"
+
+	// ConfigMapLabel selects ConfigMaps holding rule sets
+	ConfigMapLabel = Group + "/rules"
+	// AppliedHashAnnotation records the hash of the last applied ConfigMap data
+	AppliedHashAnnotation = Group + "/applied-hash"
+	// SyncStatusAnnotation records the outcome of the last ConfigMap sync
+	SyncStatusAnnotation = Group + "/sync-status"
+
+	statusSynced = "Synced"
+)
+
+// RuleSet is the JSON document stored under each ConfigMap data key
+type RuleSet struct {
+	RateLimitRules []RateLimitRuleSpec `json:"rateLimitRules,omitempty"`
+	SecurityRules  []json.RawMessage   `json:"securityRules,omitempty"`
+}
+
+// RuleStatus is the status subresource of the custom resources
+type RuleStatus struct {
+	ObservedGeneration int64  `json:"observedGeneration"`
+	AppliedGeneration  int64  `json:"appliedGeneration"`
+	Synced             bool   `json:"synced"`
+	Message            string `json:"message,omitempty"`
+	LastSyncTime       string `json:"lastSyncTime,omitempty"`
+}
+
+// source is one kind of object the syncer watches
+type source struct {
+	kind      string
+	listPath  string
+	params    url.Values
+	reconcile func(ctx context.Context, obj Object) error
+	remove    func(ctx context.Context, obj Object)
+}
+
+// Syncer watches rule objects and reconciles them into the limiter
+type Syncer struct {
+	kube      *KubeClient
+	limiter   *LimiterClient
+	namespace string
+	resync    time.Duration
+
+	mutex sync.Mutex
+	owned map[string][]string // object key -> security rule IDs it applied
+}
+
+// NewSyncer creates a syncer. An empty namespace watches all namespaces;
+// resync bounds how long a watch runs before everything is re-applied.
+func NewSyncer(kube *KubeClient, limiter *LimiterClient, namespace string, resync time.Duration) *Syncer {
+	return &Syncer{
+		kube:      kube,
+		limiter:   limiter,
+		namespace: namespace,
+		resync:    resync,
+		owned:     make(map[string][]string),
+	}
+}
+
+// Run watches all sources until ctx is done
+func (s *Syncer) Run(ctx context.Context) {
+	sources := []source{
+		{
+			kind:      "RateLimitRule",
+			listPath:  s.customResourcePath("ratelimitrules"),
+			reconcile: s.reconcileRateLimitRule,
+			remove:    s.removeRateLimitRule,
+		},
+		{
+			kind:      "SecurityRule",
+			listPath:  s.customResourcePath("securityrules"),
+			reconcile: s.reconcileSecurityRule,
+			remove:    s.removeOwned("SecurityRule"),
+		},
+		{
+			kind:      "ConfigMap",
+			listPath:  s.namespacedPath("/api/v1", "configmaps"),
+			params:    url.Values{"labelSelector": {ConfigMapLabel + "=true"}},
+			reconcile: s.reconcileConfigMap,
+			remove:    s.removeOwned("ConfigMap"),
+		},
+	}
+
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src source) {
+			defer wg.Done()
+			s.watchLoop(ctx, src)
+		}(src)
+	}
+	wg.Wait()
+}
+
+// watchLoop lists and reconciles every object, then applies watch events
+// until the watch expires, and starts over
+func (s *Syncer) watchLoop(ctx context.Context, src source) {
+	known := make(map[string]Object)
+
+	for ctx.Err() == nil {
+		if err := s.syncOnce(ctx, src, known); err != nil {
+			log.Printf("rule-syncer: %s: %v", src.kind, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// syncOnce performs one list and watch cycle
+func (s *Syncer) syncOnce(ctx context.Context, src source, known map[string]Object) error {
+	list, err := s.kube.List(ctx, src.listPath, src.params)
+	if err != nil {
+		return fmt.Errorf("failed to list: %w", err)
+	}
+
+	seen := make(map[string]bool, len(list.Items))
+	for _, obj := range list.Items {
+		seen[obj.Key()] = true
+		known[obj.Key()] = obj
+		s.apply(ctx, src, obj)
+	}
+	for key, obj := range known {
+		if !seen[key] {
+			delete(known, key)
+			src.remove(ctx, obj)
+		}
+	}
+
+	params := url.Values{}
+	for key, values := range src.params {
+		params[key] = values
+	}
+	params.Set("resourceVersion", list.Metadata.ResourceVersion)
+	params.Set("timeoutSeconds", strconv.Itoa(int(s.resync.Seconds())))
+
+	return s.kube.Watch(ctx, src.listPath, params, func(event WatchEvent) error {
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var obj Object
+			if err := json.Unmarshal(event.Object, &obj); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", src.kind, err)
+			}
+			if event.Type == "DELETED" {
+				delete(known, obj.Key())
+				src.remove(ctx, obj)
+				return nil
+			}
+			known[obj.Key()] = obj
+			s.apply(ctx, src, obj)
+		case "ERROR":
+			// Usually 410 Gone: the resource version is too old, so relist
+			return fmt.Errorf("watch expired: %s", event.Object)
+		}
+		return nil
+	})
+}
+
+// apply reconciles one object and logs failures, which are also reported
+// in the object's status
+func (s *Syncer) apply(ctx context.Context, src source, obj Object) {
+	if err := src.reconcile(ctx, obj); err != nil {
+		log.Printf("rule-syncer: %s %s: %v", src.kind, obj.Key(), err)
+	}
+}
+
+// reconcileRateLimitRule applies a RateLimitRule resource
+func (s *Syncer) reconcileRateLimitRule(ctx context.Context, obj Object) error {
+	var spec RateLimitRuleSpec
+	err := json.Unmarshal(obj.Spec, &spec)
+	if err == nil {
+		err = s.limiter.ApplyRateLimitRule(ctx, spec)
+	}
+	return s.reportStatus(ctx, "ratelimitrules", obj, err)
+}
+
+// removeRateLimitRule handles a deleted RateLimitRule. The limiter API has no
+// delete for rate limit rules, so the rule stays active until replaced.
+func (s *Syncer) removeRateLimitRule(ctx context.Context, obj Object) {
+	log.Printf("rule-syncer: RateLimitRule %s deleted; its limit remains active until replaced", obj.Key())
+}
+
+// reconcileSecurityRule applies a SecurityRule resource. The rule ID
+// defaults to <namespace>.<name>.
+func (s *Syncer) reconcileSecurityRule(ctx context.Context, obj Object) error {
+	rule, err := decodeSecurityRule(obj.Spec)
+	if err == nil {
+		if rule.ID == "" {
+			rule.ID = obj.Metadata.Namespace + "." + obj.Metadata.Name
+		}
+		if rule.Name == "" {
+			rule.Name = obj.Metadata.Name
+		}
+		err = s.applySecurityRules(ctx, "SecurityRule/"+obj.Key(), []ruleDomain.Rule{rule})
+	}
+	return s.reportStatus(ctx, "securityrules", obj, err)
+}
+
+// reconcileConfigMap applies every rule set stored in a ConfigMap
+func (s *Syncer) reconcileConfigMap(ctx context.Context, obj Object) error {
+	err := s.applyConfigMap(ctx, obj)
+
+	syncStatus := statusSynced
+	appliedHash := obj.Metadata.Annotations[AppliedHashAnnotation]
+	if err != nil {
+		syncStatus = err.Error()
+	} else {
+		appliedHash = hashData(obj.Data)
+	}
+
+	if obj.Metadata.Annotations[SyncStatusAnnotation] != syncStatus || obj.Metadata.Annotations[AppliedHashAnnotation] != appliedHash {
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{
+					SyncStatusAnnotation:  syncStatus,
+					AppliedHashAnnotation: appliedHash,
+				},
+			},
+		}
+		path := fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", obj.Metadata.Namespace, obj.Metadata.Name)
+		if patchErr := s.kube.MergePatch(ctx, path, patch); patchErr != nil {
+			return fmt.Errorf("failed to update status: %w", patchErr)
+		}
+	}
+	return err
+}
+
+// applyConfigMap parses and applies the rule sets of a ConfigMap
+func (s *Syncer) applyConfigMap(ctx context.Context, obj Object) error {
+	keys := make([]string, 0, len(obj.Data))
+	for key := range obj.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var securityRules []ruleDomain.Rule
+	for _, key := range keys {
+		var set RuleSet
+		if err := json.Unmarshal([]byte(obj.Data[key]), &set); err != nil {
+			return fmt.Errorf("invalid rule set %q: %w", key, err)
+		}
+
+		for _, spec := range set.RateLimitRules {
+			if err := s.limiter.ApplyRateLimitRule(ctx, spec); err != nil {
+				return fmt.Errorf("failed to apply rate limit rule for %q: %w", spec.Resource, err)
+			}
+		}
+		for i, raw := range set.SecurityRules {
+			rule, err := decodeSecurityRule(raw)
+			if err != nil {
+				return fmt.Errorf("invalid security rule %d in %q: %w", i, key, err)
+			}
+			if rule.ID == "" {
+				rule.ID = fmt.Sprintf("%s.%s.%s.%d", obj.Metadata.Namespace, obj.Metadata.Name, strings.TrimSuffix(key, ".json"), i)
+			}
+			securityRules = append(securityRules, rule)
+		}
+	}
+
+	return s.applySecurityRules(ctx, "ConfigMap/"+obj.Key(), securityRules)
+}
+
+// applySecurityRules applies rules on behalf of an object and deletes the
+// rules it applied previously but no longer declares
+func (s *Syncer) applySecurityRules(ctx context.Context, owner string, rules []ruleDomain.Rule) error {
+	current := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := s.limiter.ApplySecurityRule(ctx, rule); err != nil {
+			return fmt.Errorf("failed to apply security rule %q: %w", rule.ID, err)
+		}
+		current[rule.ID] = true
+	}
+
+	s.mutex.Lock()
+	previous := s.owned[owner]
+	ids := make([]string, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	s.owned[owner] = ids
+	s.mutex.Unlock()
+
+	for _, id := range previous {
+		if !current[id] {
+			if err := s.limiter.DeleteSecurityRule(ctx, id); err != nil {
+				return fmt.Errorf("failed to delete security rule %q: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeOwned returns a remove func that deletes the security rules applied
+// on behalf of a deleted object of the given kind
+func (s *Syncer) removeOwned(kind string) func(ctx context.Context, obj Object) {
+	return func(ctx context.Context, obj Object) {
+		owner := kind + "/" + obj.Key()
+		if err := s.applySecurityRules(ctx, owner, nil); err != nil {
+			log.Printf("rule-syncer: %s: %v", owner, err)
+		}
+		s.mutex.Lock()
+		delete(s.owned, owner)
+		s.mutex.Unlock()
+	}
+}
+
+// reportStatus records the outcome of a reconcile in the status subresource,
+// patching only when it changed
+func (s *Syncer) reportStatus(ctx context.Context, plural string, obj Object, reconcileErr error) error {
+	var current RuleStatus
+	if len(obj.Status) > 0 {
+		json.Unmarshal(obj.Status, &current)
+	}
+
+	desired := current
+	desired.ObservedGeneration = obj.Metadata.Generation
+	desired.Synced = reconcileErr == nil
+	desired.Message = ""
+	if reconcileErr != nil {
+		desired.Message = reconcileErr.Error()
+	} else {
+		desired.AppliedGeneration = obj.Metadata.Generation
+	}
+
+	desired.LastSyncTime = current.LastSyncTime
+	if desired != current {
+		desired.LastSyncTime = time.Now().UTC().Format(time.RFC3339)
+		path := fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s/status", Group, Version, obj.Metadata.Namespace, plural, obj.Metadata.Name)
+		if err := s.kube.MergePatch(ctx, path, map[string]interface{}{"status": desired}); err != nil {
+			if apiErr, ok := err.(*APIError); !ok || apiErr.StatusCode != http.StatusNotFound {
+				return fmt.Errorf("failed to update status: %w", err)
+			}
+		}
+	}
+	return reconcileErr
+}
+
+// decodeSecurityRule decodes a rule engine rule, enabling it unless the
+// document sets "enabled" explicitly
+func decodeSecurityRule(raw json.RawMessage) (ruleDomain.Rule, error) {
+	var rule ruleDomain.Rule
+	if err := json.Unmarshal(raw, &rule); err != nil {
+		return rule, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return rule, err
+	}
+	if _, ok := fields["enabled"]; !ok {
+		rule.Enabled = true
+	}
+	return rule, nil
+}
+
+// customResourcePath returns the collection path of a custom resource
+func (s *Syncer) customResourcePath(plural string) string {
+	return s.namespacedPath("/apis/"+Group+"/"+Version, plural)
+}
+
+// namespacedPath scopes a collection to the watched namespace, if any
+func (s *Syncer) namespacedPath(prefix, plural string) string {
+	if s.namespace == "" {
+		return prefix + "/" + plural
+	}
+	return prefix + "/namespaces/" + s.namespace + "/" + plural
+}
+
+// hashData hashes ConfigMap data independently of key order
+func hashData(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(key), key, len(data[key]), data[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,174 @@
+package sidecar
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// pruneInterval is how often denials that ran out are forgotten
+const pruneInterval = time.Minute
+
+// Watcher is told about the clients it watches. Notify is called with the
+// notifier locked, so it must not block: watchers queue notices and drop
+// them when they fall behind.
+type Watcher interface {
+	Notify(notice *Notice)
+}
+
+// Notifier tracks which clients are denied on which resources from the
+// events published on the bus, and tells the watchers of a client when it
+// starts being denied on a resource and when its denials may have been
+// lifted early. A watcher starting to watch a client denied at the time is
+// told its denials in effect, so that a gateway can deny its requests
+// locally without checking them.
+type Notifier struct {
+	mu       sync.Mutex
+	denials  map[string]map[string]time.Time // When each denied client is allowed again, by resource
+	watchers map[string]map[Watcher]struct{} // Watchers by client
+	everyone map[Watcher]struct{}            // Watchers of every client
+}
+
+// NewNotifier creates a notifier knowing of no denials
+func NewNotifier() *Notifier {
+	return &Notifier{
+		denials:  make(map[string]map[string]time.Time),
+		watchers: make(map[string]map[Watcher]struct{}),
+		everyone: make(map[Watcher]struct{}),
+	}
+}
+
+// Run tracks the denials of clients from events until ctx is done or
+// events is closed
+func (n *Notifier) Run(ctx context.Context, events <-chan domain.Event) {
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			n.Observe(event, time.Now())
+		case now := <-prune.C:
+			n.prune(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe updates the denials of the client of event, if any, and tells
+// its watchers
+func (n *Notifier) Observe(event domain.Event, now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if e, ok := event.(*domain.RateLimitExceededEvent); ok {
+		if !e.BlockedUntil.After(now) {
+			return
+		}
+		denials := n.denials[e.ClientID]
+		if until := denials[e.Resource]; until.After(now) {
+			// Already announced; keep the latest end
+			if e.BlockedUntil.After(until) {
+				denials[e.Resource] = e.BlockedUntil
+			}
+			return
+		}
+		if denials == nil {
+			denials = make(map[string]time.Time)
+			n.denials[e.ClientID] = denials
+		}
+		denials[e.Resource] = e.BlockedUntil
+		n.notify(&Notice{ClientID: e.ClientID, Resource: e.Resource, Blocked: true, BlockedUntil: e.BlockedUntil})
+		return
+	}
+
+	clientID, lifts := infrastructure.LiftedClient(event)
+	if !lifts {
+		return
+	}
+	denials, denied := n.denials[clientID]
+	if !denied {
+		return
+	}
+	delete(n.denials, clientID)
+	for _, until := range denials {
+		if until.After(now) {
+			n.notify(&Notice{ClientID: clientID})
+			return
+		}
+	}
+}
+
+// Watch tells w about clientID from now on, starting with its denials in
+// effect
+func (n *Notifier) Watch(w Watcher, clientID string, now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	watchers := n.watchers[clientID]
+	if watchers == nil {
+		watchers = make(map[Watcher]struct{})
+		n.watchers[clientID] = watchers
+	}
+	watchers[w] = struct{}{}
+
+	for resource, until := range n.denials[clientID] {
+		if until.After(now) {
+			w.Notify(&Notice{ClientID: clientID, Resource: resource, Blocked: true, BlockedUntil: until})
+		}
+	}
+}
+
+// Unwatch stops telling w about clientID
+func (n *Notifier) Unwatch(w Watcher, clientID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.watchers[clientID], w)
+	if len(n.watchers[clientID]) == 0 {
+		delete(n.watchers, clientID)
+	}
+}
+
+// WatchAll tells w about every client from now on
+func (n *Notifier) WatchAll(w Watcher) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.everyone[w] = struct{}{}
+}
+
+// notify tells the watchers of the client of notice; the caller holds the
+// lock
+func (n *Notifier) notify(notice *Notice) {
+	for w := range n.watchers[notice.ClientID] {
+		w.Notify(notice)
+	}
+	for w := range n.everyone {
+		w.Notify(notice)
+	}
+}
+
+// prune forgets the denials that ran out by now
+func (n *Notifier) prune(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for clientID, denials := range n.denials {
+		for resource, until := range denials {
+			if !until.After(now) {
+				delete(denials, resource)
+			}
+		}
+		if len(denials) == 0 {
+			delete(n.denials, clientID)
+		}
+	}
+}
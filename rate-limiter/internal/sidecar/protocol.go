@@ -0,0 +1,430 @@
+// Package sidecar serves checks to a co-located process over a binary
+// protocol, a stream of length-delimited ratelimit.v1.CheckRequest and
+// CheckResponse messages (proto/ratelimit/v1/sidecar.proto), skipping the
+// HTTP parsing and JSON of the check endpoint. The same messages are sent
+// by gateways on the long-lived gRPC check stream of
+// proto/ratelimit/v1/stream.proto.
+package sidecar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// MaxMessageBytes is the size of the largest message either side accepts
+const MaxMessageBytes = 64 << 10
+
+// Field numbers of CheckRequest in proto/ratelimit/v1/sidecar.proto
+const (
+	requestID        protowire.Number = 1
+	requestClientID  protowire.Number = 2
+	requestResource  protowire.Number = 3
+	requestMethod    protowire.Number = 4
+	requestIPAddress protowire.Number = 5
+	requestUserAgent protowire.Number = 6
+	requestPath      protowire.Number = 7
+	requestGrant     protowire.Number = 8
+)
+
+// Field numbers of CheckResponse in proto/ratelimit/v1/sidecar.proto
+const (
+	responseID     protowire.Number = 1
+	responseStatus protowire.Number = 2
+	responseError  protowire.Number = 3
+)
+
+// Field numbers of StreamMessage, ClientBlocked and ClientUnblocked in
+// proto/ratelimit/v1/stream.proto
+const (
+	streamDecision     protowire.Number = 1
+	streamBlocked      protowire.Number = 2
+	streamUnblocked    protowire.Number = 3
+	noticeClientID     protowire.Number = 1
+	noticeResource     protowire.Number = 2
+	noticeBlockedUntil protowire.Number = 3
+)
+
+// Field numbers of WatchRequest in proto/ratelimit/v1/stream.proto
+const (
+	watchWatch   protowire.Number = 1
+	watchUnwatch protowire.Number = 2
+)
+
+// Field numbers of the RateLimitStatus fields a Response decodes
+const (
+	statusIsAllowed      protowire.Number = 3
+	statusLimit          protowire.Number = 5
+	statusRemainingQuota protowire.Number = 6
+	statusResetTime      protowire.Number = 9
+	statusRetryAfter     protowire.Number = 12
+	statusDegraded       protowire.Number = 19
+)
+
+var errMalformed = errors.New("malformed message")
+
+// Request is a check of one request
+type Request struct {
+	ID        uint64
+	ClientID  string
+	Resource  string
+	Method    string
+	IPAddress string
+	UserAgent string
+	Path      string
+	Grant     int
+}
+
+// AppendProto appends the request to b as a ratelimit.v1.CheckRequest
+func (r *Request) AppendProto(b []byte) []byte {
+	b = appendVarint(b, requestID, r.ID)
+	b = appendString(b, requestClientID, r.ClientID)
+	b = appendString(b, requestResource, r.Resource)
+	b = appendString(b, requestMethod, r.Method)
+	b = appendString(b, requestIPAddress, r.IPAddress)
+	b = appendString(b, requestUserAgent, r.UserAgent)
+	b = appendString(b, requestPath, r.Path)
+	b = appendVarint(b, requestGrant, uint64(int64(r.Grant)))
+	return b
+}
+
+// UnmarshalProto decodes a ratelimit.v1.CheckRequest from b, skipping
+// unknown fields
+func (r *Request) UnmarshalProto(b []byte) error {
+	*r = Request{}
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == requestID && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.ID = v
+			return n, nil
+		case num == requestGrant && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Grant = int(int64(v))
+			return n, nil
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case requestClientID:
+				r.ClientID = string(v)
+			case requestResource:
+				r.Resource = string(v)
+			case requestMethod:
+				r.Method = string(v)
+			case requestIPAddress:
+				r.IPAddress = string(v)
+			case requestUserAgent:
+				r.UserAgent = string(v)
+			case requestPath:
+				r.Path = string(v)
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// Response is the answer to a check, with the fields of its status a
+// caller enforces the decision by
+type Response struct {
+	ID         uint64
+	IsAllowed  bool
+	Limit      int
+	Remaining  int
+	ResetTime  time.Time
+	RetryAfter int    // Seconds
+	Degraded   string // "fail-open" or "fail-closed" when decided without storage
+	Error      string // Set when the check failed
+}
+
+// appendResponse appends the answer to the check id, status or err, to b
+// as a ratelimit.v1.CheckResponse. scratch is reused for encoding the
+// status, and returned for the next answer.
+func appendResponse(b, scratch []byte, id uint64, status *queries.RateLimitStatus, err string) ([]byte, []byte) {
+	b = appendVarint(b, responseID, id)
+	if status != nil {
+		scratch = status.AppendProto(scratch[:0])
+		b = protowire.AppendTag(b, responseStatus, protowire.BytesType)
+		b = protowire.AppendBytes(b, scratch)
+	}
+	b = appendString(b, responseError, err)
+	return b, scratch
+}
+
+// UnmarshalProto decodes a ratelimit.v1.CheckResponse from b, skipping
+// the fields of its status a Response leaves out
+func (r *Response) UnmarshalProto(b []byte) error {
+	*r = Response{}
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == responseID && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.ID = v
+			return n, nil
+		case num == responseStatus && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			return n, r.unmarshalStatus(v)
+		case num == responseError && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			r.Error = string(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// unmarshalStatus decodes the fields of a ratelimit.v1.RateLimitStatus a
+// Response holds
+func (r *Response) unmarshalStatus(b []byte) error {
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case typ == protowire.VarintType && (num == statusIsAllowed || num == statusLimit || num == statusRemainingQuota || num == statusRetryAfter):
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case statusIsAllowed:
+				r.IsAllowed = v != 0
+			case statusLimit:
+				r.Limit = int(int64(v))
+			case statusRemainingQuota:
+				r.Remaining = int(int64(v))
+			case statusRetryAfter:
+				r.RetryAfter = int(int64(v))
+			}
+			return n, nil
+		case num == statusResetTime && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			t, err := unmarshalTimestamp(v)
+			r.ResetTime = t
+			return n, err
+		case num == statusDegraded && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			r.Degraded = string(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// StreamMessage is a message sent by the server on a check stream: the
+// answer to a check, or a notice about a client checked on the stream
+type StreamMessage struct {
+	Decision *Response // Set on answers
+	Notice   *Notice   // Set on notices
+}
+
+// Notice tells a stream that a client it checked is now denied on a
+// resource, or that its denials may have been lifted early
+type Notice struct {
+	ClientID     string
+	Resource     string // Set when Blocked
+	Blocked      bool
+	BlockedUntil time.Time // Set when Blocked
+}
+
+// WatchRequest changes the clients a watch stream is told about
+type WatchRequest struct {
+	Watch   []string
+	Unwatch []string
+}
+
+// AppendProto appends the request to b as a ratelimit.v1.WatchRequest
+func (r *WatchRequest) AppendProto(b []byte) []byte {
+	for _, clientID := range r.Watch {
+		b = protowire.AppendTag(b, watchWatch, protowire.BytesType)
+		b = protowire.AppendString(b, clientID)
+	}
+	for _, clientID := range r.Unwatch {
+		b = protowire.AppendTag(b, watchUnwatch, protowire.BytesType)
+		b = protowire.AppendString(b, clientID)
+	}
+	return b
+}
+
+// UnmarshalProto decodes a ratelimit.v1.WatchRequest from b, skipping
+// unknown fields
+func (r *WatchRequest) UnmarshalProto(b []byte) error {
+	*r = WatchRequest{}
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != watchWatch && num != watchUnwatch) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if num == watchWatch {
+			r.Watch = append(r.Watch, string(v))
+		} else {
+			r.Unwatch = append(r.Unwatch, string(v))
+		}
+		return n, nil
+	})
+}
+
+// appendDecision appends the answer to the check id, status or err, to b
+// as a ratelimit.v1.StreamMessage
+func appendDecision(b []byte, id uint64, status *queries.RateLimitStatus, err string) []byte {
+	response, _ := appendResponse(nil, nil, id, status, err)
+	b = protowire.AppendTag(b, streamDecision, protowire.BytesType)
+	return protowire.AppendBytes(b, response)
+}
+
+// appendNotice appends n to b as a ratelimit.v1.StreamMessage
+func appendNotice(b []byte, n *Notice) []byte {
+	notice := appendString(nil, noticeClientID, n.ClientID)
+	num := streamUnblocked
+	if n.Blocked {
+		num = streamBlocked
+		notice = appendString(notice, noticeResource, n.Resource)
+		timestamp := appendVarint(nil, 1, uint64(n.BlockedUntil.Unix()))
+		timestamp = appendVarint(timestamp, 2, uint64(n.BlockedUntil.Nanosecond()))
+		notice = protowire.AppendTag(notice, noticeBlockedUntil, protowire.BytesType)
+		notice = protowire.AppendBytes(notice, timestamp)
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, notice)
+}
+
+// UnmarshalProto decodes a ratelimit.v1.StreamMessage from b, skipping
+// unknown fields
+func (m *StreamMessage) UnmarshalProto(b []byte) error {
+	*m = StreamMessage{}
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		switch num {
+		case streamDecision:
+			m.Decision = new(Response)
+			return n, m.Decision.UnmarshalProto(v)
+		case streamBlocked, streamUnblocked:
+			m.Notice = &Notice{Blocked: num == streamBlocked}
+			return n, m.Notice.unmarshalProto(v)
+		}
+		return n, nil
+	})
+}
+
+// unmarshalProto decodes a ratelimit.v1.ClientBlocked or ClientUnblocked
+// into n
+func (n *Notice) unmarshalProto(b []byte) error {
+	return eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, size := protowire.ConsumeBytes(b)
+		if size < 0 {
+			return size, nil
+		}
+		switch num {
+		case noticeClientID:
+			n.ClientID = string(v)
+		case noticeResource:
+			n.Resource = string(v)
+		case noticeBlockedUntil:
+			t, err := unmarshalTimestamp(v)
+			n.BlockedUntil = t
+			return size, err
+		}
+		return size, nil
+	})
+}
+
+// unmarshalTimestamp decodes a google.protobuf.Timestamp
+func unmarshalTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := eachField(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.VarintType || (num != 1 && num != 2) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if num == 1 {
+			seconds = int64(v)
+		} else {
+			nanos = int64(v)
+		}
+		return n, nil
+	})
+	return time.Unix(seconds, nanos), err
+}
+
+// eachField calls field with the number, type and remaining bytes of each
+// field of the message b. field returns the length of the value it
+// consumed, negative when it is malformed.
+func eachField(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errMalformed
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendString appends a string field unless it is empty
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendVarint appends a varint field unless it is zero
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// AppendMessage appends msg to b delimited by its length
+func AppendMessage(b, msg []byte) []byte {
+	return protowire.AppendBytes(b, msg)
+}
+
+// ReadMessage reads the next length-delimited message from r into buf,
+// growing it as needed, and returns it
+func ReadMessage(r *bufio.Reader, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return buf, err
+	}
+	if size > MaxMessageBytes {
+		return buf, fmt.Errorf("message of %d bytes exceeds %d", size, MaxMessageBytes)
+	}
+
+	if cap(buf) < int(size) {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return buf, err
+	}
+	return buf, nil
+}
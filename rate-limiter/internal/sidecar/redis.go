@@ -0,0 +1,156 @@
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+)
+
+const (
+	// redisNoticeBuffer is how many notices wait to be published; more are
+	// dropped while Redis does not keep up
+	redisNoticeBuffer = 1024
+
+	// redisTimeout bounds dialing Redis and each publish
+	redisTimeout = time.Second
+)
+
+// redisNotice is a notice as published on Redis
+type redisNotice struct {
+	ClientID     string     `json:"client_id"`
+	Resource     string     `json:"resource,omitempty"`
+	Blocked      bool       `json:"blocked"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+}
+
+// RedisPublisher publishes the notices about every client on Redis, for
+// gateways that subscribe there rather than keeping a gRPC stream open.
+// Each notice is published as JSON on the channel of its client, the
+// configured prefix followed by the client ID, so a gateway subscribes to
+// the clients it serves, or to all of them with PSUBSCRIBE.
+type RedisPublisher struct {
+	addr     string
+	password string
+	prefix   string
+	notices  chan *Notice
+}
+
+// NewRedisPublisher creates a publisher to the configured Redis server
+func NewRedisPublisher(cfg config.NoticeConfig) *RedisPublisher {
+	return &RedisPublisher{
+		addr:     cfg.RedisAddr,
+		password: cfg.RedisPassword,
+		prefix:   cfg.RedisChannelPrefix,
+		notices:  make(chan *Notice, redisNoticeBuffer),
+	}
+}
+
+// Notify queues notice to be published, dropping it when the queue is
+// full
+func (p *RedisPublisher) Notify(notice *Notice) {
+	select {
+	case p.notices <- notice:
+	default:
+	}
+}
+
+// Run publishes the queued notices until ctx is done. The connection is
+// redialed after a failure; a notice that cannot be published is dropped.
+func (p *RedisPublisher) Run(ctx context.Context) {
+	var conn net.Conn
+	var rw *bufio.ReadWriter
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	failing := false
+	for {
+		var notice *Notice
+		select {
+		case notice = <-p.notices:
+		case <-ctx.Done():
+			return
+		}
+
+		err := func() error {
+			if conn == nil {
+				dialer := net.Dialer{Timeout: redisTimeout}
+				c, err := dialer.DialContext(ctx, "tcp", p.addr)
+				if err != nil {
+					return err
+				}
+				conn, rw = c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+				conn.SetDeadline(time.Now().Add(redisTimeout))
+				if p.password != "" {
+					if err := redisCommand(rw, "AUTH", p.password); err != nil {
+						return err
+					}
+				}
+			}
+			conn.SetDeadline(time.Now().Add(redisTimeout))
+			return p.publish(rw, notice)
+		}()
+
+		switch {
+		case err != nil:
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			if !failing {
+				log.Printf("Publishing notices to Redis at %s failed: %v", p.addr, err)
+				failing = true
+			}
+		case failing:
+			log.Printf("Publishing notices to Redis at %s recovered", p.addr)
+			failing = false
+		}
+	}
+}
+
+// publish publishes notice on the channel of its client
+func (p *RedisPublisher) publish(rw *bufio.ReadWriter, notice *Notice) error {
+	message := redisNotice{ClientID: notice.ClientID, Resource: notice.Resource, Blocked: notice.Blocked}
+	if notice.Blocked {
+		message.BlockedUntil = &notice.BlockedUntil
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return redisCommand(rw, "PUBLISH", p.prefix+notice.ClientID, string(payload))
+}
+
+// redisCommand writes a command as a RESP array and reads its reply, a
+// simple string or integer
+func redisCommand(rw *bufio.ReadWriter, args ...string) error {
+	fmt.Fprintf(rw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(rw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := rw.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	switch {
+	case strings.HasPrefix(reply, "-"):
+		return fmt.Errorf("redis: %s", reply[1:])
+	case strings.HasPrefix(reply, "+"), strings.HasPrefix(reply, ":"):
+		return nil
+	}
+	return fmt.Errorf("redis: unexpected reply %q", reply)
+}
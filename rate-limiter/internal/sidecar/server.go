@@ -0,0 +1,183 @@
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
+	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/config"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// Checker decides checks, as api.RateLimiterService does
+type Checker interface {
+	CheckRequestRateLimitWithGrant(ctx context.Context, resource string, attrs keytemplate.Attributes, grant int) (*queries.RateLimitStatus, error)
+}
+
+// Server answers checks sent over the sidecar protocol. Each connection is
+// served by one goroutine, which answers its checks in order; answers to
+// checks sent back to back are written together. Callers wanting checks
+// decided in parallel open several connections.
+type Server struct {
+	checker    Checker
+	addr       string
+	socketMode os.FileMode
+	accessLog  *accesslog.Logger
+}
+
+// NewServer creates a server deciding checks with checker
+func NewServer(cfg config.SidecarConfig, checker Checker) *Server {
+	return &Server{
+		checker:    checker,
+		addr:       cfg.Addr,
+		socketMode: cfg.SocketMode,
+	}
+}
+
+// WithAccessLog records the decisions of checks in the access log, as the
+// HTTP check endpoints do
+func (s *Server) WithAccessLog(logger *accesslog.Logger) *Server {
+	s.accessLog = logger
+	return s
+}
+
+// ListenAndServe listens on the configured address, a TCP address, Unix
+// socket or socket passed by systemd as api.Listen takes, and serves checks
+func (s *Server) ListenAndServe() error {
+	listener, err := api.Listen(context.Background(), s.addr, 0, s.socketMode)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener and serves checks on them until
+// it fails
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the checks sent on conn until it is closed or sends a
+// malformed message
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var in, body, scratch, out []byte
+	var req Request
+	for {
+		var err error
+		if in, err = ReadMessage(reader, in); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Sidecar connection closed: %v", err)
+			}
+			return
+		}
+		if err := req.UnmarshalProto(in); err != nil {
+			log.Printf("Sidecar connection closed: %v", err)
+			return
+		}
+
+		start := time.Now()
+		status, failure := check(context.Background(), s.checker, &req)
+		logDecision(s.accessLog, "sidecar", start, &req, status)
+		body, scratch = appendResponse(body[:0], scratch, req.ID, status, failure)
+		if status != nil {
+			queries.ReleaseStatus(status)
+		}
+		out = AppendMessage(out[:0], body)
+		if _, err := writer.Write(out); err != nil {
+			return
+		}
+
+		// Answer checks sent back to back in one write
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// check decides req with checker, returning its status or why it failed
+func check(ctx context.Context, checker Checker, req *Request) (*queries.RateLimitStatus, string) {
+	switch {
+	case req.ClientID == "" || req.Resource == "":
+		return nil, "client_id and resource are required"
+	case req.Grant < 0:
+		return nil, "grant must not be negative"
+	}
+
+	attrs := keytemplate.Attributes{
+		ClientID:  req.ClientID,
+		Resource:  req.Resource,
+		IPAddress: req.IPAddress,
+		UserAgent: req.UserAgent,
+		Method:    req.Method,
+		Path:      req.Path,
+	}
+	status, err := checker.CheckRequestRateLimitWithGrant(ctx, req.Resource, attrs, req.Grant)
+	switch {
+	case err == nil:
+		return status, ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, "Request timed out"
+	case errors.Is(err, context.Canceled):
+		return nil, "Request canceled"
+	default:
+		log.Printf("Sidecar check of %s failed: %v", req.Resource, err)
+		return nil, "Internal server error"
+	}
+}
+
+// logDecision records the decision of req, made since start, in logger
+// under transport. Checks that failed are logged as they fail instead.
+func logDecision(logger *accesslog.Logger, transport string, start time.Time, req *Request, status *queries.RateLimitStatus) {
+	if logger == nil || status == nil {
+		return
+	}
+
+	entry := accesslog.Entry{
+		Time:           start,
+		Method:         req.Method,
+		Path:           req.Path,
+		Status:         http.StatusOK,
+		Duration:       time.Since(start),
+		ClientIP:       req.IPAddress,
+		ClientID:       req.ClientID,
+		Resource:       req.Resource,
+		Decision:       accesslog.DecisionAllowed,
+		Reason:         status.Reason,
+		RemainingQuota: &status.RemainingQuota,
+		Transport:      transport,
+	}
+	if !status.IsAllowed {
+		entry.Status = http.StatusTooManyRequests
+		entry.Decision = accesslog.DecisionDenied
+	}
+	if status.Degraded != "" {
+		entry.Reason += ", failing " + strings.TrimPrefix(status.Degraded, "fail-")
+	}
+	if err := logger.Log(entry); err != nil {
+		log.Printf("Error writing access log entry: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package sidecar
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/NickChunglolz/rate-limiter/internal/accesslog"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+const (
+	// streamConcurrency bounds the checks of a stream decided at once
+	streamConcurrency = 64
+
+	// maxWatchedClients bounds the clients a stream is sent notices about;
+	// clients first checked on a check stream watching as many are not
+	maxWatchedClients = 10000
+
+	// streamNoticeBuffer is how many notices a stream queues; more are
+	// dropped until it catches up
+	streamNoticeBuffer = 256
+)
+
+// Full names of the stream methods, for clients opening streams on a
+// connection
+const (
+	CheckStreamMethod = "/ratelimit.v1.CheckStream/Check"
+	WatchStreamMethod = "/ratelimit.v1.CheckStream/Watch"
+)
+
+// checkStreamDesc describes the ratelimit.v1.CheckStream service of
+// proto/ratelimit/v1/stream.proto
+var checkStreamDesc = grpc.ServiceDesc{
+	ServiceName: "ratelimit.v1.CheckStream",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Check",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*StreamServer).serveChecks(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Watch",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(*StreamServer).serveWatch(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ratelimit/v1/stream.proto",
+}
+
+// Codec is the gRPC codec of servers and clients of the check stream. It
+// encodes the messages of the stream by hand, as the sidecar protocol
+// does, and every other message, such as health checks', with protobuf.
+type Codec struct{}
+
+// frame is a message already encoded
+type frame []byte
+
+// Name returns the name of the protobuf codec, which Codec stands in for
+func (Codec) Name() string {
+	return "proto"
+}
+
+// Marshal encodes v
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case frame:
+		return v, nil
+	case interface{ AppendProto(b []byte) []byte }:
+		return v.AppendProto(nil), nil
+	case proto.Message:
+		return proto.Marshal(v)
+	}
+	return nil, fmt.Errorf("cannot encode %T", v)
+}
+
+// Unmarshal decodes data into v
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case interface{ UnmarshalProto(b []byte) error }:
+		return v.UnmarshalProto(data)
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	}
+	return fmt.Errorf("cannot decode %T", v)
+}
+
+// StreamServer answers checks sent by gateways on long-lived gRPC streams.
+// The checks of a stream are decided concurrently and answered as they
+// are decided, each with the id of its request. Between answers the server
+// pushes the notices of a Notifier about the clients checked on the
+// stream. Watch streams are pushed notices about the clients they name
+// without checking them.
+type StreamServer struct {
+	checker   Checker
+	notifier  *Notifier
+	accessLog *accesslog.Logger
+}
+
+// NewStreamServer creates a stream server deciding checks with checker and
+// pushing the notices of notifier, if not nil
+func NewStreamServer(checker Checker, notifier *Notifier) *StreamServer {
+	return &StreamServer{
+		checker:  checker,
+		notifier: notifier,
+	}
+}
+
+// WithAccessLog records the decisions of checks in the access log, as the
+// HTTP check endpoints do
+func (s *StreamServer) WithAccessLog(logger *accesslog.Logger) *StreamServer {
+	s.accessLog = logger
+	return s
+}
+
+// Register adds the check stream service to server, which must encode
+// messages with Codec
+func (s *StreamServer) Register(server *grpc.Server) {
+	server.RegisterService(&checkStreamDesc, s)
+}
+
+// streamConn is the state of one stream, watching clients for it
+type streamConn struct {
+	stream   grpc.ServerStream
+	notifier *Notifier
+	sendMu   sync.Mutex
+	notices  chan *Notice
+	pushed   chan struct{} // Closed once the queued notices are sent
+
+	mu      sync.Mutex
+	watched map[string]struct{}
+}
+
+// open starts pushing notices on stream
+func (s *StreamServer) open(stream grpc.ServerStream) *streamConn {
+	conn := &streamConn{
+		stream:   stream,
+		notifier: s.notifier,
+		notices:  make(chan *Notice, streamNoticeBuffer),
+		pushed:   make(chan struct{}),
+		watched:  make(map[string]struct{}),
+	}
+	go conn.push()
+	return conn
+}
+
+// serveChecks answers the checks sent on stream, and pushes notices about
+// their clients, until the gateway closes it
+func (s *StreamServer) serveChecks(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	conn := s.open(stream)
+	defer conn.close()
+
+	// Answer the checks in flight before the stream ends
+	var checks sync.WaitGroup
+	defer checks.Wait()
+
+	inFlight := make(chan struct{}, streamConcurrency)
+	for {
+		req := new(Request)
+		if err := stream.RecvMsg(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		conn.watch(req.ClientID)
+
+		inFlight <- struct{}{}
+		checks.Add(1)
+		go func() {
+			defer checks.Done()
+			start := time.Now()
+			status, failure := check(ctx, s.checker, req)
+			logDecision(s.accessLog, "grpc", start, req, status)
+			msg := appendDecision(nil, req.ID, status, failure)
+			if status != nil {
+				queries.ReleaseStatus(status)
+			}
+			<-inFlight
+			conn.send(msg)
+		}()
+	}
+}
+
+// serveWatch pushes notices about the clients the gateway names on stream
+// until it cancels it. A gateway done naming clients may close its side.
+func (s *StreamServer) serveWatch(stream grpc.ServerStream) error {
+	conn := s.open(stream)
+	defer conn.close()
+
+	for {
+		var req WatchRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				<-stream.Context().Done()
+				return nil
+			}
+			return err
+		}
+
+		for _, clientID := range req.Unwatch {
+			conn.unwatch(clientID)
+		}
+		for _, clientID := range req.Watch {
+			if !conn.watch(clientID) {
+				return status.Errorf(codes.ResourceExhausted, "a stream watches at most %d clients", maxWatchedClients)
+			}
+		}
+	}
+}
+
+// Notify queues notice to be pushed, dropping it when the queue is full
+func (c *streamConn) Notify(notice *Notice) {
+	select {
+	case c.notices <- notice:
+	default:
+	}
+}
+
+// push sends the queued notices until the queue is closed
+func (c *streamConn) push() {
+	defer close(c.pushed)
+
+	for notice := range c.notices {
+		c.send(appendNotice(nil, notice))
+	}
+}
+
+// send writes msg on the stream. A failed write ends the stream, which the
+// next read reports.
+func (c *streamConn) send(msg []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.stream.SendMsg(frame(msg))
+}
+
+// watch adds clientID to the clients notices are pushed about, reporting
+// false when the stream watches as many as it may
+func (c *streamConn) watch(clientID string) bool {
+	if c.notifier == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	_, watched := c.watched[clientID]
+	full := !watched && len(c.watched) >= maxWatchedClients
+	if !watched && !full {
+		c.watched[clientID] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	if !watched && !full {
+		c.notifier.Watch(c, clientID, time.Now())
+	}
+	return !full
+}
+
+// unwatch stops pushing notices about clientID
+func (c *streamConn) unwatch(clientID string) {
+	if c.notifier == nil {
+		return
+	}
+
+	c.mu.Lock()
+	_, watched := c.watched[clientID]
+	delete(c.watched, clientID)
+	c.mu.Unlock()
+
+	if watched {
+		c.notifier.Unwatch(c, clientID)
+	}
+}
+
+// close stops watching clients and waits for the queued notices to be
+// sent
+func (c *streamConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for clientID := range c.watched {
+		c.notifier.Unwatch(c, clientID)
+	}
+	close(c.notices)
+	<-c.pushed
+}
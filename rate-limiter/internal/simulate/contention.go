@@ -0,0 +1,110 @@
+package simulate
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+)
+
+// ContentionStats summarizes how busy the limiter's stores were
+type ContentionStats struct {
+	StoreCalls int64         `json:"store_calls"`
+	StoreTime  time.Duration `json:"store_time_ns"` // Total time spent in store calls
+	Conflicts  int64         `json:"conflicts"`     // Optimistic concurrency conflicts on the event store
+}
+
+// MeanStoreTime returns the average time of a store call
+func (s ContentionStats) MeanStoreTime() time.Duration {
+	if s.StoreCalls == 0 {
+		return 0
+	}
+	return s.StoreTime / time.Duration(s.StoreCalls)
+}
+
+// Contention records store calls made by the limiter
+type Contention struct {
+	calls     atomic.Int64
+	nanos     atomic.Int64
+	conflicts atomic.Int64
+}
+
+// Stats returns the calls recorded so far
+func (c *Contention) Stats() ContentionStats {
+	return ContentionStats{
+		StoreCalls: c.calls.Load(),
+		StoreTime:  time.Duration(c.nanos.Load()),
+		Conflicts:  c.conflicts.Load(),
+	}
+}
+
+// record adds a store call that started at began
+func (c *Contention) record(began time.Time) {
+	c.calls.Add(1)
+	c.nanos.Add(int64(time.Since(began)))
+}
+
+// InstrumentedEventStore wraps an event store to record contention
+type InstrumentedEventStore struct {
+	store      handlers.EventStore
+	contention *Contention
+}
+
+// NewInstrumentedEventStore wraps store, recording calls in contention
+func NewInstrumentedEventStore(store handlers.EventStore, contention *Contention) *InstrumentedEventStore {
+	return &InstrumentedEventStore{
+		store:      store,
+		contention: contention,
+	}
+}
+
+// SaveEvents saves events, counting version conflicts
+func (s *InstrumentedEventStore) SaveEvents(ctx context.Context, aggregateID string, events []domain.Event, expectedVersion int) error {
+	defer s.contention.record(time.Now())
+	err := s.store.SaveEvents(ctx, aggregateID, events, expectedVersion)
+	if errors.Is(err, domain.ErrConcurrencyConflict) {
+		s.contention.conflicts.Add(1)
+	}
+	return err
+}
+
+// GetEvents retrieves the events of an aggregate
+func (s *InstrumentedEventStore) GetEvents(ctx context.Context, aggregateID string) ([]domain.Event, error) {
+	defer s.contention.record(time.Now())
+	return s.store.GetEvents(ctx, aggregateID)
+}
+
+// InstrumentedCounterStore wraps a counter store to record contention
+type InstrumentedCounterStore struct {
+	store      handlers.CounterStore
+	contention *Contention
+}
+
+// NewInstrumentedCounterStore wraps store, recording calls in contention
+func NewInstrumentedCounterStore(store handlers.CounterStore, contention *Contention) *InstrumentedCounterStore {
+	return &InstrumentedCounterStore{
+		store:      store,
+		contention: contention,
+	}
+}
+
+// Increment adds delta to a counter
+func (s *InstrumentedCounterStore) Increment(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	defer s.contention.record(time.Now())
+	return s.store.Increment(ctx, key, delta, ttl)
+}
+
+// Decrement subtracts delta from a counter
+func (s *InstrumentedCounterStore) Decrement(ctx context.Context, key string, delta int64) (int64, error) {
+	defer s.contention.record(time.Now())
+	return s.store.Decrement(ctx, key, delta)
+}
+
+// Get returns a counter's value
+func (s *InstrumentedCounterStore) Get(ctx context.Context, key string) (int64, error) {
+	defer s.contention.record(time.Now())
+	return s.store.Get(ctx, key)
+}
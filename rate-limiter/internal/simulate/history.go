@@ -0,0 +1,182 @@
+package simulate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/commands"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+)
+
+// RecordedRequest is a request decided by the limiter, as its events record it
+type RecordedRequest struct {
+	ClientID string
+	At       time.Time
+	Denied   bool
+}
+
+// RuleImpact compares the recorded decisions of requests with those a
+// proposed rule would have made
+type RuleImpact struct {
+	Resource        string         `json:"resource"` // State resource of the rule
+	StartTime       time.Time      `json:"start_time"`
+	EndTime         time.Time      `json:"end_time"`
+	CurrentRuleID   string         `json:"current_rule_id,omitempty"` // Rule the proposal would replace
+	Requests        int            `json:"requests"`
+	Clients         int            `json:"clients"`
+	Denied          int            `json:"denied"`           // As recorded
+	SimulatedDenied int            `json:"simulated_denied"` // By the proposed rule
+	NewlyDenied     int            `json:"newly_denied"`     // Allowed as recorded, denied by the proposed rule
+	NewlyAllowed    int            `json:"newly_allowed"`    // Denied as recorded, allowed by the proposed rule
+	ByClient        []ClientImpact `json:"by_client"`        // Most simulated denials first
+}
+
+// ClientImpact is the part of a rule impact of one client
+type ClientImpact struct {
+	ClientID        string `json:"client_id"`
+	Requests        int    `json:"requests"`
+	Denied          int    `json:"denied"`
+	SimulatedDenied int    `json:"simulated_denied"`
+	NewlyDenied     int    `json:"newly_denied"`
+	NewlyAllowed    int    `json:"newly_allowed"`
+}
+
+// RecordedRequests returns the requests decided under stateResource in
+// events, in the order they were made. A request allowed and then undone
+// because another window or resource of its check denied it was denied.
+func RecordedRequests(events []domain.Event, stateResource string) []RecordedRequest {
+	var requests []RecordedRequest
+	last := make(map[string]int) // Index of the last request of each client
+	for _, event := range events {
+		switch e := event.(type) {
+		case *domain.RateLimitAppliedEvent:
+			if e.Resource == stateResource {
+				last[e.ClientID] = len(requests)
+				requests = append(requests, RecordedRequest{ClientID: e.ClientID, At: e.Timestamp()})
+			}
+		case *domain.RateLimitExceededEvent:
+			if e.Resource == stateResource {
+				last[e.ClientID] = len(requests)
+				requests = append(requests, RecordedRequest{ClientID: e.ClientID, At: e.Timestamp(), Denied: true})
+			}
+		case *domain.RateLimitRefundedEvent:
+			if i, ok := last[e.ClientID]; ok && e.Resource == stateResource && e.Compensation {
+				requests[i].Denied = true
+			}
+		}
+	}
+
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].At.Before(requests[j].At)
+	})
+	return requests
+}
+
+// ReplayRule decides requests again as though rule had been in force when
+// they were made, each at the time it was recorded. The requests are
+// decided by an in-process limiter holding rule alone, so overrides,
+// rollouts and freezes do not apply and every client starts without usage.
+func ReplayRule(ctx context.Context, rule domain.RateLimitRule, requests []RecordedRequest) (RuleImpact, error) {
+	clock := &replayClock{}
+	if len(requests) > 0 {
+		clock.now = requests[0].At
+	}
+	commandHandler := handlers.NewRateLimitCommandHandler(infrastructure.NewInMemoryEventStore(), infrastructure.NewInMemoryRuleRepository()).
+		WithClock(clock)
+
+	create := &commands.CreateRuleCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("replay-rule-%d", clock.now.UnixNano()),
+			Type: "CreateRule",
+			Time: clock.now,
+		},
+		Resource:      rule.Resource,
+		Method:        rule.Method,
+		Limit:         rule.Limit,
+		Window:        rule.Window,
+		Algorithm:     string(rule.Algorithm),
+		SoftThreshold: rule.SoftThreshold,
+		Parameters:    rule.Parameters,
+		Windows:       rule.Windows,
+	}
+	if err := commandHandler.Handle(ctx, create); err != nil {
+		return RuleImpact{}, fmt.Errorf("invalid rule: %w", err)
+	}
+
+	impact := RuleImpact{Resource: rule.StateResource(), Requests: len(requests)}
+	byClient := make(map[string]*ClientImpact)
+	for _, request := range requests {
+		if err := ctx.Err(); err != nil {
+			return RuleImpact{}, err
+		}
+
+		clock.now = request.At
+		cmd := &commands.ApplyRateLimitCommand{
+			BaseCommand: commands.BaseCommand{
+				ID:   domain.NewEventID("replay", request.At),
+				Type: "ApplyRateLimit",
+				Time: request.At,
+			},
+			ClientID:    request.ClientID,
+			Resource:    rule.Resource,
+			Method:      rule.Method,
+			RequestedAt: request.At,
+		}
+		if err := commandHandler.Handle(ctx, cmd); err != nil {
+			return RuleImpact{}, fmt.Errorf("failed to replay request of %s: %w", request.ClientID, err)
+		}
+		_, allowed := cmd.Result.(*domain.RateLimitAppliedEvent)
+
+		client, ok := byClient[request.ClientID]
+		if !ok {
+			client = &ClientImpact{ClientID: request.ClientID}
+			byClient[request.ClientID] = client
+		}
+		client.Requests++
+		if request.Denied {
+			client.Denied++
+		}
+		if !allowed {
+			client.SimulatedDenied++
+		}
+		switch {
+		case !allowed && !request.Denied:
+			client.NewlyDenied++
+		case allowed && request.Denied:
+			client.NewlyAllowed++
+		}
+	}
+
+	impact.Clients = len(byClient)
+	impact.ByClient = make([]ClientImpact, 0, len(byClient))
+	for _, client := range byClient {
+		impact.Denied += client.Denied
+		impact.SimulatedDenied += client.SimulatedDenied
+		impact.NewlyDenied += client.NewlyDenied
+		impact.NewlyAllowed += client.NewlyAllowed
+		impact.ByClient = append(impact.ByClient, *client)
+	}
+	sort.Slice(impact.ByClient, func(i, j int) bool {
+		a, b := impact.ByClient[i], impact.ByClient[j]
+		if a.SimulatedDenied != b.SimulatedDenied {
+			return a.SimulatedDenied > b.SimulatedDenied
+		}
+		if a.NewlyDenied != b.NewlyDenied {
+			return a.NewlyDenied > b.NewlyDenied
+		}
+		return a.ClientID < b.ClientID
+	})
+	return impact, nil
+}
+
+// replayClock is the clock of a replay, set to the time of each request
+// before it is decided
+type replayClock struct {
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time { return c.now }
@@ -0,0 +1,182 @@
+package simulate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Traffic patterns for synthetic profiles
+const (
+	PatternSteady = "steady" // Evenly spaced requests at the base rate
+	PatternBurst  = "burst"  // The base rate plus periodic bursts
+	PatternRamp   = "ramp"   // Rate rising linearly from zero to twice the base rate
+)
+
+// Request is one request of a traffic profile
+type Request struct {
+	Offset   time.Duration `json:"offset"` // Since the start of the run
+	ClientID string        `json:"client_id"`
+}
+
+// ProfileConfig describes a synthetic traffic profile
+type ProfileConfig struct {
+	Clients    int
+	Rate       float64 // Requests per second per client
+	Pattern    string
+	BurstSize  int           // Extra requests per burst
+	BurstEvery time.Duration // Time between bursts
+	Duration   time.Duration
+	Jitter     float64 // Random spread of request times, as a fraction of the interval
+	Seed       int64
+}
+
+// Synthetic generates the requests of a synthetic profile, ordered by offset
+func Synthetic(cfg ProfileConfig) ([]Request, error) {
+	if cfg.Clients <= 0 || cfg.Duration <= 0 {
+		return nil, fmt.Errorf("clients and duration must be positive")
+	}
+	if cfg.Rate <= 0 && (cfg.Pattern != PatternBurst || cfg.BurstSize <= 0) {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	var requests []Request
+	for c := 0; c < cfg.Clients; c++ {
+		clientID := fmt.Sprintf("client-%d", c)
+		add := func(offset time.Duration) {
+			if offset >= 0 && offset < cfg.Duration {
+				requests = append(requests, Request{Offset: offset, ClientID: clientID})
+			}
+		}
+
+		switch cfg.Pattern {
+		case PatternSteady, PatternBurst, "":
+			if cfg.Rate > 0 {
+				interval := time.Duration(float64(time.Second) / cfg.Rate)
+				// Stagger clients so they do not all fire at once
+				start := time.Duration(rng.Int63n(int64(interval)))
+				for offset := start; offset < cfg.Duration; offset += interval {
+					add(offset + jitter(rng, interval, cfg.Jitter))
+				}
+			}
+			if cfg.Pattern == PatternBurst && cfg.BurstSize > 0 && cfg.BurstEvery > 0 {
+				for offset := cfg.BurstEvery / 2; offset < cfg.Duration; offset += cfg.BurstEvery {
+					for i := 0; i < cfg.BurstSize; i++ {
+						add(offset + time.Duration(i)*time.Millisecond)
+					}
+				}
+			}
+		case PatternRamp:
+			// The rate at t is 2*Rate*t/Duration, so the n-th request falls
+			// where the integral reaches n
+			seconds := cfg.Duration.Seconds()
+			for n := 1; ; n++ {
+				t := math.Sqrt(float64(n) * seconds / cfg.Rate)
+				if t >= seconds {
+					break
+				}
+				add(time.Duration(t * float64(time.Second)))
+			}
+		default:
+			return nil, fmt.Errorf("unknown traffic pattern %q", cfg.Pattern)
+		}
+	}
+
+	sortRequests(requests)
+	return requests, nil
+}
+
+// jitter returns a random shift of up to fraction of interval either way
+func jitter(rng *rand.Rand, interval time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return 0
+	}
+	return time.Duration((rng.Float64()*2 - 1) * fraction * float64(interval))
+}
+
+// recordedLine is a line of a recorded profile: either an offset in
+// milliseconds, or a timestamp as in the access log
+type recordedLine struct {
+	OffsetMS *float64  `json:"offset_ms"`
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	ClientIP string    `json:"client_ip"`
+}
+
+// LoadProfile reads a recorded profile of JSON lines, each with a client_id
+// (or client_ip) and either offset_ms or time. Access log output can be
+// replayed directly. Times are made relative to the earliest request.
+func LoadProfile(r io.Reader) ([]Request, error) {
+	var (
+		requests []Request
+		times    []time.Time
+	)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var line recordedLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		clientID := line.ClientID
+		if clientID == "" {
+			clientID = line.ClientIP
+		}
+		if clientID == "" {
+			return nil, fmt.Errorf("line %d: client_id or client_ip is required", lineNumber)
+		}
+
+		switch {
+		case line.OffsetMS != nil:
+			requests = append(requests, Request{
+				Offset:   time.Duration(*line.OffsetMS * float64(time.Millisecond)),
+				ClientID: clientID,
+			})
+		case !line.Time.IsZero():
+			requests = append(requests, Request{ClientID: clientID})
+			times = append(times, line.Time)
+		default:
+			return nil, fmt.Errorf("line %d: offset_ms or time is required", lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile: %w", err)
+	}
+
+	if len(times) > 0 {
+		if len(times) != len(requests) {
+			return nil, fmt.Errorf("profile mixes offset_ms and time")
+		}
+		first := times[0]
+		for _, t := range times {
+			if t.Before(first) {
+				first = t
+			}
+		}
+		for i := range requests {
+			requests[i].Offset = times[i].Sub(first)
+		}
+	}
+
+	sortRequests(requests)
+	return requests, nil
+}
+
+// sortRequests orders requests by offset, keeping the order of ties
+func sortRequests(requests []Request) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].Offset < requests[j].Offset
+	})
+}
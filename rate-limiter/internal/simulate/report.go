@@ -0,0 +1,139 @@
+package simulate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// LatencySummary holds decision latency percentiles
+type LatencySummary struct {
+	Mean time.Duration `json:"mean_ns"`
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+// Report summarizes a simulation run
+type Report struct {
+	Requests      int             `json:"requests"`
+	Allowed       int             `json:"allowed"`
+	Denied        int             `json:"denied"`
+	Errors        int             `json:"errors"`
+	Expected      int             `json:"expected"`       // Allowed by an exact sliding window
+	OverAdmitted  int             `json:"over_admitted"`  // Allowed beyond the expected count, summed over clients
+	UnderAdmitted int             `json:"under_admitted"` // Denied within the expected count, summed over clients
+	Accuracy      float64         `json:"accuracy"`       // Share of requests not over or under admitted
+	Latency       LatencySummary  `json:"latency"`
+	MaxLag        time.Duration   `json:"max_lag_ns"` // Longest delay of a decision behind its scheduled offset
+	Elapsed       time.Duration   `json:"elapsed_ns"`
+	Contention    ContentionStats `json:"contention"`
+}
+
+// Summarize builds the report for outcomes against a limit per window
+func Summarize(outcomes []Outcome, limit int, window time.Duration) Report {
+	report := Report{Requests: len(outcomes)}
+
+	latencies := make([]time.Duration, 0, len(outcomes))
+	allowedByClient := make(map[string]int)
+	var total time.Duration
+	for _, outcome := range outcomes {
+		switch {
+		case outcome.Err != nil:
+			report.Errors++
+		case outcome.Allowed:
+			report.Allowed++
+			allowedByClient[outcome.ClientID]++
+		default:
+			report.Denied++
+		}
+
+		latencies = append(latencies, outcome.Latency)
+		total += outcome.Latency
+		if lag := outcome.At - outcome.Offset; lag > report.MaxLag {
+			report.MaxLag = lag
+		}
+		if end := outcome.At + outcome.Latency; end > report.Elapsed {
+			report.Elapsed = end
+		}
+	}
+
+	for clientID, expected := range Expected(outcomes, limit, window) {
+		report.Expected += expected
+		if diff := allowedByClient[clientID] - expected; diff > 0 {
+			report.OverAdmitted += diff
+		} else {
+			report.UnderAdmitted -= diff
+		}
+	}
+	if report.Requests > 0 {
+		report.Accuracy = 1 - float64(report.OverAdmitted+report.UnderAdmitted)/float64(report.Requests)
+		report.Latency.Mean = total / time.Duration(report.Requests)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.Latency.P50 = percentile(latencies, 0.50)
+	report.Latency.P90 = percentile(latencies, 0.90)
+	report.Latency.P99 = percentile(latencies, 0.99)
+	report.Latency.Max = percentile(latencies, 1)
+
+	return report
+}
+
+// Expected returns how many requests of each client an exact sliding window
+// of limit per window allows, taking requests in the order they were decided
+func Expected(outcomes []Outcome, limit int, window time.Duration) map[string]int {
+	byClient := make(map[string][]time.Duration)
+	for _, outcome := range outcomes {
+		byClient[outcome.ClientID] = append(byClient[outcome.ClientID], outcome.At)
+	}
+
+	expected := make(map[string]int, len(byClient))
+	for clientID, times := range byClient {
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		// Times of the allowed requests; the oldest still in the window is at
+		// allowed[oldest]
+		var allowed []time.Duration
+		oldest := 0
+		for _, at := range times {
+			for oldest < len(allowed) && allowed[oldest] <= at-window {
+				oldest++
+			}
+			if len(allowed)-oldest < limit {
+				allowed = append(allowed, at)
+			}
+		}
+		expected[clientID] = len(allowed)
+	}
+	return expected
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(p*float64(len(sorted))+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+// Write prints the report as text
+func (r Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Requests:       %d in %v (max dispatch lag %v)\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.MaxLag.Round(time.Microsecond))
+	fmt.Fprintf(w, "Decisions:      %d allowed, %d denied, %d errors\n", r.Allowed, r.Denied, r.Errors)
+	fmt.Fprintf(w, "Accuracy:       %.2f%% (%d expected, %d over-admitted, %d under-admitted)\n",
+		100*r.Accuracy, r.Expected, r.OverAdmitted, r.UnderAdmitted)
+	fmt.Fprintf(w, "Latency:        mean %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	fmt.Fprintf(w, "Store:          %d calls, mean %v, %d conflicts\n",
+		r.Contention.StoreCalls, r.Contention.MeanStoreTime(), r.Contention.Conflicts)
+}
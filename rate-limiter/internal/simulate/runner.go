@@ -0,0 +1,102 @@
+package simulate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Decider decides one request of a client, reporting whether it is allowed
+type Decider func(ctx context.Context, clientID string) (bool, error)
+
+// Outcome is the decision on one replayed request
+type Outcome struct {
+	Request
+	At      time.Duration // When the decision started, since the start of the run
+	Latency time.Duration
+	Allowed bool
+	Err     error
+}
+
+// Runner replays traffic profiles in real time
+type Runner struct {
+	decide  Decider
+	workers int
+}
+
+// NewRunner creates a runner deciding requests with up to workers at once
+func NewRunner(decide Decider, workers int) *Runner {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Runner{
+		decide:  decide,
+		workers: workers,
+	}
+}
+
+// Run replays requests at their offsets and returns their outcomes in the
+// same order. Requests are dispatched late rather than dropped when every
+// worker is busy; Outcome.At records when each one was actually decided.
+func (r *Runner) Run(ctx context.Context, requests []Request) []Outcome {
+	outcomes := make([]Outcome, len(requests))
+	decided := make([]bool, len(requests))
+	jobs := make(chan int, r.workers)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for w := 0; w < r.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				began := time.Now()
+				allowed, err := r.decide(ctx, requests[i].ClientID)
+				outcomes[i] = Outcome{
+					Request: requests[i],
+					At:      began.Sub(start),
+					Latency: time.Since(began),
+					Allowed: allowed,
+					Err:     err,
+				}
+				decided[i] = true
+			}
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+dispatch:
+	for i, request := range requests {
+		if wait := request.Offset - time.Since(start); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		// Leave out requests that were never dispatched
+		kept := outcomes[:0]
+		for i, outcome := range outcomes {
+			if decided[i] {
+				kept = append(kept, outcome)
+			}
+		}
+		outcomes = kept
+	}
+	return outcomes
+}
@@ -0,0 +1,668 @@
+package threatfeed
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/principal"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// Ban list formats, of imports and exports
+const (
+	BanListJSON = "json" // A JSON array of entries
+	BanListCSV  = "csv"  // Entries with a header naming their columns
+)
+
+// Causes of ban list removals
+const (
+	CauseDeleted  = "deleted"
+	CauseExpired  = "expired"
+	CauseReplaced = "replaced" // Left out of an import replacing the list
+)
+
+var (
+	// ErrInvalidBan is returned for ban list entries and imports that
+	// cannot be read
+	ErrInvalidBan = errors.New("invalid ban list entry")
+	// ErrNotBanned is returned for networks without a ban list entry
+	ErrNotBanned = errors.New("network is not on the ban list")
+)
+
+// banListColumns are the columns of CSV exports. Imports may also give a
+// ttl column instead of expires_at.
+var banListColumns = []string{"network", "action", "reason", "expires_at", "added_by", "added_at", "source"}
+
+// EventPublisher publishes the events of ban list changes, e.g. to the
+// EventBus
+type EventPublisher interface {
+	Publish(event domain.Event)
+}
+
+// RuleApprovals holds the rule changes that need a second principal's
+// approval. HoldRuleChange returns nil when a change leaving rule as given
+// may be made right away, and otherwise the error it is held with, running
+// apply once the change is approved.
+type RuleApprovals interface {
+	HoldRuleChange(ctx context.Context, rule ruleDomain.Rule, apply func(ctx context.Context) error) error
+}
+
+// BanList is the list of networks operators deny or allow by hand, each
+// until it expires, if ever. Denied networks are kept in a blacklist rule
+// and allowed ones in a whitelist rule, written like the rules of feeds, and
+// every entry added or removed publishes an event, so that security tooling
+// can follow what is enforced. Entries are kept in memory.
+type BanList struct {
+	rules     RuleStore
+	publisher EventPublisher
+	approvals RuleApprovals
+
+	mutex   sync.Mutex // Serializes changes along with their rule writes
+	entries map[netip.Prefix]ban
+}
+
+// ban is the entry of a network on the ban list
+type ban struct {
+	action    string
+	reason    string
+	addedBy   string
+	source    string // Who added the entry upstream, as its import says
+	addedAt   time.Time
+	expiresAt time.Time // Zero for entries that never expire
+}
+
+// BanRequest is an entry to add to the ban list. It has the fields entries
+// are listed and exported with, so that exports can be imported.
+type BanRequest struct {
+	Network   string     `json:"network"`          // An address or a CIDR network
+	Action    string     `json:"action,omitempty"` // deny by default
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`      // Instead of expires_at, e.g. "24h"
+	AddedBy   string     `json:"added_by,omitempty"` // Recorded as the source; the entry is added by the requesting principal
+	Source    string     `json:"source,omitempty"`   // Instead of added_by
+	AddedAt   *time.Time `json:"added_at,omitempty"` // Now by default
+}
+
+// banChange is an entry added to or removed from the ban list
+type banChange struct {
+	network netip.Prefix
+	ban     ban
+	removed bool
+	cause   string // Of removals
+}
+
+// NewBanList creates an empty ban list keeping its rules in rules
+func NewBanList(rules RuleStore) *BanList {
+	return &BanList{
+		rules:   rules,
+		entries: make(map[netip.Prefix]ban),
+	}
+}
+
+// WithEventPublisher publishes an event for every entry added to or removed
+// from the ban list
+func (b *BanList) WithEventPublisher(publisher EventPublisher) *BanList {
+	b.publisher = publisher
+	return b
+}
+
+// WithApprovals holds the changes adding entries until approvals lets their
+// rules be written. Removals and expiries only narrow the rules, and are
+// made right away.
+func (b *BanList) WithApprovals(approvals RuleApprovals) *BanList {
+	b.approvals = approvals
+	return b
+}
+
+// BanListRuleID returns the ID of the ban list's rule of action, deny or
+// allow
+func BanListRuleID(action string) string {
+	return "ban-list-" + action
+}
+
+// Run removes entries as they expire, looking for them every interval, until
+// ctx is done
+func (b *BanList) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := b.expire(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ban list: %v", err)
+		}
+		if expired > 0 {
+			log.Printf("ban list: %d entries expired", expired)
+		}
+	}
+}
+
+// expire removes the entries expired at now
+func (b *BanList) expire(ctx context.Context, now time.Time) (int, error) {
+	counts, err := b.apply(ctx, now, true, func(entries map[netip.Prefix]ban) []banChange {
+		var changes []banChange
+		for network, entry := range entries {
+			if entry.expired(now) {
+				changes = append(changes, banChange{network: network, removed: true, cause: CauseExpired})
+			}
+		}
+		return changes
+	})
+	return counts.Removed, err
+}
+
+// Add adds an entry to the ban list, replacing the network's entry if it has
+// one, and returns the network's entry afterwards
+func (b *BanList) Add(ctx context.Context, req BanRequest) (queries.BanListEntry, error) {
+	now := time.Now()
+	network, entry, err := parseBan(ctx, req, now)
+	if err != nil {
+		return queries.BanListEntry{}, err
+	}
+	if entry.expired(now) {
+		return queries.BanListEntry{}, fmt.Errorf("%w: %s expires in the past", ErrInvalidBan, network)
+	}
+
+	_, err = b.apply(ctx, now, true, func(map[netip.Prefix]ban) []banChange {
+		return []banChange{{network: network, ban: entry}}
+	})
+	if err != nil {
+		return queries.BanListEntry{}, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.entries[network].listing(network), nil
+}
+
+// Remove removes the entry of a network from the ban list
+func (b *BanList) Remove(ctx context.Context, network string) error {
+	prefix, ok := parseNetwork(network)
+	if !ok {
+		return fmt.Errorf("%w: %q is not an address or network", ErrInvalidBan, network)
+	}
+
+	counts, err := b.apply(ctx, time.Now(), true, func(map[netip.Prefix]ban) []banChange {
+		return []banChange{{network: prefix, removed: true, cause: CauseDeleted}}
+	})
+	if err != nil {
+		return err
+	}
+	if counts.Removed == 0 {
+		return fmt.Errorf("%w: %s", ErrNotBanned, prefix)
+	}
+	return nil
+}
+
+// Entries returns the entries with action, or every entry when it is empty,
+// ordered by network
+func (b *BanList) Entries(action string) []queries.BanListEntry {
+	return b.list(func(entry ban) bool {
+		return action == "" || entry.action == action
+	})
+}
+
+// Expiring returns the entries expiring within the given time, soonest
+// first. Expired entries not yet removed are included.
+func (b *BanList) Expiring(within time.Duration) []queries.BanListEntry {
+	deadline := time.Now().Add(within)
+	entries := b.list(func(entry ban) bool {
+		return !entry.expiresAt.IsZero() && !entry.expiresAt.After(deadline)
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ExpiresAt.Before(*entries[j].ExpiresAt)
+	})
+	return entries
+}
+
+// list returns the entries matched by match, ordered by network
+func (b *BanList) list(match func(entry ban) bool) []queries.BanListEntry {
+	b.mutex.Lock()
+	networks := make([]netip.Prefix, 0, len(b.entries))
+	for network, entry := range b.entries {
+		if match(entry) {
+			networks = append(networks, network)
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return compareNetworks(networks[i], networks[j]) < 0
+	})
+	entries := make([]queries.BanListEntry, len(networks))
+	for i, network := range networks {
+		entries[i] = b.entries[network].listing(network)
+	}
+	b.mutex.Unlock()
+	return entries
+}
+
+// Import adds the entries read from r in format. Entries that expired
+// already are skipped. With replace, entries the import does not list are
+// removed. Nothing is changed unless every entry can be read.
+func (b *BanList) Import(ctx context.Context, format string, r io.Reader, replace bool) (queries.BanListImport, error) {
+	requests, err := readBans(format, r)
+	if err != nil {
+		return queries.BanListImport{}, fmt.Errorf("%w: %v", ErrInvalidBan, err)
+	}
+
+	now := time.Now()
+	expired := 0
+	imported := make(map[netip.Prefix]bool, len(requests))
+	changes := make([]banChange, 0, len(requests))
+	for i, req := range requests {
+		network, entry, err := parseBan(ctx, req, now)
+		if err != nil {
+			return queries.BanListImport{}, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if entry.expired(now) {
+			expired++
+			continue
+		}
+		imported[network] = true
+		changes = append(changes, banChange{network: network, ban: entry})
+	}
+
+	counts, err := b.apply(ctx, now, true, func(entries map[netip.Prefix]ban) []banChange {
+		if !replace {
+			return changes
+		}
+		for network := range entries {
+			if !imported[network] {
+				changes = append(changes, banChange{network: network, removed: true, cause: CauseReplaced})
+			}
+		}
+		return changes
+	})
+	counts.Expired = expired
+	return counts, err
+}
+
+// Export writes every entry to w in format, ordered by network
+func (b *BanList) Export(w io.Writer, format string) error {
+	entries := b.Entries("")
+	switch format {
+	case BanListJSON:
+		return json.NewEncoder(w).Encode(entries)
+	case BanListCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(banListColumns)
+		for _, e := range entries {
+			expiresAt := ""
+			if e.ExpiresAt != nil {
+				expiresAt = e.ExpiresAt.Format(time.RFC3339Nano)
+			}
+			writer.Write([]string{e.Network, e.Action, e.Reason, expiresAt, e.AddedBy, e.AddedAt.Format(time.RFC3339Nano), e.Source})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("unknown format %q, expected json or csv", format)
+}
+
+// apply makes the changes planned against the current entries. The rules of
+// the actions they touch are rewritten before the changes take effect, and
+// an event is published for each. An entry added again with the same action,
+// reason and expiry is left as it is. With gate, changes adding entries are
+// held when their rules need approval, and planned again once approved.
+func (b *BanList) apply(ctx context.Context, now time.Time, gate bool, plan func(entries map[netip.Prefix]ban) []banChange) (queries.BanListImport, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var counts queries.BanListImport
+	entries := maps.Clone(b.entries)
+	touched := make(map[string]bool)
+	var applied []banChange
+	for _, change := range plan(b.entries) {
+		current, listed := entries[change.network]
+		switch {
+		case change.removed && !listed:
+			continue
+		case change.removed:
+			delete(entries, change.network)
+			change.ban = current
+			counts.Removed++
+		case listed && current.same(change.ban):
+			counts.Unchanged++
+			continue
+		case listed:
+			entries[change.network] = change.ban
+			touched[current.action] = true
+			counts.Updated++
+		default:
+			entries[change.network] = change.ban
+			counts.Added++
+		}
+		touched[change.ban.action] = true
+		applied = append(applied, change)
+	}
+
+	if gate && b.approvals != nil && addsEntries(applied) {
+		approved := func(ctx context.Context) error {
+			_, err := b.apply(ctx, now, false, plan)
+			return err
+		}
+		for _, action := range []string{ActionDeny, ActionAllow} {
+			if !touched[action] {
+				continue
+			}
+			rule, _ := b.plannedRule(ctx, action, entries)
+			if rule == nil {
+				continue
+			}
+			if err := b.approvals.HoldRuleChange(ctx, *rule, approved); err != nil {
+				return queries.BanListImport{}, err
+			}
+		}
+	}
+
+	for _, action := range []string{ActionDeny, ActionAllow} {
+		if !touched[action] {
+			continue
+		}
+		if err := b.writeRule(ctx, action, entries); err != nil {
+			return queries.BanListImport{}, fmt.Errorf("failed to write rule %s: %w", BanListRuleID(action), err)
+		}
+	}
+	b.entries = entries
+
+	by := principal.FromContext(ctx)
+	for _, change := range applied {
+		b.publish(change, by, now)
+	}
+	return counts, nil
+}
+
+// addsEntries reports whether any of changes adds or replaces an entry
+func addsEntries(changes []banChange) bool {
+	for _, change := range changes {
+		if !change.removed {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRule writes the networks of entries with action to the ban list's
+// rule of action, creating the rule for the first such network and deleting
+// it once none is left
+func (b *BanList) writeRule(ctx context.Context, action string, entries map[netip.Prefix]ban) error {
+	rule, exists := b.plannedRule(ctx, action, entries)
+	switch {
+	case rule == nil && exists:
+		return b.rules.DeleteRule(ctx, BanListRuleID(action))
+	case rule == nil:
+		return nil
+	case exists:
+		return b.rules.UpdateRule(ctx, *rule)
+	}
+	return b.rules.CreateRule(ctx, *rule)
+}
+
+// plannedRule returns the ban list's rule of action as it is written for
+// entries, or nil when no entry has action, and whether the rule exists. An
+// existing rule keeps everything but its networks, as the rules of feeds
+// do.
+func (b *BanList) plannedRule(ctx context.Context, action string, entries map[netip.Prefix]ban) (*ruleDomain.Rule, bool) {
+	var networks []netip.Prefix
+	for network, entry := range entries {
+		if entry.action == action {
+			networks = append(networks, network)
+		}
+	}
+
+	current, err := b.rules.GetRule(ctx, BanListRuleID(action))
+	exists := err == nil && current != nil
+	switch {
+	case len(networks) == 0:
+		return nil, exists
+	case exists:
+		updated := *current
+		updated.Conditions = cidrConditions(networks)
+		return &updated, true
+	}
+	rule := banListRule(action, cidrConditions(networks))
+	return &rule, false
+}
+
+// banListRule creates the ban list's rule of action, at the priorities of
+// the rules of feeds
+func banListRule(action string, conditions []ruleDomain.RuleCondition) ruleDomain.Rule {
+	rule := ruleDomain.Rule{
+		ID:          BanListRuleID(action),
+		Name:        "Ban list (deny)",
+		Description: "Deny networks on the ban list",
+		Type:        ruleDomain.BlacklistRule,
+		Priority:    250,
+		Enabled:     true,
+		Conditions:  conditions,
+		Actions: []ruleDomain.RuleAction{
+			{
+				Type:       "deny",
+				Parameters: map[string]interface{}{"reason": "denied by the ban list"},
+			},
+		},
+		CreatedBy: "ban-list",
+		Tags:      []string{"security", "ban-list"},
+	}
+
+	if action == ActionAllow {
+		rule.Name = "Ban list (allow)"
+		rule.Description = "Allow networks on the ban list"
+		rule.Type = ruleDomain.WhitelistRule
+		rule.Priority = 300
+		rule.Actions[0] = ruleDomain.RuleAction{
+			Type:       "allow",
+			Parameters: map[string]interface{}{"reason": "allowed by the ban list"},
+		}
+	}
+	return rule
+}
+
+// publish publishes the event of a change, when a publisher is set
+func (b *BanList) publish(change banChange, by string, now time.Time) {
+	if b.publisher == nil {
+		return
+	}
+
+	network := change.network.String()
+	base := domain.BaseEvent{
+		Time:    now,
+		AggrID:  "ban-list:" + network,
+		Version: 1,
+	}
+	if change.removed {
+		base.ID = domain.NewEventID("ban-list-removed-"+network, now)
+		base.Type = "BanListEntryRemoved"
+		b.publisher.Publish(&domain.BanListEntryRemovedEvent{
+			BaseEvent: base,
+			Network:   network,
+			Action:    change.ban.action,
+			Cause:     change.cause,
+			RemovedBy: by,
+		})
+		return
+	}
+
+	base.ID = domain.NewEventID("ban-list-added-"+network, now)
+	base.Type = "BanListEntryAdded"
+	b.publisher.Publish(&domain.BanListEntryAddedEvent{
+		BaseEvent: base,
+		Network:   network,
+		Action:    change.ban.action,
+		Reason:    change.ban.reason,
+		AddedBy:   change.ban.addedBy,
+		Source:    change.ban.source,
+		ExpiresAt: change.ban.listing(change.network).ExpiresAt,
+	})
+}
+
+// expired reports whether the entry expired at now
+func (e ban) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !e.expiresAt.After(now)
+}
+
+// same reports whether the entries enforce the same, whoever added them when
+func (e ban) same(other ban) bool {
+	return e.action == other.action && e.reason == other.reason && e.expiresAt.Equal(other.expiresAt)
+}
+
+// listing returns the entry as listed for network
+func (e ban) listing(network netip.Prefix) queries.BanListEntry {
+	entry := queries.BanListEntry{
+		Network: network.String(),
+		Action:  e.action,
+		Reason:  e.reason,
+		AddedBy: e.addedBy,
+		Source:  e.source,
+		AddedAt: e.addedAt,
+	}
+	if !e.expiresAt.IsZero() {
+		expiresAt := e.expiresAt
+		entry.ExpiresAt = &expiresAt
+	}
+	return entry
+}
+
+// parseBan reads an entry to add. Its action defaults to deny, and it is
+// added now unless the request says otherwise. It is always added by the
+// caller's principal; the adder the request names, such as the one an
+// export recorded, is kept as the entry's source.
+func parseBan(ctx context.Context, req BanRequest, now time.Time) (netip.Prefix, ban, error) {
+	network, ok := parseNetwork(req.Network)
+	if !ok {
+		return netip.Prefix{}, ban{}, fmt.Errorf("%w: %q is not an address or network", ErrInvalidBan, req.Network)
+	}
+
+	entry := ban{
+		action:  req.Action,
+		reason:  req.Reason,
+		addedBy: principal.FromContext(ctx),
+		source:  req.Source,
+		addedAt: now,
+	}
+	switch entry.action {
+	case "":
+		entry.action = ActionDeny
+	case ActionDeny, ActionAllow:
+	default:
+		return netip.Prefix{}, ban{}, fmt.Errorf("%w: action %q of %s must be deny or allow", ErrInvalidBan, req.Action, network)
+	}
+	if entry.source == "" {
+		entry.source = req.AddedBy
+	}
+	if req.AddedAt != nil {
+		entry.addedAt = *req.AddedAt
+	}
+
+	switch {
+	case req.TTL != "" && req.ExpiresAt != nil:
+		return netip.Prefix{}, ban{}, fmt.Errorf("%w: %s sets both expires_at and ttl", ErrInvalidBan, network)
+	case req.TTL != "":
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return netip.Prefix{}, ban{}, fmt.Errorf("%w: invalid ttl %q of %s", ErrInvalidBan, req.TTL, network)
+		}
+		entry.expiresAt = now.Add(ttl).Round(0)
+	case req.ExpiresAt != nil:
+		entry.expiresAt = *req.ExpiresAt
+	}
+	return network, entry, nil
+}
+
+// readBans reads the entries of an import in format
+func readBans(format string, r io.Reader) ([]BanRequest, error) {
+	switch format {
+	case BanListJSON:
+		var requests []BanRequest
+		if err := json.NewDecoder(r).Decode(&requests); err != nil {
+			return nil, err
+		}
+		return requests, nil
+	case BanListCSV:
+		return readBanCSV(r)
+	}
+	return nil, fmt.Errorf("unknown format %q, expected json or csv", format)
+}
+
+// readBanCSV reads CSV entries. A header names their columns, as exports
+// do, in any order; without one the columns are network, action, reason and
+// expires_at. Lines starting with "#" are comments.
+func readBanCSV(r io.Reader) ([]BanRequest, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	index := make(map[string]int)
+	for i, name := range banListColumns[:4] {
+		index[name] = i
+	}
+	var requests []BanRequest
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if _, ok := parseNetwork(record[0]); first && !ok {
+			index = make(map[string]int, len(record))
+			for i, name := range record {
+				index[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			if _, ok := index["network"]; !ok {
+				return nil, fmt.Errorf("line %d: the header has no network column", line)
+			}
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		req := BanRequest{
+			Network: field("network"),
+			Action:  field("action"),
+			Reason:  field("reason"),
+			TTL:     field("ttl"),
+			AddedBy: field("added_by"),
+			Source:  field("source"),
+		}
+		for name, t := range map[string]**time.Time{"expires_at": &req.ExpiresAt, "added_at": &req.AddedAt} {
+			value := field(name)
+			if value == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, name, value)
+			}
+			*t = &parsed
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
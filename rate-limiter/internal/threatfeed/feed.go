@@ -0,0 +1,209 @@
+package threatfeed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Feed formats
+const (
+	FormatSpamhausDROP = "spamhaus-drop" // Spamhaus DROP, as text ("network ; SBL ID") or JSON lines
+	FormatAbuseIPDB    = "abuseipdb"     // AbuseIPDB blacklist CSV export
+	FormatList         = "list"          // One address or network per line, "# comment" allowed
+)
+
+// Feed actions
+const (
+	ActionDeny  = "deny"  // Listed networks are blocked, through a blacklist rule
+	ActionAllow = "allow" // Listed networks are allowed, through a whitelist rule
+)
+
+// DefaultSpamhausDROPURL is where Spamhaus publishes the IPv4 DROP list
+const DefaultSpamhausDROPURL = "https://www.spamhaus.org/drop/drop_v4.json"
+
+// Feed is a list of networks imported on a schedule
+type Feed struct {
+	Name     string        `json:"name"`
+	URL      string        `json:"url"` // http(s) URL, file:// URL or file path
+	Format   string        `json:"format"`
+	Action   string        `json:"action"`
+	Interval time.Duration `json:"interval"`
+	Header   string        `json:"header,omitempty"` // "Name: value" sent with each download, e.g. an API key
+}
+
+// listing is one network of a feed with what the feed says about it
+type listing struct {
+	network   netip.Prefix
+	reference string
+}
+
+// parse reads the networks of a feed in format. Lines that are not
+// networks, such as headers and comments, are skipped; the same network
+// listed twice keeps its first reference.
+func parse(format string, r io.Reader) (map[netip.Prefix]string, error) {
+	var (
+		listings []listing
+		err      error
+	)
+	switch format {
+	case FormatSpamhausDROP:
+		listings, err = parseSpamhausDROP(r)
+	case FormatAbuseIPDB:
+		listings, err = parseAbuseIPDB(r)
+	case FormatList:
+		listings, err = parseList(r)
+	default:
+		return nil, fmt.Errorf("unknown feed format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	networks := make(map[netip.Prefix]string, len(listings))
+	for _, l := range listings {
+		if _, ok := networks[l.network]; !ok {
+			networks[l.network] = l.reference
+		}
+	}
+	return networks, nil
+}
+
+// parseSpamhausDROP reads the DROP list in either of the formats Spamhaus
+// publishes it: text lines of "network ; SBL ID" with ";" comments, or JSON
+// lines of {"cidr": ..., "sblid": ...} ending with a metadata line
+func parseSpamhausDROP(r io.Reader) ([]listing, error) {
+	var listings []listing
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") {
+			var record struct {
+				CIDR  string `json:"cidr"`
+				SBLID string `json:"sblid"`
+			}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return nil, fmt.Errorf("invalid DROP record %q: %w", line, err)
+			}
+			if network, ok := parseNetwork(record.CIDR); ok {
+				listings = append(listings, listing{network: network, reference: record.SBLID})
+			}
+			continue
+		}
+
+		network, reference, _ := strings.Cut(line, ";")
+		if prefix, ok := parseNetwork(network); ok {
+			listings = append(listings, listing{network: prefix, reference: strings.TrimSpace(reference)})
+		}
+	}
+	return listings, scanner.Err()
+}
+
+// parseAbuseIPDB reads an AbuseIPDB blacklist CSV export, whose header names
+// the ipAddress and abuseConfidenceScore columns. Without a header the first
+// column is the address.
+func parseAbuseIPDB(r io.Reader) ([]listing, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	addressColumn, scoreColumn := 0, -1
+	var listings []listing
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if first {
+			if header := columns(record); header["ipaddress"] >= 0 {
+				addressColumn = header["ipaddress"]
+				scoreColumn = header["abuseconfidencescore"]
+				continue
+			}
+		}
+		if addressColumn >= len(record) {
+			continue
+		}
+
+		network, ok := parseNetwork(record[addressColumn])
+		if !ok {
+			continue
+		}
+		l := listing{network: network}
+		if scoreColumn >= 0 && scoreColumn < len(record) && record[scoreColumn] != "" {
+			l.reference = "confidence " + record[scoreColumn]
+		}
+		listings = append(listings, l)
+	}
+	return listings, nil
+}
+
+// columns maps lowercase header names to their column, and every name not
+// in the header to -1
+func columns(header []string) map[string]int {
+	names := map[string]int{"ipaddress": -1, "abuseconfidencescore": -1}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := names[name]; ok {
+			names[name] = i
+		}
+	}
+	return names
+}
+
+// parseList reads one address or network per line, each optionally
+// followed by a "# comment" kept as its reference
+func parseList(r io.Reader) ([]listing, error) {
+	var listings []listing
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		network, comment, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(network)
+		if len(fields) == 0 {
+			continue
+		}
+		if prefix, ok := parseNetwork(fields[0]); ok {
+			listings = append(listings, listing{network: prefix, reference: strings.TrimSpace(comment)})
+		}
+	}
+	return listings, scanner.Err()
+}
+
+// newLineScanner scans lines of up to 1 MiB
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	return scanner
+}
+
+// parseNetwork parses a CIDR or a bare address, which lists only itself
+func parseNetwork(s string) (netip.Prefix, bool) {
+	s = strings.TrimSpace(s)
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		bits := prefix.Bits()
+		if prefix.Addr().Is4In6() {
+			bits -= 96
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+		return prefix.Masked(), prefix.IsValid()
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
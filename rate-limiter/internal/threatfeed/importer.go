@@ -0,0 +1,435 @@
+// Package threatfeed imports IP threat feeds, such as the Spamhaus DROP
+// list or an AbuseIPDB blacklist, into blacklist and whitelist rules of the
+// rule engine on a schedule, and keeps the ban list of networks operators
+// deny or allow by hand in rules of its own.
+package threatfeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+	ruleDomain "github.com/NickChunglolz/rule-engine/domain"
+)
+
+// ErrUnknownFeed is returned for a feed that is not configured
+var ErrUnknownFeed = errors.New("unknown threat feed")
+
+// maxFeedBytes bounds the size of a downloaded feed
+const maxFeedBytes = 64 << 20
+
+// RuleStore keeps the rules feeds are imported into, and counts their
+// matches
+type RuleStore interface {
+	GetRule(ctx context.Context, ruleID string) (*ruleDomain.Rule, error)
+	CreateRule(ctx context.Context, rule ruleDomain.Rule) error
+	UpdateRule(ctx context.Context, rule ruleDomain.Rule) error
+	DeleteRule(ctx context.Context, ruleID string) error
+	GetRuleStats(ctx context.Context, ruleID string) (*ruleDomain.RuleStats, error)
+}
+
+// Importer downloads each feed at its interval and keeps one rule per feed
+// listing its networks: a blacklist rule denying them, or a whitelist rule
+// allowing them. Imports are diffed against the networks already listed,
+// so the rule, and with it the rule set version, only changes when the
+// feed does. Each listed network remembers its feed, what the feed said
+// about it and when it was first and last seen.
+type Importer struct {
+	rules      RuleStore
+	httpClient *http.Client
+	feeds      []*feedState // In configuration order
+}
+
+// feedState is the imported state of one feed
+type feedState struct {
+	feed Feed
+
+	importMutex  sync.Mutex // Serializes imports
+	etag         string     // Validators of the last download, for conditional requests
+	lastModified string
+
+	mutex        sync.RWMutex
+	entries      map[netip.Prefix]entry
+	added        int
+	removed      int
+	imports      uint64
+	importErrors uint64
+	lastImportAt time.Time
+	lastChangeAt time.Time
+	lastError    string
+}
+
+// entry is a listed network's provenance within its feed
+type entry struct {
+	reference string
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// NewImporter creates an importer keeping the rules of feeds in rules
+func NewImporter(rules RuleStore, feeds []Feed, httpClient *http.Client) *Importer {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: time.Minute}
+	}
+	importer := &Importer{
+		rules:      rules,
+		httpClient: httpClient,
+	}
+	for _, feed := range feeds {
+		importer.feeds = append(importer.feeds, &feedState{
+			feed:    feed,
+			entries: make(map[netip.Prefix]entry),
+		})
+	}
+	return importer
+}
+
+// RuleID returns the ID of the rule a feed is imported into
+func RuleID(feed string) string {
+	return "threat-feed-" + feed
+}
+
+// Run imports every feed now and then at its interval until ctx is done
+func (i *Importer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, state := range i.feeds {
+		wg.Add(1)
+		go func(state *feedState) {
+			defer wg.Done()
+			i.schedule(ctx, state)
+		}(state)
+	}
+	wg.Wait()
+}
+
+// schedule imports a feed at its interval
+func (i *Importer) schedule(ctx context.Context, state *feedState) {
+	ticker := time.NewTicker(state.feed.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := i.importFeed(ctx, state); err != nil && ctx.Err() == nil {
+			log.Printf("threat feed %s: %v", state.feed.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Import imports the named feed now, returning its state afterwards
+func (i *Importer) Import(ctx context.Context, name string) (queries.ThreatFeedStats, error) {
+	for _, state := range i.feeds {
+		if state.feed.Name == name {
+			return i.importFeed(ctx, state)
+		}
+	}
+	return queries.ThreatFeedStats{}, fmt.Errorf("%w: %s", ErrUnknownFeed, name)
+}
+
+// importFeed downloads a feed and applies what changed to its rule
+func (i *Importer) importFeed(ctx context.Context, state *feedState) (queries.ThreatFeedStats, error) {
+	state.importMutex.Lock()
+	defer state.importMutex.Unlock()
+
+	err := i.sync(ctx, state)
+
+	state.mutex.Lock()
+	state.imports++
+	state.lastImportAt = time.Now()
+	state.lastError = ""
+	if err != nil {
+		state.importErrors++
+		state.lastError = err.Error()
+	}
+	state.mutex.Unlock()
+
+	return i.stats(ctx, state), err
+}
+
+// sync downloads a feed and, when its networks changed, rewrites its rule
+func (i *Importer) sync(ctx context.Context, state *feedState) error {
+	networks, unchanged, err := i.download(ctx, state)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if unchanged {
+		state.touch(now)
+		return nil
+	}
+	if len(networks) == 0 {
+		// A truncated or broken download must not lift every listing
+		return fmt.Errorf("feed lists no networks")
+	}
+
+	state.mutex.RLock()
+	added, removed := diff(state.entries, networks)
+	state.mutex.RUnlock()
+
+	if added > 0 || removed > 0 {
+		if err := i.applyRule(ctx, state.feed, networks); err != nil {
+			return err
+		}
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	entries := make(map[netip.Prefix]entry, len(networks))
+	for network, reference := range networks {
+		e, ok := state.entries[network]
+		if !ok {
+			e.firstSeen = now
+		}
+		e.reference = reference
+		e.lastSeen = now
+		entries[network] = e
+	}
+	state.entries = entries
+	if added > 0 || removed > 0 {
+		state.added = added
+		state.removed = removed
+		state.lastChangeAt = now
+		log.Printf("threat feed %s: %d networks, %d added, %d removed", state.feed.Name, len(entries), added, removed)
+	}
+	return nil
+}
+
+// touch records that every listed network was seen again
+func (s *feedState) touch(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for network, e := range s.entries {
+		e.lastSeen = now
+		s.entries[network] = e
+	}
+}
+
+// diff counts the networks added to and removed from a feed
+func diff(entries map[netip.Prefix]entry, networks map[netip.Prefix]string) (added, removed int) {
+	for network := range networks {
+		if _, ok := entries[network]; !ok {
+			added++
+		}
+	}
+	for network := range entries {
+		if _, ok := networks[network]; !ok {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// download fetches and parses a feed, reporting whether an HTTP feed is
+// unchanged since its last download
+func (i *Importer) download(ctx context.Context, state *feedState) (map[netip.Prefix]string, bool, error) {
+	feedURL, err := url.Parse(state.feed.URL)
+	if err != nil || (feedURL.Scheme != "http" && feedURL.Scheme != "https") {
+		path := state.feed.URL
+		if err == nil && feedURL.Scheme == "file" {
+			path = feedURL.Path
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, false, err
+		}
+		defer file.Close()
+		networks, err := parse(state.feed.Format, io.LimitReader(file, maxFeedBytes))
+		return networks, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, state.feed.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if name, value, ok := strings.Cut(state.feed.Header, ":"); ok {
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if state.feed.Format == FormatAbuseIPDB {
+		req.Header.Set("Accept", "text/csv")
+	}
+	if state.etag != "" {
+		req.Header.Set("If-None-Match", state.etag)
+	}
+	if state.lastModified != "" {
+		req.Header.Set("If-Modified-Since", state.lastModified)
+	}
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, true, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("%s returned %s", state.feed.URL, resp.Status)
+	}
+
+	networks, err := parse(state.feed.Format, io.LimitReader(resp.Body, maxFeedBytes))
+	if err != nil {
+		return nil, false, err
+	}
+	state.etag = resp.Header.Get("ETag")
+	state.lastModified = resp.Header.Get("Last-Modified")
+	return networks, false, nil
+}
+
+// applyRule writes the networks of a feed to its rule, creating the rule on
+// the first import. An existing rule keeps everything but its networks, so
+// operators may disable it, or change its action or priority.
+func (i *Importer) applyRule(ctx context.Context, feed Feed, networks map[netip.Prefix]string) error {
+	listed := make([]netip.Prefix, 0, len(networks))
+	for network := range networks {
+		listed = append(listed, network)
+	}
+	conditions := cidrConditions(listed)
+
+	if rule, err := i.rules.GetRule(ctx, RuleID(feed.Name)); err == nil && rule != nil {
+		updated := *rule
+		updated.Conditions = conditions
+		return i.rules.UpdateRule(ctx, updated)
+	}
+	return i.rules.CreateRule(ctx, feedRule(feed, conditions))
+}
+
+// cidrConditions returns the condition of a rule matching networks, sorted
+// so that the same networks always make the same rule
+func cidrConditions(networks []netip.Prefix) []ruleDomain.RuleCondition {
+	sort.Slice(networks, func(a, b int) bool {
+		return compareNetworks(networks[a], networks[b]) < 0
+	})
+	values := make([]interface{}, len(networks))
+	for n, network := range networks {
+		values[n] = network.String()
+	}
+	return []ruleDomain.RuleCondition{{Field: "ip_address", Operator: "cidr", Value: values}}
+}
+
+// compareNetworks orders networks by address, then by prefix length
+func compareNetworks(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// feedRule creates the rule of a feed
+func feedRule(feed Feed, conditions []ruleDomain.RuleCondition) ruleDomain.Rule {
+	rule := ruleDomain.Rule{
+		ID:         RuleID(feed.Name),
+		Name:       fmt.Sprintf("Threat feed %s", feed.Name),
+		Type:       ruleDomain.BlacklistRule,
+		Priority:   250,
+		Enabled:    true,
+		Conditions: conditions,
+		Actions: []ruleDomain.RuleAction{
+			{
+				Type:       "deny",
+				Parameters: map[string]interface{}{"reason": fmt.Sprintf("listed by threat feed %s", feed.Name)},
+			},
+		},
+		CreatedBy: "threat-feed-importer",
+		Tags:      []string{"security", "threat-feed", feed.Name},
+	}
+	rule.Description = fmt.Sprintf("Deny networks listed by %s", feed.URL)
+
+	if feed.Action == ActionAllow {
+		rule.Type = ruleDomain.WhitelistRule
+		rule.Priority = 300
+		rule.Actions[0] = ruleDomain.RuleAction{
+			Type:       "allow",
+			Parameters: map[string]interface{}{"reason": fmt.Sprintf("listed by allow feed %s", feed.Name)},
+		}
+		rule.Description = fmt.Sprintf("Allow networks listed by %s", feed.URL)
+	}
+	return rule
+}
+
+// Stats returns the import state and match counts of every feed
+func (i *Importer) Stats(ctx context.Context) []queries.ThreatFeedStats {
+	stats := make([]queries.ThreatFeedStats, 0, len(i.feeds))
+	for _, state := range i.feeds {
+		stats = append(stats, i.stats(ctx, state))
+	}
+	return stats
+}
+
+// stats returns the state of one feed, counting its matches from the hit
+// statistics of its rule
+func (i *Importer) stats(ctx context.Context, state *feedState) queries.ThreatFeedStats {
+	state.mutex.RLock()
+	stats := queries.ThreatFeedStats{
+		Feed:         state.feed.Name,
+		Format:       state.feed.Format,
+		Action:       state.feed.Action,
+		RuleID:       RuleID(state.feed.Name),
+		Entries:      len(state.entries),
+		Added:        state.added,
+		Removed:      state.removed,
+		Imports:      state.imports,
+		ImportErrors: state.importErrors,
+		LastError:    state.lastError,
+	}
+	if !state.lastImportAt.IsZero() {
+		lastImportAt := state.lastImportAt
+		stats.LastImportAt = &lastImportAt
+	}
+	if !state.lastChangeAt.IsZero() {
+		lastChangeAt := state.lastChangeAt
+		stats.LastChangeAt = &lastChangeAt
+	}
+	state.mutex.RUnlock()
+
+	if ruleStats, err := i.rules.GetRuleStats(ctx, stats.RuleID); err == nil && ruleStats != nil {
+		stats.Matches = ruleStats.Matches
+	}
+	return stats
+}
+
+// Lookup returns every listing of the networks containing ip, with the
+// feed that listed it
+func (i *Importer) Lookup(ip string) ([]queries.ThreatFeedEntry, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	addr = addr.Unmap()
+
+	entries := make([]queries.ThreatFeedEntry, 0)
+	for _, state := range i.feeds {
+		state.mutex.RLock()
+		for network, e := range state.entries {
+			if !network.Contains(addr) {
+				continue
+			}
+			entries = append(entries, queries.ThreatFeedEntry{
+				Network:   network.String(),
+				Feed:      state.feed.Name,
+				Action:    state.feed.Action,
+				Reference: e.reference,
+				FirstSeen: e.firstSeen,
+				LastSeen:  e.lastSeen,
+			})
+		}
+		state.mutex.RUnlock()
+	}
+	return entries, nil
+}
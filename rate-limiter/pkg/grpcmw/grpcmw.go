@@ -0,0 +1,132 @@
+// Package grpcmw provides gRPC server interceptors that enforce rate limits
+// in-process.
+package grpcmw
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// KeyFunc derives the rate limit key and resource for a call. An empty key
+// skips rate limiting for the call.
+type KeyFunc func(ctx context.Context, fullMethod string) (key, resource string)
+
+// ByPeer keys calls on the peer address and limits them per full method name
+func ByPeer(ctx context.Context, fullMethod string) (string, string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", fullMethod
+	}
+	return p.Addr.String(), fullMethod
+}
+
+// ByMetadata keys calls on the first value of the given metadata header and
+// limits them per full method name
+func ByMetadata(header string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, string) {
+		values := metadata.ValueFromIncomingContext(ctx, header)
+		if len(values) == 0 {
+			return "", fullMethod
+		}
+		return values[0], fullMethod
+	}
+}
+
+// UnaryServerInterceptor returns a unary interceptor that rejects calls over
+// the limit with codes.ResourceExhausted
+func UnaryServerInterceptor(limiter ratelimit.Limiter, keyFunc KeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := enforce(ctx, limiter, keyFunc, info.FullMethod, func(md metadata.MD) error {
+			return grpc.SetTrailer(ctx, md)
+		}); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a stream interceptor that checks the limit
+// once when the stream is opened
+func StreamServerInterceptor(limiter ratelimit.Limiter, keyFunc KeyFunc) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := enforce(stream.Context(), limiter, keyFunc, info.FullMethod, func(md metadata.MD) error {
+			stream.SetTrailer(md)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// enforce checks the limit for a call and sets the rate limit trailers
+func enforce(ctx context.Context, limiter ratelimit.Limiter, keyFunc KeyFunc, fullMethod string, setTrailer func(metadata.MD) error) error {
+	key, resource := keyFunc(ctx, fullMethod)
+	if key == "" {
+		return nil
+	}
+
+	decision, err := limiter.Allow(ctx, key, resource)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "rate limit check failed: %v", err)
+	}
+
+	if err := setTrailer(trailer(decision)); err != nil {
+		return status.Errorf(codes.Internal, "failed to set rate limit trailer: %v", err)
+	}
+
+	if decision.Challenge != nil {
+		return status.Error(codes.PermissionDenied, "challenge required")
+	}
+	if !decision.Allowed {
+		return exhausted(decision)
+	}
+	if err := ratelimit.Wait(ctx, decision); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+// trailer builds the rate limit metadata for a decision
+func trailer(decision *ratelimit.Decision) metadata.MD {
+	md := metadata.Pairs(
+		"x-ratelimit-limit", strconv.Itoa(decision.Limit),
+		"x-ratelimit-remaining", strconv.Itoa(decision.Remaining),
+		"x-ratelimit-reset", strconv.FormatInt(decision.ResetAt.Unix(), 10),
+	)
+	switch {
+	case decision.Challenge != nil:
+		md.Set("x-challenge", decision.Challenge.Kind)
+		md.Set("x-challenge-token", decision.Challenge.Token)
+		if decision.Challenge.URL != "" {
+			md.Set("x-challenge-url", decision.Challenge.URL)
+		}
+	case !decision.Allowed:
+		md.Set("retry-after", strconv.Itoa(decision.RetryAfterSeconds()))
+	case decision.Delay > 0:
+		md.Set("x-throttle-delay", strconv.FormatInt(decision.Delay.Milliseconds(), 10))
+	}
+	return md
+}
+
+// exhausted builds a ResourceExhausted status carrying RetryInfo
+func exhausted(decision *ratelimit.Decision) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(decision.RetryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,37 @@
+// Package chi adapts the rate limiting middleware to chi.
+package chi
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/middleware"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// New returns chi middleware that enforces limits using limiter. Options are
+// shared with the net/http middleware.
+func New(limiter ratelimit.Limiter, opts ...middleware.Option) func(http.Handler) http.Handler {
+	return middleware.New(limiter, opts...)
+}
+
+// ByURLParam keys requests on a chi URL parameter and checks resource. Use
+// it with inline middleware (r.With) so the parameter is resolved.
+func ByURLParam(param, resource string) middleware.KeyFunc {
+	return func(r *http.Request) (string, string) {
+		return chi.URLParam(r, param), resource
+	}
+}
+
+// ByRoutePattern keys requests on the client IP and checks the matched route
+// pattern. Use it with inline middleware (r.With) so the pattern is resolved.
+func ByRoutePattern(r *http.Request) (string, string) {
+	key, _ := middleware.ByClientIP(r)
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			return key, pattern
+		}
+	}
+	return key, middleware.DefaultResource
+}
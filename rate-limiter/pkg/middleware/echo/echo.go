@@ -0,0 +1,114 @@
+// Package echo adapts the rate limiting middleware to echo.
+package echo
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/middleware"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// KeyFunc derives the rate limit key and resource for a request. An empty key
+// skips rate limiting for the request.
+type KeyFunc func(c echo.Context) (key, resource string)
+
+// Option configures the middleware
+type Option func(*options)
+
+type options struct {
+	keyFunc       KeyFunc
+	deniedHandler func(c echo.Context, decision *ratelimit.Decision) error
+	errorHandler  func(c echo.Context, err error) error
+	templates     *middleware.DeniedTemplates
+}
+
+// WithKeyFunc sets how requests are keyed (default: ByRealIP)
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithDeniedHandler sets how denied requests are rendered
+func WithDeniedHandler(handler func(c echo.Context, decision *ratelimit.Decision) error) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+// WithErrorHandler sets how limiter failures are rendered. Returning nil
+// lets the request through.
+func WithErrorHandler(handler func(c echo.Context, err error) error) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithDeniedTemplates renders denials of the resources templates cover from
+// their templates, leaving the rest and challenges to the denied handler
+func WithDeniedTemplates(templates *middleware.DeniedTemplates) Option {
+	return func(o *options) {
+		o.templates = templates
+	}
+}
+
+// New returns echo middleware that enforces limits using limiter. Denied
+// requests and limiter failures are returned as *echo.HTTPError so the
+// server's HTTPErrorHandler renders them.
+func New(limiter ratelimit.Limiter, opts ...Option) echo.MiddlewareFunc {
+	o := options{
+		keyFunc: ByRealIP,
+		deniedHandler: func(c echo.Context, decision *ratelimit.Decision) error {
+			return echo.NewHTTPError(middleware.DeniedStatus(decision), middleware.DeniedBody(decision))
+		},
+		errorHandler: func(c echo.Context, err error) error {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, middleware.ErrorBody()).SetInternal(err)
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, resource := o.keyFunc(c)
+			if key == "" {
+				return next(c)
+			}
+
+			decision, err := ratelimit.AllowMethod(c.Request().Context(), limiter, key, resource, c.Request().Method)
+			if err != nil {
+				if err := o.errorHandler(c, err); err != nil {
+					return err
+				}
+				return next(c)
+			}
+
+			for name, value := range middleware.Headers(decision) {
+				c.Response().Header().Set(name, value)
+			}
+			if !decision.Allowed {
+				if body, contentType, ok := middleware.RenderDenied(o.templates, key, resource, decision); ok {
+					return c.Blob(middleware.DeniedStatus(decision), contentType, body)
+				}
+				return o.deniedHandler(c, decision)
+			}
+			if err := ratelimit.Wait(c.Request().Context(), decision); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// ByRealIP keys requests on echo's real IP and checks the default resource
+func ByRealIP(c echo.Context) (string, string) {
+	return c.RealIP(), middleware.DefaultResource
+}
+
+// ByRoute keys requests on the real IP and checks the matched route path
+func ByRoute(c echo.Context) (string, string) {
+	return c.RealIP(), c.Path()
+}
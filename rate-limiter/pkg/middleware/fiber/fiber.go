@@ -0,0 +1,106 @@
+// Package fiber adapts the rate limiting middleware to fiber.
+package fiber
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/middleware"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// KeyFunc derives the rate limit key and resource for a request. An empty key
+// skips rate limiting for the request.
+type KeyFunc func(c *fiber.Ctx) (key, resource string)
+
+// Option configures the middleware
+type Option func(*options)
+
+type options struct {
+	keyFunc       KeyFunc
+	deniedHandler func(c *fiber.Ctx, decision *ratelimit.Decision) error
+	errorHandler  func(c *fiber.Ctx, err error) error
+	templates     *middleware.DeniedTemplates
+}
+
+// WithKeyFunc sets how requests are keyed (default: ByIP)
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithDeniedHandler sets how denied requests are rendered
+func WithDeniedHandler(handler func(c *fiber.Ctx, decision *ratelimit.Decision) error) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+// WithErrorHandler sets how limiter failures are rendered. Calling c.Next()
+// from the handler lets the request through.
+func WithErrorHandler(handler func(c *fiber.Ctx, err error) error) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithDeniedTemplates renders denials of the resources templates cover from
+// their templates, leaving the rest and challenges to the denied handler
+func WithDeniedTemplates(templates *middleware.DeniedTemplates) Option {
+	return func(o *options) {
+		o.templates = templates
+	}
+}
+
+// New returns fiber middleware that enforces limits using limiter
+func New(limiter ratelimit.Limiter, opts ...Option) fiber.Handler {
+	o := options{
+		keyFunc: ByIP,
+		deniedHandler: func(c *fiber.Ctx, decision *ratelimit.Decision) error {
+			return c.Status(middleware.DeniedStatus(decision)).JSON(middleware.DeniedBody(decision))
+		},
+		errorHandler: func(c *fiber.Ctx, err error) error {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(middleware.ErrorBody())
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *fiber.Ctx) error {
+		key, resource := o.keyFunc(c)
+		if key == "" {
+			return c.Next()
+		}
+
+		decision, err := ratelimit.AllowMethod(c.UserContext(), limiter, key, resource, c.Method())
+		if err != nil {
+			return o.errorHandler(c, err)
+		}
+
+		for name, value := range middleware.Headers(decision) {
+			c.Set(name, value)
+		}
+		if !decision.Allowed {
+			if body, contentType, ok := middleware.RenderDenied(o.templates, key, resource, decision); ok {
+				c.Set(fiber.HeaderContentType, contentType)
+				return c.Status(middleware.DeniedStatus(decision)).Send(body)
+			}
+			return o.deniedHandler(c, decision)
+		}
+		if err := ratelimit.Wait(c.UserContext(), decision); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// ByIP keys requests on fiber's client IP and checks the default resource
+func ByIP(c *fiber.Ctx) (string, string) {
+	return c.IP(), middleware.DefaultResource
+}
+
+// ByRoute keys requests on the client IP and checks the matched route path
+func ByRoute(c *fiber.Ctx) (string, string) {
+	return c.IP(), c.Route().Path
+}
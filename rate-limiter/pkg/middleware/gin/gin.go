@@ -0,0 +1,115 @@
+// Package gin adapts the rate limiting middleware to gin.
+package gin
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/middleware"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// KeyFunc derives the rate limit key and resource for a request. An empty key
+// skips rate limiting for the request.
+type KeyFunc func(c *gin.Context) (key, resource string)
+
+// Option configures the middleware
+type Option func(*options)
+
+type options struct {
+	keyFunc       KeyFunc
+	deniedHandler func(c *gin.Context, decision *ratelimit.Decision)
+	errorHandler  func(c *gin.Context, err error)
+	templates     *middleware.DeniedTemplates
+}
+
+// WithKeyFunc sets how requests are keyed (default: ByClientIP)
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithDeniedHandler sets how denied requests are rendered. The handler must
+// abort the context.
+func WithDeniedHandler(handler func(c *gin.Context, decision *ratelimit.Decision)) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+// WithErrorHandler sets how limiter failures are rendered. The handler must
+// abort the context to fail closed.
+func WithErrorHandler(handler func(c *gin.Context, err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithDeniedTemplates renders denials of the resources templates cover from
+// their templates, leaving the rest and challenges to the denied handler
+func WithDeniedTemplates(templates *middleware.DeniedTemplates) Option {
+	return func(o *options) {
+		o.templates = templates
+	}
+}
+
+// New returns gin middleware that enforces limits using limiter
+func New(limiter ratelimit.Limiter, opts ...Option) gin.HandlerFunc {
+	o := options{
+		keyFunc: ByClientIP,
+		deniedHandler: func(c *gin.Context, decision *ratelimit.Decision) {
+			c.AbortWithStatusJSON(middleware.DeniedStatus(decision), middleware.DeniedBody(decision))
+		},
+		errorHandler: func(c *gin.Context, err error) {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, middleware.ErrorBody())
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		key, resource := o.keyFunc(c)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		decision, err := ratelimit.AllowMethod(c.Request.Context(), limiter, key, resource, c.Request.Method)
+		if err != nil {
+			o.errorHandler(c, err)
+			return
+		}
+
+		for name, value := range middleware.Headers(decision) {
+			c.Header(name, value)
+		}
+		if !decision.Allowed {
+			if body, contentType, ok := middleware.RenderDenied(o.templates, key, resource, decision); ok {
+				c.Data(middleware.DeniedStatus(decision), contentType, body)
+				c.Abort()
+				return
+			}
+			o.deniedHandler(c, decision)
+			return
+		}
+		if err := ratelimit.Wait(c.Request.Context(), decision); err != nil {
+			c.Abort() // The client went away while throttled
+			return
+		}
+		c.Next()
+	}
+}
+
+// ByClientIP keys requests on gin's client IP and checks the default resource
+func ByClientIP(c *gin.Context) (string, string) {
+	return c.ClientIP(), middleware.DefaultResource
+}
+
+// ByRoute keys requests on the client IP and checks the matched route pattern
+func ByRoute(c *gin.Context) (string, string) {
+	return c.ClientIP(), c.FullPath()
+}
@@ -0,0 +1,266 @@
+// Package middleware enforces rate limits in net/http servers. The gin, echo,
+// chi and fiber subpackages adapt it to those routers.
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/NickChunglolz/rate-limiter/internal/clientip"
+	"github.com/NickChunglolz/rate-limiter/internal/denial"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// DefaultResource is the resource checked when a KeyFunc does not pick one
+const DefaultResource = "api"
+
+// KeyFunc derives the rate limit key and resource for a request. An empty key
+// skips rate limiting for the request.
+type KeyFunc func(r *http.Request) (key, resource string)
+
+// DeniedHandler renders the response for a request over the limit
+type DeniedHandler func(w http.ResponseWriter, r *http.Request, decision *ratelimit.Decision)
+
+// ErrorHandler renders the response when the limiter fails
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// DeniedTemplates are templates of the bodies of denied responses by
+// resource, loaded with LoadDeniedTemplates
+type DeniedTemplates = denial.Templates
+
+// LoadDeniedTemplates loads denied response templates from a JSON file in
+// the format of the service's DENIED_RESPONSE_TEMPLATES. Templates chosen by
+// tenant are ignored, since the middleware does not know client tiers.
+func LoadDeniedTemplates(path string) (*DeniedTemplates, error) {
+	return denial.Load(path)
+}
+
+// Option configures the middleware
+type Option func(*options)
+
+type options struct {
+	keyFunc       KeyFunc
+	deniedHandler DeniedHandler
+	errorHandler  ErrorHandler
+	templates     *DeniedTemplates
+}
+
+// WithKeyFunc sets how requests are keyed (default: ByClientIP)
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithDeniedHandler sets how denied requests are rendered
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+// WithErrorHandler sets how limiter failures are rendered
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithDeniedTemplates renders denials of the resources templates cover from
+// their templates, leaving the rest and challenges to the denied handler
+func WithDeniedTemplates(templates *DeniedTemplates) Option {
+	return func(o *options) {
+		o.templates = templates
+	}
+}
+
+// New returns net/http middleware that enforces limits using limiter
+func New(limiter ratelimit.Limiter, opts ...Option) func(http.Handler) http.Handler {
+	o := options{
+		keyFunc:       ByClientIP,
+		deniedHandler: DefaultDeniedHandler,
+		errorHandler:  DefaultErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, resource := o.keyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			decision, err := ratelimit.AllowMethod(r.Context(), limiter, key, resource, r.Method)
+			if err != nil {
+				o.errorHandler(w, r, err)
+				return
+			}
+
+			for name, value := range Headers(decision) {
+				w.Header().Set(name, value)
+			}
+			if !decision.Allowed {
+				if body, contentType, ok := RenderDenied(o.templates, key, resource, decision); ok {
+					w.Header().Set("Content-Type", contentType)
+					w.WriteHeader(DeniedStatus(decision))
+					w.Write(body)
+					return
+				}
+				o.deniedHandler(w, r, decision)
+				return
+			}
+			if err := ratelimit.Wait(r.Context(), decision); err != nil {
+				return // The client went away while throttled
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ByClientIP keys requests on the resolved client IP and checks DefaultResource
+func ByClientIP(r *http.Request) (string, string) {
+	return clientip.FromRequest(r), DefaultResource
+}
+
+// ByHeader keys requests on a header value and checks resource
+func ByHeader(header, resource string) KeyFunc {
+	return func(r *http.Request) (string, string) {
+		return r.Header.Get(header), resource
+	}
+}
+
+// BySession keys requests on a hash of their session token and checks
+// resource: the named cookie, or when cookie is empty a bearer token or a
+// common session cookie. Raw tokens never become keys. Requests without a
+// session are keyed on the client IP.
+func BySession(cookie, resource string) KeyFunc {
+	return func(r *http.Request) (string, string) {
+		if session := keytemplate.Session(r.Header, cookie); session != "" {
+			return session, resource
+		}
+		return clientip.FromRequest(r), resource
+	}
+}
+
+// ByTemplate keys requests with a key template and checks resource. Templates
+// combine request attributes, e.g. "header.X-Api-Key", "ip+path" or
+// "{method}:{path}"; requests missing a field the template uses are keyed on
+// the client IP.
+func ByTemplate(template, resource string) (KeyFunc, error) {
+	tmpl, err := keytemplate.Parse(template)
+	if err != nil {
+		return nil, err
+	}
+	return func(r *http.Request) (string, string) {
+		ip := clientip.FromRequest(r)
+		if key, ok := tmpl.Render(keytemplate.FromRequest(r, ip, resource, ip)); ok {
+			return key, resource
+		}
+		return ip, resource
+	}, nil
+}
+
+// Headers returns the rate limit response headers for a decision
+func Headers(decision *ratelimit.Decision) map[string]string {
+	headers := map[string]string{
+		"X-RateLimit-Limit":     strconv.Itoa(decision.Limit),
+		"X-RateLimit-Remaining": strconv.Itoa(decision.Remaining),
+		"X-RateLimit-Reset":     strconv.FormatInt(decision.ResetAt.Unix(), 10),
+	}
+	switch {
+	case decision.Challenge != nil:
+		headers["X-Challenge"] = decision.Challenge.Kind
+		headers["X-Challenge-Token"] = decision.Challenge.Token
+		if decision.Challenge.URL != "" {
+			headers["Location"] = decision.Challenge.URL
+		}
+	case !decision.Allowed:
+		headers["Retry-After"] = strconv.Itoa(decision.RetryAfterSeconds())
+	case decision.Delay > 0:
+		headers["X-Throttle-Delay"] = strconv.FormatInt(decision.Delay.Milliseconds(), 10)
+	}
+	return headers
+}
+
+// DeniedStatus returns the status code written for denied requests: 303 See
+// Other to a captcha, 403 Forbidden for other challenges and 429 Too Many
+// Requests otherwise
+func DeniedStatus(decision *ratelimit.Decision) int {
+	switch {
+	case decision.Challenge == nil:
+		return http.StatusTooManyRequests
+	case decision.Challenge.URL != "":
+		return http.StatusSeeOther
+	default:
+		return http.StatusForbidden
+	}
+}
+
+// DeniedBody returns the JSON body written for denied requests
+func DeniedBody(decision *ratelimit.Decision) map[string]interface{} {
+	if decision.Challenge != nil {
+		return map[string]interface{}{
+			"error":     "challenge required",
+			"challenge": decision.Challenge,
+		}
+	}
+	return map[string]interface{}{
+		"error":       "rate limit exceeded",
+		"retry_after": decision.RetryAfterSeconds(),
+	}
+}
+
+// RenderDenied renders the body of a denial of key's request to resource from
+// its template, returning the body and its content type. It returns false
+// for challenges, resources without a template and failed renders.
+func RenderDenied(templates *DeniedTemplates, key, resource string, decision *ratelimit.Decision) ([]byte, string, bool) {
+	if decision.Challenge != nil {
+		return nil, "", false
+	}
+	template := templates.Select(resource, "")
+	if template == nil {
+		return nil, "", false
+	}
+	body, err := template.Render(denial.Vars{
+		ClientID:   key,
+		Resource:   resource,
+		Limit:      decision.Limit,
+		Remaining:  decision.Remaining,
+		RetryAfter: decision.RetryAfterSeconds(),
+		ResetAt:    decision.ResetAt,
+		Reason:     "rate limit exceeded",
+	})
+	if err != nil {
+		return nil, "", false
+	}
+	return body, template.ContentType(), true
+}
+
+// ErrorBody returns the JSON body written when the limiter fails
+func ErrorBody() map[string]interface{} {
+	return map[string]interface{}{
+		"error": "rate limiter unavailable",
+	}
+}
+
+// DefaultDeniedHandler writes DeniedStatus with DeniedBody
+func DefaultDeniedHandler(w http.ResponseWriter, r *http.Request, decision *ratelimit.Decision) {
+	writeJSON(w, DeniedStatus(decision), DeniedBody(decision))
+}
+
+// DefaultErrorHandler writes 503 Service Unavailable with ErrorBody
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	writeJSON(w, http.StatusServiceUnavailable, ErrorBody())
+}
+
+// writeJSON writes body as JSON with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/api"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/internal/handlers"
+	"github.com/NickChunglolz/rate-limiter/internal/infrastructure"
+	"github.com/NickChunglolz/rate-limiter/internal/keytemplate"
+	"github.com/NickChunglolz/rate-limiter/internal/queries"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// Local is an in-process Limiter backed by in-memory stores
+type Local struct {
+	service *api.RateLimiterService
+	clock   Clock
+}
+
+// NewLocal creates an in-process limiter enforcing the given rules
+func NewLocal(rules ...Rule) (*Local, error) {
+	return NewLocalWithClock(domain.SystemClock{}, rules...)
+}
+
+// NewLocalWithClock creates an in-process limiter that reads the time from
+// clock, so tests can move time forward instead of sleeping
+func NewLocalWithClock(clock Clock, rules ...Rule) (*Local, error) {
+	eventStore := infrastructure.NewInMemoryEventStore()
+	ruleRepository := infrastructure.NewInMemoryRuleRepository()
+	readModel := infrastructure.NewInMemoryReadModel().WithClock(clock)
+
+	// Project synchronously so every decision sees the previous one
+	commandHandler := handlers.NewRateLimitCommandHandler(eventStore, ruleRepository).
+		WithEventPublisher(infrastructure.NewReadModelPublisher(readModel)).
+		WithClock(clock)
+	queryHandler := handlers.NewRateLimitQueryHandler(readModel, ruleRepository)
+
+	local := &Local{
+		service: api.NewRateLimiterService(commandHandler, queryHandler).WithClock(clock),
+		clock:   clock,
+	}
+	for _, rule := range rules {
+		if err := local.AddRule(context.Background(), rule); err != nil {
+			return nil, err
+		}
+	}
+	return local, nil
+}
+
+// AddRule registers a rule at runtime
+func (l *Local) AddRule(ctx context.Context, rule Rule) error {
+	if rule.Resource == "" || rule.Limit <= 0 || rule.Window <= 0 {
+		return fmt.Errorf("invalid rule for resource %q: resource, limit and window are required", rule.Resource)
+	}
+	if rule.Algorithm == "" {
+		rule.Algorithm = "sliding_window"
+	}
+	return l.service.CreateRule(ctx, api.RuleSpec{
+		Resource:  rule.Resource,
+		Method:    rule.Method,
+		Limit:     rule.Limit,
+		Window:    rule.Window,
+		Algorithm: rule.Algorithm,
+	})
+}
+
+// Allow checks and consumes one request for key on resource
+func (l *Local) Allow(ctx context.Context, key, resource string) (*Decision, error) {
+	status, err := l.service.CheckRateLimit(ctx, key, resource, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return decisionFromStatus(status, l.clock.Now()), nil
+}
+
+// AllowMethod checks and consumes one request with method for key on
+// resource, applying the resource's rule for that method if it has one
+func (l *Local) AllowMethod(ctx context.Context, key, resource, method string) (*Decision, error) {
+	status, err := l.service.CheckRequestRateLimit(ctx, resource, keytemplate.Attributes{ClientID: key, Method: method})
+	if err != nil {
+		return nil, err
+	}
+	return decisionFromStatus(status, l.clock.Now()), nil
+}
+
+// decisionFromStatus converts a read model status into a Decision
+func decisionFromStatus(status *queries.RateLimitStatus, now time.Time) *Decision {
+	decision := &Decision{
+		Allowed:   status.IsAllowed,
+		Limit:     status.Limit,
+		Remaining: status.RemainingQuota,
+		ResetAt:   status.ResetTime,
+	}
+	if !status.IsAllowed {
+		decision.RetryAfter = time.Duration(api.RetryAfter(status, now)) * time.Second
+	}
+	return decision
+}
@@ -0,0 +1,93 @@
+// Package ratelimit exposes the rate limiter to Go programs that want to
+// enforce limits in-process or through a remote limiter service.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed    bool          `json:"allowed"`
+	Limit      int           `json:"limit"`
+	Remaining  int           `json:"remaining"`
+	ResetAt    time.Time     `json:"reset_at"`
+	RetryAfter time.Duration `json:"retry_after"`
+	Delay      time.Duration `json:"delay,omitempty"`     // Throttling delay to apply before serving an allowed request
+	Challenge  *Challenge    `json:"challenge,omitempty"` // Set when a denied client may be let through by solving it
+}
+
+// Challenge is what a client must solve to be let through instead of being
+// denied: a JS proof of work or a captcha to send the client to
+type Challenge struct {
+	Kind       string    `json:"kind"` // "js" or "captcha"
+	Token      string    `json:"token"`
+	Difficulty int       `json:"difficulty,omitempty"`
+	URL        string    `json:"url,omitempty"` // Where to send the client to solve a captcha
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// RetryAfterSeconds rounds the retry delay up to whole seconds
+func (d *Decision) RetryAfterSeconds() int {
+	if d.RetryAfter <= 0 {
+		return 0
+	}
+	return int((d.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// Wait blocks for the decision's throttling delay, returning early with the
+// context's error if it is done first
+func Wait(ctx context.Context, decision *Decision) error {
+	if decision.Delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(decision.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Limiter checks and consumes quota for a key on a resource
+type Limiter interface {
+	Allow(ctx context.Context, key, resource string) (*Decision, error)
+}
+
+// MethodLimiter is a Limiter that can apply rules specific to a request's
+// HTTP method
+type MethodLimiter interface {
+	Limiter
+	AllowMethod(ctx context.Context, key, resource, method string) (*Decision, error)
+}
+
+// AllowMethod checks a request with method against limiter, using the
+// method's rules when limiter is a MethodLimiter
+func AllowMethod(ctx context.Context, limiter Limiter, key, resource, method string) (*Decision, error) {
+	if methodLimiter, ok := limiter.(MethodLimiter); ok {
+		return methodLimiter.AllowMethod(ctx, key, resource, method)
+	}
+	return limiter.Allow(ctx, key, resource)
+}
+
+// LimiterFunc adapts a function to the Limiter interface
+type LimiterFunc func(ctx context.Context, key, resource string) (*Decision, error)
+
+// Allow calls f(ctx, key, resource)
+func (f LimiterFunc) Allow(ctx context.Context, key, resource string) (*Decision, error) {
+	return f(ctx, key, resource)
+}
+
+// Rule configures the limit for one resource
+type Rule struct {
+	Resource  string        `json:"resource"`
+	Method    string        `json:"method,omitempty"` // HTTP method the rule applies to; any method when empty
+	Limit     int           `json:"limit"`
+	Window    time.Duration `json:"window"`
+	Algorithm string        `json:"algorithm"` // Defaults to "sliding_window"
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/sidecar"
+)
+
+// Sidecar is a Limiter checking with a rate limiter running next to the
+// program, on its sidecar listener (SIDECAR_LISTEN). Checks are sent over
+// the binary sidecar protocol on pooled connections, one check at a time
+// on each, which keeps a decision within a Unix socket round trip of the
+// limiter's own latency.
+type Sidecar struct {
+	network string
+	address string
+	idle    chan *sidecarConn
+	nextID  atomic.Uint64
+}
+
+// sidecarConn is a connection to the sidecar with its buffers
+type sidecarConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	body   []byte
+	out    []byte
+	in     []byte
+}
+
+// NewSidecar creates a limiter checking with the sidecar listening on addr,
+// "unix:" followed by a socket path or a TCP host:port. Up to maxIdle
+// connections are kept open between checks.
+func NewSidecar(addr string, maxIdle int) *Sidecar {
+	network, address := "tcp", addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, address = "unix", path
+	}
+	return &Sidecar{
+		network: network,
+		address: address,
+		idle:    make(chan *sidecarConn, max(maxIdle, 1)),
+	}
+}
+
+// Allow checks and consumes one request for key on resource
+func (s *Sidecar) Allow(ctx context.Context, key, resource string) (*Decision, error) {
+	return s.check(ctx, sidecar.Request{ClientID: key, Resource: resource})
+}
+
+// AllowMethod checks and consumes one request with method for key on
+// resource, applying the resource's rule for that method if it has one
+func (s *Sidecar) AllowMethod(ctx context.Context, key, resource, method string) (*Decision, error) {
+	return s.check(ctx, sidecar.Request{ClientID: key, Resource: resource, Method: method})
+}
+
+// Close closes the idle connections. Checks still running close theirs
+// when they are done.
+func (s *Sidecar) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// check sends req on an idle or new connection and waits for its answer
+// until ctx is done
+func (s *Sidecar) check(ctx context.Context, req sidecar.Request) (*Decision, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	// A context that is never done, such as context.Background(), needs no
+	// watching
+	stop := func() bool { return true }
+	if ctx.Done() != nil {
+		stop = context.AfterFunc(ctx, func() {
+			c.conn.SetDeadline(time.Unix(1, 0))
+		})
+	}
+
+	req.ID = s.nextID.Add(1)
+	var resp sidecar.Response
+	err = c.roundTrip(&req, &resp)
+	if !stop() || err != nil {
+		c.conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("sidecar check failed: %w", err)
+	}
+	s.release(c)
+
+	if resp.Error != "" {
+		return nil, fmt.Errorf("sidecar check failed: %s", resp.Error)
+	}
+	return responseDecision(&resp), nil
+}
+
+// responseDecision returns the decision of the answer to a check
+func responseDecision(resp *sidecar.Response) *Decision {
+	decision := &Decision{
+		Allowed:   resp.IsAllowed,
+		Limit:     resp.Limit,
+		Remaining: resp.Remaining,
+		ResetAt:   resp.ResetTime,
+	}
+	if !resp.IsAllowed {
+		decision.RetryAfter = time.Duration(resp.RetryAfter) * time.Second
+	}
+	return decision
+}
+
+// roundTrip sends req and reads its answer into resp
+func (c *sidecarConn) roundTrip(req *sidecar.Request, resp *sidecar.Response) error {
+	c.body = req.AppendProto(c.body[:0])
+	c.out = sidecar.AppendMessage(c.out[:0], c.body)
+	if _, err := c.conn.Write(c.out); err != nil {
+		return err
+	}
+
+	var err error
+	if c.in, err = sidecar.ReadMessage(c.reader, c.in); err != nil {
+		return err
+	}
+	if err := resp.UnmarshalProto(c.in); err != nil {
+		return err
+	}
+	if resp.ID != req.ID {
+		return errors.New("answer out of order")
+	}
+	return nil
+}
+
+// conn returns an idle connection, or dials a new one
+func (s *Sidecar) conn(ctx context.Context) (*sidecarConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+	return &sidecarConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// release keeps c for the next check, or closes it when enough connections
+// are idle
+func (s *Sidecar) release(c *sidecarConn) {
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
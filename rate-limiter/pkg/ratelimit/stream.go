@@ -0,0 +1,193 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/NickChunglolz/rate-limiter/internal/sidecar"
+)
+
+// noticeBuffer is how many notices a stream holds for the caller; more are
+// dropped until it receives them
+const noticeBuffer = 256
+
+// checkStreamDesc describes the stream of ratelimit.v1.CheckStream/Check
+var checkStreamDesc = grpc.StreamDesc{
+	StreamName:    "Check",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Stream is a Limiter checking over one long-lived gRPC check stream to a
+// rate limiter's gRPC server (GRPC_PORT), for gateways making many checks:
+// checks from any number of goroutines are messages on the stream rather
+// than requests of their own. The server also pushes notices about the
+// clients checked on the stream, received from Notices.
+type Stream struct {
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	nextID  atomic.Uint64
+	sendMu  sync.Mutex
+	notices chan Notice
+
+	mu      sync.Mutex
+	pending map[uint64]chan *sidecar.Response // Checks awaiting their answer by ID
+	err     error                             // Why the stream ended
+}
+
+// Notice is a notice pushed on a stream about a client checked on it
+type Notice struct {
+	ClientID     string
+	Resource     string    // Set when Blocked
+	Blocked      bool      // Whether the client is now denied on Resource, or its denials may have been lifted early
+	BlockedUntil time.Time // When requests of a blocked client are allowed again
+}
+
+// OpenStream opens a check stream on conn, which lasts until ctx is done or
+// the stream is closed. Once it ends checks fail; a new stream must be
+// opened to check again.
+func OpenStream(ctx context.Context, conn grpc.ClientConnInterface) (*Stream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := conn.NewStream(ctx, &checkStreamDesc, sidecar.CheckStreamMethod, grpc.ForceCodec(sidecar.Codec{}))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("opening check stream failed: %w", err)
+	}
+
+	s := &Stream{
+		stream:  stream,
+		cancel:  cancel,
+		notices: make(chan Notice, noticeBuffer),
+		pending: make(map[uint64]chan *sidecar.Response),
+	}
+	go s.receive()
+	return s, nil
+}
+
+// Allow checks and consumes one request for key on resource
+func (s *Stream) Allow(ctx context.Context, key, resource string) (*Decision, error) {
+	return s.check(ctx, sidecar.Request{ClientID: key, Resource: resource})
+}
+
+// AllowMethod checks and consumes one request with method for key on
+// resource, applying the resource's rule for that method if it has one
+func (s *Stream) AllowMethod(ctx context.Context, key, resource, method string) (*Decision, error) {
+	return s.check(ctx, sidecar.Request{ClientID: key, Resource: resource, Method: method})
+}
+
+// Notices returns the notices pushed on the stream, which is closed when
+// the stream ends. Notices are dropped while the caller does not keep up.
+func (s *Stream) Notices() <-chan Notice {
+	return s.notices
+}
+
+// Close ends the stream, failing the checks awaiting their answer
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// check sends req on the stream and waits for its answer until ctx is done
+func (s *Stream) check(ctx context.Context, req sidecar.Request) (*Decision, error) {
+	req.ID = s.nextID.Add(1)
+	answer := make(chan *sidecar.Response, 1)
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.pending[req.ID] = answer
+	s.mu.Unlock()
+
+	s.sendMu.Lock()
+	err := s.stream.SendMsg(&req)
+	s.sendMu.Unlock()
+	if err != nil {
+		s.forget(req.ID)
+		return nil, fmt.Errorf("stream check failed: %w", err)
+	}
+
+	select {
+	case resp, ok := <-answer:
+		if !ok {
+			return nil, s.failure()
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("stream check failed: %s", resp.Error)
+		}
+		return responseDecision(resp), nil
+	case <-ctx.Done():
+		s.forget(req.ID)
+		return nil, ctx.Err()
+	}
+}
+
+// receive hands answers to the checks awaiting them and queues notices
+// until the stream ends
+func (s *Stream) receive() {
+	for {
+		var msg sidecar.StreamMessage
+		if err := s.stream.RecvMsg(&msg); err != nil {
+			s.end(err)
+			return
+		}
+
+		switch {
+		case msg.Decision != nil:
+			s.mu.Lock()
+			answer := s.pending[msg.Decision.ID]
+			delete(s.pending, msg.Decision.ID)
+			s.mu.Unlock()
+			if answer != nil {
+				answer <- msg.Decision
+			}
+		case msg.Notice != nil:
+			select {
+			case s.notices <- Notice(*msg.Notice):
+			default:
+			}
+		}
+	}
+}
+
+// end records why the stream ended and fails the checks awaiting their
+// answer
+func (s *Stream) end(err error) {
+	if errors.Is(err, io.EOF) {
+		err = errors.New("stream closed by the server")
+	}
+
+	s.mu.Lock()
+	s.err = fmt.Errorf("stream check failed: %w", err)
+	for id, answer := range s.pending {
+		close(answer)
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+	close(s.notices)
+	s.cancel()
+}
+
+// failure returns why the stream ended
+func (s *Stream) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// forget stops awaiting the answer to the check id
+func (s *Stream) forget(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, id)
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/NickChunglolz/rate-limiter/internal/sidecar"
+)
+
+// watchStreamDesc describes the stream of ratelimit.v1.CheckStream/Watch
+var watchStreamDesc = grpc.StreamDesc{
+	StreamName:    "Watch",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Watch is a gRPC watch stream to a rate limiter's gRPC server, on which
+// the server pushes notices about the clients named by Watch: when one
+// starts being denied on a resource, and when its denials may have been
+// lifted early. Watching a client denied at the time is answered with its
+// denials in effect, so a gateway following the notices with a Blocklist
+// denies blocked clients locally without checking their requests.
+type Watch struct {
+	stream  grpc.ClientStream
+	cancel  context.CancelFunc
+	sendMu  sync.Mutex
+	notices chan Notice
+
+	mu  sync.Mutex
+	err error // Why the stream ended
+}
+
+// OpenWatch opens a watch stream on conn, which lasts until ctx is done or
+// the stream is closed
+func OpenWatch(ctx context.Context, conn grpc.ClientConnInterface) (*Watch, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := conn.NewStream(ctx, &watchStreamDesc, sidecar.WatchStreamMethod, grpc.ForceCodec(sidecar.Codec{}))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("opening watch stream failed: %w", err)
+	}
+
+	w := &Watch{
+		stream:  stream,
+		cancel:  cancel,
+		notices: make(chan Notice, noticeBuffer),
+	}
+	go w.receive()
+	return w, nil
+}
+
+// Watch adds clients to those notices are pushed about. A stream watches
+// up to 10,000 clients; watching more ends it.
+func (w *Watch) Watch(clientIDs ...string) error {
+	return w.send(&sidecar.WatchRequest{Watch: clientIDs})
+}
+
+// Unwatch stops the notices about clients
+func (w *Watch) Unwatch(clientIDs ...string) error {
+	return w.send(&sidecar.WatchRequest{Unwatch: clientIDs})
+}
+
+// Notices returns the notices pushed on the stream, which is closed when
+// the stream ends. Notices are dropped while the caller does not keep up.
+func (w *Watch) Notices() <-chan Notice {
+	return w.notices
+}
+
+// Err returns why the stream ended, or nil while it is open
+func (w *Watch) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Close ends the stream
+func (w *Watch) Close() error {
+	w.cancel()
+	return nil
+}
+
+// send sends req on the stream
+func (w *Watch) send(req *sidecar.WatchRequest) error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+
+	if err := w.stream.SendMsg(req); err != nil {
+		return fmt.Errorf("watch failed: %w", err)
+	}
+	return nil
+}
+
+// receive queues the notices pushed on the stream until it ends
+func (w *Watch) receive() {
+	for {
+		var msg sidecar.StreamMessage
+		if err := w.stream.RecvMsg(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("stream closed by the server")
+			}
+			w.mu.Lock()
+			w.err = fmt.Errorf("watch failed: %w", err)
+			w.mu.Unlock()
+			close(w.notices)
+			w.cancel()
+			return
+		}
+
+		if msg.Notice != nil {
+			select {
+			case w.notices <- Notice(*msg.Notice):
+			default:
+			}
+		}
+	}
+}
+
+// Blocklist holds the denials of clients told by notices, so that a
+// gateway denies their requests locally until they are allowed again
+type Blocklist struct {
+	mu      sync.RWMutex
+	denials map[string]map[string]time.Time // When each client is allowed again, by resource
+}
+
+// NewBlocklist creates an empty blocklist
+func NewBlocklist() *Blocklist {
+	return &Blocklist{denials: make(map[string]map[string]time.Time)}
+}
+
+// Follow applies the notices of a stream until it ends
+func (b *Blocklist) Follow(notices <-chan Notice) {
+	for notice := range notices {
+		b.Apply(notice)
+	}
+}
+
+// Apply records the denial a notice tells of, or forgets the denials of
+// its client when they may have been lifted
+func (b *Blocklist) Apply(notice Notice) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !notice.Blocked {
+		delete(b.denials, notice.ClientID)
+		return
+	}
+
+	denials := b.denials[notice.ClientID]
+	if denials == nil {
+		denials = make(map[string]time.Time)
+		b.denials[notice.ClientID] = denials
+	}
+	now := time.Now()
+	for resource, until := range denials {
+		if !until.After(now) {
+			delete(denials, resource)
+		}
+	}
+	denials[notice.Resource] = notice.BlockedUntil
+}
+
+// Blocked returns until when the client's requests to resource are denied,
+// if they are at now
+func (b *Blocklist) Blocked(clientID, resource string, now time.Time) (time.Time, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	until := b.denials[clientID][resource]
+	return until, until.After(now)
+}
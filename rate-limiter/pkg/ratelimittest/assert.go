@@ -0,0 +1,58 @@
+package ratelimittest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// AssertAllowed checks one request for key on resource and fails the test
+// unless it is allowed
+func AssertAllowed(tb testing.TB, limiter ratelimit.Limiter, key, resource string) *ratelimit.Decision {
+	tb.Helper()
+
+	decision := check(tb, limiter, key, resource)
+	if !decision.Allowed {
+		tb.Errorf("request for %q on %q denied, want allowed (retry after %v)", key, resource, decision.RetryAfter)
+	}
+	return decision
+}
+
+// AssertDenied checks one request for key on resource and fails the test
+// unless it is denied
+func AssertDenied(tb testing.TB, limiter ratelimit.Limiter, key, resource string) *ratelimit.Decision {
+	tb.Helper()
+
+	decision := check(tb, limiter, key, resource)
+	if decision.Allowed {
+		tb.Errorf("request for %q on %q allowed with %d remaining, want denied", key, resource, decision.Remaining)
+	}
+	return decision
+}
+
+// AssertDeniedAfter checks n+1 requests for key on resource and fails the
+// test unless the first n are allowed and the last is denied
+func AssertDeniedAfter(tb testing.TB, limiter ratelimit.Limiter, key, resource string, n int) {
+	tb.Helper()
+
+	for i := 1; i <= n; i++ {
+		if decision := check(tb, limiter, key, resource); !decision.Allowed {
+			tb.Fatalf("request %d for %q on %q denied, want the first %d allowed", i, key, resource, n)
+		}
+	}
+	if decision := check(tb, limiter, key, resource); decision.Allowed {
+		tb.Fatalf("request %d for %q on %q allowed, want denied after %d", n+1, key, resource, n)
+	}
+}
+
+// check checks one request, failing the test if the limiter fails
+func check(tb testing.TB, limiter ratelimit.Limiter, key, resource string) *ratelimit.Decision {
+	tb.Helper()
+
+	decision, err := limiter.Allow(context.Background(), key, resource)
+	if err != nil {
+		tb.Fatalf("rate limit check for %q on %q failed: %v", key, resource, err)
+	}
+	return decision
+}
@@ -0,0 +1,160 @@
+package ratelimittest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/commands"
+	"github.com/NickChunglolz/rate-limiter/internal/domain"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// RuleBuilder builds a rule, defaulting to 10 requests per minute with a
+// sliding window
+type RuleBuilder struct {
+	rule ratelimit.Rule
+}
+
+// NewRule starts a rule for resource
+func NewRule(resource string) *RuleBuilder {
+	return &RuleBuilder{rule: ratelimit.Rule{
+		Resource:  resource,
+		Limit:     10,
+		Window:    time.Minute,
+		Algorithm: string(domain.SlidingWindow),
+	}}
+}
+
+// Allow sets the limit to limit requests per window
+func (b *RuleBuilder) Allow(limit int, window time.Duration) *RuleBuilder {
+	b.rule.Limit = limit
+	b.rule.Window = window
+	return b
+}
+
+// Algorithm sets the algorithm, e.g. "token_bucket"
+func (b *RuleBuilder) Algorithm(algorithm string) *RuleBuilder {
+	b.rule.Algorithm = algorithm
+	return b
+}
+
+// Method limits the rule to requests with an HTTP method
+func (b *RuleBuilder) Method(method string) *RuleBuilder {
+	b.rule.Method = method
+	return b
+}
+
+// Build returns the rule
+func (b *RuleBuilder) Build() ratelimit.Rule {
+	return b.rule
+}
+
+// EventsBuilder builds the event history of one client and resource, for
+// tests of projections and event consumers
+type EventsBuilder struct {
+	clientID string
+	resource string
+	window   time.Duration
+	events   []domain.Event
+}
+
+// NewEvents starts the history of clientID on resource, whose windows last
+// window
+func NewEvents(clientID, resource string, window time.Duration) *EventsBuilder {
+	return &EventsBuilder{
+		clientID: clientID,
+		resource: resource,
+		window:   window,
+	}
+}
+
+// Applied adds an allowed request at at, the requestCount-th of its window
+func (b *EventsBuilder) Applied(at time.Time, requestCount, limit int) *EventsBuilder {
+	windowStart := at.Truncate(b.window)
+	b.events = append(b.events, &domain.RateLimitAppliedEvent{
+		BaseEvent:      b.base("RateLimitApplied", at),
+		ClientID:       b.clientID,
+		Resource:       b.resource,
+		WindowStart:    windowStart,
+		WindowEnd:      windowStart.Add(b.window),
+		RequestCount:   requestCount,
+		Limit:          limit,
+		RemainingQuota: limit - requestCount,
+	})
+	return b
+}
+
+// Exceeded adds a denied request at at, blocked until the end of its window
+func (b *EventsBuilder) Exceeded(at time.Time, requestCount, limit int) *EventsBuilder {
+	windowStart := at.Truncate(b.window)
+	b.events = append(b.events, &domain.RateLimitExceededEvent{
+		BaseEvent:    b.base("RateLimitExceeded", at),
+		ClientID:     b.clientID,
+		Resource:     b.resource,
+		RequestCount: requestCount,
+		Limit:        limit,
+		WindowStart:  windowStart,
+		WindowEnd:    windowStart.Add(b.window),
+		BlockedUntil: windowStart.Add(b.window),
+	})
+	return b
+}
+
+// Reset adds a reset of the client's limit at at
+func (b *EventsBuilder) Reset(at time.Time) *EventsBuilder {
+	b.events = append(b.events, &domain.RateLimitWindowResetEvent{
+		BaseEvent:   b.base("RateLimitWindowReset", at),
+		ClientID:    b.clientID,
+		Resource:    b.resource,
+		WindowStart: at,
+	})
+	return b
+}
+
+// Build returns the events in the order they were added
+func (b *EventsBuilder) Build() []domain.Event {
+	return append([]domain.Event(nil), b.events...)
+}
+
+// base returns the base of the next event
+func (b *EventsBuilder) base(eventType string, at time.Time) domain.BaseEvent {
+	version := len(b.events) + 1
+	return domain.BaseEvent{
+		ID:      fmt.Sprintf("%s-%d", eventType, version),
+		Type:    eventType,
+		Time:    at,
+		AggrID:  b.clientID + ":" + b.resource,
+		Version: version,
+	}
+}
+
+// ApplyCommand returns the command checking one request of clientID on
+// resource at at
+func ApplyCommand(clientID, resource string, at time.Time) *commands.ApplyRateLimitCommand {
+	return &commands.ApplyRateLimitCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("apply-%d", at.UnixNano()),
+			Type: "ApplyRateLimit",
+			Time: at,
+		},
+		ClientID:    clientID,
+		Resource:    resource,
+		RequestedAt: at,
+	}
+}
+
+// CreateRuleCommand returns the command creating rule
+func CreateRuleCommand(rule ratelimit.Rule, at time.Time) *commands.CreateRuleCommand {
+	return &commands.CreateRuleCommand{
+		BaseCommand: commands.BaseCommand{
+			ID:   fmt.Sprintf("create-rule-%d", at.UnixNano()),
+			Type: "CreateRule",
+			Time: at,
+		},
+		Resource:  rule.Resource,
+		Method:    rule.Method,
+		Limit:     rule.Limit,
+		Window:    rule.Window,
+		Algorithm: rule.Algorithm,
+	}
+}
@@ -0,0 +1,132 @@
+package ratelimittest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// Call is a check made against a FakeLimiter
+type Call struct {
+	Key      string
+	Resource string
+	Method   string // Empty for Allow
+}
+
+// DecideFunc decides a call to a FakeLimiter
+type DecideFunc func(call Call) (*ratelimit.Decision, error)
+
+// FakeLimiter is a Limiter returning scripted decisions and recording every
+// call, for testing how code reacts to allowed, denied and failed checks
+type FakeLimiter struct {
+	decide DecideFunc
+	calls  []Call
+	mutex  sync.Mutex
+}
+
+// NewFakeLimiter creates a fake limiter deciding calls with decide
+func NewFakeLimiter(decide DecideFunc) *FakeLimiter {
+	return &FakeLimiter{decide: decide}
+}
+
+// AllowAll returns a fake limiter that allows every call
+func AllowAll() *FakeLimiter {
+	return NewFakeLimiter(func(Call) (*ratelimit.Decision, error) {
+		return AllowedDecision(1), nil
+	})
+}
+
+// DenyAll returns a fake limiter that denies every call
+func DenyAll(retryAfter time.Duration) *FakeLimiter {
+	return NewFakeLimiter(func(Call) (*ratelimit.Decision, error) {
+		return DeniedDecision(retryAfter), nil
+	})
+}
+
+// FailAll returns a fake limiter whose every call fails with err
+func FailAll(err error) *FakeLimiter {
+	return NewFakeLimiter(func(Call) (*ratelimit.Decision, error) {
+		return nil, err
+	})
+}
+
+// AllowFirst returns a fake limiter that allows the first n calls for each
+// key and resource and denies the rest
+func AllowFirst(n int, retryAfter time.Duration) *FakeLimiter {
+	counts := make(map[Call]int)
+	return NewFakeLimiter(func(call Call) (*ratelimit.Decision, error) {
+		call.Method = ""
+		counts[call]++
+		if counts[call] > n {
+			return DeniedDecision(retryAfter), nil
+		}
+		return AllowedDecision(n - counts[call]), nil
+	})
+}
+
+// AllowedDecision returns an allowed decision with remaining quota
+func AllowedDecision(remaining int) *ratelimit.Decision {
+	return &ratelimit.Decision{
+		Allowed:   true,
+		Limit:     remaining + 1,
+		Remaining: remaining,
+		ResetAt:   Epoch.Add(time.Minute),
+	}
+}
+
+// DeniedDecision returns a denied decision asking the client to retry after
+// retryAfter
+func DeniedDecision(retryAfter time.Duration) *ratelimit.Decision {
+	return &ratelimit.Decision{
+		Allowed:    false,
+		ResetAt:    Epoch.Add(retryAfter),
+		RetryAfter: retryAfter,
+	}
+}
+
+// ChallengedDecision returns a denied decision asking the client to solve a
+// challenge of kind, "js" or "captcha"
+func ChallengedDecision(kind string) *ratelimit.Decision {
+	challenge := &ratelimit.Challenge{
+		Kind:      kind,
+		Token:     "test-challenge-token",
+		ExpiresAt: Epoch.Add(5 * time.Minute),
+	}
+	if kind == "captcha" {
+		challenge.URL = "https://captcha.example.com/?challenge=test-challenge-token"
+	}
+	return &ratelimit.Decision{
+		Allowed:   false,
+		ResetAt:   Epoch,
+		Challenge: challenge,
+	}
+}
+
+// Allow records the call and returns the scripted decision
+func (f *FakeLimiter) Allow(ctx context.Context, key, resource string) (*ratelimit.Decision, error) {
+	return f.record(Call{Key: key, Resource: resource})
+}
+
+// AllowMethod records the call with its method and returns the scripted
+// decision
+func (f *FakeLimiter) AllowMethod(ctx context.Context, key, resource, method string) (*ratelimit.Decision, error) {
+	return f.record(Call{Key: key, Resource: resource, Method: method})
+}
+
+// Calls returns the calls made so far
+func (f *FakeLimiter) Calls() []Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// record appends call and decides it; decide runs under the lock, so
+// scripts may keep state without synchronizing
+func (f *FakeLimiter) record(call Call) (*ratelimit.Decision, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, call)
+	return f.decide(call)
+}
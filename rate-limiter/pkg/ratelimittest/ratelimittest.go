@@ -0,0 +1,48 @@
+// Package ratelimittest helps services test their rate limiting without a
+// limiter server: an in-memory limiter on a fake clock, a scriptable fake
+// limiter, builders for rules, events and commands, and assertions.
+package ratelimittest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NickChunglolz/rate-limiter/internal/domain/clocktest"
+	"github.com/NickChunglolz/rate-limiter/pkg/ratelimit"
+)
+
+// Epoch is the time a Limiter's clock starts at
+var Epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Limiter is an in-memory limiter preloaded with rules whose clock only
+// moves when advanced, so window boundaries are tested without sleeping
+type Limiter struct {
+	*ratelimit.Local
+	clock *clocktest.Fake
+}
+
+// NewLimiter creates a limiter enforcing rules, failing the test if a rule
+// is invalid
+func NewLimiter(tb testing.TB, rules ...ratelimit.Rule) *Limiter {
+	tb.Helper()
+
+	clock := clocktest.NewFake(Epoch)
+	local, err := ratelimit.NewLocalWithClock(clock, rules...)
+	if err != nil {
+		tb.Fatalf("ratelimittest: failed to create limiter: %v", err)
+	}
+	return &Limiter{
+		Local: local,
+		clock: clock,
+	}
+}
+
+// Now returns the limiter's current time
+func (l *Limiter) Now() time.Time {
+	return l.clock.Now()
+}
+
+// Advance moves the limiter's clock forward by d
+func (l *Limiter) Advance(d time.Duration) {
+	l.clock.Advance(d)
+}
@@ -0,0 +1,280 @@
+package domain
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"net/textproto"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+)
+
+// Limits of the sandbox expressions run in. CEL has no unbounded loops, and
+// the cost limit, counting the operations of an evaluation and the sizes of
+// the strings and lists it builds, bounds its CPU time and memory.
+const (
+	MaxExpressionSource = 4096  // Bytes of source
+	MaxExpressionCost   = 10000 // Cost of an evaluation, as CEL tracks it
+)
+
+// maxCachedExpressions bounds the compilation cache
+const maxCachedExpressions = 1024
+
+// Expression is a compiled CEL rule expression or script condition, a
+// boolean expression over the request such as
+//
+//	method == "POST" && headers["X-Api-Key"].startsWith("test_") && size(path) > 100
+//
+// Expressions are Common Expression Language, type checked against the
+// declared variables of celEnv when they are compiled, so a misspelled name
+// or a type error fails when the rule is created rather than never
+// matching. An Expression is immutable and safe for concurrent use.
+type Expression struct {
+	source  string
+	program cel.Program
+}
+
+// celEnv declares the variables and functions of CEL expressions: the
+// request fields, its maps, the string extensions, and inCidr, testing an
+// address against CIDR ranges
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("client_id", cel.StringType),
+		cel.Variable("resource", cel.StringType),
+		cel.Variable("ip_address", cel.StringType),
+		cel.Variable("user_agent", cel.StringType),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("timestamp", cel.TimestampType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("query_params", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("metadata", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("request_data", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+		cel.Function("inCidr",
+			cel.MemberOverload("string_in_cidr_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(celInCIDR)),
+			cel.MemberOverload("string_in_cidr_list", []*cel.Type{cel.StringType, cel.ListType(cel.StringType)}, cel.BoolType,
+				cel.BinaryBinding(celInCIDR)),
+		),
+	)
+})
+
+// expressionCache holds the most recently used compiled expressions by
+// source, so rule sets rebuilt after an unrelated rule change do not
+// compile them again. Once full, the least recently used is evicted, so a
+// churn of one-off expressions cannot flush those of the active rules.
+var expressionCache = struct {
+	expressions map[string]*list.Element
+	order       *list.List // Most recently used first
+	mutex       sync.Mutex
+}{expressions: make(map[string]*list.Element), order: list.New()}
+
+// CompileCEL compiles a CEL rule expression, reusing an earlier compilation
+// of the same source
+func CompileCEL(source string) (*Expression, error) {
+	if expression, ok := cachedExpression(source); ok {
+		return expression, nil
+	}
+
+	expression, err := compileExpression(source)
+	if err != nil {
+		return nil, fmt.Errorf("cel: %w", err)
+	}
+	cacheExpression(expression)
+	return expression, nil
+}
+
+// cachedExpression returns the cached compilation of source
+func cachedExpression(source string) (*Expression, bool) {
+	expressionCache.mutex.Lock()
+	defer expressionCache.mutex.Unlock()
+
+	element, ok := expressionCache.expressions[source]
+	if !ok {
+		return nil, false
+	}
+	expressionCache.order.MoveToFront(element)
+	return element.Value.(*Expression), true
+}
+
+// cacheExpression caches a compiled expression, evicting the least recently
+// used one when the cache is full
+func cacheExpression(expression *Expression) {
+	expressionCache.mutex.Lock()
+	defer expressionCache.mutex.Unlock()
+
+	if element, ok := expressionCache.expressions[expression.source]; ok {
+		expressionCache.order.MoveToFront(element)
+		return
+	}
+	if expressionCache.order.Len() >= maxCachedExpressions {
+		oldest := expressionCache.order.Back()
+		expressionCache.order.Remove(oldest)
+		delete(expressionCache.expressions, oldest.Value.(*Expression).source)
+	}
+	expressionCache.expressions[expression.source] = expressionCache.order.PushFront(expression)
+}
+
+// compileExpression parses and type checks source, which must be a boolean
+// expression, and plans its evaluation
+func compileExpression(source string) (*Expression, error) {
+	if len(source) > MaxExpressionSource {
+		return nil, fmt.Errorf("longer than %d bytes", MaxExpressionSource)
+	}
+
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression is of type %s, not bool", ast.OutputType())
+	}
+	program, err := env.Program(ast,
+		cel.EvalOptions(cel.OptOptimize),
+		cel.CostLimit(MaxExpressionCost),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{source: source, program: program}, nil
+}
+
+// Source returns the source of the expression
+func (e *Expression) Source() string {
+	return e.source
+}
+
+// Evaluate runs the expression against a request and returns its result
+func (e *Expression) Evaluate(ctx *RuleEvaluationContext) (interface{}, error) {
+	result, _, err := e.program.Eval(celActivation{ctx: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("cel: %w", err)
+	}
+	return result.Value(), nil
+}
+
+// Matches reports whether the expression evaluates to true for a request.
+// An expression that fails, such as on a missing map key, or exceeds its
+// cost limit does not match.
+func (e *Expression) Matches(ctx *RuleEvaluationContext) bool {
+	result, _, err := e.program.Eval(celActivation{ctx: ctx})
+	return err == nil && result == types.True
+}
+
+// celActivation resolves the variables of an expression from the request
+// as they are read, so unread maps are never converted
+type celActivation struct {
+	ctx *RuleEvaluationContext
+}
+
+// ResolveName returns the value of a declared variable
+func (a celActivation) ResolveName(name string) (interface{}, bool) {
+	ctx := a.ctx
+	switch name {
+	case "client_id":
+		return ctx.ClientID, true
+	case "resource":
+		return ctx.Resource, true
+	case "ip_address":
+		return ctx.IPAddress, true
+	case "user_agent":
+		return ctx.UserAgent, true
+	case "method":
+		return ctx.Method, true
+	case "path":
+		return ctx.Path, true
+	case "timestamp":
+		return ctx.Timestamp, true
+	case "headers":
+		return celHeaders{Mapper: types.NewStringStringMap(types.DefaultTypeAdapter, ctx.Headers)}, true
+	case "query_params":
+		return types.NewStringStringMap(types.DefaultTypeAdapter, ctx.QueryParams), true
+	case "metadata":
+		return types.NewStringStringMap(types.DefaultTypeAdapter, ctx.Metadata), true
+	case "request_data":
+		return types.NewStringInterfaceMap(types.DefaultTypeAdapter, ctx.RequestData), true
+	}
+	return nil, false
+}
+
+// Parent returns nil, as the request is the only scope
+func (a celActivation) Parent() interpreter.Activation {
+	return nil
+}
+
+// celHeaders is the request headers, keyed by canonical name, so indexing
+// them is case-insensitive as HTTP header names are
+type celHeaders struct {
+	traits.Mapper
+}
+
+// Contains reports whether the header is set
+func (h celHeaders) Contains(key ref.Val) ref.Val {
+	return h.Mapper.Contains(canonicalHeaderKey(key))
+}
+
+// Get returns the value of the header, or an error when it is not set
+func (h celHeaders) Get(key ref.Val) ref.Val {
+	return h.Mapper.Get(canonicalHeaderKey(key))
+}
+
+// Find returns the value of the header and whether it is set
+func (h celHeaders) Find(key ref.Val) (ref.Val, bool) {
+	return h.Mapper.Find(canonicalHeaderKey(key))
+}
+
+// canonicalHeaderKey returns the canonical form of a header name
+func canonicalHeaderKey(key ref.Val) ref.Val {
+	if name, ok := key.(types.String); ok {
+		return types.String(textproto.CanonicalMIMEHeaderKey(string(name)))
+	}
+	return key
+}
+
+// celInCIDR reports whether an address is in a CIDR range, or in any of a
+// list of them. Addresses that cannot be parsed are in none; ranges that
+// cannot be parsed are an error.
+func celInCIDR(address, ranges ref.Val) ref.Val {
+	var cidrs []string
+	switch r := ranges.(type) {
+	case types.String:
+		cidrs = []string{string(r)}
+	case traits.Lister:
+		for it := r.Iterator(); it.HasNext() == types.True; {
+			cidr, ok := it.Next().(types.String)
+			if !ok {
+				return types.NewErr("inCidr ranges must be strings")
+			}
+			cidrs = append(cidrs, string(cidr))
+		}
+	default:
+		return types.MaybeNoSuchOverloadErr(ranges)
+	}
+
+	addr, err := netip.ParseAddr(string(address.(types.String)))
+	if err != nil {
+		return types.False
+	}
+	addr = addr.Unmap()
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return types.NewErr("invalid CIDR range %q", cidr)
+		}
+		if prefix.Contains(addr) {
+			return types.True
+		}
+	}
+	return types.False
+}
@@ -0,0 +1,463 @@
+package domain
+
+import (
+	"fmt"
+	"net/netip"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// CompiledRule is a rule with its conditions parsed once, so that evaluating
+// it against a request allocates nothing, save for rules with expressions or
+// sampled actions
+type CompiledRule struct {
+	Rule        Rule
+	conditions  []compiledCondition
+	sampleRate  float64   // Fraction of matching clients the rule applies to
+	actionRates []float64 // Sample rates of the actions, nil when none is sampled
+}
+
+// fieldKind identifies where a condition reads its value from
+type fieldKind int
+
+const (
+	fieldClientID fieldKind = iota
+	fieldResource
+	fieldIPAddress
+	fieldUserAgent
+	fieldMethod
+	fieldPath
+	fieldTimestamp
+	fieldHeader     // "header.<name>"
+	fieldQuery      // "query.<name>"
+	fieldCustom     // Metadata first, then request data
+	fieldExpression // A CEL expression over the whole request, of the rule or a script condition; the field is unused
+)
+
+// maxScannedPrefixes is the longest cidr list matched by scanning it
+const maxScannedPrefixes = 16
+
+// Field prefixes selecting a request header or query parameter
+const (
+	HeaderFieldPrefix = "header."
+	QueryFieldPrefix  = "query."
+)
+
+// compiledCondition is a condition with its field resolved and its operator
+// turned into matchers. matchString handles string fields without boxing them
+type compiledCondition struct {
+	field       string // Header name or query parameter for those kinds
+	kind        fieldKind
+	operator    string
+	value       interface{}
+	prefixes    []netip.Prefix // Parsed cidr operands, used by RuleIndex
+	expression  *Expression    // Compiled CEL expression of the rule or script operator
+	matchString func(string) bool
+	matchValue  func(interface{}) bool
+	missing     bool // Result when the field is absent
+}
+
+// CompileRule compiles a rule for repeated evaluation. A condition that cannot
+// be compiled never matches; the returned error reports the first such condition
+func CompileRule(rule Rule) (*CompiledRule, error) {
+	compiled := &CompiledRule{
+		Rule:       rule,
+		conditions: make([]compiledCondition, 0, len(rule.Conditions)),
+	}
+	
+	var firstErr error
+	for i, condition := range rule.Conditions {
+		c, err := compileCondition(condition)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("condition %d: %w", i, err)
+		}
+		compiled.conditions = append(compiled.conditions, c)
+	}
+	
+	// The expression is one more condition, never indexed
+	if rule.Expression != "" {
+		c := compiledCondition{kind: fieldExpression, operator: "expression"}
+		expression, err := CompileCEL(rule.Expression)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("expression: %w", err)
+		}
+		c.expression = expression
+		compiled.conditions = append(compiled.conditions, c)
+	}
+	
+	// A sample rate that cannot be read samples no client
+	compiled.sampleRate = 1
+	if rule.SampleRate != nil {
+		rate, err := parseSampleRate(*rule.SampleRate)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		compiled.sampleRate = rate
+	}
+	for i, action := range rule.Actions {
+		rate, err := action.SampleRate()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("action %d: %w", i, err)
+		}
+		if rate < 1 && compiled.actionRates == nil {
+			compiled.actionRates = make([]float64, len(rule.Actions))
+			for j := range compiled.actionRates {
+				compiled.actionRates[j] = 1
+			}
+		}
+		if compiled.actionRates != nil {
+			compiled.actionRates[i] = rate
+		}
+	}
+	
+	return compiled, firstErr
+}
+
+// noActions are the actions of unmatched results, shared so that evaluating
+// a rule that does not match allocates nothing
+var noActions = []RuleAction{}
+
+// Evaluate evaluates the compiled rule against the given context
+func (c *CompiledRule) Evaluate(ctx RuleEvaluationContext) RuleEvaluationResult {
+	result := RuleEvaluationResult{
+		RuleID:      c.Rule.ID,
+		RuleName:    c.Rule.Name,
+		Matched:     false,
+		Actions:     noActions,
+		EvaluatedAt: time.Now(),
+	}
+	
+	if !c.Rule.Enabled {
+		return result
+	}
+	
+	// Evaluate all conditions (AND logic)
+	for i := range c.conditions {
+		if !c.conditions[i].matches(&ctx) {
+			return result
+		}
+	}
+	
+	// Sampled rules and actions apply to the same share of clients each time
+	if !Sampled(c.Rule.ID, c.sampleRate, &ctx) {
+		return result
+	}
+	
+	result.Matched = true
+	result.Actions = c.Rule.Actions
+	if c.actionRates != nil {
+		result.Actions = make([]RuleAction, 0, len(c.Rule.Actions))
+		for i, action := range c.Rule.Actions {
+			if Sampled(c.Rule.ID, c.actionRates[i], &ctx) {
+				result.Actions = append(result.Actions, action)
+			}
+		}
+	}
+	return result
+}
+
+// matches reports whether the condition holds for the context
+func (c *compiledCondition) matches(ctx *RuleEvaluationContext) bool {
+	switch c.kind {
+	case fieldExpression:
+		if c.expression == nil {
+			return false
+		}
+		// CEL keeps the context it reads, so only expressions pay for moving
+		// a copy of it to the heap
+		request := *ctx
+		return c.expression.Matches(&request)
+	case fieldClientID:
+		return c.matchString(ctx.ClientID)
+	case fieldResource:
+		return c.matchString(ctx.Resource)
+	case fieldIPAddress:
+		return c.matchString(ctx.IPAddress)
+	case fieldUserAgent:
+		return c.matchString(ctx.UserAgent)
+	case fieldMethod:
+		return c.matchString(ctx.Method)
+	case fieldPath:
+		return c.matchString(ctx.Path)
+	case fieldTimestamp:
+		return c.matchValue(ctx.Timestamp)
+	case fieldHeader:
+		if val, exists := ctx.Headers[c.field]; exists {
+			return c.matchString(val)
+		}
+		return c.missing
+	case fieldQuery:
+		if val, exists := ctx.QueryParams[c.field]; exists {
+			return c.matchString(val)
+		}
+		return c.missing
+	default:
+		if val, exists := ctx.Metadata[c.field]; exists {
+			return c.matchString(val)
+		}
+		if val, exists := ctx.RequestData[c.field]; exists {
+			return c.matchValue(val)
+		}
+		return c.missing // Field not found
+	}
+}
+
+// compileCondition resolves the condition's field and builds its matchers
+func compileCondition(condition RuleCondition) (compiledCondition, error) {
+	c := compiledCondition{
+		field:       condition.Field,
+		operator:    condition.Operator,
+		value:       condition.Value,
+		matchString: func(string) bool { return false },
+		matchValue:  func(interface{}) bool { return false },
+	}
+	
+	if condition.Operator == "script" {
+		c.kind = fieldExpression
+		source, ok := condition.Value.(string)
+		if !ok {
+			return c, fmt.Errorf("script value must be a string")
+		}
+		expression, err := CompileCEL(source)
+		if err != nil {
+			return c, err
+		}
+		c.expression = expression
+		return c, nil
+	}
+	
+	switch condition.Field {
+	case "client_id":
+		c.kind = fieldClientID
+	case "resource":
+		c.kind = fieldResource
+	case "ip_address":
+		c.kind = fieldIPAddress
+	case "user_agent":
+		c.kind = fieldUserAgent
+	case "method":
+		c.kind = fieldMethod
+	case "path":
+		c.kind = fieldPath
+	case "timestamp":
+		c.kind = fieldTimestamp
+	default:
+		switch {
+		case strings.HasPrefix(condition.Field, HeaderFieldPrefix):
+			c.kind = fieldHeader
+			c.field = textproto.CanonicalMIMEHeaderKey(strings.TrimPrefix(condition.Field, HeaderFieldPrefix))
+		case strings.HasPrefix(condition.Field, QueryFieldPrefix):
+			c.kind = fieldQuery
+			c.field = strings.TrimPrefix(condition.Field, QueryFieldPrefix)
+		default:
+			c.kind = fieldCustom
+		}
+	}
+	
+	value := condition.Value
+	
+	switch condition.Operator {
+	case "equals":
+		str, isString := value.(string)
+		c.matchString = func(s string) bool { return isString && s == str }
+		c.matchValue = func(v interface{}) bool { return v == value }
+	case "not_equals":
+		str, isString := value.(string)
+		c.matchString = func(s string) bool { return !isString || s != str }
+		c.matchValue = func(v interface{}) bool { return v != value }
+	case "contains", "starts_with", "ends_with":
+		str, ok := value.(string)
+		if !ok {
+			return c, nil
+		}
+		switch condition.Operator {
+		case "contains":
+			c.matchString = func(s string) bool { return containsString(s, str) }
+		case "starts_with":
+			c.matchString = func(s string) bool { return len(s) >= len(str) && s[:len(str)] == str }
+		default:
+			c.matchString = func(s string) bool { return len(s) >= len(str) && s[len(s)-len(str):] == str }
+		}
+		c.matchValue = stringOnly(c.matchString)
+	case "in", "not_in":
+		values, ok := value.([]interface{})
+		if !ok {
+			return c, nil
+		}
+		strs := make(map[string]struct{}, len(values))
+		for _, val := range values {
+			if str, ok := val.(string); ok {
+				strs[str] = struct{}{}
+			}
+		}
+		in := func(v interface{}) bool {
+			for _, val := range values {
+				if v == val {
+					return true
+				}
+			}
+			return false
+		}
+		if condition.Operator == "in" {
+			c.matchString = func(s string) bool { _, ok := strs[s]; return ok }
+			c.matchValue = in
+		} else {
+			c.matchString = func(s string) bool { _, ok := strs[s]; return !ok }
+			c.matchValue = func(v interface{}) bool { return !in(v) }
+		}
+	case "greater_than", "less_than", "greater_equal", "less_equal":
+		// Numeric comparisons never match string fields
+		threshold, ok := toNumber(value)
+		if !ok {
+			return c, nil
+		}
+		operator := condition.Operator
+		c.matchValue = func(v interface{}) bool {
+			n, ok := toNumber(v)
+			if !ok {
+				return false
+			}
+			switch operator {
+			case "greater_than":
+				return n > threshold
+			case "less_than":
+				return n < threshold
+			case "greater_equal":
+				return n >= threshold
+			default:
+				return n <= threshold
+			}
+		}
+	case "exists":
+		c.matchString = func(s string) bool { return s != "" }
+		c.matchValue = func(v interface{}) bool { return v != nil }
+	case "not_exists":
+		c.matchString = func(s string) bool { return s == "" }
+		c.matchValue = func(v interface{}) bool { return v == nil }
+		c.missing = true
+	case "path_prefix":
+		// Matches whole path segments: "/api" matches "/api" and "/api/x", not "/apix"
+		prefix, ok := value.(string)
+		if !ok {
+			return c, fmt.Errorf("path_prefix value must be a string")
+		}
+		prefix = strings.TrimSuffix(prefix, "/")
+		c.matchString = func(s string) bool {
+			if !strings.HasPrefix(s, prefix) {
+				return false
+			}
+			rest := s[len(prefix):]
+			return rest == "" || rest[0] == '/' || rest[0] == '?'
+		}
+		c.matchValue = stringOnly(c.matchString)
+	case "regex":
+		pattern, ok := value.(string)
+		if !ok {
+			return c, fmt.Errorf("regex value must be a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return c, fmt.Errorf("invalid regex %q: %w", pattern, err)
+		}
+		c.matchString = re.MatchString
+		c.matchValue = stringOnly(c.matchString)
+	case "cidr":
+		prefixes, err := parsePrefixes(value)
+		if err != nil {
+			return c, err
+		}
+		c.prefixes = prefixes
+		c.matchString = func(s string) bool {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return false
+			}
+			addr = addr.Unmap()
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(prefixes) > maxScannedPrefixes {
+			// Long lists, such as imported threat feeds, are walked as a trie
+			networks := &networkTrie{}
+			for _, prefix := range prefixes {
+				networks.insert(prefix, 0)
+			}
+			c.matchString = func(s string) bool {
+				addr, err := netip.ParseAddr(s)
+				return err == nil && networks.contains(addr.Unmap())
+			}
+		}
+		c.matchValue = stringOnly(c.matchString)
+	default:
+		return c, fmt.Errorf("unknown operator '%s'", condition.Operator)
+	}
+	
+	return c, nil
+}
+
+// stringOnly adapts a string matcher to values that may not be strings
+func stringOnly(match func(string) bool) func(interface{}) bool {
+	return func(v interface{}) bool {
+		str, ok := v.(string)
+		return ok && match(str)
+	}
+}
+
+// parsePrefixes parses a cidr condition value, either one CIDR or a list of
+// them; bare addresses match only themselves
+func parsePrefixes(value interface{}) ([]netip.Prefix, error) {
+	var raw []string
+	switch v := value.(type) {
+	case string:
+		raw = []string{v}
+	case []string:
+		raw = v
+	case []interface{}:
+		for _, val := range v {
+			str, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("cidr values must be strings")
+			}
+			raw = append(raw, str)
+		}
+	default:
+		return nil, fmt.Errorf("cidr value must be a string or a list of strings")
+	}
+	
+	prefixes := make([]netip.Prefix, 0, len(raw))
+	for _, str := range raw {
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(str)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", str, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	
+	return prefixes, nil
+}
+
+// toNumber converts numeric values to float64
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
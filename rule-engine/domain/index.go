@@ -0,0 +1,271 @@
+package domain
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RuleIndex holds compiled rules in evaluation order together with field
+// indexes, so that a request is only evaluated against rules that can match
+// it. Each rule is indexed by one of its conditions, since all conditions
+// must match; rules without an indexable condition are always candidates
+type RuleIndex struct {
+	rules     []*CompiledRule
+	unindexed []int // Positions of rules that must always be evaluated
+	
+	exact    [fieldTimestamp]map[string][]int // equals / in on built-in string fields
+	prefixes [fieldTimestamp]*prefixTrie      // starts_with on built-in string fields
+	networks *networkTrie                     // cidr on ip_address
+}
+
+// NewRuleIndex indexes compiled rules, which must already be in evaluation order
+func NewRuleIndex(rules []*CompiledRule) *RuleIndex {
+	index := &RuleIndex{
+		rules:    rules,
+		networks: &networkTrie{},
+	}
+	for kind := range index.exact {
+		index.exact[kind] = make(map[string][]int)
+		index.prefixes[kind] = &prefixTrie{}
+	}
+	
+	for position, rule := range rules {
+		if !index.add(position, rule) {
+			index.unindexed = append(index.unindexed, position)
+		}
+	}
+	
+	return index
+}
+
+// add indexes a rule by its most selective condition, reporting whether one
+// was usable. Exact matches are preferred over CIDRs, and CIDRs over prefixes
+func (x *RuleIndex) add(position int, rule *CompiledRule) bool {
+	if !rule.Rule.Enabled {
+		return false
+	}
+	
+	for _, operator := range []string{"equals", "in", "cidr", "starts_with", "path_prefix"} {
+		for i := range rule.conditions {
+			c := &rule.conditions[i]
+			if c.operator != operator || c.kind >= fieldTimestamp {
+				continue
+			}
+			
+			switch operator {
+			case "equals":
+				value, ok := c.value.(string)
+				if !ok {
+					continue
+				}
+				x.exact[c.kind][value] = append(x.exact[c.kind][value], position)
+				return true
+			case "in":
+				values, ok := c.value.([]interface{})
+				if !ok {
+					continue
+				}
+				seen := make(map[string]bool, len(values))
+				for _, val := range values {
+					if value, ok := val.(string); ok && !seen[value] {
+						seen[value] = true
+						x.exact[c.kind][value] = append(x.exact[c.kind][value], position)
+					}
+				}
+				return true
+			case "cidr":
+				if c.kind != fieldIPAddress {
+					continue
+				}
+				for _, prefix := range c.prefixes {
+					x.networks.insert(prefix, position)
+				}
+				return true
+			case "starts_with", "path_prefix":
+				// path_prefix candidates are a superset; evaluation checks the segment boundary
+				value, ok := c.value.(string)
+				if !ok {
+					continue
+				}
+				if operator == "path_prefix" {
+					value = strings.TrimSuffix(value, "/")
+				}
+				x.prefixes[c.kind].insert(value, position)
+				return true
+			}
+		}
+	}
+	
+	return false
+}
+
+// Rules returns every indexed rule in evaluation order
+func (x *RuleIndex) Rules() []*CompiledRule {
+	return x.rules
+}
+
+// positionBuffers holds the buffers that AppendCandidates collects rule
+// positions into
+var positionBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]int, 0, 64)
+		return &buf
+	},
+}
+
+// AppendCandidates appends the rules that may match the context to dst, in
+// evaluation order, and returns the extended slice
+func (x *RuleIndex) AppendCandidates(dst []*CompiledRule, ctx *RuleEvaluationContext) []*CompiledRule {
+	buf := positionBuffers.Get().(*[]int)
+	positions := append((*buf)[:0], x.unindexed...)
+	
+	fields := [fieldTimestamp]string{
+		fieldClientID:  ctx.ClientID,
+		fieldResource:  ctx.Resource,
+		fieldIPAddress: ctx.IPAddress,
+		fieldUserAgent: ctx.UserAgent,
+		fieldMethod:    ctx.Method,
+		fieldPath:      ctx.Path,
+	}
+	for kind, value := range fields {
+		positions = append(positions, x.exact[kind][value]...)
+		positions = x.prefixes[kind].collect(value, positions)
+	}
+	if addr, err := netip.ParseAddr(ctx.IPAddress); err == nil {
+		positions = x.networks.collect(addr.Unmap(), positions)
+	}
+	
+	// A rule can be reached through several entries, e.g. overlapping CIDRs
+	slices.Sort(positions)
+	positions = slices.Compact(positions)
+	
+	for _, position := range positions {
+		dst = append(dst, x.rules[position])
+	}
+	
+	*buf = positions
+	positionBuffers.Put(buf)
+	return dst
+}
+
+// prefixTrie maps string prefixes to rule positions
+type prefixTrie struct {
+	children map[byte]*prefixTrie
+	rules    []int
+}
+
+func (t *prefixTrie) insert(prefix string, position int) {
+	node := t
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*prefixTrie)
+		}
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &prefixTrie{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.rules = append(node.rules, position)
+}
+
+// collect appends the rules of every prefix of value
+func (t *prefixTrie) collect(value string, positions []int) []int {
+	node := t
+	for i := 0; ; i++ {
+		positions = append(positions, node.rules...)
+		if i == len(value) {
+			return positions
+		}
+		next, ok := node.children[value[i]]
+		if !ok {
+			return positions
+		}
+		node = next
+	}
+}
+
+// networkTrie is a binary trie over address bits mapping CIDRs to rule
+// positions. Walking an address visits every CIDR containing it in at most
+// 32 (IPv4) or 128 (IPv6) steps
+type networkTrie struct {
+	v4, v6 networkNode
+}
+
+type networkNode struct {
+	children [2]*networkNode
+	rules    []int
+}
+
+func (t *networkTrie) insert(prefix netip.Prefix, position int) {
+	node := &t.v6
+	if prefix.Addr().Is4() {
+		node = &t.v4
+	}
+	
+	bytes := prefix.Addr().AsSlice()
+	for bit := 0; bit < prefix.Bits(); bit++ {
+		b := addrBit(bytes, bit)
+		if node.children[b] == nil {
+			node.children[b] = &networkNode{}
+		}
+		node = node.children[b]
+	}
+	node.rules = append(node.rules, position)
+}
+
+// collect appends the rules of every CIDR containing addr
+func (t *networkTrie) collect(addr netip.Addr, positions []int) []int {
+	node := &t.v6
+	if addr.Is4() {
+		node = &t.v4
+	}
+	
+	bytes := addr.As16()
+	offset := 0
+	if addr.Is4() {
+		offset = 12 // As16 stores IPv4 in the last four bytes
+	}
+	
+	for bit := 0; node != nil; bit++ {
+		positions = append(positions, node.rules...)
+		if bit == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(bytes[offset:], bit)]
+	}
+	return positions
+}
+
+// contains reports whether any CIDR contains addr
+func (t *networkTrie) contains(addr netip.Addr) bool {
+	node := &t.v6
+	if addr.Is4() {
+		node = &t.v4
+	}
+	
+	bytes := addr.As16()
+	offset := 0
+	if addr.Is4() {
+		offset = 12
+	}
+	
+	for bit := 0; node != nil; bit++ {
+		if len(node.rules) > 0 {
+			return true
+		}
+		if bit == addr.BitLen() {
+			break
+		}
+		node = node.children[addrBit(bytes[offset:], bit)]
+	}
+	return false
+}
+	
+// addrBit returns the bit at index (most significant first) of an address
+func addrBit(bytes []byte, index int) int {
+	return int(bytes[index/8]>>(7-index%8)) & 1
+}
@@ -1,9 +1,16 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
 	"time"
 )
 
+// ErrRuleNotFound is returned for a rule ID that no rule has
+var ErrRuleNotFound = errors.New("rule not found")
+
 // RuleType defines different types of rules
 type RuleType string
 
@@ -19,7 +26,7 @@ const (
 // RuleCondition defines conditions for rule evaluation
 type RuleCondition struct {
 	Field    string      `json:"field"`    // e.g., "client_id", "ip_address", "user_agent"
-	Operator string      `json:"operator"` // e.g., "equals", "contains", "regex", "in"
+	Operator string      `json:"operator"` // e.g., "equals", "contains", "regex", "cidr", "in"
 	Value    interface{} `json:"value"`    // The value to compare against
 }
 
@@ -29,6 +36,77 @@ type RuleAction struct {
 	Parameters map[string]interface{} `json:"parameters"` // Action-specific parameters
 }
 
+// ThrottleDelay returns the delay a throttle action asks for: its "delay"
+// parameter (duration string or seconds), or else one request interval at its
+// "rate" parameter (requests per second)
+func (a RuleAction) ThrottleDelay() (time.Duration, error) {
+	if delay, ok := a.Parameters["delay"]; ok {
+		switch v := delay.(type) {
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return 0, fmt.Errorf("invalid throttle delay %q", v)
+			}
+			return d, nil
+		case int:
+			if v >= 0 {
+				return time.Duration(v) * time.Second, nil
+			}
+		case float64:
+			if v >= 0 {
+				return time.Duration(v * float64(time.Second)), nil
+			}
+		}
+		return 0, fmt.Errorf("invalid throttle delay %v", delay)
+	}
+	
+	if rate, ok := a.Parameters["rate"]; ok {
+		var perSecond float64
+		switch v := rate.(type) {
+		case int:
+			perSecond = float64(v)
+		case float64:
+			perSecond = v
+		}
+		if perSecond <= 0 {
+			return 0, fmt.Errorf("invalid throttle rate %v", rate)
+		}
+		return time.Duration(float64(time.Second) / perSecond), nil
+	}
+	
+	return 0, fmt.Errorf("throttle action requires a delay or rate parameter")
+}
+
+// Challenge kinds of challenge actions
+const (
+	ChallengeJS      = "js"      // A proof of work solved by JavaScript in the browser
+	ChallengeCaptcha = "captcha" // A captcha on a page the client is redirected to
+)
+	
+// ChallengeKind returns the kind of challenge a challenge action asks for:
+// its "kind" parameter, or empty for the server's default
+func (a RuleAction) ChallengeKind() (string, error) {
+	kind, ok := a.Parameters["kind"]
+	if !ok {
+		return "", nil
+	}
+	switch kind {
+	case ChallengeJS, ChallengeCaptcha:
+		return kind.(string), nil
+	}
+	return "", fmt.Errorf("invalid challenge kind %v", kind)
+}
+
+// SampleRate returns the fraction of clients matching the rule the action
+// applies to: its "sample_rate" parameter, or 1 when unset
+func (a RuleAction) SampleRate() (float64, error) {
+	rate, ok := a.Parameters["sample_rate"]
+	if !ok {
+		return 1, nil
+	}
+	return parseSampleRate(rate)
+}
+	
 // Rule represents a business rule in the system
 type Rule struct {
 	ID          string          `json:"id"`
@@ -38,11 +116,18 @@ type Rule struct {
 	Priority    int             `json:"priority"`    // Higher number = higher priority
 	Enabled     bool            `json:"enabled"`
 	Conditions  []RuleCondition `json:"conditions"`  // All conditions must match (AND logic)
+	Expression  string          `json:"expression,omitempty"` // CEL expression that must also hold, alternatively to conditions
 	Actions     []RuleAction    `json:"actions"`
+	SampleRate  *float64        `json:"sample_rate,omitempty"` // Fraction of matching clients the rule applies to, all when unset
 	CreatedAt   time.Time       `json:"created_at"`
 	UpdatedAt   time.Time       `json:"updated_at"`
 	CreatedBy   string          `json:"created_by"`
 	Tags        []string        `json:"tags"`
+	
+	// Who answers for the rule, and who changed it last and why, for audits
+	Owner          string `json:"owner,omitempty"`            // Team or person answerable for the rule
+	ChangeRef      string `json:"change_ref,omitempty"`       // Ticket or change request of the last change
+	LastModifiedBy string `json:"last_modified_by,omitempty"` // Authenticated principal of the last change
 }
 
 // RuleEvaluationContext contains data for rule evaluation
@@ -52,6 +137,10 @@ type RuleEvaluationContext struct {
 	IPAddress   string            `json:"ip_address"`
 	UserAgent   string            `json:"user_agent"`
 	Timestamp   time.Time         `json:"timestamp"`
+	Method      string            `json:"method,omitempty"`
+	Path        string            `json:"path,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`      // Keyed by canonical header name
+	QueryParams map[string]string `json:"query_params,omitempty"`
 	Metadata    map[string]string `json:"metadata"`
 	RequestData map[string]interface{} `json:"request_data"`
 }
@@ -62,138 +151,145 @@ type RuleEvaluationResult struct {
 	RuleName    string                 `json:"rule_name"`
 	Matched     bool                   `json:"matched"`
 	Actions     []RuleAction           `json:"actions"`
-	Metadata    map[string]interface{} `json:"metadata"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	EvaluatedAt time.Time              `json:"evaluated_at"`
 }
 
-// RuleSet represents a collection of rules
-type RuleSet struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Rules       []Rule    `json:"rules"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+// RuleStats contains hit statistics for a rule
+type RuleStats struct {
+	RuleID          string    `json:"rule_id"`
+	Evaluations     int64     `json:"evaluations"`
+	Matches         int64     `json:"matches"`
+	LastMatchedAt   time.Time `json:"last_matched_at,omitempty"`
+	MatchedClients  int64     `json:"matched_clients"` // Approximate distinct client IDs that matched
+	LastEvaluatedAt time.Time `json:"last_evaluated_at,omitempty"`
+	Logs            int64     `json:"logs"`   // log actions fired
+	Alerts          int64     `json:"alerts"` // alert actions fired
 }
 
-// EvaluateRule evaluates a rule against the given context
-func (r *Rule) EvaluateRule(ctx RuleEvaluationContext) RuleEvaluationResult {
-	result := RuleEvaluationResult{
-		RuleID:      r.ID,
-		RuleName:    r.Name,
-		Matched:     false,
-		Actions:     make([]RuleAction, 0),
-		Metadata:    make(map[string]interface{}),
-		EvaluatedAt: time.Now(),
+// ActionEvent describes a log or alert action fired by a matched rule
+type ActionEvent struct {
+	Type      string            `json:"type"` // "log" or "alert"
+	RuleID    string            `json:"rule_id"`
+	RuleName  string            `json:"rule_name"`
+	Level     string            `json:"level,omitempty"`    // Log actions
+	Severity  string            `json:"severity,omitempty"` // Alert actions
+	Message   string            `json:"message"`
+	DedupeKey string            `json:"dedupe_key,omitempty"` // Alerts with the same key are repeats
+	ClientID  string            `json:"client_id"`
+	Resource  string            `json:"resource"`
+	IPAddress string            `json:"ip_address"`
+	UserAgent string            `json:"user_agent"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// NewActionEvent builds the event for a log or alert action of a matched
+// rule. Parameters: "message" (default: the rule name), "level" for log
+// actions (default "info"), and for alerts "severity" (default "warning")
+// and "dedupe_by", the fields whose values make an alert distinct (default
+// client_id)
+func NewActionEvent(result RuleEvaluationResult, action RuleAction, ctx RuleEvaluationContext) ActionEvent {
+	event := ActionEvent{
+		Type:      action.Type,
+		RuleID:    result.RuleID,
+		RuleName:  result.RuleName,
+		Message:   stringParameter(action, "message", result.RuleName),
+		ClientID:  ctx.ClientID,
+		Resource:  ctx.Resource,
+		IPAddress: ctx.IPAddress,
+		UserAgent: ctx.UserAgent,
+		Metadata:  ctx.Metadata,
+		Time:      result.EvaluatedAt,
 	}
 	
-	if !r.Enabled {
-		return result
+	if action.Type == "log" {
+		event.Level = stringParameter(action, "level", "info")
+		return event
 	}
 	
-	// Evaluate all conditions (AND logic)
-	matched := true
-	for _, condition := range r.Conditions {
-		if !r.evaluateCondition(condition, ctx) {
-			matched = false
-			break
+	event.Severity = stringParameter(action, "severity", "warning")
+	
+	dedupeBy := []string{"client_id"}
+	switch v := action.Parameters["dedupe_by"].(type) {
+	case string:
+		dedupeBy = []string{v}
+	case []interface{}:
+		dedupeBy = dedupeBy[:0]
+		for _, field := range v {
+			if name, ok := field.(string); ok {
+				dedupeBy = append(dedupeBy, name)
+			}
 		}
 	}
 	
-	result.Matched = matched
-	if matched {
-		result.Actions = r.Actions
+	parts := []string{result.RuleID}
+	for _, field := range dedupeBy {
+		parts = append(parts, field+"="+ctx.fieldString(field))
 	}
+	event.DedupeKey = strings.Join(parts, "|")
 	
-	return result
+	return event
 }
 
-// evaluateCondition evaluates a single condition
-func (r *Rule) evaluateCondition(condition RuleCondition, ctx RuleEvaluationContext) bool {
-	var fieldValue interface{}
-	
-	// Get field value from context
-	switch condition.Field {
+// fieldString returns a context field as a string, for built-in fields,
+// metadata and request data
+func (ctx RuleEvaluationContext) fieldString(field string) string {
+	switch field {
 	case "client_id":
-		fieldValue = ctx.ClientID
+		return ctx.ClientID
 	case "resource":
-		fieldValue = ctx.Resource
+		return ctx.Resource
 	case "ip_address":
-		fieldValue = ctx.IPAddress
+		return ctx.IPAddress
 	case "user_agent":
-		fieldValue = ctx.UserAgent
-	case "timestamp":
-		fieldValue = ctx.Timestamp
+		return ctx.UserAgent
+	case "method":
+		return ctx.Method
+	case "path":
+		return ctx.Path
 	default:
-		// Check metadata
-		if val, exists := ctx.Metadata[condition.Field]; exists {
-			fieldValue = val
-		} else if val, exists := ctx.RequestData[condition.Field]; exists {
-			fieldValue = val
-		} else {
-			return false // Field not found
-		}
-	}
-	
-	// Evaluate based on operator
-	switch condition.Operator {
-	case "equals":
-		return fieldValue == condition.Value
-	case "not_equals":
-		return fieldValue != condition.Value
-	case "contains":
-		if str, ok := fieldValue.(string); ok {
-			if substr, ok := condition.Value.(string); ok {
-				return containsString(str, substr)
-			}
+		switch {
+		case strings.HasPrefix(field, HeaderFieldPrefix):
+			return ctx.Headers[textproto.CanonicalMIMEHeaderKey(strings.TrimPrefix(field, HeaderFieldPrefix))]
+		case strings.HasPrefix(field, QueryFieldPrefix):
+			return ctx.QueryParams[strings.TrimPrefix(field, QueryFieldPrefix)]
 		}
-		return false
-	case "starts_with":
-		if str, ok := fieldValue.(string); ok {
-			if prefix, ok := condition.Value.(string); ok {
-				return len(str) >= len(prefix) && str[:len(prefix)] == prefix
-			}
+		if value, ok := ctx.Metadata[field]; ok {
+			return value
 		}
-		return false
-	case "ends_with":
-		if str, ok := fieldValue.(string); ok {
-			if suffix, ok := condition.Value.(string); ok {
-				return len(str) >= len(suffix) && str[len(str)-len(suffix):] == suffix
-			}
+		if value, ok := ctx.RequestData[field]; ok {
+			return fmt.Sprint(value)
 		}
-		return false
-	case "in":
-		if values, ok := condition.Value.([]interface{}); ok {
-			for _, val := range values {
-				if fieldValue == val {
-					return true
-				}
-			}
-		}
-		return false
-	case "not_in":
-		if values, ok := condition.Value.([]interface{}); ok {
-			for _, val := range values {
-				if fieldValue == val {
-					return false
-				}
-			}
-			return true
-		}
-		return false
-	case "greater_than":
-		return compareNumbers(fieldValue, condition.Value) > 0
-	case "less_than":
-		return compareNumbers(fieldValue, condition.Value) < 0
-	case "greater_equal":
-		return compareNumbers(fieldValue, condition.Value) >= 0
-	case "less_equal":
-		return compareNumbers(fieldValue, condition.Value) <= 0
-	default:
-		return false
+		return ""
 	}
 }
 
+// stringParameter returns a string action parameter, or fallback when unset
+func stringParameter(action RuleAction, name, fallback string) string {
+	if value, ok := action.Parameters[name].(string); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// RuleSet represents a collection of rules
+type RuleSet struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Rules       []Rule    `json:"rules"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// EvaluateRule evaluates a rule against the given context. Callers
+// evaluating the same rule repeatedly should use CompileRule instead
+func (r *Rule) EvaluateRule(ctx RuleEvaluationContext) RuleEvaluationResult {
+	compiled, _ := CompileRule(*r)
+	return compiled.Evaluate(ctx)
+}
+
 // Helper function to check if string contains substring
 func containsString(str, substr string) bool {
 	return len(str) >= len(substr) && str != substr && findSubstring(str, substr) != -1
@@ -215,48 +311,3 @@ func findSubstring(str, substr string) int {
 	}
 	return -1
 }
-
-// Helper function to compare numbers
-func compareNumbers(a, b interface{}) int {
-	var aVal, bVal float64
-	var ok bool
-	
-	// Convert a to float64
-	switch v := a.(type) {
-	case int:
-		aVal = float64(v)
-	case int64:
-		aVal = float64(v)
-	case float64:
-		aVal = v
-	case float32:
-		aVal = float64(v)
-	default:
-		return 0 // Cannot compare
-	}
-	
-	// Convert b to float64
-	switch v := b.(type) {
-	case int:
-		bVal = float64(v)
-	case int64:
-		bVal = float64(v)
-	case float64:
-		bVal = v
-	case float32:
-		bVal = float64(v)
-	default:
-		return 0 // Cannot compare
-	}
-	
-	if !ok {
-		return 0
-	}
-	
-	if aVal > bVal {
-		return 1
-	} else if aVal < bVal {
-		return -1
-	}
-	return 0
-}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// SampleBucket deterministically places a client in [0, 1) for the rule with
+// the given ID. A client is sampled at a rate while its bucket is below the
+// rate, so each client is either always or never sampled, and raising the
+// rate only adds clients.
+func SampleBucket(ruleID, clientKey string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(ruleID))
+	h.Write([]byte{0})
+	h.Write([]byte(clientKey))
+
+	// FNV barely mixes the last bytes, in which sequential client IDs
+	// differ, so the hash is finalized like MurmurHash3's
+	sum := h.Sum64()
+	sum ^= sum >> 33
+	sum *= 0xff51afd7ed558ccd
+	sum ^= sum >> 33
+	sum *= 0xc4ceb9fe1a85ec53
+	sum ^= sum >> 33
+	return float64(sum>>11) / (1 << 53)
+}
+
+// Sampled reports whether the client of ctx is sampled by the rule with the
+// given ID at rate. Clients are told apart by client ID, or by IP address
+// when the request has none.
+func Sampled(ruleID string, rate float64, ctx *RuleEvaluationContext) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	key := ctx.ClientID
+	if key == "" {
+		key = ctx.IPAddress
+	}
+	return SampleBucket(ruleID, key) < rate
+}
+
+// parseSampleRate reads a sample rate, a fraction between 0 and 1
+func parseSampleRate(value interface{}) (float64, error) {
+	var rate float64
+	switch v := value.(type) {
+	case float64:
+		rate = v
+	case int:
+		rate = float64(v)
+	default:
+		return 0, fmt.Errorf("invalid sample rate %v", value)
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("sample rate %v is not between 0 and 1", value)
+	}
+	return rate, nil
+}
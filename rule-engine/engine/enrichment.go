@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+)
+
+// Enricher looks up extra facts about a request before rules are evaluated
+// against it, such as the country of its IP address or the reputation of
+// its client. The fields it returns are set in the request data of the
+// evaluation context, so rule conditions can name them like any custom
+// field. Enrichers must not modify the context they are given.
+type Enricher interface {
+	Name() string
+	Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error)
+}
+
+// EnrichmentChain runs enrichers in order, each bounded by its own timeout,
+// so later enrichers see the fields of earlier ones. An enricher that fails
+// or runs out of time is skipped: rules then see the request without its
+// fields rather than the request failing.
+type EnrichmentChain struct {
+	steps []enrichmentStep
+}
+
+// enrichmentStep is an enricher with its timeout
+type enrichmentStep struct {
+	enricher Enricher
+	timeout  time.Duration
+}
+
+// enrichment is the outcome of one enricher
+type enrichment struct {
+	fields map[string]interface{}
+	err    error
+}
+
+// NewEnrichmentChain creates an empty enrichment chain
+func NewEnrichmentChain() *EnrichmentChain {
+	return &EnrichmentChain{}
+}
+
+// Add appends an enricher to the chain, given at most timeout per request.
+// A zero timeout leaves it bounded only by the request's context.
+func (c *EnrichmentChain) Add(enricher Enricher, timeout time.Duration) *EnrichmentChain {
+	c.steps = append(c.steps, enrichmentStep{enricher: enricher, timeout: timeout})
+	return c
+}
+
+// Enrichers returns the names of the enrichers in the order they run
+func (c *EnrichmentChain) Enrichers() []string {
+	names := make([]string, 0, len(c.steps))
+	for _, step := range c.steps {
+		names = append(names, step.enricher.Name())
+	}
+	return names
+}
+
+// Enrich returns evalCtx with the fields of every enricher that answered in
+// time. Enriched fields replace metadata of the same name, so a client
+// cannot supply its own, and the caller's maps are left untouched.
+func (c *EnrichmentChain) Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) domain.RuleEvaluationContext {
+	if len(c.steps) == 0 {
+		return evalCtx
+	}
+
+	evalCtx = withOwnMaps(evalCtx)
+	for _, step := range c.steps {
+		fields, err := step.run(ctx, evalCtx)
+		if err != nil {
+			fmt.Printf("Error enriching request with %s: %v\n", step.enricher.Name(), err)
+			continue
+		}
+		for field, value := range fields {
+			delete(evalCtx.Metadata, field)
+			evalCtx.RequestData[field] = value
+		}
+	}
+
+	return evalCtx
+}
+
+// run calls the enricher on a snapshot of evalCtx, and gives up once the
+// timeout passes even if the enricher ignores its context
+func (s enrichmentStep) run(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	// The enricher may still be reading after we give up, so it gets maps
+	// no later step writes to
+	snapshot := withOwnMaps(evalCtx)
+	done := make(chan enrichment, 1)
+	go func() {
+		fields, err := s.enricher.Enrich(ctx, snapshot)
+		done <- enrichment{fields: fields, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.fields, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// withOwnMaps returns evalCtx with copies of its metadata and request data
+func withOwnMaps(evalCtx domain.RuleEvaluationContext) domain.RuleEvaluationContext {
+	metadata := make(map[string]string, len(evalCtx.Metadata))
+	for key, value := range evalCtx.Metadata {
+		metadata[key] = value
+	}
+	requestData := make(map[string]interface{}, len(evalCtx.RequestData))
+	for key, value := range evalCtx.RequestData {
+		requestData[key] = value
+	}
+	evalCtx.Metadata = metadata
+	evalCtx.RequestData = requestData
+	return evalCtx
+}
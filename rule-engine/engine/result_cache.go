@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+)
+
+// ResultCache remembers the rule results of recent requests for a short
+// time, so a burst of identical requests, e.g. from one client hammering
+// one endpoint, is evaluated and enriched once. Entries are keyed by the
+// rule set version and a fingerprint of the whole request, so any rule
+// change invalidates them. Only the request's timestamp is left out of the
+// fingerprint: time-based conditions may be up to the ttl late.
+type ResultCache struct {
+	ttl        time.Duration
+	maxEntries int
+	seeds      [2]maphash.Seed
+
+	mutex   sync.Mutex
+	version uint64
+	entries map[resultCacheKey]resultCacheEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// resultCacheKey identifies the results of one request against one rule
+// set; the fingerprint is 128 bits, so distinct requests do not collide
+type resultCacheKey struct {
+	version     uint64
+	ruleType    domain.RuleType // Empty for all rules
+	fingerprint [2]uint64
+}
+
+// resultCacheEntry is the results of a request with the fields it was
+// enriched with, so hits replay side effects with the same context
+type resultCacheEntry struct {
+	results     []domain.RuleEvaluationResult
+	metadata    map[string]string
+	requestData map[string]interface{}
+	expiresAt   time.Time
+}
+
+// ResultCacheStats reports how well the result cache works
+type ResultCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// NewResultCache creates a cache holding results for ttl, of at most
+// maxEntries requests
+func NewResultCache(ttl time.Duration, maxEntries int) *ResultCache {
+	return &ResultCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		seeds:      [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+		entries:    make(map[resultCacheKey]resultCacheEntry),
+	}
+}
+
+// key fingerprints a request as it arrived, before enrichment
+func (c *ResultCache) key(version uint64, ruleType domain.RuleType, evalCtx domain.RuleEvaluationContext) resultCacheKey {
+	key := resultCacheKey{version: version, ruleType: ruleType}
+	for i, seed := range c.seeds {
+		var h maphash.Hash
+		h.SetSeed(seed)
+		writeFingerprint(&h, evalCtx)
+		key.fingerprint[i] = h.Sum64()
+	}
+	return key
+}
+
+// get returns the unexpired entry for key
+func (c *ResultCache) get(key resultCacheKey, now time.Time) (resultCacheEntry, bool) {
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return entry, ok
+}
+
+// put stores the results of a request, dropping every entry of older rule
+// sets, and all entries when the cache is full
+func (c *ResultCache) put(key resultCacheKey, entry resultCacheEntry, now time.Time) {
+	entry.expiresAt = now.Add(c.ttl)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch {
+	case key.version > c.version:
+		c.version = key.version
+		c.entries = make(map[resultCacheKey]resultCacheEntry)
+	case key.version < c.version:
+		return // Evaluated against a rule set that was replaced meanwhile
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			c.entries = make(map[resultCacheKey]resultCacheEntry)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// Stats returns the number of cached requests and the hits and misses so far
+func (c *ResultCache) Stats() ResultCacheStats {
+	c.mutex.Lock()
+	entries := len(c.entries)
+	c.mutex.Unlock()
+
+	return ResultCacheStats{
+		Entries: entries,
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
+
+// writeFingerprint writes every field of a request but its timestamp,
+// each prefixed with its length so that no two requests write the same
+// bytes
+func writeFingerprint(h *maphash.Hash, evalCtx domain.RuleEvaluationContext) {
+	for _, field := range []string{evalCtx.ClientID, evalCtx.Resource, evalCtx.IPAddress, evalCtx.UserAgent, evalCtx.Method, evalCtx.Path} {
+		writeFingerprintString(h, field)
+	}
+	writeFingerprintStrings(h, evalCtx.Headers)
+	writeFingerprintStrings(h, evalCtx.QueryParams)
+	writeFingerprintStrings(h, evalCtx.Metadata)
+
+	keys := make([]string, 0, len(evalCtx.RequestData))
+	for key := range evalCtx.RequestData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeFingerprintLength(h, len(keys))
+	for _, key := range keys {
+		value := evalCtx.RequestData[key]
+		writeFingerprintString(h, key)
+		writeFingerprintString(h, fmt.Sprintf("%T:%v", value, value))
+	}
+}
+
+// writeFingerprintStrings writes a map in key order
+func writeFingerprintStrings(h *maphash.Hash, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeFingerprintLength(h, len(keys))
+	for _, key := range keys {
+		writeFingerprintString(h, key)
+		writeFingerprintString(h, m[key])
+	}
+}
+
+// writeFingerprintString writes a string after its length
+func writeFingerprintString(h *maphash.Hash, s string) {
+	writeFingerprintLength(h, len(s))
+	h.WriteString(s)
+}
+
+// writeFingerprintLength writes a length
+func writeFingerprintLength(h *maphash.Hash, n int) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(n))
+	h.Write(buf[:])
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NickChunglolz/rule-engine/domain"
@@ -13,11 +15,30 @@ import (
 type RuleEngine struct {
 	ruleRepository RuleRepository
 	eventPublisher EventPublisher
+	statsCollector StatsCollector
+	dispatcher     ActionDispatcher
+	enrichment     *EnrichmentChain
+	resultCache    *ResultCache
+	principal      PrincipalFunc
+	
+	// Compiled rule set cache, rebuilt when the rules version changes
+	ruleSet      atomic.Pointer[compiledRuleSet]
+	ruleSetMutex sync.Mutex
+	generation   atomic.Uint64 // Bumped by rule changes made through the engine
+}
+
+// compiledRuleSet is an immutable snapshot of the active rules, compiled,
+// sorted by priority (higher priority first) and indexed by field
+type compiledRuleSet struct {
+	version uint64
+	all     *domain.RuleIndex
+	byType  map[domain.RuleType]*domain.RuleIndex
 }
 
 // RuleRepository defines the interface for rule storage
 type RuleRepository interface {
 	GetActiveRules(ctx context.Context) ([]domain.Rule, error)
+	ListRules(ctx context.Context) ([]domain.Rule, error)
 	GetRulesByType(ctx context.Context, ruleType domain.RuleType) ([]domain.Rule, error)
 	GetRulesByTags(ctx context.Context, tags []string) ([]domain.Rule, error)
 	SaveRule(ctx context.Context, rule domain.Rule) error
@@ -26,12 +47,51 @@ type RuleRepository interface {
 	GetRuleByID(ctx context.Context, ruleID string) (*domain.Rule, error)
 }
 
+// Actions of UpdateRulesByTags
+const (
+	BulkEnable  = "enable"
+	BulkDisable = "disable"
+	BulkDelete  = "delete"
+)
+
+// RuleFilter selects the rules listed by ListRules
+type RuleFilter struct {
+	Type    domain.RuleType // Rules of any type when empty
+	Tags    []string        // Rules with any of the tags; all rules when empty
+	Enabled *bool           // Only enabled or only disabled rules when set
+	After   string          // Lists the rules whose IDs sort after this one
+	Limit   int             // At most this many rules; all of them when zero
+}
+
 // EventPublisher defines the interface for publishing rule evaluation events
 type EventPublisher interface {
 	PublishRuleEvaluated(ctx context.Context, result domain.RuleEvaluationResult) error
 	PublishRuleMatched(ctx context.Context, result domain.RuleEvaluationResult) error
 }
 
+// VersionedRuleRepository is implemented by repositories that report a
+// version changing on every rule change, so the engine notices changes
+// made without going through it
+type VersionedRuleRepository interface {
+	RulesVersion() uint64
+}
+
+// StatsCollector defines the interface for recording rule hit statistics
+type StatsCollector interface {
+	RecordEvaluation(ctx context.Context, ruleID, clientID string, matched bool, at time.Time) error
+	RecordAction(ctx context.Context, ruleID, actionType string, at time.Time) error
+	GetRuleStats(ctx context.Context, ruleID string) (*domain.RuleStats, error)
+}
+
+// ActionDispatcher carries out log and alert actions of matched rules
+type ActionDispatcher interface {
+	Dispatch(ctx context.Context, event domain.ActionEvent) error
+}
+
+// PrincipalFunc returns the authenticated principal a context carries, or
+// empty when the caller is unknown
+type PrincipalFunc func(ctx context.Context) string
+
 // NewRuleEngine creates a new rule engine
 func NewRuleEngine(ruleRepository RuleRepository, eventPublisher EventPublisher) *RuleEngine {
 	return &RuleEngine{
@@ -40,25 +100,152 @@ func NewRuleEngine(ruleRepository RuleRepository, eventPublisher EventPublisher)
 	}
 }
 
+// WithStatsCollector records per-rule hit statistics on every evaluation
+func (e *RuleEngine) WithStatsCollector(statsCollector StatsCollector) *RuleEngine {
+	e.statsCollector = statsCollector
+	return e
+}
+
+// WithActionDispatcher carries out log and alert actions through dispatcher
+func (e *RuleEngine) WithActionDispatcher(dispatcher ActionDispatcher) *RuleEngine {
+	e.dispatcher = dispatcher
+	return e
+}
+
+// WithEnrichment runs chain on every request before rules are evaluated,
+// so rules can condition on the fields its enrichers add
+func (e *RuleEngine) WithEnrichment(chain *EnrichmentChain) *RuleEngine {
+	e.enrichment = chain
+	return e
+}
+
+// WithResultCache reuses the results of identical requests held in cache
+func (e *RuleEngine) WithResultCache(cache *ResultCache) *RuleEngine {
+	e.resultCache = cache
+	return e
+}
+
+// WithPrincipal attributes every rule created or updated through the engine
+// to the principal of its context: the rule's last modifier becomes the
+// principal, and a new rule's creator too. Rules keep the creator they were
+// stored with, and new rules written by unknown callers the one given.
+func (e *RuleEngine) WithPrincipal(principal PrincipalFunc) *RuleEngine {
+	e.principal = principal
+	return e
+}
+
 // EvaluateRules evaluates all active rules against the given context
 func (e *RuleEngine) EvaluateRules(ctx context.Context, evalCtx domain.RuleEvaluationContext) ([]domain.RuleEvaluationResult, error) {
-	// Get all active rules
-	rules, err := e.ruleRepository.GetActiveRules(ctx)
+	ruleSet, err := e.compiledRules(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get active rules: %w", err)
+		return nil, err
 	}
 	
-	// Sort rules by priority (higher priority first)
-	sort.Slice(rules, func(i, j int) bool {
-		return rules[i].Priority > rules[j].Priority
-	})
+	return e.evaluateIndex(ctx, ruleSet.version, "", ruleSet.all, evalCtx)
+}
+
+// EvaluateRulesByType evaluates rules of a specific type
+func (e *RuleEngine) EvaluateRulesByType(ctx context.Context, ruleType domain.RuleType, evalCtx domain.RuleEvaluationContext) ([]domain.RuleEvaluationResult, error) {
+	ruleSet, err := e.compiledRules(ctx)
+	if err != nil {
+		return nil, err
+	}
 	
-	var results []domain.RuleEvaluationResult
+	index, ok := ruleSet.byType[ruleType]
+	if !ok {
+		return nil, nil
+	}
+	return e.evaluateIndex(ctx, ruleSet.version, ruleType, index, evalCtx)
+}
+
+// evaluateIndex enriches the context and evaluates the candidate rules of
+// index, or replays the cached results of an identical request. It fails
+// when ctx is done once enriched, such as when the caller's deadline passed
+// while enrichers were looking the request up, before any rule is evaluated
+// or its actions fired.
+func (e *RuleEngine) evaluateIndex(ctx context.Context, version uint64, ruleType domain.RuleType, index *domain.RuleIndex, evalCtx domain.RuleEvaluationContext) ([]domain.RuleEvaluationResult, error) {
+	if e.resultCache == nil {
+		evalCtx = e.enrich(ctx, evalCtx)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return e.evaluateCandidates(ctx, index, evalCtx), nil
+	}
+	
+	now := time.Now()
+	key := e.resultCache.key(version, ruleType, evalCtx)
+	if entry, ok := e.resultCache.get(key, now); ok {
+		evalCtx.Metadata = entry.metadata
+		evalCtx.RequestData = entry.requestData
+		results := make([]domain.RuleEvaluationResult, len(entry.results))
+		for i, result := range entry.results {
+			result.EvaluatedAt = now
+			results[i] = result
+		}
+		e.report(ctx, results, evalCtx)
+		return results, nil
+	}
 	
-	// Evaluate each rule
+	evalCtx = e.enrich(ctx, evalCtx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := e.evaluateCandidates(ctx, index, evalCtx)
+	e.resultCache.put(key, resultCacheEntry{
+		results:     append([]domain.RuleEvaluationResult(nil), results...),
+		metadata:    evalCtx.Metadata,
+		requestData: evalCtx.RequestData,
+	}, now)
+	return results, nil
+}
+
+// enrich adds the fields of the enrichment chain, if any, to evalCtx
+func (e *RuleEngine) enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) domain.RuleEvaluationContext {
+	if e.enrichment == nil {
+		return evalCtx
+	}
+	return e.enrichment.Enrich(ctx, evalCtx)
+}
+
+// candidateBuffers holds the buffers that evaluateCandidates collects
+// candidate rules into
+var candidateBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]*domain.CompiledRule, 0, 64)
+		return &buf
+	},
+}
+
+// evaluateCandidates evaluates the candidate rules of index, collected into
+// a pooled buffer, so that only the results returned are allocated
+func (e *RuleEngine) evaluateCandidates(ctx context.Context, index *domain.RuleIndex, evalCtx domain.RuleEvaluationContext) []domain.RuleEvaluationResult {
+	buf := candidateBuffers.Get().(*[]*domain.CompiledRule)
+	candidates := index.AppendCandidates((*buf)[:0], &evalCtx)
+	results := e.evaluate(ctx, candidates, evalCtx)
+	
+	// The buffer must not keep rules of replaced rule sets alive
+	clear(candidates)
+	*buf = candidates[:0]
+	candidateBuffers.Put(buf)
+	return results
+}
+
+// evaluate evaluates compiled rules in order, recording and publishing each result
+func (e *RuleEngine) evaluate(ctx context.Context, rules []*domain.CompiledRule, evalCtx domain.RuleEvaluationContext) []domain.RuleEvaluationResult {
+	results := make([]domain.RuleEvaluationResult, 0, len(rules))
 	for _, rule := range rules {
-		result := rule.EvaluateRule(evalCtx)
-		results = append(results, result)
+		results = append(results, rule.Evaluate(evalCtx))
+	}
+	
+	e.report(ctx, results, evalCtx)
+	return results
+}
+
+// report records and publishes results and fires the actions of matched
+// rules, whether the results were just evaluated or cached
+func (e *RuleEngine) report(ctx context.Context, results []domain.RuleEvaluationResult, evalCtx domain.RuleEvaluationContext) {
+	for _, result := range results {
+		e.recordEvaluation(ctx, result, evalCtx.ClientID)
 		
 		// Publish evaluation event
 		if err := e.eventPublisher.PublishRuleEvaluated(ctx, result); err != nil {
@@ -66,53 +253,180 @@ func (e *RuleEngine) EvaluateRules(ctx context.Context, evalCtx domain.RuleEvalu
 			fmt.Printf("Error publishing rule evaluated event: %v\n", err)
 		}
 		
-		// If rule matched, publish matched event
+		// If rule matched, publish matched event and fire its side effects
 		if result.Matched {
 			if err := e.eventPublisher.PublishRuleMatched(ctx, result); err != nil {
 				// Log error but continue evaluation
 				fmt.Printf("Error publishing rule matched event: %v\n", err)
 			}
+			e.fireActions(ctx, result, evalCtx)
 		}
 	}
-	
-	return results, nil
 }
 
-// EvaluateRulesByType evaluates rules of a specific type
-func (e *RuleEngine) EvaluateRulesByType(ctx context.Context, ruleType domain.RuleType, evalCtx domain.RuleEvaluationContext) ([]domain.RuleEvaluationResult, error) {
-	rules, err := e.ruleRepository.GetRulesByType(ctx, ruleType)
+// compiledRules returns the cached compiled rule set, rebuilding it from the
+// repository when the rules have changed since it was built
+func (e *RuleEngine) compiledRules(ctx context.Context) (*compiledRuleSet, error) {
+	version := e.rulesVersion()
+	if ruleSet := e.ruleSet.Load(); ruleSet != nil && ruleSet.version == version {
+		return ruleSet, nil
+	}
+	
+	e.ruleSetMutex.Lock()
+	defer e.ruleSetMutex.Unlock()
+	
+	// Another caller may have rebuilt the set while we waited
+	version = e.rulesVersion()
+	if ruleSet := e.ruleSet.Load(); ruleSet != nil && ruleSet.version == version {
+		return ruleSet, nil
+	}
+	
+	rules, err := e.ruleRepository.GetActiveRules(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get rules by type: %w", err)
+		return nil, fmt.Errorf("failed to get active rules: %w", err)
 	}
 	
-	// Sort rules by priority
+	// Sort rules by priority (higher priority first)
 	sort.Slice(rules, func(i, j int) bool {
-		return rules[i].Priority > rules[j].Priority
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
 	})
 	
-	var results []domain.RuleEvaluationResult
-	
+	all := make([]*domain.CompiledRule, 0, len(rules))
+	byType := make(map[domain.RuleType][]*domain.CompiledRule)
 	for _, rule := range rules {
-		if !rule.Enabled {
+		compiled, err := domain.CompileRule(rule)
+		if err != nil {
+			fmt.Printf("Error compiling rule %s: %v\n", rule.ID, err)
+		}
+		all = append(all, compiled)
+		byType[rule.Type] = append(byType[rule.Type], compiled)
+	}
+	
+	ruleSet := &compiledRuleSet{
+		version: version,
+		all:     domain.NewRuleIndex(all),
+		byType:  make(map[domain.RuleType]*domain.RuleIndex, len(byType)),
+	}
+	for ruleType, typed := range byType {
+		ruleSet.byType[ruleType] = domain.NewRuleIndex(typed)
+	}
+	
+	e.ruleSet.Store(ruleSet)
+	return ruleSet, nil
+}
+
+// Warm compiles the rule set ahead of the first evaluation, so that the
+// first requests do not wait for every rule to compile, and returns the
+// number of active rules
+func (e *RuleEngine) Warm(ctx context.Context) (int, error) {
+	ruleSet, err := e.compiledRules(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(ruleSet.all.Rules()), nil
+}
+
+// rulesVersion combines the engine's own change counter with the
+// repository's version, if it reports one. Both only grow, so the sum
+// changes whenever either does
+func (e *RuleEngine) rulesVersion() uint64 {
+	version := e.generation.Load()
+	if versioned, ok := e.ruleRepository.(VersionedRuleRepository); ok {
+		version += versioned.RulesVersion()
+	}
+	return version
+}
+
+// invalidateRules marks the compiled rule set as stale
+func (e *RuleEngine) invalidateRules() {
+	e.generation.Add(1)
+}
+
+// fireActions dispatches the log and alert actions of a matched rule and
+// counts them in the rule's stats
+func (e *RuleEngine) fireActions(ctx context.Context, result domain.RuleEvaluationResult, evalCtx domain.RuleEvaluationContext) {
+	for _, action := range result.Actions {
+		if action.Type != "log" && action.Type != "alert" {
 			continue
 		}
 		
-		result := rule.EvaluateRule(evalCtx)
-		results = append(results, result)
-		
-		// Publish events
-		if err := e.eventPublisher.PublishRuleEvaluated(ctx, result); err != nil {
-			fmt.Printf("Error publishing rule evaluated event: %v\n", err)
+		if e.dispatcher != nil {
+			event := domain.NewActionEvent(result, action, evalCtx)
+			if err := e.dispatcher.Dispatch(ctx, event); err != nil {
+				fmt.Printf("Error dispatching %s action of rule %s: %v\n", action.Type, result.RuleID, err)
+			}
 		}
-		
-		if result.Matched {
-			if err := e.eventPublisher.PublishRuleMatched(ctx, result); err != nil {
-				fmt.Printf("Error publishing rule matched event: %v\n", err)
+		if e.statsCollector != nil {
+			if err := e.statsCollector.RecordAction(ctx, result.RuleID, action.Type, result.EvaluatedAt); err != nil {
+				fmt.Printf("Error recording rule stats: %v\n", err)
 			}
 		}
 	}
+}
+
+// recordEvaluation feeds an evaluation result to the stats collector
+func (e *RuleEngine) recordEvaluation(ctx context.Context, result domain.RuleEvaluationResult, clientID string) {
+	if e.statsCollector == nil {
+		return
+	}
+	if err := e.statsCollector.RecordEvaluation(ctx, result.RuleID, clientID, result.Matched, result.EvaluatedAt); err != nil {
+		fmt.Printf("Error recording rule stats: %v\n", err)
+	}
+}
+
+// GetRuleStats returns hit statistics for a rule
+func (e *RuleEngine) GetRuleStats(ctx context.Context, ruleID string) (*domain.RuleStats, error) {
+	if _, err := e.ruleRepository.GetRuleByID(ctx, ruleID); err != nil {
+		return nil, err
+	}
+	if e.statsCollector == nil {
+		return nil, fmt.Errorf("rule statistics are not enabled")
+	}
+	return e.statsCollector.GetRuleStats(ctx, ruleID)
+}
+
+// ResultCacheStats returns the statistics of the result cache, or nil when
+// results are not cached
+func (e *RuleEngine) ResultCacheStats() *ResultCacheStats {
+	if e.resultCache == nil {
+		return nil
+	}
+	stats := e.resultCache.Stats()
+	return &stats
+}
+
+// ListRuleStats returns hit statistics for every active rule, least matched
+// first, so dead rules lead the list and hot rules close it
+func (e *RuleEngine) ListRuleStats(ctx context.Context) ([]domain.RuleStats, error) {
+	if e.statsCollector == nil {
+		return nil, fmt.Errorf("rule statistics are not enabled")
+	}
 	
-	return results, nil
+	rules, err := e.ruleRepository.GetActiveRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get active rules: %w", err)
+	}
+	
+	stats := make([]domain.RuleStats, 0, len(rules))
+	for _, rule := range rules {
+		ruleStats, err := e.statsCollector.GetRuleStats(ctx, rule.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get stats for rule %s: %w", rule.ID, err)
+		}
+		stats = append(stats, *ruleStats)
+	}
+	
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Matches != stats[j].Matches {
+			return stats[i].Matches < stats[j].Matches
+		}
+		return stats[i].RuleID < stats[j].RuleID
+	})
+	
+	return stats, nil
 }
 
 // GetMatchedActions returns all actions from matched rules
@@ -159,7 +473,33 @@ func (e *RuleEngine) GetRateLimitActions(results []domain.RuleEvaluationResult)
 	return rateLimitActions
 }
 
-// CreateRule creates a new rule
+// GetThrottleDelay returns the longest delay requested by throttle actions of
+// matched rules, or 0 when none matched
+func (e *RuleEngine) GetThrottleDelay(results []domain.RuleEvaluationResult) time.Duration {
+	var delay time.Duration
+	
+	for _, result := range results {
+		if result.Matched {
+			for _, action := range result.Actions {
+				if action.Type != "throttle" {
+					continue
+				}
+				d, err := action.ThrottleDelay()
+				if err != nil {
+					fmt.Printf("Error reading throttle action of rule %s: %v\n", result.RuleID, err)
+					continue
+				}
+				if d > delay {
+					delay = d
+				}
+			}
+		}
+	}
+	
+	return delay
+}
+
+// CreateRule creates a new rule, or replaces the rule with its ID
 func (e *RuleEngine) CreateRule(ctx context.Context, rule domain.Rule) error {
 	rule.CreatedAt = time.Now()
 	rule.UpdatedAt = time.Now()
@@ -167,21 +507,149 @@ func (e *RuleEngine) CreateRule(ctx context.Context, rule domain.Rule) error {
 	if rule.ID == "" {
 		rule.ID = fmt.Sprintf("rule-%d", time.Now().UnixNano())
 	}
+	e.attribute(ctx, &rule)
 	
+	defer e.invalidateRules()
 	return e.ruleRepository.SaveRule(ctx, rule)
 }
 
 // UpdateRule updates an existing rule
 func (e *RuleEngine) UpdateRule(ctx context.Context, rule domain.Rule) error {
 	rule.UpdatedAt = time.Now()
+	e.attribute(ctx, &rule)
+	defer e.invalidateRules()
 	return e.ruleRepository.UpdateRule(ctx, rule)
 }
 
+// attribute records the principal of ctx as the creator and last modifier
+// of rule, as WithPrincipal describes
+func (e *RuleEngine) attribute(ctx context.Context, rule *domain.Rule) {
+	if e.principal == nil {
+		return
+	}
+	
+	rule.LastModifiedBy = e.principal(ctx)
+	if existing, err := e.ruleRepository.GetRuleByID(ctx, rule.ID); err == nil {
+		rule.CreatedBy = existing.CreatedBy
+	} else if rule.LastModifiedBy != "" {
+		rule.CreatedBy = rule.LastModifiedBy
+	}
+}
+
 // DeleteRule deletes a rule
 func (e *RuleEngine) DeleteRule(ctx context.Context, ruleID string) error {
+	defer e.invalidateRules()
 	return e.ruleRepository.DeleteRule(ctx, ruleID)
 }
 
+// SetRuleEnabled enables or disables a rule on behalf of modifiedBy,
+// returning it as updated
+func (e *RuleEngine) SetRuleEnabled(ctx context.Context, ruleID string, enabled bool, modifiedBy string) (*domain.Rule, error) {
+	rule, err := e.ruleRepository.GetRuleByID(ctx, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	
+	rule.Enabled = enabled
+	rule.UpdatedAt = time.Now()
+	rule.LastModifiedBy = modifiedBy
+	defer e.invalidateRules()
+	if err := e.ruleRepository.UpdateRule(ctx, *rule); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// ListRules returns the rules matching filter, enabled or not, ordered by
+// ID, and whether more rules follow the last one returned
+func (e *RuleEngine) ListRules(ctx context.Context, filter RuleFilter) ([]domain.Rule, bool, error) {
+	rules, err := e.ruleRepository.ListRules(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list rules: %w", err)
+	}
+	
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	
+	matching := make([]domain.Rule, 0, len(rules))
+	for _, rule := range rules {
+		if filter.After != "" && rule.ID <= filter.After {
+			continue
+		}
+		if filter.Type != "" && rule.Type != filter.Type {
+			continue
+		}
+		if filter.Enabled != nil && rule.Enabled != *filter.Enabled {
+			continue
+		}
+		if len(filter.Tags) > 0 && !hasAnyTag(rule.Tags, filter.Tags) {
+			continue
+		}
+		if filter.Limit > 0 && len(matching) == filter.Limit {
+			return matching, true, nil
+		}
+		matching = append(matching, rule)
+	}
+	
+	return matching, false, nil
+}
+
+// UpdateRulesByTags enables, disables or deletes every rule with any of
+// tags on behalf of modifiedBy, returning the IDs of the rules it changed.
+// Rules that are already enabled or disabled are left as they are.
+func (e *RuleEngine) UpdateRulesByTags(ctx context.Context, tags []string, action, modifiedBy string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("at least one tag is required")
+	}
+	switch action {
+	case BulkEnable, BulkDisable, BulkDelete:
+	default:
+		return nil, fmt.Errorf("invalid bulk action '%s'", action)
+	}
+	
+	rules, _, err := e.ListRules(ctx, RuleFilter{Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	
+	defer e.invalidateRules()
+	now := time.Now()
+	changed := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if action == BulkDelete {
+			err = e.ruleRepository.DeleteRule(ctx, rule.ID)
+		} else {
+			enabled := action == BulkEnable
+			if rule.Enabled == enabled {
+				continue
+			}
+			rule.Enabled = enabled
+			rule.UpdatedAt = now
+			rule.LastModifiedBy = modifiedBy
+			err = e.ruleRepository.UpdateRule(ctx, rule)
+		}
+		if err != nil {
+			return changed, fmt.Errorf("failed to %s rule %s: %w", action, rule.ID, err)
+		}
+		changed = append(changed, rule.ID)
+	}
+	
+	return changed, nil
+}
+
+// hasAnyTag reports whether any of tags is among ruleTags
+func hasAnyTag(ruleTags, tags []string) bool {
+	for _, ruleTag := range ruleTags {
+		for _, tag := range tags {
+			if ruleTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // GetRule retrieves a rule by ID
 func (e *RuleEngine) GetRule(ctx context.Context, ruleID string) (*domain.Rule, error) {
 	return e.ruleRepository.GetRuleByID(ctx, ruleID)
@@ -193,8 +661,8 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 		return fmt.Errorf("rule name is required")
 	}
 	
-	if len(rule.Conditions) == 0 {
-		return fmt.Errorf("rule must have at least one condition")
+	if len(rule.Conditions) == 0 && rule.Expression == "" {
+		return fmt.Errorf("rule must have at least one condition or an expression")
 	}
 	
 	if len(rule.Actions) == 0 {
@@ -203,7 +671,7 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 	
 	// Validate conditions
 	for i, condition := range rule.Conditions {
-		if condition.Field == "" {
+		if condition.Field == "" && condition.Operator != "script" {
 			return fmt.Errorf("condition %d: field is required", i)
 		}
 		
@@ -215,6 +683,7 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 		validOperators := []string{
 			"equals", "not_equals", "contains", "starts_with", "ends_with",
 			"in", "not_in", "greater_than", "less_than", "greater_equal", "less_equal",
+			"regex", "cidr", "exists", "not_exists", "path_prefix", "script",
 		}
 		
 		validOp := false
@@ -230,6 +699,11 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 		}
 	}
 	
+	// Reject patterns and CIDRs that would never match
+	if _, err := domain.CompileRule(rule); err != nil {
+		return err
+	}
+	
 	// Validate actions
 	for i, action := range rule.Actions {
 		if action.Type == "" {
@@ -238,7 +712,7 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 		
 		// Validate action type
 		validActions := []string{
-			"allow", "deny", "block", "rate_limit", "throttle", "log", "alert",
+			"allow", "deny", "block", "rate_limit", "throttle", "challenge", "log", "alert",
 		}
 		
 		validAction := false
@@ -252,6 +726,17 @@ func (e *RuleEngine) ValidateRule(rule domain.Rule) error {
 		if !validAction {
 			return fmt.Errorf("action %d: invalid action type '%s'", i, action.Type)
 		}
+		
+		if action.Type == "throttle" {
+			if _, err := action.ThrottleDelay(); err != nil {
+				return fmt.Errorf("action %d: %w", i, err)
+			}
+		}
+		if action.Type == "challenge" {
+			if _, err := action.ChallengeKind(); err != nil {
+				return fmt.Errorf("action %d: %w", i, err)
+			}
+		}
 	}
 	
 	return nil
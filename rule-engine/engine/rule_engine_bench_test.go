@@ -0,0 +1,78 @@
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+	"github.com/NickChunglolz/rule-engine/engine"
+	"github.com/NickChunglolz/rule-engine/infrastructure"
+)
+
+// BenchmarkEvaluateRules measures rule evaluation of one request against
+// 10, 100 and 1000 rules, indexed by client, network and path, with every
+// fourth rule matched by user agent and so evaluated for every request
+func BenchmarkEvaluateRules(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			benchmarkEvaluateRules(b, n)
+		})
+	}
+}
+
+// benchmarkEvaluateRules measures rule evaluation against n rules
+func benchmarkEvaluateRules(b *testing.B, n int) {
+	ruleEngine := engine.NewRuleEngine(infrastructure.NewInMemoryRuleRepository(), infrastructure.NewSimpleEventPublisher())
+	ctx := context.Background()
+
+	for i := 0; i < n; i++ {
+		var condition domain.RuleCondition
+		switch i % 4 {
+		case 0:
+			condition = domain.RuleCondition{Field: "client_id", Operator: "equals", Value: fmt.Sprintf("client-%d", i)}
+		case 1:
+			condition = domain.RuleCondition{Field: "ip_address", Operator: "cidr", Value: fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)}
+		case 2:
+			condition = domain.RuleCondition{Field: "path", Operator: "starts_with", Value: fmt.Sprintf("/api/v%d/", i)}
+		case 3:
+			condition = domain.RuleCondition{Field: "user_agent", Operator: "contains", Value: fmt.Sprintf("bot-%d", i)}
+		}
+
+		rule := domain.Rule{
+			ID:         fmt.Sprintf("rule-%d", i),
+			Name:       fmt.Sprintf("Benchmark rule %d", i),
+			Type:       domain.RateLimitRule,
+			Priority:   i,
+			Enabled:    true,
+			Conditions: []domain.RuleCondition{condition},
+			Actions: []domain.RuleAction{{
+				Type:       "rate_limit",
+				Parameters: map[string]interface{}{"limit": 100, "window": "1m"},
+			}},
+		}
+		if err := ruleEngine.CreateRule(ctx, rule); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	evalCtx := domain.RuleEvaluationContext{
+		ClientID:  "client-0",
+		Resource:  "bench",
+		IPAddress: "10.0.1.7",
+		UserAgent: "Mozilla/5.0",
+		Timestamp: time.Now(),
+		Method:    "GET",
+		Path:      "/api/v2/orders",
+		Metadata:  map[string]string{},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ruleEngine.EvaluateRules(ctx, evalCtx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
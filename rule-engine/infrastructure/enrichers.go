@@ -0,0 +1,292 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+)
+
+// GeoIPEnricher adds the country and autonomous system of a request's IP
+// address, as the fields geo.country and geo.asn, from a table of networks
+type GeoIPEnricher struct {
+	networks map[int]map[netip.Prefix]geoLocation
+	lengths  []int // Prefix lengths present, longest first
+}
+
+// geoLocation is what the table knows about a network
+type geoLocation struct {
+	country string
+	asn     float64 // A float64, as numbers in rule conditions are
+}
+
+// NewGeoIPEnricher reads a table of networks from CSV records of the form
+// network,country[,asn], e.g. "203.0.113.0/24,AU,64500". Blank lines, lines
+// starting with # and a header line are skipped.
+func NewGeoIPEnricher(r io.Reader) (*GeoIPEnricher, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	enricher := &GeoIPEnricher{networks: make(map[int]map[netip.Prefix]geoLocation)}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("geoip: %w", err)
+		}
+
+		prefix, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			if line == 1 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("geoip: line %d: invalid network %q", line, record[0])
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("geoip: line %d: missing country", line)
+		}
+
+		location := geoLocation{country: strings.ToUpper(record[1])}
+		if len(record) > 2 && record[2] != "" {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(record[2]), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("geoip: line %d: invalid asn %q", line, record[2])
+			}
+			location.asn = float64(asn)
+		}
+
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+		networks, ok := enricher.networks[prefix.Bits()]
+		if !ok {
+			networks = make(map[netip.Prefix]geoLocation)
+			enricher.networks[prefix.Bits()] = networks
+			enricher.lengths = append(enricher.lengths, prefix.Bits())
+		}
+		networks[prefix] = location
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(enricher.lengths)))
+	return enricher, nil
+}
+
+// LoadGeoIPEnricher reads the table of networks from the CSV file at path
+func LoadGeoIPEnricher(path string) (*GeoIPEnricher, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+	defer file.Close()
+	return NewGeoIPEnricher(file)
+}
+
+// Name returns the name of the enricher
+func (e *GeoIPEnricher) Name() string {
+	return "geoip"
+}
+
+// Enrich looks up the most specific network containing the request's IP
+// address, adding nothing when there is none
+func (e *GeoIPEnricher) Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error) {
+	addr, err := netip.ParseAddr(evalCtx.IPAddress)
+	if err != nil {
+		return nil, nil
+	}
+	addr = addr.Unmap()
+
+	for _, bits := range e.lengths {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue // An IPv6 length for an IPv4 address
+		}
+		location, ok := e.networks[bits][prefix]
+		if !ok {
+			continue
+		}
+
+		fields := map[string]interface{}{"geo.country": location.country}
+		if location.asn != 0 {
+			fields["geo.asn"] = location.asn
+		}
+		return fields, nil
+	}
+	return nil, nil
+}
+
+// fingerprintHeaders are the request headers, besides the user agent, that
+// tell devices apart
+var fingerprintHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+}
+
+// DeviceEnricher fingerprints the device a request comes from by its user
+// agent and client hint headers, adding device.fingerprint, a hash stable
+// across requests of one browser, and device.type, one of bot, mobile,
+// desktop or unknown
+type DeviceEnricher struct{}
+
+// NewDeviceEnricher creates a device fingerprint enricher
+func NewDeviceEnricher() *DeviceEnricher {
+	return &DeviceEnricher{}
+}
+
+// Name returns the name of the enricher
+func (e *DeviceEnricher) Name() string {
+	return "device"
+}
+
+// Enrich fingerprints the request's device
+func (e *DeviceEnricher) Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error) {
+	hash := sha256.New()
+	io.WriteString(hash, evalCtx.UserAgent)
+	for _, header := range fingerprintHeaders {
+		io.WriteString(hash, "\n"+evalCtx.Headers[header])
+	}
+
+	return map[string]interface{}{
+		"device.fingerprint": hex.EncodeToString(hash.Sum(nil)[:8]),
+		"device.type":        deviceType(evalCtx),
+	}, nil
+}
+
+// deviceType classifies the device a request comes from
+func deviceType(evalCtx domain.RuleEvaluationContext) string {
+	ua := ParseUserAgent(evalCtx.UserAgent)
+	switch {
+	case evalCtx.UserAgent == "":
+		return "unknown"
+	case ua.Class != UAClassBrowser && ua.Class != UAClassUnknown:
+		return "bot"
+	case evalCtx.Headers["Sec-Ch-Ua-Mobile"] == "?1", ua.Mobile:
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+// HTTPLookupEnricher asks an HTTP service about each request, such as a
+// user reputation service or the store of internal account flags. It posts
+// the request's client, resource, IP address and user agent as JSON, and
+// adds every field of the JSON object in the response prefixed with its
+// name, so {"score": 12} from an enricher named reputation becomes
+// reputation.score. Nested objects are flattened the same way, and a 404
+// response adds nothing.
+type HTTPLookupEnricher struct {
+	name       string
+	url        string
+	httpClient *http.Client
+}
+
+// httpLookupRequest is the body posted to the lookup service
+type httpLookupRequest struct {
+	ClientID  string `json:"client_id"`
+	Resource  string `json:"resource"`
+	IPAddress string `json:"ip_address"`
+	UserAgent string `json:"user_agent"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+// NewHTTPLookupEnricher creates an enricher named name asking the service
+// at url. Requests are bounded by the enrichment chain's timeout, so
+// httpClient needs none of its own.
+func NewHTTPLookupEnricher(name, url string, httpClient *http.Client) *HTTPLookupEnricher {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &HTTPLookupEnricher{
+		name:       name,
+		url:        url,
+		httpClient: httpClient,
+	}
+}
+
+// Name returns the name of the enricher
+func (e *HTTPLookupEnricher) Name() string {
+	return e.name
+}
+
+// Enrich asks the service about the request
+func (e *HTTPLookupEnricher) Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error) {
+	body, err := json.Marshal(httpLookupRequest{
+		ClientID:  evalCtx.ClientID,
+		Resource:  evalCtx.Resource,
+		IPAddress: evalCtx.IPAddress,
+		UserAgent: evalCtx.UserAgent,
+		Method:    evalCtx.Method,
+		Path:      evalCtx.Path,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", e.url, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decode response of %s: %w", e.url, err)
+	}
+	if result == nil {
+		return nil, errors.New("response is not a JSON object")
+	}
+
+	fields := make(map[string]interface{}, len(result))
+	flatten(e.name, result, fields)
+	return fields, nil
+}
+
+// flatten adds the values of object to fields under prefix, joining the
+// keys of nested objects with dots
+func flatten(prefix string, object map[string]interface{}, fields map[string]interface{}) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flatten(prefix+"."+key, nested, fields)
+			continue
+		}
+		fields[prefix+"."+key] = value
+	}
+}
@@ -0,0 +1,155 @@
+package infrastructure
+
+import (
+	"context"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+)
+
+// InMemoryRuleStatsStore implements StatsCollector interface for testing/development
+type InMemoryRuleStatsStore struct {
+	stats map[string]*ruleStatsEntry
+	seed  maphash.Seed
+	mutex sync.RWMutex
+}
+
+// ruleStatsEntry holds the counters of one rule
+type ruleStatsEntry struct {
+	stats   domain.RuleStats
+	clients *hyperLogLog
+}
+
+// NewInMemoryRuleStatsStore creates a new in-memory rule stats store
+func NewInMemoryRuleStatsStore() *InMemoryRuleStatsStore {
+	return &InMemoryRuleStatsStore{
+		stats: make(map[string]*ruleStatsEntry),
+		seed:  maphash.MakeSeed(),
+	}
+}
+
+// RecordEvaluation records one evaluation of a rule
+func (s *InMemoryRuleStatsStore) RecordEvaluation(ctx context.Context, ruleID, clientID string, matched bool, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	entry := s.entry(ruleID)
+	entry.stats.Evaluations++
+	entry.stats.LastEvaluatedAt = at
+	if matched {
+		entry.stats.Matches++
+		entry.stats.LastMatchedAt = at
+		if clientID != "" {
+			entry.clients.add(maphash.String(s.seed, clientID))
+		}
+	}
+	
+	return nil
+}
+
+// RecordAction counts a log or alert action fired by a rule
+func (s *InMemoryRuleStatsStore) RecordAction(ctx context.Context, ruleID, actionType string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	
+	entry := s.entry(ruleID)
+	switch actionType {
+	case "log":
+		entry.stats.Logs++
+	case "alert":
+		entry.stats.Alerts++
+	}
+	
+	return nil
+}
+
+// GetRuleStats retrieves the statistics of a rule; rules never evaluated
+// report zero counts
+func (s *InMemoryRuleStatsStore) GetRuleStats(ctx context.Context, ruleID string) (*domain.RuleStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	
+	entry, exists := s.stats[ruleID]
+	if !exists {
+		return &domain.RuleStats{RuleID: ruleID}, nil
+	}
+	
+	stats := entry.stats
+	stats.MatchedClients = int64(math.Round(entry.clients.estimate()))
+	return &stats, nil
+}
+
+// entry returns the counters of a rule, creating them on first use. Callers
+// must hold the write lock
+func (s *InMemoryRuleStatsStore) entry(ruleID string) *ruleStatsEntry {
+	entry, exists := s.stats[ruleID]
+	if !exists {
+		entry = &ruleStatsEntry{
+			stats:   domain.RuleStats{RuleID: ruleID},
+			clients: newHyperLogLog(),
+		}
+		s.stats[ruleID] = entry
+	}
+	return entry
+}
+
+// hyperLogLogPrecision gives 4096 one-byte registers per rule and a standard
+// error of about 1.6%
+const hyperLogLogPrecision = 12
+
+// hyperLogLog estimates the number of distinct hashed values
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hyperLogLogPrecision)}
+}
+
+// add records a 64-bit hash
+func (h *hyperLogLog) add(hash uint64) {
+	index := hash >> (64 - hyperLogLogPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hyperLogLogPrecision|1<<(hyperLogLogPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// estimate returns the approximate number of distinct values added
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	
+	sum := 0.0
+	zeros := 0
+	for _, register := range h.registers {
+		sum += 1 / float64(uint64(1)<<register)
+		if register == 0 {
+			zeros++
+		}
+	}
+	
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	
+	// Small cardinalities are more accurate with linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
@@ -4,14 +4,16 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/NickChunglolz/rule-engine/domain"
 )
 
 // InMemoryRuleRepository implements RuleRepository interface for testing/development
 type InMemoryRuleRepository struct {
-	rules map[string]domain.Rule
-	mutex sync.RWMutex
+	rules   map[string]domain.Rule
+	mutex   sync.RWMutex
+	version atomic.Uint64 // Incremented on every rule change
 }
 
 // NewInMemoryRuleRepository creates a new in-memory rule repository
@@ -23,6 +25,10 @@ func NewInMemoryRuleRepository() *InMemoryRuleRepository {
 
 // GetActiveRules retrieves all active rules
 func (r *InMemoryRuleRepository) GetActiveRules(ctx context.Context) ([]domain.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
@@ -36,8 +42,29 @@ func (r *InMemoryRuleRepository) GetActiveRules(ctx context.Context) ([]domain.R
 	return activeRules, nil
 }
 
+// ListRules retrieves all rules, enabled or not
+func (r *InMemoryRuleRepository) ListRules(ctx context.Context) ([]domain.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	
+	rules := make([]domain.Rule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		rules = append(rules, rule)
+	}
+	
+	return rules, nil
+}
+
 // GetRulesByType retrieves rules by type
 func (r *InMemoryRuleRepository) GetRulesByType(ctx context.Context, ruleType domain.RuleType) ([]domain.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
@@ -53,6 +80,10 @@ func (r *InMemoryRuleRepository) GetRulesByType(ctx context.Context, ruleType do
 
 // GetRulesByTags retrieves rules by tags
 func (r *InMemoryRuleRepository) GetRulesByTags(ctx context.Context, tags []string) ([]domain.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
@@ -68,52 +99,76 @@ func (r *InMemoryRuleRepository) GetRulesByTags(ctx context.Context, tags []stri
 
 // SaveRule saves a rule
 func (r *InMemoryRuleRepository) SaveRule(ctx context.Context, rule domain.Rule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
 	r.rules[rule.ID] = rule
+	r.version.Add(1)
 	return nil
 }
 
 // UpdateRule updates an existing rule
 func (r *InMemoryRuleRepository) UpdateRule(ctx context.Context, rule domain.Rule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
 	if _, exists := r.rules[rule.ID]; !exists {
-		return fmt.Errorf("rule not found: %s", rule.ID)
+		return fmt.Errorf("%w: %s", domain.ErrRuleNotFound, rule.ID)
 	}
 	
 	r.rules[rule.ID] = rule
+	r.version.Add(1)
 	return nil
 }
 
 // DeleteRule deletes a rule
 func (r *InMemoryRuleRepository) DeleteRule(ctx context.Context, ruleID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	
 	if _, exists := r.rules[ruleID]; !exists {
-		return fmt.Errorf("rule not found: %s", ruleID)
+		return fmt.Errorf("%w: %s", domain.ErrRuleNotFound, ruleID)
 	}
 	
 	delete(r.rules, ruleID)
+	r.version.Add(1)
 	return nil
 }
 
 // GetRuleByID retrieves a rule by ID
 func (r *InMemoryRuleRepository) GetRuleByID(ctx context.Context, ruleID string) (*domain.Rule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	
 	rule, exists := r.rules[ruleID]
 	if !exists {
-		return nil, fmt.Errorf("rule not found: %s", ruleID)
+		return nil, fmt.Errorf("%w: %s", domain.ErrRuleNotFound, ruleID)
 	}
 	
 	return &rule, nil
 }
 
+// RulesVersion returns a counter that changes whenever a rule changes
+func (r *InMemoryRuleRepository) RulesVersion() uint64 {
+	return r.version.Load()
+}
+
 // hasAnyTag checks if rule has any of the specified tags
 func (r *InMemoryRuleRepository) hasAnyTag(ruleTags, searchTags []string) bool {
 	for _, ruleTag := range ruleTags {
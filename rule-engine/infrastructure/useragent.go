@@ -0,0 +1,442 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NickChunglolz/rule-engine/domain"
+)
+
+// User agent classes, from most to least trusted
+const (
+	UAClassBrowser         = "browser"          // A browser driven by a person
+	UAClassVerifiedCrawler = "verified_crawler" // A known crawler from one of its own addresses
+	UAClassCrawler         = "crawler"          // A known crawler that could not be verified
+	UAClassSpoofedCrawler  = "spoofed_crawler"  // A known crawler's name from an address not its own
+	UAClassBot             = "bot"              // A self-declared bot not on the list of known crawlers
+	UAClassAutomation      = "automation"       // An HTTP library, command line tool or headless browser
+	UAClassUnknown         = "unknown"          // No user agent, or one not looking like any of the above
+)
+
+// UserAgent is what a User-Agent header tells about the client sending it
+type UserAgent struct {
+	Family   string `json:"family"`            // Browser, crawler or tool, e.g. Chrome, Googlebot or curl
+	Version  string `json:"version,omitempty"` // Major version of the family
+	OS       string `json:"os,omitempty"`
+	Mobile   bool   `json:"mobile"`
+	Crawler  string `json:"crawler,omitempty"` // The known crawler it claims to be
+	Headless bool   `json:"headless"`
+	Class    string `json:"class"`
+}
+
+// knownCrawler is a well-behaved crawler, recognized by a token of its user
+// agent. Crawlers whose operators document reverse DNS names for their
+// addresses can be verified.
+type knownCrawler struct {
+	name    string
+	token   string   // Lowercase
+	domains []string // Host name suffixes of its addresses
+}
+
+var (
+	googleDomains = []string{".googlebot.com", ".google.com", ".googleusercontent.com"}
+
+	knownCrawlers = []knownCrawler{
+		{name: "Googlebot", token: "googlebot", domains: googleDomains},
+		{name: "AdsBot-Google", token: "adsbot-google", domains: googleDomains},
+		{name: "Mediapartners-Google", token: "mediapartners-google", domains: googleDomains},
+		{name: "Bingbot", token: "bingbot", domains: []string{".search.msn.com"}},
+		{name: "Applebot", token: "applebot", domains: []string{".applebot.apple.com"}},
+		{name: "YandexBot", token: "yandexbot", domains: []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+		{name: "Baiduspider", token: "baiduspider", domains: []string{".baidu.com", ".baidu.jp"}},
+		{name: "Yahoo! Slurp", token: "yahoo! slurp", domains: []string{".crawl.yahoo.net"}},
+		{name: "PetalBot", token: "petalbot", domains: []string{".petalsearch.com"}},
+		{name: "DuckDuckBot", token: "duckduckbot"},
+		{name: "facebookexternalhit", token: "facebookexternalhit"},
+		{name: "Twitterbot", token: "twitterbot"},
+		{name: "LinkedInBot", token: "linkedinbot"},
+		{name: "Slackbot", token: "slackbot"},
+	}
+)
+
+// uaToken maps a lowercase user agent token to the family it identifies
+type uaToken struct {
+	token  string
+	family string
+}
+
+var (
+	// headlessTokens identify browsers run without a person in front of them
+	headlessTokens = []uaToken{
+		{"headlesschrome", "Chrome"},
+		{"phantomjs", "PhantomJS"},
+		{"slimerjs", "SlimerJS"},
+		{"puppeteer", "Puppeteer"},
+		{"playwright", "Playwright"},
+		{"selenium", "Selenium"},
+		{"webdriver", "WebDriver"},
+	}
+
+	// automationTokens identify HTTP libraries and command line tools
+	automationTokens = []uaToken{
+		{"curl/", "curl"},
+		{"wget/", "Wget"},
+		{"python-requests", "python-requests"},
+		{"python-urllib", "Python-urllib"},
+		{"aiohttp", "aiohttp"},
+		{"python-httpx", "httpx"},
+		{"go-http-client", "Go-http-client"},
+		{"okhttp", "OkHttp"},
+		{"apache-httpclient", "Apache-HttpClient"},
+		{"java/", "Java"},
+		{"libwww-perl", "libwww-perl"},
+		{"node-fetch", "node-fetch"},
+		{"axios/", "axios"},
+		{"postmanruntime", "PostmanRuntime"},
+		{"httpie", "HTTPie"},
+		{"scrapy", "Scrapy"},
+	}
+
+	// botTokens are what other crawlers and bots call themselves
+	botTokens = []string{"bot", "crawler", "crawl", "spider", "scraper", "slurp"}
+
+	// browserTokens identify browser families, most specific first, since
+	// most browsers also name the engines they are compatible with
+	browserTokens = []uaToken{
+		{"edg/", "Edge"},
+		{"edga/", "Edge"},
+		{"edgios/", "Edge"},
+		{"opr/", "Opera"},
+		{"samsungbrowser/", "Samsung Internet"},
+		{"firefox/", "Firefox"},
+		{"fxios/", "Firefox"},
+		{"crios/", "Chrome"},
+		{"chrome/", "Chrome"},
+		{"chromium/", "Chromium"},
+		{"version/", "Safari"},
+		{"msie ", "Internet Explorer"},
+		{"trident/", "Internet Explorer"},
+	}
+
+	// osTokens identify operating systems; iOS comes before macOS, as iOS
+	// user agents claim to be "like Mac OS X"
+	osTokens = []uaToken{
+		{"windows", "Windows"},
+		{"iphone", "iOS"},
+		{"ipad", "iOS"},
+		{"ipod", "iOS"},
+		{"android", "Android"},
+		{"cros", "ChromeOS"},
+		{"mac os x", "macOS"},
+		{"macintosh", "macOS"},
+		{"linux", "Linux"},
+	}
+)
+
+// ParseUserAgent tells the family, version and operating system of a user
+// agent, and classifies it as a browser, a known crawler, another bot,
+// automation or unknown. Known crawlers are classified as crawler: only
+// their addresses tell whether they are genuine, see CrawlerVerifier.
+func ParseUserAgent(userAgent string) UserAgent {
+	lower := strings.ToLower(strings.TrimSpace(userAgent))
+	if lower == "" {
+		return UserAgent{Class: UAClassUnknown}
+	}
+
+	ua := UserAgent{OS: matchToken(lower, osTokens)}
+	ua.Mobile = strings.Contains(lower, "mobile") || ua.OS == "iOS" || ua.OS == "Android"
+
+	for _, crawler := range knownCrawlers {
+		if strings.Contains(lower, crawler.token) {
+			ua.Family = crawler.name
+			ua.Version = versionAfter(lower, crawler.token+"/")
+			ua.Crawler = crawler.name
+			ua.Class = UAClassCrawler
+			return ua
+		}
+	}
+
+	for _, token := range headlessTokens {
+		if strings.Contains(lower, token.token) {
+			ua.Family = token.family
+			ua.Version = versionAfter(lower, token.token+"/")
+			ua.Headless = true
+			ua.Class = UAClassAutomation
+			return ua
+		}
+	}
+
+	for _, token := range automationTokens {
+		if strings.HasPrefix(lower, token.token) || strings.Contains(lower, " "+token.token) {
+			ua.Family = token.family
+			ua.Version = versionAfter(lower, strings.TrimSuffix(token.token, "/")+"/")
+			ua.Class = UAClassAutomation
+			return ua
+		}
+	}
+
+	for _, token := range botTokens {
+		if strings.Contains(lower, token) {
+			ua.Family = "Other"
+			ua.Class = UAClassBot
+			return ua
+		}
+	}
+
+	if !strings.HasPrefix(lower, "mozilla/") && !strings.HasPrefix(lower, "opera/") {
+		ua.Family = "Other"
+		ua.Class = UAClassUnknown
+		return ua
+	}
+
+	ua.Family = "Other"
+	for _, token := range browserTokens {
+		if strings.Contains(lower, token.token) {
+			ua.Family = token.family
+			ua.Version = versionAfter(lower, token.token)
+			break
+		}
+	}
+	ua.Class = UAClassBrowser
+	return ua
+}
+
+// matchToken returns the family of the first token in s
+func matchToken(s string, tokens []uaToken) string {
+	for _, token := range tokens {
+		if strings.Contains(s, token.token) {
+			return token.family
+		}
+	}
+	return ""
+}
+
+// versionAfter returns the major version following prefix in s
+func versionAfter(s, prefix string) string {
+	i := strings.Index(s, prefix)
+	if i < 0 {
+		return ""
+	}
+	rest := s[i+len(prefix):]
+	end := 0
+	for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+		end++
+	}
+	return rest[:end]
+}
+
+// maxCrawlerVerifications bounds the addresses a CrawlerVerifier remembers
+const maxCrawlerVerifications = 10000
+
+// CrawlerVerifier tells genuine crawlers from clients borrowing their
+// names by forward-confirmed reverse DNS, the way search engines ask sites
+// to: the address must resolve to a host name of the crawler's domains,
+// and that name back to the address. Lookups run in the background, so
+// requests never wait for DNS; a crawler stays unverified until its lookup
+// completes, and the outcome is remembered for ttl.
+type CrawlerVerifier struct {
+	ttl        time.Duration
+	timeout    time.Duration
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mutex   sync.Mutex
+	results map[crawlerAddress]crawlerVerification
+	pending map[crawlerAddress]bool
+}
+
+// crawlerAddress is a crawler seen from an address
+type crawlerAddress struct {
+	crawler string
+	ip      string
+}
+
+// crawlerVerification is the remembered outcome of a lookup
+type crawlerVerification struct {
+	genuine   bool
+	expiresAt time.Time
+}
+
+// NewCrawlerVerifier creates a verifier using the default resolver that
+// remembers outcomes for ttl
+func NewCrawlerVerifier(ttl time.Duration) *CrawlerVerifier {
+	return (&CrawlerVerifier{
+		ttl:     ttl,
+		timeout: 5 * time.Second,
+		results: make(map[crawlerAddress]crawlerVerification),
+		pending: make(map[crawlerAddress]bool),
+	}).WithResolver(net.DefaultResolver)
+}
+
+// WithResolver sets the resolver used for lookups
+func (v *CrawlerVerifier) WithResolver(resolver *net.Resolver) *CrawlerVerifier {
+	v.lookupAddr = resolver.LookupAddr
+	v.lookupHost = resolver.LookupHost
+	return v
+}
+
+// Classify returns the class of a parsed user agent seen from ip: known
+// crawlers become verified_crawler or spoofed_crawler once their address
+// is looked up, and stay crawler until then or when their operator
+// documents no host names
+func (v *CrawlerVerifier) Classify(ua UserAgent, ip string) string {
+	if ua.Class != UAClassCrawler || net.ParseIP(ip) == nil {
+		return ua.Class
+	}
+	var crawler knownCrawler
+	for _, known := range knownCrawlers {
+		if known.name == ua.Crawler {
+			crawler = known
+			break
+		}
+	}
+	if len(crawler.domains) == 0 {
+		return ua.Class
+	}
+
+	key := crawlerAddress{crawler: crawler.name, ip: ip}
+	now := time.Now()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if result, ok := v.results[key]; ok && now.Before(result.expiresAt) {
+		if result.genuine {
+			return UAClassVerifiedCrawler
+		}
+		return UAClassSpoofedCrawler
+	}
+	if !v.pending[key] {
+		v.pending[key] = true
+		go v.verify(key, crawler.domains)
+	}
+	return ua.Class
+}
+
+// verify looks up an address and remembers the outcome. Lookups that fail
+// for other reasons than the address or name not existing are forgotten,
+// so the next request retries them.
+func (v *CrawlerVerifier) verify(key crawlerAddress, domains []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	genuine, err := v.confirm(ctx, key.ip, domains)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.pending, key)
+	if err != nil {
+		return
+	}
+	if len(v.results) >= maxCrawlerVerifications {
+		v.results = make(map[crawlerAddress]crawlerVerification)
+	}
+	v.results[key] = crawlerVerification{genuine: genuine, expiresAt: time.Now().Add(v.ttl)}
+}
+
+// confirm reports whether ip reverse resolves to a name of domains that
+// resolves back to ip
+func (v *CrawlerVerifier) confirm(ctx context.Context, ip string, domains []string) (bool, error) {
+	names, err := v.lookupAddr(ctx, ip)
+	if err != nil {
+		return false, ignoreNotFound(err)
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !hasAnySuffix(name, domains) {
+			continue
+		}
+		addrs, err := v.lookupHost(ctx, name)
+		if err != nil {
+			if ignoreNotFound(err) != nil {
+				return false, err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ignoreNotFound returns nil for DNS errors saying a name does not exist,
+// which are an answer rather than a failure
+func ignoreNotFound(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
+
+// hasAnySuffix reports whether s ends with any of suffixes
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserAgentEnricher parses each request's user agent, adding ua_class, one
+// of the UAClass constants, and ua.family, ua.version, ua.os, ua.crawler
+// and ua.headless. Rules can then tell verified crawlers, to be throttled,
+// from unknown automation, to be blocked.
+type UserAgentEnricher struct {
+	verifier *CrawlerVerifier
+}
+
+// NewUserAgentEnricher creates a user agent enricher that does not verify
+// crawlers, classifying them all as crawler
+func NewUserAgentEnricher() *UserAgentEnricher {
+	return &UserAgentEnricher{}
+}
+
+// WithCrawlerVerification verifies known crawlers by their addresses
+func (e *UserAgentEnricher) WithCrawlerVerification(verifier *CrawlerVerifier) *UserAgentEnricher {
+	e.verifier = verifier
+	return e
+}
+
+// Name returns the name of the enricher
+func (e *UserAgentEnricher) Name() string {
+	return "useragent"
+}
+
+// Enrich classifies the request's user agent
+func (e *UserAgentEnricher) Enrich(ctx context.Context, evalCtx domain.RuleEvaluationContext) (map[string]interface{}, error) {
+	ua := ParseUserAgent(evalCtx.UserAgent)
+	if strings.Contains(strings.ToLower(evalCtx.Headers["Sec-Ch-Ua"]), "headlesschrome") && ua.Class == UAClassBrowser {
+		ua.Headless = true
+		ua.Class = UAClassAutomation
+	}
+	if e.verifier != nil {
+		ua.Class = e.verifier.Classify(ua, evalCtx.IPAddress)
+	}
+
+	fields := map[string]interface{}{
+		"ua_class":    ua.Class,
+		"ua.headless": ua.Headless,
+	}
+	for field, value := range map[string]string{
+		"ua.family":  ua.Family,
+		"ua.version": ua.Version,
+		"ua.os":      ua.OS,
+		"ua.crawler": ua.Crawler,
+	} {
+		if value != "" {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}